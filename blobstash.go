@@ -5,6 +5,7 @@ package main
 import (
 	"flag"
 	"log"
+	"os"
 
 	"a4.io/blobstash/pkg/config"
 	"a4.io/blobstash/pkg/server"
@@ -14,6 +15,7 @@ var (
 	scan                   bool
 	s3scan                 bool
 	s3restore              bool
+	remoteRestore          bool
 	docstoreIndexesReindex bool
 	check                  bool
 	loglevel               string
@@ -21,10 +23,34 @@ var (
 )
 
 func main() {
+	// Offline sub-commands (the server must not be running)
+	if len(os.Args) > 1 {
+		var cmd func([]string) error
+		switch os.Args[1] {
+		case "export":
+			cmd = exportCmd
+		case "import":
+			cmd = importCmd
+		case "restore":
+			cmd = restoreCmd
+		case "hash-migrate":
+			cmd = hashMigrateCmd
+		case "signing-keygen":
+			cmd = signingKeygenCmd
+		}
+		if cmd != nil {
+			if err := cmd(os.Args[2:]); err != nil {
+				log.Fatalf("%s failed: %v", os.Args[1], err)
+			}
+			return
+		}
+	}
+
 	flag.BoolVar(&check, "check", false, "Check the blobstore consistency.")
 	flag.BoolVar(&scan, "scan", false, "Trigger a BlobStore rescan.")
 	flag.BoolVar(&s3scan, "s3-scan", false, "Trigger a BlobStore rescan of the S3 backend.")
 	flag.BoolVar(&s3restore, "s3-restore", false, "Trigger a BlobStore restore of the S3 backend.")
+	flag.BoolVar(&remoteRestore, "remote-restore", false, "Trigger a BlobStore restore from the (encrypted) remote replication.")
 	flag.BoolVar(&docstoreIndexesReindex, "docstore-indexes-reindex", false, "Trigger a re-indexing of all document store sort indexes.")
 	flag.StringVar(&loglevel, "loglevel", "", "logging level (debug|info|warn|crit)")
 	flag.Parse()
@@ -41,6 +67,7 @@ func main() {
 	conf.ScanMode = scan
 	conf.S3ScanMode = s3scan
 	conf.S3RestoreMode = s3restore
+	conf.RemoteRestoreMode = remoteRestore
 	conf.DocstoreIndexesReindexMode = docstoreIndexesReindex
 	if loglevel != "" {
 		conf.LogLevel = loglevel
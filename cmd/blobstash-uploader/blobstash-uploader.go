@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
@@ -14,21 +15,67 @@ import (
 
 const ua = "blobstash-uploader v1"
 
+// Exit codes (stable, for scripting)
+const (
+	exitOK       = 0
+	exitError    = 1
+	exitUsage    = 2
+	exitNotFound = 3
+	exitAuth     = 4
+)
+
 func usage() {
 	fmt.Printf("Usage: %s [OPTIONS] [FSNAME] [DIRPATH]\n", os.Args[0])
 	flag.PrintDefaults()
+	fmt.Printf("\nExit codes: 0 success, 1 error, 2 usage, 3 path not found, 4 authentication failure\n")
 }
 
-var snapMessage string
+var (
+	snapMessage string
+	jsonOutput  bool
+	quiet       bool
+	chunking    string
+	chunkSize   int
+)
+
+// result is the output of the `-json` mode
+type result struct {
+	FS   string `json:"fs"`
+	Root string `json:"root"`
+	Rev  int64  `json:"rev"`
+}
+
+// fail outputs the error (as JSON in `-json` mode) and exits with the given code
+func fail(code int, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if jsonOutput {
+		json.NewEncoder(os.Stdout).Encode(map[string]interface{}{
+			"error":     msg,
+			"exit_code": code,
+		})
+	} else {
+		fmt.Fprintln(os.Stderr, msg)
+	}
+	os.Exit(code)
+}
 
 func main() {
 	flag.Usage = usage
 	flag.StringVar(&snapMessage, "message", "", "Optional snapshot message")
+	flag.BoolVar(&jsonOutput, "json", false, "Output the result as JSON")
+	flag.BoolVar(&quiet, "quiet", false, "Only output the root ref")
+	flag.StringVar(&chunking, "chunking", writer.DefaultChunking.Mode, "Chunking mode (\"cdc\" or \"fixed\")")
+	flag.IntVar(&chunkSize, "chunk-size", writer.DefaultChunking.Size, "Target chunk size in bytes (a power of 2 in \"cdc\" mode)")
 	flag.Parse()
 
 	if flag.NArg() != 2 {
 		usage()
-		os.Exit(2)
+		os.Exit(exitUsage)
+	}
+
+	chunkingOpts := &writer.Chunking{Mode: chunking, Size: chunkSize}
+	if err := chunkingOpts.Validate(); err != nil {
+		fail(exitUsage, "invalid chunking: %v", err)
 	}
 
 	host := os.Getenv("BLOBSTASH_API_HOST")
@@ -37,8 +84,7 @@ func main() {
 	dirPath := flag.Arg(1)
 
 	if host == "" {
-		fmt.Printf("no server configure, please set BLOBSTASH_API_{HOST|KEY}\n")
-		os.Exit(1)
+		fail(exitUsage, "no server configure, please set BLOBSTASH_API_{HOST|KEY}")
 	}
 
 	c := clientutil.NewClientUtil(host,
@@ -47,13 +93,11 @@ func main() {
 
 	authOk, err := c.CheckAuth()
 	if err != nil {
-		fmt.Printf("failed to check authentication: %v\n", err)
-		os.Exit(1)
+		fail(exitError, "failed to check authentication: %v", err)
 	}
 
 	if !authOk {
-		fmt.Printf("bad API key")
-		os.Exit(1)
+		fail(exitAuth, "bad API key")
 	}
 
 	bs := blobstore.New(c)
@@ -63,41 +107,47 @@ func main() {
 	finfo, err := os.Stat(dirPath)
 	switch {
 	case os.IsNotExist(err):
-		fmt.Printf("path \"%s\" does not exist\n", dirPath)
-		os.Exit(1)
+		fail(exitNotFound, "path \"%s\" does not exist", dirPath)
 	case err == nil:
 	default:
-		fmt.Printf("failed to stat file: %v\n", err)
-		os.Exit(1)
+		fail(exitError, "failed to stat file: %v", err)
 	}
 	if !finfo.IsDir() {
-		fmt.Printf("can only backup directories\n")
-		os.Exit(1)
+		fail(exitUsage, "can only backup directories")
 	}
 
 	var m *rnode.RawNode
 	up := writer.NewUploader(bs)
+	if err := up.SetChunking(chunkingOpts); err != nil {
+		fail(exitUsage, "invalid chunking: %v", err)
+	}
 
 	// Upload the tree
 	m, err = up.PutDir(dirPath)
 	if err != nil {
-		fmt.Printf("failed to upload: %v\n", err)
-		os.Exit(1)
+		fail(exitError, "failed to upload: %v", err)
 	}
 
 	// Make a snaphot/create a FS entry for the given tree
 	rev, err := ft.MakeSnapshot(m.Hash, fsName, snapMessage, ua)
 	if err != nil {
-		fmt.Printf("failed to create snapshot: %v\n", err)
-		os.Exit(1)
+		fail(exitError, "failed to create snapshot: %v", err)
 	}
 
 	// The GC step will actually save the tree, as we're working within a namespace
 	if err := ft.GC(fsName, fsName, rev); err != nil {
-		fmt.Printf("failed to perform GC: %v\n", err)
-		os.Exit(1)
+		fail(exitError, "failed to perform GC: %v", err)
 	}
 
-	fmt.Printf("Backup successful,\nroot=%s\nrev=%d\n", m.Hash, rev)
-	os.Exit(0)
+	switch {
+	case jsonOutput:
+		if err := json.NewEncoder(os.Stdout).Encode(&result{FS: fsName, Root: m.Hash, Rev: rev}); err != nil {
+			fail(exitError, "failed to output result: %v", err)
+		}
+	case quiet:
+		fmt.Println(m.Hash)
+	default:
+		fmt.Printf("Backup successful,\nroot=%s\nrev=%d\n", m.Hash, rev)
+	}
+	os.Exit(exitOK)
 }
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	log15 "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/backup"
+	"a4.io/blobstash/pkg/blobstore"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/hub"
+	"a4.io/blobstash/pkg/kvstore"
+	"a4.io/blobstash/pkg/meta"
+	"a4.io/blobstash/pkg/migration"
+)
+
+// openStores opens the root blobstore/kvstore (the server must not be running)
+func openStores(conf *config.Config) (*blobstore.BlobStore, *kvstore.KvStore, error) {
+	if err := conf.Init(); err != nil {
+		return nil, nil, err
+	}
+	logger := log15.New("logger", "blobstash")
+	logger.SetHandler(log15.LvlFilterHandler(conf.LogLvl(), log15.StreamHandler(os.Stderr, log15.LogfmtFormat())))
+	if err := migration.Run(logger.New("app", "migration"), conf.VarDir()); err != nil {
+		return nil, nil, fmt.Errorf("failed to migrate the data directory: %v", err)
+	}
+	chub := hub.New(logger.New("app", "hub"), true)
+	bs, err := blobstore.New(logger.New("app", "blobstore"), true, conf.VarDir(), conf, chub)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to initialize blobstore: %v", err)
+	}
+	metaHandler, err := meta.New(logger.New("app", "meta"), chub)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to initialize meta: %v", err)
+	}
+	kvs, err := kvstore.New(logger.New("app", "kvstore"), conf.VarDir(), bs, metaHandler)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to initialize kvstore: %v", err)
+	}
+	return bs, kvs, nil
+}
+
+func loadConfig(fs *flag.FlagSet) *config.Config {
+	conf := &config.Config{}
+	if fs.NArg() == 1 {
+		var err error
+		conf, err = config.New(fs.Arg(0))
+		if err != nil {
+			log.Fatalf("failed to load config at \"%v\": %v", fs.Arg(0), err)
+		}
+	}
+	if loglevel != "" {
+		conf.LogLevel = loglevel
+	}
+	return conf
+}
+
+// exportCmd implements `blobstash export --output stash.tar [config.yaml]`
+func exportCmd(args []string) (err error) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	output := fs.String("output", "", "Path of the tar archive (\"-\" for stdout).")
+	fs.StringVar(&loglevel, "loglevel", "", "logging level (debug|info|warn|crit)")
+	fs.Parse(args)
+	if *output == "" {
+		return fmt.Errorf("missing --output")
+	}
+	conf := loadConfig(fs)
+
+	bs, kvs, err := openStores(conf)
+	if err != nil {
+		return fmt.Errorf("failed to open stores: %v", err)
+	}
+	defer bs.Close()
+	defer kvs.Close()
+
+	var w io.Writer = os.Stdout
+	if *output != "-" {
+		f, ferr := os.Create(*output)
+		if ferr != nil {
+			return fmt.Errorf("failed to create archive: %v", ferr)
+		}
+		// A failed close means a truncated archive
+		defer func() {
+			if cerr := f.Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}()
+		w = f
+	}
+	manifest, err := backup.Export(context.Background(), w, bs, kvs)
+	if err != nil {
+		return fmt.Errorf("export failed: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "exported %d blobs, %d kv entries, %d FS\n", manifest.BlobsCount, manifest.KvsCount, manifest.FSCount)
+	return nil
+}
+
+// importCmd implements `blobstash import --input stash.tar [config.yaml]`
+func importCmd(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	input := fs.String("input", "", "Path of the tar archive (\"-\" for stdin).")
+	fs.StringVar(&loglevel, "loglevel", "", "logging level (debug|info|warn|crit)")
+	fs.Parse(args)
+	if *input == "" {
+		return fmt.Errorf("missing --input")
+	}
+	conf := loadConfig(fs)
+
+	bs, kvs, err := openStores(conf)
+	if err != nil {
+		return fmt.Errorf("failed to open stores: %v", err)
+	}
+	defer bs.Close()
+	defer kvs.Close()
+
+	var r io.Reader = os.Stdin
+	if *input != "-" {
+		f, err := os.Open(*input)
+		if err != nil {
+			return fmt.Errorf("failed to open archive: %v", err)
+		}
+		defer f.Close()
+		r = f
+	}
+	manifest, err := backup.Import(context.Background(), r, bs, kvs)
+	if err != nil {
+		return fmt.Errorf("import failed: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "imported %d blobs, %d kv entries, %d FS\n", manifest.BlobsCount, manifest.KvsCount, manifest.FSCount)
+	return nil
+}
+
+// restoreCmd implements `blobstash restore --export <name> [config.yaml]`, all the blobs from the incremental
+// export target are restored (the kv entries are rebuilt from the meta blobs)
+func restoreCmd(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	name := fs.String("export", "", "Name of the export target (as defined in the config).")
+	fs.StringVar(&loglevel, "loglevel", "", "logging level (debug|info|warn|crit)")
+	fs.Parse(args)
+	if *name == "" {
+		return fmt.Errorf("missing --export")
+	}
+	conf := loadConfig(fs)
+
+	bs, kvs, err := openStores(conf)
+	if err != nil {
+		return fmt.Errorf("failed to open stores: %v", err)
+	}
+	defer bs.Close()
+	defer kvs.Close()
+
+	var tconf *config.ExportTarget
+	for _, t := range conf.Exports {
+		if t.Name == *name {
+			tconf = t
+		}
+	}
+	if tconf == nil {
+		return fmt.Errorf("export %q not found in config", *name)
+	}
+	target, err := backup.NewTarget(tconf)
+	if err != nil {
+		return fmt.Errorf("failed to open target: %v", err)
+	}
+	manifest, err := backup.Restore(context.Background(), target, []byte(conf.SecretKey), bs)
+	if err != nil {
+		return fmt.Errorf("restore failed: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "restored %d blobs\n", manifest.BlobsCount)
+	return nil
+}
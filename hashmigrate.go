@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/hashutil"
+)
+
+// hashMigrateCmd implements `blobstash hash-migrate [--dry-run] [config.yaml]`, it switches the existing data to the
+// `hash_algorithm` set in the config: every blob is verified and counted per algorithm, and the kv meta blobs (only
+// referenced by the kv index) are re-created with the new algorithm. The other blobs are referenced by their hash (in
+// the trees, the documents...) so they keep it, they are still verified with their original algorithm.
+func hashMigrateCmd(args []string) error {
+	fs := flag.NewFlagSet("hash-migrate", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "Only report the blobs per algorithm.")
+	fs.StringVar(&loglevel, "loglevel", "", "logging level (debug|info|warn|crit)")
+	fs.Parse(args)
+	conf := loadConfig(fs)
+
+	bs, kvs, err := openStores(conf)
+	if err != nil {
+		return fmt.Errorf("failed to open stores: %v", err)
+	}
+	defer bs.Close()
+	defer kvs.Close()
+	target := conf.HashAlg()
+	hashutil.SetDefault(target)
+
+	ctx := context.Background()
+	refs, err := bs.Enumerate(ctx, &blob.Range{})
+	if err != nil {
+		return err
+	}
+	counts := map[hashutil.Algorithm]int{}
+	var corrupted int
+	for _, ref := range refs {
+		data, err := bs.Get(ctx, ref.Hash)
+		if err != nil {
+			return err
+		}
+		alg, ok := hashutil.Identify(ref.Hash, data)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "corrupted blob %s\n", ref.Hash)
+			corrupted++
+			continue
+		}
+		counts[alg]++
+	}
+	for _, alg := range hashutil.Algorithms {
+		fmt.Fprintf(os.Stderr, "%s: %d blobs\n", alg, counts[alg])
+	}
+	if corrupted > 0 {
+		return fmt.Errorf("%d corrupted blobs, run a scrub first", corrupted)
+	}
+	if *dryRun {
+		return nil
+	}
+
+	rewritten, err := kvs.RehashMeta(ctx, func(hash string) (bool, error) {
+		data, err := bs.Get(ctx, hash)
+		if err != nil {
+			return false, err
+		}
+		alg, _ := hashutil.Identify(hash, data)
+		return alg != target, nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to rehash the kv meta blobs: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "re-created %d kv meta blobs with %s\n", rewritten, target)
+	return nil
+}
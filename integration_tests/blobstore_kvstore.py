@@ -130,7 +130,7 @@ all_blobs = []
 
 cursor = ''
 while 1:
-    resp = c._get('/api/blobstore/blobs?limit=100&start='+cursor).json()
+    resp = c._get('/api/blobstore/blobs?limit=100&cursor='+cursor).json()
 
     if len(resp['refs']) == 0 or not resp['cursor']:
         break
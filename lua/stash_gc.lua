@@ -69,3 +69,41 @@ function mark_filetree_node (ref)
   mark(ref)
 end
 _G.mark_filetree_node = mark_filetree_node
+
+-- Walk a decoded document and call `cb` for each attachment (`{"_attachment": "<node ref>"}`) ref
+local function docstore_attachments (v, cb)
+  if type(v) ~= 'table' then
+    return
+  end
+  if type(v._attachment) == 'string' then
+    cb(v._attachment)
+    return
+  end
+  for _, cv in pairs(v) do
+    docstore_attachments(cv, cb)
+  end
+end
+
+local function docstore_doc (collection, id, version, mark_kv_fn, mark_node_fn)
+  local key = 'docstore:' .. collection .. ':' .. id
+  if kvstore.get_meta_blob(key, version) == nil then
+    return
+  end
+  mark_kv_fn(key, version)
+  local data, _, _ = kvstore.get(key, version)
+  -- the first byte is the doc flag (deleted docs have no data)
+  if #data > 1 then
+    docstore_attachments(msgpack.decode(data:sub(2)), mark_node_fn)
+  end
+end
+
+-- Setup the `mark_docstore_doc` (and `premark_docstore_doc`) GC helpers, marks the document version and its attachments
+function premark_docstore_doc (collection, id, version)
+  docstore_doc(collection, id, version, premark_kv, premark_filetree_node)
+end
+_G.premark_docstore_doc = premark_docstore_doc
+
+function mark_docstore_doc (collection, id, version)
+  docstore_doc(collection, id, version, mark_kv, mark_filetree_node)
+end
+_G.mark_docstore_doc = mark_docstore_doc
@@ -0,0 +1,210 @@
+/*
+Package admin implements the built-in admin web UI (served at `/admin/`) and the JSON admin APIs backing it.
+
+The UI is a single page (no external assets) using the JSON APIs, it covers the storage stats, the BlobsFile volumes
+utilization, a FS browser, a docstore collection viewer, the apps (with their latest logs), the replication status and
+the GC/scrub controls. Every page requires the admin permission.
+*/
+package admin // import "a4.io/blobstash/pkg/admin"
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/apps"
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/blobstore"
+	"a4.io/blobstash/pkg/filetree"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/perms"
+)
+
+// Admin serves the admin UI and APIs
+type Admin struct {
+	log       log.Logger
+	bs        *blobstore.BlobStore
+	ft        *filetree.FileTree
+	apps      *apps.Apps
+	lastSync  func() time.Time
+	startedAt time.Time
+}
+
+// New initializes the admin UI, lastSync returns the time of the last successful sync (may be nil)
+func New(logger log.Logger, bs *blobstore.BlobStore, ft *filetree.FileTree, a *apps.Apps, lastSync func() time.Time) *Admin {
+	return &Admin{
+		log:       logger,
+		bs:        bs,
+		ft:        ft,
+		apps:      a,
+		lastSync:  lastSync,
+		startedAt: time.Now(),
+	}
+}
+
+// canAdmin checks the admin permission (and writes the 403 response if not allowed)
+func canAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if !auth.Can(
+		w,
+		r,
+		perms.Action(perms.Admin, perms.Config),
+		perms.Resource(perms.Server, perms.Config),
+	) {
+		auth.Forbidden(w)
+		return false
+	}
+	return true
+}
+
+func (a *Admin) uiHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !canAdmin(w, r) {
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write([]byte(uiPage))
+	}
+}
+
+func (a *Admin) statsHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !canAdmin(w, r) {
+			return
+		}
+		stats, err := a.bs.DetailedStats()
+		if err != nil {
+			panic(err)
+		}
+		httputil.MarshalAndWrite(r, w, map[string]interface{}{
+			"started_at": a.startedAt.Format(time.RFC3339),
+			"uptime":     time.Since(a.startedAt).Round(time.Second).String(),
+			"stats":      stats,
+		})
+	}
+}
+
+func (a *Admin) volumesHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !canAdmin(w, r) {
+			return
+		}
+		volumes, err := a.bs.VolumesStats()
+		if err != nil {
+			panic(err)
+		}
+		httputil.MarshalAndWrite(r, w, map[string]interface{}{
+			"data": volumes,
+		})
+	}
+}
+
+func (a *Admin) fsHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !canAdmin(w, r) {
+			return
+		}
+		fss, err := a.ft.IterFS(r.Context(), "")
+		if err != nil {
+			panic(err)
+		}
+		httputil.MarshalAndWrite(r, w, map[string]interface{}{
+			"data": fss,
+		})
+	}
+}
+
+func (a *Admin) appsHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !canAdmin(w, r) {
+			return
+		}
+		httputil.MarshalAndWrite(r, w, map[string]interface{}{
+			"data": a.apps.Infos(),
+		})
+	}
+}
+
+func (a *Admin) appLogsHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !canAdmin(w, r) {
+			return
+		}
+		logs, ok := a.apps.Logs(mux.Vars(r)["name"])
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		httputil.MarshalAndWrite(r, w, map[string]interface{}{
+			"data": logs,
+		})
+	}
+}
+
+func (a *Admin) replicationHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !canAdmin(w, r) {
+			return
+		}
+		stats, err := a.bs.DetailedStats()
+		if err != nil {
+			panic(err)
+		}
+		out := map[string]interface{}{
+			"s3":                 stats.Replication,
+			"remote_replication": stats.Remote,
+			"sync":               nil,
+		}
+		if a.lastSync != nil {
+			if lastSync := a.lastSync(); !lastSync.IsZero() {
+				out["sync"] = map[string]interface{}{
+					"last_sync":     lastSync.Format(time.RFC3339),
+					"last_sync_age": time.Since(lastSync).Round(time.Second).String(),
+				}
+			}
+		}
+		httputil.MarshalAndWrite(r, w, out)
+	}
+}
+
+// Register registers the JSON APIs on r (mounted at `/api/admin`) and the UI on root
+func (a *Admin) Register(r *mux.Router, root *mux.Router, basicAuth func(http.Handler) http.Handler) {
+	r.Handle("/stats", basicAuth(http.HandlerFunc(a.statsHandler())))
+	r.Handle("/volumes", basicAuth(http.HandlerFunc(a.volumesHandler())))
+	r.Handle("/fs", basicAuth(http.HandlerFunc(a.fsHandler())))
+	r.Handle("/apps", basicAuth(http.HandlerFunc(a.appsHandler())))
+	r.Handle("/apps/{name}/logs", basicAuth(http.HandlerFunc(a.appLogsHandler())))
+	r.Handle("/replication", basicAuth(http.HandlerFunc(a.replicationHandler())))
+
+	root.Handle("/admin/", basicAuth(http.HandlerFunc(a.uiHandler())))
+}
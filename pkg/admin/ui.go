@@ -0,0 +1,191 @@
+package admin // import "a4.io/blobstash/pkg/admin"
+
+// The admin UI page (the pages are rendered client-side from the JSON APIs)
+const uiPage = `<!doctype html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>BlobStash admin</title>
+<style>
+body{font-family:sans-serif;margin:0;color:#222}
+header{background:#222;color:#eee;padding:.5em 1em}
+header a{color:#eee;margin-right:1em;text-decoration:none}header a.active{text-decoration:underline}
+main{max-width:70em;margin:1em auto;padding:0 1em}
+table{width:100%;border-collapse:collapse;margin-bottom:1em}td,th{text-align:left;padding:.2em .5em;border-bottom:1px solid #ddd;vertical-align:top}
+pre{background:#f5f5f5;padding:.5em;overflow:auto}
+.bar{background:#eee;width:10em;height:.8em}.bar div{background:#4a4;height:100%}
+.error{color:#b00}
+textarea{width:100%;height:8em;font-family:monospace}
+</style>
+</head>
+<body>
+<header>
+<strong>BlobStash</strong>&nbsp;
+<a href="#stats">Stats</a><a href="#volumes">Volumes</a><a href="#fs">FS</a><a href="#docstore">Docstore</a><a href="#apps">Apps</a><a href="#replication">Replication</a><a href="#maintenance">GC/Scrub</a>
+</header>
+<main id="main"></main>
+<script>
+"use strict";
+const main = document.getElementById("main");
+
+function esc(v) {
+  return String(v === undefined || v === null ? "" : v).replace(/[&<>"']/g, c => ({"&": "&amp;", "<": "&lt;", ">": "&gt;", '"': "&quot;", "'": "&#39;"}[c]));
+}
+
+async function api(path, opts) {
+  opts = Object.assign({credentials: "same-origin", headers: {"Accept": "application/json"}}, opts || {});
+  const resp = await fetch(path, opts);
+  if (!resp.ok) {
+    throw new Error((opts.method || "GET") + " " + path + ": " + resp.status + " " + (await resp.text()));
+  }
+  if (resp.status === 204 || resp.status === 202) {
+    return null;
+  }
+  return resp.json();
+}
+
+function table(headers, rows) {
+  return "<table><tr>" + headers.map(h => "<th>" + esc(h) + "</th>").join("") + "</tr>" +
+    rows.map(r => "<tr>" + r.map(c => "<td>" + c + "</td>").join("") + "</tr>").join("") + "</table>";
+}
+
+function kv(obj) {
+  return table(["Key", "Value"], Object.keys(obj || {}).map(k => [esc(k), typeof obj[k] === "object" ? "<pre>" + esc(JSON.stringify(obj[k], null, 2)) + "</pre>" : esc(obj[k])]));
+}
+
+function bar(ratio) {
+  return '<div class="bar"><div style="width:' + Math.round(ratio * 100) + '%"></div></div>' + Math.round(ratio * 100) + "%";
+}
+
+const pages = {
+  async stats() {
+    const res = await api("/api/admin/stats");
+    const s = res.stats;
+    return "<h2>Storage</h2>" + kv({
+      started_at: res.started_at, uptime: res.uptime, blobs_count: s.blobs_count, blobs_size: s.blobs_size_human,
+    }) + "<h3>Backends</h3>" + table(["Name", "Volumes", "Sealed", "Size"], s.backends.map(b => [esc(b.name), esc(b.volumes), esc(b.sealed_volumes), esc(b.size_human)])) +
+      "<h3>Compression</h3>" + kv(s.compression) + "<h3>Dedup</h3>" + kv(s.dedup) +
+      (s.read_cache ? "<h3>Read cache</h3>" + kv(s.read_cache) : "") +
+      "<h3>Namespaces</h3>" + table(["Name", "Blobs", "Size"], s.namespaces.map(n => [esc(n.name), esc(n.blobs_count), esc(n.blobs_size)]));
+  },
+
+  async volumes() {
+    const res = await api("/api/admin/volumes");
+    return "<h2>BlobsFile volumes</h2>" + table(["Volume", "Size", "Sealed", "Utilization"], res.data.map(v => [esc(v.name), esc(v.size_human), v.sealed ? "yes" : "no", bar(v.utilization)]));
+  },
+
+  async fs(args) {
+    if (!args.length) {
+      const res = await api("/api/admin/fs");
+      return "<h2>FS</h2>" + table(["Name", "Ref"], res.data.map(f => ['<a href="#fs/' + encodeURIComponent(f.name) + '">' + esc(f.name) + "</a>", esc(f.ref)]));
+    }
+    const name = decodeURIComponent(args[0]);
+    const path = args.slice(1).join("/");
+    const node = await api("/api/filetree/fs/fs/" + encodeURIComponent(name) + "/" + path);
+    let out = "<h2>" + esc(name) + ":/" + esc(decodeURIComponent(path)) + "</h2>";
+    if (node.type !== "dir") {
+      return out + kv({ref: node.ref, size: node.size, mtime: node.mtime, content_type: node.content_type}) +
+        (node.url ? '<a href="' + esc(node.url) + '">Download</a>' : "");
+    }
+    const base = "#fs/" + args[0] + "/" + (path ? path + "/" : "");
+    return out + table(["Name", "Type", "Size", "Modified"], (node.children || []).map(c => [
+      '<a href="' + esc(base + encodeURIComponent(c.name)) + '">' + esc(c.name) + "</a>", esc(c.type), esc(c.size), esc(c.mtime),
+    ]));
+  },
+
+  async docstore(args) {
+    if (!args.length) {
+      const res = await api("/api/docstore/");
+      return "<h2>Collections</h2>" + table(["Name"], res.collections.map(c => ['<a href="#docstore/' + encodeURIComponent(c) + '">' + esc(c) + "</a>"]));
+    }
+    const col = decodeURIComponent(args[0]);
+    const cursor = args[1] ? decodeURIComponent(args[1]) : "";
+    const res = await api("/api/docstore/" + encodeURIComponent(col) + "?limit=20&cursor=" + encodeURIComponent(cursor));
+    let out = "<h2>" + esc(col) + "</h2>" + (res.data || []).map(d => "<pre>" + esc(JSON.stringify(d, null, 2)) + "</pre>").join("");
+    if (res.pagination.has_more) {
+      out += '<a href="#docstore/' + args[0] + "/" + encodeURIComponent(res.pagination.cursor) + '">Next</a>';
+    }
+    return out;
+  },
+
+  async apps(args) {
+    if (!args.length) {
+      const res = await api("/api/admin/apps");
+      return "<h2>Apps</h2>" + table(["Name", "Domain", "Source", "Ready"], res.data.map(a => [
+        '<a href="#apps/' + encodeURIComponent(a.name) + '">' + esc(a.name) + "</a>", esc(a.domain), esc(a.remote || a.proxy || a.path), a.ready ? "yes" : "no",
+      ]));
+    }
+    const name = decodeURIComponent(args[0]);
+    const res = await api("/api/admin/apps/" + encodeURIComponent(name) + "/logs");
+    return "<h2>" + esc(name) + " logs</h2>" + table(["Time", "Level", "Message", "Context"], res.data.slice().reverse().map(l => [
+      esc(l.time), esc(l.level), esc(l.msg), esc(Object.keys(l.ctx || {}).map(k => k + "=" + l.ctx[k]).join(" ")),
+    ]));
+  },
+
+  async replication() {
+    const res = await api("/api/admin/replication");
+    return "<h2>S3 replication</h2>" + (res.s3 ? kv(res.s3) : "<p>disabled</p>") +
+      "<h2>Remote replication</h2>" + (res.remote_replication ? kv(res.remote_replication) : "<p>disabled</p>") +
+      "<h2>Sync</h2>" + (res.sync ? kv(res.sync) : "<p>no sync yet</p>");
+  },
+
+  async maintenance() {
+    let scrub;
+    try {
+      scrub = kv(await api("/api/admin/scrub")) + '<button onclick="startScrub()">Start scrub</button>';
+    } catch (e) {
+      scrub = '<p class="error">' + esc(e.message) + "</p>";
+    }
+    const ns = await api("/api/stash/");
+    return "<h2>Scrub</h2>" + scrub + "<h2>GC</h2>" +
+      "<p>Runs the GC script in the namespace (the marked blobs are merged back in the root namespace, and the namespace is destroyed).</p>" +
+      '<select id="gc-ns">' + (ns.data || []).map(n => "<option>" + esc(n) + "</option>").join("") + "</select>" +
+      '<textarea id="gc-script" placeholder="Lua GC script"></textarea><button onclick="runGC()">Run GC</button>';
+  },
+};
+
+async function startScrub() {
+  try {
+    await api("/api/admin/scrub", {method: "POST"});
+  } catch (e) {
+    alert(e.message);
+  }
+  render();
+}
+
+async function runGC() {
+  const ns = document.getElementById("gc-ns").value;
+  if (!ns || !confirm("Run the GC in namespace " + ns + "?")) {
+    return;
+  }
+  try {
+    await api("/api/stash/" + encodeURIComponent(ns) + "/_gc", {
+      method: "POST",
+      headers: {"Content-Type": "application/json"},
+      body: JSON.stringify({script: document.getElementById("gc-script").value}),
+    });
+  } catch (e) {
+    alert(e.message);
+  }
+  render();
+}
+
+async function render() {
+  const parts = (location.hash.slice(1) || "stats").split("/");
+  const page = pages[parts[0]] ? parts[0] : "stats";
+  document.querySelectorAll("header a").forEach(a => a.classList.toggle("active", a.getAttribute("href") === "#" + page));
+  main.innerHTML = "<p>Loading...</p>";
+  try {
+    main.innerHTML = await pages[page](parts.slice(1).filter(p => p !== ""));
+  } catch (e) {
+    main.innerHTML = '<p class="error">' + esc(e.message) + "</p>";
+  }
+}
+
+window.addEventListener("hashchange", render);
+render();
+</script>
+</body>
+</html>
+`
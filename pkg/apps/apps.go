@@ -2,6 +2,8 @@ package apps // import "a4.io/blobstash/pkg/apps"
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io/ioutil"
@@ -10,6 +12,7 @@ import (
 	"net/url"
 	"os"
 	"path"
+	"reflect"
 	"strings"
 	"sync"
 	"time"
@@ -32,19 +35,19 @@ import (
 	"a4.io/blobstash/pkg/filetree"
 	filetreeLua "a4.io/blobstash/pkg/filetree/lua"
 	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/httputil/bewit"
 	"a4.io/blobstash/pkg/hub"
 	kvLua "a4.io/blobstash/pkg/kvstore/lua"
+	"a4.io/blobstash/pkg/notify"
 	"a4.io/blobstash/pkg/session"
 	"a4.io/blobstash/pkg/stash/store"
+	"a4.io/blobstash/pkg/warmup"
 	"a4.io/blobstash/pkg/webauthn"
 	"a4.io/gluapp"
 	"a4.io/go/indieauth"
-	lru "github.com/hashicorp/golang-lru"
 	"github.com/robfig/cron"
 )
 
-// TODO(tsileo): at startup, scan all filetree FS and looks for app.yaml for registering
-
 // Apps holds the Apps manager data
 type Apps struct {
 	apps            map[string]*App
@@ -56,32 +59,201 @@ type Apps struct {
 	kvs             store.KvStore
 	wa              *webauthn.WebAuthn
 	hub             *hub.Hub
+	warmup          *warmup.Warmup
 	hostWhitelister func(...string)
 	log             log.Logger
 	cron            *cron.Cron
+
+	// Apps installed via the API (including the disabled ones)
+	installed map[string]*InstalledApp
+
+	// Pending re-loads of the apps served from a FS (app name => timer)
+	fsReloads map[string]*time.Timer
+
+	// Custom top-level routes (path => app name)
+	routes       map[string]string
+	root         *mux.Router
+	routesRoute  *mux.Route
+	domainsRoute *mux.Route
+
 	sync.Mutex
 }
 
 // Close cleanly shutdown thes AppsManager
 func (apps *Apps) Close() error {
+	apps.Lock()
+	defer apps.Unlock()
 	apps.cron.Stop()
+	for _, t := range apps.fsReloads {
+		t.Stop()
+	}
 	for _, app := range apps.apps {
-		if app.tmp != "" {
-			if err := os.RemoveAll(app.tmp); err != nil {
-				return err
-			}
+		if err := apps.cleanup(app); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cleanup removes the temp dir of a remote app
+func (apps *Apps) cleanup(app *App) error {
+	// Wait for any in-progress git clone
+	apps.warmup.Wait(app.warmupName())
+	if app.jobs != nil {
+		app.jobs.Stop()
+	}
+	if app.tmp != "" {
+		if err := os.RemoveAll(app.tmp); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
+// Apps returns a snapshot of the registered apps
 func (apps *Apps) Apps() map[string]*App {
-	return apps.apps
+	apps.Lock()
+	defer apps.Unlock()
+	out := make(map[string]*App, len(apps.apps))
+	for name, app := range apps.apps {
+		out[name] = app
+	}
+	return out
+}
+
+func (apps *Apps) getApp(name string) (*App, bool) {
+	apps.Lock()
+	defer apps.Unlock()
+	app, ok := apps.apps[name]
+	return app, ok
+}
+
+func (apps *Apps) getAppByDomain(host string) (*App, bool) {
+	apps.Lock()
+	defer apps.Unlock()
+	for _, app := range apps.apps {
+		if app.domain != "" && app.domain == host {
+			return app, true
+		}
+	}
+	return nil, false
+}
+
+// Reload updates the apps from the given config: new apps are started, removed apps are stopped, and the apps
+// whose config changed are re-created.
+func (apps *Apps) Reload(conf *config.Config) error {
+	apps.Lock()
+	defer apps.Unlock()
+
+	newApps := map[string]*App{}
+	for _, appConf := range conf.Apps {
+		// The apps served from a FS are re-created, as the tag may have moved
+		if current, ok := apps.apps[appConf.Name]; ok && current.fsRef == "" && reflect.DeepEqual(current.appConf, appConf) {
+			// The assets may have been updated
+			if current.remote == "" {
+				if err := current.buildAssets(); err != nil {
+					return fmt.Errorf("failed to reload app %q: %v", appConf.Name, err)
+				}
+			}
+			newApps[appConf.Name] = current
+			continue
+		}
+		app, err := apps.newApp(appConf, conf)
+		if err != nil {
+			return fmt.Errorf("failed to reload app %q: %v", appConf.Name, err)
+		}
+		apps.log.Info("app (re)loaded", "app", app.name)
+		newApps[app.name] = app
+	}
+	// Keep the apps installed via the API
+	for name := range apps.installed {
+		if _, ok := newApps[name]; ok {
+			return fmt.Errorf("failed to reload app %q: an app with the same name is installed", name)
+		}
+		if app, ok := apps.apps[name]; ok && app.installed {
+			newApps[name] = app
+		}
+	}
+
+	if err := apps.swap(newApps); err != nil {
+		return err
+	}
+	apps.config = conf
+	return nil
+}
+
+// swap replaces the running apps (the apps lock must be held), the apps not part of newApps are stopped
+func (apps *Apps) swap(newApps map[string]*App) error {
+	routes, err := apps.buildRoutes(newApps)
+	if err != nil {
+		// Cleanup the newly created apps
+		for name, app := range newApps {
+			if current, ok := apps.apps[name]; ok && current == app {
+				continue
+			}
+			go func(app *App) {
+				if err := apps.cleanup(app); err != nil {
+					apps.log.Error("failed to cleanup app", "app", app.name, "err", err)
+				}
+			}(app)
+		}
+		return err
+	}
+
+	// Stop the old apps, the in-flight requests still hold a reference to it
+	for name, app := range apps.apps {
+		if newApp, ok := newApps[name]; ok && newApp == app {
+			continue
+		}
+		apps.log.Info("app unloaded", "app", name)
+		go func(app *App) {
+			if err := apps.cleanup(app); err != nil {
+				apps.log.Error("failed to cleanup app", "app", app.name, "err", err)
+			}
+		}(app)
+	}
+
+	// Re-schedule all the apps
+	apps.cron.Stop()
+	apps.cron = cron.New()
+	for _, app := range newApps {
+		apps.schedule(app)
+	}
+	apps.cron.Start()
+
+	apps.apps = newApps
+	apps.routes = routes
+	apps.whitelistDomains()
+	return nil
+}
+
+// whitelistDomains allows the apps domains for the TLS certificates
+func (apps *Apps) whitelistDomains() {
+	if apps.hostWhitelister == nil {
+		return
+	}
+	for _, app := range apps.apps {
+		if app.domain != "" {
+			apps.hostWhitelister(app.domain)
+		}
+	}
+}
+
+func (apps *Apps) schedule(app *App) {
+	if app.scheduled == "" {
+		return
+	}
+	apps.cron.AddFunc(app.scheduled, func() {
+		app.log.Info("running the (scheduled) app")
+		// TODO(tsileo): add LuaHook instead of gluapp with
+		// app.config, app.log, what for input payload?
+	})
 }
 
 // App handle an app meta data
 type App struct {
 	rootConfig       *config.Config
+	appConf          *config.AppConfig
 	path, name       string
 	entrypoint       string
 	domain           string
@@ -95,26 +267,53 @@ type App struct {
 	proxyTarget *url.URL
 	proxy       *rhttputil.ReverseProxy
 
-	appCache *lru.Cache
+	appCache *appCache
+
+	// Client used for the outbound requests (restricted to the allowed domains)
+	httpClient *extra.HTTPClient
+
+	// Credential for signing/checking the links via the `crypto` Lua module
+	cred *bewit.Cred
+
+	// Fingerprinted assets (if enabled)
+	assets *assetIndex
 
 	docstore *docstore.DocStore
 	app      *gluapp.App
 	repo     *git.Repository
 	tree     *object.Tree
 	wa       *webauthn.WebAuthn
+	sess     *session.Session
 	tmp      string
 
-	log log.Logger
-	mu  sync.Mutex
+	// Installed via the API (and not defined in the config)
+	installed bool
+
+	// Name of the FS the app is served from (only set if it tracks the latest version of the FS)
+	fsRef string
+
+	// Parsed `app.yaml` (if any), and the jobs it defines
+	manifest *Manifest
+	luaConf  *gluapp.Config
+	jobs     *cron.Cron
+
+	log  log.Logger
+	logs *logBuffer
+	mu   sync.Mutex
 }
 
 func (apps *Apps) newApp(appConf *config.AppConfig, conf *config.Config) (*App, error) {
-	appCache, err := lru.New(512)
+	appCache, err := newAppCache(appConf.Name, appConf.Cache, apps.kvs)
+	if err != nil {
+		return nil, err
+	}
+	httpClient, err := extra.NewHTTPClient(appConf.Name, appConf.HTTP)
 	if err != nil {
 		return nil, err
 	}
 	app := &App{
 		rootConfig: conf,
+		appConf:    appConf,
 		docstore:   apps.docstore,
 		path:       appConf.Path,
 		name:       appConf.Name,
@@ -123,11 +322,21 @@ func (apps *Apps) newApp(appConf *config.AppConfig, conf *config.Config) (*App,
 		entrypoint: appConf.Entrypoint,
 		config:     appConf.Config,
 		appCache:   appCache,
+		httpClient: httpClient,
+		cred:       extra.AppCred(conf.SharingKey, appConf.Name),
 		scheduled:  appConf.Scheduled,
 		wa:         apps.wa,
+		sess:       apps.sess,
 		log:        apps.log.New("app", appConf.Name),
+		logs:       newLogBuffer(logBufferSize),
 		mu:         sync.Mutex{},
 	}
+	// Keep the latest logs for the admin UI
+	app.log.SetHandler(log.MultiHandler(apps.log.GetHandler(), app.logs))
+
+	if _, err := webauthn.ParseUserVerification(appConf.WebAuthnUserVerification); err != nil {
+		return nil, err
+	}
 
 	if appConf.Username != "" || appConf.Password != "" {
 		app.auth = httputil.BasicAuthFunc(appConf.Username, appConf.Password)
@@ -149,13 +358,41 @@ func (apps *Apps) newApp(appConf *config.AppConfig, conf *config.Config) (*App,
 		}()
 	}
 
+	if appConf.Proxy != "" {
+		// XXX(tsileo): only allow domain for proxy?
+		url, err := url.Parse(appConf.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse proxy URL target: %v", err)
+		}
+		app.proxy = rhttputil.NewSingleHostReverseProxy(url)
+		app.log.Info("proxy registered", "url", url)
+	}
+
+	// Remote apps needs a git clone, warm them up in the background to not delay the server startup
+	if app.remote != "" {
+		apps.warmup.Go(app.warmupName(), func() error {
+			return apps.warmUp(app)
+		})
+	} else {
+		if err := apps.warmUp(app); err != nil {
+			return nil, err
+		}
+	}
+
+	// TODO(tsileo): check that `path` exists, create it if it doesn't exist?
+	app.log.Debug("new app")
+	return app, nil
+}
+
+// warmUp clones the app repo (for remote apps) and setup the Lua app
+func (apps *Apps) warmUp(app *App) error {
 	// If it's a remote app, clone the repo in a temp dir
-	if appConf.Remote != "" {
+	if app.remote != "" {
 		// Format of the remote is `<repo_url>#<commit_hash>`
-		parts := strings.Split(appConf.Remote, "#")
+		parts := strings.Split(app.remote, "#")
 		dir, err := ioutil.TempDir("", fmt.Sprintf("blobstash-app-%s-", app.name))
 		if err != nil {
-			return nil, err
+			return err
 		}
 
 		// the temp dir will be removed at shutdown
@@ -166,13 +403,13 @@ func (apps *Apps) newApp(appConf *config.AppConfig, conf *config.Config) (*App,
 			URL: parts[0],
 		})
 		if err != nil {
-			return nil, err
+			return err
 		}
 
 		// Checkout the pinned hash
 		wt, err := r.Worktree()
 		if err != nil {
-			return nil, err
+			return err
 		}
 		app.repo = r
 		coOpts := &git.CheckoutOptions{}
@@ -180,30 +417,42 @@ func (apps *Apps) newApp(appConf *config.AppConfig, conf *config.Config) (*App,
 			coOpts.Branch = plumbing.ReferenceName("refs/tags/" + parts[1])
 		}
 		if err := wt.Checkout(coOpts); err != nil {
-			return nil, err
+			return err
 		}
 		app.path = app.tmp
 	}
 
-	if appConf.Proxy != "" {
-		// XXX(tsileo): only allow domain for proxy?
-		url, err := url.Parse(appConf.Proxy)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse proxy URL target: %v", err)
+	// Checkout the FS if the app is served from a filetree FS
+	if isFSPath(app.path) {
+		ref := strings.TrimPrefix(app.path, fsPathPrefix)
+		if !strings.Contains(ref, "@") {
+			app.fsRef = ref
+		}
+		dir, err := apps.checkoutFS(context.TODO(), ref, app.name)
+		switch {
+		case err == nil:
+		case app.fsRef != "" && errors.Is(err, filetree.ErrFSNotFound):
+			// The app will be loaded once the FS is created
+			app.log.Warn("app FS not found", "fs", ref)
+			app.path = ""
+			return nil
+		default:
+			return err
+		}
+		// the temp dir will be removed when the app is unloaded
+		app.tmp = dir
+		app.path = dir
+	}
+
+	if app.path != "" {
+		if err := app.loadManifest(); err != nil {
+			return err
 		}
-		app.proxy = rhttputil.NewSingleHostReverseProxy(url)
-		app.log.Info("proxy registered", "url", url)
 	}
 
+	// Scheduled apps don't serve HTTP requests
 	if app.scheduled != "" {
-		apps.cron.AddFunc(app.scheduled, func() {
-			app.log.Info("running the (scheduled) app")
-			// TODO(tsileo): add LuaHook instead of gluapp with
-			// app.config, app.log, what for input payload?
-		})
-		// Return now
-		app.log.Debug("new app")
-		return app, nil
+		return nil
 	}
 
 	// Fetch BlobStash root URL (not the app URL)
@@ -250,10 +499,13 @@ func (apps *Apps) newApp(appConf *config.AppConfig, conf *config.Config) (*App,
 
 	// Setup the gluapp app
 	if app.path != "" {
-		var err error
-		app.app, err = gluapp.NewApp(&gluapp.Config{
+		if err := app.buildAssets(); err != nil {
+			return err
+		}
+		app.luaConf = &gluapp.Config{
 			Path:       app.path,
 			Entrypoint: app.entrypoint,
+			Client:     app.httpClient.Client(),
 			TemplateFuncMap: template.FuncMap{
 				"url_for": func(p string) string {
 					u, err := url.Parse(baseURL)
@@ -263,6 +515,10 @@ func (apps *Apps) newApp(appConf *config.AppConfig, conf *config.Config) (*App,
 					u.Path = path.Join(u.Path, p)
 					return u.String()
 				},
+				"url_for_asset": func(p string) string {
+					return app.urlForAsset(baseURL, p)
+				},
+				"csrf_field": session.CSRFField,
 				"url_for_js": func(p string) string {
 					u, err := url.Parse(bsurl)
 					if err != nil {
@@ -274,9 +530,11 @@ func (apps *Apps) newApp(appConf *config.AppConfig, conf *config.Config) (*App,
 			},
 			SetupState: func(L *lua.LState, w http.ResponseWriter, r *http.Request) error {
 				// Setup the Webauthn module
-				apps.wa.SetupLua(L, baseURL, w, r)
+				apps.wa.SetupLua(L, baseURL, app.appConf.WebAuthnUserVerification, w, r)
+				// Setup the flash messages/CSRF helpers
+				apps.sess.SetupLua(L, w, r)
 				// Setup the in-mem cache
-				cache := app.buildCache(L)
+				cache := app.appCache.buildTable(L)
 				// Now that we have the base URL, we can export a new `url_for` helper
 				L.SetGlobal("url_for", L.NewFunction(func(L *lua.LState) int {
 					u, err := url.Parse(baseURL)
@@ -288,6 +546,11 @@ func (apps *Apps) newApp(appConf *config.AppConfig, conf *config.Config) (*App,
 					return 1
 				}))
 
+				L.SetGlobal("url_for_asset", L.NewFunction(func(L *lua.LState) int {
+					L.Push(lua.LString(app.urlForAsset(baseURL, L.ToString(1))))
+					return 1
+				}))
+
 				// Set the "app-specific" global variable
 				// Add some config in the `blobstash` global var
 				confTable := L.NewTable()
@@ -298,53 +561,50 @@ func (apps *Apps) newApp(appConf *config.AppConfig, conf *config.Config) (*App,
 				L.SetGlobal("blobstash", confTable)
 
 				docstore.SetLuaGlobals(L)
-				blobstoreLua.Setup(context.TODO(), L, apps.bs)
-				filetreeLua.Setup(L, apps.ft, apps.bs, apps.kvs)
-				docstoreLua.Setup(L, apps.docstore)
-				kvLua.Setup(L, apps.kvs, context.TODO())
+				var streamer *blobstoreLua.Streamer
+				if sw, ok := w.(*streamWriter); ok {
+					streamer = blobstoreLua.NewStreamer(apps.bs)
+					sw.streamer = streamer
+				}
+				// Only setup the modules granted to the app
+				if app.can("blobstore") {
+					blobstoreLua.SetupWithStreamer(context.TODO(), L, apps.bs, streamer)
+				}
+				if app.can("filetree") {
+					filetreeLua.Setup(L, apps.ft, apps.bs, apps.kvs)
+				}
+				if app.can("docstore") {
+					docstoreLua.Setup(L, apps.docstore)
+				}
+				if app.can("kvstore") {
+					kvLua.Setup(L, apps.kvs, context.TODO())
+				}
 				// setup "apps"
-				setup(L, apps)
+				if app.can("apps") {
+					setup(L, apps)
+				}
+				if app.can("notify") {
+					notify.SetupLua(L)
+				}
 				extra.Setup(L)
+				extra.SetupHTTP(L, app.httpClient)
+				extra.SetupCrypto(L, app.cred)
 				return nil
 			},
-		})
+		}
+		var err error
+		app.app, err = gluapp.NewApp(app.luaConf)
 		if err != nil {
-			return nil, err
+			return err
 		}
+		apps.scheduleJobs(app)
 	}
 
-	// TODO(tsileo): check that `path` exists, create it if it doesn't exist?
-	app.log.Debug("new app")
-	return app, nil
+	return nil
 }
 
-func (app *App) buildCache(L *lua.LState) *lua.LTable {
-	confTable := L.NewTable()
-	mt := L.NewTypeMetatable("blobstash_cache")
-	L.SetField(mt, "__index", L.NewFunction(func(ls *lua.LState) int {
-		cached, ok := app.appCache.Get(ls.Get(2))
-		if !ok {
-			ls.Push(lua.LNil)
-		} else {
-			ls.Push(cached.(lua.LValue))
-		}
-		return 1
-	}))
-	L.SetField(mt, "__newindex", L.NewFunction(func(ls *lua.LState) int {
-		// FIXME(tsileo): extract the LGFunction for functions and reject invalid types
-		key := ls.Get(2)
-		val := ls.Get(3)
-
-		// Setting the value to nil is the same as removing the key
-		if val == lua.LNil {
-			app.appCache.Remove(key)
-		}
-		app.appCache.Add(key, val)
-		return 0
-	}))
-
-	L.SetMetatable(confTable, L.GetTypeMetatable("blobstash_cache"))
-	return confTable
+func (app *App) warmupName() string {
+	return "apps/" + app.name
 }
 
 // Serve the request for the given path
@@ -352,13 +612,13 @@ func (app *App) serve(ctx context.Context, p string, w http.ResponseWriter, req
 	if app.auth != nil {
 		if !app.auth(req) {
 			if app.waitForIndieAuth && app.ia != nil {
-				panic("IndieAuth not ready")
+				panic(httputil.NewError(http.StatusServiceUnavailable, "IndieAuth not ready"))
 			}
 			// Handle IndieAuth
 			if app.ia != nil {
 				if err := app.ia.Redirect(w, req); err != nil {
 					if err == indieauth.ErrForbidden {
-						w.WriteHeader(http.StatusForbidden)
+						httputil.WriteErrorStatus(w, http.StatusForbidden)
 						return
 					}
 					panic(err)
@@ -366,7 +626,7 @@ func (app *App) serve(ctx context.Context, p string, w http.ResponseWriter, req
 			} else {
 				// Basic auth
 				w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=\"BlobStash App %s\"", app.name))
-				w.WriteHeader(http.StatusUnauthorized)
+				httputil.WriteErrorStatus(w, http.StatusUnauthorized)
 			}
 			return
 		}
@@ -378,22 +638,53 @@ func (app *App) serve(ctx context.Context, p string, w http.ResponseWriter, req
 	// Clean the path and check there's no double dot
 	p = path.Clean(p)
 	if containsDotDot(p) {
-		w.WriteHeader(500)
-		w.Write([]byte("Invalid URL path"))
+		httputil.WriteError(w, httputil.NewError(http.StatusBadRequest, "invalid URL path"))
+		return
 	}
 
-	app.log.Info("Serving", "app", app)
+	reqLog := httputil.Log(req, app.log)
+	reqLog.Info("Serving", "app", app)
 	if app.proxy != nil {
-		app.log.Info("Proxying request", "path", p)
+		reqLog.Info("Proxying request", "path", p)
 		req.URL.Path = p
+		// Forward the request ID so the upstream logs can be correlated
+		if reqID := httputil.ReqID(req); reqID != "" {
+			req.Header.Set(httputil.RequestIDHeader, reqID)
+		}
 		app.proxy.ServeHTTP(w, req)
 		return
 	}
 
+	if app.serveAsset(w, req, p) {
+		return
+	}
+
 	if app.app != nil {
+		// Reject the unsafe requests without a valid CSRF token
+		if app.appConf.CSRF {
+			if err := app.sess.ValidateCSRF(req); err != nil {
+				reqLog.Info("CSRF check failed", "path", p, "err", err)
+				httputil.WriteErrorStatus(w, http.StatusForbidden)
+				return
+			}
+		}
+
 		// FIXME(tsileo): support app not serving from a domain (like blobstashdomain/app/path)
-		app.log.Info("Serve gluapp", "path", p)
-		app.app.ServeHTTP(w, req)
+		reqLog.Info("Serve gluapp", "path", p)
+		sw := &streamWriter{ResponseWriter: w}
+		resp, err := app.app.Exec(sw, req)
+		if err != nil {
+			panic(err)
+		}
+		if resp != nil {
+			resp.WriteTo(w)
+		}
+		// Stream the blobs requested via `blobstore.stream` (after the body written by the app)
+		if sw.streamer != nil && sw.streamer.Pending() {
+			if _, err := sw.streamer.WriteTo(ctx, w); err != nil {
+				reqLog.Error("failed to stream blobs", "err", err)
+			}
+		}
 		return
 	}
 
@@ -401,7 +692,7 @@ func (app *App) serve(ctx context.Context, p string, w http.ResponseWriter, req
 }
 
 // New initializes the Apps manager
-func New(logger log.Logger, conf *config.Config, sess *session.Session, wa *webauthn.WebAuthn, bs *blobstore.BlobStore, kvs store.KvStore, ft *filetree.FileTree, ds *docstore.DocStore, chub *hub.Hub, hostWhitelister func(...string)) (*Apps, error) {
+func New(logger log.Logger, conf *config.Config, sess *session.Session, wa *webauthn.WebAuthn, bs *blobstore.BlobStore, kvs store.KvStore, ft *filetree.FileTree, ds *docstore.DocStore, chub *hub.Hub, wu *warmup.Warmup, hostWhitelister func(...string)) (*Apps, error) {
 	if conf.SecretKey == "" {
 		return nil, fmt.Errorf("missing secret_key in config")
 	}
@@ -409,6 +700,8 @@ func New(logger log.Logger, conf *config.Config, sess *session.Session, wa *weba
 	apps := &Apps{
 		sess:            sess,
 		apps:            map[string]*App{},
+		installed:       map[string]*InstalledApp{},
+		fsReloads:       map[string]*time.Timer{},
 		ft:              ft,
 		log:             logger,
 		bs:              bs,
@@ -416,11 +709,13 @@ func New(logger log.Logger, conf *config.Config, sess *session.Session, wa *weba
 		wa:              wa,
 		kvs:             kvs,
 		hub:             chub,
+		warmup:          wu,
 		docstore:        ds,
 		cron:            cron.New(),
 		hostWhitelister: hostWhitelister,
 	}
 	apps.cron.Start()
+	chub.Subscribe(hub.FiletreeFSUpdate, "apps", apps.fsUpdateCallback)
 	for _, appConf := range conf.Apps {
 		app, err := apps.newApp(appConf, conf)
 		if err != nil {
@@ -429,12 +724,30 @@ func New(logger log.Logger, conf *config.Config, sess *session.Session, wa *weba
 		fmt.Printf("app %+v\n", app)
 		apps.apps[app.name] = app
 	}
+	if err := apps.loadInstalled(context.Background()); err != nil {
+		apps.log.Error("failed to load the installed apps", "err", err)
+	}
+	for _, app := range apps.apps {
+		apps.schedule(app)
+	}
+	// The conflicts with the core routes are checked once all the routes are registered (see `CheckRoutes`)
+	routes, err := apps.buildRoutes(apps.apps)
+	if err != nil {
+		return nil, err
+	}
+	apps.routes = routes
+	apps.whitelistDomains()
 	return apps, nil
 }
 
+// streamWriter holds the request blobs streamer (set during the Lua state setup)
+type streamWriter struct {
+	http.ResponseWriter
+	streamer *blobstoreLua.Streamer
+}
+
 func handle404(w http.ResponseWriter) {
-	w.WriteHeader(http.StatusNotFound)
-	w.Write([]byte(http.StatusText(http.StatusNotFound)))
+	httputil.WriteErrorStatus(w, http.StatusNotFound)
 }
 
 func (apps *Apps) appHandler(w http.ResponseWriter, req *http.Request) {
@@ -442,12 +755,16 @@ func (apps *Apps) appHandler(w http.ResponseWriter, req *http.Request) {
 	// First, find which app we're trying to call
 	appName := vars["name"]
 	// => select the app and call its handler?
-	app, ok := apps.apps[appName]
+	app, ok := apps.getApp(appName)
 	if !ok {
 		apps.log.Warn("unknown app called", "app", appName)
 		handle404(w)
 		return
 	}
+	if !apps.warmup.IsReady(app.warmupName()) {
+		warmup.NotReady(w, app.warmupName())
+		return
+	}
 	p := vars["path"]
 	// No auth yet, handle the IndieAuth redirect flow
 	if p == "indieauth-redirect" && app.ia != nil {
@@ -457,23 +774,57 @@ func (apps *Apps) appHandler(w http.ResponseWriter, req *http.Request) {
 	app.serve(context.TODO(), "/"+p, w, req)
 }
 
-func (apps *Apps) subdomainHandler(app *App) func(http.ResponseWriter, *http.Request) {
+func (apps *Apps) subdomainHandler() func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
+		app, ok := apps.getAppByDomain(requestHost(r))
+		if !ok {
+			handle404(w)
+			return
+		}
 		apps.log.Info("subdomain handler", "app", app)
+		if !apps.warmup.IsReady(app.warmupName()) {
+			warmup.NotReady(w, app.warmupName())
+			return
+		}
 		app.serve(context.TODO(), r.URL.Path, w, r)
 	}
 }
 
 // Register Apps endpoint
 func (apps *Apps) Register(r *mux.Router, root *mux.Router, basicAuth func(http.Handler) http.Handler) {
+	r.Handle("/", basicAuth(http.HandlerFunc(apps.installedHandler())))
+	// The router redirects the trailing slashes, make sure the apps still receive the PATCH/DELETE requests on `/`
+	r.Handle("/{name}", basicAuth(http.HandlerFunc(apps.installedAppHandler()))).Methods("PATCH", "DELETE").MatcherFunc(func(r *http.Request, _ *mux.RouteMatch) bool {
+		return !strings.HasSuffix(r.URL.Path, "/")
+	})
 	r.Handle("/{name}/", http.HandlerFunc(apps.appHandler))
 	r.Handle("/{name}/{path:.+}", http.HandlerFunc(apps.appHandler))
 	for _, app := range apps.apps {
 		if app.domain != "" {
 			apps.log.Info("Registering app", "subdomain", app.domain)
-			root.Host(app.domain).HandlerFunc(apps.subdomainHandler(app))
 		}
 	}
+	// The domains are matched dynamically as apps can be added on config reload
+	apps.domainsRoute = root.MatcherFunc(func(r *http.Request, _ *mux.RouteMatch) bool {
+		_, ok := apps.getAppByDomain(requestHost(r))
+		return ok
+	}).HandlerFunc(apps.subdomainHandler())
+	// Same for the custom routes
+	apps.routesRoute = root.MatcherFunc(func(r *http.Request, _ *mux.RouteMatch) bool {
+		_, ok := apps.getAppByRoute(r.URL.Path)
+		return ok
+	}).HandlerFunc(apps.routeHandler())
+	apps.Lock()
+	apps.root = root
+	apps.Unlock()
+}
+
+// requestHost returns the host the same way the mux `Host` matcher does
+func requestHost(r *http.Request) string {
+	if r.URL.IsAbs() {
+		return r.URL.Host
+	}
+	return r.Host
 }
 
 // borrowed from net/http
@@ -542,8 +893,23 @@ func setup(L *lua.LState, apps *Apps) {
 				lbstats.RawSetString("blobs_size_human", lua.LString(humanize.Bytes(uint64(bstats.BlobsSize))))
 				lbstats.RawSetString("blobs_blobsfile_volumes", lua.LNumber(bstats.BlobsFilesCount))
 
-				out := L.CreateTable(0, 2)
+				details, err := apps.bs.DetailedStats()
+				if err != nil {
+					panic(err)
+				}
+				// Convert the typed stats using their JSON representation
+				js, err := json.Marshal(details)
+				if err != nil {
+					panic(err)
+				}
+				ldetails := map[string]interface{}{}
+				if err := json.Unmarshal(js, &ldetails); err != nil {
+					panic(err)
+				}
+
+				out := L.CreateTable(0, 3)
 				out.RawSetString("blobstore", lbstats)
+				out.RawSetString("blobstore_details", luautil.InterfaceToLValue(L, ldetails))
 				out.RawSetString("s3", luautil.InterfaceToLValue(L, stats))
 
 				L.Push(out)
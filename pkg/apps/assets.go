@@ -0,0 +1,223 @@
+package apps // import "a4.io/blobstash/pkg/apps"
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// Asset pipeline
+//
+// When enabled (`assets: true` in the app config), the files in the app `public/` dir are fingerprinted (the
+// content hash is added to the filename) and served under `/_assets/` with far-future caching headers. The
+// `url_for_asset` helper (template func and Lua global) returns the fingerprinted URL.
+//
+// The compressible assets are gzipped once at build time, a `.br` file next to an asset (e.g. `app.js.br`) is served
+// to the clients accepting brotli. The index is rebuilt when the app is reloaded.
+
+const (
+	// Path prefix of the fingerprinted assets
+	assetsPrefix = "/_assets/"
+
+	// Smaller assets are not compressed
+	minCompressSize = 1024
+)
+
+// asset holds a fingerprinted asset
+type asset struct {
+	path        string // on-disk path
+	name        string // path relative to `public/`
+	fingerprint string // fingerprinted name
+	hash        string
+	contentType string
+	modTime     time.Time
+	gz          []byte // gzipped content (nil if not compressible)
+	br          string // path of the brotli variant (if any)
+}
+
+// assetIndex holds the app assets (indexed by name and by fingerprinted name)
+type assetIndex struct {
+	byName        map[string]*asset
+	byFingerprint map[string]*asset
+}
+
+// fingerprintName adds the hash to the filename (`css/app.css` => `css/app.<hash>.css`)
+func fingerprintName(name, hash string) string {
+	ext := path.Ext(name)
+	return strings.TrimSuffix(name, ext) + "." + hash + ext
+}
+
+// isCompressible returns true for the text-based content types
+func isCompressible(contentType string) bool {
+	ct, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case strings.HasPrefix(ct, "text/"):
+		return true
+	case ct == "application/javascript", ct == "application/json", ct == "application/xml", ct == "image/svg+xml":
+		return true
+	}
+	return false
+}
+
+// buildAssetIndex fingerprints (and compresses) the files in the given public dir
+func buildAssetIndex(dir string) (*assetIndex, error) {
+	idx := &assetIndex{
+		byName:        map[string]*asset{},
+		byFingerprint: map[string]*asset{},
+	}
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return idx, nil
+	}
+	if err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
+			return nil
+		}
+		// The pre-compressed variants are not assets
+		if ext := filepath.Ext(p); ext == ".br" || ext == ".gz" {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		sum := blake2b.Sum256(data)
+		a := &asset{
+			path:        p,
+			name:        filepath.ToSlash(rel),
+			hash:        fmt.Sprintf("%x", sum[:8]),
+			contentType: mime.TypeByExtension(filepath.Ext(p)),
+			modTime:     fi.ModTime(),
+		}
+		if a.contentType == "" {
+			a.contentType = http.DetectContentType(data)
+		}
+		a.fingerprint = fingerprintName(a.name, a.hash)
+
+		if len(data) >= minCompressSize && isCompressible(a.contentType) {
+			var buf bytes.Buffer
+			gw, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+			if err != nil {
+				return err
+			}
+			if _, err := gw.Write(data); err != nil {
+				return err
+			}
+			if err := gw.Close(); err != nil {
+				return err
+			}
+			if buf.Len() < len(data) {
+				a.gz = buf.Bytes()
+			}
+		}
+		if _, err := os.Stat(p + ".br"); err == nil {
+			a.br = p + ".br"
+		}
+
+		idx.byName[a.name] = a
+		idx.byFingerprint[a.fingerprint] = a
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// serve serves the asset (using the best encoding accepted by the client)
+func (a *asset) serve(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", a.contentType)
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("Vary", "Accept-Encoding")
+	ae := r.Header.Get("Accept-Encoding")
+	switch {
+	case a.br != "" && strings.Contains(ae, "br"):
+		f, err := os.Open(a.br)
+		if err == nil {
+			defer f.Close()
+			w.Header().Set("Content-Encoding", "br")
+			w.Header().Set("ETag", fmt.Sprintf("\"%s-br\"", a.hash))
+			http.ServeContent(w, r, a.name, a.modTime, f)
+			return
+		}
+	case a.gz != nil && strings.Contains(ae, "gzip"):
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("ETag", fmt.Sprintf("\"%s-gz\"", a.hash))
+		http.ServeContent(w, r, a.name, a.modTime, bytes.NewReader(a.gz))
+		return
+	}
+	f, err := os.Open(a.path)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	w.Header().Set("ETag", fmt.Sprintf("\"%s\"", a.hash))
+	http.ServeContent(w, r, a.name, a.modTime, f)
+}
+
+// buildAssets (re)builds the asset index if the pipeline is enabled for the app
+func (app *App) buildAssets() error {
+	if !app.appConf.Assets || app.path == "" {
+		return nil
+	}
+	idx, err := buildAssetIndex(filepath.Join(app.path, "public"))
+	if err != nil {
+		return fmt.Errorf("failed to build assets: %w", err)
+	}
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	app.assets = idx
+	app.log.Info("assets built", "count", len(idx.byName))
+	return nil
+}
+
+func (app *App) assetIndex() *assetIndex {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	return app.assets
+}
+
+// urlForAsset returns the fingerprinted URL of the asset (or the `public/` URL if the asset is not indexed)
+func (app *App) urlForAsset(baseURL, name string) string {
+	name = strings.TrimPrefix(name, "/")
+	p := "/" + name
+	if idx := app.assetIndex(); idx != nil {
+		if a, ok := idx.byName[name]; ok {
+			p = assetsPrefix + a.fingerprint
+		}
+	}
+	return strings.TrimSuffix(baseURL, "/") + p
+}
+
+// serveAsset serves a fingerprinted asset, returns false if the path is not an asset path
+func (app *App) serveAsset(w http.ResponseWriter, r *http.Request, p string) bool {
+	if !strings.HasPrefix(p, assetsPrefix) {
+		return false
+	}
+	idx := app.assetIndex()
+	if idx == nil {
+		return false
+	}
+	a, ok := idx.byFingerprint[strings.TrimPrefix(p, assetsPrefix)]
+	if !ok {
+		handle404(w)
+		return true
+	}
+	a.serve(w, r)
+	return true
+}
@@ -0,0 +1,78 @@
+package apps
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAssetIndex(t *testing.T) {
+	dir := t.TempDir()
+	css := bytes.Repeat([]byte("body { color: red; }\n"), 100)
+	if err := os.MkdirAll(filepath.Join(dir, "css"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string][]byte{
+		"css/app.css":    css,
+		"css/app.css.br": []byte("fake brotli"),
+		"logo.png":       {0x89, 'P', 'N', 'G'},
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	idx, err := buildAssetIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(idx.byName) != 2 {
+		t.Fatalf("expected 2 assets, got %d", len(idx.byName))
+	}
+	a := idx.byName["css/app.css"]
+	if a == nil || !strings.HasPrefix(a.fingerprint, "css/app.") || !strings.HasSuffix(a.fingerprint, ".css") || a.gz == nil || a.br == "" {
+		t.Fatalf("unexpected asset %+v", a)
+	}
+	if idx.byName["logo.png"].gz != nil {
+		t.Errorf("images should not be compressed")
+	}
+
+	for _, tc := range []struct {
+		acceptEncoding string
+		encoding       string
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"gzip, br", "br"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", tc.acceptEncoding)
+		w := httptest.NewRecorder()
+		a.serve(w, r)
+		if w.Code != http.StatusOK || w.Header().Get("Content-Encoding") != tc.encoding {
+			t.Errorf("%q: unexpected response %d/%q", tc.acceptEncoding, w.Code, w.Header().Get("Content-Encoding"))
+		}
+		if !strings.Contains(w.Header().Get("Cache-Control"), "immutable") {
+			t.Errorf("missing cache headers")
+		}
+		body := w.Body.Bytes()
+		if tc.encoding == "gzip" {
+			gr, err := gzip.NewReader(w.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if body, err = ioutil.ReadAll(gr); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if tc.encoding != "br" && !bytes.Equal(body, css) {
+			t.Errorf("%q: unexpected body", tc.acceptEncoding)
+		}
+	}
+}
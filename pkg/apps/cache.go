@@ -0,0 +1,228 @@
+package apps // import "a4.io/blobstash/pkg/apps"
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	lua "github.com/yuin/gopher-lua"
+
+	"a4.io/blobstash/pkg/apps/luautil"
+	"a4.io/blobstash/pkg/clock"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/kvstore"
+	"a4.io/blobstash/pkg/stash/store"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+// AppCacheKeyFmt is the kv key format for the entries of the persistent app caches (`_appcache:<app>:<key>`)
+const AppCacheKeyFmt = "_appcache:%s:%s"
+
+const defaultAppCacheSize = 512
+
+// appCache is the per-app LRU cache, the entries can expire, and can be written to the kv store so the cache survives
+// restarts (the in-memory LRU is then lazily re-populated from the kv store)
+type appCache struct {
+	app string
+	lru *lru.Cache
+	kvs store.KvStore // only set for the persistent caches
+}
+
+// cacheEntry is an in-memory cache entry
+type cacheEntry struct {
+	value     lua.LValue
+	expiresAt time.Time // zero if the entry never expires
+}
+
+// persistedCacheEntry is a cache entry stored in the kv store
+type persistedCacheEntry struct {
+	Value     json.RawMessage `json:"v"`
+	ExpiresAt int64           `json:"e,omitempty"` // UNIX nano timestamp
+}
+
+func (e *cacheEntry) expired() bool {
+	return !e.expiresAt.IsZero() && !clock.Now().Before(e.expiresAt)
+}
+
+func newAppCache(app string, conf *config.AppCache, kvs store.KvStore) (*appCache, error) {
+	size := defaultAppCacheSize
+	c := &appCache{app: app}
+	if conf != nil {
+		if conf.Size < 0 {
+			return nil, fmt.Errorf("invalid cache size %d", conf.Size)
+		}
+		if conf.Size > 0 {
+			size = conf.Size
+		}
+		if conf.Persistent {
+			c.kvs = kvs
+		}
+	}
+	var err error
+	c.lru, err = lru.New(size)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *appCache) kvKey(key lua.LValue) string {
+	return fmt.Sprintf(AppCacheKeyFmt, c.app, key.String())
+}
+
+// get returns the cached value for the key (or `lua.LNil`)
+func (c *appCache) get(L *lua.LState, key lua.LValue) (lua.LValue, error) {
+	if cached, ok := c.lru.Get(key); ok {
+		entry := cached.(*cacheEntry)
+		if !entry.expired() {
+			return entry.value, nil
+		}
+		return lua.LNil, c.remove(key)
+	}
+	if c.kvs == nil {
+		return lua.LNil, nil
+	}
+
+	// Lazily load the entry from the kv store
+	kv, err := c.kvs.Get(context.TODO(), c.kvKey(key), -1)
+	switch err {
+	case nil:
+		if kv.Expired() {
+			return lua.LNil, nil
+		}
+	case vkv.ErrNotFound:
+		return lua.LNil, nil
+	default:
+		return nil, err
+	}
+	persisted := &persistedCacheEntry{}
+	if err := json.Unmarshal(kv.Data, persisted); err != nil {
+		return nil, err
+	}
+	entry := &cacheEntry{value: luautil.FromJSON(L, persisted.Value)}
+	if persisted.ExpiresAt > 0 {
+		entry.expiresAt = time.Unix(0, persisted.ExpiresAt)
+	}
+	if entry.expired() {
+		return lua.LNil, c.remove(key)
+	}
+	c.lru.Add(key, entry)
+	return entry.value, nil
+}
+
+// set caches the value, for the given duration if ttl is not zero, setting the value to nil removes the key
+func (c *appCache) set(L *lua.LState, key, val lua.LValue, ttl time.Duration) error {
+	if val == lua.LNil {
+		return c.remove(key)
+	}
+	entry := &cacheEntry{value: val}
+	if ttl > 0 {
+		entry.expiresAt = clock.Now().Add(ttl)
+	}
+	if c.kvs != nil {
+		switch val.(type) {
+		case lua.LBool, lua.LNumber, lua.LString, *lua.LTable:
+		default:
+			return fmt.Errorf("cannot persist a %s in the cache", val.Type())
+		}
+		persisted := &persistedCacheEntry{Value: luautil.ToJSON(L, val)}
+		if !entry.expiresAt.IsZero() {
+			persisted.ExpiresAt = entry.expiresAt.UnixNano()
+		}
+		data, err := json.Marshal(persisted)
+		if err != nil {
+			return err
+		}
+		if err := c.put(c.kvKey(key), data); err != nil {
+			return err
+		}
+	}
+	c.lru.Add(key, entry)
+	return nil
+}
+
+// put writes a new version of the kv key (ensuring the version is greater than the current one)
+func (c *appCache) put(key string, data []byte) error {
+	ctx := context.TODO()
+	version := clock.Now().UTC().UnixNano()
+	current, err := c.kvs.Get(ctx, key, -1)
+	switch err {
+	case nil:
+		if version <= current.Version {
+			version = current.Version + 1
+		}
+	case vkv.ErrNotFound:
+	default:
+		return err
+	}
+	_, err = c.kvs.Put(ctx, key, "", data, version)
+	return err
+}
+
+// remove removes the key from the cache
+func (c *appCache) remove(key lua.LValue) error {
+	c.lru.Remove(key)
+	if c.kvs != nil {
+		return kvstore.Expire(context.TODO(), c.kvs, c.kvKey(key))
+	}
+	return nil
+}
+
+// buildTable returns the Lua table exposed as `blobstash.app_cache`, the entries can be read/written directly (without
+// TTL), or via the `get_or_set(key, ttl, fn)` and `set(key, value, ttl)` helpers (TTL in seconds, 0 for no expiry)
+func (c *appCache) buildTable(L *lua.LState) *lua.LTable {
+	tbl := L.NewTable()
+	mt := L.NewTypeMetatable("blobstash_cache")
+	L.SetField(mt, "__index", L.NewFunction(func(ls *lua.LState) int {
+		val, err := c.get(ls, ls.Get(2))
+		if err != nil {
+			ls.RaiseError("cache: %v", err)
+		}
+		ls.Push(val)
+		return 1
+	}))
+	L.SetField(mt, "__newindex", L.NewFunction(func(ls *lua.LState) int {
+		// FIXME(tsileo): extract the LGFunction for functions and reject invalid types
+		if err := c.set(ls, ls.Get(2), ls.Get(3), 0); err != nil {
+			ls.RaiseError("cache: %v", err)
+		}
+		return 0
+	}))
+	// The helpers are set as raw fields so they're not proxied to the cache
+	tbl.RawSetString("set", L.NewFunction(func(ls *lua.LState) int {
+		if err := c.set(ls, ls.CheckAny(1), ls.CheckAny(2), luaTTL(ls, 3)); err != nil {
+			ls.RaiseError("cache: %v", err)
+		}
+		return 0
+	}))
+	tbl.RawSetString("get_or_set", L.NewFunction(func(ls *lua.LState) int {
+		key := ls.CheckAny(1)
+		ttl := luaTTL(ls, 2)
+		fn := ls.CheckFunction(3)
+		val, err := c.get(ls, key)
+		if err != nil {
+			ls.RaiseError("cache: %v", err)
+		}
+		if val == lua.LNil {
+			if err := ls.CallByParam(lua.P{Fn: fn, NRet: 1, Protect: true}); err != nil {
+				ls.RaiseError("cache: %v", err)
+			}
+			val = ls.Get(-1)
+			ls.Pop(1)
+			if err := c.set(ls, key, val, ttl); err != nil {
+				ls.RaiseError("cache: %v", err)
+			}
+		}
+		ls.Push(val)
+		return 1
+	}))
+	L.SetMetatable(tbl, L.GetTypeMetatable("blobstash_cache"))
+	return tbl
+}
+
+// luaTTL returns the TTL (in seconds) at the given index of the stack
+func luaTTL(L *lua.LState, n int) time.Duration {
+	return time.Duration(float64(L.OptNumber(n, 0)) * float64(time.Second))
+}
@@ -0,0 +1,110 @@
+package apps
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+
+	"a4.io/blobstash/pkg/clock"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/stash/store"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+// memKvStore is a minimal in-memory kv store (only the latest version of each key is kept)
+type memKvStore struct {
+	store.KvStore
+	kvs map[string]*vkv.KeyValue
+}
+
+func (m *memKvStore) Get(ctx context.Context, key string, version int64) (*vkv.KeyValue, error) {
+	kv, ok := m.kvs[key]
+	if !ok {
+		return nil, vkv.ErrNotFound
+	}
+	return kv, nil
+}
+
+func (m *memKvStore) Put(ctx context.Context, key, ref string, data []byte, version int64) (*vkv.KeyValue, error) {
+	kv := &vkv.KeyValue{Key: key, Data: data, Version: version}
+	m.kvs[key] = kv
+	return kv, nil
+}
+
+func TestAppCache(t *testing.T) {
+	fake := clock.NewFake(time.Now())
+	clock.Set(fake)
+	defer clock.Set(nil)
+
+	kvs := &memKvStore{kvs: map[string]*vkv.KeyValue{}}
+	run := func(cache *appCache, code string) lua.LValue {
+		t.Helper()
+		L := lua.NewState()
+		defer L.Close()
+		L.SetGlobal("cache", cache.buildTable(L))
+		top := L.GetTop()
+		if err := L.DoString(code); err != nil {
+			t.Fatal(err)
+		}
+		// Return the first returned value
+		return L.Get(top + 1)
+	}
+	newCache := func(persistent bool) *appCache {
+		t.Helper()
+		cache, err := newAppCache("test", &config.AppCache{Size: 8, Persistent: persistent}, kvs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cache
+	}
+
+	for _, persistent := range []bool{false, true} {
+		cache := newCache(persistent)
+		run(cache, `cache.a = 'hello'; cache.set('b', {x = 1}, 10)`)
+		if v := run(cache, `return cache.a`); v.String() != "hello" {
+			t.Errorf("expected hello, got %v", v)
+		}
+
+		// The function is only called on a cache miss
+		getOrSet := `cache.get_or_set('c', 10, function() calls = (calls or 0) + 1; return 'computed' end)`
+		if v := run(cache, `return `+getOrSet); v.String() != "computed" {
+			t.Errorf("expected computed, got %v", v)
+		}
+		if v := run(cache, `local v = `+getOrSet+`; return calls`); v != lua.LNil {
+			t.Errorf("expected a cache hit, got %v", v)
+		}
+
+		fake.Add(11 * time.Second)
+		if v := run(cache, `return cache.b`); v != lua.LNil {
+			t.Errorf("expected the entry to be expired, got %v", v)
+		}
+		if v := run(cache, `return cache.a`); v.String() != "hello" {
+			t.Errorf("expected hello, got %v", v)
+		}
+		run(cache, `cache.a = nil`)
+		if v := run(cache, `return cache.a`); v != lua.LNil {
+			t.Errorf("expected the entry to be removed, got %v", v)
+		}
+	}
+
+	// The persistent cache survives a "restart"
+	cache := newCache(true)
+	run(cache, `cache.set('t', {1, 2, 3}, 60); cache.k = 'kept'`)
+	cache = newCache(true)
+	if v := run(cache, `return cache.k .. #cache.t`); v.String() != "kept3" {
+		t.Errorf("expected the persisted entries, got %v", v)
+	}
+	if v := run(newCache(false), `return cache.k`); v != lua.LNil {
+		t.Errorf("expected an empty in-memory cache, got %v", v)
+	}
+	fake.Add(time.Minute)
+	if v := run(newCache(true), `return cache.t`); v != lua.LNil {
+		t.Errorf("expected the persisted entry to be expired, got %v", v)
+	}
+
+	if v := run(newCache(true), `return (pcall(function() cache.f = function() end end))`); v != lua.LFalse {
+		t.Errorf("expected an error when persisting a function, got %v", v)
+	}
+}
@@ -0,0 +1,101 @@
+package apps // import "a4.io/blobstash/pkg/apps"
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/filetree"
+)
+
+// Apps served from a filetree FS
+//
+// An app `path` can be a filetree reference (`fs://<fs>`, `fs://<fs>@<tag>` or `fs://<fs>@<root ref>`) instead of a
+// local directory: the FS is checked out in a temp dir when the app is loaded (the Lua files, the templates and the
+// public assets are read from there). The apps tracking the latest version of a FS (i.e. without `@`) are re-loaded
+// when the FS is updated (the FS may not exist yet, the app returns 404s until then), so an app can be deployed by
+// uploading it to the stash.
+
+const fsPathPrefix = "fs://"
+
+// Delay before re-loading an app after a FS update (an upload usually updates the FS several times)
+var fsReloadDelay = 2 * time.Second
+
+func isFSPath(p string) bool {
+	return strings.HasPrefix(p, fsPathPrefix)
+}
+
+// checkoutFS checks out the FS ref in a new temp dir
+func (apps *Apps) checkoutFS(ctx context.Context, ref, name string) (string, error) {
+	dir, err := ioutil.TempDir("", fmt.Sprintf("blobstash-app-%s-", name))
+	if err != nil {
+		return "", err
+	}
+	if err := apps.ft.Checkout(ctx, ref, dir, maxExtractedSize); err != nil {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("failed to checkout FS %q: %w", ref, err)
+	}
+	return dir, nil
+}
+
+// fsUpdateCallback schedules the re-load of the apps tracking the updated FS
+func (apps *Apps) fsUpdateCallback(ctx context.Context, _ *blob.Blob, data interface{}) error {
+	js, ok := data.(string)
+	if !ok {
+		return nil
+	}
+	evt := &filetree.FSUpdateEvent{}
+	if err := json.Unmarshal([]byte(js), evt); err != nil {
+		return err
+	}
+
+	apps.Lock()
+	defer apps.Unlock()
+	for name, app := range apps.apps {
+		if app.fsRef != evt.Name {
+			continue
+		}
+		if t, ok := apps.fsReloads[name]; ok {
+			t.Stop()
+		}
+		name := name
+		apps.fsReloads[name] = time.AfterFunc(fsReloadDelay, func() {
+			if err := apps.reloadApp(name); err != nil {
+				apps.log.Error("failed to reload app", "app", name, "err", err)
+			}
+		})
+	}
+	return nil
+}
+
+// reloadApp re-creates the app (and checks out its FS again)
+func (apps *Apps) reloadApp(name string) error {
+	apps.Lock()
+	defer apps.Unlock()
+	delete(apps.fsReloads, name)
+	current, ok := apps.apps[name]
+	if !ok {
+		return nil
+	}
+	var app *App
+	var err error
+	if current.installed {
+		ia, ok := apps.installed[name]
+		if !ok {
+			return nil
+		}
+		app, err = apps.newInstalledApp(context.Background(), ia)
+	} else {
+		app, err = apps.newApp(current.appConf, current.rootConfig)
+	}
+	if err != nil {
+		return err
+	}
+	apps.log.Info("app reloaded after a FS update", "app", name)
+	return apps.swap(apps.withApp(name, app))
+}
@@ -0,0 +1,43 @@
+package apps
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"a4.io/blobstash/pkg/filetree"
+)
+
+func TestFSUpdateCallback(t *testing.T) {
+	fsReloadDelay = time.Hour
+	apps := &Apps{
+		apps: map[string]*App{
+			"blog":   {name: "blog", fsRef: "blog"},
+			"pinned": {name: "pinned"},
+		},
+		fsReloads: map[string]*time.Timer{},
+	}
+	for _, fsName := range []string{"blog", "blog", "other"} {
+		evt := &filetree.FSUpdateEvent{Name: fsName, Type: "file-updated"}
+		if err := apps.fsUpdateCallback(context.Background(), nil, evt.JSON()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(apps.fsReloads) != 1 || apps.fsReloads["blog"] == nil {
+		t.Errorf("expected a single reload for the blog app, got %+v", apps.fsReloads)
+	}
+	for _, timer := range apps.fsReloads {
+		timer.Stop()
+	}
+
+	for p, expected := range map[string]bool{
+		"fs://blog":      true,
+		"fs://blog@v1":   true,
+		"/srv/apps/blog": false,
+		"blog":           false,
+	} {
+		if got := isFSPath(p); got != expected {
+			t.Errorf("isFSPath(%q) = %v, expected %v", p, got, expected)
+		}
+	}
+}
@@ -0,0 +1,613 @@
+package apps // import "a4.io/blobstash/pkg/apps"
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/hashutil"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/perms"
+)
+
+// Dynamic app installation
+//
+// Besides the apps defined in the config, apps can be installed at runtime (from a git remote, a filetree FS, or from
+// an uploaded .tar.gz/.zip archive stored as a blob) via `POST /api/apps`. The name defaults to the one of the app
+// manifest (except for the git remotes, cloned in the background). The installed apps are persisted in the kv store (and
+// re-loaded at startup), can be disabled/enabled without losing their settings, and are mounted (with their custom
+// routes and domain) without a restart.
+
+// InstalledAppKeyFmt is the kv key format for the installed apps (`_apps:<name>`)
+const InstalledAppKeyFmt = "_apps:%s"
+
+// Limits for the uploaded archives
+const (
+	maxArchiveSize   = 16 << 20
+	maxExtractedSize = 64 << 20
+)
+
+var (
+	// ErrAppExists is returned when installing an app with the name of an existing app
+	ErrAppExists = errors.New("app already exists")
+
+	// ErrAppNotInstalled is returned when managing an app not installed via the API
+	ErrAppNotInstalled = errors.New("app not installed")
+
+	errArchiveTooLarge = errors.New("archive too large")
+)
+
+var validAppName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// InstalledApp holds the settings of an app installed via the API
+type InstalledApp struct {
+	Name        string                 `json:"name"`
+	Remote      string                 `json:"remote,omitempty"`
+	Archive     string                 `json:"archive,omitempty"`
+	FS          string                 `json:"fs,omitempty"`
+	Entrypoint  string                 `json:"entrypoint,omitempty"`
+	Domain      string                 `json:"domain,omitempty"`
+	Routes      []string               `json:"routes,omitempty"`
+	Assets      bool                   `json:"assets,omitempty"`
+	CSRF        bool                   `json:"csrf,omitempty"`
+	Scopes      []string               `json:"scopes,omitempty"`
+	Config      map[string]interface{} `json:"config,omitempty"`
+	Enabled     bool                   `json:"enabled"`
+	InstalledAt int64                  `json:"installed_at"`
+}
+
+// appConf returns the config of the app (the path is only set once the archive is extracted)
+func (ia *InstalledApp) appConf() *config.AppConfig {
+	return &config.AppConfig{
+		Name:       ia.Name,
+		Remote:     ia.Remote,
+		Entrypoint: ia.Entrypoint,
+		Domain:     ia.Domain,
+		Routes:     ia.Routes,
+		Assets:     ia.Assets,
+		CSRF:       ia.CSRF,
+		Scopes:     ia.Scopes,
+		Config:     ia.Config,
+	}
+}
+
+func (ia *InstalledApp) validate() error {
+	if !validAppName.MatchString(ia.Name) {
+		return fmt.Errorf("invalid app name %q", ia.Name)
+	}
+	var sources int
+	for _, src := range []string{ia.Remote, ia.Archive, ia.FS} {
+		if src != "" {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return errors.New("either a remote, a FS or an archive is required")
+	}
+	if ia.Remote != "" {
+		// Same format as the config: `<repo_url>#<tag>`, defaults to master
+		if !strings.Contains(ia.Remote, "#") {
+			ia.Remote = ia.Remote + "#master"
+		}
+		if strings.Count(ia.Remote, "#") != 1 || strings.HasPrefix(ia.Remote, "#") {
+			return fmt.Errorf("invalid remote %q", ia.Remote)
+		}
+	}
+	for _, p := range ia.Routes {
+		if err := validRoute(p); err != nil {
+			return err
+		}
+	}
+	for _, scope := range ia.Scopes {
+		if _, ok := validScopes[scope]; !ok {
+			return fmt.Errorf("unknown scope %q", scope)
+		}
+	}
+	return nil
+}
+
+// fetch extracts the archive or the FS of the app in a temp dir (returns an empty dir for the git remotes)
+func (apps *Apps) fetch(ctx context.Context, ia *InstalledApp) (string, error) {
+	switch {
+	case ia.FS != "":
+		return apps.checkoutFS(ctx, ia.FS, ia.Name)
+	case ia.Archive == "":
+		return "", nil
+	}
+	data, err := apps.bs.Get(ctx, ia.Archive)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch archive: %v", err)
+	}
+	dir, err := ioutil.TempDir("", fmt.Sprintf("blobstash-app-%s-", ia.Name))
+	if err != nil {
+		return "", err
+	}
+	if err := extractArchive(data, dir); err != nil {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("failed to extract archive: %v", err)
+	}
+	return dir, nil
+}
+
+// newInstalledApp initializes the app, the archive/FS (if any) is extracted in a temp dir
+func (apps *Apps) newInstalledApp(ctx context.Context, ia *InstalledApp) (*App, error) {
+	dir, err := apps.fetch(ctx, ia)
+	if err != nil {
+		return nil, err
+	}
+	return apps.newInstalledAppFromDir(ia, dir)
+}
+
+// newInstalledAppFromDir initializes the app from the fetched dir (removed when the app is unloaded)
+func (apps *Apps) newInstalledAppFromDir(ia *InstalledApp, dir string) (*App, error) {
+	appConf := ia.appConf()
+	appConf.Path = dir
+	app, err := apps.newApp(appConf, apps.config)
+	if err != nil {
+		if dir != "" {
+			os.RemoveAll(dir)
+		}
+		return nil, err
+	}
+	app.installed = true
+	if ia.FS != "" && !strings.Contains(ia.FS, "@") {
+		app.fsRef = ia.FS
+	}
+	if dir != "" {
+		// the temp dir will be removed when the app is unloaded
+		app.tmp = dir
+	}
+	return app, nil
+}
+
+// loadInstalled loads the installed apps at startup, the failing apps are skipped (the apps lock must be held)
+func (apps *Apps) loadInstalled(ctx context.Context) error {
+	prefix := fmt.Sprintf(InstalledAppKeyFmt, "")
+	kvs, _, err := apps.kvs.Keys(ctx, prefix, prefix+"\xff", -1)
+	if err != nil {
+		return err
+	}
+	for _, kv := range kvs {
+		// Skip the uninstalled apps
+		if len(kv.Data) == 0 {
+			continue
+		}
+		ia := &InstalledApp{}
+		if err := json.Unmarshal(kv.Data, ia); err != nil {
+			return err
+		}
+		apps.installed[ia.Name] = ia
+		if !ia.Enabled {
+			continue
+		}
+		if _, ok := apps.apps[ia.Name]; ok {
+			apps.log.Error("installed app conflicts with a config app, skipping it", "app", ia.Name)
+			continue
+		}
+		app, err := apps.newInstalledApp(ctx, ia)
+		if err != nil {
+			apps.log.Error("failed to load installed app", "app", ia.Name, "err", err)
+			continue
+		}
+		apps.apps[app.name] = app
+		if _, err := apps.buildRoutes(apps.apps); err != nil {
+			apps.log.Error("failed to load installed app", "app", ia.Name, "err", err)
+			delete(apps.apps, app.name)
+			go apps.cleanup(app)
+			continue
+		}
+		apps.log.Info("installed app loaded", "app", app.name)
+	}
+	return nil
+}
+
+// saveInstalled persists the app settings
+func (apps *Apps) saveInstalled(ctx context.Context, ia *InstalledApp) error {
+	encoded, err := json.Marshal(ia)
+	if err != nil {
+		return err
+	}
+	_, err = apps.kvs.Put(ctx, fmt.Sprintf(InstalledAppKeyFmt, ia.Name), ia.Archive, encoded, -1)
+	return err
+}
+
+// withApp returns a copy of the running apps, with app added (or the app removed if app is nil)
+func (apps *Apps) withApp(name string, app *App) map[string]*App {
+	newApps := make(map[string]*App, len(apps.apps)+1)
+	for n, a := range apps.apps {
+		if n != name {
+			newApps[n] = a
+		}
+	}
+	if app != nil {
+		newApps[name] = app
+	}
+	return newApps
+}
+
+// Install installs and starts the app (if the archive is not empty, it's stored in the blobstore)
+func (apps *Apps) Install(ctx context.Context, ia *InstalledApp, archive []byte) error {
+	if len(archive) > 0 {
+		ia.Archive = hashutil.Compute(archive)
+		if _, err := apps.bs.Put(ctx, &blob.Blob{Hash: ia.Archive, Data: archive}); err != nil {
+			return err
+		}
+	}
+
+	// The archive/FS is fetched first, as the name may be defined in the manifest
+	dir, err := apps.fetch(ctx, ia)
+	if err != nil {
+		return httputil.BadRequest(err)
+	}
+	if ia.Name == "" && dir != "" {
+		m, err := readManifest(dir)
+		if err != nil {
+			os.RemoveAll(dir)
+			return httputil.BadRequest(err)
+		}
+		if m != nil {
+			ia.Name = m.Name
+		}
+	}
+	if err := ia.validate(); err != nil {
+		os.RemoveAll(dir)
+		return httputil.BadRequest(err)
+	}
+	if apps.exists(ia.Name) {
+		os.RemoveAll(dir)
+		return ErrAppExists
+	}
+	ia.Enabled = true
+	ia.InstalledAt = time.Now().Unix()
+
+	app, err := apps.newInstalledAppFromDir(ia, dir)
+	if err != nil {
+		return httputil.BadRequest(err)
+	}
+
+	apps.Lock()
+	defer apps.Unlock()
+	// Check again, another app may have been installed in the meantime
+	if _, ok := apps.installed[ia.Name]; ok {
+		go apps.cleanup(app)
+		return ErrAppExists
+	}
+	if _, ok := apps.apps[ia.Name]; ok {
+		go apps.cleanup(app)
+		return ErrAppExists
+	}
+	newApps := apps.withApp(ia.Name, app)
+	if _, err := apps.buildRoutes(newApps); err != nil {
+		go apps.cleanup(app)
+		return httputil.BadRequest(err)
+	}
+	if err := apps.saveInstalled(ctx, ia); err != nil {
+		go apps.cleanup(app)
+		return err
+	}
+	apps.installed[ia.Name] = ia
+	apps.log.Info("app installed", "app", ia.Name)
+	return apps.swap(newApps)
+}
+
+func (apps *Apps) exists(name string) bool {
+	apps.Lock()
+	defer apps.Unlock()
+	_, installed := apps.installed[name]
+	_, running := apps.apps[name]
+	return installed || running
+}
+
+// installedApp returns the app settings, the apps lock must be held
+func (apps *Apps) installedApp(name string) (*InstalledApp, error) {
+	ia, ok := apps.installed[name]
+	if !ok {
+		if _, ok := apps.apps[name]; ok {
+			return nil, httputil.Errorf(http.StatusConflict, "app %q is defined in the config", name)
+		}
+		return nil, ErrAppNotInstalled
+	}
+	return ia, nil
+}
+
+// SetEnabled starts or stops an installed app
+func (apps *Apps) SetEnabled(ctx context.Context, name string, enabled bool) (*InstalledApp, error) {
+	apps.Lock()
+	defer apps.Unlock()
+	ia, err := apps.installedApp(name)
+	if err != nil {
+		return nil, err
+	}
+	if ia.Enabled == enabled {
+		return ia, nil
+	}
+
+	newApps := apps.withApp(name, nil)
+	if enabled {
+		app, err := apps.newInstalledApp(ctx, ia)
+		if err != nil {
+			return nil, httputil.BadRequest(err)
+		}
+		newApps[name] = app
+		if _, err := apps.buildRoutes(newApps); err != nil {
+			go apps.cleanup(app)
+			return nil, httputil.BadRequest(err)
+		}
+	}
+
+	updated := *ia
+	updated.Enabled = enabled
+	if err := apps.saveInstalled(ctx, &updated); err != nil {
+		return nil, err
+	}
+	apps.installed[name] = &updated
+	apps.log.Info("app updated", "app", name, "enabled", enabled)
+	return &updated, apps.swap(newApps)
+}
+
+// Uninstall stops and removes an installed app (the archive blob is kept)
+func (apps *Apps) Uninstall(ctx context.Context, name string) error {
+	apps.Lock()
+	defer apps.Unlock()
+	if _, err := apps.installedApp(name); err != nil {
+		return err
+	}
+	if _, err := apps.kvs.Put(ctx, fmt.Sprintf(InstalledAppKeyFmt, name), "", nil, -1); err != nil {
+		return err
+	}
+	delete(apps.installed, name)
+	apps.log.Info("app uninstalled", "app", name)
+	return apps.swap(apps.withApp(name, nil))
+}
+
+// Installed returns the apps installed via the API (sorted by name)
+func (apps *Apps) Installed() []*InstalledApp {
+	apps.Lock()
+	defer apps.Unlock()
+	out := make([]*InstalledApp, 0, len(apps.installed))
+	for _, ia := range apps.installed {
+		out = append(out, ia)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// extractArchive extracts a .tar.gz or .zip archive in dir, if all the files are in a single top-level directory
+// (like the GitHub archives), it is stripped
+func extractArchive(data []byte, dir string) error {
+	files := map[string][]byte{}
+	var total int64
+	add := func(name string, r io.Reader) error {
+		name = filepath.ToSlash(name)
+		if strings.HasPrefix(name, "/") || containsDotDot(name) {
+			return fmt.Errorf("invalid path %q", name)
+		}
+		b, err := ioutil.ReadAll(io.LimitReader(r, maxExtractedSize-total+1))
+		if err != nil {
+			return err
+		}
+		total += int64(len(b))
+		if total > maxExtractedSize {
+			return errArchiveTooLarge
+		}
+		files[strings.TrimPrefix(name, "./")] = b
+		return nil
+	}
+
+	switch {
+	case bytes.HasPrefix(data, []byte("PK\x03\x04")):
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return err
+		}
+		for _, f := range zr.File {
+			// Only extract the regular files (the directories are created as needed)
+			if !f.Mode().IsRegular() {
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				return err
+			}
+			err = add(f.Name, rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+		}
+	case bytes.HasPrefix(data, []byte("\x1f\x8b")):
+		gr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		tr := tar.NewReader(gr)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			// Skip the directories, the symlinks and the special files
+			if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+				continue
+			}
+			if err := add(hdr.Name, tr); err != nil {
+				return err
+			}
+		}
+	default:
+		return errors.New("unsupported archive format (only .tar.gz and .zip are supported)")
+	}
+	if len(files) == 0 {
+		return errors.New("empty archive")
+	}
+
+	// Strip the top-level directory if all the files share it
+	var prefix string
+	for name := range files {
+		i := strings.Index(name, "/")
+		if i == -1 || (prefix != "" && name[:i+1] != prefix) {
+			prefix = ""
+			break
+		}
+		prefix = name[:i+1]
+	}
+
+	for name, b := range files {
+		p := filepath.Join(dir, filepath.FromSlash(strings.TrimPrefix(name, prefix)))
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(p, b, 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// installedHandler lists and installs the apps
+func (apps *Apps) installedHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !canManage(w, r) {
+			return
+		}
+		switch r.Method {
+		case "GET", "HEAD":
+			httputil.MarshalAndWrite(r, w, map[string]interface{}{
+				"data": apps.Installed(),
+			})
+		case "POST":
+			ia := &InstalledApp{}
+			var archive []byte
+			if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+				// The settings are in the `app` field, and the archive in the `archive` file
+				if r.ContentLength > maxArchiveSize+(1<<20) {
+					httputil.WriteError(w, httputil.NewError(http.StatusRequestEntityTooLarge, errArchiveTooLarge.Error()))
+					return
+				}
+				r.Body = http.MaxBytesReader(w, r.Body, maxArchiveSize+(1<<20))
+				if err := r.ParseMultipartForm(maxArchiveSize); err != nil {
+					httputil.WriteError(w, httputil.BadRequest(err))
+					return
+				}
+				if err := json.Unmarshal([]byte(r.FormValue("app")), ia); err != nil {
+					httputil.WriteError(w, httputil.BadRequest(fmt.Errorf("invalid app field: %v", err)))
+					return
+				}
+				file, _, err := r.FormFile("archive")
+				if err != nil {
+					httputil.WriteError(w, httputil.BadRequest(fmt.Errorf("missing archive: %v", err)))
+					return
+				}
+				defer file.Close()
+				archive, err = ioutil.ReadAll(io.LimitReader(file, maxArchiveSize+1))
+				if err != nil {
+					panic(err)
+				}
+				if len(archive) > maxArchiveSize {
+					httputil.WriteError(w, httputil.NewError(http.StatusRequestEntityTooLarge, errArchiveTooLarge.Error()))
+					return
+				}
+			} else if err := httputil.Unmarshal(r, ia); err != nil {
+				httputil.WriteError(w, err)
+				return
+			}
+			// The archive hash is computed from the uploaded archive
+			ia.Archive = ""
+
+			switch err := apps.Install(r.Context(), ia, archive); err {
+			case nil:
+			case ErrAppExists:
+				httputil.WriteError(w, httputil.Errorf(http.StatusConflict, "app %q already exists", ia.Name))
+				return
+			default:
+				httputil.WriteError(w, err)
+				return
+			}
+			httputil.MarshalAndWrite(r, w, ia, httputil.WithStatusCode(http.StatusCreated))
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// installedAppHandler enables/disables and uninstalls an app
+func (apps *Apps) installedAppHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !canManage(w, r) {
+			return
+		}
+		name := mux.Vars(r)["name"]
+		switch r.Method {
+		case "PATCH":
+			patch := &struct {
+				Enabled *bool `json:"enabled"`
+			}{}
+			if err := httputil.Unmarshal(r, patch); err != nil {
+				httputil.WriteError(w, err)
+				return
+			}
+			if patch.Enabled == nil {
+				httputil.WriteError(w, httputil.NewError(http.StatusBadRequest, "missing enabled field"))
+				return
+			}
+			ia, err := apps.SetEnabled(r.Context(), name, *patch.Enabled)
+			if err != nil {
+				writeInstallError(w, err)
+				return
+			}
+			httputil.MarshalAndWrite(r, w, ia)
+		case "DELETE":
+			if err := apps.Uninstall(r.Context(), name); err != nil {
+				writeInstallError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func writeInstallError(w http.ResponseWriter, err error) {
+	if err == ErrAppNotInstalled {
+		httputil.WriteErrorStatus(w, http.StatusNotFound)
+		return
+	}
+	httputil.WriteError(w, err)
+}
+
+// canManage checks the admin permission (and writes the 403 response if not allowed)
+func canManage(w http.ResponseWriter, r *http.Request) bool {
+	if !auth.Can(
+		w,
+		r,
+		perms.Action(perms.Admin, perms.Config),
+		perms.Resource(perms.Server, perms.Config),
+	) {
+		auth.Forbidden(w)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,125 @@
+package apps
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testTarGz(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for name, content := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(content))
+	}
+	tw.WriteHeader(&tar.Header{Name: "app/link", Linkname: "/etc/passwd", Typeflag: tar.TypeSymlink})
+	tw.Close()
+	gw.Close()
+	return buf.Bytes()
+}
+
+func testZip(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range files {
+		f, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(content))
+	}
+	zw.Close()
+	return buf.Bytes()
+}
+
+func TestExtractArchive(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		data     []byte
+		expected map[string]string
+	}{
+		{
+			"tar.gz stripped",
+			testTarGz(t, map[string]string{"app/app.lua": "app", "app/public/index.html": "index"}),
+			map[string]string{"app.lua": "app", "public/index.html": "index"},
+		},
+		{
+			"zip",
+			testZip(t, map[string]string{"app.lua": "app", "tpl/index.html": "index"}),
+			map[string]string{"app.lua": "app", "tpl/index.html": "index"},
+		},
+	} {
+		dir := t.TempDir()
+		if err := extractArchive(tc.data, dir); err != nil {
+			t.Fatalf("%s: failed to extract: %v", tc.name, err)
+		}
+		for name, content := range tc.expected {
+			data, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+			if err != nil {
+				t.Errorf("%s: %v", tc.name, err)
+				continue
+			}
+			if string(data) != content {
+				t.Errorf("%s: %s: got %q, expected %q", tc.name, name, data, content)
+			}
+		}
+		if _, err := ioutil.ReadFile(filepath.Join(dir, "link")); err == nil {
+			t.Errorf("%s: the symlink should be skipped", tc.name)
+		}
+	}
+
+	for _, data := range [][]byte{
+		testTarGz(t, map[string]string{"../evil.lua": "evil"}),
+		testZip(t, map[string]string{"app/../../evil.lua": "evil"}),
+		testZip(t, map[string]string{"/etc/evil.lua": "evil"}),
+		[]byte("not an archive"),
+	} {
+		if err := extractArchive(data, t.TempDir()); err == nil {
+			t.Errorf("expected an error for %q", data[:8])
+		}
+	}
+}
+
+func TestInstalledAppValidate(t *testing.T) {
+	for _, tc := range []struct {
+		ia  *InstalledApp
+		err string
+	}{
+		{&InstalledApp{Name: "blog", Remote: "https://github.com/tsileo/blog"}, ""},
+		{&InstalledApp{Name: "blog", Archive: "abcd", Routes: []string{"/feed.xml"}}, ""},
+		{&InstalledApp{Name: "Blog", Remote: "https://github.com/tsileo/blog"}, "invalid app name"},
+		{&InstalledApp{Name: "../blog", Remote: "https://github.com/tsileo/blog"}, "invalid app name"},
+		{&InstalledApp{Name: "blog"}, "either a remote, a FS or an archive"},
+		{&InstalledApp{Name: "blog", Remote: "https://github.com/tsileo/blog", Archive: "abcd"}, "either a remote, a FS or an archive"},
+		{&InstalledApp{Name: "blog", Remote: "https://github.com/tsileo/blog#v1#v2"}, "invalid remote"},
+		{&InstalledApp{Name: "blog", Archive: "abcd", Routes: []string{"feed.xml"}}, "must be an absolute path"},
+		{&InstalledApp{Name: "blog", FS: "blog@v1", Scopes: []string{"docstore"}}, ""},
+		{&InstalledApp{Name: "blog", FS: "blog", Scopes: []string{"network"}}, "unknown scope"},
+	} {
+		err := tc.ia.validate()
+		if tc.err == "" {
+			if err != nil {
+				t.Errorf("%+v: unexpected error %v", tc.ia, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%+v: expected error %q, got %v", tc.ia, tc.err, err)
+		}
+	}
+
+	ia := &InstalledApp{Name: "blog", Remote: "https://github.com/tsileo/blog"}
+	ia.validate()
+	if ia.Remote != "https://github.com/tsileo/blog#master" {
+		t.Errorf("remote ref not defaulted: %q", ia.Remote)
+	}
+}
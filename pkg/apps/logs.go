@@ -0,0 +1,106 @@
+package apps // import "a4.io/blobstash/pkg/apps"
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+)
+
+// Number of log records kept per app (for the admin UI)
+const logBufferSize = 200
+
+// LogRecord is a log entry of an app
+type LogRecord struct {
+	Time  time.Time         `json:"time"`
+	Level string            `json:"level"`
+	Msg   string            `json:"msg"`
+	Ctx   map[string]string `json:"ctx,omitempty"`
+}
+
+// logBuffer keeps the latest log records of an app (it implements log15.Handler)
+type logBuffer struct {
+	records []*LogRecord
+	next    int
+	full    bool
+	mu      sync.Mutex
+}
+
+func newLogBuffer(size int) *logBuffer {
+	return &logBuffer{records: make([]*LogRecord, size)}
+}
+
+// Log implements log15.Handler
+func (b *logBuffer) Log(r *log.Record) error {
+	rec := &LogRecord{
+		Time:  r.Time,
+		Level: r.Lvl.String(),
+		Msg:   r.Msg,
+	}
+	if len(r.Ctx) > 0 {
+		rec.Ctx = map[string]string{}
+		for i := 0; i+1 < len(r.Ctx); i += 2 {
+			rec.Ctx[fmt.Sprint(r.Ctx[i])] = fmt.Sprint(r.Ctx[i+1])
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.records[b.next] = rec
+	b.next = (b.next + 1) % len(b.records)
+	if b.next == 0 {
+		b.full = true
+	}
+	return nil
+}
+
+// Records returns the buffered records (oldest first)
+func (b *logBuffer) Records() []*LogRecord {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	out := []*LogRecord{}
+	if b.full {
+		out = append(out, b.records[b.next:]...)
+	}
+	return append(out, b.records[:b.next]...)
+}
+
+// AppInfo holds the info about a registered app (for the admin API)
+type AppInfo struct {
+	Name      string `json:"name"`
+	Path      string `json:"path,omitempty"`
+	Domain    string `json:"domain,omitempty"`
+	Remote    string `json:"remote,omitempty"`
+	Proxy     string `json:"proxy,omitempty"`
+	Scheduled string `json:"scheduled,omitempty"`
+	Ready     bool   `json:"ready"`
+}
+
+// Infos returns the registered apps (sorted by name)
+func (apps *Apps) Infos() []*AppInfo {
+	out := []*AppInfo{}
+	for _, app := range apps.Apps() {
+		out = append(out, &AppInfo{
+			Name:      app.name,
+			Path:      app.appConf.Path,
+			Domain:    app.domain,
+			Remote:    app.remote,
+			Proxy:     app.appConf.Proxy,
+			Scheduled: app.scheduled,
+			Ready:     apps.warmup.IsReady(app.warmupName()),
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// Logs returns the latest log records of the app
+func (apps *Apps) Logs(name string) ([]*LogRecord, bool) {
+	app, ok := apps.getApp(name)
+	if !ok {
+		return nil, false
+	}
+	return app.logs.Records(), true
+}
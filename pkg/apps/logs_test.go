@@ -0,0 +1,36 @@
+package apps
+
+import (
+	"fmt"
+	"testing"
+
+	log "github.com/inconshreveable/log15"
+)
+
+func TestLogBuffer(t *testing.T) {
+	b := newLogBuffer(3)
+	l := log.New()
+	l.SetHandler(b)
+
+	if recs := b.Records(); len(recs) != 0 {
+		t.Fatalf("expected no records, got %d", len(recs))
+	}
+	l.Info("first", "k", 1)
+	recs := b.Records()
+	if len(recs) != 1 || recs[0].Msg != "first" || recs[0].Level != "info" || recs[0].Ctx["k"] != "1" {
+		t.Fatalf("unexpected records %+v", recs)
+	}
+
+	for i := 0; i < 5; i++ {
+		l.Warn(fmt.Sprintf("msg%d", i))
+	}
+	recs = b.Records()
+	if len(recs) != 3 {
+		t.Fatalf("expected 3 records, got %d", len(recs))
+	}
+	for i, rec := range recs {
+		if expected := fmt.Sprintf("msg%d", i+2); rec.Msg != expected {
+			t.Errorf("record %d: got %q, expected %q", i, rec.Msg, expected)
+		}
+	}
+}
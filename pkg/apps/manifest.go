@@ -0,0 +1,322 @@
+package apps // import "a4.io/blobstash/pkg/apps"
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron"
+	yaml "gopkg.in/yaml.v2"
+
+	"a4.io/gluapp"
+)
+
+// App manifest
+//
+// An app can ship an `app.yaml` file at its root to describe itself:
+//
+//	name: blog
+//	entrypoint: app.lua
+//	scopes: [docstore, filetree]
+//	config:
+//	  title: {type: string, required: true}
+//	  per_page: {type: number, default: 10}
+//	jobs:
+//	  - name: cleanup
+//	    schedule: '@every 1h'
+//	    script: jobs/cleanup.lua
+//
+// The manifest is read when the app is (re)loaded: the app config is validated against the schema (and the defaults
+// are applied), the jobs are scheduled, and the app only gets the Lua modules listed in `scopes` (the apps without a
+// manifest get all of them). The app config `scopes` item lists the scopes granted by the admin, an app requiring
+// more is rejected.
+
+// ManifestFile is the name of the app manifest
+const ManifestFile = "app.yaml"
+
+// Scopes that can be required by an app (each scope is a Lua module)
+var validScopes = map[string]struct{}{
+	"blobstore": {},
+	"docstore":  {},
+	"filetree":  {},
+	"kvstore":   {},
+	"apps":      {},
+	"notify":    {},
+}
+
+// Types supported in the config schema
+var validConfigTypes = map[string]struct{}{
+	"string": {},
+	"number": {},
+	"bool":   {},
+	"list":   {},
+	"map":    {},
+}
+
+// Manifest is the content of the `app.yaml` file
+type Manifest struct {
+	Name       string                  `yaml:"name"`
+	Entrypoint string                  `yaml:"entrypoint"`
+	Scopes     []string                `yaml:"scopes"`
+	Config     map[string]*ConfigField `yaml:"config"`
+	Jobs       []*Job                  `yaml:"jobs"`
+}
+
+// ConfigField describes an app config item
+type ConfigField struct {
+	Type        string      `yaml:"type"`
+	Required    bool        `yaml:"required"`
+	Default     interface{} `yaml:"default"`
+	Description string      `yaml:"description"`
+}
+
+// Job is a Lua script executed periodically
+type Job struct {
+	Name     string `yaml:"name"`
+	Schedule string `yaml:"schedule"`
+	Script   string `yaml:"script"`
+}
+
+// readManifest parses the manifest of the app at dir, returns nil if the app has no manifest
+func readManifest(dir string) (*Manifest, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, ManifestFile))
+	switch {
+	case err == nil:
+	case os.IsNotExist(err):
+		return nil, nil
+	default:
+		return nil, err
+	}
+	m := &Manifest{}
+	if err := yaml.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", ManifestFile, err)
+	}
+	if err := m.validate(dir); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", ManifestFile, err)
+	}
+	return m, nil
+}
+
+// validate checks the manifest, the scripts must exist in dir
+func (m *Manifest) validate(dir string) error {
+	if m.Name != "" && !validAppName.MatchString(m.Name) {
+		return fmt.Errorf("invalid name %q", m.Name)
+	}
+	if m.Entrypoint != "" && !validScriptPath(m.Entrypoint) {
+		return fmt.Errorf("invalid entrypoint %q", m.Entrypoint)
+	}
+	for _, scope := range m.Scopes {
+		if _, ok := validScopes[scope]; !ok {
+			return fmt.Errorf("unknown scope %q", scope)
+		}
+	}
+	for name, field := range m.Config {
+		if field == nil {
+			return fmt.Errorf("config %q: missing type", name)
+		}
+		if _, ok := validConfigTypes[field.Type]; !ok {
+			return fmt.Errorf("config %q: unknown type %q", name, field.Type)
+		}
+		if field.Default != nil {
+			if err := checkConfigType(field.Type, field.Default); err != nil {
+				return fmt.Errorf("config %q: invalid default: %v", name, err)
+			}
+		}
+	}
+	names := map[string]struct{}{}
+	for _, job := range m.Jobs {
+		if job.Name == "" {
+			return errors.New("job: missing name")
+		}
+		if _, ok := names[job.Name]; ok {
+			return fmt.Errorf("job %q: duplicate name", job.Name)
+		}
+		names[job.Name] = struct{}{}
+		if _, err := cron.Parse(job.Schedule); err != nil {
+			return fmt.Errorf("job %q: invalid schedule: %v", job.Name, err)
+		}
+		if !validScriptPath(job.Script) {
+			return fmt.Errorf("job %q: invalid script %q", job.Name, job.Script)
+		}
+		if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(job.Script))); err != nil {
+			return fmt.Errorf("job %q: script not found: %v", job.Name, err)
+		}
+	}
+	return nil
+}
+
+// validScriptPath returns true if the path is a clean relative path to a Lua file
+func validScriptPath(p string) bool {
+	return strings.HasSuffix(p, ".lua") && !strings.HasPrefix(p, "/") && path.Clean(p) == p && !containsDotDot(p)
+}
+
+// checkScopes returns an error if the manifest requires scopes not granted in the app config (nil means no
+// restriction)
+func (m *Manifest) checkScopes(granted []string) error {
+	if granted == nil {
+		return nil
+	}
+	missing := []string{}
+	for _, scope := range m.Scopes {
+		var ok bool
+		for _, g := range granted {
+			if g == scope {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			missing = append(missing, scope)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("scopes not granted: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// applyConfig validates the app config against the schema, and returns a copy with the defaults set (the items not
+// defined in the schema are kept as is)
+func (m *Manifest) applyConfig(conf map[string]interface{}) (map[string]interface{}, error) {
+	out := make(map[string]interface{}, len(conf)+len(m.Config))
+	for k, v := range conf {
+		out[k] = v
+	}
+	names := make([]string, 0, len(m.Config))
+	for name := range m.Config {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		field := m.Config[name]
+		v, ok := out[name]
+		if !ok || v == nil {
+			if field.Default != nil {
+				out[name] = field.Default
+				continue
+			}
+			if field.Required {
+				return nil, fmt.Errorf("missing config %q", name)
+			}
+			continue
+		}
+		if err := checkConfigType(field.Type, v); err != nil {
+			return nil, fmt.Errorf("config %q: %v", name, err)
+		}
+	}
+	return out, nil
+}
+
+// checkConfigType checks the type of a config value (as decoded from YAML or JSON)
+func checkConfigType(typ string, v interface{}) error {
+	var ok bool
+	switch typ {
+	case "string":
+		_, ok = v.(string)
+	case "number":
+		switch v.(type) {
+		case int, int64, uint64, float64:
+			ok = true
+		}
+	case "bool":
+		_, ok = v.(bool)
+	case "list":
+		_, ok = v.([]interface{})
+	case "map":
+		switch v.(type) {
+		case map[string]interface{}, map[interface{}]interface{}:
+			ok = true
+		}
+	}
+	if !ok {
+		return fmt.Errorf("expected a %s, got %T", typ, v)
+	}
+	return nil
+}
+
+// can returns true if the app has been granted the scope
+func (app *App) can(scope string) bool {
+	if app.manifest == nil {
+		return true
+	}
+	for _, s := range app.manifest.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// loadManifest reads the app manifest (if any) and applies it to the app
+func (app *App) loadManifest() error {
+	m, err := readManifest(app.path)
+	if err != nil || m == nil {
+		return err
+	}
+	if err := m.checkScopes(app.appConf.Scopes); err != nil {
+		return err
+	}
+	conf, err := m.applyConfig(app.appConf.Config)
+	if err != nil {
+		return err
+	}
+	app.config = conf
+	// The config entrypoint takes precedence
+	if app.entrypoint == "" {
+		app.entrypoint = m.Entrypoint
+	}
+	app.manifest = m
+	return nil
+}
+
+// scheduleJobs starts the jobs defined in the manifest (they're stopped when the app is unloaded)
+func (apps *Apps) scheduleJobs(app *App) {
+	if app.manifest == nil || len(app.manifest.Jobs) == 0 {
+		return
+	}
+	app.jobs = cron.New()
+	for _, job := range app.manifest.Jobs {
+		job := job
+		if err := app.jobs.AddFunc(job.Schedule, func() {
+			app.runJob(job)
+		}); err != nil {
+			app.log.Error("failed to schedule job", "job", job.Name, "err", err)
+		}
+	}
+	app.jobs.Start()
+}
+
+// jobResponseWriter discards the response of a job
+type jobResponseWriter struct {
+	header http.Header
+}
+
+func (w *jobResponseWriter) Header() http.Header         { return w.header }
+func (w *jobResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *jobResponseWriter) WriteHeader(int)             {}
+
+// runJob executes the job script (with the same modules as the app requests)
+func (app *App) runJob(job *Job) {
+	t := time.Now()
+	code, err := ioutil.ReadFile(filepath.Join(app.path, filepath.FromSlash(job.Script)))
+	if err != nil {
+		app.log.Error("failed to read job script", "job", job.Name, "err", err)
+		return
+	}
+	req, err := http.NewRequest("POST", "/", http.NoBody)
+	if err != nil {
+		panic(err)
+	}
+	if err := gluapp.Exec(app.luaConf, string(code), &jobResponseWriter{header: http.Header{}}, req); err != nil {
+		app.log.Error("job failed", "job", job.Name, "err", err)
+		return
+	}
+	app.log.Info("job executed", "job", job.Name, "duration", time.Since(t))
+}
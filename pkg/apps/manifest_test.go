@@ -0,0 +1,103 @@
+package apps
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadManifest(t *testing.T) {
+	dir := t.TempDir()
+	if m, err := readManifest(dir); m != nil || err != nil {
+		t.Fatalf("expected no manifest, got %+v, %v", m, err)
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, "jobs"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "jobs", "cleanup.lua"), []byte("log('ok')"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	manifest := `
+name: blog
+entrypoint: main.lua
+scopes: [docstore, kvstore]
+config:
+  title: {type: string, required: true}
+  per_page: {type: number, default: 10}
+  tags: {type: list}
+jobs:
+  - name: cleanup
+    schedule: '@every 1h'
+    script: jobs/cleanup.lua
+`
+	if err := ioutil.WriteFile(filepath.Join(dir, ManifestFile), []byte(manifest), 0600); err != nil {
+		t.Fatal(err)
+	}
+	m, err := readManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Name != "blog" || m.Entrypoint != "main.lua" || len(m.Jobs) != 1 || len(m.Config) != 3 {
+		t.Fatalf("unexpected manifest %+v", m)
+	}
+
+	app := &App{manifest: m}
+	if !app.can("docstore") || app.can("filetree") {
+		t.Errorf("unexpected scopes")
+	}
+	if !(&App{}).can("filetree") {
+		t.Errorf("the apps without manifest should get all the scopes")
+	}
+
+	if err := m.checkScopes(nil); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := m.checkScopes([]string{"docstore", "kvstore", "filetree"}); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := m.checkScopes([]string{"docstore"}); err == nil || !strings.Contains(err.Error(), "kvstore") {
+		t.Errorf("expected a kvstore scope error, got %v", err)
+	}
+
+	conf, err := m.applyConfig(map[string]interface{}{"title": "My blog", "extra": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[string]interface{}{"title": "My blog", "per_page": 10, "extra": true}; !reflect.DeepEqual(conf, expected) {
+		t.Errorf("got config %+v, expected %+v", conf, expected)
+	}
+	if _, err := m.applyConfig(nil); err == nil || !strings.Contains(err.Error(), "missing config \"title\"") {
+		t.Errorf("expected a missing config error, got %v", err)
+	}
+	if _, err := m.applyConfig(map[string]interface{}{"title": "x", "tags": "a,b"}); err == nil {
+		t.Errorf("expected a type error")
+	}
+}
+
+func TestInvalidManifest(t *testing.T) {
+	for _, tc := range []struct {
+		manifest, err string
+	}{
+		{"name: Blog", "invalid name"},
+		{"entrypoint: ../app.lua", "invalid entrypoint"},
+		{"scopes: [network]", "unknown scope"},
+		{"config: {title: {type: text}}", "unknown type"},
+		{"config: {title: {type: number, default: ten}}", "invalid default"},
+		{"jobs: [{name: a, schedule: 'nope', script: a.lua}]", "invalid schedule"},
+		{"jobs: [{name: a, schedule: '@daily', script: /etc/a.lua}]", "invalid script"},
+		{"jobs: [{name: a, schedule: '@daily', script: missing.lua}]", "script not found"},
+		{"name: [", "invalid app.yaml"},
+	} {
+		dir := t.TempDir()
+		if err := ioutil.WriteFile(filepath.Join(dir, ManifestFile), []byte(tc.manifest), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readManifest(dir); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%q: expected error %q, got %v", tc.manifest, tc.err, err)
+		}
+	}
+}
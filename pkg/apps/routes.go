@@ -0,0 +1,116 @@
+package apps // import "a4.io/blobstash/pkg/apps"
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"a4.io/blobstash/pkg/warmup"
+)
+
+// Custom top-level routes
+//
+// An app can mount additional paths on the root router (e.g. `/.well-known/webfinger` or `/feed.xml`) using the
+// `routes` config item, so protocol endpoints can be implemented in Lua. Only exact paths are supported, and a
+// path cannot be mounted by more than one app, shadow a core route or be in the /api/ namespace.
+
+// validRoute returns an error if the route is not a clean absolute path
+func validRoute(p string) error {
+	if !strings.HasPrefix(p, "/") || p == "/" {
+		return fmt.Errorf("route %q must be an absolute path", p)
+	}
+	if path.Clean(p) != p || containsDotDot(p) {
+		return fmt.Errorf("route %q is not a clean path", p)
+	}
+	return nil
+}
+
+// buildRoutes returns the path => app name mapping, and checks for conflicts (between apps and with the core
+// routes)
+func (apps *Apps) buildRoutes(newApps map[string]*App) (map[string]string, error) {
+	routes := map[string]string{}
+	for name, app := range newApps {
+		for _, p := range app.appConf.Routes {
+			if err := validRoute(p); err != nil {
+				return nil, fmt.Errorf("app %q: %v", name, err)
+			}
+			if other, ok := routes[p]; ok {
+				return nil, fmt.Errorf("app %q: route %q is already registered by app %q", name, p, other)
+			}
+			if err := apps.checkCoreRoute(p); err != nil {
+				return nil, fmt.Errorf("app %q: %v", name, err)
+			}
+			routes[p] = name
+		}
+	}
+	return routes, nil
+}
+
+var errRouteConflict = errors.New("route conflict")
+
+// checkCoreRoute returns an error if the path is already handled by the root router (only checked once the
+// routes are registered)
+func (apps *Apps) checkCoreRoute(p string) error {
+	// The API namespace is reserved, even for the paths not (yet) handled
+	if strings.HasPrefix(p, "/api/") {
+		return fmt.Errorf("route %q is in the reserved /api/ namespace", p)
+	}
+	if apps.root == nil {
+		return nil
+	}
+	req := &http.Request{Method: "GET", URL: &url.URL{Path: p}, Header: http.Header{}}
+	err := apps.root.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		if route != apps.routesRoute && route != apps.domainsRoute && route.Match(req, &mux.RouteMatch{}) {
+			return errRouteConflict
+		}
+		// Only check the top-level routes (the subrouters are matched by their parent route)
+		return mux.SkipRouter
+	})
+	switch err {
+	case nil:
+		return nil
+	case errRouteConflict:
+		return fmt.Errorf("route %q conflicts with a core route", p)
+	default:
+		return err
+	}
+}
+
+// CheckRoutes checks the apps routes against the core routes, must be called once all the routes are registered
+func (apps *Apps) CheckRoutes() error {
+	apps.Lock()
+	defer apps.Unlock()
+	_, err := apps.buildRoutes(apps.apps)
+	return err
+}
+
+func (apps *Apps) getAppByRoute(p string) (*App, bool) {
+	apps.Lock()
+	defer apps.Unlock()
+	name, ok := apps.routes[p]
+	if !ok {
+		return nil, false
+	}
+	app, ok := apps.apps[name]
+	return app, ok
+}
+
+func (apps *Apps) routeHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		app, ok := apps.getAppByRoute(r.URL.Path)
+		if !ok {
+			handle404(w)
+			return
+		}
+		if !apps.warmup.IsReady(app.warmupName()) {
+			warmup.NotReady(w, app.warmupName())
+			return
+		}
+		app.serve(r.Context(), r.URL.Path, w, r)
+	}
+}
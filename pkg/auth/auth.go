@@ -5,6 +5,7 @@ import (
 	"encoding/base64"
 	"fmt"
 	"net/http"
+	"sync"
 
 	"a4.io/blobstash/pkg/config"
 	"a4.io/blobstash/pkg/httputil"
@@ -20,6 +21,7 @@ type key int
 const authKey key = 0
 
 var auths = []*Auth{}
+var mu sync.RWMutex
 var logger log.Logger
 
 type Auth struct {
@@ -27,36 +29,59 @@ type Auth struct {
 	roles    rbac.Roles
 	Username string
 	Password string
+	Tenant   string
 	encoded  []byte
 	sroles   []string
 }
 
+// Setup (re-)loads the roles and the credentials defined in the config
 func Setup(conf *config.Config, l log.Logger) error {
-	if err := perms.Setup(conf); err != nil {
+	apply, err := Load(conf, l)
+	if err != nil {
 		return err
 	}
-	logger = l
+	apply()
+	return nil
+}
+
+// Load loads the roles and the credentials defined in the config, they're only used once the returned func is called
+func Load(conf *config.Config, l log.Logger) (func(), error) {
+	rs, err := perms.Load(conf)
+	if err != nil {
+		return nil, err
+	}
+	newAuths := []*Auth{}
 	for _, c := range conf.Auth {
-		roles, err := perms.GetRoles(c.Roles)
+		roles, err := rs.GetRoles(c.Roles)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		encoded := "Basic " + base64.StdEncoding.EncodeToString([]byte(c.Username+":"+c.Password))
-		auths = append(auths, &Auth{
+		newAuths = append(newAuths, &Auth{
 			ID:       c.ID,
 			roles:    roles,
 			sroles:   c.Roles,
 			Username: c.Username,
 			Password: c.Password,
+			Tenant:   c.Tenant,
 			encoded:  []byte(encoded),
 		})
 	}
-	return nil
+	return func() {
+		rs.Apply()
+		logger = l
+		mu.Lock()
+		defer mu.Unlock()
+		auths = newAuths
+	}, nil
 }
 
 func Check(req *http.Request) bool {
 	h := req.Header.Get("Authorization")
-	for _, auth := range auths {
+	mu.RLock()
+	current := auths
+	mu.RUnlock()
+	for _, auth := range current {
 		if subtle.ConstantTimeCompare([]byte(h), auth.encoded) == 1 {
 			logger.Debug("successful auth", "auth", auth.ID, "roles", auth.sroles)
 			gcontext.Set(req, authKey, auth)
@@ -66,6 +91,15 @@ func Check(req *http.Request) bool {
 	return false
 }
 
+// Tenant returns the tenant of the authenticated request (empty if none)
+func Tenant(r *http.Request) string {
+	a, ok := gcontext.GetOk(r, authKey)
+	if !ok {
+		return ""
+	}
+	return a.(*Auth).Tenant
+}
+
 func Can(w http.ResponseWriter, r *http.Request, action, resource string) bool {
 	auth, ok := gcontext.GetOk(r, authKey)
 	if !ok {
@@ -0,0 +1,189 @@
+/*
+Package mem implements an in-memory blobs backend (for the tests).
+
+It satisfies the same interface as the BlobsFile (`mirror.Replica`), the blobs are lost when the backend is closed.
+*/
+package mem // import "a4.io/blobstash/pkg/backend/mem"
+
+import (
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+
+	"a4.io/blobsfile"
+)
+
+// ErrClosed is returned when using a closed backend
+var ErrClosed = errors.New("mem backend closed")
+
+// Mem stores the blobs in memory
+type Mem struct {
+	mu     sync.RWMutex
+	blobs  map[string][]byte
+	hashes []string // sorted
+	closed bool
+}
+
+// New initializes an empty backend
+func New() *Mem {
+	return &Mem{
+		blobs:  map[string][]byte{},
+		hashes: []string{},
+	}
+}
+
+// Put stores the blob (a no-op if it's already stored)
+func (m *Mem) Put(hash string, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return ErrClosed
+	}
+	if _, ok := m.blobs[hash]; ok {
+		return nil
+	}
+	buf := make([]byte, len(data))
+	copy(buf, data)
+	m.blobs[hash] = buf
+
+	i := sort.SearchStrings(m.hashes, hash)
+	m.hashes = append(m.hashes, "")
+	copy(m.hashes[i+1:], m.hashes[i:])
+	m.hashes[i] = hash
+	return nil
+}
+
+// Get returns the blob content
+func (m *Mem) Get(hash string) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed {
+		return nil, ErrClosed
+	}
+	data, ok := m.blobs[hash]
+	if !ok {
+		return nil, blobsfile.ErrBlobNotFound
+	}
+	buf := make([]byte, len(data))
+	copy(buf, data)
+	return buf, nil
+}
+
+// Exists returns true if the blob is stored
+func (m *Mem) Exists(hash string) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed {
+		return false, ErrClosed
+	}
+	_, ok := m.blobs[hash]
+	return ok, nil
+}
+
+// Size returns the size of the blob
+func (m *Mem) Size(hash string) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed {
+		return 0, ErrClosed
+	}
+	data, ok := m.blobs[hash]
+	if !ok {
+		return 0, blobsfile.ErrBlobNotFound
+	}
+	return len(data), nil
+}
+
+// Enumerate sends the blobs from start (an hex hash, inclusive) to end (inclusive, not bounded if it's not an hex
+// hash, like the "\xff" used by the callers) in the channel, and closes it
+func (m *Mem) Enumerate(blobs chan<- *blobsfile.Blob, start, end string, limit int) error {
+	defer close(blobs)
+	if _, err := hex.DecodeString(start); err != nil {
+		return err
+	}
+	bounded := false
+	if _, err := hex.DecodeString(end); err == nil && end != "" {
+		bounded = true
+	}
+	return m.enumerate(blobs, limit, func(hash string) (bool, bool) {
+		if hash < start {
+			return false, true
+		}
+		if bounded && hash > end {
+			return false, false
+		}
+		return true, true
+	})
+}
+
+// EnumeratePrefix sends the blobs whose hash starts with prefix in the channel, and closes it
+func (m *Mem) EnumeratePrefix(blobs chan<- *blobsfile.Blob, prefix string, limit int) error {
+	defer close(blobs)
+	if _, err := hex.DecodeString(prefix); err != nil {
+		return err
+	}
+	return m.enumerate(blobs, limit, func(hash string) (bool, bool) {
+		if strings.HasPrefix(hash, prefix) {
+			return true, true
+		}
+		return false, hash < prefix
+	})
+}
+
+// enumerate iterates the sorted hashes, match returns (send the blob, continue)
+func (m *Mem) enumerate(blobs chan<- *blobsfile.Blob, limit int, match func(string) (bool, bool)) error {
+	m.mu.RLock()
+	if m.closed {
+		m.mu.RUnlock()
+		return ErrClosed
+	}
+	out := []*blobsfile.Blob{}
+	for _, hash := range m.hashes {
+		if limit != 0 && len(out) == limit {
+			break
+		}
+		send, cont := match(hash)
+		if !cont {
+			break
+		}
+		if send {
+			out = append(out, &blobsfile.Blob{Hash: hash, Size: len(m.blobs[hash])})
+		}
+	}
+	m.mu.RUnlock()
+
+	// Don't hold the lock while the consumer reads the channel
+	for _, b := range out {
+		blobs <- b
+	}
+	return nil
+}
+
+// CheckBlobsFiles does nothing (there's nothing to corrupt on disk)
+func (m *Mem) CheckBlobsFiles() error {
+	return nil
+}
+
+// Close releases the blobs
+func (m *Mem) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed = true
+	m.blobs = nil
+	m.hashes = nil
+	return nil
+}
+
+// Stats returns the stats in the BlobsFile format (the blobs are not compressed)
+func (m *Mem) Stats() *blobsfile.Stats {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	stats := &blobsfile.Stats{BlobsCount: len(m.hashes)}
+	for _, data := range m.blobs {
+		stats.BlobsSize += int64(len(data))
+	}
+	stats.BlobsFilesSize = stats.BlobsSize
+	return stats
+}
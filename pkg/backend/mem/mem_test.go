@@ -0,0 +1,73 @@
+package mem
+
+import (
+	"testing"
+
+	"a4.io/blobsfile"
+
+	"a4.io/blobstash/pkg/backend/mirror"
+	"a4.io/blobstash/pkg/hashutil"
+)
+
+var _ mirror.Replica = &Mem{}
+
+func hashes(t *testing.T, enum func(chan<- *blobsfile.Blob) error) []string {
+	blobs := make(chan *blobsfile.Blob)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- enum(blobs)
+	}()
+	out := []string{}
+	for b := range blobs {
+		out = append(out, b.Hash)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestMem(t *testing.T) {
+	m := New()
+	all := []string{}
+	for _, d := range []string{"a", "b", "c", "d"} {
+		h := hashutil.Compute([]byte(d))
+		if err := m.Put(h, []byte(d)); err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, h)
+	}
+	// Deduped
+	if err := m.Put(all[0], []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if stats := m.Stats(); stats.BlobsCount != 4 || stats.BlobsSize != 4 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if _, err := m.Get("deadbeef"); err != blobsfile.ErrBlobNotFound {
+		t.Errorf("expected ErrBlobNotFound, got %v", err)
+	}
+	data, err := m.Get(all[2])
+	if err != nil || string(data) != "c" {
+		t.Errorf("failed to get blob, got %q (%v)", data, err)
+	}
+
+	sorted := hashes(t, func(c chan<- *blobsfile.Blob) error { return m.Enumerate(c, "", "\xff", 0) })
+	if len(sorted) != 4 {
+		t.Fatalf("expected 4 blobs, got %d", len(sorted))
+	}
+	for i := 1; i < len(sorted); i++ {
+		if sorted[i-1] >= sorted[i] {
+			t.Errorf("blobs not sorted: %q", sorted)
+		}
+	}
+	if got := hashes(t, func(c chan<- *blobsfile.Blob) error { return m.Enumerate(c, sorted[1], sorted[2], 0) }); len(got) != 2 || got[0] != sorted[1] {
+		t.Errorf("unexpected range %q", got)
+	}
+	if got := hashes(t, func(c chan<- *blobsfile.Blob) error { return m.Enumerate(c, "", "\xff", 3) }); len(got) != 3 {
+		t.Errorf("expected 3 blobs, got %d", len(got))
+	}
+	if got := hashes(t, func(c chan<- *blobsfile.Blob) error { return m.EnumeratePrefix(c, sorted[3][:4], 0) }); len(got) != 1 || got[0] != sorted[3] {
+		t.Errorf("unexpected prefix enumeration %q", got)
+	}
+}
@@ -0,0 +1,323 @@
+/*
+Package mirror implements a RAID-1 like backend on top of multiple BlobsFiles (e.g. one per disk).
+
+Every blob is written synchronously to all the healthy replicas, and read from the first healthy one (falling back to
+the next replicas on error). A replica is marked as unhealthy (and skipped until the next restart) after an I/O error.
+
+The consistency checker compares the replicas and reports the divergences (missing or corrupted blobs).
+*/
+package mirror // import "a4.io/blobstash/pkg/backend/mirror"
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobsfile"
+
+	"a4.io/blobstash/pkg/hashutil"
+)
+
+// ErrNoHealthyReplica is returned when all the replicas failed
+var ErrNoHealthyReplica = errors.New("no healthy replica")
+
+// Replica is a single copy of the blobs (satisfied by `*blobsfile.BlobsFiles`)
+type Replica interface {
+	Put(hash string, data []byte) error
+	Get(hash string) ([]byte, error)
+	Exists(hash string) (bool, error)
+	Size(hash string) (int, error)
+	Enumerate(blobs chan<- *blobsfile.Blob, start, end string, limit int) error
+	EnumeratePrefix(blobs chan<- *blobsfile.Blob, prefix string, limit int) error
+	CheckBlobsFiles() error
+	Close() error
+}
+
+type replica struct {
+	name    string
+	back    Replica
+	healthy bool
+	err     error
+}
+
+// Mirror writes the blobs to all the replicas
+type Mirror struct {
+	replicas []*replica
+	log      log.Logger
+	mu       sync.Mutex
+}
+
+// New initializes a mirror, the first replica is the primary one
+func New(logger log.Logger, names []string, replicas []Replica) (*Mirror, error) {
+	if len(replicas) == 0 || len(names) != len(replicas) {
+		return nil, fmt.Errorf("invalid mirror replicas")
+	}
+	m := &Mirror{
+		log: logger,
+	}
+	for i, back := range replicas {
+		m.replicas = append(m.replicas, &replica{name: names[i], back: back, healthy: true})
+	}
+	return m, nil
+}
+
+// healthyReplicas returns the healthy replicas (in order)
+func (m *Mirror) healthyReplicas() []*replica {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := []*replica{}
+	for _, r := range m.replicas {
+		if r.healthy {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// markUnhealthy removes the replica from the rotation
+func (m *Mirror) markUnhealthy(r *replica, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !r.healthy {
+		return
+	}
+	r.healthy = false
+	r.err = err
+	m.log.Error("replica marked as unhealthy", "replica", r.name, "err", err)
+}
+
+// Put writes the blob to all the healthy replicas, it only fails if no replica stored the blob
+func (m *Mirror) Put(hash string, data []byte) error {
+	var saved int
+	for _, r := range m.healthyReplicas() {
+		if err := r.back.Put(hash, data); err != nil {
+			m.markUnhealthy(r, err)
+			continue
+		}
+		saved++
+	}
+	if saved == 0 {
+		return ErrNoHealthyReplica
+	}
+	return nil
+}
+
+// safeGet reads the blob (BlobsFile panics if the data does not match the hash)
+func safeGet(back Replica, hash string) (data []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	data, err = back.Get(hash)
+	if err != nil {
+		return nil, err
+	}
+	if !hashutil.Verify(hash, data) {
+		return nil, fmt.Errorf("hash mismatch, got %s", hashutil.Compute(data))
+	}
+	return data, nil
+}
+
+// Get reads the blob from the first healthy replica (the next replicas are tried if the blob is missing/corrupted)
+func (m *Mirror) Get(hash string) ([]byte, error) {
+	var lastErr error = ErrNoHealthyReplica
+	for _, r := range m.healthyReplicas() {
+		data, err := safeGet(r.back, hash)
+		if err == nil {
+			return data, nil
+		}
+		if err != blobsfile.ErrBlobNotFound {
+			m.log.Error("failed to read blob from replica", "replica", r.name, "hash", hash, "err", err)
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// Exists returns true if the blob is stored in the first healthy replica
+func (m *Mirror) Exists(hash string) (bool, error) {
+	for _, r := range m.healthyReplicas() {
+		exists, err := r.back.Exists(hash)
+		if err != nil {
+			m.markUnhealthy(r, err)
+			continue
+		}
+		return exists, nil
+	}
+	return false, ErrNoHealthyReplica
+}
+
+// Size returns the blob size using the first healthy replica
+func (m *Mirror) Size(hash string) (int, error) {
+	var lastErr error = ErrNoHealthyReplica
+	for _, r := range m.healthyReplicas() {
+		size, err := r.back.Size(hash)
+		if err == nil {
+			return size, nil
+		}
+		lastErr = err
+	}
+	return 0, lastErr
+}
+
+// first returns the first healthy replica
+func (m *Mirror) first() (*replica, error) {
+	healthy := m.healthyReplicas()
+	if len(healthy) == 0 {
+		return nil, ErrNoHealthyReplica
+	}
+	return healthy[0], nil
+}
+
+// Enumerate enumerates the blobs of the first healthy replica
+func (m *Mirror) Enumerate(blobs chan<- *blobsfile.Blob, start, end string, limit int) error {
+	r, err := m.first()
+	if err != nil {
+		close(blobs)
+		return err
+	}
+	return r.back.Enumerate(blobs, start, end, limit)
+}
+
+// EnumeratePrefix enumerates the blobs of the first healthy replica
+func (m *Mirror) EnumeratePrefix(blobs chan<- *blobsfile.Blob, prefix string, limit int) error {
+	r, err := m.first()
+	if err != nil {
+		close(blobs)
+		return err
+	}
+	return r.back.EnumeratePrefix(blobs, prefix, limit)
+}
+
+// CheckBlobsFiles checks (and repairs using the parity blobs) all the replicas
+func (m *Mirror) CheckBlobsFiles() error {
+	for _, r := range m.healthyReplicas() {
+		if err := r.back.CheckBlobsFiles(); err != nil {
+			return fmt.Errorf("replica %s: %w", r.name, err)
+		}
+	}
+	return nil
+}
+
+// Close closes all the replicas
+func (m *Mirror) Close() error {
+	var firstErr error
+	for _, r := range m.replicas {
+		if err := r.back.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// ReplicaReport holds the consistency check results for a replica
+type ReplicaReport struct {
+	Name       string   `json:"name"`
+	Healthy    bool     `json:"healthy"`
+	Error      string   `json:"error,omitempty"`
+	BlobsCount int      `json:"blobs_count"`
+	Missing    []string `json:"missing"`
+	Corrupted  []string `json:"corrupted"`
+}
+
+// Report holds the result of a consistency check
+type Report struct {
+	Started    time.Time        `json:"started"`
+	Duration   string           `json:"duration"`
+	BlobsCount int              `json:"blobs_count"`
+	Consistent bool             `json:"consistent"`
+	Replicas   []*ReplicaReport `json:"replicas"`
+}
+
+// enumerateAll returns the hashes stored in the replica
+func enumerateAll(back Replica) (map[string]struct{}, error) {
+	out := make(chan *blobsfile.Blob)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- back.EnumeratePrefix(out, "", 0)
+	}()
+	hashes := map[string]struct{}{}
+	for b := range out {
+		hashes[b.Hash] = struct{}{}
+	}
+	if err := <-errc; err != nil {
+		return nil, err
+	}
+	return hashes, nil
+}
+
+// Check compares the content of all the replicas, if verify is true, the blobs are read back to check their hash
+func (m *Mirror) Check(ctx context.Context, verify bool) (*Report, error) {
+	report := &Report{
+		Started:    time.Now().UTC(),
+		Consistent: true,
+		Replicas:   []*ReplicaReport{},
+	}
+
+	m.mu.Lock()
+	replicas := append([]*replica{}, m.replicas...)
+	m.mu.Unlock()
+
+	all := map[string]struct{}{}
+	indexes := make([]map[string]struct{}, len(replicas))
+	for i, r := range replicas {
+		m.mu.Lock()
+		rr := &ReplicaReport{Name: r.name, Healthy: r.healthy, Missing: []string{}, Corrupted: []string{}}
+		if r.err != nil {
+			rr.Error = r.err.Error()
+		}
+		m.mu.Unlock()
+		report.Replicas = append(report.Replicas, rr)
+
+		hashes, err := enumerateAll(r.back)
+		if err != nil {
+			rr.Error = err.Error()
+			report.Consistent = false
+			continue
+		}
+		rr.BlobsCount = len(hashes)
+		indexes[i] = hashes
+		for h := range hashes {
+			all[h] = struct{}{}
+		}
+	}
+	report.BlobsCount = len(all)
+
+	for i, r := range replicas {
+		rr := report.Replicas[i]
+		if indexes[i] == nil {
+			continue
+		}
+		for h := range all {
+			if _, ok := indexes[i][h]; !ok {
+				rr.Missing = append(rr.Missing, h)
+				continue
+			}
+			if !verify {
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			default:
+			}
+			if _, err := safeGet(r.back, h); err != nil {
+				rr.Corrupted = append(rr.Corrupted, h)
+			}
+		}
+		sort.Strings(rr.Missing)
+		sort.Strings(rr.Corrupted)
+		if !rr.Healthy || len(rr.Missing) > 0 || len(rr.Corrupted) > 0 {
+			report.Consistent = false
+		}
+	}
+
+	report.Duration = time.Since(report.Started).String()
+	return report, nil
+}
@@ -0,0 +1,106 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobsfile"
+
+	"a4.io/blobstash/pkg/hashutil"
+)
+
+type failingReplica struct {
+	Replica
+}
+
+func (r *failingReplica) Put(hash string, data []byte) error {
+	return errors.New("disk failure")
+}
+
+func newReplica(t *testing.T) *blobsfile.BlobsFiles {
+	back, err := blobsfile.New(&blobsfile.Opts{Directory: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { back.Close() })
+	return back
+}
+
+func TestMirror(t *testing.T) {
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	r1, r2 := newReplica(t), newReplica(t)
+	m, err := New(logger, []string{"r1", "r2"}, []Replica{r1, r2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("hello")
+	hash := hashutil.Compute(data)
+	if err := m.Put(hash, data); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []Replica{r1, r2} {
+		if exists, err := r.Exists(hash); err != nil || !exists {
+			t.Fatalf("blob should be stored in every replica")
+		}
+	}
+
+	// A blob only stored in the second replica can still be read
+	data2 := []byte("only in r2")
+	hash2 := hashutil.Compute(data2)
+	if err := r2.Put(hash2, data2); err != nil {
+		t.Fatal(err)
+	}
+	out, err := m.Get(hash2)
+	if err != nil || string(out) != string(data2) {
+		t.Fatalf("failed to read from the second replica: %v", err)
+	}
+
+	report, err := m.Check(context.Background(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Consistent || report.BlobsCount != 2 {
+		t.Errorf("unexpected report %+v", report)
+	}
+	if missing := report.Replicas[0].Missing; len(missing) != 1 || missing[0] != hash2 {
+		t.Errorf("unexpected missing blobs %+v", missing)
+	}
+	if len(report.Replicas[1].Missing) != 0 {
+		t.Errorf("second replica should not miss any blob")
+	}
+}
+
+func TestMirrorDegraded(t *testing.T) {
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	r1, r2 := newReplica(t), newReplica(t)
+	m, err := New(logger, []string{"r1", "r2"}, []Replica{&failingReplica{r1}, r2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("hello")
+	hash := hashutil.Compute(data)
+	if err := m.Put(hash, data); err != nil {
+		t.Fatalf("write should succeed with one healthy replica: %v", err)
+	}
+	if len(m.healthyReplicas()) != 1 {
+		t.Errorf("the failing replica should be marked as unhealthy")
+	}
+	if exists, err := m.Exists(hash); err != nil || !exists {
+		t.Errorf("blob should be served by the healthy replica")
+	}
+
+	report, err := m.Check(context.Background(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Consistent || report.Replicas[0].Healthy || report.Replicas[0].Error == "" {
+		t.Errorf("unexpected report %+v", report.Replicas[0])
+	}
+}
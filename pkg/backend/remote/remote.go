@@ -0,0 +1,382 @@
+/*
+Package remote implements an end-to-end encrypted replication to another (untrusted) BlobStash instance.
+
+The blobs are sealed locally (the key never leaves the local instance, and the plain-text hash is encrypted along
+with the data), and stored on the remote under the hash of the sealed data. The mapping between the plain-text hash
+and the remote hash is kept in a local index, and can be rebuilt by decrypting the remote blobs (restore).
+
+Like the S3 replication, the blobs are journaled (in a disk-backed queue) before being written locally, and uploaded
+asynchronously.
+*/
+package remote // import "a4.io/blobstash/pkg/backend/remote"
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobsfile"
+
+	"a4.io/blobstash/pkg/backend/s3/index"
+	"a4.io/blobstash/pkg/backend/s3/s3util"
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/client/blobstore"
+	"a4.io/blobstash/pkg/client/clientutil"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/hashutil"
+	"a4.io/blobstash/pkg/hub"
+	"a4.io/blobstash/pkg/queue"
+	"a4.io/blobstash/pkg/throttle"
+)
+
+const (
+	// Delay before retrying a failed upload (doubled after each failure)
+	minRetryDelay = 1 * time.Second
+	maxRetryDelay = 5 * time.Minute
+
+	// Number of remote blobs fetched per request during a restore
+	restoreBatchSize = 500
+)
+
+// LocalBackend is the local blobs storage
+type LocalBackend interface {
+	Put(hash string, data []byte) error
+	Get(hash string) ([]byte, error)
+	Exists(hash string) (bool, error)
+}
+
+// RemoteBlobStore is the remote BlobStash blobstore API
+type RemoteBlobStore interface {
+	Put(ctx context.Context, hash string, data []byte) error
+	Get(ctx context.Context, hash string) ([]byte, error)
+	Enumerate(ctx context.Context, cursor string, limit int) ([]*blob.SizedBlobRef, string, error)
+}
+
+// Backend replicates the (sealed) blobs to a remote BlobStash instance
+type Backend struct {
+	log     log.Logger
+	key     *[32]byte
+	remote  RemoteBlobStore
+	backend LocalBackend
+	hub     *hub.Hub
+
+	uploadQueue *queue.Queue
+	index       *index.Index
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+
+	blobsUploaded int
+	failures      int
+	lastError     string
+	mu            sync.Mutex
+}
+
+// New initializes the remote replication and starts the upload worker
+func New(logger log.Logger, back LocalBackend, h *hub.Hub, conf *config.Config) (*Backend, error) {
+	rconf := conf.RemoteRepl
+	key, err := rconf.Key()
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, fmt.Errorf("missing key_file for the remote replication")
+	}
+	remote := blobstore.New(clientutil.NewClientUtil(rconf.URL, clientutil.WithAPIKey(rconf.APIKey)))
+	return newBackend(logger, back, h, remote, key, conf.VarDir())
+}
+
+func newBackend(logger log.Logger, back LocalBackend, h *hub.Hub, remote RemoteBlobStore, key *[32]byte, dir string) (*Backend, error) {
+	uq, err := queue.New(filepath.Join(dir, "remote-upload.queue"))
+	if err != nil {
+		return nil, err
+	}
+	idx, err := index.New(filepath.Join(dir, "remote-backend.index"))
+	if err != nil {
+		return nil, err
+	}
+	b := &Backend{
+		log:         logger,
+		key:         key,
+		remote:      remote,
+		backend:     back,
+		hub:         h,
+		uploadQueue: uq,
+		index:       idx,
+		stop:        make(chan struct{}),
+	}
+	if err := b.recoverQueue(); err != nil {
+		return nil, fmt.Errorf("failed to recover the upload queue: %v", err)
+	}
+	b.wg.Add(1)
+	go b.uploadWorker()
+	return b, nil
+}
+
+// Put journals the blob for replication, it must be called before writing the blob to the local backend
+func (b *Backend) Put(hash string) error {
+	if _, err := b.uploadQueue.Enqueue(&blob.Blob{Hash: hash}); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Cancel removes the blob from the journal (if the local write failed)
+func (b *Backend) Cancel(hash string) error {
+	return b.uploadQueue.RemoveBlobs([]string{hash})
+}
+
+// recoverQueue removes the journaled blobs that never made it to the local backend
+func (b *Backend) recoverQueue() error {
+	blbs, err := b.uploadQueue.Blobs()
+	if err != nil {
+		return err
+	}
+	missing := []string{}
+	for _, blb := range blbs {
+		exists, err := b.backend.Exists(blb.Hash)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			missing = append(missing, blb.Hash)
+		}
+	}
+	if len(missing) > 0 {
+		b.log.Info("dropping unwritten blobs from the upload queue", "count", len(missing))
+		return b.uploadQueue.RemoveBlobs(missing)
+	}
+	return nil
+}
+
+// upload seals the blob and uploads it (if not already replicated)
+func (b *Backend) upload(hash string) error {
+	exists, err := b.index.Exists(hash)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+	data, err := b.backend.Get(hash)
+	if err != nil {
+		return err
+	}
+	sealed, err := s3util.SealV2(b.key, &blob.Blob{Hash: hash, Data: data})
+	if err != nil {
+		return err
+	}
+	ehash := hashutil.Compute(sealed)
+	if err := throttle.Upload().WaitN(context.TODO(), len(sealed)); err != nil {
+		return err
+	}
+	if err := b.remote.Put(context.TODO(), ehash, sealed); err != nil {
+		return err
+	}
+	return b.index.Index(hash, ehash)
+}
+
+func (b *Backend) uploadWorker() {
+	log := b.log.New("worker", "upload_worker")
+	log.Debug("starting worker")
+	defer b.wg.Done()
+	for {
+		blb := &blob.Blob{}
+		b.uploadQueue.Lock()
+		ok, deqFunc, err := b.uploadQueue.Dequeue(blb)
+		if err != nil {
+			b.uploadQueue.Unlock()
+			panic(err)
+		}
+		delay := minRetryDelay
+		if ok {
+			if err := b.upload(blb.Hash); err != nil {
+				deqFunc(false)
+				if err != blobsfile.ErrBlobNotFound {
+					delay = b.uploadFailed(err)
+				}
+				log.Error("failed to upload blob", "hash", blb.Hash, "err", err, "retry_in", delay)
+			} else {
+				deqFunc(true)
+				b.uploadSucceeded()
+				delay = 0
+			}
+		}
+		b.uploadQueue.Unlock()
+
+		if delay == 0 {
+			select {
+			case <-b.stop:
+				log.Debug("worker stopped")
+				return
+			default:
+				continue
+			}
+		}
+		t := time.NewTimer(delay)
+		select {
+		case <-b.stop:
+			t.Stop()
+			log.Debug("worker stopped")
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// uploadFailed records the failure and returns the delay before the next attempt
+func (b *Backend) uploadFailed(err error) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.lastError = err.Error()
+	delay := minRetryDelay
+	for i := 1; i < b.failures && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay
+}
+
+func (b *Backend) uploadSucceeded() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.lastError = ""
+	b.blobsUploaded++
+}
+
+// Get fetches the blob from the remote and decrypts it
+func (b *Backend) Get(hash string) ([]byte, error) {
+	ehash, err := b.index.Get(hash)
+	if err != nil {
+		return nil, err
+	}
+	if ehash == "" {
+		return nil, clientutil.ErrBlobNotFound
+	}
+	sealed, err := b.remote.Get(context.TODO(), ehash)
+	if err != nil {
+		return nil, err
+	}
+	if err := throttle.Download().WaitN(context.TODO(), len(sealed)); err != nil {
+		return nil, err
+	}
+	phash, data, err := s3util.Unseal(b.key, sealed)
+	if err != nil {
+		return nil, err
+	}
+	if phash != hash || !hashutil.Verify(hash, data) {
+		return nil, fmt.Errorf("hash does not match")
+	}
+	return data, nil
+}
+
+// Restore rebuilds the local index by decrypting all the remote blobs, the blobs missing locally are restored if
+// restore is true
+func (b *Backend) Restore(ctx context.Context, restore bool) (int, error) {
+	var cursor string
+	var restored int
+	for {
+		refs, next, err := b.remote.Enumerate(ctx, cursor, restoreBatchSize)
+		if err != nil {
+			return restored, err
+		}
+		for _, ref := range refs {
+			sealed, err := b.remote.Get(ctx, ref.Hash)
+			if err != nil {
+				return restored, err
+			}
+			if err := throttle.Download().WaitN(ctx, len(sealed)); err != nil {
+				return restored, err
+			}
+			hash, data, err := s3util.Unseal(b.key, sealed)
+			if err != nil {
+				// Not a blob sealed with our key
+				b.log.Debug("skipping remote blob", "hash", ref.Hash, "err", err)
+				continue
+			}
+			if !hashutil.Verify(hash, data) {
+				return restored, fmt.Errorf("corrupted remote blob %s", ref.Hash)
+			}
+			if err := b.index.Index(hash, ref.Hash); err != nil {
+				return restored, err
+			}
+			if !restore {
+				continue
+			}
+			exists, err := b.backend.Exists(hash)
+			if err != nil {
+				return restored, err
+			}
+			if exists {
+				continue
+			}
+			if err := b.backend.Put(hash, data); err != nil {
+				return restored, err
+			}
+			// Wait for subscribed event completion
+			if b.hub != nil {
+				if err := b.hub.NewBlobEvent(ctx, &blob.Blob{Hash: hash, Data: data}, nil); err != nil {
+					return restored, err
+				}
+			}
+			restored++
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	b.log.Info("remote restore done", "restored", restored)
+	return restored, nil
+}
+
+// Stats holds the remote replication stats
+type Stats struct {
+	BlobsWaiting              int     `json:"blobs_waiting"`
+	OldestWaitingAge          float64 `json:"oldest_waiting_age"`
+	BlobsUploadedSinceStartup int     `json:"blobs_uploaded_since_startup"`
+	Failures                  int     `json:"failures"`
+	LastError                 string  `json:"last_error,omitempty"`
+}
+
+// Stats returns the replication stats
+func (b *Backend) Stats() (*Stats, error) {
+	b.mu.Lock()
+	stats := &Stats{
+		BlobsUploadedSinceStartup: b.blobsUploaded,
+		Failures:                  b.failures,
+		LastError:                 b.lastError,
+	}
+	b.mu.Unlock()
+	cnt, err := b.uploadQueue.Size()
+	if err != nil {
+		return nil, err
+	}
+	stats.BlobsWaiting = cnt
+	oldest, ok, err := b.uploadQueue.Oldest()
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		stats.OldestWaitingAge = time.Since(oldest).Seconds()
+	}
+	return stats, nil
+}
+
+// Close stops the upload worker
+func (b *Backend) Close() error {
+	close(b.stop)
+	b.wg.Wait()
+	if err := b.uploadQueue.Close(); err != nil {
+		return err
+	}
+	return b.index.Close()
+}
@@ -0,0 +1,166 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobsfile"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/client/clientutil"
+	"a4.io/blobstash/pkg/hashutil"
+)
+
+type memBackend struct {
+	blobs map[string][]byte
+	mu    sync.Mutex
+}
+
+func (m *memBackend) Put(hash string, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.blobs[hash] = data
+	return nil
+}
+
+func (m *memBackend) Get(hash string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.blobs[hash]
+	if !ok {
+		return nil, blobsfile.ErrBlobNotFound
+	}
+	return data, nil
+}
+
+func (m *memBackend) Exists(hash string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.blobs[hash]
+	return ok, nil
+}
+
+type memRemote struct {
+	memBackend
+}
+
+func (m *memRemote) Put(ctx context.Context, hash string, data []byte) error {
+	return m.memBackend.Put(hash, data)
+}
+
+func (m *memRemote) Get(ctx context.Context, hash string) ([]byte, error) {
+	data, err := m.memBackend.Get(hash)
+	if err != nil {
+		return nil, clientutil.ErrBlobNotFound
+	}
+	return data, nil
+}
+
+func (m *memRemote) Enumerate(ctx context.Context, cursor string, limit int) ([]*blob.SizedBlobRef, string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	hashes := []string{}
+	for h := range m.blobs {
+		if h > cursor {
+			hashes = append(hashes, h)
+		}
+	}
+	sort.Strings(hashes)
+	var next string
+	if len(hashes) > limit {
+		hashes = hashes[:limit]
+		next = hashes[limit-1]
+	}
+	refs := []*blob.SizedBlobRef{}
+	for _, h := range hashes {
+		refs = append(refs, &blob.SizedBlobRef{Hash: h, Size: len(m.blobs[h])})
+	}
+	return refs, next, nil
+}
+
+func TestRemoteReplication(t *testing.T) {
+	key := &[32]byte{1, 2, 3}
+	local := &memBackend{blobs: map[string][]byte{}}
+	rem := &memRemote{memBackend{blobs: map[string][]byte{}}}
+	b, err := newBackend(log.New(), local, nil, rem, key, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("secret content")
+	hash := hashutil.Compute(data)
+	if err := b.Put(hash); err != nil {
+		t.Fatal(err)
+	}
+	if err := local.Put(hash, data); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stats, err := b.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.BlobsUploadedSinceStartup == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("blob not uploaded: %+v", stats)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// The remote must not see the plain-text data nor the real hash
+	if len(rem.blobs) != 1 {
+		t.Fatalf("expected 1 remote blob, got %d", len(rem.blobs))
+	}
+	for ehash, sealed := range rem.blobs {
+		if ehash == hash || bytes.Contains(sealed, data) || strings.Contains(string(sealed), hash) {
+			t.Errorf("remote blob leaks the content or the hash")
+		}
+	}
+
+	got, err := b.Get(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("unexpected data %q", got)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Restore on a fresh instance (empty local index and backend)
+	local2 := &memBackend{blobs: map[string][]byte{}}
+	b2, err := newBackend(log.New(), local2, nil, rem, key, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b2.Close()
+	restored, err := b2.Restore(context.Background(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored != 1 || !bytes.Equal(local2.blobs[hash], data) {
+		t.Errorf("failed to restore the blob (restored=%d)", restored)
+	}
+
+	// Blobs sealed with another key are skipped
+	b3, err := newBackend(log.New(), &memBackend{blobs: map[string][]byte{}}, nil, rem, &[32]byte{4}, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b3.Close()
+	if restored, err := b3.Restore(context.Background(), true); err != nil || restored != 0 {
+		t.Errorf("unexpected restore %d/%v", restored, err)
+	}
+}
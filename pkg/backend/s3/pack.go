@@ -0,0 +1,308 @@
+package s3 // import "a4.io/blobstash/pkg/backend/s3"
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	humanize "github.com/dustin/go-humanize"
+
+	"a4.io/blobsfile"
+
+	"a4.io/blobstash/pkg/backend/s3/pack"
+	"a4.io/blobstash/pkg/backend/s3/s3util"
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/hashutil"
+	"a4.io/blobstash/pkg/throttle"
+)
+
+// Blob packing
+//
+// When enabled (`pack` in the S3 replication config), the small blobs are grouped into pack files before being
+// uploaded. A pack is stored at `bpacks/{pack hash}`, and its index (the position of each blob in the pack) at
+// `bpacks/{pack hash}.index`. Both are encrypted if a key is set (each blob is sealed individually in the pack, so it
+// can be fetched and decrypted with a single range request).
+//
+// A pack is uploaded once it reaches the target size, or once the oldest waiting blob waited for more than the max
+// delay. The blobs stay in the upload queue until their pack is uploaded.
+
+// Prefix of the pack objects
+const packsPrefix = "bpacks/"
+
+// Suffix of the pack index objects
+const packIndexSuffix = ".index"
+
+func packKey(packHash string) string {
+	return packsPrefix + packHash
+}
+
+// isPacked returns true if the indexed value is the location of a packed blob
+func isPacked(ehash string) bool {
+	_, _, _, ok := pack.ParseLocation(ehash)
+	return ok
+}
+
+// putObject uploads the given data
+func (b *S3Backend) putObject(key string, data []byte) error {
+	if err := throttle.Upload().WaitN(context.TODO(), len(data)); err != nil {
+		return err
+	}
+	if _, err := b.s3.PutObject(&s3.PutObjectInput{
+		Bucket:   aws.String(b.bucket),
+		Key:      aws.String(key),
+		Body:     bytes.NewReader(data),
+		Metadata: map[string]*string{},
+	}); err != nil {
+		return err
+	}
+	return nil
+}
+
+// uploadPack uploads the pack and its index, and then indexes the location of the packed blobs
+func (b *S3Backend) uploadPack(w *pack.Writer) error {
+	packHash := hashutil.Compute(w.Bytes())
+	js, err := w.Index().Encode()
+	if err != nil {
+		return err
+	}
+	if b.encrypted {
+		js, err = s3util.Seal(b.key, &blob.Blob{Hash: hashutil.Compute(js), Data: js})
+		if err != nil {
+			return err
+		}
+	}
+
+	// The index is uploaded last, a pack without index is ignored on restore
+	if err := b.putObject(packKey(packHash), w.Bytes()); err != nil {
+		return err
+	}
+	if err := b.putObject(packKey(packHash)+packIndexSuffix, js); err != nil {
+		return err
+	}
+
+	for _, e := range w.Index().Blobs {
+		loc, err := pack.Location(packHash, e)
+		if err != nil {
+			return err
+		}
+		if err := b.index.Index(e.Hash, loc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// packStep uploads the blobs waiting in the queue, the small blobs are added to the current pack. Returns the number of
+// uploaded blobs.
+func (b *S3Backend) packStep() (int, error) {
+	b.uploadQueue.Lock()
+	defer b.uploadQueue.Unlock()
+	b.wg.Add(1)
+	defer b.wg.Done()
+
+	blbs, err := b.uploadQueue.Blobs()
+	if err != nil {
+		return 0, err
+	}
+	if len(blbs) == 0 {
+		return 0, nil
+	}
+	oldest, _, err := b.uploadQueue.Oldest()
+	if err != nil {
+		return 0, err
+	}
+
+	var uploaded int
+	w := pack.NewWriter()
+	packed := []string{}
+	sizes := []int{}
+	flush := func() error {
+		if w.Count() == 0 {
+			return nil
+		}
+		t := time.Now()
+		if err := b.uploadPack(w); err != nil {
+			return err
+		}
+		if err := b.uploadQueue.RemoveBlobs(packed); err != nil {
+			return err
+		}
+		for _, size := range sizes {
+			b.uploadSucceeded(uint64(size))
+		}
+		b.log.Info("pack uploaded to s3", "blobs", w.Count(), "size", humanize.Bytes(uint64(w.Size())), "duration", time.Since(t))
+		uploaded += w.Count()
+		w = pack.NewWriter()
+		packed = []string{}
+		sizes = []int{}
+		return nil
+	}
+
+	for _, blb := range blbs {
+		if w.Has(blb.Hash) {
+			continue
+		}
+		exists, err := b.index.Exists(blb.Hash)
+		if err != nil {
+			return uploaded, err
+		}
+		if exists {
+			if err := b.uploadQueue.RemoveBlobs([]string{blb.Hash}); err != nil {
+				return uploaded, err
+			}
+			continue
+		}
+
+		// The blob may not be available yet (the blob is journaled before the local write)
+		data, err := b.backend.Get(blb.Hash)
+		if err != nil {
+			if err == blobsfile.ErrBlobNotFound {
+				continue
+			}
+			return uploaded, err
+		}
+
+		// Upload the big blobs directly
+		if len(data) > b.pack.MaxBlobSize {
+			if err := b.put(blb.Hash, data); err != nil {
+				return uploaded, err
+			}
+			if err := b.uploadQueue.RemoveBlobs([]string{blb.Hash}); err != nil {
+				return uploaded, err
+			}
+			b.uploadSucceeded(uint64(len(data)))
+			uploaded++
+			continue
+		}
+
+		sizes = append(sizes, len(data))
+		if b.encrypted {
+			data, err = s3util.Seal(b.key, &blob.Blob{Hash: blb.Hash, Data: data})
+			if err != nil {
+				return uploaded, err
+			}
+		}
+		w.Add(blb.Hash, data)
+		packed = append(packed, blb.Hash)
+
+		if w.Size() >= b.pack.Size {
+			if err := flush(); err != nil {
+				return uploaded, err
+			}
+		}
+	}
+
+	// Don't wait for a full pack if the blobs waited for too long
+	if time.Since(oldest) >= b.packMaxDelay {
+		if err := flush(); err != nil {
+			return uploaded, err
+		}
+	}
+
+	return uploaded, nil
+}
+
+// getPacked fetches a blob stored in a pack (using a range request)
+func (b *S3Backend) getPacked(hash, packHash string, offset int64, size int) ([]byte, error) {
+	obj := s3util.NewBucket(b.s3, b.bucket).GetObject(packKey(packHash))
+	r, err := obj.RangeReader(offset, int64(size))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := throttle.Download().WaitN(context.TODO(), len(data)); err != nil {
+		return nil, err
+	}
+	if b.encrypted {
+		var fhash string
+		fhash, data, err = s3util.Unseal(b.key, data)
+		if err != nil {
+			return nil, err
+		}
+		if fhash != hash {
+			return nil, fmt.Errorf("hash does not match")
+		}
+	}
+	if !hashutil.Verify(hash, data) {
+		return nil, fmt.Errorf("hash does not match")
+	}
+	return data, nil
+}
+
+// fetchPackIndex fetches (and decrypts) a pack index
+func (b *S3Backend) fetchPackIndex(obj *s3util.Object) (*pack.Index, error) {
+	r, err := obj.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	js, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if b.encrypted {
+		_, js, err = s3util.Unseal(b.key, js)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return pack.DecodeIndex(js)
+}
+
+// reindexPacks indexes the packed blobs (and restores them locally if restore is true)
+func (b *S3Backend) reindexPacks(restore bool) (int, error) {
+	var cnt int
+	bucket := s3util.NewBucket(b.s3, b.bucket)
+	err := bucket.IterPrefix(packsPrefix, 100, func(obj *s3util.Object) error {
+		if !strings.HasSuffix(obj.Key, packIndexSuffix) {
+			return nil
+		}
+		packHash := strings.TrimSuffix(strings.TrimPrefix(obj.Key, packsPrefix), packIndexSuffix)
+		idx, err := b.fetchPackIndex(obj)
+		if err != nil {
+			return fmt.Errorf("failed to fetch pack index %s: %v", obj.Key, err)
+		}
+		for _, e := range idx.Blobs {
+			loc, err := pack.Location(packHash, e)
+			if err != nil {
+				return err
+			}
+			if err := b.index.Index(e.Hash, loc); err != nil {
+				return err
+			}
+			cnt++
+			if !restore {
+				continue
+			}
+			exists, err := b.backend.Exists(e.Hash)
+			if err != nil {
+				return err
+			}
+			if exists {
+				continue
+			}
+			data, err := b.getPacked(e.Hash, packHash, e.Offset, e.Size)
+			if err != nil {
+				return err
+			}
+			if err := b.backend.Put(e.Hash, data); err != nil {
+				return err
+			}
+			// Wait for subscribed event completion
+			if err := b.hub.NewBlobEvent(context.TODO(), &blob.Blob{Hash: e.Hash, Data: data}, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return cnt, err
+}
@@ -0,0 +1,135 @@
+/*
+Package pack implements the pack files used to group the small blobs before uploading them to the cold storage.
+
+A pack is the concatenation of the (optionally encrypted) blobs, along with an index (stored as a separate blob)
+listing the position of every blob in the pack, so a single blob can be fetched with a range request.
+
+The location of a packed blob (pack hash, offset and size) is encoded as a hex string so it can be stored in the
+local S3 index in place of the encrypted hash.
+*/
+package pack // import "a4.io/blobstash/pkg/backend/s3/pack"
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+// Version of the pack index format
+const Version = 1
+
+// Size of a decoded location (pack hash + offset + size)
+const locationSize = 32 + 8 + 4
+
+// Entry locates a blob inside a pack
+type Entry struct {
+	Hash   string `json:"hash"`
+	Offset int64  `json:"offset"`
+	Size   int    `json:"size"`
+}
+
+// Index lists the blobs stored in a pack
+type Index struct {
+	Version int      `json:"version"`
+	Blobs   []*Entry `json:"blobs"`
+}
+
+// Encode serializes the index
+func (idx *Index) Encode() ([]byte, error) {
+	return json.Marshal(idx)
+}
+
+// DecodeIndex deserializes a pack index
+func DecodeIndex(data []byte) (*Index, error) {
+	idx := &Index{}
+	if err := json.Unmarshal(data, idx); err != nil {
+		return nil, err
+	}
+	if idx.Version != Version {
+		return nil, fmt.Errorf("unsupported pack index version %d", idx.Version)
+	}
+	return idx, nil
+}
+
+// Writer builds a pack in memory
+type Writer struct {
+	buf    bytes.Buffer
+	index  *Index
+	hashes map[string]struct{}
+}
+
+// NewWriter initializes an empty pack
+func NewWriter() *Writer {
+	return &Writer{
+		index:  &Index{Version: Version, Blobs: []*Entry{}},
+		hashes: map[string]struct{}{},
+	}
+}
+
+// Add appends the blob data to the pack
+func (w *Writer) Add(hash string, data []byte) {
+	w.index.Blobs = append(w.index.Blobs, &Entry{
+		Hash:   hash,
+		Offset: int64(w.buf.Len()),
+		Size:   len(data),
+	})
+	w.hashes[hash] = struct{}{}
+	w.buf.Write(data)
+}
+
+// Has returns true if the blob is already in the pack
+func (w *Writer) Has(hash string) bool {
+	_, ok := w.hashes[hash]
+	return ok
+}
+
+// Count returns the number of blobs in the pack
+func (w *Writer) Count() int {
+	return len(w.index.Blobs)
+}
+
+// Size returns the size of the pack (in bytes)
+func (w *Writer) Size() int {
+	return w.buf.Len()
+}
+
+// Bytes returns the pack content
+func (w *Writer) Bytes() []byte {
+	return w.buf.Bytes()
+}
+
+// Index returns the pack index
+func (w *Writer) Index() *Index {
+	return w.index
+}
+
+// Location encodes the location of a packed blob
+func Location(packHash string, e *Entry) (string, error) {
+	raw, err := hex.DecodeString(packHash)
+	if err != nil {
+		return "", err
+	}
+	if len(raw) != 32 {
+		return "", fmt.Errorf("invalid pack hash %q", packHash)
+	}
+	out := make([]byte, locationSize)
+	copy(out, raw)
+	binary.BigEndian.PutUint64(out[32:], uint64(e.Offset))
+	binary.BigEndian.PutUint32(out[40:], uint32(e.Size))
+	return hex.EncodeToString(out), nil
+}
+
+// ParseLocation decodes the location of a packed blob, returns false if the given value is not a location (i.e. a
+// regular hash)
+func ParseLocation(loc string) (packHash string, offset int64, size int, ok bool) {
+	if len(loc) != locationSize*2 {
+		return "", 0, 0, false
+	}
+	raw, err := hex.DecodeString(loc)
+	if err != nil {
+		return "", 0, 0, false
+	}
+	return hex.EncodeToString(raw[:32]), int64(binary.BigEndian.Uint64(raw[32:])), int(binary.BigEndian.Uint32(raw[40:])), true
+}
@@ -0,0 +1,50 @@
+package pack
+
+import (
+	"bytes"
+	"testing"
+
+	"a4.io/blobstash/pkg/hashutil"
+)
+
+func TestPack(t *testing.T) {
+	w := NewWriter()
+	blobs := [][]byte{[]byte("hello"), []byte("world"), []byte("!")}
+	for _, data := range blobs {
+		w.Add(hashutil.Compute(data), data)
+	}
+	if w.Count() != 3 || w.Size() != 11 || !w.Has(hashutil.Compute([]byte("world"))) {
+		t.Fatalf("unexpected pack count=%d size=%d", w.Count(), w.Size())
+	}
+
+	js, err := w.Index().Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := DecodeIndex(js)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packHash := hashutil.Compute(w.Bytes())
+	for i, e := range idx.Blobs {
+		if got := w.Bytes()[e.Offset : e.Offset+int64(e.Size)]; !bytes.Equal(got, blobs[i]) {
+			t.Errorf("unexpected blob %q", got)
+		}
+		loc, err := Location(packHash, e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, off, size, ok := ParseLocation(loc)
+		if !ok || h != packHash || off != e.Offset || size != e.Size {
+			t.Errorf("failed to parse location %q", loc)
+		}
+	}
+
+	// A regular hash is not a location
+	if _, _, _, ok := ParseLocation(packHash); ok {
+		t.Errorf("a hash should not be parsed as a location")
+	}
+	if _, err := DecodeIndex([]byte(`{"version":42}`)); err == nil {
+		t.Errorf("unsupported version should fail")
+	}
+}
@@ -29,6 +29,7 @@ import (
 	"a4.io/blobsfile"
 
 	"a4.io/blobstash/pkg/backend/s3/index"
+	"a4.io/blobstash/pkg/backend/s3/pack"
 	"a4.io/blobstash/pkg/backend/s3/s3util"
 	"a4.io/blobstash/pkg/blob"
 	"a4.io/blobstash/pkg/config"
@@ -37,6 +38,7 @@ import (
 	"a4.io/blobstash/pkg/hashutil"
 	"a4.io/blobstash/pkg/hub"
 	"a4.io/blobstash/pkg/queue"
+	"a4.io/blobstash/pkg/throttle"
 )
 
 // TODO(tsileo):
@@ -65,7 +67,7 @@ type S3Backend struct {
 	encrypted bool
 	key       *[32]byte
 
-	backend *blobsfile.BlobsFiles
+	backend LocalBackend
 	hub     *hub.Hub
 
 	wg sync.WaitGroup
@@ -80,11 +82,35 @@ type S3Backend struct {
 
 	bucket string
 
+	// Blob packing (nil if disabled)
+	pack         *config.S3Pack
+	packMaxDelay time.Duration
+
 	uploadedSinceStartup      uint64
 	blobsUploadedSinceStartup int
+
+	// Upload failures (reset after a successful upload)
+	failures  int
+	lastError string
+	mu        sync.Mutex
 }
 
-func New(logger log.Logger, back *blobsfile.BlobsFiles, h *hub.Hub, conf *config.Config, packsDir string) (*S3Backend, error) {
+const (
+	// Delay before retrying a failed upload (doubled after each failure)
+	minRetryDelay = 1 * time.Second
+	maxRetryDelay = 5 * time.Minute
+)
+
+// LocalBackend is the local blobs storage (a BlobsFile or a mirror)
+type LocalBackend interface {
+	Put(hash string, data []byte) error
+	Get(hash string) ([]byte, error)
+	Exists(hash string) (bool, error)
+	Size(hash string) (int, error)
+	Enumerate(blobs chan<- *blobsfile.Blob, start, end string, limit int) error
+}
+
+func New(logger log.Logger, back LocalBackend, h *hub.Hub, conf *config.Config, packsDir string) (*S3Backend, error) {
 	// Parse config
 	var sess *session.Session
 	bucket := conf.S3Repl.Bucket
@@ -142,6 +168,11 @@ func New(logger log.Logger, back *blobsfile.BlobsFiles, h *hub.Hub, conf *config
 		downloader:  s3manager.NewDownloader(sess),
 	}
 
+	if conf.S3Repl.Pack != nil {
+		s3backend.pack = conf.S3Repl.Pack
+		s3backend.packMaxDelay = conf.S3Repl.Pack.MaxDelayDuration()
+	}
+
 	// FIXME(tsileo): should encypption be optional?
 	if key != nil {
 		s3backend.encrypted = true
@@ -164,6 +195,11 @@ func New(logger log.Logger, back *blobsfile.BlobsFiles, h *hub.Hub, conf *config
 		}
 	}
 
+	// Drop the journal entries for the blobs that never made it to the local backend (crash during a write)
+	if err := s3backend.recoverQueue(); err != nil {
+		return nil, fmt.Errorf("failed to recover the upload queue: %v", err)
+	}
+
 	// Initialize the worker (queue consumer)
 	go s3backend.uploadWorker()
 
@@ -258,6 +294,10 @@ func (b *S3Backend) BlobsFilesUploadPack(pack string) error {
 		b.log.Debug("deleting blob", "hash", h, "exists", exists)
 		if exists {
 			ehash, err := b.index.Get(h)
+			if isPacked(ehash) {
+				// The blob cannot be removed from its pack
+				continue
+			}
 			if err == nil && ehash != "" {
 				if err := bucket.GetObject(ehash).Delete(); err != nil {
 					return fmt.Errorf("failed to remove blob:%s/%s: %v", h, ehash, err)
@@ -284,7 +324,7 @@ func (b *S3Backend) BlobsFilesSyncWorker(sealedPacks []string) error {
 }
 
 func (b *S3Backend) DownloadFile(key string, dest io.WriterAt) error {
-	if _, err := b.downloader.Download(dest, &s3.GetObjectInput{
+	if _, err := b.downloader.Download(throttle.Download().WriterAt(context.TODO(), dest), &s3.GetObjectInput{
 		Bucket: aws.String(b.bucket),
 		Key:    aws.String(key),
 	}); err != nil {
@@ -298,7 +338,7 @@ func (b *S3Backend) UploadFile(src io.Reader, key string) error {
 	if _, err := b.uploader.Upload(&s3manager.UploadInput{
 		Bucket: aws.String(b.bucket),
 		Key:    aws.String(key),
-		Body:   src,
+		Body:   throttle.Upload().Reader(context.TODO(), src),
 	}); err != nil {
 		return err
 	}
@@ -313,9 +353,31 @@ func (b *S3Backend) String() string {
 	return fmt.Sprintf("s3-backend-%s", b.bucket) + suf
 }
 
-func (b *S3Backend) Stats() (map[string]interface{}, error) {
-	total := uint64(0)
-	count := 0
+// ReplicationStats holds the S3 replication stats (the blobs waiting in the upload queue are the replication lag)
+type ReplicationStats struct {
+	BlobsWaiting              int    `json:"blobs_waiting"`
+	SizeWaiting               uint64 `json:"blobs_size"`
+	BlobsUploadedSinceStartup int    `json:"blobs_uploaded_since_startup"`
+	SizeUploadedSinceStartup  uint64 `json:"blobs_size_uploaded_since_startup"`
+
+	// Age of the oldest blob waiting to be uploaded (in seconds)
+	OldestWaitingAge float64 `json:"oldest_waiting_age"`
+
+	// Consecutive upload failures (the uploads are retried with an exponential backoff)
+	Failures  int    `json:"failures"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// ReplicationStats returns the replication stats
+func (b *S3Backend) ReplicationStats() (*ReplicationStats, error) {
+	b.mu.Lock()
+	stats := &ReplicationStats{
+		BlobsUploadedSinceStartup: b.blobsUploadedSinceStartup,
+		SizeUploadedSinceStartup:  b.uploadedSinceStartup,
+		Failures:                  b.failures,
+		LastError:                 b.lastError,
+	}
+	b.mu.Unlock()
 
 	blbs, err := b.uploadQueue.Blobs()
 	if err != nil {
@@ -323,24 +385,49 @@ func (b *S3Backend) Stats() (map[string]interface{}, error) {
 	}
 
 	for _, blb := range blbs {
-		count += 1
+		stats.BlobsWaiting++
 		sz, err := b.backend.Size(blb.Hash)
 		if err != nil {
+			// The blob may still be being written locally
+			if err == blobsfile.ErrBlobNotFound {
+				continue
+			}
 			return nil, err
 		}
-		total += uint64(sz)
+		stats.SizeWaiting += uint64(sz)
+	}
+
+	oldest, ok, err := b.uploadQueue.Oldest()
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		stats.OldestWaitingAge = time.Since(oldest).Seconds()
+	}
+	return stats, nil
+}
+
+func (b *S3Backend) Stats() (map[string]interface{}, error) {
+	stats, err := b.ReplicationStats()
+	if err != nil {
+		return nil, err
 	}
 
 	return map[string]interface{}{
-		"blobs_waiting":                           count,
-		"blobs_size":                              total,
-		"blobs_size_human":                        humanize.Bytes(total),
-		"blobs_uploaded_since_startup":            b.blobsUploadedSinceStartup,
-		"blobs_size_uploaded_since_startup":       b.uploadedSinceStartup,
-		"blobs_size_uploaded_since_startup_human": humanize.Bytes(b.uploadedSinceStartup),
+		"blobs_waiting":                           stats.BlobsWaiting,
+		"blobs_size":                              stats.SizeWaiting,
+		"blobs_size_human":                        humanize.Bytes(stats.SizeWaiting),
+		"blobs_uploaded_since_startup":            stats.BlobsUploadedSinceStartup,
+		"blobs_size_uploaded_since_startup":       stats.SizeUploadedSinceStartup,
+		"blobs_size_uploaded_since_startup_human": humanize.Bytes(stats.SizeUploadedSinceStartup),
+		"oldest_waiting_age":                      stats.OldestWaitingAge,
+		"failures":                                stats.Failures,
+		"last_error":                              stats.LastError,
 	}, nil
 }
 
+// Put journals the blob for replication, it must be called before writing the blob to the local backend (the
+// journal entry is synced to disk so the blob cannot be lost if the server crashes before the upload)
 func (b *S3Backend) Put(hash string) error {
 	if _, err := b.uploadQueue.Enqueue(&blob.Blob{Hash: hash}); err != nil {
 		return err
@@ -348,6 +435,72 @@ func (b *S3Backend) Put(hash string) error {
 	return nil
 }
 
+// Cancel removes the blob from the journal (if the local write failed)
+func (b *S3Backend) Cancel(hash string) error {
+	return b.uploadQueue.RemoveBlobs([]string{hash})
+}
+
+// recoverQueue removes the journaled blobs that are not stored locally (the server crashed before the local write
+// completed, the blob write was never acknowledged)
+func (b *S3Backend) recoverQueue() error {
+	blbs, err := b.uploadQueue.Blobs()
+	if err != nil {
+		return err
+	}
+	missing := []string{}
+	for _, blb := range blbs {
+		exists, err := b.backend.Exists(blb.Hash)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			missing = append(missing, blb.Hash)
+		}
+	}
+	if len(missing) > 0 {
+		b.log.Info("dropping unwritten blobs from the upload queue", "count", len(missing))
+		return b.uploadQueue.RemoveBlobs(missing)
+	}
+	return nil
+}
+
+// uploadFailed records the failure and returns the delay before the next attempt
+func (b *S3Backend) uploadFailed(err error) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.lastError = err.Error()
+	delay := minRetryDelay
+	for i := 1; i < b.failures && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay
+}
+
+func (b *S3Backend) uploadSucceeded(size uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.lastError = ""
+	b.uploadedSinceStartup += size
+	b.blobsUploadedSinceStartup++
+}
+
+// wait sleeps for the given duration, returns false if the worker must stop
+func (b *S3Backend) wait(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-b.stop:
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
 func (b *S3Backend) Reindex(restore bool) error {
 	bucket := s3util.NewBucket(b.s3, b.bucket)
 	b.log.Info("Starting S3 re-indexing")
@@ -409,7 +562,12 @@ func (b *S3Backend) Reindex(restore bool) error {
 		return err
 	}
 
-	b.log.Info("S3 scan done", "objects_downloaded_cnt", cnt, "duration", time.Since(start))
+	packedCnt, err := b.reindexPacks(restore)
+	if err != nil {
+		return err
+	}
+
+	b.log.Info("S3 scan done", "objects_downloaded_cnt", cnt, "packed_blobs_cnt", packedCnt, "duration", time.Since(start))
 	start = time.Now()
 	cnt = 0
 	out := make(chan *blobsfile.Blob)
@@ -454,6 +612,22 @@ L:
 			log.Debug("worker stopped")
 			break L
 		default:
+			if b.pack != nil {
+				uploaded, err := b.packStep()
+				delay := 1 * time.Second
+				if err != nil {
+					delay = b.uploadFailed(err)
+					log.Error("failed to upload blobs", "err", err, "retry_in", delay)
+				}
+				if uploaded > 0 && err == nil {
+					continue L
+				}
+				if !b.wait(delay) {
+					log.Debug("worker stopped")
+					break L
+				}
+				continue L
+			}
 			b.uploadQueue.Lock()
 			// log.Debug("polling")
 			blb := &blob.Blob{}
@@ -483,6 +657,7 @@ L:
 						return nil
 					}
 
+					// The blob may not be available yet (the blob is journaled before the local write)
 					data, err := b.backend.Get(blob.Hash)
 					if err != nil {
 						deqFunc(false)
@@ -495,18 +670,27 @@ L:
 					}
 					deqFunc(true)
 					blobSize := uint64(len(data))
-					b.uploadedSinceStartup += blobSize
-					b.blobsUploadedSinceStartup++
+					b.uploadSucceeded(blobSize)
 					log.Info("blob uploaded to s3", "hash", blob.Hash, "size", humanize.Bytes(blobSize), "duration", time.Since(t), "uploaded_since_startup", humanize.Bytes(b.uploadedSinceStartup))
 
 					return nil
 				}(blb); err != nil {
-					log.Error("failed to upload blob", "hash", blb.Hash, "err", err)
-					time.Sleep(1 * time.Second)
+					delay := minRetryDelay
+					if err != blobsfile.ErrBlobNotFound {
+						delay = b.uploadFailed(err)
+					}
+					log.Error("failed to upload blob", "hash", blb.Hash, "err", err, "retry_in", delay)
+					if !b.wait(delay) {
+						log.Debug("worker stopped")
+						break L
+					}
 				}
 				continue L
 			}
-			time.Sleep(1 * time.Second)
+			if !b.wait(1 * time.Second) {
+				log.Debug("worker stopped")
+				break L
+			}
 			continue L
 		}
 	}
@@ -536,6 +720,9 @@ func (b *S3Backend) put(hash string, data []byte) error {
 	}
 
 	// Actually upload the blob
+	if err := throttle.Upload().WaitN(context.TODO(), len(data)); err != nil {
+		return err
+	}
 	if _, err := b.s3.PutObject(params); err != nil {
 		return err
 	}
@@ -561,10 +748,16 @@ func (b *S3Backend) Get(hash string) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	if packHash, offset, size, ok := pack.ParseLocation(ehash); ok {
+		return b.getPacked(hash, packHash, offset, size)
+	}
 
 	obj := s3util.NewBucket(b.s3, b.bucket).GetObject(ehash)
 	eblob := s3util.NewEncryptedBlob(obj, b.key)
 	fhash, data, err := eblob.HashAndPlainText()
+	if werr := throttle.Download().WaitN(context.TODO(), len(data)); werr != nil {
+		return nil, werr
+	}
 	if fhash != hash {
 		return nil, fmt.Errorf("hash does not match")
 	}
@@ -43,7 +43,10 @@ const (
 )
 
 var (
+	// Legacy format (the plain-text hash is stored in clear)
 	blobHeader = []byte("#blobstash/secretbox\n")
+
+	blobHeaderV2 = []byte("#blobstash/secretbox2\n")
 )
 
 // nextKey returns the next key for lexigraphical (key = NextKey(lastkey))
@@ -219,6 +222,30 @@ type Object struct {
 	s3     *s3.S3
 }
 
+// IterPrefix iterates over the objects with the given prefix
+func (b *Bucket) IterPrefix(prefix string, max int, f func(*Object) error) error {
+	var marker string
+	for {
+		objects, err := b.ListPrefix(prefix, marker, max)
+		if err != nil {
+			return err
+		}
+
+		if len(objects) == 0 {
+			break
+		}
+
+		for _, object := range objects {
+			if err := f(object); err != nil {
+				return err
+			}
+			marker = nextKey(object.Key)
+		}
+	}
+
+	return nil
+}
+
 func (o *Object) Delete() error {
 	params := &s3.DeleteObjectInput{
 		Bucket: aws.String(o.Bucket),
@@ -266,6 +293,20 @@ func (o *Object) Reader() (io.ReadCloser, error) {
 	return o.reader(-1)
 }
 
+// RangeReader returns a reader for the given byte range of the object
+func (o *Object) RangeReader(offset, size int64) (io.ReadCloser, error) {
+	params := &s3.GetObjectInput{
+		Bucket: aws.String(o.Bucket),
+		Key:    aws.String(o.Key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+size-1)),
+	}
+	resp, err := o.s3.GetObject(params)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
 func (o *Object) reader(size int64) (io.ReadCloser, error) {
 	params := &s3.GetObjectInput{
 		Bucket: aws.String(o.Bucket),
@@ -292,73 +333,56 @@ func NewEncryptedBlob(o *Object, key *[32]byte) *EncryptedBlob {
 	return &EncryptedBlob{o: o, key: key}
 }
 
-func (b *EncryptedBlob) PlainText() ([]byte, error) {
+// readAll returns the full (encrypted) object content
+func (b *EncryptedBlob) readAll() ([]byte, error) {
 	r, err := b.o.Reader()
 	if err != nil {
 		return nil, err
 	}
 	defer r.Close()
-	data, err := ioutil.ReadAll(r)
-	if err != nil {
-		return nil, err
-	}
-
-	if !bytes.Equal(blobHeader, data[0:21]) {
-		return nil, fmt.Errorf("missing header (\"%s\")", data[0:21])
-	}
+	return ioutil.ReadAll(r)
+}
 
-	decoded, err := Open(b.key, data)
+func (b *EncryptedBlob) PlainText() ([]byte, error) {
+	data, err := b.readAll()
 	if err != nil {
 		return nil, err
 	}
-
-	return decoded, nil
+	_, decoded, err := Unseal(b.key, data)
+	return decoded, err
 }
 
 func (b *EncryptedBlob) HashAndPlainText() (string, []byte, error) {
-	r, err := b.o.Reader()
-	if err != nil {
-		return "", nil, err
-	}
-	defer r.Close()
-	data, err := ioutil.ReadAll(r)
-	if err != nil {
-		return "", nil, err
-	}
-
-	if !bytes.Equal(blobHeader, data[0:21]) {
-		return "", nil, fmt.Errorf("missing header (\"%s\")", data[0:21])
-	}
-
-	decoded, err := Open(b.key, data)
+	data, err := b.readAll()
 	if err != nil {
 		return "", nil, err
 	}
-
-	return hex.EncodeToString(data[21:53]), decoded, nil
+	return Unseal(b.key, data)
 }
 
+// PlainTextHash returns the hash of the plain-text blob (only the header is fetched, the S3 backend always uses the
+// legacy format)
 func (b *EncryptedBlob) PlainTextHash() (string, error) {
-	r, err := b.o.Peeker(53)
-	defer r.Close()
+	r, err := b.o.Peeker(int64(len(blobHeader) + 32))
 	if err != nil {
 		return "", err
 	}
+	defer r.Close()
 	data, err := ioutil.ReadAll(r)
 	if err != nil {
 		return "", err
 	}
 
-	if !bytes.Equal(blobHeader, data[0:21]) {
-		return "", fmt.Errorf("missing header (\"%s\")", data[0:21])
+	if len(data) < len(blobHeader)+32 || !bytes.Equal(blobHeader, data[0:21]) {
+		return "", fmt.Errorf("missing header (\"%s\")", data)
 	}
 
 	return hex.EncodeToString(data[21:53]), nil
 }
 
-// Seal the data with the key derived from `password` (using scrypt) and seal the data with nacl/secretbox
+// Seal the data with nacl/secretbox (legacy format, the plain-text hash is stored in clear in the header, used by the
+// S3 backend)
 func Seal(nkey *[32]byte, blb *blob.Blob) ([]byte, error) {
-	// FIXME(tsileo): store a flag for "data blobs"
 	nonce := new([nonceLength]byte)
 	if _, err := rand.Reader.Read(nonce[:]); err != nil {
 		return nil, err
@@ -386,8 +410,74 @@ func Seal(nkey *[32]byte, blb *blob.Blob) ([]byte, error) {
 	return secretbox.Seal(box, blb.Data, nonce, nkey), nil
 }
 
-// Open a previously sealed secretbox with the key derived from `password` (using scrypt)
+// SealV2 seals the blob with nacl/secretbox, the plain-text hash is sealed along with the data so the remote never
+// sees the real content hash (the sealed blob must be stored under the hash of the sealed data)
+//
+// Format: header + nonce + secretbox(hash (32 bytes) + flag (1 byte) + data)
+func SealV2(nkey *[32]byte, blb *blob.Blob) ([]byte, error) {
+	nonce := new([nonceLength]byte)
+	if _, err := rand.Reader.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	bhash, err := hex.DecodeString(blb.Hash)
+	if err != nil {
+		return nil, err
+	}
+
+	// The "data blob" flag
+	flag := byte(0)
+	if blb.IsFiletreeNode() || blb.IsMeta() {
+		flag = 1
+	}
+
+	plain := make([]byte, 0, len(bhash)+1+len(blb.Data))
+	plain = append(plain, bhash...)
+	plain = append(plain, flag)
+	plain = append(plain, blb.Data...)
+
+	box := make([]byte, len(blobHeaderV2)+nonceLength)
+	copy(box[:], blobHeaderV2)
+	copy(box[len(blobHeaderV2):], nonce[:])
+	return secretbox.Seal(box, plain, nonce, nkey), nil
+}
+
+// Unseal decrypts a sealed blob (both the current and the legacy format are supported) and returns the plain-text
+// hash along with the data
+func Unseal(nkey *[32]byte, data []byte) (string, []byte, error) {
+	if !bytes.HasPrefix(data, blobHeaderV2) {
+		if len(data) < len(blobHeader)+32 || !bytes.Equal(blobHeader, data[0:21]) {
+			return "", nil, fmt.Errorf("missing header")
+		}
+		decoded, err := openLegacy(nkey, data)
+		if err != nil {
+			return "", nil, err
+		}
+		return hex.EncodeToString(data[21:53]), decoded, nil
+	}
+
+	if len(data) < len(blobHeaderV2)+nonceLength {
+		return "", nil, fmt.Errorf("truncated blob")
+	}
+	nonce := new([nonceLength]byte)
+	copy(nonce[:], data[len(blobHeaderV2):len(blobHeaderV2)+nonceLength])
+	decrypted, success := secretbox.Open(nil, data[len(blobHeaderV2)+nonceLength:], nonce, nkey)
+	if !success || len(decrypted) < 33 {
+		return "", nil, errors.New("failed to decrypt file (bad password?)")
+	}
+	return hex.EncodeToString(decrypted[0:32]), decrypted[33:], nil
+}
+
+// Open a previously sealed secretbox
 func Open(nkey *[32]byte, data []byte) ([]byte, error) {
+	_, decoded, err := Unseal(nkey, data)
+	return decoded, err
+}
+
+// openLegacy opens a blob sealed with the legacy format (the plain-text hash is stored in the header)
+func openLegacy(nkey *[32]byte, data []byte) ([]byte, error) {
+	if len(data) < nonceLength+32+2+len(blobHeader) {
+		return nil, fmt.Errorf("truncated blob")
+	}
 	// Extract the nonce
 	nonce := new([nonceLength]byte)
 	copy(nonce[:], data[len(blobHeader)+32+2:len(blobHeader)+32+2+nonceLength])
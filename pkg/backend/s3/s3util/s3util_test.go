@@ -0,0 +1,49 @@
+package s3util
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/hashutil"
+)
+
+func TestSealFormats(t *testing.T) {
+	key := new([32]byte)
+	if _, err := rand.Read(key[:]); err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("hello")
+	blb := &blob.Blob{Hash: hashutil.Compute(data), Data: data}
+
+	// The S3 backend relies on the legacy format (the plain-text hash must be readable from the header)
+	sealed, err := Seal(key, blb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(sealed, blobHeader) || bytes.HasPrefix(sealed, blobHeaderV2) {
+		t.Fatalf("Seal must use the legacy format")
+	}
+
+	sealedV2, err := SealV2(key, blb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(sealedV2, blobHeaderV2) {
+		t.Fatalf("SealV2 must use the v2 format")
+	}
+	if bytes.Contains(sealedV2, []byte(blb.Hash[:16])) {
+		t.Fatalf("SealV2 must not leak the plain-text hash")
+	}
+
+	for _, s := range [][]byte{sealed, sealedV2} {
+		hash, decoded, err := Unseal(key, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hash != blb.Hash || !bytes.Equal(decoded, data) {
+			t.Errorf("bad unseal, got %q/%q", hash, decoded)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+/*
+Package backup implements the export/import of a whole BlobStash instance as a portable tar archive.
+
+Everything in BlobStash is stored as blobs (the kv entries are backed by "meta blobs", and the FS roots are kv
+entries), so the archive contains every blob (`blobs/<hash>`), and importing them into a fresh instance rebuilds
+the kv index. The latest kv entries (`kvs.json`), the FS roots (`fs_roots.json`) and a manifest (`manifest.json`,
+always the last entry) are also included so the archive can be inspected/verified without BlobStash.
+*/
+package backup // import "a4.io/blobstash/pkg/backup"
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+	"time"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/ctxutil"
+	"a4.io/blobstash/pkg/stash/store"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+// FormatVersion is the version of the archive layout
+const FormatVersion = 1
+
+const (
+	blobsDir     = "blobs/"
+	kvsFile      = "kvs.json"
+	fsRootsFile  = "fs_roots.json"
+	manifestFile = "manifest.json"
+
+	fsKeyPrefix = "_filetree:fs:"
+)
+
+var pageSize = 1000
+
+// Manifest holds the archive summary
+type Manifest struct {
+	Version    int       `json:"version"`
+	CreatedAt  time.Time `json:"created_at"`
+	BlobsCount int       `json:"blobs_count"`
+	BlobsSize  int64     `json:"blobs_size"`
+	KvsCount   int       `json:"kvs_count"`
+	FSCount    int       `json:"fs_count"`
+}
+
+// KvEntry holds the latest version of a kv entry
+type KvEntry struct {
+	Key     string `json:"key"`
+	Version int64  `json:"version"`
+	Ref     string `json:"ref,omitempty"`
+	Data    []byte `json:"data,omitempty"`
+}
+
+// FSRoot holds the latest root of a filetree FS
+type FSRoot struct {
+	Name    string `json:"name"`
+	Ref     string `json:"ref"`
+	Version int64  `json:"version"`
+}
+
+func writeFile(tw *tar.Writer, name string, data []byte, modTime time.Time) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    int64(len(data)),
+		ModTime: modTime,
+	}); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+func writeJSON(tw *tar.Writer, name string, v interface{}, modTime time.Time) error {
+	js, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return writeFile(tw, name, js, modTime)
+}
+
+// Export streams all the blobs and kv entries to the given writer as a tar archive
+func Export(ctx context.Context, w io.Writer, bs store.BlobStore, kvs store.KvStore) (*Manifest, error) {
+	manifest := &Manifest{
+		Version:   FormatVersion,
+		CreatedAt: time.Now().UTC(),
+	}
+	tw := tar.NewWriter(w)
+	// Exporting must not mark all the blobs as hot
+	ctx = ctxutil.WithSkipAccessTracking(ctx)
+
+	// Blobs
+	r := &blob.Range{Limit: pageSize}
+	for r != nil {
+		refs, err := bs.Enumerate(ctx, r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to enumerate blobs: %v", err)
+		}
+		for _, ref := range refs {
+			data, err := bs.Get(ctx, ref.Hash)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get blob %s: %v", ref.Hash, err)
+			}
+			if err := writeFile(tw, blobsDir+ref.Hash, data, manifest.CreatedAt); err != nil {
+				return nil, err
+			}
+			manifest.BlobsCount++
+			manifest.BlobsSize += int64(len(data))
+		}
+		r = r.Next(refs)
+	}
+
+	// Latest version of the kv entries and the FS roots
+	entries := []*KvEntry{}
+	roots := []*FSRoot{}
+	start := ""
+	for {
+		res, cursor, err := kvs.Keys(ctx, start, "\xff", pageSize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list kv entries: %v", err)
+		}
+		for _, kv := range res {
+			entries = append(entries, &KvEntry{kv.Key, kv.Version, kv.HexHash(), kv.Data})
+			if strings.HasPrefix(kv.Key, fsKeyPrefix) {
+				roots = append(roots, &FSRoot{strings.TrimPrefix(kv.Key, fsKeyPrefix), kv.HexHash(), kv.Version})
+			}
+		}
+		if len(res) < pageSize {
+			break
+		}
+		start = cursor
+	}
+	manifest.KvsCount = len(entries)
+	manifest.FSCount = len(roots)
+
+	if err := writeJSON(tw, kvsFile, entries, manifest.CreatedAt); err != nil {
+		return nil, err
+	}
+	if err := writeJSON(tw, fsRootsFile, roots, manifest.CreatedAt); err != nil {
+		return nil, err
+	}
+	if err := writeJSON(tw, manifestFile, manifest, manifest.CreatedAt); err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// Import restores the blobs from the given tar archive, the kv store is rebuilt from the meta blobs and then
+// verified against the exported kv entries.
+func Import(ctx context.Context, r io.Reader, bs store.BlobStore, kvs store.KvStore) (*Manifest, error) {
+	var manifest *Manifest
+	var entries []*KvEntry
+	var blobsCount int
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case strings.HasPrefix(hdr.Name, blobsDir):
+			data, err := ioutil.ReadAll(tr)
+			if err != nil {
+				return nil, err
+			}
+			b := &blob.Blob{Hash: path.Base(hdr.Name), Data: data}
+			if err := b.Check(); err != nil {
+				return nil, fmt.Errorf("corrupted blob %s: %v", b.Hash, err)
+			}
+			if _, err := bs.Put(ctx, b); err != nil {
+				return nil, fmt.Errorf("failed to put blob %s: %v", b.Hash, err)
+			}
+			blobsCount++
+		case hdr.Name == kvsFile:
+			if err := json.NewDecoder(tr).Decode(&entries); err != nil {
+				return nil, fmt.Errorf("failed to decode %s: %v", kvsFile, err)
+			}
+		case hdr.Name == manifestFile:
+			manifest = &Manifest{}
+			if err := json.NewDecoder(tr).Decode(manifest); err != nil {
+				return nil, fmt.Errorf("failed to decode %s: %v", manifestFile, err)
+			}
+		}
+	}
+
+	if manifest == nil {
+		return nil, fmt.Errorf("missing %s, the archive is truncated", manifestFile)
+	}
+	if manifest.Version != FormatVersion {
+		return nil, fmt.Errorf("unsupported archive version %d", manifest.Version)
+	}
+	if blobsCount != manifest.BlobsCount {
+		return nil, fmt.Errorf("archive contains %d blobs, expected %d", blobsCount, manifest.BlobsCount)
+	}
+
+	// Ensure the kv entries were rebuilt from the meta blobs
+	for _, entry := range entries {
+		kv, err := kvs.Get(ctx, entry.Key, entry.Version)
+		if err != nil {
+			if err == vkv.ErrNotFound {
+				return nil, fmt.Errorf("kv entry %q (version %d) not restored", entry.Key, entry.Version)
+			}
+			return nil, err
+		}
+		if kv.HexHash() != entry.Ref {
+			return nil, fmt.Errorf("kv entry %q (version %d) ref mismatch", entry.Key, entry.Version)
+		}
+	}
+	return manifest, nil
+}
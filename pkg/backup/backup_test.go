@@ -0,0 +1,157 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/blobstore"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/hashutil"
+	"a4.io/blobstash/pkg/hub"
+	"a4.io/blobstash/pkg/kvstore"
+	"a4.io/blobstash/pkg/meta"
+)
+
+func check(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
+
+func newStores(dir string) (*blobstore.BlobStore, *kvstore.KvStore) {
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	chub := hub.New(logger.New("app", "hub"), true)
+	metaHandler, err := meta.New(logger.New("app", "meta"), chub)
+	check(err)
+	bs, err := blobstore.New(logger.New("app", "blobstore"), true, dir, nil, chub)
+	check(err)
+	kvs, err := kvstore.New(logger.New("app", "kvstore"), dir, bs, metaHandler)
+	check(err)
+	return bs, kvs
+}
+
+func TestExportImport(t *testing.T) {
+	src, err := ioutil.TempDir("", "blobstash-backup-src")
+	check(err)
+	defer os.RemoveAll(src)
+	dst, err := ioutil.TempDir("", "blobstash-backup-dst")
+	check(err)
+	defer os.RemoveAll(dst)
+
+	ctx := context.Background()
+	bs, kvs := newStores(src)
+	for i := 0; i < 10; i++ {
+		data := []byte(fmt.Sprintf("blob %d", i))
+		_, err := bs.Put(ctx, &blob.Blob{Hash: hashutil.Compute(data), Data: data})
+		check(err)
+	}
+	ref := hashutil.Compute([]byte("blob 1"))
+	_, err = kvs.Put(ctx, "_filetree:fs:test", ref, nil, -1)
+	check(err)
+	kv, err := kvs.Put(ctx, "hello", "", []byte("world"), -1)
+	check(err)
+
+	var buf bytes.Buffer
+	manifest, err := Export(ctx, &buf, bs, kvs)
+	check(err)
+	check(kvs.Close())
+	check(bs.Close())
+
+	// 10 blobs + 2 meta blobs
+	if manifest.BlobsCount != 12 || manifest.KvsCount != 2 || manifest.FSCount != 1 {
+		t.Errorf("unexpected manifest %+v", manifest)
+	}
+
+	bs2, kvs2 := newStores(dst)
+	defer bs2.Close()
+	defer kvs2.Close()
+	imported, err := Import(ctx, &buf, bs2, kvs2)
+	check(err)
+	if imported.BlobsCount != manifest.BlobsCount {
+		t.Errorf("expected %d blobs, got %d", manifest.BlobsCount, imported.BlobsCount)
+	}
+	kv2, err := kvs2.Get(ctx, "hello", -1)
+	check(err)
+	if string(kv2.Data) != "world" || kv2.Version != kv.Version {
+		t.Errorf("kv not restored, got %+v", kv2)
+	}
+	fsRoot, err := kvs2.Get(ctx, "_filetree:fs:test", -1)
+	check(err)
+	if fsRoot.HexHash() != ref {
+		t.Errorf("FS root not restored, got %+v", fsRoot)
+	}
+}
+
+func TestIncrementalExport(t *testing.T) {
+	src, err := ioutil.TempDir("", "blobstash-backup-src")
+	check(err)
+	defer os.RemoveAll(src)
+	dst, err := ioutil.TempDir("", "blobstash-backup-dst")
+	check(err)
+	defer os.RemoveAll(dst)
+	targetDir, err := ioutil.TempDir("", "blobstash-backup-target")
+	check(err)
+	defer os.RemoveAll(targetDir)
+
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	ctx := context.Background()
+	bs, kvs := newStores(src)
+	defer bs.Close()
+	defer kvs.Close()
+	put := func(start, end int) {
+		for i := start; i < end; i++ {
+			data := []byte(fmt.Sprintf("blob %d", i))
+			_, err := bs.Put(ctx, &blob.Blob{Hash: hashutil.Compute(data), Data: data})
+			check(err)
+		}
+	}
+
+	conf := &config.Config{DataDir: src, SecretKey: "secret"}
+	tconf := &config.ExportTarget{Name: "test", Dir: targetDir}
+	e, err := NewExporter(logger, conf, tconf, bs)
+	check(err)
+
+	put(0, 5)
+	m1, err := e.Run(ctx)
+	check(err)
+	if m1 == nil || m1.Seq != 1 || len(m1.Blobs) != 5 {
+		t.Errorf("unexpected first manifest %+v", m1)
+	}
+	m, err := e.Run(ctx)
+	check(err)
+	if m != nil {
+		t.Errorf("nothing should have been exported, got %+v", m)
+	}
+	put(5, 8)
+	m2, err := e.Run(ctx)
+	check(err)
+	if m2 == nil || m2.Seq != 2 || len(m2.Blobs) != 3 || m2.Prev == "" {
+		t.Errorf("unexpected second manifest %+v", m2)
+	}
+	check(e.Close())
+
+	target, err := NewTarget(tconf)
+	check(err)
+
+	// The manifests must be signed with the secret key
+	bs2, kvs2 := newStores(dst)
+	defer bs2.Close()
+	defer kvs2.Close()
+	if _, err := Restore(ctx, target, []byte("wrong"), bs2); err == nil {
+		t.Errorf("restore should have failed with the wrong key")
+	}
+	restored, err := Restore(ctx, target, []byte("secret"), bs2)
+	check(err)
+	if restored.BlobsCount != 8 {
+		t.Errorf("expected 8 blobs, got %d", restored.BlobsCount)
+	}
+}
@@ -0,0 +1,153 @@
+package backup // import "a4.io/blobstash/pkg/backup"
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/gorilla/mux"
+	log "github.com/inconshreveable/log15"
+	"github.com/robfig/cron"
+
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/lifecycle"
+	"a4.io/blobstash/pkg/perms"
+	"a4.io/blobstash/pkg/stash/store"
+)
+
+// Exports manages the incremental export targets defined in the config
+type Exports struct {
+	exporters map[string]*Exporter
+	cron      *cron.Cron
+	lc        *lifecycle.Lifecycle
+	log       log.Logger
+}
+
+// NewExports initializes the exporters, and schedules them
+func NewExports(logger log.Logger, conf *config.Config, bs store.BlobStore, lc *lifecycle.Lifecycle) (*Exports, error) {
+	logger.Debug("init")
+	exports := &Exports{
+		exporters: map[string]*Exporter{},
+		cron:      cron.New(),
+		lc:        lc,
+		log:       logger,
+	}
+	for _, tconf := range conf.Exports {
+		e, err := NewExporter(logger.New("export", tconf.Name), conf, tconf, bs)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize export %q: %v", tconf.Name, err)
+		}
+		exports.exporters[tconf.Name] = e
+		if tconf.Schedule != "" {
+			if err := exports.cron.AddFunc(tconf.Schedule, exports.runFunc(e)); err != nil {
+				return nil, fmt.Errorf("invalid schedule for export %q: %v", tconf.Name, err)
+			}
+		}
+	}
+	exports.cron.Start()
+	return exports, nil
+}
+
+func (exports *Exports) runFunc(e *Exporter) func() {
+	return func() {
+		exports.lc.Go("exports-"+e.name, func(ctx context.Context) {
+			if _, err := e.Run(ctx); err != nil {
+				e.log.Error("export failed", "err", err)
+			}
+		})
+	}
+}
+
+// Close stops the scheduler and closes the exporters
+func (exports *Exports) Close() error {
+	exports.cron.Stop()
+	for _, e := range exports.exporters {
+		if err := e.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Register registers the exports endpoints
+func (exports *Exports) Register(r *mux.Router, basicAuth func(http.Handler) http.Handler) {
+	r.Handle("/", basicAuth(http.HandlerFunc(exports.statusHandler())))
+	r.Handle("/{name}/_run", basicAuth(http.HandlerFunc(exports.runHandler())))
+}
+
+func (exports *Exports) statusHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET", "HEAD":
+			if !auth.Can(
+				w,
+				r,
+				perms.Action(perms.Admin, perms.Config),
+				perms.Resource(perms.Server, perms.Config),
+			) {
+				auth.Forbidden(w)
+				return
+			}
+			names := []string{}
+			for name := range exports.exporters {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			out := []map[string]interface{}{}
+			for _, name := range names {
+				out = append(out, exports.exporters[name].Status())
+			}
+			httputil.MarshalAndWrite(r, w, map[string]interface{}{
+				"data": out,
+			})
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func (exports *Exports) runHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			if !auth.Can(
+				w,
+				r,
+				perms.Action(perms.Admin, perms.Config),
+				perms.Resource(perms.Server, perms.Config),
+			) {
+				auth.Forbidden(w)
+				return
+			}
+			name := mux.Vars(r)["name"]
+			e, ok := exports.exporters[name]
+			if !ok {
+				httputil.WriteJSONError(w, http.StatusNotFound, fmt.Sprintf("export %q not found", name))
+				return
+			}
+
+			// The export must complete before shutting down
+			done, err := exports.lc.Track()
+			if err != nil {
+				httputil.WriteJSONError(w, http.StatusServiceUnavailable, err.Error())
+				return
+			}
+			defer done()
+			manifest, err := e.Run(r.Context())
+			if err != nil {
+				httputil.WriteJSONError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			if manifest == nil {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			httputil.MarshalAndWrite(r, w, manifest)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
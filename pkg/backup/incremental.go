@@ -0,0 +1,349 @@
+package backup // import "a4.io/blobstash/pkg/backup"
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/ctxutil"
+	"a4.io/blobstash/pkg/rangedb"
+	"a4.io/blobstash/pkg/stash/store"
+)
+
+// ErrObjectNotFound is returned by a `Target` when the key does not exist
+var ErrObjectNotFound = errors.New("object not found")
+
+const manifestsDir = "manifests/"
+
+var (
+	exportedKeyPrefix = "b:"
+	seqKey            = []byte("_seq")
+	lastManifestKey   = []byte("_last")
+)
+
+func blobKey(hash string) string {
+	return blobsDir + hash[:2] + "/" + hash
+}
+
+func manifestKey(seq int64) string {
+	return fmt.Sprintf("%s%020d.json", manifestsDir, seq)
+}
+
+// IncrementalManifest lists the blobs exported during a run, each manifest references the previous one (by its
+// SHA-256 hash), and is signed with the server secret key (HMAC-SHA256).
+type IncrementalManifest struct {
+	Seq       int64     `json:"seq"`
+	Prev      string    `json:"prev,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	Blobs     []string  `json:"blobs"`
+	BlobsSize int64     `json:"blobs_size"`
+	Signature string    `json:"signature,omitempty"`
+}
+
+func (m *IncrementalManifest) sign(key []byte) (string, error) {
+	unsigned := *m
+	unsigned.Signature = ""
+	js, err := json.Marshal(&unsigned)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(js)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+func (m *IncrementalManifest) verify(key []byte) error {
+	expected, err := m.sign(key)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(expected), []byte(m.Signature)) {
+		return fmt.Errorf("invalid signature for manifest %d", m.Seq)
+	}
+	return nil
+}
+
+func manifestHash(data []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(data))
+}
+
+// readManifests returns the manifests (and their hashes), after verifying the chain
+func readManifests(t Target, key []byte) ([]*IncrementalManifest, []string, error) {
+	keys, err := t.List(manifestsDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	manifests := []*IncrementalManifest{}
+	hashes := []string{}
+	var prev string
+	for i, k := range keys {
+		data, err := t.Get(k)
+		if err != nil {
+			return nil, nil, err
+		}
+		m := &IncrementalManifest{}
+		if err := json.Unmarshal(data, m); err != nil {
+			return nil, nil, fmt.Errorf("failed to decode manifest %s: %v", k, err)
+		}
+		if m.Seq != int64(i+1) || m.Prev != prev {
+			return nil, nil, fmt.Errorf("broken manifest chain at %s", k)
+		}
+		if err := m.verify(key); err != nil {
+			return nil, nil, err
+		}
+		prev = manifestHash(data)
+		manifests = append(manifests, m)
+		hashes = append(hashes, prev)
+	}
+	return manifests, hashes, nil
+}
+
+// Exporter periodically exports the new blobs to a target
+type Exporter struct {
+	name   string
+	target Target
+	bs     store.BlobStore
+	key    []byte
+
+	// Local index of the already exported blobs
+	index *rangedb.RangeDB
+
+	lastRun  time.Time
+	lastErr  error
+	lastSeq  int64
+	running  bool
+	mu       sync.Mutex
+	statusMu sync.Mutex
+
+	log log.Logger
+}
+
+// NewExporter initializes an exporter for the given target
+func NewExporter(logger log.Logger, conf *config.Config, tconf *config.ExportTarget, bs store.BlobStore) (*Exporter, error) {
+	logger.Debug("init")
+	if conf.SecretKey == "" {
+		return nil, fmt.Errorf("missing secret_key in config")
+	}
+	target, err := NewTarget(tconf)
+	if err != nil {
+		return nil, err
+	}
+	index, err := rangedb.New(filepath.Join(conf.VarDir(), fmt.Sprintf("export-%s.index", tconf.Name)))
+	if err != nil {
+		return nil, err
+	}
+	return &Exporter{
+		name:   tconf.Name,
+		target: target,
+		bs:     bs,
+		key:    []byte(conf.SecretKey),
+		index:  index,
+		log:    logger,
+	}, nil
+}
+
+// Close closes the local index
+func (e *Exporter) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.index.Close()
+}
+
+func encodeSeq(seq int64) []byte {
+	out := make([]byte, 8)
+	binary.BigEndian.PutUint64(out, uint64(seq))
+	return out
+}
+
+// state returns the last manifest seq/hash, the local index is rebuilt from the target if needed
+func (e *Exporter) state() (int64, string, error) {
+	seq, err := e.index.Get(seqKey)
+	if err != nil {
+		return 0, "", err
+	}
+	if seq != nil {
+		last, err := e.index.Get(lastManifestKey)
+		if err != nil {
+			return 0, "", err
+		}
+		return int64(binary.BigEndian.Uint64(seq)), string(last), nil
+	}
+
+	// The local index is empty (first run or lost), rebuild it from the manifests
+	manifests, hashes, err := readManifests(e.target, e.key)
+	if err != nil {
+		return 0, "", err
+	}
+	if len(manifests) == 0 {
+		return 0, "", nil
+	}
+	e.log.Info("rebuilding the local export index", "manifests", len(manifests))
+	for _, m := range manifests {
+		for _, hash := range m.Blobs {
+			if err := e.index.Set([]byte(exportedKeyPrefix+hash), []byte{1}); err != nil {
+				return 0, "", err
+			}
+		}
+	}
+	last := manifests[len(manifests)-1]
+	lastHash := hashes[len(hashes)-1]
+	if err := e.index.Set(seqKey, encodeSeq(last.Seq)); err != nil {
+		return 0, "", err
+	}
+	if err := e.index.Set(lastManifestKey, []byte(lastHash)); err != nil {
+		return 0, "", err
+	}
+	return last.Seq, lastHash, nil
+}
+
+// Run exports the blobs not exported yet, and writes a new manifest (returns nil if there was nothing to export)
+func (e *Exporter) Run(ctx context.Context) (manifest *IncrementalManifest, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.setRunning(true)
+	defer func() {
+		e.statusMu.Lock()
+		defer e.statusMu.Unlock()
+		e.running = false
+		e.lastRun = time.Now()
+		e.lastErr = err
+		if manifest != nil {
+			e.lastSeq = manifest.Seq
+		}
+	}()
+
+	seq, prev, err := e.state()
+	if err != nil {
+		return nil, err
+	}
+
+	manifest = &IncrementalManifest{
+		Seq:       seq + 1,
+		Prev:      prev,
+		CreatedAt: time.Now().UTC(),
+		Blobs:     []string{},
+	}
+	r := &blob.Range{Limit: pageSize}
+	for r != nil {
+		refs, err := e.bs.Enumerate(ctx, r)
+		if err != nil {
+			return nil, err
+		}
+		for _, ref := range refs {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			exported, err := e.index.Has([]byte(exportedKeyPrefix + ref.Hash))
+			if err != nil {
+				return nil, err
+			}
+			if exported {
+				continue
+			}
+			data, err := e.bs.Get(ctxutil.WithSkipAccessTracking(ctx), ref.Hash)
+			if err != nil {
+				return nil, err
+			}
+			if err := e.target.Put(blobKey(ref.Hash), data); err != nil {
+				return nil, fmt.Errorf("failed to export blob %s: %v", ref.Hash, err)
+			}
+			manifest.Blobs = append(manifest.Blobs, ref.Hash)
+			manifest.BlobsSize += int64(len(data))
+		}
+		r = r.Next(refs)
+	}
+
+	if len(manifest.Blobs) == 0 {
+		e.log.Info("nothing to export")
+		return nil, nil
+	}
+
+	if manifest.Signature, err = manifest.sign(e.key); err != nil {
+		return nil, err
+	}
+	js, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	if err := e.target.Put(manifestKey(manifest.Seq), js); err != nil {
+		return nil, err
+	}
+
+	// The blobs are only marked as exported once the manifest is saved
+	for _, hash := range manifest.Blobs {
+		if err := e.index.Set([]byte(exportedKeyPrefix+hash), []byte{1}); err != nil {
+			return nil, err
+		}
+	}
+	if err := e.index.Set(seqKey, encodeSeq(manifest.Seq)); err != nil {
+		return nil, err
+	}
+	if err := e.index.Set(lastManifestKey, []byte(manifestHash(js))); err != nil {
+		return nil, err
+	}
+	e.log.Info("export done", "seq", manifest.Seq, "blobs", len(manifest.Blobs), "size", manifest.BlobsSize)
+	return manifest, nil
+}
+
+func (e *Exporter) setRunning(running bool) {
+	e.statusMu.Lock()
+	defer e.statusMu.Unlock()
+	e.running = running
+}
+
+// Status returns the status of the exporter
+func (e *Exporter) Status() map[string]interface{} {
+	e.statusMu.Lock()
+	defer e.statusMu.Unlock()
+	out := map[string]interface{}{
+		"name":     e.name,
+		"running":  e.running,
+		"last_seq": e.lastSeq,
+	}
+	if !e.lastRun.IsZero() {
+		out["last_run"] = e.lastRun.Format(time.RFC3339)
+	}
+	if e.lastErr != nil {
+		out["last_error"] = e.lastErr.Error()
+	}
+	return out
+}
+
+// Restore puts all the blobs from the target manifests into the blobstore (after verifying the manifest chain)
+func Restore(ctx context.Context, t Target, key []byte, bs store.BlobStore) (*Manifest, error) {
+	manifests, _, err := readManifests(t, key)
+	if err != nil {
+		return nil, err
+	}
+	res := &Manifest{Version: FormatVersion, CreatedAt: time.Now().UTC()}
+	for _, m := range manifests {
+		for _, hash := range m.Blobs {
+			data, err := t.Get(blobKey(hash))
+			if err != nil {
+				return nil, fmt.Errorf("failed to get blob %s: %v", hash, err)
+			}
+			b := &blob.Blob{Hash: hash, Data: data}
+			if err := b.Check(); err != nil {
+				return nil, fmt.Errorf("corrupted blob %s: %v", hash, err)
+			}
+			if _, err := bs.Put(ctx, b); err != nil {
+				return nil, err
+			}
+			res.BlobsCount++
+			res.BlobsSize += int64(len(data))
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,178 @@
+package backup // import "a4.io/blobstash/pkg/backup"
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"a4.io/blobstash/pkg/backend/s3/s3util"
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/throttle"
+)
+
+// Target is the storage for the incremental exports
+type Target interface {
+	// Put stores an object at the given key (overwriting it)
+	Put(key string, data []byte) error
+	// Get returns the object data, or `ErrObjectNotFound`
+	Get(key string) ([]byte, error)
+	// List returns the (sorted) keys starting with the given prefix
+	List(prefix string) ([]string, error)
+}
+
+// NewTarget initializes the target from its config
+func NewTarget(conf *config.ExportTarget) (Target, error) {
+	if conf.Dir != "" {
+		return &dirTarget{conf.Dir}, nil
+	}
+	return newS3Target(conf.S3)
+}
+
+// dirTarget stores the objects as files in a local directory
+type dirTarget struct {
+	dir string
+}
+
+func (t *dirTarget) Put(key string, data []byte) error {
+	path := filepath.Join(t.dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	// Write to a temp file first so a crash never leaves a truncated object
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (t *dirTarget) Get(key string) ([]byte, error) {
+	data, err := ioutil.ReadFile(filepath.Join(t.dir, filepath.FromSlash(key)))
+	if os.IsNotExist(err) {
+		return nil, ErrObjectNotFound
+	}
+	return data, err
+}
+
+func (t *dirTarget) List(prefix string) ([]string, error) {
+	dir, base := filepath.Split(filepath.FromSlash(prefix))
+	infos, err := ioutil.ReadDir(filepath.Join(t.dir, dir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+	out := []string{}
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || !strings.HasPrefix(name, base) || strings.HasSuffix(name, ".tmp") {
+			continue
+		}
+		out = append(out, filepath.ToSlash(filepath.Join(dir, name)))
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// s3Target stores the objects in a S3 bucket (blobs are encrypted if a key is configured)
+type s3Target struct {
+	svc    *s3.S3
+	bucket *s3util.Bucket
+	key    *[32]byte
+}
+
+func newS3Target(conf *config.S3Repl) (*s3Target, error) {
+	key, err := conf.Key()
+	if err != nil {
+		return nil, err
+	}
+	var sess *session.Session
+	if conf.Endpoint != "" {
+		sess, err = s3util.NewWithCustomEndoint(conf.AccessKey, conf.SecretKey, conf.Region, conf.Endpoint)
+	} else {
+		sess, err = s3util.New(conf.Region)
+	}
+	if err != nil {
+		return nil, err
+	}
+	svc := s3.New(sess)
+	bucket := s3util.NewBucket(svc, conf.Bucket)
+	ok, err := bucket.Exists()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		if err := bucket.Create(); err != nil {
+			return nil, err
+		}
+	}
+	return &s3Target{svc, bucket, key}, nil
+}
+
+func (t *s3Target) Put(key string, data []byte) error {
+	if t.key != nil && strings.HasPrefix(key, blobsDir) {
+		var err error
+		if data, err = s3util.Seal(t.key, &blob.Blob{Hash: filepath.Base(key), Data: data}); err != nil {
+			return err
+		}
+	}
+	if err := throttle.Upload().WaitN(context.TODO(), len(data)); err != nil {
+		return err
+	}
+	_, err := t.svc.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(t.bucket.Name),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(data),
+	})
+	return err
+}
+
+func (t *s3Target) Get(key string) ([]byte, error) {
+	r, err := t.bucket.GetObject(key).Reader()
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+			return nil, ErrObjectNotFound
+		}
+		return nil, err
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(throttle.Download().Reader(context.TODO(), r))
+	if err != nil {
+		return nil, err
+	}
+	if t.key != nil && strings.HasPrefix(key, blobsDir) {
+		return s3util.Open(t.key, data)
+	}
+	return data, nil
+}
+
+func (t *s3Target) List(prefix string) ([]string, error) {
+	out := []string{}
+	var marker string
+	for {
+		objects, err := t.bucket.ListPrefix(prefix, marker, 1000)
+		if err != nil {
+			return nil, err
+		}
+		if len(objects) == 0 {
+			break
+		}
+		for _, o := range objects {
+			out = append(out, o.Key)
+			marker = o.Key
+		}
+	}
+	sort.Strings(out)
+	return out, nil
+}
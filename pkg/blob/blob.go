@@ -42,9 +42,8 @@ func New(data []byte) *Blob {
 
 // Check ensures the hash match the data
 func (b *Blob) Check() error {
-	chash := hashutil.Compute(b.Data)
-	if b.Hash != chash {
-		return fmt.Errorf("Hash mismatch: given=%s, computed=%v", b.Hash, chash)
+	if !hashutil.Verify(b.Hash, b.Data) {
+		return fmt.Errorf("Hash mismatch: given=%s, computed=%v", b.Hash, hashutil.Compute(b.Data))
 	}
 	return nil
 }
@@ -0,0 +1,61 @@
+package blob // import "a4.io/blobstash/pkg/blob"
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+)
+
+// Blob frames are used for streaming many blobs over a single request/response (the seed packs and the blobs upload
+// stream), each blob is framed as: <32 bytes hash><4 bytes big endian size><data>.
+
+const frameHashSize = 32
+
+// Ack is the acknowledgement of a streamed blob
+type Ack struct {
+	Hash  string `json:"hash"`
+	Saved bool   `json:"saved"` // false if the blob was already stored
+	Error string `json:"error,omitempty"`
+}
+
+// WriteFrame writes the framed blob to w
+func WriteFrame(w io.Writer, hash string, data []byte) error {
+	h, err := hex.DecodeString(hash)
+	if err != nil {
+		return err
+	}
+	if len(h) != frameHashSize {
+		return fmt.Errorf("invalid hash %q", hash)
+	}
+	size := make([]byte, 4)
+	binary.BigEndian.PutUint32(size, uint32(len(data)))
+	for _, b := range [][]byte{h, size, data} {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadFrame reads the next framed blob (returns `io.EOF` at the end of the stream), bigger blobs than maxSize are
+// rejected (if maxSize > 0). The hash is not checked.
+func ReadFrame(r io.Reader, maxSize int) (*Blob, error) {
+	h := make([]byte, frameHashSize)
+	if _, err := io.ReadFull(r, h); err != nil {
+		return nil, err
+	}
+	size := make([]byte, 4)
+	if _, err := io.ReadFull(r, size); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	n := binary.BigEndian.Uint32(size)
+	if maxSize > 0 && int64(n) > int64(maxSize) {
+		return nil, fmt.Errorf("blob %x too large (%d bytes)", h, n)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return &Blob{Hash: hex.EncodeToString(h), Data: data}, nil
+}
@@ -0,0 +1,89 @@
+package blob // import "a4.io/blobstash/pkg/blob"
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Range holds the bounds of a blobs enumeration. The hashes are compared lexicographically with the bounds (that can be
+// partial hashes, see `PrefixRange` for enumerating the hashes starting with a prefix), an empty bound is unbounded.
+// The zero value enumerates all the blobs in ascending order.
+//
+// The enumeration is paginated using the hashes as keys: `Next` returns the range of the next page, starting right
+// after the last hash of the current page.
+type Range struct {
+	Start          string // lower bound, inclusive unless StartExclusive is set
+	StartExclusive bool
+	End            string // upper bound, exclusive unless EndInclusive is set
+	EndInclusive   bool
+	Reverse        bool // descending order
+	Limit          int  // max number of blobs, 0 for no limit
+}
+
+// PrefixRange returns the range of the hashes starting with the given prefix
+func PrefixRange(prefix string) *Range {
+	return &Range{Start: prefix, End: nextPrefix(prefix)}
+}
+
+// nextPrefix returns the smallest hex string greater than all the strings starting with prefix (empty if there's none)
+func nextPrefix(prefix string) string {
+	p := []byte(prefix)
+	for i := len(p) - 1; i >= 0; i-- {
+		switch p[i] {
+		case 'f':
+			continue
+		case '9':
+			p[i] = 'a'
+		default:
+			p[i]++
+		}
+		return string(p[:i+1])
+	}
+	return ""
+}
+
+// Validate returns an error if a bound is not a (partial) lowercase hex hash
+func (r *Range) Validate() error {
+	for _, bound := range []string{r.Start, r.End} {
+		if strings.Trim(bound, "0123456789abcdef") != "" {
+			return fmt.Errorf("invalid bound %q", bound)
+		}
+	}
+	if r.Limit < 0 {
+		return fmt.Errorf("invalid limit %d", r.Limit)
+	}
+	return nil
+}
+
+// AfterStart returns true if the hash is not below the lower bound
+func (r *Range) AfterStart(hash string) bool {
+	return r.Start == "" || hash > r.Start || !r.StartExclusive && hash == r.Start
+}
+
+// BeforeEnd returns true if the hash is not above the upper bound
+func (r *Range) BeforeEnd(hash string) bool {
+	return r.End == "" || hash < r.End || r.EndInclusive && hash == r.End
+}
+
+// Contains returns true if the hash is within the bounds
+func (r *Range) Contains(hash string) bool {
+	return r.AfterStart(hash) && r.BeforeEnd(hash)
+}
+
+// Next returns the range of the page following refs (the result of the enumeration of r), or nil if it was the last
+// page (the next page may be empty if the last page was full)
+func (r *Range) Next(refs []*SizedBlobRef) *Range {
+	if r.Limit == 0 || len(refs) < r.Limit {
+		return nil
+	}
+	next := *r
+	last := refs[len(refs)-1].Hash
+	if r.Reverse {
+		next.End = last
+		next.EndInclusive = false
+	} else {
+		next.Start = last
+		next.StartExclusive = true
+	}
+	return &next
+}
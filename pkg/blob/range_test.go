@@ -0,0 +1,54 @@
+package blob
+
+import "testing"
+
+func TestRange(t *testing.T) {
+	for _, tdata := range []struct {
+		prefix, next string
+	}{
+		{"", ""},
+		{"ab", "ac"},
+		{"a9", "aa"},
+		{"af", "b"},
+		{"3ff", "4"},
+		{"fff", ""},
+	} {
+		if next := nextPrefix(tdata.prefix); next != tdata.next {
+			t.Errorf("nextPrefix(%q): expected %q, got %q", tdata.prefix, tdata.next, next)
+		}
+	}
+
+	r := PrefixRange("ab")
+	for hash, ok := range map[string]bool{"ab": true, "ab00": true, "abff": true, "aa": false, "ac": false, "ac00": false} {
+		if r.Contains(hash) != ok {
+			t.Errorf("%+v contains %q: expected %v", r, hash, ok)
+		}
+	}
+
+	r = &Range{Start: "10", StartExclusive: true, End: "20", EndInclusive: true}
+	for hash, ok := range map[string]bool{"10": false, "1000": true, "20": true, "2000": false} {
+		if r.Contains(hash) != ok {
+			t.Errorf("%+v contains %q: expected %v", r, hash, ok)
+		}
+	}
+
+	r = &Range{Start: "10", End: "20", Limit: 2}
+	if next := r.Next([]*SizedBlobRef{{Hash: "11"}}); next != nil {
+		t.Errorf("expected no next page, got %+v", next)
+	}
+	next := r.Next([]*SizedBlobRef{{Hash: "11"}, {Hash: "12"}})
+	if next == nil || next.Start != "12" || !next.StartExclusive || next.End != "20" {
+		t.Errorf("unexpected next page %+v", next)
+	}
+	r.Reverse = true
+	next = r.Next([]*SizedBlobRef{{Hash: "19"}, {Hash: "18"}})
+	if next == nil || next.Start != "10" || next.End != "18" || next.EndInclusive {
+		t.Errorf("unexpected next page %+v", next)
+	}
+
+	for _, r := range []*Range{{Start: "zz"}, {End: "\xff"}, {Start: "AB"}, {Limit: -1}} {
+		if err := r.Validate(); err == nil {
+			t.Errorf("%+v should be invalid", r)
+		}
+	}
+}
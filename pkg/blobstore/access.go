@@ -0,0 +1,330 @@
+package blobstore // import "a4.io/blobstash/pkg/blobstore"
+
+import (
+	"context"
+	"encoding/binary"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobsfile"
+	"a4.io/blobstash/pkg/rangedb"
+)
+
+// Access times are coarse (truncated to the hour) and written in batch
+var (
+	accessResolution    = 1 * time.Hour
+	accessFlushInterval = 1 * time.Minute
+
+	accessKeyPrefix = "a:"
+	accessSinceKey  = []byte("_since")
+)
+
+// accessTracker records the last access time of the blobs
+type accessTracker struct {
+	db      *rangedb.RangeDB
+	pending map[string]int64
+	since   time.Time
+
+	stop chan struct{}
+	done chan struct{}
+	mu   sync.Mutex
+
+	log log.Logger
+}
+
+func newAccessTracker(logger log.Logger, path string) (*accessTracker, error) {
+	db, err := rangedb.New(path)
+	if err != nil {
+		return nil, err
+	}
+	t := &accessTracker{
+		db:      db,
+		pending: map[string]int64{},
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+		log:     logger,
+	}
+
+	// Keep track of when the tracking started, blobs without access time are considered accessed at this date
+	since, err := db.Get(accessSinceKey)
+	if err != nil {
+		return nil, err
+	}
+	if since == nil {
+		since = encodeTs(time.Now().Unix())
+		if err := db.Set(accessSinceKey, since); err != nil {
+			return nil, err
+		}
+	}
+	t.since = time.Unix(decodeTs(since), 0)
+
+	go t.loop()
+	return t, nil
+}
+
+func encodeTs(ts int64) []byte {
+	out := make([]byte, 8)
+	binary.BigEndian.PutUint64(out, uint64(ts))
+	return out
+}
+
+func decodeTs(data []byte) int64 {
+	return int64(binary.BigEndian.Uint64(data))
+}
+
+// Touch records an access for the given blob
+func (t *accessTracker) Touch(hash string) {
+	t.touchAt(hash, time.Now().Truncate(accessResolution).Unix())
+}
+
+func (t *accessTracker) touchAt(hash string, ts int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pending[hash] = ts
+}
+
+// pendingAccess returns the access time of the blob if it's not flushed yet
+func (t *accessTracker) pendingAccess(hash string) (int64, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ts, ok := t.pending[hash]
+	return ts, ok
+}
+
+func (t *accessTracker) flush() error {
+	t.mu.Lock()
+	pending := t.pending
+	t.pending = map[string]int64{}
+	t.mu.Unlock()
+
+	for hash, ts := range pending {
+		if err := t.db.Set([]byte(accessKeyPrefix+hash), encodeTs(ts)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *accessTracker) loop() {
+	defer close(t.done)
+	ticker := time.NewTicker(accessFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := t.flush(); err != nil {
+				t.log.Error("failed to flush access times", "err", err)
+			}
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+// LastAccess returns the last (known) access time of the blob
+func (t *accessTracker) LastAccess(hash string) (time.Time, error) {
+	if ts, ok := t.pendingAccess(hash); ok {
+		return time.Unix(ts, 0), nil
+	}
+
+	data, err := t.db.Get([]byte(accessKeyPrefix + hash))
+	if err != nil {
+		return time.Time{}, err
+	}
+	if data == nil {
+		return t.since, nil
+	}
+	return time.Unix(decodeTs(data), 0), nil
+}
+
+// Close flushes the pending access times
+func (t *accessTracker) Close() error {
+	close(t.stop)
+	<-t.done
+	if err := t.flush(); err != nil {
+		return err
+	}
+	return t.db.Close()
+}
+
+// ColdBlob holds a blob not accessed recently
+type ColdBlob struct {
+	Hash       string    `json:"hash"`
+	Size       int       `json:"size"`
+	LastAccess time.Time `json:"last_access"`
+}
+
+// ColdGroup holds the cold data of a namespace or of a FS (of the root namespace)
+type ColdGroup struct {
+	Type       string `json:"type"` // "namespace" or "fs"
+	Name       string `json:"name"`
+	BlobsCount int    `json:"blobs_count"`
+	BlobsSize  int64  `json:"blobs_size"`
+	ColdCount  int    `json:"cold_blobs_count"`
+	ColdSize   int64  `json:"cold_blobs_size"`
+}
+
+// ColdReport holds a summary of the data not accessed recently
+type ColdReport struct {
+	Cutoff        time.Time    `json:"cutoff"`
+	TrackingSince time.Time    `json:"tracking_since"`
+	BlobsCount    int          `json:"blobs_count"`
+	BlobsSize     int64        `json:"blobs_size"`
+	ColdCount     int          `json:"cold_blobs_count"`
+	ColdSize      int64        `json:"cold_blobs_size"`
+	Blobs         []*ColdBlob  `json:"blobs"`
+	Groups        []*ColdGroup `json:"groups"` // the namespaces and FS, the coldest first
+}
+
+// ShareAccessTracking records the accesses of the blobs in the access index of the given (root) blob store, so the
+// namespaces blobs are part of the cold data report
+func (bs *BlobStore) ShareAccessTracking(root *BlobStore) {
+	if root.access == nil {
+		return
+	}
+	bs.access = root.access
+	bs.sharedAccess = true
+}
+
+// SetColdGroupsFuncs sets the funcs returning the blob stores of the namespaces (managed by the stash), and the blobs
+// of each FS (managed by the filetree), used for grouping the cold data
+func (bs *BlobStore) SetColdGroupsFuncs(namespaces func() map[string]*BlobStore, fsBlobs func(context.Context) (map[string][]string, error)) {
+	bs.namespaces = namespaces
+	bs.fsBlobs = fsBlobs
+}
+
+// AccessTrackingEnabled returns true if the access times are recorded
+func (bs *BlobStore) AccessTrackingEnabled() bool {
+	return bs.access != nil
+}
+
+// LastAccess returns the last access time for the given blob
+func (bs *BlobStore) LastAccess(hash string) (time.Time, error) {
+	if bs.access == nil {
+		return time.Time{}, ErrAccessTrackingDisabled
+	}
+	return bs.access.LastAccess(hash)
+}
+
+// enumerateAccess calls fn with the last access time of each blob of the blob store
+func (bs *BlobStore) enumerateAccess(fn func(*blobsfile.Blob, time.Time)) error {
+	out := make(chan *blobsfile.Blob)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- bs.back.EnumeratePrefix(out, "", 0)
+	}()
+	var err error
+	for cblob := range out {
+		// Keep consuming the channel on error to let the enumerate goroutine returns
+		if err != nil {
+			continue
+		}
+		var lastAccess time.Time
+		lastAccess, err = bs.access.LastAccess(cblob.Hash)
+		if err != nil {
+			continue
+		}
+		fn(cblob, lastAccess)
+	}
+	if eerr := <-errc; eerr != nil {
+		return eerr
+	}
+	return err
+}
+
+// ColdReport returns the blobs not accessed since the given duration (at most `limit` blobs are listed), grouped by
+// namespace and FS
+func (bs *BlobStore) ColdReport(ctx context.Context, olderThan time.Duration, limit int) (*ColdReport, error) {
+	if bs.access == nil {
+		return nil, ErrAccessTrackingDisabled
+	}
+	report := &ColdReport{
+		Cutoff:        time.Now().Add(-olderThan),
+		TrackingSince: bs.access.since,
+		Blobs:         []*ColdBlob{},
+		Groups:        []*ColdGroup{},
+	}
+
+	// Size of the blobs (for the FS grouping), and the cold ones
+	sizes := map[string]int{}
+	cold := map[string]struct{}{}
+	if err := bs.enumerateAccess(func(cblob *blobsfile.Blob, lastAccess time.Time) {
+		report.BlobsCount++
+		report.BlobsSize += int64(cblob.Size)
+		if bs.fsBlobs != nil {
+			sizes[cblob.Hash] = cblob.Size
+		}
+		if lastAccess.Before(report.Cutoff) {
+			report.ColdCount++
+			report.ColdSize += int64(cblob.Size)
+			if bs.fsBlobs != nil {
+				cold[cblob.Hash] = struct{}{}
+			}
+			if len(report.Blobs) < limit {
+				report.Blobs = append(report.Blobs, &ColdBlob{cblob.Hash, cblob.Size, lastAccess})
+			}
+		}
+	}); err != nil {
+		return nil, err
+	}
+
+	if bs.namespaces != nil {
+		for name, nbs := range bs.namespaces() {
+			if nbs.access == nil {
+				continue
+			}
+			group := &ColdGroup{Type: "namespace", Name: name}
+			if err := nbs.enumerateAccess(func(cblob *blobsfile.Blob, lastAccess time.Time) {
+				group.BlobsCount++
+				group.BlobsSize += int64(cblob.Size)
+				if lastAccess.Before(report.Cutoff) {
+					group.ColdCount++
+					group.ColdSize += int64(cblob.Size)
+				}
+			}); err != nil {
+				return nil, err
+			}
+			report.Groups = append(report.Groups, group)
+		}
+	}
+
+	if bs.fsBlobs != nil {
+		fsBlobs, err := bs.fsBlobs(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for name, hashes := range fsBlobs {
+			group := &ColdGroup{Type: "fs", Name: name}
+			// The same blob can be referenced multiple times by a FS
+			seen := map[string]struct{}{}
+			for _, hash := range hashes {
+				size, ok := sizes[hash]
+				if _, dup := seen[hash]; dup || !ok {
+					continue
+				}
+				seen[hash] = struct{}{}
+				group.BlobsCount++
+				group.BlobsSize += int64(size)
+				if _, ok := cold[hash]; ok {
+					group.ColdCount++
+					group.ColdSize += int64(size)
+				}
+			}
+			report.Groups = append(report.Groups, group)
+		}
+	}
+
+	sort.Slice(report.Groups, func(i, j int) bool {
+		if report.Groups[i].ColdSize != report.Groups[j].ColdSize {
+			return report.Groups[i].ColdSize > report.Groups[j].ColdSize
+		}
+		if report.Groups[i].Type != report.Groups[j].Type {
+			return report.Groups[i].Type < report.Groups[j].Type
+		}
+		return report.Groups[i].Name < report.Groups[j].Name
+	})
+	return report, nil
+}
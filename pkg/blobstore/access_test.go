@@ -0,0 +1,97 @@
+package blobstore
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/ctxutil"
+	"a4.io/blobstash/pkg/hub"
+)
+
+func TestColdReportGroups(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstore-cold")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	h := hub.New(logger, true)
+	root, err := New(logger, true, dir, &config.Config{BlobAccessTracking: true}, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.Close()
+	ns, err := New(logger, false, dir+"/ns", nil, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Close()
+	ns.ShareAccessTracking(root)
+
+	ctx := context.Background()
+	put := func(bs *BlobStore, data string) string {
+		b := blob.New([]byte(data))
+		if _, err := bs.Put(ctx, b); err != nil {
+			t.Fatal(err)
+		}
+		return b.Hash
+	}
+	hot := put(root, "hot")
+	cold := put(root, "cold!")
+	put(root, "not in any FS")
+	nsHot := put(ns, "ns hot")
+	put(ns, "ns cold")
+
+	// The namespace reads are tracked by the root
+	if _, err := ns.Get(ctx, nsHot); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := root.access.pendingAccess(nsHot); !ok {
+		t.Errorf("the namespace read should be tracked")
+	}
+	// The internal reads are not tracked
+	root.access.touchAt(cold, 1)
+	if _, err := root.Get(ctxutil.WithSkipAccessTracking(ctx), cold); err != nil {
+		t.Fatal(err)
+	}
+	if ts, _ := root.access.pendingAccess(cold); ts != 1 {
+		t.Errorf("the internal read should not be tracked")
+	}
+	// Only the blobs read in the future are not cold
+	for _, hash := range []string{hot, nsHot} {
+		root.access.touchAt(hash, time.Now().Add(24*time.Hour).Unix())
+	}
+
+	root.SetColdGroupsFuncs(func() map[string]*BlobStore {
+		return map[string]*BlobStore{"ns1": ns}
+	}, func(context.Context) (map[string][]string, error) {
+		return map[string][]string{"docs": {hot, cold, cold}}, nil
+	})
+	report, err := root.ColdReport(ctx, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.BlobsCount != 3 || report.ColdCount != 2 || len(report.Blobs) != 2 {
+		t.Errorf("unexpected report %+v", report)
+	}
+	expected := []ColdGroup{
+		{Type: "namespace", Name: "ns1", BlobsCount: 2, BlobsSize: 13, ColdCount: 1, ColdSize: 7},
+		{Type: "fs", Name: "docs", BlobsCount: 2, BlobsSize: 8, ColdCount: 1, ColdSize: 5},
+	}
+	if len(report.Groups) != len(expected) {
+		t.Fatalf("unexpected groups %+v", report.Groups)
+	}
+	for i, g := range report.Groups {
+		if *g != expected[i] {
+			t.Errorf("group %d: got %+v, expected %+v", i, g, expected[i])
+		}
+	}
+}
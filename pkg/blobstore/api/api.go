@@ -1,15 +1,21 @@
 package api // import "a4.io/blobstash/pkg/blobstore/api"
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
 
 	"a4.io/blobsfile"
 	"a4.io/blobstash/pkg/auth"
 	mblob "a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/blobstore"
 	"a4.io/blobstash/pkg/ctxutil"
 	"a4.io/blobstash/pkg/hashutil"
 	"a4.io/blobstash/pkg/httputil"
@@ -17,20 +23,58 @@ import (
 	"a4.io/blobstash/pkg/stash/store"
 )
 
+const ndjsonMimeType = "application/x-ndjson"
+
+const (
+	// Max size of a streamed blob
+	maxStreamBlobSize = 16 << 20
+	// The stream is closed if no blob is received (or no ack can be sent) for this long
+	streamIdleTimeout = 1 * time.Minute
+)
+
 type BlobStoreAPI struct {
-	bs store.BlobStore
+	bs   store.BlobStore
+	root *blobstore.BlobStore
 }
 
-func New(bs store.BlobStore) *BlobStoreAPI {
-	return &BlobStoreAPI{bs}
+func New(bs store.BlobStore, root *blobstore.BlobStore) *BlobStoreAPI {
+	return &BlobStoreAPI{bs, root}
 }
 
 func (bs *BlobStoreAPI) Register(r *mux.Router, basicAuth func(http.Handler) http.Handler) {
+	r.Handle("/_cold", basicAuth(http.HandlerFunc(bs.coldReportHandler())))
 	r.Handle("/blobs", basicAuth(http.HandlerFunc(bs.enumerateHandler())))
 	r.Handle("/upload", basicAuth(http.HandlerFunc(bs.uploadHandler())))
+	r.Handle("/stream", basicAuth(http.HandlerFunc(bs.streamHandler())))
 	r.Handle("/blob/{hash}", basicAuth(http.HandlerFunc(bs.blobHandler())))
 }
 
+// Namespace actions required by the blob handler methods
+var namespaceActions = map[string]perms.ActionType{
+	"GET":  perms.Read,
+	"HEAD": perms.Stat,
+	"POST": perms.Write,
+}
+
+// namespace returns the namespace of the request (the `ns` query arg takes precedence over the namespace header), the
+// action must be allowed on the namespace (except for the root namespace), writes a 403 response if it's not
+func namespace(w http.ResponseWriter, r *http.Request, action perms.ActionType) (string, bool) {
+	ns := r.URL.Query().Get("ns")
+	if ns == "" {
+		ns = r.Header.Get(ctxutil.NamespaceHeader)
+	}
+	if ns != "" && !auth.Can(
+		w,
+		r,
+		perms.Action(action, perms.Namespace),
+		perms.ResourceWithID(perms.Stash, perms.Namespace, ns),
+	) {
+		auth.Forbidden(w)
+		return "", false
+	}
+	return ns, true
+}
+
 func (bs *BlobStoreAPI) uploadHandler() func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
@@ -58,7 +102,11 @@ func (bs *BlobStoreAPI) uploadHandler() func(http.ResponseWriter, *http.Request)
 				return
 			}
 
-			ctx := ctxutil.WithNamespace(r.Context(), r.Header.Get(ctxutil.NamespaceHeader))
+			ns, ok := namespace(w, r, perms.Write)
+			if !ok {
+				return
+			}
+			ctx := ctxutil.WithNamespace(r.Context(), ns)
 
 			//parse the multipart form in the request
 			mr, err := r.MultipartReader()
@@ -67,6 +115,9 @@ func (bs *BlobStoreAPI) uploadHandler() func(http.ResponseWriter, *http.Request)
 				return
 			}
 
+			var savedCount int
+			deduped := []string{}
+
 			for {
 				part, err := mr.NextPart()
 				if err == io.EOF {
@@ -81,26 +132,118 @@ func (bs *BlobStoreAPI) uploadHandler() func(http.ResponseWriter, *http.Request)
 				buf.ReadFrom(part)
 				blob := buf.Bytes()
 				// FIXME(tsileo): should we do the check here? or let the storage engine do it
-				chash := hashutil.Compute(blob)
-				if hash != chash {
-					httputil.WriteJSONError(w, http.StatusInternalServerError, "blob corrupted, hash does not match, expected "+chash)
+				if !hashutil.Verify(hash, blob) {
+					httputil.WriteJSONError(w, http.StatusInternalServerError, "blob corrupted, hash does not match, expected "+hashutil.Compute(blob))
 					return
 				}
 				b := &mblob.Blob{Hash: hash, Data: blob}
-				if _, err := bs.bs.Put(ctx, b); err != nil {
+				saved, err := bs.bs.Put(ctx, b)
+				if err != nil {
 					httputil.WriteJSONError(w, http.StatusInternalServerError, err.Error())
+					return
+				}
+				if saved {
+					savedCount++
+				} else {
+					deduped = append(deduped, hash)
 				}
 			}
-			// XXX(tsileo): returns a `http.StatusNoContent` here?
+			httputil.MarshalAndWrite(r, w, map[string]interface{}{
+				"saved_count":   savedCount,
+				"deduped_count": len(deduped),
+				"deduped":       deduped,
+			})
 		default:
 			w.WriteHeader(http.StatusMethodNotAllowed)
 		}
 	}
 }
 
+// streamHandler stores the blobs streamed in the request body (as blob frames, see `blob.WriteFrame`), one ack is
+// streamed back for each blob (as newline-delimited JSON), so the clients can push many tiny blobs over a single
+// long-lived request
+func (bs *BlobStoreAPI) streamHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Write, perms.Blob),
+			perms.Resource(perms.BlobStore, perms.Blob),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+		ns, ok := namespace(w, r, perms.Write)
+		if !ok {
+			return
+		}
+		ctx := ctxutil.WithNamespace(r.Context(), ns)
+
+		rc := http.NewResponseController(w)
+		// HTTP/1.x only: keep reading the body once the response has started (HTTP/2 is always full-duplex)
+		rc.EnableFullDuplex()
+		w.Header().Set("Content-Type", ndjsonMimeType)
+		w.WriteHeader(http.StatusOK)
+		if err := rc.Flush(); err != nil {
+			return
+		}
+
+		br := bufio.NewReader(r.Body)
+		enc := json.NewEncoder(w)
+		for {
+			rc.SetReadDeadline(time.Now().Add(streamIdleTimeout))
+			b, err := mblob.ReadFrame(br, maxStreamBlobSize)
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				// The stream is corrupted, report the error and stop reading
+				enc.Encode(&mblob.Ack{Error: err.Error()})
+				rc.Flush()
+				return
+			}
+
+			ack := &mblob.Ack{Hash: b.Hash}
+			stop := false
+			if err := b.Check(); err != nil {
+				ack.Error = err.Error()
+			} else if saved, err := bs.bs.Put(ctx, b); err != nil {
+				ack.Error = err.Error()
+				stop = true
+			} else {
+				ack.Saved = saved
+			}
+
+			rc.SetWriteDeadline(time.Now().Add(streamIdleTimeout))
+			if err := enc.Encode(ack); err != nil {
+				return
+			}
+			// Batch the acks of the frames already received
+			if stop || br.Buffered() == 0 {
+				if err := rc.Flush(); err != nil || stop {
+					return
+				}
+			}
+		}
+	}
+}
+
 func (bs *BlobStoreAPI) blobHandler() func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		ctx := ctxutil.WithNamespace(r.Context(), r.Header.Get(ctxutil.NamespaceHeader))
+		action, ok := namespaceActions[r.Method]
+		if !ok {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		ns, ok := namespace(w, r, action)
+		if !ok {
+			return
+		}
+		ctx := ctxutil.WithNamespace(r.Context(), ns)
 		vars := mux.Vars(r)
 		switch r.Method {
 		case "GET":
@@ -158,6 +301,20 @@ func (bs *BlobStoreAPI) blobHandler() func(http.ResponseWriter, *http.Request) {
 				return
 			}
 
+			// Conditional put: skip the upload if the blob already exists
+			if r.Header.Get("If-None-Match") == "*" {
+				exists, err := bs.bs.Stat(ctx, vars["hash"])
+				if err != nil {
+					httputil.Error(w, err)
+					return
+				}
+				if exists {
+					w.Header().Set("BlobStash-Blob-Deduped", "1")
+					httputil.WriteErrorStatus(w, http.StatusPreconditionFailed)
+					return
+				}
+			}
+
 			blob, err := httputil.Read(r)
 			if err != nil {
 				httputil.Error(w, err)
@@ -166,15 +323,20 @@ func (bs *BlobStoreAPI) blobHandler() func(http.ResponseWriter, *http.Request) {
 
 			// FIXME(tsileo): should we do the check here? or let the storage engine do it
 			// XXX(tsileo): if the blob is already snappy encoded, find a way to skip the extra decoding/encoding like for GET
-			chash := hashutil.Compute(blob)
-			if vars["hash"] != chash {
-				httputil.WriteJSONError(w, http.StatusInternalServerError, "blob corrupted, hash does not match, expected "+chash)
+			if !hashutil.Verify(vars["hash"], blob) {
+				httputil.WriteJSONError(w, http.StatusInternalServerError, "blob corrupted, hash does not match, expected "+hashutil.Compute(blob))
 				return
 			}
 
 			b := &mblob.Blob{Hash: vars["hash"], Data: blob}
-			if _, err := bs.bs.Put(ctx, b); err != nil {
+			saved, err := bs.bs.Put(ctx, b)
+			if err != nil {
 				httputil.WriteJSONError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			if !saved {
+				// The blob was already stored
+				w.Header().Set("BlobStash-Blob-Deduped", "1")
 			}
 
 			w.WriteHeader(http.StatusCreated)
@@ -197,28 +359,65 @@ func (bs *BlobStoreAPI) enumerateHandler() func(http.ResponseWriter, *http.Reque
 				auth.Forbidden(w)
 				return
 			}
-			ctx := ctxutil.WithNamespace(r.Context(), r.Header.Get(ctxutil.NamespaceHeader))
+			ns, ok := namespace(w, r, perms.List)
+			if !ok {
+				return
+			}
+			ctx := ctxutil.WithNamespace(r.Context(), ns)
 			q := httputil.NewQuery(r.URL.Query())
-			limit, err := q.GetInt("limit", 50, 1000)
+			ndjson := r.Header.Get("Accept") == ndjsonMimeType
+			maxLimit := 1000
+			if ndjson {
+				maxLimit = 10000
+			}
+			limit, err := q.GetInt("limit", 50, maxLimit)
 			if err != nil {
 				httputil.Error(w, err)
 				return
 			}
-			// var scan bool
-			// if sscan := r.URL.Query().Get("scan"); sscan != "" {
-			// 	scan = true
-			// }
-			refs, nextCursor, err := bs.bs.Enumerate(ctx, q.Get("cursor"), "\xff", limit)
+			rng, err := blobsRange(q)
+			if err != nil {
+				httputil.WriteError(w, httputil.NewError(http.StatusBadRequest, err.Error()))
+				return
+			}
+			// Fetch an extra blob to know if there's a next page
+			rng.Limit = limit + 1
+			refs, err := bs.bs.Enumerate(ctx, rng)
 			if err != nil {
 				httputil.Error(w, err)
 				return
 			}
 
+			hasMore := len(refs) > limit
+			var nextCursor string
+			if hasMore {
+				refs = refs[:limit]
+				nextCursor = refs[limit-1].Hash
+			}
+			w.Header().Set("BlobStash-Blobs-Cursor", nextCursor)
+			w.Header().Set("BlobStash-Blobs-Has-More", strconv.FormatBool(hasMore))
+
+			if ndjson {
+				// One `{"hash": ..., "size": ...}` object per line
+				w.Header().Set("Content-Type", ndjsonMimeType)
+				enc := json.NewEncoder(w)
+				flusher, _ := w.(http.Flusher)
+				for i, ref := range refs {
+					if err := enc.Encode(ref); err != nil {
+						return
+					}
+					if flusher != nil && i%500 == 499 {
+						flusher.Flush()
+					}
+				}
+				return
+			}
+
 			httputil.MarshalAndWrite(r, w, map[string]interface{}{
 				"data": refs,
 				"pagination": map[string]interface{}{
 					"cursor":   nextCursor,
-					"has_more": len(refs) == limit,
+					"has_more": hasMore,
 					"count":    len(refs),
 					"per_page": limit,
 				},
@@ -229,3 +428,94 @@ func (bs *BlobStoreAPI) enumerateHandler() func(http.ResponseWriter, *http.Reque
 		}
 	}
 }
+
+// blobsRange parses the enumeration query args: `start` (inclusive, unless `start_exclusive=1`), `end` (exclusive, unless
+// `end_inclusive=1`), `prefix` and `reverse`. `cursor` is the last hash of the previous page (the response
+// `BlobStash-Blobs-Cursor` header).
+func blobsRange(q *httputil.Query) (*mblob.Range, error) {
+	startExclusive, err := q.GetBoolDefault("start_exclusive", false)
+	if err != nil {
+		return nil, err
+	}
+	endInclusive, err := q.GetBoolDefault("end_inclusive", false)
+	if err != nil {
+		return nil, err
+	}
+	reverse, err := q.GetBoolDefault("reverse", false)
+	if err != nil {
+		return nil, err
+	}
+	r := &mblob.Range{
+		Start:          q.Get("start"),
+		StartExclusive: startExclusive,
+		End:            q.Get("end"),
+		EndInclusive:   endInclusive,
+	}
+	// The older clients use "\xff" as the upper bound
+	if r.End == "\xff" {
+		r.End = ""
+	}
+	if prefix := q.Get("prefix"); prefix != "" {
+		if r.Start != "" || r.End != "" {
+			return nil, errors.New("prefix cannot be combined with start/end")
+		}
+		r = mblob.PrefixRange(prefix)
+	}
+	r.Reverse = reverse
+	if cursor := q.Get("cursor"); cursor != "" {
+		if reverse {
+			r.End, r.EndInclusive = cursor, false
+		} else {
+			r.Start, r.StartExclusive = cursor, true
+		}
+	}
+	if err := r.Validate(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// coldReportHandler lists the blobs not accessed in the last N days, grouped by namespace/FS (requires
+// `blob_access_tracking`)
+func (bs *BlobStoreAPI) coldReportHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			if !auth.Can(
+				w,
+				r,
+				perms.Action(perms.Admin, perms.Blob),
+				perms.Resource(perms.BlobStore, perms.Blob),
+			) {
+				auth.Forbidden(w)
+				return
+			}
+			if !bs.root.AccessTrackingEnabled() {
+				httputil.WriteJSONError(w, http.StatusUnprocessableEntity, "blob_access_tracking is not enabled")
+				return
+			}
+			q := httputil.NewQuery(r.URL.Query())
+			days, err := q.GetIntDefault("days", 90)
+			if err != nil {
+				httputil.Error(w, err)
+				return
+			}
+			limit, err := q.GetInt("limit", 100, 1000)
+			if err != nil {
+				httputil.Error(w, err)
+				return
+			}
+
+			report, err := bs.root.ColdReport(r.Context(), time.Duration(days)*24*time.Hour, limit)
+			if err != nil {
+				panic(err)
+			}
+
+			httputil.MarshalAndWrite(r, w, map[string]interface{}{
+				"data": report,
+			})
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
@@ -12,10 +12,16 @@ import (
 	"a4.io/blobsfile"
 
 	// "a4.io/blobstash/pkg/backend/blobsfile"
+	"a4.io/blobstash/pkg/backend/mem"
+	"a4.io/blobstash/pkg/backend/mirror"
+	"a4.io/blobstash/pkg/backend/remote"
 	"a4.io/blobstash/pkg/backend/s3"
 	"a4.io/blobstash/pkg/blob"
 	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/ctxutil"
 	"a4.io/blobstash/pkg/hub"
+	"a4.io/blobstash/pkg/mode"
+	"a4.io/blobstash/pkg/trace"
 )
 
 var (
@@ -24,12 +30,22 @@ var (
 
 	readCountVar  = expvar.NewInt("blobstore-read-count")
 	writeCountVar = expvar.NewInt("blobstore-write-count")
+
+	// Writes skipped because the blob was already stored
+	dedupCountVar = expvar.NewInt("blobstore-dedup-count")
+	dedupVar      = expvar.NewInt("blobstore-dedup-bytes")
+	// Deduped blobs whose stored copy failed the verification
+	dedupCorruptedVar = expvar.NewInt("blobstore-dedup-corrupted-count")
 )
 
 var ErrBlobExists = fmt.Errorf("blob exist")
 
 var ErrRemoteNotAvailable = fmt.Errorf("remote backend not available")
 
+var ErrAccessTrackingDisabled = fmt.Errorf("blob access tracking is disabled")
+
+var ErrMirrorDisabled = fmt.Errorf("mirror is disabled")
+
 func NextHexKey(key string) string {
 	bkey, err := hex.DecodeString(key)
 	if err != nil {
@@ -47,28 +63,91 @@ func NextHexKey(key string) string {
 	return hex.EncodeToString(bkey)
 }
 
+// localBackend is the local blobs storage (the BlobsFile, or a mirror of multiple BlobsFiles)
+type localBackend interface {
+	mirror.Replica
+}
+
 type BlobStore struct {
-	back   *blobsfile.BlobsFiles
+	back   localBackend
+	packs  *blobsfile.BlobsFiles // primary BlobsFile (for the stats and the S3 packs replication)
+	mem    *mem.Mem              // in-memory backend (replaces the BlobsFile in the tests)
+	mirror *mirror.Mirror
 	s3back *s3.S3Backend
+	remote *remote.Backend
+	access *accessTracker
+	scrub  *scrubber
+	cache  *readCache
+
+	// The access tracker is owned by the root blob store (see `ShareAccessTracking`)
+	sharedAccess bool
 
 	hub  *hub.Hub
 	root bool
 	stop chan struct{}
 
+	// Verify the stored copy when a write is deduped
+	verifyDedup bool
+
+	namespacesStats func() ([]*NamespaceStats, error)
+
+	// Blob stores of the namespaces and blobs of the FS, for grouping the cold data
+	namespaces func() map[string]*BlobStore
+	fsBlobs    func(context.Context) (map[string][]string, error)
+
+	// Directory of the primary BlobsFile (for the volumes stats)
+	packsDir string
+
 	log log.Logger
 }
 
 func New(logger log.Logger, root bool, dir string, conf2 *config.Config, hub *hub.Hub) (*BlobStore, error) {
 	logger.Debug("init")
-	back, err := blobsfile.New(&blobsfile.Opts{
-		Compression: blobsfile.Snappy,
-		Directory:   filepath.Join(dir, "blobs"),
-		LogFunc: func(msg string) {
-			logger.Info(msg, "submodule", "blobsfile")
-		},
-	})
-	if err != nil {
-		return nil, fmt.Errorf("failed to init BlobsFile: %v", err)
+	newBlobsFile := func(dir string) (*blobsfile.BlobsFiles, error) {
+		return blobsfile.New(&blobsfile.Opts{
+			Compression:   blobsfile.Snappy,
+			Directory:     dir,
+			BlobsFileSize: blobsFileSize,
+			LogFunc: func(msg string) {
+				logger.Info(msg, "submodule", "blobsfile", "dir", dir)
+			},
+		})
+	}
+	var back localBackend
+	var packs *blobsfile.BlobsFiles
+	var memBack *mem.Mem
+	var err error
+	if root && conf2 != nil && conf2.InMemoryBlobs {
+		if conf2.Mirror != nil || conf2.S3Repl != nil {
+			return nil, fmt.Errorf("the in-memory blobs backend does not support the mirror and the S3 replication")
+		}
+		memBack = mem.New()
+		back = memBack
+	} else {
+		packs, err = newBlobsFile(filepath.Join(dir, "blobs"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to init BlobsFile: %v", err)
+		}
+		back = packs
+	}
+	var mirr *mirror.Mirror
+	if root && conf2 != nil && conf2.Mirror != nil && len(conf2.Mirror.Dirs) > 0 {
+		logger.Debug("init mirror")
+		names := []string{filepath.Join(dir, "blobs")}
+		replicas := []mirror.Replica{packs}
+		for _, mdir := range conf2.Mirror.Dirs {
+			replica, err := newBlobsFile(mdir)
+			if err != nil {
+				return nil, fmt.Errorf("failed to init mirror BlobsFile %q: %v", mdir, err)
+			}
+			names = append(names, mdir)
+			replicas = append(replicas, replica)
+		}
+		mirr, err = mirror.New(logger.New("submodule", "mirror"), names, replicas)
+		if err != nil {
+			return nil, err
+		}
+		back = mirr
 	}
 	var s3back *s3.S3Backend
 	if root && conf2 != nil {
@@ -81,17 +160,57 @@ func New(logger log.Logger, root bool, dir string, conf2 *config.Config, hub *hu
 			}
 		}
 	}
+	var remoteBack *remote.Backend
+	if root && conf2 != nil && conf2.RemoteRepl != nil {
+		logger.Debug("init remote replication")
+		remoteBack, err = remote.New(logger.New("app", "remote_replication"), back, hub, conf2)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init remote replication: %v", err)
+		}
+	}
+	var access *accessTracker
+	if root && conf2 != nil && conf2.BlobAccessTracking {
+		access, err = newAccessTracker(logger.New("submodule", "access"), filepath.Join(dir, "blobs_access.index"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to init access tracker: %v", err)
+		}
+	}
+	var scrub *scrubber
+	if root && conf2 != nil && conf2.Scrub != nil {
+		scrub, err = newScrubber(logger.New("submodule", "scrub"), filepath.Join(dir, "blobs_scrub.index"), conf2.Scrub.Rate, conf2.Scrub.Repair)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init scrubber: %v", err)
+		}
+	}
+	var cache *readCache
+	if root && conf2 != nil && conf2.BlobCache != nil {
+		cache, err = newReadCache(conf2.BlobCache.MaxSize, conf2.BlobCache.MaxBlobSize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init read cache: %v", err)
+		}
+	}
 	bs := &BlobStore{
 		back:   back,
+		packs:  packs,
+		mem:    memBack,
+		mirror: mirr,
+		cache:  cache,
 		root:   root,
 		s3back: s3back,
+		remote: remoteBack,
+		access: access,
+		scrub:  scrub,
 		hub:    hub,
 		log:    logger,
 		stop:   make(chan struct{}),
 	}
+	bs.packsDir = filepath.Join(dir, "blobs")
+	if root && conf2 != nil {
+		bs.verifyDedup = conf2.VerifyDedup
+	}
 
 	if bs.root && bs.s3back != nil {
-		bs.back.SetBlobsFilesSealedFunc(func(path string) {
+		bs.packs.SetBlobsFilesSealedFunc(func(path string) {
 			go func(path string) {
 				if err := bs.s3back.BlobsFilesUploadPack(path); err != nil {
 					logger.Error("failed to upload pack", "path", path, "err", err)
@@ -99,7 +218,7 @@ func New(logger log.Logger, root bool, dir string, conf2 *config.Config, hub *hu
 			}(path)
 		})
 		go func() {
-			if err := bs.s3back.BlobsFilesSyncWorker(bs.back.SealedPacks()); err != nil {
+			if err := bs.s3back.BlobsFilesSyncWorker(bs.packs.SealedPacks()); err != nil {
 				logger.Error("failed to sync BlobsFile", "err", err)
 			}
 		}()
@@ -120,6 +239,11 @@ func (bs *BlobStore) S3Backend() *s3.S3Backend {
 	return bs.s3back
 }
 
+// RemoteBackend returns the (end-to-end encrypted) remote replication, nil if disabled
+func (bs *BlobStore) RemoteBackend() *remote.Backend {
+	return bs.remote
+}
+
 func (bs *BlobStore) ReplicationEnabled() bool {
 	return bs.s3back != nil
 }
@@ -129,6 +253,23 @@ func (bs *BlobStore) Close() error {
 	if bs.s3back != nil {
 		bs.s3back.Close()
 	}
+	if bs.remote != nil {
+		if err := bs.remote.Close(); err != nil {
+			return err
+		}
+	}
+
+	if bs.access != nil && !bs.sharedAccess {
+		if err := bs.access.Close(); err != nil {
+			return err
+		}
+	}
+
+	if bs.scrub != nil {
+		if err := bs.scrub.Close(); err != nil {
+			return err
+		}
+	}
 
 	if err := bs.back.Close(); err != nil {
 		return err
@@ -144,9 +285,14 @@ func (bs *BlobStore) S3Stats() (map[string]interface{}, error) {
 	return bs.s3back.Stats()
 }
 
-func (bs *BlobStore) Put(ctx context.Context, blob *blob.Blob) (bool, error) {
+func (bs *BlobStore) Put(ctx context.Context, blob *blob.Blob) (saved bool, err error) {
 	bs.log.Info("OP Put", "hash", blob.Hash, "len", len(blob.Data))
-	var saved bool
+	ctx, span := trace.Start(ctx, "blobstore.Put", "hash", blob.Hash, "len", len(blob.Data))
+	defer func() {
+		span.SetAttrs("saved", saved)
+		span.SetError(err)
+		span.Finish()
+	}()
 
 	// Ensure the blob hash match the blob content
 	if err := blob.Check(); err != nil {
@@ -160,9 +306,22 @@ func (bs *BlobStore) Put(ctx context.Context, blob *blob.Blob) (bool, error) {
 
 	if exists {
 		bs.log.Debug("blob already saved", "hash", blob.Hash)
+		dedupCountVar.Add(1)
+		dedupVar.Add(int64(len(blob.Data)))
+		if bs.verifyDedup {
+			if err := bs.checkBlob(blob.Hash); err != nil {
+				// The BlobsFile cannot be rewritten in place, the scrub (with `repair`) can fix it
+				dedupCorruptedVar.Add(1)
+				bs.log.Error("stored copy of a deduped blob is corrupted", "hash", blob.Hash, "err", err)
+			}
+		}
 		return saved, nil
 	}
 
+	if err := mode.CanWrite(); err != nil {
+		return saved, err
+	}
+
 	saved = true
 
 	var specialBlob bool
@@ -170,18 +329,34 @@ func (bs *BlobStore) Put(ctx context.Context, blob *blob.Blob) (bool, error) {
 		specialBlob = true
 	}
 
-	// Save the blob
-	if err := bs.back.Put(blob.Hash, blob.Data); err != nil {
-		return saved, err
-	}
-
-	// Wait for adding the blob to the S3 replication queue if enabled
+	// Journal the blob in the S3 replication queue (if enabled) before the local write, so it cannot be lost
 	if bs.root && bs.s3back != nil {
 		if err := bs.s3back.Put(blob.Hash); err != nil {
 			return saved, err
 		}
 	}
 
+	if bs.root && bs.remote != nil {
+		if err := bs.remote.Put(blob.Hash); err != nil {
+			return saved, err
+		}
+	}
+
+	// Save the blob
+	if err := bs.back.Put(blob.Hash, blob.Data); err != nil {
+		if bs.root && bs.s3back != nil {
+			if cerr := bs.s3back.Cancel(blob.Hash); cerr != nil {
+				bs.log.Error("failed to remove the blob from the replication queue", "hash", blob.Hash, "err", cerr)
+			}
+		}
+		if bs.root && bs.remote != nil {
+			if cerr := bs.remote.Cancel(blob.Hash); cerr != nil {
+				bs.log.Error("failed to remove the blob from the remote replication queue", "hash", blob.Hash, "err", cerr)
+			}
+		}
+		return saved, err
+	}
+
 	// Wait for subscribed event completion
 	if err := bs.hub.NewBlobEvent(ctx, blob, nil); err != nil {
 		return saved, err
@@ -190,24 +365,76 @@ func (bs *BlobStore) Put(ctx context.Context, blob *blob.Blob) (bool, error) {
 	writeCountVar.Add(1)
 	writeVar.Add(int64(len(blob.Data)))
 
+	if bs.access != nil {
+		bs.access.Touch(blob.Hash)
+	}
+
 	bs.log.Debug("blob saved", "hash", blob.Hash, "special_blob", specialBlob)
 	return saved, nil
 }
 
+// DedupStats returns the number of deduped writes, and the number of bytes saved
+func (bs *BlobStore) DedupStats() (int64, int64) {
+	return dedupCountVar.Value(), dedupVar.Value()
+}
+
+// SealedPacks returns the paths of the sealed (read-only) BlobsFiles
+func (bs *BlobStore) SealedPacks() []string {
+	if bs.packs == nil {
+		return []string{}
+	}
+	return bs.packs.SealedPacks()
+}
+
 func (bs *BlobStore) Stats() (*blobsfile.Stats, error) {
-	return bs.back.Stats()
+	if bs.mem != nil {
+		return bs.mem.Stats(), nil
+	}
+	return bs.packs.Stats()
+}
+
+// MirrorCheck compares the mirror replicas (and verifies the blobs hash if verify is true)
+func (bs *BlobStore) MirrorCheck(ctx context.Context, verify bool) (*mirror.Report, error) {
+	if bs.mirror == nil {
+		return nil, ErrMirrorDisabled
+	}
+	return bs.mirror.Check(ctx, verify)
 }
 
 func (bs *BlobStore) Get(ctx context.Context, hash string) ([]byte, error) {
 	bs.log.Info("OP Get", "hash", hash)
-	blob, err := bs.back.Get(hash)
+	_, span := trace.Start(ctx, "blobstore.Get", "hash", hash)
+	defer span.Finish()
+	var blob []byte
+	var err error
+	if bs.cache != nil {
+		blob = bs.cache.Get(hash)
+	}
+	switch {
+	case blob != nil:
+		span.SetAttrs("cached", true)
+	case bs.scrub != nil && bs.s3back != nil && bs.scrub.servedFromReplica(hash):
+		// The local copy is corrupted (detected by the scrubber)
+		blob, err = bs.s3back.Get(hash)
+	default:
+		blob, err = bs.back.Get(hash)
+	}
 	if err != nil {
+		span.SetError(err)
 		return nil, err
 	}
+	span.SetAttrs("len", len(blob))
+	if bs.cache != nil {
+		bs.cache.Add(hash, blob)
+	}
 
 	readCountVar.Add(1)
 	readVar.Add(int64(len(blob)))
 
+	if bs.access != nil && !ctxutil.SkipAccessTracking(ctx) {
+		bs.access.Touch(hash)
+	}
+
 	return blob, err
 }
 
@@ -216,49 +443,105 @@ func (bs *BlobStore) Stat(ctx context.Context, hash string) (bool, error) {
 	return bs.back.Exists(hash)
 }
 
-// func (backend *BlobsFileBackend) Enumerate(blobs chan<- *blob.SizedBlobRef, start, stop string, limit int) error {
-func (bs *BlobStore) Enumerate(ctx context.Context, start, end string, limit int) ([]*blob.SizedBlobRef, string, error) {
-	return bs.enumerate(ctx, start, end, limit, false)
+// Enumerate returns the blobs within the range (see `blob.Range`), in ascending order, or in descending order if
+// `Reverse` is set (the BlobsFile index can only be iterated forward, so the whole range is scanned in this case)
+func (bs *BlobStore) Enumerate(ctx context.Context, r *blob.Range) ([]*blob.SizedBlobRef, error) {
+	bs.log.Info("OP Enumerate", "start", r.Start, "end", r.End, "reverse", r.Reverse, "limit", r.Limit)
+	if err := r.Validate(); err != nil {
+		return nil, err
+	}
+	refs := []*blob.SizedBlobRef{}
+	if err := bs.iter(ctx, r.Start, func(b *blobsfile.Blob) (bool, error) {
+		if !r.BeforeEnd(b.Hash) {
+			return false, nil
+		}
+		if !r.AfterStart(b.Hash) {
+			return true, nil
+		}
+		refs = append(refs, &blob.SizedBlobRef{Hash: b.Hash, Size: b.Size})
+		if r.Limit == 0 {
+			return true, nil
+		}
+		if !r.Reverse {
+			return len(refs) < r.Limit, nil
+		}
+		// Only keep the last blobs
+		if len(refs) >= 2*r.Limit {
+			refs = append(refs[:0], refs[len(refs)-r.Limit:]...)
+		}
+		return true, nil
+	}); err != nil {
+		return nil, err
+	}
+	if r.Reverse {
+		if r.Limit > 0 && len(refs) > r.Limit {
+			refs = refs[len(refs)-r.Limit:]
+		}
+		for i, j := 0, len(refs)-1; i < j; i, j = i+1, j-1 {
+			refs[i], refs[j] = refs[j], refs[i]
+		}
+	}
+	return refs, nil
 }
 
+// Scan re-sends all the blobs to the hub (as `ScanBlob` events)
 func (bs *BlobStore) Scan(ctx context.Context) error {
-	_, _, err := bs.enumerate(ctx, "", "\xff", 0, true)
-	return err
+	return bs.iter(ctx, "", func(b *blobsfile.Blob) (bool, error) {
+		data, err := bs.Get(ctx, b.Hash)
+		if err != nil {
+			return false, err
+		}
+		if err := bs.hub.ScanBlobEvent(ctx, &blob.Blob{Hash: b.Hash, Data: data}, nil); err != nil {
+			return false, err
+		}
+		return true, nil
+	})
 }
 
-func (bs *BlobStore) enumerate(ctx context.Context, start, end string, limit int, scan bool) ([]*blob.SizedBlobRef, string, error) {
-	var cursor string
-	bs.log.Info("OP Enumerate", "start", start, "end", end, "limit", limit)
-	out := make(chan *blobsfile.Blob)
-	refs := []*blob.SizedBlobRef{}
-	errc := make(chan error, 1)
-	go func() {
-		if start == "" && end == "\xff" || end == "" {
-			errc <- bs.back.EnumeratePrefix(out, start, limit)
-
-		} else {
-			errc <- bs.back.Enumerate(out, start, end, limit)
+// Number of blobs fetched from the backend at once when iterating (a var for the tests)
+var iterBatchSize = 1000
 
+// iter calls fn for each blob (in ascending order) starting at start (inclusive) until it returns false
+func (bs *BlobStore) iter(ctx context.Context, start string, fn func(*blobsfile.Blob) (bool, error)) error {
+	// The backend expects a full hex string
+	if len(start)%2 == 1 {
+		start += "0"
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
 		}
-	}()
-	for cblob := range out {
-		if scan {
-			fullblob, err := bs.Get(ctx, cblob.Hash)
+		// Fetch a batch at a time, the backend is locked until the channel is drained
+		out := make(chan *blobsfile.Blob)
+		errc := make(chan error, 1)
+		go func() {
+			errc <- bs.back.Enumerate(out, start, "\xff", iterBatchSize)
+		}()
+		batch := []*blobsfile.Blob{}
+		for b := range out {
+			batch = append(batch, b)
+		}
+		if err := <-errc; err != nil {
+			return err
+		}
+
+		for _, b := range batch {
+			cont, err := fn(b)
 			if err != nil {
-				return nil, cursor, err
+				return err
 			}
-			if err := bs.hub.ScanBlobEvent(ctx, &blob.Blob{Hash: cblob.Hash, Data: fullblob}, nil); err != nil {
-				return nil, cursor, err
+			if !cont {
+				return nil
 			}
 		}
-		refs = append(refs, &blob.SizedBlobRef{Hash: cblob.Hash, Size: cblob.Size})
-	}
-	if err := <-errc; err != nil {
-		return nil, cursor, err
-	}
-	if len(refs) > 0 {
-		cursor = NextHexKey(refs[len(refs)-1].Hash)
+		if len(batch) < iterBatchSize {
+			return nil
+		}
+		last := batch[len(batch)-1].Hash
+		start = NextHexKey(last)
+		if start <= last {
+			// The last hash was the max key
+			return nil
+		}
 	}
-
-	return refs, cursor, nil
 }
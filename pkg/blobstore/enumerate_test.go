@@ -0,0 +1,122 @@
+package blobstore
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/hub"
+)
+
+func TestEnumerate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstore-enumerate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	bs, err := New(logger, true, dir, nil, hub.New(logger, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	// Iterate the backend by small batches
+	defer func(size int) { iterBatchSize = size }(iterBatchSize)
+	iterBatchSize = 7
+
+	ctx := context.Background()
+	all := []string{}
+	for i := 0; i < 50; i++ {
+		b := blob.New([]byte(fmt.Sprintf("blob %d", i)))
+		if _, err := bs.Put(ctx, b); err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, b.Hash)
+	}
+	sort.Strings(all)
+
+	// expected returns the hashes matching the range
+	expected := func(r *blob.Range) []string {
+		out := []string{}
+		for _, h := range all {
+			if r.Contains(h) {
+				out = append(out, h)
+			}
+		}
+		if r.Reverse {
+			for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+				out[i], out[j] = out[j], out[i]
+			}
+		}
+		if r.Limit > 0 && len(out) > r.Limit {
+			out = out[:r.Limit]
+		}
+		return out
+	}
+	check := func(r *blob.Range, refs []*blob.SizedBlobRef, want []string) {
+		t.Helper()
+		got := []string{}
+		for _, ref := range refs {
+			got = append(got, ref.Hash)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("range %+v: expected %v, got %v", r, want, got)
+		}
+	}
+
+	prefix := all[20][:1]
+	for _, r := range []*blob.Range{
+		{},
+		{Limit: 10},
+		{Start: all[10]},
+		{Start: all[10], StartExclusive: true, Limit: 3},
+		{Start: all[10], End: all[20]},
+		{Start: all[10], End: all[20], EndInclusive: true},
+		{Start: all[10], StartExclusive: true, End: all[20], EndInclusive: true, Reverse: true},
+		{End: all[5]},
+		{Reverse: true, Limit: 8},
+		{Start: all[30][:3]},
+		{End: all[49], EndInclusive: true, Reverse: true, Limit: 1},
+		{Start: all[49], StartExclusive: true},
+		blob.PrefixRange(prefix),
+		blob.PrefixRange(all[7]),
+	} {
+		refs, err := bs.Enumerate(ctx, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(r, refs, expected(r))
+	}
+
+	// Paginate in both directions
+	for _, reverse := range []bool{false, true} {
+		got := []*blob.SizedBlobRef{}
+		pages := 0
+		r := &blob.Range{Reverse: reverse, Limit: 6}
+		for r != nil {
+			refs, err := bs.Enumerate(ctx, r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, refs...)
+			pages++
+			r = r.Next(refs)
+		}
+		if pages != 9 {
+			t.Errorf("expected 9 pages, got %d", pages)
+		}
+		check(&blob.Range{Reverse: reverse}, got, expected(&blob.Range{Reverse: reverse}))
+	}
+
+	if _, err := bs.Enumerate(ctx, &blob.Range{End: "\xff"}); err == nil {
+		t.Errorf("expected an invalid bound error")
+	}
+}
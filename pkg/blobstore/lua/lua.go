@@ -2,7 +2,9 @@ package lua // import "a4.io/blobstash/pkg/blobstore/lua"
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 
 	humanize "github.com/dustin/go-humanize"
 	"github.com/yuin/gopher-lua"
@@ -20,16 +22,67 @@ func convertBlobRef(L *lua.LState, br *blob.SizedBlobRef) *lua.LTable {
 	return tbl
 }
 
-func setupBlobStore(ctx context.Context, L *lua.LState, bs store.BlobStore) func(*lua.LState) int {
+// Streamer collects the blobs to stream after the app response, this way the blobs data never go through the Lua
+// state (the blobs are fetched one at a time)
+type Streamer struct {
+	bs     store.BlobStore
+	hashes []string
+}
+
+// NewStreamer initializes a streamer
+func NewStreamer(bs store.BlobStore) *Streamer {
+	return &Streamer{bs: bs}
+}
+
+// Pending returns true if some blobs must be streamed
+func (s *Streamer) Pending() bool {
+	return len(s.hashes) > 0
+}
+
+// WriteTo writes the blobs to `w`
+func (s *Streamer) WriteTo(ctx context.Context, w io.Writer) (int64, error) {
+	var written int64
+	for _, hash := range s.hashes {
+		data, err := s.bs.Get(ctx, hash)
+		if err != nil {
+			return written, fmt.Errorf("failed to fetch %s: %w", hash, err)
+		}
+		n, err := w.Write(data)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	s.hashes = nil
+	return written, nil
+}
+
+// blobSize returns the size of the blob (or -1 if it does not exist)
+func blobSize(ctx context.Context, bs store.BlobStore, hash string) (int, error) {
+	refs, err := bs.Enumerate(ctx, &blob.Range{Start: hash, End: hash, EndInclusive: true, Limit: 1})
+	if err != nil {
+		return -1, err
+	}
+	if len(refs) == 0 || refs[0].Hash != hash {
+		return -1, nil
+	}
+	return refs[0].Size, nil
+}
+
+func setupBlobStore(ctx context.Context, L *lua.LState, bs store.BlobStore, streamer *Streamer) func(*lua.LState) int {
 	return func(L *lua.LState) int {
 		// register functions to the table
 		mod := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
 			"blobs": func(L *lua.LState) int {
-				startCursor := L.ToString(1)
-				blobs, cursor, err := bs.Enumerate(context.TODO(), startCursor, startCursor+"\xff", 0)
+				// List the blobs starting with the given prefix
+				blobs, err := bs.Enumerate(context.TODO(), blob.PrefixRange(L.ToString(1)))
 				if err != nil {
 					panic(err)
 				}
+				var cursor string
+				if len(blobs) > 0 {
+					cursor = blobs[len(blobs)-1].Hash
+				}
 				blobsTbl := L.CreateTable(len(blobs), 0)
 				for _, blob := range blobs {
 					blobsTbl.Append(convertBlobRef(L, blob))
@@ -52,7 +105,69 @@ func setupBlobStore(ctx context.Context, L *lua.LState, bs store.BlobStore) func
 				}
 				return 1
 			},
+			"stat_many": func(L *lua.LState) int {
+				// Returns a table `hash => size` (the missing blobs are not set)
+				hashes := L.CheckTable(1)
+				out := L.CreateTable(0, hashes.Len())
+				var ferr error
+				hashes.ForEach(func(_, v lua.LValue) {
+					if ferr != nil {
+						return
+					}
+					hash := v.String()
+					size, err := blobSize(ctx, bs, hash)
+					if err != nil {
+						ferr = err
+						return
+					}
+					if size >= 0 {
+						out.RawSetString(hash, lua.LNumber(size))
+					}
+				})
+				if ferr != nil {
+					L.RaiseError("failed to stat blobs: %v", ferr)
+					return 0
+				}
+				L.Push(out)
+				return 1
+			},
+			"stream": func(L *lua.LState) int {
+				// Stream the blob(s) after the response body
+				if streamer == nil {
+					L.RaiseError("%v", errors.New("streaming is not supported in this context"))
+					return 0
+				}
+				hashes := []string{}
+				for i := 1; i <= L.GetTop(); i++ {
+					hash := L.CheckString(i)
+					exists, err := bs.Stat(ctx, hash)
+					if err != nil {
+						L.RaiseError("failed to stat %s: %v", hash, err)
+						return 0
+					}
+					if !exists {
+						L.Push(lua.LFalse)
+						return 1
+					}
+					hashes = append(hashes, hash)
+				}
+				streamer.hashes = append(streamer.hashes, hashes...)
+				L.Push(lua.LTrue)
+				return 1
+			},
 			"get": func(L *lua.LState) int {
+				// Size-limited read (`blobstore.get(hash, max_size)` returns nil and an error if the blob is larger)
+				if maxSize := L.OptInt(2, 0); maxSize > 0 {
+					size, err := blobSize(ctx, bs, L.ToString(1))
+					if err != nil {
+						panic(err)
+					}
+					if size > maxSize {
+						L.Push(lua.LNil)
+						L.Push(lua.LString(fmt.Sprintf("blob too large (%s)", humanize.Bytes(uint64(size)))))
+						return 2
+					}
+				}
 				data, err := bs.Get(ctx, L.ToString(1))
 				if err != nil {
 					fmt.Printf("failed to fetch %s: %v\n", L.ToString(1), err)
@@ -71,5 +186,10 @@ func setupBlobStore(ctx context.Context, L *lua.LState, bs store.BlobStore) func
 }
 
 func Setup(ctx context.Context, L *lua.LState, bs store.BlobStore) {
-	L.PreloadModule("blobstore", setupBlobStore(ctx, L, bs))
+	SetupWithStreamer(ctx, L, bs, nil)
+}
+
+// SetupWithStreamer setups the module with a streamer (for `blobstore.stream`)
+func SetupWithStreamer(ctx context.Context, L *lua.LState, bs store.BlobStore, streamer *Streamer) {
+	L.PreloadModule("blobstore", setupBlobStore(ctx, L, bs, streamer))
 }
@@ -0,0 +1,98 @@
+package lua
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"testing"
+
+	"github.com/yuin/gopher-lua"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/hashutil"
+)
+
+type memBlobStore map[string][]byte
+
+func (m memBlobStore) Put(_ context.Context, b *blob.Blob) (bool, error) {
+	m[b.Hash] = b.Data
+	return true, nil
+}
+
+func (m memBlobStore) Get(_ context.Context, hash string) ([]byte, error) {
+	return m[hash], nil
+}
+
+func (m memBlobStore) Stat(_ context.Context, hash string) (bool, error) {
+	_, ok := m[hash]
+	return ok, nil
+}
+
+func (m memBlobStore) Enumerate(_ context.Context, r *blob.Range) ([]*blob.SizedBlobRef, error) {
+	out := []*blob.SizedBlobRef{}
+	for h, data := range m {
+		if r.Contains(h) {
+			out = append(out, &blob.SizedBlobRef{Hash: h, Size: len(data)})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Hash < out[j].Hash != r.Reverse })
+	if r.Limit > 0 && len(out) > r.Limit {
+		out = out[:r.Limit]
+	}
+	return out, nil
+}
+
+func (m memBlobStore) Close() error { return nil }
+
+func TestBlobStoreModule(t *testing.T) {
+	ctx := context.Background()
+	bs := memBlobStore{}
+	small := []byte("hello")
+	large := bytes.Repeat([]byte("a"), 1000)
+	for _, data := range [][]byte{small, large} {
+		bs.Put(ctx, &blob.Blob{Hash: hashutil.Compute(data), Data: data})
+	}
+
+	L := lua.NewState()
+	defer L.Close()
+	streamer := NewStreamer(bs)
+	SetupWithStreamer(ctx, L, bs, streamer)
+	L.SetGlobal("small", lua.LString(hashutil.Compute(small)))
+	L.SetGlobal("large", lua.LString(hashutil.Compute(large)))
+
+	if err := L.DoString(`
+local blobstore = require('blobstore')
+stats = blobstore.stat_many({small, large, 'missing'})
+small_data = blobstore.get(small, 100)
+large_data, large_err = blobstore.get(large, 100)
+streamed = blobstore.stream(small, large)
+not_streamed = blobstore.stream(small, 'missing')
+`); err != nil {
+		t.Fatal(err)
+	}
+	stats := L.GetGlobal("stats").(*lua.LTable)
+	if stats.RawGetString(hashutil.Compute(small)) != lua.LNumber(5) || stats.RawGetString(hashutil.Compute(large)) != lua.LNumber(1000) || stats.RawGetString("missing") != lua.LNil {
+		t.Errorf("unexpected stats")
+	}
+	if L.GetGlobal("small_data").String() != "hello" {
+		t.Errorf("unexpected small data")
+	}
+	if L.GetGlobal("large_data") != lua.LNil || L.GetGlobal("large_err") == lua.LNil {
+		t.Errorf("the large blob should not be returned")
+	}
+	if L.GetGlobal("streamed") != lua.LTrue || L.GetGlobal("not_streamed") != lua.LFalse {
+		t.Errorf("unexpected stream results")
+	}
+
+	if !streamer.Pending() {
+		t.Fatalf("blobs should be pending")
+	}
+	var buf bytes.Buffer
+	n, err := streamer.WriteTo(ctx, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1005 || !bytes.Equal(buf.Bytes(), append(small, large...)) {
+		t.Errorf("unexpected streamed data (%d bytes)", n)
+	}
+}
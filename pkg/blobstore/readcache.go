@@ -0,0 +1,146 @@
+package blobstore // import "a4.io/blobstash/pkg/blobstore"
+
+import (
+	"expvar"
+	"math"
+	"sync"
+
+	"github.com/hashicorp/golang-lru/simplelru"
+)
+
+var (
+	cacheHitsVar      = expvar.NewInt("blobstore-cache-hits")
+	cacheMissesVar    = expvar.NewInt("blobstore-cache-misses")
+	cacheEvictionsVar = expvar.NewInt("blobstore-cache-evictions")
+	cacheSizeVar      = expvar.NewInt("blobstore-cache-size")
+)
+
+// Share of the cache reserved for the blobs seen only once (the 2Q "A1in" queue)
+const recentRatio = 0.25
+
+// readCache is an in-memory cache for the hot blobs, bounded in bytes, using a simplified 2Q policy: new blobs
+// enter the "recent" queue and are only promoted to the "frequent" queue on the second hit, so a big scan (like
+// a scrub or an export) cannot flush the frequently used blobs (filetree meta blobs, small chunks...).
+type readCache struct {
+	mu sync.Mutex
+
+	recent   *simplelru.LRU
+	frequent *simplelru.LRU
+
+	recentSize, frequentSize int
+	maxSize, maxBlobSize     int
+}
+
+// ReadCacheStats holds the blob read cache stats
+type ReadCacheStats struct {
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+	Size      int64 `json:"size"`
+	MaxSize   int64 `json:"max_size"`
+	Blobs     int   `json:"blobs_count"`
+}
+
+func newReadCache(maxSize, maxBlobSize int) (*readCache, error) {
+	c := &readCache{maxSize: maxSize, maxBlobSize: maxBlobSize}
+	var err error
+	// The LRUs are only bounded by the bytes size (evictions are done manually)
+	c.recent, err = simplelru.NewLRU(math.MaxInt32, func(_ interface{}, v interface{}) {
+		c.recentSize -= len(v.([]byte))
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.frequent, err = simplelru.NewLRU(math.MaxInt32, func(_ interface{}, v interface{}) {
+		c.frequentSize -= len(v.([]byte))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Get returns the cached blob (nil if it's not cached)
+func (c *readCache) Get(hash string) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if v, ok := c.frequent.Get(hash); ok {
+		cacheHitsVar.Add(1)
+		return v.([]byte)
+	}
+	if v, ok := c.recent.Peek(hash); ok {
+		// Second hit, promote the blob
+		c.recent.Remove(hash)
+		c.frequent.Add(hash, v)
+		c.frequentSize += len(v.([]byte))
+		cacheHitsVar.Add(1)
+		return v.([]byte)
+	}
+	cacheMissesVar.Add(1)
+	return nil
+}
+
+// Add caches the blob (the blobs bigger than the max blob size are ignored)
+func (c *readCache) Add(hash string, data []byte) {
+	if len(data) > c.maxBlobSize {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.frequent.Contains(hash) || c.recent.Contains(hash) {
+		return
+	}
+	c.recent.Add(hash, data)
+	c.recentSize += len(data)
+	c.evict()
+}
+
+// Remove invalidates the cached blob
+func (c *readCache) Remove(hash string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.recent.Remove(hash)
+	c.frequent.Remove(hash)
+	cacheSizeVar.Set(int64(c.recentSize + c.frequentSize))
+}
+
+func (c *readCache) evict() {
+	for c.recentSize+c.frequentSize > c.maxSize {
+		if c.recentSize > int(float64(c.maxSize)*recentRatio) || c.frequent.Len() == 0 {
+			c.recent.RemoveOldest()
+		} else {
+			c.frequent.RemoveOldest()
+		}
+		cacheEvictionsVar.Add(1)
+	}
+	cacheSizeVar.Set(int64(c.recentSize + c.frequentSize))
+}
+
+// Stats returns the cache stats
+func (c *readCache) Stats() *ReadCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return &ReadCacheStats{
+		Hits:      cacheHitsVar.Value(),
+		Misses:    cacheMissesVar.Value(),
+		Evictions: cacheEvictionsVar.Value(),
+		Size:      int64(c.recentSize + c.frequentSize),
+		MaxSize:   int64(c.maxSize),
+		Blobs:     c.recent.Len() + c.frequent.Len(),
+	}
+}
+
+// ReadCacheStats returns the read cache stats (nil if the cache is disabled)
+func (bs *BlobStore) ReadCacheStats() *ReadCacheStats {
+	if bs.cache == nil {
+		return nil
+	}
+	return bs.cache.Stats()
+}
+
+// invalidate removes the blob from the read cache (if enabled)
+func (bs *BlobStore) invalidate(hash string) {
+	if bs.cache != nil {
+		bs.cache.Remove(hash)
+	}
+}
@@ -0,0 +1,42 @@
+package blobstore
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestReadCache(t *testing.T) {
+	c, err := newReadCache(100, 40)
+	if err != nil {
+		panic(err)
+	}
+	c.Add("big", make([]byte, 50))
+	if c.Get("big") != nil {
+		t.Errorf("blobs bigger than the max blob size should not be cached")
+	}
+
+	c.Add("hot", bytes.Repeat([]byte("h"), 20))
+	// Promote the blob to the "frequent" queue
+	if !bytes.Equal(c.Get("hot"), bytes.Repeat([]byte("h"), 20)) {
+		t.Errorf("failed to get cached blob")
+	}
+
+	// A scan should only evict the blobs seen once
+	for _, h := range []string{"a", "b", "c", "d", "e", "f"} {
+		c.Add(h, make([]byte, 20))
+	}
+	if c.Get("hot") == nil {
+		t.Errorf("hot blob should not have been evicted")
+	}
+	if c.Get("a") != nil {
+		t.Errorf("blob a should have been evicted")
+	}
+	if st := c.Stats(); st.Size > 100 {
+		t.Errorf("cache is too big: %+v", st)
+	}
+
+	c.Remove("hot")
+	if c.Get("hot") != nil {
+		t.Errorf("blob should have been invalidated")
+	}
+}
@@ -0,0 +1,272 @@
+package blobstore // import "a4.io/blobstash/pkg/blobstore"
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/hashutil"
+	"a4.io/blobstash/pkg/rangedb"
+)
+
+// ErrScrubDisabled is returned when the scrubber is not configured
+var ErrScrubDisabled = fmt.Errorf("scrubber is disabled")
+
+// ErrScrubRunning is returned when a scrub is already in progress
+var ErrScrubRunning = fmt.Errorf("scrub already running")
+
+var scrubFindingPrefix = "f:"
+
+// ScrubFinding holds a blob that failed the integrity check
+type ScrubFinding struct {
+	Hash       string `json:"hash"`
+	Error      string `json:"error"`
+	DetectedAt int64  `json:"detected_at"`
+
+	// Set to "parity" if the blob was repaired (the BlobsFile is rewritten)
+	RepairedFrom string `json:"repaired_from,omitempty"`
+
+	// Set if the local copy could not be repaired, but a verified copy is available on the S3 replica (the reads are
+	// served from the replica, the local copy is still corrupted)
+	ServedFromReplica bool `json:"served_from_replica,omitempty"`
+}
+
+// ScrubReport holds the result of the last (or current) scrub
+type ScrubReport struct {
+	Running     bool            `json:"running"`
+	StartedAt   int64           `json:"started_at,omitempty"`
+	FinishedAt  int64           `json:"finished_at,omitempty"`
+	Checked     int             `json:"checked"`
+	Failed      int             `json:"failed"`
+	Repaired    int             `json:"repaired"`
+	FromReplica int             `json:"from_replica"` // not repaired, but served from the S3 replica
+	Error       string          `json:"error,omitempty"`
+	Findings    []*ScrubFinding `json:"findings"`
+}
+
+// scrubber slowly re-reads all the blobs from the BlobsFiles to detect corruptions
+type scrubber struct {
+	db     *rangedb.RangeDB
+	rate   int
+	repair bool
+
+	// Corrupted blobs served from the S3 replica
+	fromReplica map[string]bool
+
+	report *ScrubReport
+	mu     sync.Mutex
+
+	log log.Logger
+}
+
+func newScrubber(logger log.Logger, path string, rate int, repair bool) (*scrubber, error) {
+	db, err := rangedb.New(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &scrubber{
+		db:          db,
+		rate:        rate,
+		repair:      repair,
+		fromReplica: map[string]bool{},
+		report:      &ScrubReport{},
+		log:         logger,
+	}
+	// Reload the findings from the previous runs
+	findings, err := s.findings()
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range findings {
+		if f.ServedFromReplica {
+			s.fromReplica[f.Hash] = true
+		}
+	}
+	return s, nil
+}
+
+func (s *scrubber) Close() error {
+	return s.db.Close()
+}
+
+func (s *scrubber) findings() ([]*ScrubFinding, error) {
+	out := []*ScrubFinding{}
+	r := s.db.PrefixRange([]byte(scrubFindingPrefix), false)
+	defer r.Close()
+	k, v, err := r.Next()
+	for ; err == nil; k, v, err = r.Next() {
+		f := &ScrubFinding{}
+		if err := json.Unmarshal(v, f); err != nil {
+			return nil, fmt.Errorf("failed to decode finding %s: %v", k, err)
+		}
+		out = append(out, f)
+	}
+	if err != io.EOF {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (s *scrubber) saveFinding(f *ScrubFinding) error {
+	js, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	return s.db.Set([]byte(scrubFindingPrefix+f.Hash), js)
+}
+
+func (s *scrubber) servedFromReplica(hash string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.fromReplica[hash]
+}
+
+// Report returns the last scrub report along with all the findings
+func (s *scrubber) Report() (*ScrubReport, error) {
+	findings, err := s.findings()
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	report := *s.report
+	report.Findings = findings
+	return &report, nil
+}
+
+// checkBlob reads the blob directly from the BlobsFile and verifies its hash
+func (bs *BlobStore) checkBlob(hash string) (err error) {
+	// BlobsFile panics if the hash does not match the data
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	data, err := bs.back.Get(hash)
+	if err != nil {
+		return err
+	}
+	if !hashutil.Verify(hash, data) {
+		return fmt.Errorf("hash mismatch, got %s", hashutil.Compute(data))
+	}
+	return nil
+}
+
+// repairBlob tries to repair the blob using the BlobsFile parity blobs (the corrupted BlobsFile is rewritten)
+func (bs *BlobStore) repairBlob(hash string) bool {
+	if err := bs.back.CheckBlobsFiles(); err != nil {
+		bs.log.Error("failed to check BlobsFiles", "err", err)
+	}
+	return bs.checkBlob(hash) == nil
+}
+
+// serveFromReplica checks the S3 replica of a blob that could not be repaired, and serves the reads from it if valid
+// (the BlobsFile can't be rewritten with the replica, a blob cannot be overwritten)
+func (bs *BlobStore) serveFromReplica(hash string) bool {
+	if bs.s3back == nil {
+		return false
+	}
+	data, err := bs.s3back.Get(hash)
+	if err != nil || !hashutil.Verify(hash, data) {
+		bs.log.Error("failed to fetch the S3 replica", "hash", hash, "err", err)
+		return false
+	}
+	bs.scrub.mu.Lock()
+	defer bs.scrub.mu.Unlock()
+	bs.scrub.fromReplica[hash] = true
+	return true
+}
+
+// ScrubReport returns the scrub findings
+func (bs *BlobStore) ScrubReport() (*ScrubReport, error) {
+	if bs.scrub == nil {
+		return nil, ErrScrubDisabled
+	}
+	return bs.scrub.Report()
+}
+
+// Scrub checks the integrity of all the blobs (at the configured rate)
+func (bs *BlobStore) Scrub(ctx context.Context) (err error) {
+	if bs.scrub == nil {
+		return ErrScrubDisabled
+	}
+	s := bs.scrub
+	s.mu.Lock()
+	if s.report.Running {
+		s.mu.Unlock()
+		return ErrScrubRunning
+	}
+	s.report = &ScrubReport{Running: true, StartedAt: time.Now().Unix()}
+	report := s.report
+	s.mu.Unlock()
+
+	s.log.Info("scrub started")
+	defer func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		report.Running = false
+		report.FinishedAt = time.Now().Unix()
+		if err != nil {
+			report.Error = err.Error()
+		}
+		s.log.Info("scrub done", "checked", report.Checked, "failed", report.Failed, "repaired", report.Repaired,
+			"from_replica", report.FromReplica, "err", err)
+	}()
+
+	tick := time.NewTicker(time.Second / time.Duration(s.rate))
+	defer tick.Stop()
+
+	r := &blob.Range{Limit: 1000}
+	for r != nil {
+		refs, err := bs.Enumerate(ctx, r)
+		if err != nil {
+			return err
+		}
+		for _, ref := range refs {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-tick.C:
+			}
+
+			cerr := bs.checkBlob(ref.Hash)
+			s.mu.Lock()
+			report.Checked++
+			s.mu.Unlock()
+			if cerr == nil {
+				continue
+			}
+
+			s.log.Error("corrupted blob", "hash", ref.Hash, "err", cerr)
+			bs.invalidate(ref.Hash)
+			finding := &ScrubFinding{Hash: ref.Hash, Error: cerr.Error(), DetectedAt: time.Now().Unix()}
+			if s.repair {
+				if bs.repairBlob(ref.Hash) {
+					finding.RepairedFrom = "parity"
+				} else {
+					finding.ServedFromReplica = bs.serveFromReplica(ref.Hash)
+				}
+			}
+			if err := s.saveFinding(finding); err != nil {
+				return err
+			}
+			s.mu.Lock()
+			report.Failed++
+			if finding.RepairedFrom != "" {
+				report.Repaired++
+			}
+			if finding.ServedFromReplica {
+				report.FromReplica++
+			}
+			s.mu.Unlock()
+		}
+		r = r.Next(refs)
+	}
+	return nil
+}
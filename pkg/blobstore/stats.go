@@ -0,0 +1,174 @@
+package blobstore // import "a4.io/blobstash/pkg/blobstore"
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+
+	humanize "github.com/dustin/go-humanize"
+
+	"a4.io/blobstash/pkg/backend/remote"
+	"a4.io/blobstash/pkg/backend/s3"
+)
+
+// DetailedStats holds the blob store stats, with the breakdown per backend and per namespace
+type DetailedStats struct {
+	BlobsCount     int    `json:"blobs_count"`
+	BlobsSize      int64  `json:"blobs_size"`
+	BlobsSizeHuman string `json:"blobs_size_human"`
+
+	Backends    []*BackendStats      `json:"backends"`
+	Compression *CompressionStats    `json:"compression"`
+	Dedup       *DedupStats          `json:"dedup"`
+	Replication *s3.ReplicationStats `json:"replication,omitempty"`
+	Remote      *remote.Stats        `json:"remote_replication,omitempty"`
+	ReadCache   *ReadCacheStats      `json:"read_cache,omitempty"`
+	Namespaces  []*NamespaceStats    `json:"namespaces"`
+}
+
+// BackendStats holds the stats of a storage backend
+type BackendStats struct {
+	Name          string `json:"name"`
+	Volumes       int    `json:"volumes"`
+	SealedVolumes int    `json:"sealed_volumes"`
+	Size          int64  `json:"size"`
+	SizeHuman     string `json:"size_human"`
+}
+
+// CompressionStats compares the size of the blobs with the size of the BlobsFiles (the BlobsFiles also contain
+// the parity blobs, so the savings can be negative for incompressible data)
+type CompressionStats struct {
+	RawSize    int64   `json:"raw_size"`
+	StoredSize int64   `json:"stored_size"`
+	Savings    int64   `json:"savings"`
+	Ratio      float64 `json:"ratio"`
+}
+
+// DedupStats holds the stats about the deduplicated writes (since startup)
+type DedupStats struct {
+	Count int64 `json:"count"`
+	Size  int64 `json:"size"`
+}
+
+// NamespaceStats holds the usage of a namespace (a stash data context)
+type NamespaceStats struct {
+	Name       string `json:"name"`
+	BlobsCount int    `json:"blobs_count"`
+	BlobsSize  int64  `json:"blobs_size"`
+}
+
+// SetNamespacesStatsFunc sets the func returning the per-namespace usage (the namespaces are managed by the stash)
+func (bs *BlobStore) SetNamespacesStatsFunc(f func() ([]*NamespaceStats, error)) {
+	bs.namespacesStats = f
+}
+
+// DetailedStats returns the detailed stats
+func (bs *BlobStore) DetailedStats() (*DetailedStats, error) {
+	bstats, err := bs.Stats()
+	if err != nil {
+		return nil, err
+	}
+	backendName := "blobsfile"
+	if bs.mem != nil {
+		backendName = "mem"
+	}
+	stats := &DetailedStats{
+		BlobsCount:     bstats.BlobsCount,
+		BlobsSize:      bstats.BlobsSize,
+		BlobsSizeHuman: humanize.Bytes(uint64(bstats.BlobsSize)),
+		Backends: []*BackendStats{
+			{
+				Name:          backendName,
+				Volumes:       bstats.BlobsFilesCount,
+				SealedVolumes: len(bs.SealedPacks()),
+				Size:          bstats.BlobsFilesSize,
+				SizeHuman:     humanize.Bytes(uint64(bstats.BlobsFilesSize)),
+			},
+		},
+		Compression: &CompressionStats{
+			RawSize:    bstats.BlobsSize,
+			StoredSize: bstats.BlobsFilesSize,
+			Savings:    bstats.BlobsSize - bstats.BlobsFilesSize,
+		},
+		ReadCache:  bs.ReadCacheStats(),
+		Namespaces: []*NamespaceStats{},
+	}
+	if bstats.BlobsFilesSize > 0 {
+		stats.Compression.Ratio = float64(bstats.BlobsSize) / float64(bstats.BlobsFilesSize)
+	}
+	dedupCount, dedupSize := bs.DedupStats()
+	stats.Dedup = &DedupStats{Count: dedupCount, Size: dedupSize}
+
+	if bs.s3back != nil {
+		stats.Replication, err = bs.s3back.ReplicationStats()
+		if err != nil {
+			return nil, err
+		}
+		stats.Backends = append(stats.Backends, &BackendStats{Name: bs.s3back.String()})
+	}
+	if bs.remote != nil {
+		stats.Remote, err = bs.remote.Stats()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if bs.namespacesStats != nil {
+		namespaces, err := bs.namespacesStats()
+		if err != nil {
+			return nil, err
+		}
+		sort.Slice(namespaces, func(i, j int) bool { return namespaces[i].Name < namespaces[j].Name })
+		stats.Namespaces = namespaces
+	}
+	return stats, nil
+}
+
+// Max size of a BlobsFile volume (the BlobsFile default)
+const blobsFileSize = 256 << 20
+
+// VolumeStats holds the utilization of a BlobsFile volume
+type VolumeStats struct {
+	Name        string  `json:"name"`
+	Size        int64   `json:"size"`
+	SizeHuman   string  `json:"size_human"`
+	Sealed      bool    `json:"sealed"`
+	Utilization float64 `json:"utilization"`
+}
+
+// VolumesStats returns the utilization of the (primary) BlobsFile volumes, the sealed volumes are always full (they
+// are padded before the parity blobs get written)
+func (bs *BlobStore) VolumesStats() ([]*VolumeStats, error) {
+	sealed := map[string]struct{}{}
+	for _, p := range bs.SealedPacks() {
+		sealed[filepath.Base(p)] = struct{}{}
+	}
+	paths, err := filepath.Glob(filepath.Join(bs.packsDir, "blobs-[0-9]*"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	volumes := []*VolumeStats{}
+	for _, p := range paths {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		vstats := &VolumeStats{
+			Name:      fi.Name(),
+			Size:      fi.Size(),
+			SizeHuman: humanize.Bytes(uint64(fi.Size())),
+		}
+		if _, ok := sealed[fi.Name()]; ok {
+			vstats.Sealed = true
+			vstats.Utilization = 1
+		} else {
+			vstats.Utilization = float64(fi.Size()) / float64(blobsFileSize)
+			if vstats.Utilization > 1 {
+				vstats.Utilization = 1
+			}
+		}
+		volumes = append(volumes, vstats)
+	}
+	return volumes, nil
+}
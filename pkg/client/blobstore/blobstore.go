@@ -1,13 +1,22 @@
 package blobstore // import "a4.io/blobstash/pkg/client/blobstore"
 
 import (
+	"bufio"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"strconv"
+	"sync"
 
+	"a4.io/blobstash/pkg/blob"
 	"a4.io/blobstash/pkg/client/clientutil"
+	"a4.io/blobstash/pkg/iface"
 )
 
+var _ iface.BlobStorer = (*BlobStore)(nil)
+
 type BlobStore struct {
 	client *clientutil.ClientUtil
 }
@@ -56,12 +65,22 @@ func (bs *BlobStore) Stat(ctx context.Context, hash string) (bool, error) {
 }
 
 func (bs *BlobStore) Put(ctx context.Context, hash string, blob []byte) error {
-	resp, err := bs.client.Post(fmt.Sprintf("/api/blobstore/blob/%s", hash), blob)
+	// The body is only sent if the blob does not exist yet
+	resp, err := bs.client.Post(
+		fmt.Sprintf("/api/blobstore/blob/%s", hash),
+		blob,
+		clientutil.WithHeader("If-None-Match", "*"),
+		clientutil.WithHeader("Expect", "100-continue"),
+	)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		// The blob is already stored
+		return nil
+	}
 	if err := clientutil.ExpectStatusCode(resp, http.StatusCreated); err != nil {
 		return err
 	}
@@ -69,4 +88,169 @@ func (bs *BlobStore) Put(ctx context.Context, hash string, blob []byte) error {
 	return nil
 }
 
-// TODO(tsileo): add Enumerate and all other methods from the other client
+// Enumerate returns a page of blobs starting at the given cursor, along with the next cursor (empty if there is no
+// more blobs)
+func (bs *BlobStore) Enumerate(ctx context.Context, cursor string, limit int) ([]*blob.SizedBlobRef, string, error) {
+	resp, err := bs.client.Get(
+		"/api/blobstore/blobs",
+		clientutil.WithQueryArgs(map[string]string{
+			"cursor": cursor,
+			"limit":  strconv.Itoa(limit),
+		}),
+	)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if err := clientutil.ExpectStatusCode(resp, http.StatusOK); err != nil {
+		return nil, "", err
+	}
+
+	out := struct {
+		Data       []*blob.SizedBlobRef `json:"data"`
+		Pagination struct {
+			Cursor  string `json:"cursor"`
+			HasMore bool   `json:"has_more"`
+		} `json:"pagination"`
+	}{}
+	if err := clientutil.Unmarshal(resp, &out); err != nil {
+		return nil, "", err
+	}
+	if !out.Pagination.HasMore {
+		return out.Data, "", nil
+	}
+	return out.Data, out.Pagination.Cursor, nil
+}
+
+// Stream uploads many blobs over a single long-lived request (`POST /api/blobstore/stream`), way faster than one
+// request per blob for tiny blobs
+type Stream struct {
+	pw   *io.PipeWriter
+	bw   *bufio.Writer
+	resp *http.Response
+	done chan struct{}
+
+	mu      sync.Mutex
+	pending int
+	saved   int
+	deduped int
+	err     error
+}
+
+// Stream starts a blobs upload stream, `Close` must be called to wait for the acks (a `*clientutil.BadStatusCodeError`
+// is returned if the stream cannot be started, a 404 means the remote instance does not support it)
+func (bs *BlobStore) Stream(ctx context.Context) (*Stream, error) {
+	pr, pw := io.Pipe()
+	resp, err := bs.client.Do("POST", "/api/blobstore/stream", pr, clientutil.WithContext(ctx))
+	if err != nil {
+		pw.Close()
+		return nil, err
+	}
+	if err := clientutil.ExpectStatusCode(resp, http.StatusOK); err != nil {
+		resp.Body.Close()
+		pw.Close()
+		return nil, err
+	}
+	s := &Stream{
+		pw:   pw,
+		bw:   bufio.NewWriter(pw),
+		resp: resp,
+		done: make(chan struct{}),
+	}
+	go s.readAcks()
+	return s, nil
+}
+
+func (s *Stream) readAcks() {
+	defer close(s.done)
+	dec := json.NewDecoder(s.resp.Body)
+	for {
+		ack := &blob.Ack{}
+		if err := dec.Decode(ack); err != nil {
+			if err != io.EOF {
+				s.setErr(err)
+			}
+			// Unblock the writes if the server stopped reading
+			s.pw.CloseWithError(io.ErrClosedPipe)
+			return
+		}
+		s.mu.Lock()
+		s.pending--
+		if ack.Error != "" && s.err == nil {
+			s.err = fmt.Errorf("failed to upload blob %s: %s", ack.Hash, ack.Error)
+		}
+		if ack.Saved {
+			s.saved++
+		} else if ack.Error == "" {
+			s.deduped++
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *Stream) setErr(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+// Err returns the first error received (the stream is aborted)
+func (s *Stream) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Put queues the blob for upload, the frames are buffered (call `Flush` to send them right away)
+func (s *Stream) Put(hash string, data []byte) error {
+	if err := s.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.pending++
+	s.mu.Unlock()
+	if err := blob.WriteFrame(s.bw, hash, data); err != nil {
+		if ackErr := s.Err(); ackErr != nil {
+			return ackErr
+		}
+		return err
+	}
+	return nil
+}
+
+// Flush sends the buffered blobs
+func (s *Stream) Flush() error {
+	if err := s.bw.Flush(); err != nil {
+		if ackErr := s.Err(); ackErr != nil {
+			return ackErr
+		}
+		return err
+	}
+	return nil
+}
+
+// Close ends the stream and waits for the remaining acks, returns the number of saved and deduplicated blobs
+func (s *Stream) Close() (int, int, error) {
+	err := s.bw.Flush()
+	s.pw.Close()
+	<-s.done
+	s.resp.Body.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.saved, s.deduped, s.err
+	}
+	if err != nil {
+		return s.saved, s.deduped, err
+	}
+	if s.pending > 0 {
+		return s.saved, s.deduped, fmt.Errorf("stream closed with %d blobs not acknowledged", s.pending)
+	}
+	return s.saved, s.deduped, nil
+}
+
+// TODO(tsileo): add all other methods from the other client
@@ -0,0 +1,117 @@
+package blobstore_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/client/blobstore"
+	"a4.io/blobstash/pkg/client/clientutil"
+	"a4.io/blobstash/pkg/testutil"
+)
+
+func TestStream(t *testing.T) {
+	srv := testutil.NewServer(t)
+	defer srv.Close()
+	bs := blobstore.New(clientutil.NewClientUtil(srv.URL, clientutil.WithAPIKey(testutil.APIKey)))
+	ctx := context.Background()
+
+	var blobs []*blob.Blob
+	for i := 0; i < 1000; i++ {
+		blobs = append(blobs, blob.New([]byte(fmt.Sprintf("blob %d", i))))
+	}
+
+	stream, err := bs.Stream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range blobs {
+		if err := stream.Put(b.Hash, b.Data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The stream stays open after a flush
+	if err := stream.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Put(blobs[0].Hash, blobs[0].Data); err != nil {
+		t.Fatal(err)
+	}
+	saved, deduped, err := stream.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved != len(blobs) || deduped != 1 {
+		t.Errorf("expected %d saved/1 deduped blobs, got %d/%d", len(blobs), saved, deduped)
+	}
+	for _, b := range []*blob.Blob{blobs[0], blobs[999]} {
+		data, err := bs.Get(ctx, b.Hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, b.Data) {
+			t.Errorf("blob %s mismatch", b.Hash)
+		}
+	}
+
+	// A corrupted blob is reported
+	stream, err = bs.Stream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := blob.New([]byte("valid"))
+	if err := stream.Put(valid.Hash, []byte("corrupted")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := stream.Close(); err == nil || !strings.Contains(err.Error(), valid.Hash) {
+		t.Errorf("expected a hash mismatch error, got %v", err)
+	}
+	if ok, err := bs.Stat(ctx, valid.Hash); err != nil || ok {
+		t.Errorf("the corrupted blob should not be stored (%v, %v)", ok, err)
+	}
+}
+
+func TestEnumerate(t *testing.T) {
+	srv := testutil.NewServer(t)
+	defer srv.Close()
+	bs := blobstore.New(clientutil.NewClientUtil(srv.URL, clientutil.WithAPIKey(testutil.APIKey)))
+	ctx := context.Background()
+
+	for i := 0; i < 20; i++ {
+		b := blob.New([]byte(fmt.Sprintf("blob %d", i)))
+		if err := bs.Put(ctx, b.Hash, b.Data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	all, cursor, err := bs.Enumerate(ctx, "", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cursor != "" || len(all) < 20 {
+		t.Fatalf("unexpected enumeration (%d blobs, cursor=%q)", len(all), cursor)
+	}
+
+	// A full last page must not announce a next page
+	for _, limit := range []int{len(all), 3} {
+		var got []*blob.SizedBlobRef
+		cursor, pages := "", 0
+		for {
+			refs, next, err := bs.Enumerate(ctx, cursor, limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, refs...)
+			pages++
+			if next == "" {
+				break
+			}
+			cursor = next
+		}
+		if pages != (len(all)+limit-1)/limit || len(got) != len(all) || got[len(got)-1].Hash != all[len(all)-1].Hash {
+			t.Errorf("limit %d: unexpected pagination (%d pages, %d blobs)", limit, pages, len(got))
+		}
+	}
+}
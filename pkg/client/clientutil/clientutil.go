@@ -29,7 +29,8 @@ var transport http.RoundTripper = &http.Transport{
 		Timeout:   10 * time.Second,
 		KeepAlive: 30 * time.Second,
 	}).Dial,
-	TLSHandshakeTimeout: 5 * time.Second,
+	TLSHandshakeTimeout:   5 * time.Second,
+	ExpectContinueTimeout: 1 * time.Second,
 }
 
 // Opts holds the client configuration
@@ -184,6 +185,14 @@ func WithHeader(name, value string) func(*http.Request) error {
 	}
 }
 
+// WithContext sets the context of the request
+func WithContext(ctx context.Context) func(*http.Request) error {
+	return func(request *http.Request) error {
+		*request = *request.WithContext(ctx)
+		return nil
+	}
+}
+
 func WithUserAgent(ua string) func(*http.Request) error {
 	return WithHeader("User-Agent", ua)
 }
@@ -62,6 +62,37 @@ func (f *Filetree) MakeSnapshot(ref, fs, message, userAgent string) (int64, erro
 	return snap.Version, nil
 }
 
+// Snapshot holds a FS version
+type Snapshot struct {
+	Ref       string `json:"ref"`
+	CreatedAt int64  `json:"created_at"`
+	Hostname  string `json:"hostname,omitempty"`
+	Message   string `json:"message,omitempty"`
+	UserAgent string `json:"user_agent,omitempty"`
+}
+
+// Versions returns the FS history (newest first), the history is empty if the FS does not exist
+func (f *Filetree) Versions(fs string, limit int) ([]*Snapshot, error) {
+	resp, err := f.client.Get(fmt.Sprintf("/api/filetree/versions/fs/%s?limit=%d", fs, limit))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := clientutil.ExpectStatusCode(resp, http.StatusOK); err != nil {
+		return nil, err
+	}
+
+	out := &struct {
+		Versions []*Snapshot `json:"versions"`
+	}{}
+	if err := clientutil.Unmarshal(resp, out); err != nil {
+		return nil, err
+	}
+
+	return out.Versions, nil
+}
+
 // GC performs a garbage collection to save the latest filetreee snapshot
 func (f *Filetree) GC(ns, name string, rev int64) error {
 	resp, err := f.client.PostJSON(
@@ -0,0 +1,415 @@
+package filetree // import "a4.io/blobstash/pkg/client/filetree"
+
+import (
+	"context"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+
+	"a4.io/blobstash/pkg/client/blobstore"
+	"a4.io/blobstash/pkg/filetree/filetreeutil/node"
+	"a4.io/blobstash/pkg/hashutil"
+	"a4.io/blobstash/pkg/iface"
+)
+
+// RestoreStats holds the stats of a restore
+type RestoreStats struct {
+	FilesCount    int
+	DirsCount     int
+	Size          int64
+	ChunksFetched int
+	ChunksReused  int // chunks read back from the previously restored files
+	ChunksResumed int // chunks already written by an interrupted download (see `ResumeFile`)
+}
+
+// localChunk holds the location of a chunk already written to disk
+type localChunk struct {
+	path   string
+	offset int64
+	size   int
+}
+
+// Restorer restores files and trees to the local disk.
+//
+// The content hashes are verified, the mode/mtime (and the xattrs stored in the `xattrs` metadata) are restored,
+// and the chunks already written by the restorer are read back from the local files instead of being fetched
+// again (the restorer can be re-used to share this local chunk cache between restores).
+type Restorer struct {
+	bs     iface.BlobGetter
+	chunks map[string]*localChunk
+	Stats  *RestoreStats
+}
+
+// NewRestorer initializes a restorer
+func NewRestorer(bs iface.BlobGetter) *Restorer {
+	return &Restorer{
+		bs:     bs,
+		chunks: map[string]*localChunk{},
+		Stats:  &RestoreStats{},
+	}
+}
+
+// GetFile restores the file at the given ref to `dest` (which must not exist)
+func (f *Filetree) GetFile(ctx context.Context, ref, dest string) (*RestoreStats, error) {
+	r := NewRestorer(blobstore.New(f.client))
+	if err := r.GetFile(ctx, ref, dest); err != nil {
+		return nil, err
+	}
+	return r.Stats, nil
+}
+
+// ResumeFile restores the file at the given ref to `dest`, resuming a previously interrupted download if any (see
+// `Restorer.ResumeFile`)
+func (f *Filetree) ResumeFile(ctx context.Context, ref, dest string) (*RestoreStats, error) {
+	r := NewRestorer(blobstore.New(f.client))
+	if err := r.ResumeFile(ctx, ref, dest); err != nil {
+		return nil, err
+	}
+	return r.Stats, nil
+}
+
+// GetDir restores the tree at the given ref to `dest` (which must not exist)
+func (f *Filetree) GetDir(ctx context.Context, ref, dest string) (*RestoreStats, error) {
+	r := NewRestorer(blobstore.New(f.client))
+	if err := r.GetDir(ctx, ref, dest); err != nil {
+		return nil, err
+	}
+	return r.Stats, nil
+}
+
+func (r *Restorer) getMeta(ctx context.Context, ref string) (*node.RawNode, error) {
+	blob, err := r.bs.Get(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := node.NewNodeFromBlob(ref, blob)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode meta %s: %v", ref, err)
+	}
+	return meta, nil
+}
+
+// GetFile restores the file at the given ref to `dest`
+func (r *Restorer) GetFile(ctx context.Context, ref, dest string) error {
+	meta, err := r.getMeta(ctx, ref)
+	if err != nil {
+		return err
+	}
+	if !meta.IsFile() {
+		return fmt.Errorf("%s is not a file", ref)
+	}
+	return r.getFile(ctx, meta, dest)
+}
+
+// GetDir restores the tree at the given ref to `dest`
+func (r *Restorer) GetDir(ctx context.Context, ref, dest string) error {
+	meta, err := r.getMeta(ctx, ref)
+	if err != nil {
+		return err
+	}
+	if meta.IsFile() {
+		return fmt.Errorf("%s is not a dir", ref)
+	}
+	return r.getDir(ctx, meta, dest)
+}
+
+func (r *Restorer) getDir(ctx context.Context, meta *node.RawNode, dest string) error {
+	if err := os.Mkdir(dest, 0700); err != nil {
+		return err
+	}
+	for _, cref := range meta.Refs {
+		cmeta, err := r.getMeta(ctx, cref.(string))
+		if err != nil {
+			return err
+		}
+		if cmeta.Name == "" || cmeta.Name != filepath.Base(cmeta.Name) || cmeta.Name == ".." {
+			return fmt.Errorf("invalid node name %q", cmeta.Name)
+		}
+		cdest := filepath.Join(dest, cmeta.Name)
+		if cmeta.IsFile() {
+			err = r.getFile(ctx, cmeta, cdest)
+		} else {
+			err = r.getDir(ctx, cmeta, cdest)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	r.Stats.DirsCount++
+	// The attributes are set once the children are restored (as it updates the mtime)
+	return setAttrs(meta, dest)
+}
+
+// chunk returns the chunk data (read from a restored file if possible)
+func (r *Restorer) chunk(ctx context.Context, ref string) ([]byte, error) {
+	if lc, ok := r.chunks[ref]; ok {
+		data, err := readChunk(lc)
+		if err == nil && hashutil.Verify(ref, data) {
+			r.Stats.ChunksReused++
+			return data, nil
+		}
+		// The local file may have been modified since
+		delete(r.chunks, ref)
+	}
+	data, err := r.bs.Get(ctx, ref)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch chunk %s: %v", ref, err)
+	}
+	if !hashutil.Verify(ref, data) {
+		return nil, fmt.Errorf("corrupted chunk %s", ref)
+	}
+	r.Stats.ChunksFetched++
+	return data, nil
+}
+
+func readChunk(lc *localChunk) ([]byte, error) {
+	f, err := os.Open(lc.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data := make([]byte, lc.size)
+	if _, err := f.ReadAt(data, lc.offset); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (r *Restorer) getFile(ctx context.Context, meta *node.RawNode, dest string) error {
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	h, err := blake2b.New256(nil)
+	if err != nil {
+		return err
+	}
+	offset, err := r.writeChunks(ctx, io.MultiWriter(out, h), dest, 0, meta.FileRefs(), nil)
+	if err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return r.checkFile(meta, dest, offset, h)
+}
+
+// writeChunks writes the chunks to w (the file at `dest`, starting at offset), and calls written (if set) after
+// each chunk is written, it returns the offset after the last chunk
+func (r *Restorer) writeChunks(ctx context.Context, w io.Writer, dest string, offset int64, ivs []*node.IndexValue, written func(ref string) error) (int64, error) {
+	for _, iv := range ivs {
+		data, err := r.chunk(ctx, iv.Value)
+		if err != nil {
+			return offset, err
+		}
+		if _, err := w.Write(data); err != nil {
+			return offset, err
+		}
+		r.chunks[iv.Value] = &localChunk{path: dest, offset: offset, size: len(data)}
+		offset += int64(len(data))
+		if written != nil {
+			if err := written(iv.Value); err != nil {
+				return offset, err
+			}
+		}
+	}
+	return offset, nil
+}
+
+// checkFile verifies the size and content hash of the restored file, and restores its attributes
+func (r *Restorer) checkFile(meta *node.RawNode, dest string, size int64, h hash.Hash) error {
+	if size != int64(meta.Size) {
+		return fmt.Errorf("file %s not successfully restored, size:%d/expected size:%d", dest, size, meta.Size)
+	}
+	// Empty files have no content hash
+	if meta.ContentHash != "" && meta.Size > 0 {
+		if chash := fmt.Sprintf("%x", h.Sum(nil)); chash != meta.ContentHash {
+			return fmt.Errorf("file %s not successfully restored, hash:%s/expected hash:%s", dest, chash, meta.ContentHash)
+		}
+	}
+	r.Stats.FilesCount++
+	r.Stats.Size += size
+	return setAttrs(meta, dest)
+}
+
+// ResumeFile restores the file at the given ref to `dest` like `GetFile`, but the download can be resumed.
+//
+// The hashes of the chunks written to `dest` are recorded in a marker file (`dest` + ".blobstash-resume"), calling
+// `ResumeFile` again after a failure only fetches the missing chunks (the chunks already written are read back and
+// verified). The marker is removed once the content hash of the file is verified against the node meta.
+func (r *Restorer) ResumeFile(ctx context.Context, ref, dest string) error {
+	meta, err := r.getMeta(ctx, ref)
+	if err != nil {
+		return err
+	}
+	if !meta.IsFile() {
+		return fmt.Errorf("%s is not a file", ref)
+	}
+
+	markerPath := dest + resumeMarkerSuffix
+	resuming, done, err := readResumeMarker(markerPath, ref)
+	if err != nil {
+		return err
+	}
+	// Without a marker, `dest` is not a partial download and must not be overwritten
+	flag := os.O_RDWR | os.O_CREATE | os.O_EXCL
+	if resuming {
+		flag = os.O_RDWR | os.O_CREATE
+	}
+	out, err := os.OpenFile(dest, flag, 0600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	h, err := blake2b.New256(nil)
+	if err != nil {
+		return err
+	}
+
+	// Keep the chunks already written (in order) as long as they're valid
+	ivs := meta.FileRefs()
+	var offset int64
+	var i int
+	for ; i < len(ivs) && i < len(done) && done[i] == ivs[i].Value; i++ {
+		lc := &localChunk{path: dest, offset: offset, size: int(ivs[i].Index - offset)}
+		data, err := readChunk(lc)
+		if err != nil || !hashutil.Verify(ivs[i].Value, data) {
+			break
+		}
+		h.Write(data)
+		r.chunks[ivs[i].Value] = lc
+		offset += int64(lc.size)
+		r.Stats.ChunksResumed++
+	}
+	if err := out.Truncate(offset); err != nil {
+		return err
+	}
+	if _, err := out.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	// Rewrite the marker with the valid chunks only before appending the new ones
+	marker, err := writeResumeMarker(markerPath, ref, done[:i])
+	if err != nil {
+		return err
+	}
+	defer marker.Close()
+
+	offset, err = r.writeChunks(ctx, io.MultiWriter(out, h), dest, offset, ivs[i:], func(cref string) error {
+		_, err := fmt.Fprintln(marker, cref)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := r.checkFile(meta, dest, offset, h); err != nil {
+		return err
+	}
+	if err := marker.Close(); err != nil {
+		return err
+	}
+	return os.Remove(markerPath)
+}
+
+// resumeMarkerSuffix is appended to the destination path to name the resumption marker
+const resumeMarkerSuffix = ".blobstash-resume"
+
+// readResumeMarker returns the chunks already written if the marker exists (the first line is the file ref,
+// followed by the hash of each chunk written, the chunks are discarded if the marker is for another ref)
+func readResumeMarker(path, ref string) (bool, []string, error) {
+	data, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		return false, nil, nil
+	case err != nil:
+		return false, nil, err
+	}
+	lines := strings.Split(string(data), "\n")
+	if lines[0] != ref {
+		return true, nil, nil
+	}
+	var done []string
+	for _, line := range lines[1:] {
+		// Skip the truncated last line if the previous download was interrupted while updating the marker
+		if len(line) != 64 {
+			break
+		}
+		done = append(done, line)
+	}
+	return true, done, nil
+}
+
+// writeResumeMarker (re)creates the marker and returns it for appending the next chunks
+func writeResumeMarker(path, ref string, done []string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Fprintln(f, ref); err != nil {
+		f.Close()
+		return nil, err
+	}
+	for _, h := range done {
+		if _, err := fmt.Fprintln(f, h); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// setAttrs restores the mode, the xattrs and the mtime
+func setAttrs(meta *node.RawNode, path string) error {
+	if meta.Mode != 0 {
+		if err := os.Chmod(path, os.FileMode(meta.Mode).Perm()); err != nil {
+			return err
+		}
+	}
+	for name, value := range xattrs(meta) {
+		if err := setXattr(path, name, []byte(value)); err != nil {
+			return fmt.Errorf("failed to set xattr %q on %s: %v", name, path, err)
+		}
+	}
+	if meta.ModTime > 0 {
+		mtime := time.Unix(meta.ModTime, 0)
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// xattrs returns the xattrs stored in the `xattrs` metadata
+func xattrs(meta *node.RawNode) map[string]string {
+	out := map[string]string{}
+	switch m := meta.Metadata["xattrs"].(type) {
+	case map[string]interface{}:
+		for k, v := range m {
+			if s, ok := v.(string); ok {
+				out[k] = s
+			}
+		}
+	case map[interface{}]interface{}:
+		for k, v := range m {
+			ks, ok1 := k.(string)
+			vs, ok2 := v.(string)
+			if ok1 && ok2 {
+				out[ks] = vs
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,167 @@
+package filetree
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"a4.io/blobstash/pkg/filetree/writer"
+)
+
+// memBlobStore is safe for concurrent use (the uploader puts the files concurrently)
+type memBlobStore struct {
+	sync.Mutex
+	blobs map[string][]byte
+}
+
+func newMemBlobStore() *memBlobStore {
+	return &memBlobStore{blobs: map[string][]byte{}}
+}
+
+func (bs *memBlobStore) Get(ctx context.Context, hash string) ([]byte, error) {
+	bs.Lock()
+	defer bs.Unlock()
+	return bs.blobs[hash], nil
+}
+
+func (bs *memBlobStore) Stat(ctx context.Context, hash string) (bool, error) {
+	bs.Lock()
+	defer bs.Unlock()
+	_, ok := bs.blobs[hash]
+	return ok, nil
+}
+
+func (bs *memBlobStore) Put(ctx context.Context, hash string, data []byte) error {
+	bs.Lock()
+	defer bs.Unlock()
+	// The uploader re-uses its buffer
+	bs.blobs[hash] = append([]byte(nil), data...)
+	return nil
+}
+
+func TestRestorer(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "blobstash_restore")
+	check(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	// Two files sharing the same content
+	src := filepath.Join(tmpDir, "src")
+	check(t, os.MkdirAll(filepath.Join(src, "sub"), 0755))
+	data := make([]byte, 3<<20)
+	rand.Read(data)
+	check(t, ioutil.WriteFile(filepath.Join(src, "a"), data, 0640))
+	check(t, ioutil.WriteFile(filepath.Join(src, "sub", "b"), data, 0600))
+	check(t, ioutil.WriteFile(filepath.Join(src, "empty"), nil, 0644))
+
+	bs := newMemBlobStore()
+	up := writer.NewUploader(bs)
+	check(t, up.SetChunking(&writer.Chunking{Mode: writer.ChunkingFixed, Size: 1 << 20}))
+	m, err := up.PutDir(src)
+	check(t, err)
+
+	r := NewRestorer(bs)
+	dst := filepath.Join(tmpDir, "dst")
+	check(t, r.GetDir(context.Background(), m.Hash, dst))
+
+	for _, p := range []string{"a", "sub/b"} {
+		restored, err := ioutil.ReadFile(filepath.Join(dst, p))
+		check(t, err)
+		if !bytes.Equal(restored, data) {
+			t.Errorf("%s not restored", p)
+		}
+	}
+	fi, err := os.Stat(filepath.Join(dst, "a"))
+	check(t, err)
+	if fi.Mode().Perm() != 0640 {
+		t.Errorf("bad mode, got %v, expected 0640", fi.Mode().Perm())
+	}
+	if r.Stats.FilesCount != 3 || r.Stats.DirsCount != 2 {
+		t.Errorf("bad stats %+v", r.Stats)
+	}
+	if r.Stats.ChunksFetched != 3 || r.Stats.ChunksReused != 3 {
+		t.Errorf("the chunks should be fetched once, got %+v", r.Stats)
+	}
+}
+
+// failingBlobStore fails after `left` fetches
+type failingBlobStore struct {
+	*memBlobStore
+	left int
+}
+
+func (bs *failingBlobStore) Get(ctx context.Context, hash string) ([]byte, error) {
+	if bs.left == 0 {
+		return nil, fmt.Errorf("connection reset")
+	}
+	bs.left--
+	return bs.memBlobStore.Get(ctx, hash)
+}
+
+func TestRestorerResumeFile(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "blobstash_resume")
+	check(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	data := make([]byte, 4<<20)
+	rand.Read(data)
+	src := filepath.Join(tmpDir, "src")
+	check(t, ioutil.WriteFile(src, data, 0644))
+
+	bs := newMemBlobStore()
+	up := writer.NewUploader(bs)
+	check(t, up.SetChunking(&writer.Chunking{Mode: writer.ChunkingFixed, Size: 1 << 20}))
+	m, err := up.PutFile(src)
+	check(t, err)
+	ctx := context.Background()
+	dst := filepath.Join(tmpDir, "dst")
+
+	// Interrupted after fetching the meta and 3 chunks
+	if err := NewRestorer(&failingBlobStore{bs, 4}).ResumeFile(ctx, m.Hash, dst); err == nil {
+		t.Fatal("the download should fail")
+	}
+	if _, err := os.Stat(dst + resumeMarkerSuffix); err != nil {
+		t.Fatalf("missing resume marker: %v", err)
+	}
+	// A partial download is not overwritten by a regular restore
+	if err := NewRestorer(bs).GetFile(ctx, m.Hash, dst); err == nil {
+		t.Fatal("the partial file should not be overwritten")
+	}
+
+	// Corrupt the second chunk, it should be fetched again along with the following ones
+	f, err := os.OpenFile(dst, os.O_WRONLY, 0)
+	check(t, err)
+	_, err = f.WriteAt([]byte("corrupted"), 1<<20+10)
+	check(t, err)
+	check(t, f.Close())
+
+	r := NewRestorer(bs)
+	check(t, r.ResumeFile(ctx, m.Hash, dst))
+	restored, err := ioutil.ReadFile(dst)
+	check(t, err)
+	if !bytes.Equal(restored, data) {
+		t.Error("file not restored")
+	}
+	if r.Stats.ChunksResumed != 1 || r.Stats.ChunksFetched != 3 {
+		t.Errorf("only the missing chunks should be fetched, got %+v", r.Stats)
+	}
+	if _, err := os.Stat(dst + resumeMarkerSuffix); !os.IsNotExist(err) {
+		t.Errorf("the resume marker should be removed (%v)", err)
+	}
+
+	// A complete file is not overwritten
+	if err := NewRestorer(bs).ResumeFile(ctx, m.Hash, dst); err == nil {
+		t.Error("the restored file should not be overwritten")
+	}
+}
+
+func check(t *testing.T, err error) {
+	if err != nil {
+		t.Fatal(err)
+	}
+}
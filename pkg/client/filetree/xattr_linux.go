@@ -0,0 +1,7 @@
+package filetree // import "a4.io/blobstash/pkg/client/filetree"
+
+import "syscall"
+
+func setXattr(path, name string, value []byte) error {
+	return syscall.Setxattr(path, name, value, 0)
+}
@@ -2,7 +2,7 @@ package kvstore // import "a4.io/blobstash/pkg/client/kvstore"
 
 import (
 	"context"
-	"errors"
+	"encoding/hex"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -10,9 +10,31 @@ import (
 
 	"a4.io/blobstash/pkg/client/clientutil"
 	"a4.io/blobstash/pkg/client/response"
+	"a4.io/blobstash/pkg/iface"
+	"a4.io/blobstash/pkg/vkv"
 )
 
-var ErrKeyNotFound = errors.New("key doest not exist")
+var _ iface.KvStorer = (*KvStore)(nil)
+
+// ErrKeyNotFound is returned when the key does not exist (same error as the server-side store)
+var ErrKeyNotFound = vkv.ErrNotFound
+
+// toKeyValue converts an API response to a `*vkv.KeyValue`, like the one returned by the server-side store
+func toKeyValue(rkv *response.KeyValue) (*vkv.KeyValue, error) {
+	kv := &vkv.KeyValue{
+		Key:     rkv.Key,
+		Version: int64(rkv.Version),
+		Data:    rkv.Data,
+	}
+	if rkv.Hash != "" {
+		h, err := hex.DecodeString(rkv.Hash)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hash %q: %v", rkv.Hash, err)
+		}
+		kv.Hash = h
+	}
+	return kv, nil
+}
 
 func nextKey(key string) string {
 	bkey := []byte(key)
@@ -35,12 +57,12 @@ func New(c *clientutil.ClientUtil) *KvStore {
 	return &KvStore{c}
 }
 
-func (kvs *KvStore) Put(ctx context.Context, key, ref string, pdata []byte, version int) (*response.KeyValue, error) {
+func (kvs *KvStore) Put(ctx context.Context, key, ref string, pdata []byte, version int64) (*vkv.KeyValue, error) {
 	data := url.Values{}
 	data.Set("data", string(pdata))
 	data.Set("ref", ref)
 	if version != -1 {
-		data.Set("version", strconv.Itoa(version))
+		data.Set("version", strconv.FormatInt(version, 10))
 	}
 	resp, err := kvs.client.Post("/api/kvstore/key/"+key, []byte(data.Encode()))
 	if err != nil {
@@ -59,10 +81,10 @@ func (kvs *KvStore) Put(ctx context.Context, key, ref string, pdata []byte, vers
 		return nil, err
 	}
 
-	return kv, nil
+	return toKeyValue(kv)
 }
 
-func (kvs *KvStore) Get(ctx context.Context, key string, version int) (*response.KeyValue, error) {
+func (kvs *KvStore) Get(ctx context.Context, key string, version int64) (*vkv.KeyValue, error) {
 	resp, err := kvs.client.Get(fmt.Sprintf("/api/kvstore/key/%s?version=%v", key, version))
 	if err != nil {
 		return nil, err
@@ -82,7 +104,7 @@ func (kvs *KvStore) Get(ctx context.Context, key string, version int) (*response
 		return nil, err
 	}
 
-	return kv, nil
+	return toKeyValue(kv)
 }
 
 func (kvs *KvStore) Versions(ctx context.Context, key string, start, end, limit int) (*response.KeyValueVersions, error) {
@@ -65,12 +65,25 @@ func (o *Oplog) Notify(ctx context.Context, ops chan<- *Op, connCallback func())
 	reader := bufio.NewReader(resp.Body)
 
 	defer resp.Body.Close()
-	// TODO(tsileo): a select with ctx cancel?
+
+	// Unblock the reader when the context is cancelled
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			resp.Body.Close()
+		case <-done:
+		}
+	}()
 	var op *Op
 	for {
 		// Read each new line and process the type of event
 		line, err := reader.ReadBytes('\n')
 		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
 			return err
 		}
 		switch {
@@ -0,0 +1,75 @@
+/*
+Package clock implements an injectable clock.
+
+The modules get the current time with `clock.Now()` instead of `time.Now()`, so the tests can freeze and advance the
+time (for the versions, the TTLs, the snapshots...) with a fake clock.
+*/
+package clock // import "a4.io/blobstash/pkg/clock"
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock returns the current time
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+var (
+	mu      sync.RWMutex
+	current Clock = realClock{}
+)
+
+// Now returns the current time according to the clock in use
+func Now() time.Time {
+	mu.RLock()
+	defer mu.RUnlock()
+	return current.Now()
+}
+
+// Set replaces the clock in use (nil restores the real clock)
+func Set(c Clock) {
+	mu.Lock()
+	defer mu.Unlock()
+	if c == nil {
+		c = realClock{}
+	}
+	current = c
+}
+
+// Fake is a clock that only moves when told to
+type Fake struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewFake returns a fake clock set at the given time
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now}
+}
+
+// Now implements the `Clock` interface
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+// Set moves the clock to the given time
+func (f *Fake) Set(now time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = now
+}
+
+// Add advances the clock
+func (f *Fake) Add(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+}
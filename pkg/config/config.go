@@ -1,26 +1,66 @@
 package config // import "a4.io/blobstash/pkg/config"
 
 import (
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
 
 	"github.com/inconshreveable/log15"
 	"gopkg.in/yaml.v2"
 
 	"a4.io/blobstash/pkg/config/pathutil"
+	"a4.io/blobstash/pkg/hashutil"
 )
 
+var validTenant = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
 var (
-	DefaultListen  = ":8051"
-	LetsEncryptDir = "letsencrypt"
+	DefaultListen               = ":8051"
+	LetsEncryptDir              = "letsencrypt"
+	DefaultShutdownGracePeriod  = 30 * time.Second
+	DefaultShareTTL             = 1 * time.Hour
+	DefaultScrubRate            = 100
+	DefaultBlobCacheMaxSize     = 64 << 20
+	DefaultBlobCacheMaxBlobSize = 512 << 10
+	DefaultFiletreeMaxDepth     = 5
+	DefaultFiletreeMaxLimit     = 10000
+	DefaultFiletreeReadAhead    = 2
+	DefaultFiletreeChunkCache   = 64
+	DefaultS3PackSize           = 8 << 20
+	DefaultS3PackMaxBlobSize    = 512 << 10
+	DefaultS3PackMaxDelay       = 1 * time.Minute
+	DefaultCORSMaxAge           = 600
+	DefaultReadHeaderTimeout    = 30 * time.Second
+	DefaultTLSDNSPropagation    = 30 * time.Second
+	DefaultIdleTimeout          = 2 * time.Minute
+	DefaultMaxHeaderBytes       = 1 << 20
+	DefaultCORSAllowedMethods   = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
+	DefaultCORSAllowedHeaders   = []string{
+		"Accept", "Authorization", "Content-Type", "Content-Encoding", "If-Match", "If-None-Match",
+		"BlobStash-API-Response-Format", "BlobStash-Namespace", "BlobStash-Session-ID", "Blobstash-Req-ID",
+		"BlobStash-Filetree-Patch-Ref", "BlobStash-Filetree-Patch-Name", "BlobStash-Filetree-Patch-Mode",
+		"BlobStash-Filetree-Patch-ModTime",
+	}
+	DefaultCORSExposedHeaders = []string{
+		"ETag", "Blobstash-Req-ID", "BlobStash-Blob-Deduped", "BlobStash-Blobs-Cursor", "BlobStash-Blobs-Has-More",
+		"BlobStash-FileTree-Revision",
+		"BlobStash-Filetree-FS-Revision", "BlobStash-FileTree-Cursor", "BlobStash-FileTree-Has-More",
+		"BlobStash-DocStore-Doc-Id", "BlobStash-DocStore-Doc-Version", "BlobStash-DocStore-Doc-CreatedAt",
+		"BlobStash-DocStore-Iter-Cursor", "BlobStash-DocStore-Iter-Has-More", "BlobStash-DocStore-Results-Count",
+	}
 )
 
 // AppConfig holds an app configuration items
 type AppConfig struct {
 	Name              string `yaml:"name"`
-	Path              string `yaml:"path"` // App path, optional?
+	Path              string `yaml:"path"` // App path (a local dir, or a `fs://<fs>[@<tag|ref>]` filetree reference)
 	Entrypoint        string `yaml:"entrypoint"`
 	Domain            string `yaml:"domain"`
 	Username          string `yaml:"username"`
@@ -30,9 +70,44 @@ type AppConfig struct {
 	Remote            string `yaml:"remote"`
 	Scheduled         string `yaml:"scheduled"`
 
+	// Additional top-level paths served by the app (e.g. "/.well-known/webfinger")
+	Routes []string `yaml:"routes"`
+
+	// Fingerprint (and pre-compress) the `public/` files, see `url_for_asset`
+	Assets bool `yaml:"assets"`
+
+	// Scopes granted to the app, the app is rejected if its manifest requires more (all the scopes are granted if
+	// not set)
+	Scopes []string `yaml:"scopes"`
+
+	// Reject the POST/PUT/PATCH/DELETE requests without a valid CSRF token (see the `session` Lua module)
+	CSRF bool `yaml:"csrf"`
+
+	// WebAuthn user verification requirement ("required", "preferred" (the default) or "discouraged")
+	WebAuthnUserVerification string `yaml:"webauthn_user_verification"`
+
+	// In-memory LRU cache exposed as `blobstash.app_cache`
+	Cache *AppCache `yaml:"cache"`
+
+	// Outbound requests made via the `http` Lua module (all the requests are rejected if not set)
+	HTTP *AppHTTP `yaml:"http"`
+
 	Config map[string]interface{} `yaml:"config"`
 }
 
+// AppCache holds the configuration of the app cache
+type AppCache struct {
+	Size       int  `yaml:"size"`       // max number of entries (default to 512)
+	Persistent bool `yaml:"persistent"` // store the entries in the kv store, so they survive restarts
+}
+
+// AppHTTP holds the limits of the outbound requests of an app
+type AppHTTP struct {
+	AllowedDomains  []string `yaml:"allowed_domains"`   // e.g. "api.example.com", or "*.example.com" for the subdomains
+	Timeout         string   `yaml:"timeout"`           // default to 10s
+	MaxResponseSize int64    `yaml:"max_response_size"` // in bytes, default to 10MB
+}
+
 type S3Repl struct {
 	Bucket    string `yaml:"bucket"`
 	Region    string `yaml:"region"`
@@ -40,6 +115,45 @@ type S3Repl struct {
 	Endpoint  string `yaml:"endpoint"`
 	AccessKey string `yaml:"access_key_id"`
 	SecretKey string `yaml:"secret_access_key"`
+
+	// Group the small blobs into pack files before uploading them (fewer, larger objects)
+	Pack *S3Pack `yaml:"pack"`
+}
+
+// S3Pack holds the S3 blob packing configuration
+type S3Pack struct {
+	// Target size of a pack (in bytes)
+	Size int `yaml:"size"`
+
+	// The bigger blobs are uploaded individually
+	MaxBlobSize int `yaml:"max_blob_size"`
+
+	// Max duration a blob can wait for a pack to be full (e.g. "1m"), the pack is uploaded anyway after that
+	MaxDelay string `yaml:"max_delay"`
+}
+
+// MaxDelayDuration returns the max duration a blob can wait before the pack is uploaded
+func (p *S3Pack) MaxDelayDuration() time.Duration {
+	if p.MaxDelay == "" {
+		return DefaultS3PackMaxDelay
+	}
+	d, err := time.ParseDuration(p.MaxDelay)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+// RemoteRepl holds the end-to-end encrypted replication to another (untrusted) BlobStash instance
+type RemoteRepl struct {
+	URL     string `yaml:"url"`
+	APIKey  string `yaml:"api_key"`
+	KeyFile string `yaml:"key_file"` // required, the key never leaves the local instance
+}
+
+// Key returns the key used to seal the blobs
+func (r *RemoteRepl) Key() (*[32]byte, error) {
+	return (&S3Repl{KeyFile: r.KeyFile}).Key()
 }
 
 type Replication struct {
@@ -49,6 +163,9 @@ type Replication struct {
 type ReplicateFrom struct {
 	URL    string `yaml:"url"`
 	APIKey string `yaml:"api_key"`
+
+	// Bootstrap an empty replica by streaming the sealed BlobsFiles of the source (instead of per-blob transfers)
+	Seed bool `yaml:"seed"`
 }
 
 func (s3 *S3Repl) Key() (*[32]byte, error) {
@@ -64,11 +181,340 @@ func (s3 *S3Repl) Key() (*[32]byte, error) {
 	return &out, nil
 }
 
+// ExportTarget holds an incremental export target (either a local directory or a S3 bucket)
+type ExportTarget struct {
+	Name     string  `yaml:"name"`
+	Dir      string  `yaml:"dir"`
+	S3       *S3Repl `yaml:"s3"`       // blobs are encrypted if `key_file` is set
+	Schedule string  `yaml:"schedule"` // cron spec (e.g. "@daily"), the export must be triggered manually if empty
+}
+
+// Scrub holds the blob integrity scrubber configuration
+type Scrub struct {
+	Schedule string `yaml:"schedule"` // cron spec (e.g. "@weekly"), the scrub must be triggered manually if empty
+	Rate     int    `yaml:"rate"`     // max blobs checked per second (default to 100)
+	Repair   bool   `yaml:"repair"`   // try to repair the corrupted blobs using the parity blobs (or serve them from the S3 replica)
+}
+
+// Snapshots holds the snapshots retention configuration
+type Snapshots struct {
+	PruneSchedule string               `yaml:"prune_schedule"` // cron spec (e.g. "@daily"), the pruning must be triggered manually if empty
+	Retention     []*SnapshotRetention `yaml:"retention"`
+}
+
+// SnapshotRetention is a grandfather-father-son retention policy (the most recent snapshot of the last N days/weeks/months
+// are kept)
+type SnapshotRetention struct {
+	Name    string `yaml:"name"` // snapshot name, can be a glob pattern (e.g. "backup-*"), the first matching policy applies
+	Daily   int    `yaml:"daily"`
+	Weekly  int    `yaml:"weekly"`
+	Monthly int    `yaml:"monthly"`
+}
+
+// Signing holds the Ed25519 signing configuration of the filetree roots and the snapshots
+type Signing struct {
+	KeyFile           string   `yaml:"key_file"`            // hex-encoded Ed25519 seed, the entries are not signed if empty
+	TrustedKeys       []string `yaml:"trusted_keys"`        // hex-encoded public keys (the key of `key_file` is always trusted)
+	RequireSignedSync bool     `yaml:"require_signed_sync"` // reject the unsigned roots/snapshots received during a sync
+}
+
+// WORM holds a write-once retention policy, the data of the matching namespaces/FS written in the last `retention`
+// can't be deleted or overwritten
+type WORM struct {
+	Namespace string `yaml:"namespace"` // namespace glob pattern (e.g. "backup-*")
+	FS        string `yaml:"fs"`        // FS name glob pattern
+	Retention string `yaml:"retention"` // e.g. "720h"
+}
+
+// Throttle holds the bandwidth limits (in bytes/sec) shared by the S3 replication, the sync and the exports
+type Throttle struct {
+	Upload        int64 `yaml:"upload"`         // 0 for unlimited
+	UploadBurst   int64 `yaml:"upload_burst"`   // default to 1s worth of data
+	Download      int64 `yaml:"download"`       // 0 for unlimited
+	DownloadBurst int64 `yaml:"download_burst"` // default to 1s worth of data
+}
+
+// Notify holds the email notifications configuration (via SMTP or Mailgun)
+type Notify struct {
+	From    string         `yaml:"from"`
+	To      []string       `yaml:"to"`     // recipients of the built-in notifications
+	Events  []string       `yaml:"events"` // built-in notifications to send ("scrub", "replication" and/or "gc", all by default)
+	SMTP    *NotifySMTP    `yaml:"smtp"`
+	Mailgun *NotifyMailgun `yaml:"mailgun"`
+
+	// Notify when the replication has been failing for longer than this (default to 10m)
+	ReplicationLag string `yaml:"replication_lag"`
+}
+
+// NotifySMTP holds the SMTP server used for sending the emails
+type NotifySMTP struct {
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"` // default to 587
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// NotifyMailgun holds the Mailgun credentials used for sending the emails
+type NotifyMailgun struct {
+	Domain  string `yaml:"domain"`
+	APIKey  string `yaml:"api_key"`
+	BaseURL string `yaml:"base_url"` // default to https://api.mailgun.net/v3 (https://api.eu.mailgun.net/v3 for the EU)
+}
+
+// Reports holds the scheduled reports configuration (storage growth and activity digests)
+type Reports struct {
+	Schedule string   `yaml:"schedule"` // cron spec (default to "@weekly")
+	Period   string   `yaml:"period"`   // period covered by a report (default to 168h)
+	Top      int      `yaml:"top"`      // number of top-growing FS/collections listed (default to 5)
+	Email    []string `yaml:"email"`    // recipients of the report (requires the `notify` config)
+	Webhook  string   `yaml:"webhook"`  // URL the report is POSTed to (as JSON)
+}
+
+// Mirror holds the blobs mirror configuration
+type Mirror struct {
+	Dirs []string `yaml:"dirs"` // additional BlobsFile directories (e.g. on other disks), written synchronously
+}
+
+// BlobCache holds the in-memory blob read cache configuration
+type BlobCache struct {
+	MaxSize     int `yaml:"max_size"`      // in bytes (default to 64MB)
+	MaxBlobSize int `yaml:"max_blob_size"` // bigger blobs are not cached (default to 512KB)
+}
+
+// Filetree holds the filetree API configuration
+type Filetree struct {
+	MaxDepth int `yaml:"max_depth"` // max `depth` when fetching a tree (default to 5)
+	MaxLimit int `yaml:"max_limit"` // max children returned per dir (default to 10000)
+
+	// Number of chunks fetched ahead when streaming a file (default to 2, -1 to disable)
+	ReadAhead int `yaml:"read_ahead"`
+	// Number of chunks kept in the shared chunk cache (default to 64)
+	ChunkCacheSize int `yaml:"chunk_cache_size"`
+
+	// Cache-Control header value for the public files, per FS name ("*" for the default)
+	CacheControl map[string]string `yaml:"cache_control"`
+
+	// Static websites hosted from a FS
+	Sites []*FiletreeSite `yaml:"sites"`
+
+	// Breadcrumbs, sorting, README and thumbnails in the public dirs listing (instead of a minimal listing)
+	RichListing bool `yaml:"rich_listing"`
+
+	// Chunking parameters for the server-side uploads, per FS name ("*" for the default)
+	Chunking map[string]*FiletreeChunking `yaml:"chunking"`
+
+	// Keep the deleted nodes in the FS trash for this duration before purging them (e.g. "720h"), per FS name ("*" for
+	// the default), the deletes are permanent if not set
+	Trash map[string]string `yaml:"trash"`
+
+	// Size limits, per FS name ("*" for the default)
+	Quotas map[string]*FiletreeQuota `yaml:"quotas"`
+
+	// Scheduled materialized snapshots of FS to local directories
+	Materialize []*FiletreeMaterialize `yaml:"materialize"`
+
+	// Local directory the server-side imports are restricted to (the imports are disabled if not set)
+	ImportRoot string `yaml:"import_root"`
+
+	// Local directory the on-demand materializations are restricted to (disabled if not set, the scheduled ones are
+	// not restricted)
+	MaterializeRoot string `yaml:"materialize_root"`
+}
+
+// FiletreeMaterialize holds a scheduled materialization of a FS to a local directory, each run writes the whole tree
+// in a new dated sub-directory, and the files unchanged since the previous runs are hard links (see
+// `FileTree.Materialize`)
+type FiletreeMaterialize struct {
+	FS       string `yaml:"fs"`       // FS name (can be `<fs>@<tag>`)
+	Dir      string `yaml:"dir"`      // absolute path of the local directory
+	Schedule string `yaml:"schedule"` // cron spec (e.g. "@daily")
+	Keep     int    `yaml:"keep"`     // number of materialized snapshots to keep (0 to keep them all)
+}
+
+// FiletreeQuota holds the size limits of a FS (in bytes, 0 for no limit)
+type FiletreeQuota struct {
+	MaxSize     int64 `yaml:"max_size"`      // max total size of the FS
+	MaxFileSize int64 `yaml:"max_file_size"` // max size of a single file
+}
+
+// FiletreeChunking holds the chunking parameters of a FS
+type FiletreeChunking struct {
+	Mode string `yaml:"mode"` // "cdc" (content-defined, the default) or "fixed"
+	Size int    `yaml:"size"` // target chunk size in bytes (must be a power of 2 in "cdc" mode)
+}
+
+// FiletreeSite holds a static website served from a FS
+type FiletreeSite struct {
+	Domain    string `yaml:"domain"`
+	FS        string `yaml:"fs"`
+	Root      string `yaml:"root"`       // dir of the FS served at `/` (default to "/")
+	CleanURLs bool   `yaml:"clean_urls"` // serve `/about` from `/about.html` or `/about/index.html`
+}
+
+// TLSDNS holds the Let's Encrypt DNS-01 challenge configuration
+type TLSDNS struct {
+	Provider  string   `yaml:"provider"`  // "cloudflare", "route53" or "rfc2136"
+	Wildcards []string `yaml:"wildcards"` // a cert is issued for both "example.com" and "*.example.com"
+	Email     string   `yaml:"email"`
+
+	DirectoryURL     string `yaml:"directory_url"`     // ACME directory (default to Let's Encrypt)
+	PropagationDelay string `yaml:"propagation_delay"` // wait before asking for the validation (default to 30s)
+
+	Cloudflare *CloudflareDNS `yaml:"cloudflare"`
+	Route53    *Route53DNS    `yaml:"route53"`
+	RFC2136    *RFC2136DNS    `yaml:"rfc2136"`
+}
+
+// CloudflareDNS holds the Cloudflare DNS provider config
+type CloudflareDNS struct {
+	APIToken string `yaml:"api_token"` // needs the Zone.DNS edit permission
+	ZoneID   string `yaml:"zone_id"`   // looked up from the domain if empty
+}
+
+// Route53DNS holds the AWS Route 53 DNS provider config
+type Route53DNS struct {
+	HostedZoneID string `yaml:"hosted_zone_id"`
+	AccessKey    string `yaml:"access_key_id"`     // default to the AWS_ACCESS_KEY_ID env var
+	SecretKey    string `yaml:"secret_access_key"` // default to the AWS_SECRET_ACCESS_KEY env var
+}
+
+// RFC2136DNS holds the dynamic DNS update (RFC 2136) provider config
+type RFC2136DNS struct {
+	Nameserver    string `yaml:"nameserver"` // host:port
+	Zone          string `yaml:"zone"`
+	TSIGKey       string `yaml:"tsig_key"`
+	TSIGSecret    string `yaml:"tsig_secret"`    // base64 encoded
+	TSIGAlgorithm string `yaml:"tsig_algorithm"` // "hmac-sha256" (the default) or "hmac-sha512"
+}
+
+// Propagation returns the delay to wait for the DNS records propagation
+func (t *TLSDNS) Propagation() time.Duration {
+	if t.PropagationDelay == "" {
+		return DefaultTLSDNSPropagation
+	}
+	d, err := time.ParseDuration(t.PropagationDelay)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+func (t *TLSDNS) init() error {
+	if len(t.Wildcards) == 0 {
+		return fmt.Errorf("invalid `tls_dns` config, `wildcards` is required")
+	}
+	if t.PropagationDelay != "" {
+		if _, err := time.ParseDuration(t.PropagationDelay); err != nil {
+			return fmt.Errorf("invalid `tls_dns.propagation_delay` config item: %v", err)
+		}
+	}
+	switch t.Provider {
+	case "cloudflare":
+		if t.Cloudflare == nil || t.Cloudflare.APIToken == "" {
+			return fmt.Errorf("invalid `tls_dns` config, `cloudflare.api_token` is required")
+		}
+	case "route53":
+		if t.Route53 == nil || t.Route53.HostedZoneID == "" {
+			return fmt.Errorf("invalid `tls_dns` config, `route53.hosted_zone_id` is required")
+		}
+	case "rfc2136":
+		if t.RFC2136 == nil || t.RFC2136.Nameserver == "" || t.RFC2136.Zone == "" || t.RFC2136.TSIGKey == "" || t.RFC2136.TSIGSecret == "" {
+			return fmt.Errorf("invalid `tls_dns` config, `rfc2136.nameserver`, `zone`, `tsig_key` and `tsig_secret` are required")
+		}
+		switch t.RFC2136.TSIGAlgorithm {
+		case "", "hmac-sha256", "hmac-sha512":
+		default:
+			return fmt.Errorf("invalid `tls_dns.rfc2136.tsig_algorithm` %q", t.RFC2136.TSIGAlgorithm)
+		}
+	default:
+		return fmt.Errorf("invalid `tls_dns.provider` %q", t.Provider)
+	}
+	return nil
+}
+
+// HTTP holds the HTTP server tuning
+type HTTP struct {
+	// Unix domain socket to listen on (e.g. for a reverse proxy), `listen` is only used if set explicitly
+	UnixSocket     string `yaml:"unix_socket"`
+	UnixSocketMode string `yaml:"unix_socket_mode"` // octal permissions of the socket (default to "0660")
+
+	ReadHeaderTimeout string `yaml:"read_header_timeout"` // default to 30s, protects against the slow clients
+	ReadTimeout       string `yaml:"read_timeout"`        // whole request, including the body (none by default)
+	WriteTimeout      string `yaml:"write_timeout"`       // whole response (none by default)
+	IdleTimeout       string `yaml:"idle_timeout"`        // keep-alive connections (default to 2m)
+	MaxHeaderBytes    int    `yaml:"max_header_bytes"`    // default to 1MB
+
+	DisableKeepAlives bool `yaml:"disable_keep_alives"`
+	DisableHTTP2      bool `yaml:"disable_http2"` // only used with TLS
+}
+
+// HTTPTimeouts holds the parsed HTTP server timeouts (0 for no timeout)
+type HTTPTimeouts struct {
+	ReadHeader, Read, Write, Idle time.Duration
+}
+
+// Timeouts returns the parsed timeouts (with the defaults)
+func (h *HTTP) Timeouts() *HTTPTimeouts {
+	t := &HTTPTimeouts{ReadHeader: DefaultReadHeaderTimeout, Idle: DefaultIdleTimeout}
+	for _, item := range []struct {
+		val string
+		dst *time.Duration
+	}{
+		{h.ReadHeaderTimeout, &t.ReadHeader},
+		{h.ReadTimeout, &t.Read},
+		{h.WriteTimeout, &t.Write},
+		{h.IdleTimeout, &t.Idle},
+	} {
+		if item.val == "" {
+			continue
+		}
+		d, err := time.ParseDuration(item.val)
+		if err != nil {
+			panic(err)
+		}
+		*item.dst = d
+	}
+	return t
+}
+
+// SocketMode returns the permissions of the unix socket
+func (h *HTTP) SocketMode() os.FileMode {
+	if h.UnixSocketMode == "" {
+		return 0660
+	}
+	mode, err := strconv.ParseUint(h.UnixSocketMode, 8, 32)
+	if err != nil {
+		panic(err)
+	}
+	return os.FileMode(mode)
+}
+
+// CORS holds the Cross-Origin Resource Sharing configuration of the API endpoints (`/api/`)
+type CORS struct {
+	AllowedOrigins   []string `yaml:"allowed_origins"`   // "*" for any origin, "https://*.example.com" for the subdomains
+	AllowedMethods   []string `yaml:"allowed_methods"`   // default to the methods used by the API
+	AllowedHeaders   []string `yaml:"allowed_headers"`   // default to the headers used by the API, "*" to allow any
+	ExposedHeaders   []string `yaml:"exposed_headers"`   // default to the BlobStash headers
+	AllowCredentials bool     `yaml:"allow_credentials"` // can't be used with the "*" origin
+	MaxAge           int      `yaml:"max_age"`           // preflight cache duration in seconds (default to 600)
+}
+
+// Tracing holds the tracing configuration
+type Tracing struct {
+	Exporter    string            `yaml:"exporter"` // "otlp" or "log"
+	Endpoint    string            `yaml:"endpoint"` // OTLP/HTTP endpoint, default to "http://localhost:4318/v1/traces"
+	ServiceName string            `yaml:"service_name"`
+	Headers     map[string]string `yaml:"headers"`
+}
+
 type BasicAuth struct {
 	ID       string   `yaml:"id"`
 	Roles    []string `yaml:"roles"`
 	Username string   `yaml:"username"`
 	Password string   `yaml:"password"`
+
+	// Isolate the data of the API key (the kv keys, collections, FS and namespaces are prefixed with `{tenant}.`)
+	Tenant string `yaml:"tenant"`
 }
 
 type Role struct {
@@ -90,12 +536,16 @@ type Perm struct {
 // Config holds the configuration items
 type Config struct {
 	init     bool
+	path     string
 	Listen   string `yaml:"listen"`
 	LogLevel string `yaml:"log_level"`
 	// TLS     bool     `yaml:"tls"`
 	AutoTLS bool     `yaml:"tls_auto"`
 	Domains []string `yaml:"tls_domains"`
 
+	// Let's Encrypt DNS-01 challenge, for the wildcard certificates (requires `tls_auto`)
+	TLSDNS *TLSDNS `yaml:"tls_dns"`
+
 	Roles []*Role `yaml:"roles"`
 	Auth  []*BasicAuth
 
@@ -107,6 +557,23 @@ type Config struct {
 	DataDir    string  `yaml:"data_dir"`
 	S3Repl     *S3Repl `yaml:"s3_replication"`
 
+	RemoteRepl *RemoteRepl `yaml:"remote_replication"`
+
+	// Validity of the filetree sharing links (e.g. "1h")
+	ShareTTL string `yaml:"share_ttl"`
+
+	// Record (coarse) last-access times for the blobs (needed for the cold data report)
+	BlobAccessTracking bool `yaml:"blob_access_tracking"`
+
+	// Read back the stored copy when a blob write is deduped (already stored)
+	VerifyDedup bool `yaml:"verify_dedup"`
+
+	// Roll up the kv meta blobs in checkpoint blobs created at this interval (e.g. "1m", disabled if not set)
+	KvCheckpointInterval string `yaml:"kv_checkpoint_interval"`
+
+	// Hash algorithm for the new blobs ("blake2b" or "blake3", default to "blake2b")
+	HashAlgorithm string `yaml:"hash_algorithm"`
+
 	Apps          []*AppConfig    `yaml:"apps"`
 	Docstore      *DocstoreConfig `yaml:"docstore"`
 	Replication   *Replication    `yaml:"replication"`
@@ -114,12 +581,51 @@ type Config struct {
 
 	SecretKey string `yaml:"secret_key"`
 
+	Tracing *Tracing `yaml:"tracing"`
+
+	HTTP *HTTP `yaml:"http"`
+
+	// Browser access to the API from other origins (any origin without credentials if not set)
+	CORS *CORS `yaml:"cors"`
+
+	Exports []*ExportTarget `yaml:"exports"`
+
+	Scrub *Scrub `yaml:"scrub"`
+
+	Snapshots *Snapshots `yaml:"snapshots"`
+
+	Signing *Signing `yaml:"signing"`
+
+	WORM []*WORM `yaml:"worm"`
+
+	BlobCache *BlobCache `yaml:"blob_cache"`
+
+	Mirror *Mirror `yaml:"mirror"`
+
+	Throttle *Throttle `yaml:"throttle"`
+
+	Filetree *Filetree `yaml:"filetree"`
+
+	Notify *Notify `yaml:"notify"`
+
+	Reports *Reports `yaml:"reports"`
+
+	// Server mode on startup ("read-write", "read-only" or "maintenance")
+	Mode string `yaml:"mode"`
+
+	// Max duration to wait for in-flight requests/tasks when shutting down (e.g. "30s")
+	ShutdownGracePeriod string `yaml:"shutdown_grace_period"`
+
 	// Items defined with the CLI flags
 	CheckMode                  bool `yaml:"-"`
 	ScanMode                   bool `yaml:"-"`
 	S3ScanMode                 bool `yaml:"-"`
 	S3RestoreMode              bool `yaml:"-"`
+	RemoteRestoreMode          bool `yaml:"-"`
 	DocstoreIndexesReindexMode bool `yaml:"-"`
+
+	// Keep the blobs in memory instead of the BlobsFile (set by the test harness)
+	InMemoryBlobs bool `yaml:"-"`
 }
 
 func (c *Config) LogLvl() log15.Lvl {
@@ -133,12 +639,197 @@ func (c *Config) LogLvl() log15.Lvl {
 	return lvl
 }
 
+// GracePeriod returns the shutdown grace period
+func (c *Config) GracePeriod() time.Duration {
+	if c.ShutdownGracePeriod == "" {
+		return DefaultShutdownGracePeriod
+	}
+	d, err := time.ParseDuration(c.ShutdownGracePeriod)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+// SharingTTL returns the validity duration of the sharing links
+func (c *Config) SharingTTL() time.Duration {
+	if c.ShareTTL == "" {
+		return DefaultShareTTL
+	}
+	d, err := time.ParseDuration(c.ShareTTL)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+// KvCheckpoints returns the interval of the kv meta checkpoints (0 if disabled)
+func (c *Config) KvCheckpoints() time.Duration {
+	if c.KvCheckpointInterval == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(c.KvCheckpointInterval)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+// HashAlg returns the hash algorithm for the new blobs
+func (c *Config) HashAlg() hashutil.Algorithm {
+	if c.HashAlgorithm == "" {
+		return hashutil.Blake2b256
+	}
+	a, err := hashutil.ParseAlgorithm(c.HashAlgorithm)
+	if err != nil {
+		panic(err)
+	}
+	return a
+}
+
+// FiletreeMaxDepth returns the max depth for fetching a tree
+func (c *Config) FiletreeMaxDepth() int {
+	if c.Filetree == nil || c.Filetree.MaxDepth == 0 {
+		return DefaultFiletreeMaxDepth
+	}
+	return c.Filetree.MaxDepth
+}
+
+// FiletreeMaxLimit returns the max number of children returned per dir
+func (c *Config) FiletreeMaxLimit() int {
+	if c.Filetree == nil || c.Filetree.MaxLimit == 0 {
+		return DefaultFiletreeMaxLimit
+	}
+	return c.Filetree.MaxLimit
+}
+
+// FiletreeReadAhead returns the number of chunks to fetch ahead when streaming a file
+func (c *Config) FiletreeReadAhead() int {
+	if c.Filetree == nil || c.Filetree.ReadAhead == 0 {
+		return DefaultFiletreeReadAhead
+	}
+	if c.Filetree.ReadAhead < 0 {
+		return 0
+	}
+	return c.Filetree.ReadAhead
+}
+
+// FiletreeChunkCacheSize returns the number of chunks kept in the shared chunk cache
+func (c *Config) FiletreeChunkCacheSize() int {
+	if c.Filetree == nil || c.Filetree.ChunkCacheSize == 0 {
+		return DefaultFiletreeChunkCache
+	}
+	return c.Filetree.ChunkCacheSize
+}
+
+// FiletreeCacheControl returns the Cache-Control header value for the public files of the given FS
+func (c *Config) FiletreeCacheControl(fs string) string {
+	if c.Filetree == nil {
+		return ""
+	}
+	if cc, ok := c.Filetree.CacheControl[fs]; ok {
+		return cc
+	}
+	return c.Filetree.CacheControl["*"]
+}
+
+// FiletreeChunking returns the chunking parameters for the given FS (nil if not configured)
+func (c *Config) FiletreeChunking(fs string) *FiletreeChunking {
+	if c.Filetree == nil {
+		return nil
+	}
+	if chunking, ok := c.Filetree.Chunking[fs]; ok {
+		return chunking
+	}
+	return c.Filetree.Chunking["*"]
+}
+
+// FiletreeQuota returns the size limits of the given FS (nil if not configured)
+func (c *Config) FiletreeQuota(fs string) *FiletreeQuota {
+	if c.Filetree == nil {
+		return nil
+	}
+	if quota, ok := c.Filetree.Quotas[fs]; ok {
+		return quota
+	}
+	return c.Filetree.Quotas["*"]
+}
+
+// FiletreeImportRoot returns the local directory the server-side imports are restricted to (empty if disabled)
+func (c *Config) FiletreeImportRoot() string {
+	if c.Filetree == nil {
+		return ""
+	}
+	return c.Filetree.ImportRoot
+}
+
+// FiletreeMaterializeRoot returns the local directory the on-demand materializations are restricted to (empty if
+// disabled)
+func (c *Config) FiletreeMaterializeRoot() string {
+	if c.Filetree == nil {
+		return ""
+	}
+	return c.Filetree.MaterializeRoot
+}
+
+// FiletreeTrashRetention returns how long the deleted nodes of the given FS are kept in the trash (0 if the trash is
+// disabled)
+func (c *Config) FiletreeTrashRetention(fs string) time.Duration {
+	if c.Filetree == nil {
+		return 0
+	}
+	retention, ok := c.Filetree.Trash[fs]
+	if !ok {
+		retention = c.Filetree.Trash["*"]
+	}
+	if retention == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(retention)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+// Path returns the path of the YAML file the config was loaded from (empty if it wasn't loaded from a file)
+func (c *Config) Path() string {
+	return c.path
+}
+
 type DocstoreSortIndex struct {
 	Field string `yaml:"field"`
 }
 
+// DocstoreCollection holds the per-collection config
+type DocstoreCollection struct {
+	// Values set for the missing fields on insert/update
+	Defaults map[string]interface{} `yaml:"defaults"`
+
+	// Automatically set the creation/last update time (RFC 3339) on insert/update
+	Timestamps     bool   `yaml:"timestamps"`
+	CreatedAtField string `yaml:"created_at_field"` // default to "created_at"
+	UpdatedAtField string `yaml:"updated_at_field"` // default to "updated_at"
+
+	// Remove the docs after this duration (since their last update), e.g. "24h"
+	TTL string `yaml:"ttl"`
+}
+
+// TTLDuration returns the TTL of the collection docs (0 if the docs never expire)
+func (c *DocstoreCollection) TTLDuration() time.Duration {
+	if c.TTL == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(c.TTL)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
 type DocstoreConfig struct {
 	SortIndexes map[string]map[string]*DocstoreSortIndex `yaml:"sort_indexes"`
+	Collections map[string]*DocstoreCollection           `yaml:"collections"`
 }
 
 // New initialize a config object by loading the YAML path at the given path
@@ -151,6 +842,7 @@ func New(path string) (*Config, error) {
 	if err := yaml.Unmarshal([]byte(data), &conf); err != nil {
 		return nil, err
 	}
+	conf.path = path
 	return conf, nil
 }
 
@@ -185,6 +877,15 @@ func (c *Config) Init() error {
 	if c.init {
 		return nil
 	}
+	if c.HTTP == nil {
+		c.HTTP = &HTTP{}
+	}
+	if c.CORS == nil {
+		c.CORS = &CORS{AllowedOrigins: []string{"*"}}
+	}
+	if err := c.CORS.init(); err != nil {
+		return err
+	}
 	if _, err := os.Stat(c.VarDir()); os.IsNotExist(err) {
 		if err := os.MkdirAll(c.VarDir(), 0700); err != nil {
 			return err
@@ -210,19 +911,278 @@ func (c *Config) Init() error {
 			return err
 		}
 	}
+	for _, a := range c.Auth {
+		if a.Tenant != "" && !validTenant.MatchString(a.Tenant) {
+			return fmt.Errorf("invalid tenant %q for auth %q (only a-z, 0-9, _ and - are allowed)", a.Tenant, a.ID)
+		}
+	}
 	if c.SharingKey == "" {
 		return fmt.Errorf("missing `sharing_key` config item")
 	}
+	if c.ShutdownGracePeriod != "" {
+		if _, err := time.ParseDuration(c.ShutdownGracePeriod); err != nil {
+			return fmt.Errorf("invalid `shutdown_grace_period` config item: %v", err)
+		}
+	}
+	if c.ShareTTL != "" {
+		if _, err := time.ParseDuration(c.ShareTTL); err != nil {
+			return fmt.Errorf("invalid `share_ttl` config item: %v", err)
+		}
+	}
+	if c.HashAlgorithm != "" {
+		if _, err := hashutil.ParseAlgorithm(c.HashAlgorithm); err != nil {
+			return fmt.Errorf("invalid `hash_algorithm` config item: %v", err)
+		}
+	}
+	if c.KvCheckpointInterval != "" {
+		d, err := time.ParseDuration(c.KvCheckpointInterval)
+		if err != nil {
+			return fmt.Errorf("invalid `kv_checkpoint_interval` config item: %v", err)
+		}
+		if d <= 0 {
+			return fmt.Errorf("invalid `kv_checkpoint_interval` config item: must be positive")
+		}
+	}
+	for _, export := range c.Exports {
+		if export.Name == "" {
+			return fmt.Errorf("missing `name` for export target")
+		}
+		if (export.Dir == "") == (export.S3 == nil) {
+			return fmt.Errorf("export target %q must have either a `dir` or a `s3` config", export.Name)
+		}
+		if export.S3 != nil && export.S3.Region == "" {
+			export.S3.Region = "us-east-1"
+		}
+	}
+	switch c.Mode {
+	case "", "read-write", "read-only", "maintenance":
+	default:
+		return fmt.Errorf("invalid `mode` config item %q", c.Mode)
+	}
+	if c.BlobCache != nil {
+		if c.BlobCache.MaxSize == 0 {
+			c.BlobCache.MaxSize = DefaultBlobCacheMaxSize
+		}
+		if c.BlobCache.MaxBlobSize == 0 {
+			c.BlobCache.MaxBlobSize = DefaultBlobCacheMaxBlobSize
+		}
+	}
+	if c.Docstore != nil {
+		for name, col := range c.Docstore.Collections {
+			if col.TTL != "" {
+				if _, err := time.ParseDuration(col.TTL); err != nil {
+					return fmt.Errorf("invalid `ttl` for docstore collection %q: %v", name, err)
+				}
+			}
+			if col.CreatedAtField == "" {
+				col.CreatedAtField = "created_at"
+			}
+			if col.UpdatedAtField == "" {
+				col.UpdatedAtField = "updated_at"
+			}
+		}
+	}
+	if c.Filetree != nil {
+		if c.Filetree.MaxDepth < 0 || c.Filetree.MaxLimit < 0 || c.Filetree.ChunkCacheSize < 0 {
+			return fmt.Errorf("invalid `filetree` config, `max_depth`, `max_limit` and `chunk_cache_size` must be positive")
+		}
+		domains := map[string]bool{}
+		for _, site := range c.Filetree.Sites {
+			if site.Domain == "" || site.FS == "" {
+				return fmt.Errorf("invalid `filetree` site, `domain` and `fs` are required")
+			}
+			if domains[site.Domain] {
+				return fmt.Errorf("invalid `filetree` site, duplicate domain %q", site.Domain)
+			}
+			domains[site.Domain] = true
+			if site.Root == "" {
+				site.Root = "/"
+			}
+		}
+		// The sizes are checked when initializing the filetree
+		for fs, chunking := range c.Filetree.Chunking {
+			if chunking == nil || chunking.Size <= 0 {
+				return fmt.Errorf("invalid `filetree` chunking for %q, `size` is required", fs)
+			}
+			if chunking.Mode == "" {
+				chunking.Mode = "cdc"
+			}
+		}
+		for fs, retention := range c.Filetree.Trash {
+			if d, err := time.ParseDuration(retention); err != nil || d <= 0 {
+				return fmt.Errorf("invalid `filetree` trash for %q, invalid retention %q", fs, retention)
+			}
+		}
+		for fs, quota := range c.Filetree.Quotas {
+			if quota == nil || quota.MaxSize < 0 || quota.MaxFileSize < 0 {
+				return fmt.Errorf("invalid `filetree` quota for %q, the sizes must be positive", fs)
+			}
+		}
+		for _, root := range []string{c.Filetree.ImportRoot, c.Filetree.MaterializeRoot} {
+			if root != "" && !filepath.IsAbs(root) {
+				return fmt.Errorf("invalid `filetree` config, `import_root` and `materialize_root` must be absolute")
+			}
+		}
+		for _, m := range c.Filetree.Materialize {
+			if m.FS == "" || !filepath.IsAbs(m.Dir) || m.Schedule == "" || m.Keep < 0 {
+				return fmt.Errorf("invalid `filetree` materialize for %q, `fs`, `schedule` and an absolute `dir` are required", m.FS)
+			}
+		}
+	}
+	if c.Scrub != nil && c.Scrub.Rate <= 0 {
+		c.Scrub.Rate = DefaultScrubRate
+	}
+	if c.Snapshots != nil {
+		for _, rp := range c.Snapshots.Retention {
+			if _, err := path.Match(rp.Name, ""); err != nil || rp.Name == "" {
+				return fmt.Errorf("invalid `snapshots.retention` config, invalid name %q", rp.Name)
+			}
+			if rp.Daily < 0 || rp.Weekly < 0 || rp.Monthly < 0 || rp.Daily+rp.Weekly+rp.Monthly == 0 {
+				return fmt.Errorf("invalid `snapshots.retention` config for %q, `daily`, `weekly` and `monthly` must be positive (and not all zero)", rp.Name)
+			}
+		}
+	}
+	for _, p := range c.WORM {
+		if p.Namespace == "" && p.FS == "" {
+			return fmt.Errorf("invalid `worm` config, `namespace` or `fs` must be set")
+		}
+		for _, pattern := range []string{p.Namespace, p.FS} {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid `worm` config, invalid pattern %q", pattern)
+			}
+		}
+		if d, err := time.ParseDuration(p.Retention); err != nil || d <= 0 {
+			return fmt.Errorf("invalid `worm` config, invalid retention %q", p.Retention)
+		}
+	}
+	if c.Signing != nil {
+		for _, k := range c.Signing.TrustedKeys {
+			if raw, err := hex.DecodeString(k); err != nil || len(raw) != 32 {
+				return fmt.Errorf("invalid `signing.trusted_keys` config, invalid public key %q", k)
+			}
+		}
+	}
+	if c.Notify != nil {
+		if (c.Notify.SMTP == nil) == (c.Notify.Mailgun == nil) {
+			return fmt.Errorf("invalid `notify` config, either `smtp` or `mailgun` must be set")
+		}
+		if c.Notify.From == "" {
+			return fmt.Errorf("invalid `notify` config, `from` must be set")
+		}
+		for _, evt := range c.Notify.Events {
+			switch evt {
+			case "scrub", "replication", "gc":
+			default:
+				return fmt.Errorf("invalid `notify` config, unknown event %q", evt)
+			}
+		}
+		if c.Notify.ReplicationLag != "" {
+			if d, err := time.ParseDuration(c.Notify.ReplicationLag); err != nil || d <= 0 {
+				return fmt.Errorf("invalid `notify` config, invalid replication lag %q", c.Notify.ReplicationLag)
+			}
+		}
+	}
+	if c.Reports != nil {
+		if c.Reports.Schedule == "" {
+			c.Reports.Schedule = "@weekly"
+		}
+		if c.Reports.Period == "" {
+			c.Reports.Period = "168h"
+		}
+		if d, err := time.ParseDuration(c.Reports.Period); err != nil || d <= 0 {
+			return fmt.Errorf("invalid `reports` config, invalid period %q", c.Reports.Period)
+		}
+		if c.Reports.Top <= 0 {
+			c.Reports.Top = 5
+		}
+		if len(c.Reports.Email) > 0 && c.Notify == nil {
+			return fmt.Errorf("invalid `reports` config, the `notify` config is required for sending emails")
+		}
+	}
+	for item, val := range map[string]string{
+		"read_header_timeout": c.HTTP.ReadHeaderTimeout,
+		"read_timeout":        c.HTTP.ReadTimeout,
+		"write_timeout":       c.HTTP.WriteTimeout,
+		"idle_timeout":        c.HTTP.IdleTimeout,
+	} {
+		if val == "" {
+			continue
+		}
+		if _, err := time.ParseDuration(val); err != nil {
+			return fmt.Errorf("invalid `http.%s` config item: %v", item, err)
+		}
+	}
+	if c.HTTP.UnixSocketMode != "" {
+		if _, err := strconv.ParseUint(c.HTTP.UnixSocketMode, 8, 32); err != nil {
+			return fmt.Errorf("invalid `http.unix_socket_mode` config item: %v", err)
+		}
+	}
+	if c.HTTP.MaxHeaderBytes <= 0 {
+		c.HTTP.MaxHeaderBytes = DefaultMaxHeaderBytes
+	}
+	if c.TLSDNS != nil {
+		if !c.AutoTLS {
+			return fmt.Errorf("invalid `tls_dns` config, `tls_auto` must be enabled")
+		}
+		if err := c.TLSDNS.init(); err != nil {
+			return err
+		}
+	}
+	if c.RemoteRepl != nil && (c.RemoteRepl.URL == "" || c.RemoteRepl.KeyFile == "") {
+		return fmt.Errorf("invalid `remote_replication`, `url` and `key_file` are required")
+	}
 	if c.S3Repl != nil {
 		// Set default region
 		if c.S3Repl.Region == "" {
 			c.S3Repl.Region = "us-east-1"
 		}
+		if pack := c.S3Repl.Pack; pack != nil {
+			if pack.Size <= 0 {
+				pack.Size = DefaultS3PackSize
+			}
+			if pack.MaxBlobSize <= 0 {
+				pack.MaxBlobSize = DefaultS3PackMaxBlobSize
+			}
+			if pack.MaxDelay != "" {
+				if _, err := time.ParseDuration(pack.MaxDelay); err != nil {
+					return fmt.Errorf("invalid `s3_replication.pack.max_delay` config item: %v", err)
+				}
+			}
+		}
 	}
 	c.init = true
 	return nil
 }
 
+// init sets the defaults and checks the origins
+func (c *CORS) init() error {
+	if len(c.AllowedMethods) == 0 {
+		c.AllowedMethods = DefaultCORSAllowedMethods
+	}
+	if len(c.AllowedHeaders) == 0 {
+		c.AllowedHeaders = DefaultCORSAllowedHeaders
+	}
+	if len(c.ExposedHeaders) == 0 {
+		c.ExposedHeaders = DefaultCORSExposedHeaders
+	}
+	if c.MaxAge <= 0 {
+		c.MaxAge = DefaultCORSMaxAge
+	}
+	for _, origin := range c.AllowedOrigins {
+		if origin == "*" {
+			if c.AllowCredentials {
+				return fmt.Errorf("invalid `cors` config, `allow_credentials` can't be used with the \"*\" origin")
+			}
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			return fmt.Errorf("invalid `cors` origin %q, must be \"*\" or \"scheme://host[:port]\"", origin)
+		}
+	}
+	return nil
+}
+
 // Sync url config parsing
 //u, err := url.Parse("http://:123@127.0.0.1:8053")
 //	if err != nil {
@@ -19,6 +19,7 @@ const (
 	filetreeHostnameKey
 	namespaceKey
 	authKey
+	skipAccessTrackingKey
 )
 
 func WithStashName(ctx context.Context, name string) context.Context {
@@ -48,6 +49,18 @@ func Namespace(ctx context.Context) (string, bool) {
 	return namespace, ok
 }
 
+// WithSkipAccessTracking marks the context of an internal reader (exports, GC), its reads don't update the blobs
+// access time
+func WithSkipAccessTracking(ctx context.Context) context.Context {
+	return context.WithValue(ctx, skipAccessTrackingKey, true)
+}
+
+// SkipAccessTracking returns true if the reads must not update the blobs access time
+func SkipAccessTracking(ctx context.Context) bool {
+	skip, _ := ctx.Value(skipAccessTrackingKey).(bool)
+	return skip
+}
+
 type actionResource struct {
 	action, resource string
 }
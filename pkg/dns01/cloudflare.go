@@ -0,0 +1,160 @@
+package dns01 // import "a4.io/blobstash/pkg/dns01"
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"a4.io/blobstash/pkg/config"
+)
+
+const cloudflareAPI = "https://api.cloudflare.com/client/v4"
+
+// cloudflare manages the records using the Cloudflare API
+type cloudflare struct {
+	conf    *config.CloudflareDNS
+	baseURL string
+	client  *http.Client
+
+	mu      sync.Mutex
+	zones   map[string]string // fqdn => zone ID
+	records map[string]string // fqdn + value => record ID
+}
+
+func newCloudflare(conf *config.CloudflareDNS) *cloudflare {
+	return &cloudflare{
+		conf:    conf,
+		baseURL: cloudflareAPI,
+		client:  http.DefaultClient,
+		zones:   map[string]string{},
+		records: map[string]string{},
+	}
+}
+
+type cloudflareResponse struct {
+	Success bool `json:"success"`
+	Errors  []struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"errors"`
+	Result json.RawMessage `json:"result"`
+}
+
+func (cf *cloudflare) do(ctx context.Context, method, path string, payload interface{}, out interface{}) error {
+	var body bytes.Buffer
+	if payload != nil {
+		if err := json.NewEncoder(&body).Encode(payload); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, cf.baseURL+path, &body)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", "Bearer "+cf.conf.APIToken)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := cf.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	cfResp := &cloudflareResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(cfResp); err != nil {
+		return fmt.Errorf("cloudflare: failed to decode response (status %d): %v", resp.StatusCode, err)
+	}
+	if !cfResp.Success {
+		msgs := []string{}
+		for _, e := range cfResp.Errors {
+			msgs = append(msgs, fmt.Sprintf("%d: %s", e.Code, e.Message))
+		}
+		return fmt.Errorf("cloudflare: %s %s failed: %s", method, path, strings.Join(msgs, ", "))
+	}
+	if out != nil {
+		return json.Unmarshal(cfResp.Result, out)
+	}
+	return nil
+}
+
+// zoneID returns the ID of the zone containing the fqdn (by trying all its parent domains)
+func (cf *cloudflare) zoneID(ctx context.Context, fqdn string) (string, error) {
+	if cf.conf.ZoneID != "" {
+		return cf.conf.ZoneID, nil
+	}
+	cf.mu.Lock()
+	id, ok := cf.zones[fqdn]
+	cf.mu.Unlock()
+	if ok {
+		return id, nil
+	}
+
+	labels := strings.Split(strings.TrimSuffix(fqdn, "."), ".")
+	for i := 1; i < len(labels)-1; i++ {
+		zones := []struct {
+			ID string `json:"id"`
+		}{}
+		name := strings.Join(labels[i:], ".")
+		if err := cf.do(ctx, "GET", "/zones?name="+url.QueryEscape(name), nil, &zones); err != nil {
+			return "", err
+		}
+		if len(zones) > 0 {
+			cf.mu.Lock()
+			cf.zones[fqdn] = zones[0].ID
+			cf.mu.Unlock()
+			return zones[0].ID, nil
+		}
+	}
+	return "", fmt.Errorf("cloudflare: no zone found for %q", fqdn)
+}
+
+// Present implements the Provider interface
+func (cf *cloudflare) Present(ctx context.Context, fqdn string, values []string) error {
+	zoneID, err := cf.zoneID(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+	for _, val := range values {
+		rec := &struct {
+			ID string `json:"id"`
+		}{}
+		if err := cf.do(ctx, "POST", "/zones/"+zoneID+"/dns_records", map[string]interface{}{
+			"type":    "TXT",
+			"name":    strings.TrimSuffix(fqdn, "."),
+			"content": val,
+			"ttl":     120,
+		}, rec); err != nil {
+			return err
+		}
+		cf.mu.Lock()
+		cf.records[fqdn+val] = rec.ID
+		cf.mu.Unlock()
+	}
+	return nil
+}
+
+// CleanUp implements the Provider interface
+func (cf *cloudflare) CleanUp(ctx context.Context, fqdn string, values []string) error {
+	zoneID, err := cf.zoneID(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+	for _, val := range values {
+		cf.mu.Lock()
+		id, ok := cf.records[fqdn+val]
+		delete(cf.records, fqdn+val)
+		cf.mu.Unlock()
+		if !ok {
+			continue
+		}
+		if err := cf.do(ctx, "DELETE", "/zones/"+zoneID+"/dns_records/"+id, nil, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,375 @@
+/*
+Package dns01 implements the Let's Encrypt DNS-01 challenge, needed to issue wildcard certificates.
+
+For each configured domain, a single certificate covers both "example.com" and "*.example.com", so the app
+subdomains registered on the fly don't need their own certificate. The challenge TXT records are managed by a
+pluggable DNS provider (Cloudflare, Route 53 or a RFC 2136 dynamic update).
+
+The certificates (and the ACME account key) are stored in the same cache as the autocert ones.
+*/
+package dns01 // import "a4.io/blobstash/pkg/dns01"
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+
+	"a4.io/blobstash/pkg/config"
+)
+
+// Renew the certificates when they expire in less than renewBefore
+const renewBefore = 30 * 24 * time.Hour
+
+// Interval between two checks of the certificates expiration (and between two attempts after a failure)
+var (
+	checkInterval = 12 * time.Hour
+	retryInterval = 1 * time.Hour
+)
+
+// Provider manages the challenge TXT records (all the values for a name are set at once, as a certificate for both
+// "example.com" and "*.example.com" needs two records for "_acme-challenge.example.com")
+type Provider interface {
+	Present(ctx context.Context, fqdn string, values []string) error
+	CleanUp(ctx context.Context, fqdn string, values []string) error
+}
+
+// NewProvider initializes the DNS provider from the config
+func NewProvider(conf *config.TLSDNS) (Provider, error) {
+	switch conf.Provider {
+	case "cloudflare":
+		return newCloudflare(conf.Cloudflare), nil
+	case "route53":
+		return newRoute53(conf.Route53), nil
+	case "rfc2136":
+		return newRFC2136(conf.RFC2136)
+	default:
+		return nil, fmt.Errorf("unknown DNS provider %q", conf.Provider)
+	}
+}
+
+// Manager obtains and renews the wildcard certificates
+type Manager struct {
+	log         log.Logger
+	conf        *config.TLSDNS
+	provider    Provider
+	cache       autocert.Cache
+	client      *acme.Client
+	propagation time.Duration
+
+	mu    sync.RWMutex
+	certs map[string]*tls.Certificate // keyed by base domain
+}
+
+// New initializes the manager
+func New(logger log.Logger, conf *config.TLSDNS, cache autocert.Cache) (*Manager, error) {
+	provider, err := NewProvider(conf)
+	if err != nil {
+		return nil, err
+	}
+	return &Manager{
+		log:         logger,
+		conf:        conf,
+		provider:    provider,
+		cache:       cache,
+		propagation: conf.Propagation(),
+		certs:       map[string]*tls.Certificate{},
+	}, nil
+}
+
+func certKey(domain string) string {
+	return "dns01+" + domain
+}
+
+// Covers returns true if the host is covered by one of the wildcard certificates
+func (m *Manager) Covers(host string) bool {
+	return m.domainFor(host) != ""
+}
+
+// domainFor returns the configured base domain covering the host
+func (m *Manager) domainFor(host string) string {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, domain := range m.conf.Wildcards {
+		if host == domain {
+			return domain
+		}
+		// The wildcard only covers a single label
+		if sub := strings.TrimSuffix(host, "."+domain); sub != host && sub != "" && !strings.Contains(sub, ".") {
+			return domain
+		}
+	}
+	return ""
+}
+
+// GetCertificate returns the wildcard certificate for the requested server name, nil if the name is not covered (or
+// if the certificate is not ready yet)
+func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) *tls.Certificate {
+	domain := m.domainFor(hello.ServerName)
+	if domain == "" {
+		return nil
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.certs[domain]
+}
+
+// Run loads the cached certificates, and obtains/renews them until the context is canceled
+func (m *Manager) Run(ctx context.Context) {
+	for _, domain := range m.conf.Wildcards {
+		cert, err := m.loadCert(ctx, domain)
+		if err != nil && err != autocert.ErrCacheMiss {
+			m.log.Error("failed to load cached certificate", "domain", domain, "err", err)
+			continue
+		}
+		if cert != nil {
+			m.setCert(domain, cert)
+		}
+	}
+
+	for {
+		next := checkInterval
+		if !m.renewAll(ctx) {
+			next = retryInterval
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(next):
+		}
+	}
+}
+
+// renewAll obtains the missing/expiring certificates, returns false if one of them failed
+func (m *Manager) renewAll(ctx context.Context) bool {
+	ok := true
+	for _, domain := range m.conf.Wildcards {
+		if !m.needsRenewal(domain) {
+			continue
+		}
+		m.log.Info("obtaining certificate", "domain", domain)
+		cert, err := m.obtain(ctx, domain)
+		if err != nil {
+			m.log.Error("failed to obtain certificate", "domain", domain, "err", err)
+			ok = false
+			continue
+		}
+		m.setCert(domain, cert)
+		m.log.Info("certificate obtained", "domain", domain, "expires", cert.Leaf.NotAfter)
+	}
+	return ok
+}
+
+func (m *Manager) setCert(domain string, cert *tls.Certificate) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.certs[domain] = cert
+}
+
+func (m *Manager) needsRenewal(domain string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	cert, ok := m.certs[domain]
+	return !ok || time.Until(cert.Leaf.NotAfter) < renewBefore
+}
+
+// loadCert loads a certificate from the cache (stored like autocert does: the key followed by the chain)
+func (m *Manager) loadCert(ctx context.Context, domain string) (*tls.Certificate, error) {
+	data, err := m.cache.Get(ctx, certKey(domain))
+	if err != nil {
+		return nil, err
+	}
+	return parseCert(data)
+}
+
+func parseCert(data []byte) (*tls.Certificate, error) {
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return nil, err
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// accountKey returns the ACME account key (created if needed)
+func (m *Manager) accountKey(ctx context.Context) (crypto.Signer, error) {
+	const name = "dns01+account.key"
+	data, err := m.cache.Get(ctx, name)
+	switch err {
+	case nil:
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("invalid account key")
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	case autocert.ErrCacheMiss:
+	default:
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.cache.Put(ctx, name, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// acmeClient returns the registered ACME client
+func (m *Manager) acmeClient(ctx context.Context) (*acme.Client, error) {
+	if m.client != nil {
+		return m.client, nil
+	}
+	key, err := m.accountKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	client := &acme.Client{Key: key, DirectoryURL: m.conf.DirectoryURL}
+	acct := &acme.Account{}
+	if m.conf.Email != "" {
+		acct.Contact = []string{"mailto:" + m.conf.Email}
+	}
+	if _, err := client.Register(ctx, acct, acme.AcceptTOS); err != nil && err != acme.ErrAccountAlreadyExists {
+		return nil, err
+	}
+	m.client = client
+	return client, nil
+}
+
+// obtain issues a certificate for the domain and its wildcard
+func (m *Manager) obtain(ctx context.Context, domain string) (*tls.Certificate, error) {
+	client, err := m.acmeClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{domain, "*." + domain}
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(names...))
+	if err != nil {
+		return nil, err
+	}
+
+	// Collect the pending challenges, the records are grouped by name
+	challenges := []*acme.Challenge{}
+	authzURLs := []string{}
+	records := map[string][]string{}
+	for _, u := range order.AuthzURLs {
+		z, err := client.GetAuthorization(ctx, u)
+		if err != nil {
+			return nil, err
+		}
+		if z.Status != acme.StatusPending {
+			continue
+		}
+		var chal *acme.Challenge
+		for _, c := range z.Challenges {
+			if c.Type == "dns-01" {
+				chal = c
+				break
+			}
+		}
+		if chal == nil {
+			return nil, fmt.Errorf("no dns-01 challenge for %q", z.Identifier.Value)
+		}
+		val, err := client.DNS01ChallengeRecord(chal.Token)
+		if err != nil {
+			return nil, err
+		}
+		fqdn := "_acme-challenge." + strings.TrimPrefix(z.Identifier.Value, "*.") + "."
+		records[fqdn] = append(records[fqdn], val)
+		challenges = append(challenges, chal)
+		authzURLs = append(authzURLs, z.URI)
+	}
+
+	if len(challenges) > 0 {
+		for fqdn, values := range records {
+			if err := m.provider.Present(ctx, fqdn, values); err != nil {
+				return nil, fmt.Errorf("failed to create the %s record: %v", fqdn, err)
+			}
+			defer func(fqdn string, values []string) {
+				if err := m.provider.CleanUp(context.Background(), fqdn, values); err != nil {
+					m.log.Error("failed to cleanup the challenge record", "fqdn", fqdn, "err", err)
+				}
+			}(fqdn, values)
+		}
+
+		// Give some time to the DNS to propagate the records
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(m.propagation):
+		}
+
+		for i, chal := range challenges {
+			if _, err := client.Accept(ctx, chal); err != nil {
+				return nil, err
+			}
+			if _, err := client.WaitAuthorization(ctx, authzURLs[i]); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if _, err := client.WaitOrder(ctx, order.URI); err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: domain},
+		DNSNames: names,
+	}, key)
+	if err != nil {
+		return nil, err
+	}
+	der, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := encodeCert(key, der)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.cache.Put(ctx, certKey(domain), data); err != nil {
+		return nil, err
+	}
+	return parseCert(data)
+}
+
+// encodeCert encodes the key and the chain in a single PEM
+func encodeCert(key *ecdsa.PrivateKey, chain [][]byte) ([]byte, error) {
+	kder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	out := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder})
+	for _, der := range chain {
+		out = append(out, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	return out, nil
+}
@@ -0,0 +1,222 @@
+package dns01
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"a4.io/blobstash/pkg/config"
+)
+
+func TestManagerCovers(t *testing.T) {
+	m := &Manager{conf: &config.TLSDNS{Wildcards: []string{"example.com"}}, certs: map[string]*tls.Certificate{}}
+	for host, expected := range map[string]bool{
+		"example.com":         true,
+		"app.example.com":     true,
+		"App.Example.com.":    true,
+		"a.app.example.com":   false,
+		"example.org":         false,
+		"badexample.com":      false,
+		"example.com.evil.io": false,
+	} {
+		if got := m.Covers(host); got != expected {
+			t.Errorf("Covers(%q) = %v, expected %v", host, got, expected)
+		}
+	}
+	if cert := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "app.example.com"}); cert != nil {
+		t.Errorf("cert should not be ready")
+	}
+}
+
+func TestCloudflare(t *testing.T) {
+	records := map[string]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer tok" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"success":false,"errors":[{"code":9109,"message":"Invalid access token"}]}`))
+			return
+		}
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/zones":
+			if r.URL.Query().Get("name") == "example.com" {
+				w.Write([]byte(`{"success":true,"result":[{"id":"z1"}]}`))
+				return
+			}
+			w.Write([]byte(`{"success":true,"result":[]}`))
+		case r.Method == "POST" && r.URL.Path == "/zones/z1/dns_records":
+			rec := map[string]interface{}{}
+			if err := json.NewDecoder(r.Body).Decode(&rec); err != nil {
+				t.Fatal(err)
+			}
+			if rec["type"] != "TXT" || rec["name"] != "_acme-challenge.example.com" {
+				t.Errorf("unexpected record %+v", rec)
+			}
+			id := "r" + rec["content"].(string)
+			records[id] = rec["content"].(string)
+			w.Write([]byte(`{"success":true,"result":{"id":"` + id + `"}}`))
+		case r.Method == "DELETE" && strings.HasPrefix(r.URL.Path, "/zones/z1/dns_records/"):
+			delete(records, strings.TrimPrefix(r.URL.Path, "/zones/z1/dns_records/"))
+			w.Write([]byte(`{"success":true,"result":{}}`))
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		}
+	}))
+	defer server.Close()
+
+	cf := newCloudflare(&config.CloudflareDNS{APIToken: "tok"})
+	cf.baseURL = server.URL
+	ctx := context.Background()
+	fqdn := "_acme-challenge.example.com."
+	if err := cf.Present(ctx, fqdn, []string{"a", "b"}); err != nil {
+		t.Fatalf("failed to present: %v", err)
+	}
+	if len(records) != 2 {
+		t.Errorf("expected 2 records, got %+v", records)
+	}
+	if err := cf.CleanUp(ctx, fqdn, []string{"a", "b"}); err != nil {
+		t.Fatalf("failed to cleanup: %v", err)
+	}
+	if len(records) != 0 {
+		t.Errorf("records not deleted: %+v", records)
+	}
+
+	cf.conf.APIToken = "bad"
+	if err := cf.Present(ctx, "_acme-challenge.example.org.", []string{"a"}); err == nil || !strings.Contains(err.Error(), "Invalid access token") {
+		t.Errorf("expected an auth error, got %v", err)
+	}
+}
+
+func TestRoute53(t *testing.T) {
+	var polled bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") {
+			t.Errorf("request not signed: %q", r.Header.Get("Authorization"))
+		}
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/hostedzone/Z1/rrset":
+			body, _ := ioutil.ReadAll(r.Body)
+			req := &route53ChangeRequest{}
+			if err := xml.Unmarshal(body, req); err != nil {
+				t.Fatal(err)
+			}
+			rrset := req.Changes[0].ResourceRecordSet
+			if req.Changes[0].Action != "UPSERT" || rrset.Name != "_acme-challenge.example.com." || len(rrset.ResourceRecords) != 2 || rrset.ResourceRecords[1].Value != `"b"` {
+				t.Errorf("unexpected change %s", body)
+			}
+			w.Write([]byte(`<ChangeResourceRecordSetsResponse><ChangeInfo><Id>/change/C1</Id><Status>PENDING</Status></ChangeInfo></ChangeResourceRecordSetsResponse>`))
+		case r.Method == "GET" && r.URL.Path == "/change/C1":
+			polled = true
+			w.Write([]byte(`<GetChangeResponse><ChangeInfo><Id>/change/C1</Id><Status>INSYNC</Status></ChangeInfo></GetChangeResponse>`))
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`<ErrorResponse><Error><Code>InvalidInput</Code><Message>bad</Message></Error></ErrorResponse>`))
+		}
+	}))
+	defer server.Close()
+
+	route53PollInterval = 10 * time.Millisecond
+	r := newRoute53(&config.Route53DNS{HostedZoneID: "Z1", AccessKey: "AKID", SecretKey: "secret"})
+	r.baseURL = server.URL
+	if err := r.Present(context.Background(), "_acme-challenge.example.com.", []string{"a", "b"}); err != nil {
+		t.Fatalf("failed to present: %v", err)
+	}
+	if !polled {
+		t.Errorf("change status not polled")
+	}
+	r.conf.HostedZoneID = "Z2"
+	if err := r.Present(context.Background(), "_acme-challenge.example.com.", []string{"a"}); err == nil || !strings.Contains(err.Error(), "InvalidInput") {
+		t.Errorf("expected an InvalidInput error, got %v", err)
+	}
+}
+
+func TestRFC2136(t *testing.T) {
+	secret := []byte("secret")
+	r, err := newRFC2136(&config.RFC2136DNS{
+		Nameserver: "127.0.0.1:0",
+		Zone:       "example.com",
+		TSIGKey:    "key.",
+		TSIGSecret: base64.StdEncoding.EncodeToString(secret),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.now = func() time.Time { return time.Unix(1600000000, 0) }
+
+	msg, err := r.updateMsg(0x1234, "_acme-challenge.example.com.", []string{"a", "b"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if op := msg[2] >> 3; op != dnsOpUpdate {
+		t.Errorf("got opcode %d, expected UPDATE", op)
+	}
+	if up, ad := binary.BigEndian.Uint16(msg[8:]), binary.BigEndian.Uint16(msg[10:]); up != 2 || ad != 1 {
+		t.Errorf("got UPCOUNT=%d ADCOUNT=%d", up, ad)
+	}
+
+	// Check the MAC (the last 2+2+2 bytes are the original ID, the error and the other len)
+	tsigName, _ := appendName(nil, "key")
+	start := strings.LastIndex(string(msg), string(tsigName)+"\x00\xfa")
+	if start == -1 {
+		t.Fatalf("TSIG RR not found")
+	}
+	unsigned := append([]byte{}, msg[:start]...)
+	binary.BigEndian.PutUint16(unsigned[10:], 0)
+	algo, _ := appendName(nil, "hmac-sha256")
+	macStart := start + len(tsigName) + 10 + len(algo) + 6 + 2 + 2
+	sum := msg[macStart : macStart+sha256.Size]
+	vars := append(append([]byte{}, tsigName...), 0, 255, 0, 0, 0, 0)
+	vars = append(vars, algo...)
+	vars = append(vars, 0, 0, 0x5f, 0x5e, 0x10, 0x00, 0x01, 0x2c, 0, 0, 0, 0)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(unsigned)
+	mac.Write(vars)
+	if !hmac.Equal(mac.Sum(nil), sum) {
+		t.Errorf("invalid MAC")
+	}
+
+	// Fake nameserver replying NOTAUTH to the deletions
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			var size [2]byte
+			io.ReadFull(conn, size[:])
+			req := make([]byte, binary.BigEndian.Uint16(size[:]))
+			io.ReadFull(conn, req)
+			resp := append([]byte{}, req[:12]...)
+			resp[2] |= 0x80
+			if strings.Contains(string(req), "\x00\x10\x00\xfe") {
+				resp[3] |= 9
+			}
+			conn.Write(append(appendUint16(nil, uint16(len(resp))), resp...))
+			conn.Close()
+		}
+	}()
+	r.conf.Nameserver = ln.Addr().String()
+	if err := r.Present(context.Background(), "_acme-challenge.example.com.", []string{"a"}); err != nil {
+		t.Errorf("failed to present: %v", err)
+	}
+	if err := r.CleanUp(context.Background(), "_acme-challenge.example.com.", []string{"a"}); err == nil || !strings.Contains(err.Error(), "rcode 9") {
+		t.Errorf("expected a rcode 9 error, got %v", err)
+	}
+}
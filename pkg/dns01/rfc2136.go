@@ -0,0 +1,234 @@
+package dns01 // import "a4.io/blobstash/pkg/dns01"
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"a4.io/blobstash/pkg/config"
+)
+
+// DNS constants (RFC 1035, RFC 2136 and RFC 8945)
+const (
+	dnsOpUpdate    = 5
+	dnsTypeSOA     = 6
+	dnsTypeTXT     = 16
+	dnsTypeTSIG    = 250
+	dnsClassIN     = 1
+	dnsClassNone   = 254
+	dnsClassAny    = 255
+	tsigFudge      = 300
+	rfc2136TTL     = 60
+	rfc2136Timeout = 30 * time.Second
+)
+
+var errInvalidName = errors.New("rfc2136: invalid name")
+
+// rfc2136 manages the records using dynamic DNS updates (signed with TSIG) over TCP
+type rfc2136 struct {
+	conf   *config.RFC2136DNS
+	secret []byte
+	algo   string
+	hash   func() hash.Hash
+	now    func() time.Time
+}
+
+func newRFC2136(conf *config.RFC2136DNS) (*rfc2136, error) {
+	secret, err := base64.StdEncoding.DecodeString(conf.TSIGSecret)
+	if err != nil {
+		return nil, fmt.Errorf("rfc2136: invalid TSIG secret: %v", err)
+	}
+	r := &rfc2136{conf: conf, secret: secret, now: time.Now}
+	switch conf.TSIGAlgorithm {
+	case "", "hmac-sha256":
+		r.algo, r.hash = "hmac-sha256.", sha256.New
+	case "hmac-sha512":
+		r.algo, r.hash = "hmac-sha512.", sha512.New
+	default:
+		return nil, fmt.Errorf("rfc2136: unsupported TSIG algorithm %q", conf.TSIGAlgorithm)
+	}
+	return r, nil
+}
+
+// appendName appends the name in the (uncompressed, lowercased) wire format
+func appendName(b []byte, name string) ([]byte, error) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			if len(label) == 0 || len(label) > 63 {
+				return nil, errInvalidName
+			}
+			b = append(b, byte(len(label)))
+			b = append(b, label...)
+		}
+	}
+	return append(b, 0), nil
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+// appendTXT appends a TXT RR (with the NONE class and a 0 TTL to delete it)
+func appendTXT(b []byte, fqdn string, class uint16, ttl uint32, value string) ([]byte, error) {
+	b, err := appendName(b, fqdn)
+	if err != nil {
+		return nil, err
+	}
+	b = appendUint16(b, dnsTypeTXT)
+	b = appendUint16(b, class)
+	b = appendUint32(b, ttl)
+	if len(value) > 255 {
+		return nil, errors.New("rfc2136: TXT value too long")
+	}
+	b = appendUint16(b, uint16(len(value)+1))
+	b = append(b, byte(len(value)))
+	return append(b, value...), nil
+}
+
+// updateMsg builds the signed update message, the records are added (or deleted if del is true)
+func (r *rfc2136) updateMsg(id uint16, fqdn string, values []string, del bool) ([]byte, error) {
+	// Header
+	msg := appendUint16(nil, id)
+	msg = appendUint16(msg, dnsOpUpdate<<11)
+	msg = appendUint16(msg, 1)                   // ZOCOUNT
+	msg = appendUint16(msg, 0)                   // PRCOUNT
+	msg = appendUint16(msg, uint16(len(values))) // UPCOUNT
+	msg = appendUint16(msg, 0)                   // ADCOUNT (incremented once signed)
+
+	// Zone
+	msg, err := appendName(msg, r.conf.Zone)
+	if err != nil {
+		return nil, err
+	}
+	msg = appendUint16(msg, dnsTypeSOA)
+	msg = appendUint16(msg, dnsClassIN)
+
+	// Updates
+	for _, val := range values {
+		class, ttl := uint16(dnsClassIN), uint32(rfc2136TTL)
+		if del {
+			class, ttl = dnsClassNone, 0
+		}
+		if msg, err = appendTXT(msg, fqdn, class, ttl, val); err != nil {
+			return nil, err
+		}
+	}
+
+	return r.sign(msg, id)
+}
+
+// sign appends the TSIG RR to the message
+func (r *rfc2136) sign(msg []byte, id uint16) ([]byte, error) {
+	signedAt := uint64(r.now().Unix())
+	keyName, err := appendName(nil, r.conf.TSIGKey)
+	if err != nil {
+		return nil, err
+	}
+	algo, err := appendName(nil, r.algo)
+	if err != nil {
+		return nil, err
+	}
+	timeSigned := []byte{byte(signedAt >> 40), byte(signedAt >> 32), byte(signedAt >> 24), byte(signedAt >> 16), byte(signedAt >> 8), byte(signedAt)}
+
+	// MAC over the message and the TSIG variables
+	mac := hmac.New(r.hash, r.secret)
+	mac.Write(msg)
+	vars := append([]byte{}, keyName...)
+	vars = appendUint16(vars, dnsClassAny)
+	vars = appendUint32(vars, 0) // TTL
+	vars = append(vars, algo...)
+	vars = append(vars, timeSigned...)
+	vars = appendUint16(vars, tsigFudge)
+	vars = appendUint16(vars, 0) // Error
+	vars = appendUint16(vars, 0) // Other len
+	mac.Write(vars)
+	sum := mac.Sum(nil)
+
+	rdata := append([]byte{}, algo...)
+	rdata = append(rdata, timeSigned...)
+	rdata = appendUint16(rdata, tsigFudge)
+	rdata = appendUint16(rdata, uint16(len(sum)))
+	rdata = append(rdata, sum...)
+	rdata = appendUint16(rdata, id)
+	rdata = appendUint16(rdata, 0) // Error
+	rdata = appendUint16(rdata, 0) // Other len
+
+	out := append([]byte{}, msg...)
+	out = append(out, keyName...)
+	out = appendUint16(out, dnsTypeTSIG)
+	out = appendUint16(out, dnsClassAny)
+	out = appendUint32(out, 0)
+	out = appendUint16(out, uint16(len(rdata)))
+	out = append(out, rdata...)
+	// ADCOUNT
+	binary.BigEndian.PutUint16(out[10:], 1)
+	return out, nil
+}
+
+// exchange sends the message over TCP and checks the response code
+func (r *rfc2136) exchange(ctx context.Context, msg []byte) error {
+	d := &net.Dialer{Timeout: rfc2136Timeout}
+	conn, err := d.DialContext(ctx, "tcp", r.conf.Nameserver)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(rfc2136Timeout))
+
+	if _, err := conn.Write(append(appendUint16(nil, uint16(len(msg))), msg...)); err != nil {
+		return err
+	}
+	var size [2]byte
+	if _, err := io.ReadFull(conn, size[:]); err != nil {
+		return err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return err
+	}
+	if len(resp) < 12 || binary.BigEndian.Uint16(resp) != binary.BigEndian.Uint16(msg) {
+		return errors.New("rfc2136: invalid response")
+	}
+	if rcode := resp[3] & 0xf; rcode != 0 {
+		return fmt.Errorf("rfc2136: update failed with rcode %d", rcode)
+	}
+	return nil
+}
+
+func (r *rfc2136) update(ctx context.Context, fqdn string, values []string, del bool) error {
+	var id [2]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return err
+	}
+	msg, err := r.updateMsg(binary.BigEndian.Uint16(id[:]), fqdn, values, del)
+	if err != nil {
+		return err
+	}
+	return r.exchange(ctx, msg)
+}
+
+// Present implements the Provider interface
+func (r *rfc2136) Present(ctx context.Context, fqdn string, values []string) error {
+	return r.update(ctx, fqdn, values, false)
+}
+
+// CleanUp implements the Provider interface
+func (r *rfc2136) CleanUp(ctx context.Context, fqdn string, values []string) error {
+	return r.update(ctx, fqdn, values, true)
+}
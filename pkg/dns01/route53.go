@@ -0,0 +1,162 @@
+package dns01 // import "a4.io/blobstash/pkg/dns01"
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+
+	"a4.io/blobstash/pkg/config"
+)
+
+const route53API = "https://route53.amazonaws.com/2013-04-01"
+
+// Interval between two checks of a Route 53 change status
+var route53PollInterval = 5 * time.Second
+
+// route53 manages the records using the AWS Route 53 API
+type route53 struct {
+	conf    *config.Route53DNS
+	baseURL string
+	client  *http.Client
+	signer  *v4.Signer
+}
+
+func newRoute53(conf *config.Route53DNS) *route53 {
+	creds := credentials.NewEnvCredentials()
+	if conf.AccessKey != "" {
+		creds = credentials.NewStaticCredentials(conf.AccessKey, conf.SecretKey, "")
+	}
+	return &route53{
+		conf:    conf,
+		baseURL: route53API,
+		client:  http.DefaultClient,
+		signer:  v4.NewSigner(creds),
+	}
+}
+
+type route53ResourceRecord struct {
+	Value string `xml:"Value"`
+}
+
+type route53ResourceRecordSet struct {
+	Name            string                   `xml:"Name"`
+	Type            string                   `xml:"Type"`
+	TTL             int                      `xml:"TTL"`
+	ResourceRecords []*route53ResourceRecord `xml:"ResourceRecords>ResourceRecord"`
+}
+
+type route53Change struct {
+	Action            string                    `xml:"Action"`
+	ResourceRecordSet *route53ResourceRecordSet `xml:"ResourceRecordSet"`
+}
+
+type route53ChangeRequest struct {
+	XMLName xml.Name         `xml:"https://route53.amazonaws.com/doc/2013-04-01/ ChangeResourceRecordSetsRequest"`
+	Changes []*route53Change `xml:"ChangeBatch>Changes>Change"`
+}
+
+type route53ChangeInfo struct {
+	ChangeInfo struct {
+		ID     string `xml:"Id"`
+		Status string `xml:"Status"`
+	} `xml:"ChangeInfo"`
+}
+
+type route53Error struct {
+	Code    string `xml:"Error>Code"`
+	Message string `xml:"Error>Message"`
+}
+
+func (r *route53) do(ctx context.Context, method, path string, payload interface{}, out interface{}) error {
+	var body []byte
+	if payload != nil {
+		var err error
+		body, err = xml.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		body = append([]byte(xml.Header), body...)
+	}
+	req, err := http.NewRequest(method, r.baseURL+path, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	if body != nil {
+		req.Header.Set("Content-Type", "text/xml")
+	}
+	// Route 53 is a global service, the requests are always signed for us-east-1
+	if _, err := r.signer.Sign(req, bytes.NewReader(body), "route53", "us-east-1", time.Now()); err != nil {
+		return err
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		rerr := &route53Error{}
+		if err := xml.Unmarshal(data, rerr); err != nil || rerr.Code == "" {
+			return fmt.Errorf("route53: %s %s failed with status %d", method, path, resp.StatusCode)
+		}
+		return fmt.Errorf("route53: %s: %s", rerr.Code, rerr.Message)
+	}
+	return xml.Unmarshal(data, out)
+}
+
+// change applies the change and waits until it's propagated to all the Route 53 DNS servers
+func (r *route53) change(ctx context.Context, action, fqdn string, values []string) error {
+	records := make([]*route53ResourceRecord, len(values))
+	for i, val := range values {
+		records[i] = &route53ResourceRecord{Value: fmt.Sprintf("%q", val)}
+	}
+	info := &route53ChangeInfo{}
+	if err := r.do(ctx, "POST", "/hostedzone/"+r.conf.HostedZoneID+"/rrset", &route53ChangeRequest{
+		Changes: []*route53Change{{
+			Action: action,
+			ResourceRecordSet: &route53ResourceRecordSet{
+				Name:            fqdn,
+				Type:            "TXT",
+				TTL:             60,
+				ResourceRecords: records,
+			},
+		}},
+	}, info); err != nil {
+		return err
+	}
+
+	for info.ChangeInfo.Status != "INSYNC" {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(route53PollInterval):
+		}
+		id := strings.TrimPrefix(info.ChangeInfo.ID, "/change/")
+		if err := r.do(ctx, "GET", "/change/"+id, nil, info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Present implements the Provider interface
+func (r *route53) Present(ctx context.Context, fqdn string, values []string) error {
+	return r.change(ctx, "UPSERT", fqdn, values)
+}
+
+// CleanUp implements the Provider interface
+func (r *route53) CleanUp(ctx context.Context, fqdn string, values []string) error {
+	return r.change(ctx, "DELETE", fqdn, values)
+}
@@ -0,0 +1,135 @@
+package docstore // import "a4.io/blobstash/pkg/docstore"
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/ctxutil"
+	"a4.io/blobstash/pkg/filetree"
+	"a4.io/blobstash/pkg/filetree/writer"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/iface"
+	"a4.io/blobstash/pkg/perms"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+// Attachments
+//
+// A document field can reference a file stored via the filetree Uploader: `{"_attachment": "<node ref>"}`. The
+// attachments are expanded in the `pointers` (under the `@filetree/ref:<node ref>` key), and marked along with the
+// document by the `mark_docstore_doc` GC helper.
+//
+// The pointers are not expanded for a tenant (they're resolved in the shared root namespace), its attachments are
+// stored in its own namespace and can be fetched with the filetree API.
+
+const attachmentKey = "_attachment"
+
+// attachmentRef returns the node ref if the value is an attachment
+func attachmentRef(v map[string]interface{}) (string, bool) {
+	if len(v) != 1 {
+		return "", false
+	}
+	ref, ok := v[attachmentKey].(string)
+	return ref, ok && ref != ""
+}
+
+// Attachment returns the value to store in a document to reference the given node
+func Attachment(ref string) map[string]interface{} {
+	return map[string]interface{}{attachmentKey: ref}
+}
+
+// attachmentsHandler uploads a file (multipart `file`) and links it in the `field` of the document
+func (docstore *DocStore) attachmentsHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			httputil.WriteErrorStatus(w, http.StatusMethodNotAllowed)
+			return
+		}
+		vars := mux.Vars(r)
+		collection := vars["collection"]
+		sid := vars["_id"]
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Write, perms.JSONCollection),
+			perms.ResourceWithID(perms.DocStore, perms.JSONCollection, collection),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+		field := r.URL.Query().Get("field")
+		if field == "" || strings.HasPrefix(field, "_") {
+			httputil.WriteJSONError(w, http.StatusBadRequest, "invalid field")
+			return
+		}
+		// The attachments of a tenant are stored in its namespace
+		ctx := ctxutil.WithNamespace(r.Context(), r.Header.Get(ctxutil.NamespaceHeader))
+
+		doc := map[string]interface{}{}
+		_id, _, err := docstore.Fetch(collection, sid, &doc, false, false, -1)
+		if err != nil {
+			if err == vkv.ErrNotFound {
+				httputil.WriteErrorStatus(w, http.StatusNotFound)
+				return
+			}
+			panic(err)
+		}
+		if _id.Flag() == flagDeleted {
+			httputil.WriteErrorStatus(w, http.StatusNotFound)
+			return
+		}
+		ifMatch := r.Header.Get("If-Match")
+		if ifMatch == "" {
+			// Prevent overwriting a concurrent update
+			ifMatch = _id.VersionString()
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, filetree.MaxUploadSize)
+		if err := r.ParseMultipartForm(32 << 20); err != nil {
+			httputil.WriteJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid upload: %v", err))
+			return
+		}
+		defer r.MultipartForm.RemoveAll()
+		file, handler, err := r.FormFile("file")
+		if err != nil {
+			httputil.WriteJSONError(w, http.StatusBadRequest, "missing file")
+			return
+		}
+		defer file.Close()
+		uploader := writer.NewUploader(iface.NewBlobStorer(ctx, docstore.blobStore))
+		meta, err := uploader.PutReader(handler.Filename, file, nil)
+		if err != nil {
+			panic(err)
+		}
+
+		doc[field] = Attachment(meta.Hash)
+		_id, err = docstore.Update(collection, sid, doc, ifMatch)
+		switch err {
+		case nil:
+		case ErrDocNotFound:
+			httputil.WriteErrorStatus(w, http.StatusNotFound)
+			return
+		case ErrPreconditionFailed:
+			httputil.WriteErrorStatus(w, http.StatusPreconditionFailed)
+			return
+		default:
+			panic(err)
+		}
+
+		node, err := docstore.filetree.Node(ctx, meta.Hash)
+		if err != nil {
+			panic(fmt.Errorf("failed to fetch node: %v", err))
+		}
+		w.Header().Set("ETag", _id.VersionString())
+		httputil.MarshalAndWrite(r, w, map[string]interface{}{
+			"_id":      _id.String(),
+			"_version": _id.VersionString(),
+			"field":    field,
+			"node":     node,
+		}, httputil.WithStatusCode(http.StatusCreated))
+	}
+}
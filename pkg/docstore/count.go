@@ -0,0 +1,252 @@
+package docstore // import "a4.io/blobstash/pkg/docstore"
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"a4.io/blobstash/pkg/asof"
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/docstore/id"
+	"a4.io/blobstash/pkg/docstore/maputil"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/perms"
+)
+
+// DistinctValue holds a distinct value of a field, and the number of docs with this value
+type DistinctValue struct {
+	Value interface{} `json:"value"`
+	Count int         `json:"count"`
+}
+
+// scan calls `cb` for every doc matching the query, the docs are only fetched if the query requires it (or if
+// `fetch` is true)
+func (docstore *DocStore) scan(collection string, query *query, asOf int64, fetch bool, cb func(*id.ID, map[string]interface{}) error) (*executionStats, error) {
+	tstart := time.Now()
+	stats := &executionStats{}
+	it := newNoIndexIterator(docstore.kvStore)
+	stats.Index = it.Name()
+
+	var qmatcher QueryMatcher
+	var err error
+	switch {
+	case query.isMatchAll():
+		stats.Engine = "match_all"
+		qmatcher = &MatchAllEngine{}
+	default:
+		qmatcher, err = docstore.newLuaQueryEngine(query)
+		if err != nil {
+			return stats, err
+		}
+		stats.Engine = "lua"
+		fetch = true
+	}
+	defer qmatcher.Close()
+
+	var start string
+	for {
+		_ids, cursor, err := it.Iter(collection, start, true, 1000, asOf)
+		if err != nil {
+			return stats, err
+		}
+		if len(_ids) == 0 {
+			break
+		}
+		for _, _id := range _ids {
+			if _id.Flag() == flagDeleted {
+				continue
+			}
+			var doc map[string]interface{}
+			if fetch {
+				doc = map[string]interface{}{}
+				if _, _, err := docstore.Fetch(collection, _id.String(), &doc, true, false, _id.Version()); err != nil {
+					return stats, err
+				}
+				stats.TotalDocsExamined++
+				ok, err := qmatcher.Match(doc)
+				if err != nil {
+					return stats, err
+				}
+				if !ok {
+					continue
+				}
+			}
+			stats.NReturned++
+			if err := cb(_id, doc); err != nil {
+				return stats, err
+			}
+		}
+		start = cursor
+	}
+
+	stats.ExecutionTimeNano = time.Since(tstart).Nanoseconds()
+	return stats, nil
+}
+
+// Count returns the number of docs matching the query (the docs are not fetched for "match all" queries)
+func (docstore *DocStore) Count(collection string, query *query, asOf int64) (int, *executionStats, error) {
+	stats, err := docstore.scan(collection, query, asOf, false, func(_ *id.ID, _ map[string]interface{}) error {
+		return nil
+	})
+	if err != nil {
+		return 0, stats, err
+	}
+	return stats.NReturned, stats, nil
+}
+
+// CountAll returns the number of docs in the collection (as of the given time in UNIX nano if asOf is not 0)
+func (docstore *DocStore) CountAll(collection string, asOf int64) (int, error) {
+	count, _, err := docstore.Count(collection, &query{}, asOf)
+	return count, err
+}
+
+// Distinct returns the distinct values for the given field (in "dot notation") among the docs matching the query,
+// each item of a list value is counted as a distinct value
+func (docstore *DocStore) Distinct(collection string, query *query, field string, asOf int64) ([]*DistinctValue, *executionStats, error) {
+	index := map[string]*DistinctValue{}
+	add := func(v interface{}) error {
+		k, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		if dv, ok := index[string(k)]; ok {
+			dv.Count++
+			return nil
+		}
+		index[string(k)] = &DistinctValue{Value: v, Count: 1}
+		return nil
+	}
+	stats, err := docstore.scan(collection, query, asOf, true, func(_ *id.ID, doc map[string]interface{}) error {
+		v, err := maputil.GetPath(doc, field)
+		if err != nil {
+			// The field is missing
+			return nil
+		}
+		if l, ok := v.([]interface{}); ok {
+			for _, item := range l {
+				if err := add(item); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		return add(v)
+	})
+	if err != nil {
+		return nil, stats, err
+	}
+
+	// Sort by their JSON representation (so the order is stable)
+	keys := []string{}
+	for k := range index {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	out := []*DistinctValue{}
+	for _, k := range keys {
+		out = append(out, index[k])
+	}
+	return out, stats, nil
+}
+
+func parseAsOf(q *httputil.Query) (int64, error) {
+	if v := q.Get("as_of"); v != "" {
+		return asof.ParseAsOf(v)
+	}
+	return q.GetInt64Default("as_of_nano", 0)
+}
+
+func setQueryStatsHeaders(w http.ResponseWriter, stats *executionStats) {
+	w.Header().Set("BlobStash-DocStore-Query-Index", stats.Index)
+	w.Header().Set("BlobStash-DocStore-Query-Engine", stats.Engine)
+	w.Header().Set("BlobStash-DocStore-Query-Returned", strconv.Itoa(stats.NReturned))
+	w.Header().Set("BlobStash-DocStore-Query-Examined", strconv.Itoa(stats.TotalDocsExamined))
+	w.Header().Set("BlobStash-DocStore-Query-Exec-Time-Nano", strconv.FormatInt(stats.ExecutionTimeNano, 10))
+}
+
+func (docstore *DocStore) countHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		collection := mux.Vars(r)["collection"]
+		switch r.Method {
+		case "GET", "HEAD":
+			if !auth.Can(
+				w,
+				r,
+				perms.Action(perms.Read, perms.JSONCollection),
+				perms.ResourceWithID(perms.DocStore, perms.JSONCollection, collection),
+			) {
+				auth.Forbidden(w)
+				return
+			}
+			q := httputil.NewQuery(r.URL.Query())
+			asOf, err := parseAsOf(q)
+			if err != nil {
+				panic(err)
+			}
+			count, stats, err := docstore.Count(collection, &query{
+				script:     q.Get("script"),
+				basicQuery: q.Get("query"),
+			}, asOf)
+			if err != nil {
+				docstore.logger.Error("count failed", "err", err)
+				httputil.Error(w, err)
+				return
+			}
+			setQueryStatsHeaders(w, stats)
+			httputil.MarshalAndWrite(r, w, map[string]interface{}{
+				"count": count,
+			})
+		default:
+			httputil.WriteErrorStatus(w, http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func (docstore *DocStore) distinctHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		collection := mux.Vars(r)["collection"]
+		switch r.Method {
+		case "GET", "HEAD":
+			if !auth.Can(
+				w,
+				r,
+				perms.Action(perms.Read, perms.JSONCollection),
+				perms.ResourceWithID(perms.DocStore, perms.JSONCollection, collection),
+			) {
+				auth.Forbidden(w)
+				return
+			}
+			q := httputil.NewQuery(r.URL.Query())
+			field := q.Get("field")
+			if field == "" {
+				httputil.WriteJSONError(w, http.StatusBadRequest, "missing field")
+				return
+			}
+			asOf, err := parseAsOf(q)
+			if err != nil {
+				panic(err)
+			}
+			values, stats, err := docstore.Distinct(collection, &query{
+				script:     q.Get("script"),
+				basicQuery: q.Get("query"),
+			}, field, asOf)
+			if err != nil {
+				docstore.logger.Error("distinct failed", "err", err)
+				httputil.Error(w, err)
+				return
+			}
+			setQueryStatsHeaders(w, stats)
+			httputil.MarshalAndWrite(r, w, map[string]interface{}{
+				"field": field,
+				"data":  values,
+				"count": len(values),
+			})
+		default:
+			httputil.WriteErrorStatus(w, http.StatusMethodNotAllowed)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package docstore // import "a4.io/blobstash/pkg/docstore"
+
+import (
+	"fmt"
+	"time"
+
+	"a4.io/blobstash/pkg/config"
+)
+
+// collectionConfig returns the config for the given collection (nil if there's none)
+func (docstore *DocStore) collectionConfig(collection string) *config.DocstoreCollection {
+	if docstore.conf.Docstore == nil || docstore.conf.Docstore.Collections == nil {
+		return nil
+	}
+	return docstore.conf.Docstore.Collections[collection]
+}
+
+// normalizeValue converts the YAML maps (`map[interface{}]interface{}`) so the value can be JSON encoded, it
+// always returns a copy so the config cannot be modified by the docs.
+func normalizeValue(v interface{}) interface{} {
+	switch vv := v.(type) {
+	case map[interface{}]interface{}:
+		out := map[string]interface{}{}
+		for k, val := range vv {
+			out[fmt.Sprintf("%v", k)] = normalizeValue(val)
+		}
+		return out
+	case map[string]interface{}:
+		out := map[string]interface{}{}
+		for k, val := range vv {
+			out[k] = normalizeValue(val)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(vv))
+		for i, val := range vv {
+			out[i] = normalizeValue(val)
+		}
+		return out
+	default:
+		return v
+	}
+}
+
+func applyDefaults(conf *config.DocstoreCollection, doc map[string]interface{}) {
+	for k, v := range conf.Defaults {
+		if _, ok := doc[k]; !ok {
+			doc[k] = normalizeValue(v)
+		}
+	}
+}
+
+// prepareInsert sets the default values and the timestamps (if configured) for a new doc
+func (docstore *DocStore) prepareInsert(collection string, doc map[string]interface{}, now time.Time) {
+	conf := docstore.collectionConfig(collection)
+	if conf == nil {
+		return
+	}
+	applyDefaults(conf, doc)
+	if conf.Timestamps {
+		ts := now.UTC().Format(time.RFC3339)
+		doc[conf.CreatedAtField] = ts
+		doc[conf.UpdatedAtField] = ts
+	}
+}
+
+// prepareUpdate sets the default values and the timestamps (if configured) for an updated doc, the creation
+// time cannot be modified.
+func (docstore *DocStore) prepareUpdate(collection string, oldDoc, newDoc map[string]interface{}, created, now time.Time) {
+	conf := docstore.collectionConfig(collection)
+	if conf == nil {
+		return
+	}
+	applyDefaults(conf, newDoc)
+	if conf.Timestamps {
+		if v, ok := oldDoc[conf.CreatedAtField]; ok {
+			newDoc[conf.CreatedAtField] = v
+		} else {
+			// The doc was created before the timestamps were enabled
+			newDoc[conf.CreatedAtField] = created.UTC().Format(time.RFC3339)
+		}
+		newDoc[conf.UpdatedAtField] = now.UTC().Format(time.RFC3339)
+	}
+}
@@ -0,0 +1,58 @@
+package docstore
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"a4.io/blobstash/pkg/config"
+)
+
+func TestDefaultsAndTimestamps(t *testing.T) {
+	conf := &config.Config{
+		SharingKey: "k",
+		Docstore: &config.DocstoreConfig{
+			Collections: map[string]*config.DocstoreCollection{
+				"notes": &config.DocstoreCollection{
+					Defaults: map[string]interface{}{
+						"status": "draft",
+						"meta":   map[interface{}]interface{}{"tags": []interface{}{"a"}},
+					},
+					Timestamps: true,
+				},
+			},
+		},
+	}
+	conf.DataDir = t.TempDir()
+	if err := conf.Init(); err != nil {
+		t.Fatal(err)
+	}
+	dc := &DocStore{conf: conf}
+
+	created := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	doc := map[string]interface{}{"status": "published"}
+	dc.prepareInsert("notes", doc, created)
+	if doc["status"] != "published" || doc["created_at"] != "2020-01-01T00:00:00Z" || doc["updated_at"] != doc["created_at"] {
+		t.Errorf("unexpected doc %+v", doc)
+	}
+	// Defaults must be JSON encodable
+	if _, err := json.Marshal(doc); err != nil {
+		t.Errorf("failed to encode doc: %v", err)
+	}
+
+	newDoc := map[string]interface{}{"created_at": "tampered"}
+	dc.prepareUpdate("notes", doc, newDoc, created, created.Add(time.Hour))
+	if newDoc["status"] != "draft" || newDoc["created_at"] != "2020-01-01T00:00:00Z" || newDoc["updated_at"] != "2020-01-01T01:00:00Z" {
+		t.Errorf("unexpected updated doc %+v", newDoc)
+	}
+	if _, err := json.Marshal(newDoc); err != nil {
+		t.Errorf("failed to encode doc: %v", err)
+	}
+
+	// No config for the collection
+	other := map[string]interface{}{}
+	dc.prepareInsert("other", other, created)
+	if len(other) != 0 {
+		t.Errorf("unexpected doc %+v", other)
+	}
+}
@@ -36,6 +36,7 @@ import (
 
 	"github.com/evanphx/json-patch"
 	"github.com/gorilla/mux"
+	lru "github.com/hashicorp/golang-lru"
 	log "github.com/inconshreveable/log15"
 	logext "github.com/inconshreveable/log15/ext"
 	"github.com/vmihailenco/msgpack"
@@ -51,7 +52,9 @@ import (
 	"a4.io/blobstash/pkg/perms"
 	"a4.io/blobstash/pkg/rangedb"
 	"a4.io/blobstash/pkg/stash/store"
+	"a4.io/blobstash/pkg/tenant"
 	"a4.io/blobstash/pkg/vkv"
+	"a4.io/blobstash/pkg/warmup"
 )
 
 // FIXME(tsileo): create a "meta" hook for handling indexing
@@ -111,6 +114,9 @@ const (
 
 	// Sharing TTL for the bewit link of Filetree references
 	shareDuration = 30 * time.Minute
+
+	// Name of the indexes rebuild warm-up task
+	warmupName = "docstore/indexes"
 )
 
 type executionStats struct {
@@ -133,16 +139,22 @@ type DocStore struct {
 	conf *config.Config
 
 	queryCache *rangedb.RangeDB
+	expiry     *rangedb.ExpirationIndex
+
+	compiledQueries *lru.Cache
+	luaStates       *luaStatePool
 
 	locker *locker
 
 	indexes map[string]map[string]Indexer
 
+	warmup *warmup.Warmup
+
 	logger log.Logger
 }
 
 // New initializes the `DocStoreExt`
-func New(logger log.Logger, conf *config.Config, kvStore store.KvStore, blobStore store.BlobStore, ft *filetree.FileTree) (*DocStore, error) {
+func New(logger log.Logger, conf *config.Config, kvStore store.KvStore, blobStore store.BlobStore, ft *filetree.FileTree, wu *warmup.Warmup, expiry *rangedb.ExpirationIndex) (*DocStore, error) {
 	logger.Debug("init")
 
 	sortIndexes := map[string]map[string]Indexer{}
@@ -176,6 +188,12 @@ func New(logger log.Logger, conf *config.Config, kvStore store.KvStore, blobStor
 		locker:     newLocker(),
 		logger:     logger,
 		indexes:    sortIndexes,
+		warmup:     wu,
+		expiry:     expiry,
+	}
+	expiry.Handle(expiryPrefix, dc.expireDoc)
+	if err := dc.setupQueryEngine(); err != nil {
+		return nil, err
 	}
 
 	// Finish the indexes setup
@@ -188,13 +206,19 @@ func New(logger log.Logger, conf *config.Config, kvStore store.KvStore, blobStor
 		if _, err := dc.GetSortIndex(col, "_updated"); err != nil {
 			return nil, fmt.Errorf("failed to build index %v/_updated: %w", col, err)
 		}
+	}
 
-		// Only rebuild if blostash is started with --docstore-indexes-reindex
-		if conf.DocstoreIndexesReindexMode {
-			if err := dc.RebuildIndexes(col); err != nil {
-				return nil, fmt.Errorf("failed to rebuild indexes for collection %v: %w", col, err)
+	// Only rebuild if blostash is started with --docstore-indexes-reindex (in the background, queries relying on
+	// a sort index will return a 503 until it's done)
+	if conf.DocstoreIndexesReindexMode {
+		wu.Go(warmupName, func() error {
+			for _, col := range collections {
+				if err := dc.RebuildIndexes(col); err != nil {
+					return fmt.Errorf("failed to rebuild indexes for collection %v: %w", col, err)
+				}
 			}
-		}
+			return nil
+		})
 	}
 
 	return dc, nil
@@ -202,6 +226,9 @@ func New(logger log.Logger, conf *config.Config, kvStore store.KvStore, blobStor
 
 // Close closes all the open DB files.
 func (docstore *DocStore) Close() error {
+	// Don't close the indexes while they're being rebuilt
+	docstore.warmup.Wait(warmupName)
+	docstore.luaStates.Close()
 	if err := docstore.queryCache.Close(); err != nil {
 		return err
 	}
@@ -268,13 +295,20 @@ func (docstore *DocStore) Register(r *mux.Router, basicAuth func(http.Handler) h
 	r.Handle("/{collection}/_rebuild_indexes", basicAuth(http.HandlerFunc(docstore.reindexDocsHandler()))) // FIXME Move this to _indexes with a DELETE ?
 	r.Handle("/{collection}/_map_reduce", basicAuth(http.HandlerFunc(docstore.mapReduceHandler())))
 	r.Handle("/{collection}/_indexes", basicAuth(http.HandlerFunc(docstore.indexesHandler())))
+	r.Handle("/{collection}/_count", basicAuth(http.HandlerFunc(docstore.countHandler())))
+	r.Handle("/{collection}/_distinct", basicAuth(http.HandlerFunc(docstore.distinctHandler())))
 	r.Handle("/{collection}/{_id}", basicAuth(http.HandlerFunc(docstore.docHandler())))
 	r.Handle("/{collection}/{_id}/_versions", basicAuth(http.HandlerFunc(docstore.docVersionsHandler())))
+	r.Handle("/{collection}/{_id}/_history", basicAuth(http.HandlerFunc(docstore.historyHandler())))
+	r.Handle("/{collection}/{_id}/_attachments", basicAuth(http.HandlerFunc(docstore.attachmentsHandler())))
 }
 
 func (docstore *DocStore) fetchPointersRec(v interface{}, pointers map[string]interface{}) error {
 	switch vv := v.(type) {
 	case map[string]interface{}:
+		if ref, ok := attachmentRef(vv); ok {
+			return docstore.fetchFiletreePointer(ref, pointers)
+		}
 		for _, value := range vv {
 			if err := docstore.fetchPointersRec(value, pointers); err != nil {
 				return err
@@ -306,36 +340,7 @@ func (docstore *DocStore) fetchPointersRec(v interface{}, pointers map[string]in
 			}
 			pointers[vv] = p
 		case strings.HasPrefix(vv, pointerFiletreeRef):
-			if _, ok := pointers[vv]; ok {
-				// The reference has already been fetched
-				return nil
-			}
-			// XXX(tsileo): here and at other place, add a util func in hashutil to detect invalid string length at least
-			hash := vv[len(pointerFiletreeRef):]
-			// TODO(tsileo): call filetree to get a node
-			// blob, err := docstore.blobStore.Get(context.TODO(), hash)
-			// if err != nil {
-			// 	return nil, fmt.Errorf("failed to fetch JSON ref: \"%v => %v\": %v", pointerFiletreeRef, v, err)
-			// }
-
-			// // Reconstruct the Meta
-			// var p map[string]interface{}
-			// if err := json.Unmarshal(blob, &p); err != nil {
-			// 	return nil, fmt.Errorf("failed to unmarshal meta  \"%v => %v\": %v", pointerBlobJSON, v, err)
-			// }
-			node, err := docstore.filetree.Node(context.TODO(), hash)
-			if err != nil {
-				return err
-			}
-
-			// Create a temporary authorization for the file (with a bewit)
-			u := &url.URL{Path: fmt.Sprintf("/%s/%s", node.Type[0:1], hash)}
-			if err := bewit.Bewit(docstore.filetree.SharingCred(), u, shareDuration); err != nil {
-				return fmt.Errorf("failed to generate bewit: %v", err)
-			}
-			node.URL = u.String()
-
-			pointers[vv] = node
+			return docstore.fetchFiletreePointer(vv[len(pointerFiletreeRef):], pointers)
 		}
 
 		return nil
@@ -344,6 +349,30 @@ func (docstore *DocStore) fetchPointersRec(v interface{}, pointers map[string]in
 	}
 }
 
+// fetchFiletreePointer fetches the node (with a temporary bewit URL) for the given ref
+func (docstore *DocStore) fetchFiletreePointer(hash string, pointers map[string]interface{}) error {
+	key := pointerFiletreeRef + hash
+	if _, ok := pointers[key]; ok {
+		// The reference has already been fetched
+		return nil
+	}
+	// XXX(tsileo): here and at other place, add a util func in hashutil to detect invalid string length at least
+	node, err := docstore.filetree.Node(context.TODO(), hash)
+	if err != nil {
+		return err
+	}
+
+	// Create a temporary authorization for the file (with a bewit)
+	u := &url.URL{Path: fmt.Sprintf("/%s/%s", node.Type[0:1], hash)}
+	if err := bewit.Bewit(docstore.filetree.SharingCred(), u, shareDuration); err != nil {
+		return fmt.Errorf("failed to generate bewit: %v", err)
+	}
+	node.URL = u.String()
+
+	pointers[key] = node
+	return nil
+}
+
 // Expand a doc keys (fetch the blob as JSON, or a filesystem reference)
 // e.g: {"ref": "@blobstash/json:<hash>"}
 //      => {"ref": {"blob": "json decoded"}}
@@ -438,7 +467,7 @@ func (docstore *DocStore) indexesHandler() func(http.ResponseWriter, *http.Reque
 			})
 			srw.Close()
 		default:
-			w.WriteHeader(http.StatusMethodNotAllowed)
+			httputil.WriteErrorStatus(w, http.StatusMethodNotAllowed)
 		}
 	}
 }
@@ -458,17 +487,24 @@ func (docstore *DocStore) collectionsHandler() func(http.ResponseWriter, *http.R
 				return
 			}
 
-			collections, err := docstore.Collections()
+			allCollections, err := docstore.Collections()
 			if err != nil {
 				panic(err)
 			}
+			// Only list the collections of the tenant
+			collections := []string{}
+			for _, c := range allCollections {
+				if name, ok := tenant.Strip(r, c); ok {
+					collections = append(collections, name)
+				}
+			}
 
 			httputil.MarshalAndWrite(r, w, map[string]interface{}{
 				"collections": collections,
 			})
 			return
 		default:
-			w.WriteHeader(http.StatusMethodNotAllowed)
+			httputil.WriteErrorStatus(w, http.StatusMethodNotAllowed)
 			return
 		}
 	}
@@ -497,13 +533,16 @@ func (docstore *DocStore) Insert(collection string, doc map[string]interface{})
 		}
 	}
 
+	// Set the configured defaults/timestamps
+	now := time.Now().UTC()
+	docstore.prepareInsert(collection, doc, now)
+
 	data, err := msgpack.Marshal(doc)
 	if err != nil {
 		return nil, err
 	}
 
 	// Build the ID and add some meta data
-	now := time.Now().UTC()
 	_id, err := id.New(now.UnixNano())
 	if err != nil {
 		return nil, err
@@ -589,6 +628,7 @@ func (docstore *DocStore) Update(collection, sid string, newDoc map[string]inter
 			delete(newDoc, k)
 		}
 	}
+	docstore.prepareUpdate(collection, doc, newDoc, time.Unix(0, _id.Ts()), time.Now())
 
 	data, err := msgpack.Marshal(newDoc)
 	if err != nil {
@@ -703,10 +743,14 @@ func (docstore *DocStore) query(L *lua.LState, collection string, query *query,
 		stats.Engine = "match_all"
 		qmatcher = &MatchAllEngine{}
 	default:
-		qmatcher, err = docstore.newLuaQueryEngine(L, query)
+		lqe, err := docstore.newLuaQueryEngine(query)
 		if err != nil {
 			return nil, nil, stats, err
 		}
+		if lqe.cached {
+			stats.NQueryCached++
+		}
+		qmatcher = lqe
 		stats.Engine = "lua"
 	}
 	defer qmatcher.Close()
@@ -876,7 +920,7 @@ func (docstore *DocStore) IndexDoc(collection string, _id *id.ID, doc map[string
 			}
 		}
 	}
-	return nil
+	return docstore.updateExpiry(collection, _id, doc)
 }
 
 // HTTP handler for the collection (handle listing+query+insert)
@@ -906,7 +950,7 @@ func (docstore *DocStore) reindexDocsHandler() func(http.ResponseWriter, *http.R
 
 			w.WriteHeader(http.StatusCreated)
 		default:
-			w.WriteHeader(http.StatusMethodNotAllowed)
+			httputil.WriteErrorStatus(w, http.StatusMethodNotAllowed)
 		}
 	}
 }
@@ -953,21 +997,81 @@ func (docstore *DocStore) docsHandler() func(http.ResponseWriter, *http.Request)
 				return
 			}
 
-			docs, pointers, stats, err := docstore.query(nil, collection, &query{
+			sortIndex := q.Get("sort_index")
+			var sorts []*sortField
+			if v := q.Get("sort"); v != "" {
+				if sortIndex != "" {
+					httputil.WriteJSONError(w, http.StatusBadRequest, "sort and sort_index cannot be used together")
+					return
+				}
+				if sorts, err = parseSort(v); err != nil {
+					httputil.WriteJSONError(w, http.StatusBadRequest, err.Error())
+					return
+				}
+				// Use a sort index if possible
+				sortIndex = docstore.sortIndexFor(collection, sorts)
+				if sortIndex != "" {
+					sorts = nil
+				}
+			}
+			fields := parseFields(q.Get("fields"))
+
+			// The sort indexes may still being rebuilt
+			if si := sortIndex; si != "" && si != "_id" && si != "-_id" && !docstore.warmup.IsReady(warmupName) {
+				warmup.NotReady(w, warmupName)
+				return
+			}
+
+			// The pointers are only fetched for the returned docs/fields, and never for a tenant (as they're resolved in
+			// the shared root namespace)
+			expandPointers := tenant.FromRequest(r) == ""
+			fetchPointers := len(sorts) == 0 && len(fields) == 0 && expandPointers
+			dq := &query{
 				script:     q.Get("script"),
 				basicQuery: q.Get("query"),
-				sortIndex:  q.Get("sort_index"),
-			}, cursor, limit, true, asOf)
+				sortIndex:  sortIndex,
+			}
+			var docs []map[string]interface{}
+			var pointers map[string]interface{}
+			var stats *executionStats
+			if len(sorts) > 0 {
+				docs, stats, err = docstore.sortedQuery(collection, dq, sorts, cursor, limit, asOf)
+			} else {
+				docs, pointers, stats, err = docstore.query(nil, collection, dq, cursor, limit, fetchPointers, asOf)
+			}
 			if err != nil {
 				if errors.Is(err, ErrSortIndexNotFound) {
-					docstore.logger.Error("sort index not found", "collection", collection, "sort_index", q.Get("sort_index"))
-					httputil.WriteJSONError(w, http.StatusUnprocessableEntity, fmt.Sprintf("The sort index %q does not exists", q.Get("sort_index")))
+					docstore.logger.Error("sort index not found", "collection", collection, "sort_index", sortIndex)
+					httputil.WriteJSONError(w, http.StatusUnprocessableEntity, fmt.Sprintf("The sort index %q does not exists", sortIndex))
+					return
+				}
+				switch err {
+				case ErrTooManyDocsToSort:
+					httputil.WriteJSONError(w, http.StatusUnprocessableEntity, err.Error())
+					return
+				case ErrInvalidSortCursor:
+					httputil.WriteJSONError(w, http.StatusBadRequest, err.Error())
 					return
 				}
 				docstore.logger.Error("query failed", "err", err)
 				httputil.Error(w, err)
 				return
 			}
+			if !fetchPointers {
+				pointers = map[string]interface{}{}
+				for i, doc := range docs {
+					if len(fields) > 0 {
+						doc = projectDoc(doc, fields)
+						docs[i] = doc
+					}
+					if !expandPointers {
+						continue
+					}
+					if err := docstore.fetchPointers(doc, pointers); err != nil {
+						panic(err)
+					}
+				}
+			}
 
 			// Set some meta headers to help the client build subsequent query
 			// (iterator/cursor handling)
@@ -1026,7 +1130,7 @@ func (docstore *DocStore) docsHandler() func(http.ResponseWriter, *http.Request)
 			doc := map[string]interface{}{}
 			if err := json.Unmarshal(blob, &doc); err != nil {
 				docstore.logger.Error("Failed to parse JSON input", "collection", collection, "err", err)
-				panic(httputil.NewPublicErrorFmt("Invalid JSON document"))
+				panic(httputil.NewError(http.StatusBadRequest, "Invalid JSON document"))
 			}
 
 			// Check for reserved keys
@@ -1041,7 +1145,7 @@ func (docstore *DocStore) docsHandler() func(http.ResponseWriter, *http.Request)
 			_id, err := docstore.Insert(collection, doc)
 			if err == ErrUnprocessableEntity {
 				// FIXME(tsileo): returns an object with field errors (set via the Lua API in the hook)
-				w.WriteHeader(http.StatusUnprocessableEntity)
+				httputil.WriteErrorStatus(w, http.StatusUnprocessableEntity)
 				return
 			}
 			if err != nil {
@@ -1065,7 +1169,7 @@ func (docstore *DocStore) docsHandler() func(http.ResponseWriter, *http.Request)
 				httputil.WithStatusCode(http.StatusCreated))
 			return
 		default:
-			w.WriteHeader(http.StatusMethodNotAllowed)
+			httputil.WriteErrorStatus(w, http.StatusMethodNotAllowed)
 			return
 		}
 	}
@@ -1103,7 +1207,7 @@ func (docstore *DocStore) mapReduceHandler() func(http.ResponseWriter, *http.Req
 
 			input := &mapReduceInput{}
 			if err := json.NewDecoder(r.Body).Decode(input); err != nil {
-				panic(httputil.NewPublicErrorFmt("Invalid JSON input"))
+				panic(httputil.NewError(http.StatusBadRequest, "Invalid JSON input"))
 			}
 
 			var asOf int64
@@ -1120,6 +1224,7 @@ func (docstore *DocStore) mapReduceHandler() func(http.ResponseWriter, *http.Req
 
 			rootMre := NewMapReduceEngine()
 			defer rootMre.Close()
+			rootMre.Setup(docstore.setupLuaDocStore)
 			if err := rootMre.SetupReduce(input.Reduce); err != nil {
 				panic(err)
 			}
@@ -1251,7 +1356,7 @@ func (docstore *DocStore) mapReduceHandler() func(http.ResponseWriter, *http.Req
 				"data": result,
 			})
 		default:
-			w.WriteHeader(http.StatusMethodNotAllowed)
+			httputil.WriteErrorStatus(w, http.StatusMethodNotAllowed)
 			return
 		}
 	}
@@ -1389,16 +1494,37 @@ func (docstore *DocStore) docHandler() func(http.ResponseWriter, *http.Request)
 			// js := []byte{}
 			var doc, pointers map[string]interface{}
 
-			// FIXME(tsileo): support asOf?
+			// Select the version current at `as_of` (if requested)
+			asOf, err := parseAsOf(httputil.NewQuery(r.URL.Query()))
+			if err != nil {
+				httputil.WriteJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			version := int64(-1)
+			if asOf > 0 {
+				version, err = docstore.VersionAt(collection, sid, asOf)
+				if err != nil {
+					if err == vkv.ErrNotFound {
+						// The document didn't exist yet
+						httputil.WriteErrorStatus(w, http.StatusNotFound)
+						return
+					}
+					panic(err)
+				}
+			}
 
-			if _id, pointers, err = docstore.Fetch(collection, sid, &doc, true, true, -1); err != nil {
+			if _id, pointers, err = docstore.Fetch(collection, sid, &doc, true, tenant.FromRequest(r) == "", version); err != nil {
 				if err == vkv.ErrNotFound || _id.Flag() == flagDeleted {
 					// Document doesn't exist, returns a status 404
-					w.WriteHeader(http.StatusNotFound)
+					httputil.WriteErrorStatus(w, http.StatusNotFound)
 					return
 				}
 				panic(err)
 			}
+			if _id.Flag() == flagDeleted {
+				httputil.WriteErrorStatus(w, http.StatusNotFound)
+				return
+			}
 
 			// FIXME(tsileo): fix-precondition, suport If-Match
 			if etag := r.Header.Get("If-None-Match"); etag != "" {
@@ -1441,7 +1567,7 @@ func (docstore *DocStore) docHandler() func(http.ResponseWriter, *http.Request)
 			if _id, _, err = docstore.Fetch(collection, sid, &doc, false, false, -1); err != nil {
 				if err == vkv.ErrNotFound {
 					// Document doesn't exist, returns a status 404
-					w.WriteHeader(http.StatusNotFound)
+					httputil.WriteErrorStatus(w, http.StatusNotFound)
 					return
 				}
 				panic(err)
@@ -1455,7 +1581,7 @@ func (docstore *DocStore) docHandler() func(http.ResponseWriter, *http.Request)
 			// FIXME(tsileo): make it required?
 			if etag := r.Header.Get("If-Match"); etag != "" {
 				if etag != _id.VersionString() {
-					w.WriteHeader(http.StatusPreconditionFailed)
+					httputil.WriteErrorStatus(w, http.StatusPreconditionFailed)
 					return
 				}
 			}
@@ -1481,6 +1607,7 @@ func (docstore *DocStore) docHandler() func(http.ResponseWriter, *http.Request)
 			if err := json.Unmarshal(pdata, &ndoc); err != nil {
 				panic(err)
 			}
+			docstore.prepareUpdate(collection, doc, ndoc, time.Unix(0, _id.Ts()), time.Now())
 			data, err := msgpack.Marshal(ndoc)
 			if err != nil {
 				panic(err)
@@ -1535,10 +1662,10 @@ func (docstore *DocStore) docHandler() func(http.ResponseWriter, *http.Request)
 			switch err {
 			case nil:
 			case ErrDocNotFound:
-				w.WriteHeader(http.StatusNotFound)
+				httputil.WriteErrorStatus(w, http.StatusNotFound)
 				return
 			case ErrPreconditionFailed:
-				w.WriteHeader(http.StatusPreconditionFailed)
+				httputil.WriteErrorStatus(w, http.StatusPreconditionFailed)
 				return
 			default:
 				panic(err)
@@ -1571,7 +1698,7 @@ func (docstore *DocStore) docHandler() func(http.ResponseWriter, *http.Request)
 			case nil:
 				w.WriteHeader(http.StatusNoContent)
 			case ErrDocNotFound:
-				w.WriteHeader(http.StatusNotFound)
+				httputil.WriteErrorStatus(w, http.StatusNotFound)
 			default:
 				panic(err)
 			}
@@ -1623,11 +1750,11 @@ func (docstore *DocStore) docVersionsHandler() func(http.ResponseWriter, *http.R
 				return
 			}
 
-			docs, pointers, cursor, err := docstore.FetchVersions(collection, sid, cursor, limit, fetchPointers)
+			docs, pointers, cursor, err := docstore.FetchVersions(collection, sid, cursor, limit, fetchPointers && tenant.FromRequest(r) == "")
 			if err != nil {
 				if err == vkv.ErrNotFound || _id.Flag() == flagDeleted {
 					// Document doesn't exist, returns a status 404
-					w.WriteHeader(http.StatusNotFound)
+					httputil.WriteErrorStatus(w, http.StatusNotFound)
 					return
 				}
 				panic(err)
@@ -1646,7 +1773,7 @@ func (docstore *DocStore) docVersionsHandler() func(http.ResponseWriter, *http.R
 				})
 			}
 		default:
-			w.WriteHeader(http.StatusMethodNotAllowed)
+			httputil.WriteErrorStatus(w, http.StatusMethodNotAllowed)
 			return
 		}
 	}
@@ -0,0 +1,114 @@
+package docstore // import "a4.io/blobstash/pkg/docstore"
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/perms"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+// HistoryEntry holds a single version of a document
+type HistoryEntry struct {
+	Version int64  `json:"version"`
+	Updated string `json:"_updated"`
+	Ref     string `json:"ref"` // meta blob of the version
+	Deleted bool   `json:"deleted,omitempty"`
+}
+
+// VersionAt returns the version of the document that was current at `asOf` (unix nano timestamp)
+func (docstore *DocStore) VersionAt(collection, sid string, asOf int64) (int64, error) {
+	kvv, _, err := docstore.kvStore.Versions(context.TODO(), fmt.Sprintf(keyFmt, collection, sid), strconv.FormatInt(asOf, 10), 1)
+	if err != nil {
+		return 0, err
+	}
+	return kvv.Versions[0].Version, nil
+}
+
+// History returns the versions of the document (most recent first), starting at the `start` version
+func (docstore *DocStore) History(collection, sid string, start int64, limit int) ([]*HistoryEntry, int64, error) {
+	ctx := context.TODO()
+	key := fmt.Sprintf(keyFmt, collection, sid)
+	kvv, _, err := docstore.kvStore.Versions(ctx, key, strconv.FormatInt(start, 10), limit)
+	if err != nil {
+		return nil, 0, err
+	}
+	var cursor int64
+	out := []*HistoryEntry{}
+	for _, kv := range kvv.Versions {
+		ref, err := docstore.kvStore.GetMetaBlob(ctx, key, kv.Version)
+		if err != nil {
+			return nil, 0, err
+		}
+		out = append(out, &HistoryEntry{
+			Version: kv.Version,
+			Updated: time.Unix(0, kv.Version).UTC().Format(time.RFC3339),
+			Ref:     ref,
+			Deleted: len(kv.Data) > 0 && kv.Data[0] == flagDeleted,
+		})
+		cursor = kv.Version - 1
+	}
+	return out, cursor, nil
+}
+
+// historyHandler lists the versions of a document (the version can be passed to `?as_of_nano=`)
+func (docstore *DocStore) historyHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			httputil.WriteErrorStatus(w, http.StatusMethodNotAllowed)
+			return
+		}
+		vars := mux.Vars(r)
+		collection := vars["collection"]
+		sid := vars["_id"]
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Read, perms.JSONCollection),
+			perms.ResourceWithID(perms.DocStore, perms.JSONCollection, collection),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+
+		q := httputil.NewQuery(r.URL.Query())
+		limit, err := q.GetIntDefault("limit", 50)
+		if err != nil {
+			httputil.Error(w, err)
+			return
+		}
+		cursor, err := q.GetInt64Default("cursor", time.Now().UnixNano())
+		if err != nil {
+			httputil.Error(w, err)
+			return
+		}
+
+		history, cursor, err := docstore.History(collection, sid, cursor, limit)
+		if err != nil {
+			if err == vkv.ErrNotFound {
+				httputil.WriteErrorStatus(w, http.StatusNotFound)
+				return
+			}
+			panic(err)
+		}
+
+		if r.Method == "GET" {
+			httputil.MarshalAndWrite(r, w, map[string]interface{}{
+				"data": history,
+				"pagination": map[string]interface{}{
+					"cursor":   cursor,
+					"has_more": len(history) == limit,
+					"count":    len(history),
+					"per_page": limit,
+				},
+			})
+		}
+	}
+}
@@ -17,8 +17,6 @@ import (
 
 	luautil "a4.io/blobstash/pkg/apps/luautil"
 	"a4.io/blobstash/pkg/docstore/textsearch"
-	"a4.io/blobstash/pkg/luascripts"
-	"a4.io/gluarequire2"
 )
 
 var closedError = errors.New("map reduce engine closed")
@@ -111,6 +109,9 @@ type MapReduceEngine struct {
 
 	mapCode, reduceCode string
 
+	// Optional setup (like extra globals) re-applied to the duplicated engines
+	setup func(*lua.LState)
+
 	reduced bool
 
 	emitted map[string][]map[string]interface{}
@@ -251,6 +252,9 @@ func (mre *MapReduceEngine) Duplicate() (*MapReduceEngine, error) {
 	if mre.mapCode == "" || mre.reduceCode == "" {
 		return nil, fmt.Errorf("a map reduce engine must be configured before duplication: %+v", mre)
 	}
+	if mre.setup != nil {
+		n.Setup(mre.setup)
+	}
 	if err := n.SetupMap(mre.mapCode); err != nil {
 		return nil, err
 	}
@@ -260,6 +264,13 @@ func (mre *MapReduceEngine) Duplicate() (*MapReduceEngine, error) {
 	return n, nil
 }
 
+// Setup calls `setup` with the engine Lua state (must be called before `SetupMap`/`SetupReduce`), it will also be
+// called for the duplicated engines
+func (mre *MapReduceEngine) Setup(setup func(*lua.LState)) {
+	mre.setup = setup
+	setup(mre.L)
+}
+
 func NewMapReduceEngine() *MapReduceEngine {
 	state := lua.NewState()
 	mre := &MapReduceEngine{
@@ -301,13 +312,15 @@ type LuaQueryEngine struct {
 	q     lua.LValue
 
 	matchFunc func(map[string]interface{}) (bool, error)
-	L         *lua.LState // Lua state that will live the whole query
+	L         *lua.LState // Lua state that will live the whole query (borrowed from the pool)
+	pool      *luaStatePool
+	cached    bool // true if the compiled script was cached
 
 	logger log.Logger
 }
 
 func (lqe *LuaQueryEngine) Close() error {
-	lqe.L.Close()
+	lqe.pool.Put(lqe.L)
 	return nil
 }
 
@@ -344,60 +357,55 @@ func (docstore *DocStore) LuaTextSearch(L *lua.LState) int {
 	return 1
 }
 
-func (docstore *DocStore) newLuaQueryEngine(L *lua.LState, query *query) (*LuaQueryEngine, error) {
-	if L == nil {
-		L = lua.NewState()
-	}
+func (docstore *DocStore) newLuaQueryEngine(query *query) (*LuaQueryEngine, error) {
 	engine := &LuaQueryEngine{
 		code:   queryToScript(query),
 		lfunc:  query.lfunc,
-		L:      lua.NewState(),
+		L:      docstore.luaStates.Get(),
+		pool:   docstore.luaStates,
 		q:      lua.LNil,
 		logger: docstore.logger.New("submodule", "lua_query_engine"),
 	}
-	fmt.Printf("code=\n\n%s\n\n", engine.code)
-	gluarequire2.NewRequire2Module(gluarequire2.NewRequireFromGitHub(nil)).SetGlobal(engine.L)
-	SetLuaGlobals(engine.L)
-	L.SetGlobal("text_search", L.NewFunction(docstore.LuaTextSearch))
-	if err := engine.L.DoString(luascripts.Get("docstore_query.lua")); err != nil {
-		panic(err)
-	}
 	engine.logger.Debug("init", "query", engine.query)
-	// Parse the Lua query, which should be defined as a `function(doc) -> bool`, we parse it only once, then we got
-	// a "Lua func" Go object which we can call repeatedly for each document.
-	// XXX(tsileo): keep the function (along with the Lua context `L` for a few minutes) in a cache, so if a client is paginating
-	// through results, it will reuse the func/Lua context. (Cache[hash(script)] = FuncWithContextReadyToCall)
-	var ret *lua.LFunction
-	if engine.lfunc != nil {
-		ret = engine.lfunc
-	}
+	// Parse the Lua query, which should be defined as a `function(doc) -> bool`, the script is only compiled once (and
+	// cached by hash), then we got a "Lua func" Go object which we can call repeatedly for each document.
+	ret := engine.lfunc
 	if ret == nil {
 		// XXX(tsileo): queryToString converted the basic function to a script retunring a function
-		if err := engine.L.DoString(engine.code); err != nil {
+		proto, cached, err := docstore.compileQuery(engine.code)
+		if err != nil {
+			engine.Close()
 			return nil, err
 		}
-		ret = engine.L.Get(-1).(*lua.LFunction)
-	}
-	if ret != nil {
-		fmt.Printf("extracted fun %v\n", ret)
-		matchDoc := func(doc map[string]interface{}) (bool, error) {
-			if err := engine.L.CallByParam(lua.P{
-				Fn:      ret,
-				NRet:    1,
-				Protect: true,
-			}, luautil.InterfaceToLValue(engine.L, doc)); err != nil {
-				fmt.Printf("failed to call match func: %+v %+v\n", doc, err)
-				return false, err // FIXME(tsileo): a way to switch the return error/don't return error?
-			}
-			ret := engine.L.Get(-1)
-			engine.L.Pop(1)
-			if ret == lua.LTrue {
-				return true, nil
-			}
-			return false, nil
+		engine.cached = cached
+		engine.L.Push(engine.L.NewFunctionFromProto(proto))
+		if err := engine.L.PCall(0, 1, nil); err != nil {
+			engine.Close()
+			return nil, err
 		}
-
-		engine.matchFunc = matchDoc
+		fn, ok := engine.L.Get(-1).(*lua.LFunction)
+		engine.L.Pop(1)
+		if !ok {
+			engine.Close()
+			return nil, errors.New("the query script must return a function")
+		}
+		ret = fn
+	}
+	engine.matchFunc = func(doc map[string]interface{}) (bool, error) {
+		if err := engine.L.CallByParam(lua.P{
+			Fn:      ret,
+			NRet:    1,
+			Protect: true,
+		}, luautil.InterfaceToLValue(engine.L, doc)); err != nil {
+			engine.logger.Debug("failed to call match func", "err", err)
+			return false, err // FIXME(tsileo): a way to switch the return error/don't return error?
+		}
+		ret := engine.L.Get(-1)
+		engine.L.Pop(1)
+		if ret == lua.LTrue {
+			return true, nil
+		}
+		return false, nil
 	}
 	return engine, nil
 }
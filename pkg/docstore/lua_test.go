@@ -1,7 +1,10 @@
 package docstore
 
 import (
+	"fmt"
 	"testing"
+
+	log "github.com/inconshreveable/log15"
 )
 
 func TestLuaMapReduce(t *testing.T) {
@@ -93,3 +96,81 @@ func TestLuaMapReduce(t *testing.T) {
 		t.Errorf("expected 9, got %d\n", result3["data"]["count"])
 	}
 }
+
+func newTestQueryDocStore() *DocStore {
+	dc := &DocStore{logger: log.New()}
+	dc.logger.SetHandler(log.DiscardHandler())
+	if err := dc.setupQueryEngine(); err != nil {
+		panic(err)
+	}
+	return dc
+}
+
+func TestLuaQueryEngineCache(t *testing.T) {
+	dc := newTestQueryDocStore()
+	defer dc.luaStates.Close()
+
+	q := &query{basicQuery: "doc.count > 1"}
+	for i := 0; i < 2; i++ {
+		lqe, err := dc.newLuaQueryEngine(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lqe.cached != (i > 0) {
+			t.Errorf("run #%d: unexpected cached status %v", i, lqe.cached)
+		}
+		ok, err := lqe.Match(map[string]interface{}{"count": 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Errorf("doc should match")
+		}
+		ok, err = lqe.Match(map[string]interface{}{"count": 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok {
+			t.Errorf("doc should not match")
+		}
+		lqe.Close()
+	}
+	if n := len(dc.luaStates.states); n != 1 {
+		t.Errorf("expected 1 pooled state, got %d", n)
+	}
+
+	if _, err := dc.newLuaQueryEngine(&query{script: "return 1"}); err == nil {
+		t.Errorf("a script that does not return a function should fail")
+	}
+}
+
+func benchmarkLuaQuery(b *testing.B, dc *DocStore, script func(int) string) {
+	doc := map[string]interface{}{"count": 2, "title": "hello"}
+	for i := 0; i < b.N; i++ {
+		lqe, err := dc.newLuaQueryEngine(&query{basicQuery: script(i)})
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := lqe.Match(doc); err != nil {
+			b.Fatal(err)
+		}
+		lqe.Close()
+	}
+}
+
+func BenchmarkLuaQueryCached(b *testing.B) {
+	dc := newTestQueryDocStore()
+	defer dc.luaStates.Close()
+	benchmarkLuaQuery(b, dc, func(_ int) string {
+		return "doc.count > 1 and doc.title == 'hello'"
+	})
+}
+
+func BenchmarkLuaQueryUncached(b *testing.B) {
+	dc := newTestQueryDocStore()
+	benchmarkLuaQuery(b, dc, func(i int) string {
+		// A new Lua state and a new script for every query
+		dc.luaStates.Close()
+		return fmt.Sprintf("doc.count > %d and doc.title == 'hello'", i)
+	})
+}
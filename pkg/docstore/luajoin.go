@@ -0,0 +1,45 @@
+package docstore
+
+import (
+	"github.com/yuin/gopher-lua"
+
+	luautil "a4.io/blobstash/pkg/apps/luautil"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+// setupLuaDocStore sets the `docstore` global for the query/map reduce scripts, it allows to dereference a foreign
+// key (i.e. simple joins):
+//
+//	return function(doc)
+//	  local author = docstore.get('authors', doc.author_id)
+//	  return author ~= nil and author.verified
+//	end
+//
+// `docstore.get(collection, id)` returns the document (with the special fields) or nil if it does not exist.
+func (docstore *DocStore) setupLuaDocStore(L *lua.LState) {
+	mod := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"get": docstore.luaGet,
+	})
+	L.SetGlobal("docstore", mod)
+}
+
+func (docstore *DocStore) luaGet(L *lua.LState) int {
+	collection := L.CheckString(1)
+	sid := L.CheckString(2)
+	doc := map[string]interface{}{}
+	_id, _, err := docstore.Fetch(collection, sid, &doc, true, false, -1)
+	if err != nil {
+		if err == vkv.ErrNotFound {
+			L.Push(lua.LNil)
+			return 1
+		}
+		L.RaiseError("failed to fetch %s/%s: %v", collection, sid, err)
+		return 0
+	}
+	if _id.Flag() == flagDeleted {
+		L.Push(lua.LNil)
+		return 1
+	}
+	L.Push(luautil.InterfaceToLValue(L, doc))
+	return 1
+}
@@ -0,0 +1,114 @@
+package docstore
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+	"golang.org/x/crypto/blake2b"
+
+	"a4.io/blobstash/pkg/luascripts"
+	"a4.io/gluarequire2"
+)
+
+const (
+	// Number of compiled query scripts kept in memory
+	compiledQueriesCacheSize = 512
+
+	// Max number of idle Lua states kept for the queries
+	maxPooledStates = 32
+)
+
+// luaStatePool keeps the initialized Lua states (with the docstore query helpers loaded) across queries
+type luaStatePool struct {
+	mu       sync.Mutex
+	states   []*lua.LState
+	newState func() *lua.LState
+}
+
+func newLuaStatePool(newState func() *lua.LState) *luaStatePool {
+	return &luaStatePool{
+		states:   []*lua.LState{},
+		newState: newState,
+	}
+}
+
+// Get returns an idle state (or a new one)
+func (p *luaStatePool) Get() *lua.LState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := len(p.states)
+	if n == 0 {
+		return p.newState()
+	}
+	L := p.states[n-1]
+	p.states = p.states[:n-1]
+	return L
+}
+
+// Put puts back the state in the pool
+func (p *luaStatePool) Put(L *lua.LState) {
+	L.SetTop(0)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.states) >= maxPooledStates {
+		L.Close()
+		return
+	}
+	p.states = append(p.states, L)
+}
+
+// Close closes all the idle states
+func (p *luaStatePool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, L := range p.states {
+		L.Close()
+	}
+	p.states = nil
+}
+
+// newQueryState initializes a Lua state for running the query scripts
+func (docstore *DocStore) newQueryState() *lua.LState {
+	L := lua.NewState()
+	gluarequire2.NewRequire2Module(gluarequire2.NewRequireFromGitHub(nil)).SetGlobal(L)
+	SetLuaGlobals(L)
+	L.SetGlobal("text_search", L.NewFunction(docstore.LuaTextSearch))
+	docstore.setupLuaDocStore(L)
+	if err := L.DoString(luascripts.Get("docstore_query.lua")); err != nil {
+		panic(err)
+	}
+	return L
+}
+
+// compileQuery returns the compiled query script (cached by script hash), and true if it was already cached
+func (docstore *DocStore) compileQuery(code string) (*lua.FunctionProto, bool, error) {
+	key := fmt.Sprintf("%x", blake2b.Sum256([]byte(code)))
+	if cached, ok := docstore.compiledQueries.Get(key); ok {
+		return cached.(*lua.FunctionProto), true, nil
+	}
+	chunk, err := parse.Parse(strings.NewReader(code), "<query>")
+	if err != nil {
+		return nil, false, err
+	}
+	proto, err := lua.Compile(chunk, "<query>")
+	if err != nil {
+		return nil, false, err
+	}
+	docstore.compiledQueries.Add(key, proto)
+	return proto, false, nil
+}
+
+// setupQueryEngine initializes the compiled queries cache and the Lua states pool
+func (docstore *DocStore) setupQueryEngine() error {
+	compiledQueries, err := lru.New(compiledQueriesCacheSize)
+	if err != nil {
+		return err
+	}
+	docstore.compiledQueries = compiledQueries
+	docstore.luaStates = newLuaStatePool(docstore.newQueryState)
+	return nil
+}
@@ -0,0 +1,246 @@
+package docstore // import "a4.io/blobstash/pkg/docstore"
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"a4.io/blobstash/pkg/docstore/maputil"
+)
+
+// Sort and projection
+//
+// The `sort` query arg is a list of fields (ES-style: `field:asc,other:desc`, a `-field` prefix is also supported).
+// A single field sort is served by a sort index (`_id`/`_created` and `_updated` are always available), otherwise
+// the matching documents are sorted in memory (up to `maxSortedDocs`) and the cursor becomes an offset.
+//
+// The `fields` query arg is a list of "dot notation" paths, only these fields (and the special fields) are returned.
+
+// maxSortedDocs is the max number of matching documents that can be sorted in memory
+const maxSortedDocs = 10000
+
+// ErrTooManyDocsToSort is returned when a query without a sort index matches more than `maxSortedDocs` documents
+var ErrTooManyDocsToSort = fmt.Errorf("too many documents to sort without a sort index (max %d)", maxSortedDocs)
+
+// ErrInvalidSortCursor is returned when the cursor of an in-memory sorted query is not a valid offset
+var ErrInvalidSortCursor = errors.New("invalid cursor")
+
+// sortField is a single sort criteria
+type sortField struct {
+	field string
+	desc  bool
+}
+
+func (sf *sortField) String() string {
+	if sf.desc {
+		return "-" + sf.field
+	}
+	return sf.field
+}
+
+// parseSort parses the `sort` query arg
+func parseSort(s string) ([]*sortField, error) {
+	out := []*sortField{}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		sf := &sortField{field: part}
+		if strings.HasPrefix(part, "-") {
+			sf.field = part[1:]
+			sf.desc = true
+		} else if i := strings.LastIndex(part, ":"); i != -1 {
+			sf.field = part[:i]
+			switch strings.ToLower(part[i+1:]) {
+			case "asc":
+			case "desc":
+				sf.desc = true
+			default:
+				return nil, fmt.Errorf("invalid sort order %q", part[i+1:])
+			}
+		}
+		if sf.field == "" {
+			return nil, errors.New("invalid sort field")
+		}
+		if sf.field == "_created" {
+			// The IDs are sorted by creation time
+			sf.field = "_id"
+		}
+		out = append(out, sf)
+	}
+	return out, nil
+}
+
+// sortIndexFor returns the sort index that can serve the sort (or an empty string if the docs must be sorted in
+// memory)
+func (docstore *DocStore) sortIndexFor(collection string, sorts []*sortField) string {
+	if len(sorts) != 1 {
+		return ""
+	}
+	if sorts[0].field != "_id" {
+		if _, err := docstore.GetSortIndex(collection, sorts[0].field); err != nil {
+			return ""
+		}
+	}
+	return sorts[0].String()
+}
+
+// typeRank orders the values of different types (missing < null < bool < number < string)
+func typeRank(v interface{}) int {
+	switch v.(type) {
+	case nil:
+		return 1
+	case bool:
+		return 2
+	case int, int8, int16, int32, int64, uint8, uint16, uint32, uint64, float32, float64:
+		return 3
+	case string, fmt.Stringer:
+		return 4
+	default:
+		return 5
+	}
+}
+
+func toFloat64(v interface{}) float64 {
+	f, _ := strconv.ParseFloat(fmt.Sprintf("%v", v), 64)
+	return f
+}
+
+// compareValues returns -1, 0 or 1
+func compareValues(a, b interface{}) int {
+	ra, rb := typeRank(a), typeRank(b)
+	if ra != rb {
+		if ra < rb {
+			return -1
+		}
+		return 1
+	}
+	switch ra {
+	case 2:
+		ba, bb := a.(bool), b.(bool)
+		switch {
+		case ba == bb:
+			return 0
+		case !ba:
+			return -1
+		default:
+			return 1
+		}
+	case 3:
+		fa, fb := toFloat64(a), toFloat64(b)
+		switch {
+		case fa < fb:
+			return -1
+		case fa > fb:
+			return 1
+		}
+		return 0
+	case 4:
+		return strings.Compare(fmt.Sprintf("%v", a), fmt.Sprintf("%v", b))
+	}
+	return 0
+}
+
+// sortDocs sorts the docs in place (the missing fields are sorted first)
+func sortDocs(docs []map[string]interface{}, sorts []*sortField) {
+	sort.SliceStable(docs, func(i, j int) bool {
+		for _, sf := range sorts {
+			va, erra := maputil.GetPath(docs[i], sf.field)
+			vb, errb := maputil.GetPath(docs[j], sf.field)
+			var c int
+			switch {
+			case erra != nil && errb != nil:
+			case erra != nil:
+				c = -1
+			case errb != nil:
+				c = 1
+			default:
+				c = compareValues(va, vb)
+			}
+			if sf.desc {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+}
+
+// parseFields parses the `fields` query arg
+func parseFields(s string) []string {
+	var out []string
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// projectDoc returns a copy of the doc containing only the given fields (and the special fields)
+func projectDoc(doc map[string]interface{}, fields []string) map[string]interface{} {
+	out := map[string]interface{}{}
+	for k := range reservedKeys {
+		if v, ok := doc[k]; ok {
+			out[k] = v
+		}
+	}
+	for _, field := range fields {
+		v, err := maputil.GetPath(doc, field)
+		if err != nil {
+			continue
+		}
+		// Re-build the nested maps for the "dot notation" paths
+		keys := strings.Split(field, ".")
+		cur := out
+		for _, k := range keys[:len(keys)-1] {
+			next, ok := cur[k].(map[string]interface{})
+			if !ok {
+				next = map[string]interface{}{}
+				cur[k] = next
+			}
+			cur = next
+		}
+		cur[keys[len(keys)-1]] = v
+	}
+	return out
+}
+
+// sortedQuery runs the query and sorts all the matching documents in memory, the cursor is an offset
+func (docstore *DocStore) sortedQuery(collection string, query *query, sorts []*sortField, cursor string, limit int, asOf int64) ([]map[string]interface{}, *executionStats, error) {
+	var offset int
+	if cursor != "" {
+		var err error
+		offset, err = strconv.Atoi(cursor)
+		if err != nil || offset < 0 {
+			return nil, nil, ErrInvalidSortCursor
+		}
+	}
+	query.sortIndex = ""
+	docs, _, stats, err := docstore.query(nil, collection, query, "", maxSortedDocs+1, false, asOf)
+	if err != nil {
+		return nil, stats, err
+	}
+	if len(docs) > maxSortedDocs {
+		return nil, stats, ErrTooManyDocsToSort
+	}
+	sortDocs(docs, sorts)
+
+	stats.Index = "in_memory_sort"
+	if offset > len(docs) {
+		offset = len(docs)
+	}
+	end := offset + limit
+	if end > len(docs) {
+		end = len(docs)
+	}
+	docs = docs[offset:end]
+	stats.NReturned = len(docs)
+	stats.Cursor = strconv.Itoa(end)
+	return docs, stats, nil
+}
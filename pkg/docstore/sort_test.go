@@ -0,0 +1,69 @@
+package docstore
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSort(t *testing.T) {
+	sorts, err := parseSort("a.b:desc, -c,d:asc,_created")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []string
+	for _, sf := range sorts {
+		out = append(out, sf.String())
+	}
+	if !reflect.DeepEqual(out, []string{"-a.b", "-c", "d", "_id"}) {
+		t.Errorf("unexpected sort %q", out)
+	}
+	for _, invalid := range []string{"a:up", "-", ":desc"} {
+		if _, err := parseSort(invalid); err == nil {
+			t.Errorf("%q should be invalid", invalid)
+		}
+	}
+}
+
+func TestSortDocs(t *testing.T) {
+	docs := []map[string]interface{}{
+		{"n": 1, "s": "b"},
+		{"n": 2.5, "s": "a"},
+		{"s": "c"},
+		{"n": int64(1), "s": "a"},
+		{"n": "x", "s": "a"},
+	}
+	sorts, err := parseSort("n,s:desc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sortDocs(docs, sorts)
+	var out []string
+	for _, doc := range docs {
+		out = append(out, doc["s"].(string))
+	}
+	// missing < number < string
+	if !reflect.DeepEqual(out, []string{"c", "b", "a", "a", "a"}) {
+		t.Errorf("unexpected order %q", out)
+	}
+	if docs[3]["n"] != 2.5 || docs[4]["n"] != "x" {
+		t.Errorf("unexpected order %+v", docs)
+	}
+}
+
+func TestProjectDoc(t *testing.T) {
+	doc := map[string]interface{}{
+		"_id":   "abc",
+		"title": "hello",
+		"body":  "world",
+		"meta":  map[string]interface{}{"a": 1, "b": 2},
+	}
+	out := projectDoc(doc, []string{"title", "meta.b", "missing"})
+	expected := map[string]interface{}{
+		"_id":   "abc",
+		"title": "hello",
+		"meta":  map[string]interface{}{"b": 2},
+	}
+	if !reflect.DeepEqual(out, expected) {
+		t.Errorf("got %+v, expected %+v", out, expected)
+	}
+}
@@ -0,0 +1,40 @@
+package docstore // import "a4.io/blobstash/pkg/docstore"
+
+import (
+	"strings"
+	"time"
+
+	"a4.io/blobstash/pkg/docstore/id"
+)
+
+// Prefix of the docs keys in the expiration index
+const expiryPrefix = "docstore:"
+
+func expiryKey(collection string, _id *id.ID) string {
+	return expiryPrefix + collection + "\x00" + _id.String()
+}
+
+// updateExpiry schedules the removal of the doc if the collection has a TTL (relative to the doc version)
+func (docstore *DocStore) updateExpiry(collection string, _id *id.ID, doc map[string]interface{}) error {
+	if docstore.expiry == nil {
+		return nil
+	}
+	conf := docstore.collectionConfig(collection)
+	if doc == nil || conf == nil || conf.TTLDuration() == 0 {
+		return docstore.expiry.Remove(expiryKey(collection, _id))
+	}
+	return docstore.expiry.Set(expiryKey(collection, _id), time.Unix(0, _id.Version()).Add(conf.TTLDuration()))
+}
+
+// expireDoc is called by the expiration index when a doc TTL expires
+func (docstore *DocStore) expireDoc(key string) error {
+	parts := strings.SplitN(strings.TrimPrefix(key, expiryPrefix), "\x00", 2)
+	if len(parts) != 2 {
+		return nil
+	}
+	docstore.logger.Debug("doc expired", "collection", parts[0], "_id", parts[1])
+	if _, err := docstore.Remove(parts[0], parts[1]); err != nil && err != ErrDocNotFound {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package extra // import "a4.io/blobstash/pkg/extra"
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+	"golang.org/x/crypto/blake2b"
+
+	"a4.io/blobstash/pkg/httputil/bewit"
+)
+
+// AppCred returns the bewit credential of an app, the key is derived from the sharing key so the apps can't sign
+// links for the other apps (or for the filetree)
+func AppCred(sharingKey, app string) *bewit.Cred {
+	mac := hmac.New(sha256.New, []byte(sharingKey))
+	mac.Write([]byte("apps:" + app))
+	return &bewit.Cred{
+		ID:  "app-" + app,
+		Key: mac.Sum(nil),
+	}
+}
+
+// SetupCrypto registers the `crypto` module:
+//
+//	local crypto = require('crypto')
+//	crypto.sha256(data)               -- hex encoded digests
+//	crypto.blake2b(data)
+//	crypto.hmac_sha256(key, data)
+//	crypto.compare(a, b)              -- constant-time comparison
+//	crypto.random_token(size)         -- URL-safe random token (32 bytes by default)
+//	crypto.sign_url(url, ttl)         -- bewit signed URL (TTL in seconds)
+//	crypto.check_url(url)             -- true, or false and the error message
+func SetupCrypto(L *lua.LState, cred *bewit.Cred) {
+	L.PreloadModule("crypto", func(L *lua.LState) int {
+		mod := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+			"sha256": func(L *lua.LState) int {
+				h := sha256.Sum256([]byte(L.CheckString(1)))
+				L.Push(lua.LString(hex.EncodeToString(h[:])))
+				return 1
+			},
+			"blake2b": func(L *lua.LState) int {
+				h := blake2b.Sum256([]byte(L.CheckString(1)))
+				L.Push(lua.LString(hex.EncodeToString(h[:])))
+				return 1
+			},
+			"hmac_sha256": func(L *lua.LState) int {
+				mac := hmac.New(sha256.New, []byte(L.CheckString(1)))
+				mac.Write([]byte(L.CheckString(2)))
+				L.Push(lua.LString(hex.EncodeToString(mac.Sum(nil))))
+				return 1
+			},
+			"compare": func(L *lua.LState) int {
+				L.Push(lua.LBool(subtle.ConstantTimeCompare([]byte(L.CheckString(1)), []byte(L.CheckString(2))) == 1))
+				return 1
+			},
+			"random_token": func(L *lua.LState) int {
+				size := L.OptInt(1, 32)
+				if size <= 0 {
+					L.ArgError(1, "size must be positive")
+				}
+				raw := make([]byte, size)
+				if _, err := rand.Read(raw); err != nil {
+					panic(err)
+				}
+				L.Push(lua.LString(base64.RawURLEncoding.EncodeToString(raw)))
+				return 1
+			},
+			"sign_url": func(L *lua.LState) int {
+				u, err := url.Parse(L.CheckString(1))
+				if err != nil {
+					L.ArgError(1, "invalid URL")
+				}
+				ttl := time.Duration(float64(L.CheckNumber(2)) * float64(time.Second))
+				if err := bewit.Bewit(cred, u, ttl); err != nil {
+					panic(err)
+				}
+				L.Push(lua.LString(u.String()))
+				return 1
+			},
+			"check_url": func(L *lua.LState) int {
+				req, err := http.NewRequest("GET", L.CheckString(1), nil)
+				if err != nil {
+					L.ArgError(1, "invalid URL")
+				}
+				if err := bewit.Validate(req, cred); err != nil {
+					L.Push(lua.LFalse)
+					L.Push(lua.LString(err.Error()))
+					return 2
+				}
+				L.Push(lua.LTrue)
+				return 1
+			},
+		})
+		L.Push(mod)
+		return 1
+	})
+}
@@ -0,0 +1,47 @@
+package extra
+
+import (
+	"testing"
+
+	"github.com/yuin/gopher-lua"
+)
+
+func TestCrypto(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	SetupCrypto(L, AppCred("secret", "test"))
+	if err := L.DoString(`
+local crypto = require('crypto')
+assert(crypto.sha256('hello') == '2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824')
+assert(#crypto.blake2b('hello') == 64)
+assert(crypto.hmac_sha256('key', 'The quick brown fox jumps over the lazy dog') == 'f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8')
+assert(crypto.compare('abc', 'abc'))
+assert(not crypto.compare('abc', 'abd'))
+assert(#crypto.random_token() == 43)
+assert(crypto.random_token(16) ~= crypto.random_token(16))
+
+local u = crypto.sign_url('https://example.com/share/1', 60)
+assert(crypto.check_url(u))
+local ok, err = crypto.check_url('https://example.com/share/2' .. string.sub(u, string.find(u, '?', 1, true), -1))
+assert(not ok and err == 'Bad mac', err)
+ok, err = crypto.check_url('https://example.com/share/1')
+assert(not ok)
+`); err != nil {
+		t.Fatal(err)
+	}
+
+	// The links signed by another app are rejected
+	other := lua.NewState()
+	defer other.Close()
+	SetupCrypto(other, AppCred("secret", "other"))
+	if err := other.DoString(`
+local crypto = require('crypto')
+signed = crypto.sign_url('https://example.com/share/1', 60)
+`); err != nil {
+		t.Fatal(err)
+	}
+	L.SetGlobal("signed", other.GetGlobal("signed"))
+	if err := L.DoString(`assert(not require('crypto').check_url(signed))`); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,270 @@
+package extra // import "a4.io/blobstash/pkg/extra"
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+
+	"a4.io/blobstash/pkg/apps/luautil"
+	"a4.io/blobstash/pkg/config"
+)
+
+const (
+	defaultHTTPTimeout         = 10 * time.Second
+	defaultHTTPMaxResponseSize = 10 << 20
+)
+
+// Per-app counters of the outbound requests (app name => requests/blocked/errors/bytes)
+var httpVar = expvar.NewMap("apps-http")
+
+// ErrDomainNotAllowed is returned when requesting a domain not in the app allowlist
+var ErrDomainNotAllowed = errors.New("domain not allowed")
+
+// ErrResponseTooLarge is returned when reading a response larger than the max response size
+var ErrResponseTooLarge = errors.New("response too large")
+
+// HTTPClient is an HTTP client restricted to an allowlist of domains
+type HTTPClient struct {
+	allowed []string
+	maxSize int64
+	client  *http.Client
+	stats   *expvar.Map
+}
+
+// NewHTTPClient initializes the HTTP client of the app (a nil config rejects all the requests)
+func NewHTTPClient(app string, conf *config.AppHTTP) (*HTTPClient, error) {
+	c := &HTTPClient{maxSize: defaultHTTPMaxResponseSize}
+	timeout := defaultHTTPTimeout
+	if conf != nil {
+		c.allowed = conf.AllowedDomains
+		if conf.Timeout != "" {
+			var err error
+			timeout, err = time.ParseDuration(conf.Timeout)
+			if err != nil || timeout <= 0 {
+				return nil, fmt.Errorf("invalid HTTP timeout %q", conf.Timeout)
+			}
+		}
+		if conf.MaxResponseSize < 0 {
+			return nil, fmt.Errorf("invalid HTTP max response size %d", conf.MaxResponseSize)
+		}
+		if conf.MaxResponseSize > 0 {
+			c.maxSize = conf.MaxResponseSize
+		}
+	}
+	if stats, ok := httpVar.Get(app).(*expvar.Map); ok {
+		c.stats = stats
+	} else {
+		c.stats = new(expvar.Map).Init()
+		httpVar.Set(app, c.stats)
+	}
+	c.client = &http.Client{
+		Timeout:   timeout,
+		Transport: &allowlistTransport{c},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			// The redirects are checked by the transport
+			return nil
+		},
+	}
+	return c, nil
+}
+
+// Client returns the underlying `*http.Client`
+func (c *HTTPClient) Client() *http.Client {
+	return c.client
+}
+
+// Allowed returns true if the host is in the allowlist
+func (c *HTTPClient) Allowed(host string) bool {
+	host = strings.ToLower(host)
+	for _, domain := range c.allowed {
+		domain = strings.ToLower(domain)
+		if host == domain || (strings.HasPrefix(domain, "*.") && strings.HasSuffix(host, domain[1:])) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowlistTransport rejects the requests to the domains not in the allowlist and limits the response size
+type allowlistTransport struct {
+	c *HTTPClient
+}
+
+func (t *allowlistTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if (req.URL.Scheme != "http" && req.URL.Scheme != "https") || !t.c.Allowed(req.URL.Hostname()) {
+		t.c.stats.Add("blocked", 1)
+		return nil, fmt.Errorf("%v: %s", ErrDomainNotAllowed, req.URL.Hostname())
+	}
+	t.c.stats.Add("requests", 1)
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.c.stats.Add("errors", 1)
+		return nil, err
+	}
+	if resp.ContentLength > t.c.maxSize {
+		resp.Body.Close()
+		t.c.stats.Add("errors", 1)
+		return nil, ErrResponseTooLarge
+	}
+	resp.Body = &limitedBody{rc: resp.Body, left: t.c.maxSize, stats: t.c.stats}
+	return resp, nil
+}
+
+// limitedBody returns `ErrResponseTooLarge` once more than `left` bytes are read
+type limitedBody struct {
+	rc    io.ReadCloser
+	left  int64
+	stats *expvar.Map
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.left < 0 {
+		return 0, ErrResponseTooLarge
+	}
+	// Read one extra byte to detect the responses that are too large
+	if int64(len(p)) > b.left+1 {
+		p = p[:b.left+1]
+	}
+	n, err := b.rc.Read(p)
+	b.left -= int64(n)
+	if b.left < 0 {
+		b.stats.Add("errors", 1)
+		return n - 1, ErrResponseTooLarge
+	}
+	b.stats.Add("bytes", int64(n))
+	return n, err
+}
+
+func (b *limitedBody) Close() error {
+	return b.rc.Close()
+}
+
+// do executes the request and returns the response with the body fully read
+func (c *HTTPClient) do(method, url string, body []byte, header http.Header) (*http.Response, []byte, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, url, r)
+	if err != nil {
+		return nil, nil, err
+	}
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp, data, nil
+}
+
+// luaHeaders converts the optional headers table at the given index of the stack
+func luaHeaders(L *lua.LState, n int) http.Header {
+	header := http.Header{}
+	if tbl, ok := L.Get(n).(*lua.LTable); ok {
+		tbl.ForEach(func(k, v lua.LValue) {
+			header.Set(k.String(), v.String())
+		})
+	}
+	return header
+}
+
+func luaResponse(L *lua.LState, resp *http.Response, body []byte) *lua.LTable {
+	headers := L.NewTable()
+	for k := range resp.Header {
+		headers.RawSetString(k, lua.LString(resp.Header.Get(k)))
+	}
+	tbl := L.NewTable()
+	tbl.RawSetString("status_code", lua.LNumber(resp.StatusCode))
+	tbl.RawSetString("headers", headers)
+	tbl.RawSetString("body", lua.LString(body))
+	return tbl
+}
+
+// luaDo executes the request and pushes the response table (or nil and the error message)
+func (c *HTTPClient) luaDo(L *lua.LState, method, url string, body []byte, header http.Header, decodeJSON bool) int {
+	resp, data, err := c.do(method, url, body, header)
+	if err == nil && decodeJSON && (resp.StatusCode < 200 || resp.StatusCode > 299) {
+		err = fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	if decodeJSON {
+		var res interface{}
+		if err := json.Unmarshal(data, &res); err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		L.Push(luautil.InterfaceToLValue(L, res))
+		return 1
+	}
+	L.Push(luaResponse(L, resp, data))
+	return 1
+}
+
+// SetupHTTP adds the request helpers (using the restricted client) to the `http` module:
+//
+//	local http = require('http')
+//	local resp, err = http.get(url, headers)       -- resp.status_code, resp.headers, resp.body
+//	local resp, err = http.post(url, body, headers)
+//	local data, err = http.get_json(url, headers)  -- the decoded JSON response (2XX only)
+//	local data, err = http.post_json(url, payload, headers)
+func SetupHTTP(L *lua.LState, c *HTTPClient) {
+	preload := L.GetField(L.GetField(L.GetGlobal("package"), "preload"), "http")
+	L.PreloadModule("http", func(L *lua.LState) int {
+		mod := L.NewTable()
+		if fn, ok := preload.(*lua.LFunction); ok {
+			// Load the original module first (it sets up the `url` and `form` modules types)
+			if err := L.CallByParam(lua.P{Fn: fn, NRet: 1, Protect: true}); err != nil {
+				L.RaiseError("http: %v", err)
+			}
+			if tbl, ok := L.Get(-1).(*lua.LTable); ok {
+				mod = tbl
+			}
+			L.Pop(1)
+		}
+		L.SetFuncs(mod, map[string]lua.LGFunction{
+			"get": func(L *lua.LState) int {
+				return c.luaDo(L, "GET", L.CheckString(1), nil, luaHeaders(L, 2), false)
+			},
+			"post": func(L *lua.LState) int {
+				return c.luaDo(L, "POST", L.CheckString(1), []byte(L.CheckString(2)), luaHeaders(L, 3), false)
+			},
+			"get_json": func(L *lua.LState) int {
+				header := luaHeaders(L, 2)
+				header.Set("Accept", "application/json")
+				return c.luaDo(L, "GET", L.CheckString(1), nil, header, true)
+			},
+			"post_json": func(L *lua.LState) int {
+				header := luaHeaders(L, 3)
+				header.Set("Accept", "application/json")
+				header.Set("Content-Type", "application/json")
+				return c.luaDo(L, "POST", L.CheckString(1), luautil.ToJSON(L, L.CheckAny(2)), header, true)
+			},
+		})
+		L.Push(mod)
+		return 1
+	})
+}
@@ -0,0 +1,93 @@
+package extra
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/yuin/gopher-lua"
+
+	"a4.io/blobstash/pkg/config"
+)
+
+func TestHTTP(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/large":
+			w.Write([]byte(strings.Repeat("a", 100)))
+		case "/json":
+			body, _ := ioutil.ReadAll(r.Body)
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"method": %q, "body": %s}`, r.Method, body)
+		default:
+			w.Header().Set("X-Test", r.Header.Get("X-Test"))
+			w.Write([]byte("ok"))
+		}
+	}))
+	defer ts.Close()
+
+	c, err := NewHTTPClient("test", &config.AppHTTP{AllowedDomains: []string{"127.0.0.1"}, MaxResponseSize: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for host, expected := range map[string]bool{
+		"127.0.0.1":       true,
+		"localhost":       false,
+		"api.example.com": false,
+	} {
+		if got := c.Allowed(host); got != expected {
+			t.Errorf("Allowed(%q) = %v, expected %v", host, got, expected)
+		}
+	}
+	wildcard, err := NewHTTPClient("test", &config.AppHTTP{AllowedDomains: []string{"*.example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !wildcard.Allowed("api.example.com") || wildcard.Allowed("example.com") || wildcard.Allowed("notexample.com") {
+		t.Errorf("unexpected wildcard matching")
+	}
+
+	L := lua.NewState()
+	defer L.Close()
+	SetupHTTP(L, c)
+	L.SetGlobal("base_url", lua.LString(ts.URL))
+	if err := L.DoString(`
+local http = require('http')
+local resp, err = http.get(base_url .. '/', {['X-Test'] = 'hello'})
+if err then error(err) end
+if resp.status_code ~= 200 or resp.body ~= 'ok' or resp.headers['X-Test'] ~= 'hello' then
+  error('unexpected response ' .. resp.body)
+end
+
+local data, err = http.post_json(base_url .. '/json', {a = 1})
+if err then error(err) end
+if data.method ~= 'POST' or data.body.a ~= 1 then error('unexpected JSON response') end
+
+local resp, err = http.get(base_url .. '/large')
+if resp ~= nil or not string.find(err, 'response too large') then
+  error('expected a too large error, got ' .. tostring(err))
+end
+
+local resp, err = http.get('http://localhost/')
+if resp ~= nil or not string.find(err, 'domain not allowed') then
+  error('expected a not allowed error, got ' .. tostring(err))
+end
+`); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without config, all the requests are rejected
+	c, err = NewHTTPClient("test2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Client().Get(ts.URL); err == nil || !strings.Contains(err.Error(), ErrDomainNotAllowed.Error()) {
+		t.Errorf("expected a not allowed error, got %v", err)
+	}
+	if _, err := NewHTTPClient("test3", &config.AppHTTP{Timeout: "nope"}); err == nil {
+		t.Errorf("expected an invalid timeout error")
+	}
+}
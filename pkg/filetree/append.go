@@ -0,0 +1,115 @@
+package filetree // import "a4.io/blobstash/pkg/filetree"
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/ctxutil"
+	rnode "a4.io/blobstash/pkg/filetree/filetreeutil/node"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/iface"
+	"a4.io/blobstash/pkg/perms"
+)
+
+// appendHandler appends the request body to the file at `path` (created if it does not exist), the existing
+// chunks are re-used so only the new data is uploaded (useful for log files and growing archives).
+//
+// The `If-Match` header can be set to the current node ref to prevent concurrent appends.
+func (ft *FileTree) appendHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			httputil.WriteErrorStatus(w, http.StatusMethodNotAllowed)
+			return
+		}
+		vars := mux.Vars(r)
+		if vars["type"] != "fs" {
+			httputil.WriteJSONError(w, http.StatusBadRequest, "only FS references can be appended to")
+			return
+		}
+		fsName := vars["name"]
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Write, perms.FS),
+			perms.ResourceWithID(perms.Filetree, perms.FS, fsName),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+		ctx := ctxutil.WithNamespace(r.Context(), r.Header.Get(ctxutil.NamespaceHeader))
+		path := "/" + strings.Trim(r.URL.Query().Get("path"), "/")
+		if path == "/" {
+			httputil.WriteJSONError(w, http.StatusBadRequest, "missing path")
+			return
+		}
+
+		fs, err := ft.FS(ctx, fsName, FSKeyFmt, false, 0)
+		if err != nil {
+			panic(err)
+		}
+		mtime := time.Now().Unix()
+		node, _, created, err := fs.Path(ctx, path, 1, true, mtime)
+		if err != nil {
+			panic(err)
+		}
+		if node.Type != rnode.File {
+			httputil.WriteJSONError(w, http.StatusBadRequest, "only files can be appended to")
+			return
+		}
+		if hash := r.Header.Get("If-Match"); hash != "" && node.Hash != hash {
+			httputil.WriteErrorStatus(w, http.StatusPreconditionFailed)
+			return
+		}
+		if !created {
+			if err := ft.checkRetention(ctx, fs.Name, path, node.Hash); err != nil {
+				panic(err)
+			}
+		}
+
+		limit, err := ft.uploadLimit(ctx, fs.Name, node)
+		if err != nil {
+			panic(err)
+		}
+		uploader, err := ft.newUploader(ctx, fs.Name, r.URL.Query())
+		if err != nil {
+			httputil.WriteJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		limit.apply(uploader)
+		r.Body = http.MaxBytesReader(w, r.Body, MaxUploadSize)
+		meta, err := uploader.AppendReader(iface.NewBlobStorer(ctx, ft.blobStore), node.Meta, r.Body)
+		if err != nil {
+			panic(limit.error(err))
+		}
+		newNode, revision, err := ft.Update(ctx, nil, node, meta, FSKeyFmt, true)
+		if err != nil {
+			panic(err)
+		}
+
+		w.Header().Add("BlobStash-Filetree-FS-Revision", strconv.FormatInt(revision, 10))
+		newNode.UploadStats = uploader.Stats()
+
+		evtType := "file-updated"
+		if created {
+			evtType = "file-created"
+		}
+		updateEvent := &FSUpdateEvent{
+			Name:      fs.Name,
+			Type:      evtType,
+			Ref:       newNode.Hash,
+			Path:      path[1:],
+			Time:      time.Now().UTC().Unix(),
+			SessionID: httputil.GetSessionID(r),
+		}
+		if err := ft.hub.FiletreeFSUpdateEvent(ctx, nil, updateEvent.JSON()); err != nil {
+			panic(err)
+		}
+
+		httputil.MarshalAndWrite(r, w, newNode)
+	}
+}
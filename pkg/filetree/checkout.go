@@ -0,0 +1,113 @@
+package filetree // import "a4.io/blobstash/pkg/filetree"
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrFSNotFound is returned when the requested FS does not exist
+var ErrFSNotFound = errors.New("FS not found")
+
+// ResolveFS returns the (read-only) FS for a `<fs>`, `<fs>@<tag>` or `<fs>@<root ref>` reference
+func (ft *FileTree) ResolveFS(ctx context.Context, ref string) (*FS, error) {
+	if i := strings.LastIndex(ref, "@"); i != -1 {
+		fs, err := ft.TaggedFS(ctx, ref)
+		if err == ErrTagNotFound {
+			// Not a tag, maybe a root ref
+			if h := ref[i+1:]; isHash(h) {
+				return &FS{Name: ref[:i], Ref: h, ft: ft}, nil
+			}
+			return nil, ErrFSNotFound
+		}
+		return fs, err
+	}
+	fs, err := ft.FS(ctx, ref, FSKeyFmt, false, 0)
+	if err != nil {
+		return nil, err
+	}
+	if fs.Ref == "" {
+		return nil, ErrFSNotFound
+	}
+	return fs, nil
+}
+
+// Checkout writes the files of the FS referenced by ref in dir (the directories are created as needed), it fails if
+// the files total more than maxSize bytes
+func (ft *FileTree) Checkout(ctx context.Context, ref, dir string, maxSize int64) error {
+	fs, err := ft.ResolveFS(ctx, ref)
+	if err != nil {
+		return err
+	}
+	root, err := fs.Root(ctx, false, 0)
+	if err != nil {
+		return err
+	}
+	var total int64
+	return ft.IterTree(ctx, root, func(n *Node, p string) error {
+		if !n.Meta.IsFile() {
+			return nil
+		}
+		total += int64(n.Size)
+		if total > maxSize {
+			return fmt.Errorf("FS %q is larger than %d bytes", ref, maxSize)
+		}
+		dst := filepath.Join(dir, filepath.FromSlash(p))
+		if !strings.HasPrefix(dst, filepath.Clean(dir)+string(filepath.Separator)) {
+			return fmt.Errorf("invalid path %q", p)
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		for _, iv := range n.Meta.FileRefs() {
+			blob, err := ft.blobStore.Get(ctx, iv.Value)
+			if err != nil {
+				return err
+			}
+			if _, err := f.Write(blob); err != nil {
+				return err
+			}
+		}
+		return f.Close()
+	})
+}
+
+// isHash returns true if h looks like a blob hash
+func isHash(h string) bool {
+	if len(h) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(h)
+	return err == nil
+}
+
+// Refs calls fn for each blob of the tree rooted at the node ref (the node blobs and the file contents)
+func (ft *FileTree) Refs(ctx context.Context, ref string, fn func(string) error) error {
+	root, err := ft.nodeByRef(ctx, ref)
+	if err != nil {
+		return err
+	}
+	return ft.IterTree(ctx, root, func(n *Node, _ string) error {
+		if err := fn(n.Hash); err != nil {
+			return err
+		}
+		if !n.Meta.IsFile() {
+			return nil
+		}
+		for _, iv := range n.Meta.FileRefs() {
+			if err := fn(iv.Value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
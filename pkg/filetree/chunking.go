@@ -0,0 +1,42 @@
+package filetree // import "a4.io/blobstash/pkg/filetree"
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/filetree/writer"
+	"a4.io/blobstash/pkg/iface"
+)
+
+func toChunking(c *config.FiletreeChunking) *writer.Chunking {
+	return &writer.Chunking{Mode: c.Mode, Size: c.Size}
+}
+
+// newUploader returns an uploader using the chunking configured for the FS, the `chunking` and `chunk_size` query
+// args override it for a single upload
+func (ft *FileTree) newUploader(ctx context.Context, fsName string, q url.Values) (*writer.Uploader, error) {
+	uploader := writer.NewUploader(iface.NewBlobStorer(ctx, ft.blobStore))
+	chunking := writer.DefaultChunking
+	if c := ft.conf.FiletreeChunking(fsName); c != nil {
+		chunking = toChunking(c)
+	}
+	if mode, size := q.Get("chunking"), q.Get("chunk_size"); mode != "" || size != "" {
+		override := *chunking
+		if mode != "" {
+			override.Mode = mode
+		}
+		if size != "" {
+			var err error
+			if override.Size, err = strconv.Atoi(size); err != nil {
+				return nil, err
+			}
+		}
+		chunking = &override
+	}
+	if err := uploader.SetChunking(chunking); err != nil {
+		return nil, err
+	}
+	return uploader, nil
+}
@@ -0,0 +1,278 @@
+package filetree // import "a4.io/blobstash/pkg/filetree"
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"a4.io/blobsfile"
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/client/clientutil"
+	"a4.io/blobstash/pkg/ctxutil"
+	rnode "a4.io/blobstash/pkg/filetree/filetreeutil/node"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/perms"
+	"a4.io/blobstash/pkg/tenant"
+)
+
+// Server-side copy/move
+//
+// A node (file or whole subtree) is copied by linking its meta in the destination dir (with an optional new name),
+// the content is never transferred. A move is a copy followed by the removal of the source node.
+
+var (
+	// ErrNodeExists is returned when the destination already exists (and overwrite is not set)
+	ErrNodeExists = errors.New("destination already exists")
+
+	// ErrInvalidCopy is returned when trying to copy a node into itself (or to copy the root)
+	ErrInvalidCopy = errors.New("cannot copy a node into itself")
+
+	// ErrInvalidDest is returned when the destination is not a dir (or the new name is invalid)
+	ErrInvalidDest = errors.New("invalid destination")
+
+	// ErrSameNode is returned when the destination is the source node itself
+	ErrSameNode = errors.New("the source and the destination are the same")
+)
+
+// CopyOptions holds the copy/move API request payload
+type CopyOptions struct {
+	// Source path
+	Path string `json:"path"`
+
+	// Destination FS (defaults to the source FS)
+	DestFS string `json:"dest_fs,omitempty"`
+
+	// Destination dir (created if needed)
+	DestDir string `json:"dest_dir"`
+
+	// Optional new name
+	Name string `json:"name,omitempty"`
+
+	// Replace the existing node at the destination
+	Overwrite bool `json:"overwrite,omitempty"`
+}
+
+// mkdirAll returns the dir at the given path, creating the missing dirs
+func (ft *FileTree) mkdirAll(ctx context.Context, fs *FS, dir, prefixFmt string, mtime int64) (*Node, error) {
+	if dir == "/" {
+		node, _, _, err := fs.Path(ctx, dir, 1, true, mtime)
+		return node, err
+	}
+	node, _, _, err := fs.Path(ctx, dir, 1, false, 0)
+	switch err {
+	case nil:
+		if node.Type != rnode.Dir {
+			return nil, ErrInvalidDest
+		}
+		return node, nil
+	case clientutil.ErrBlobNotFound, blobsfile.ErrBlobNotFound:
+	default:
+		return nil, err
+	}
+
+	parent, err := ft.mkdirAll(ctx, fs, path.Dir(dir), prefixFmt, mtime)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err := ft.AddChild(ctx, nil, parent, &rnode.RawNode{
+		Version: rnode.V1,
+		Type:    rnode.Dir,
+		Name:    path.Base(dir),
+		ModTime: mtime,
+		Mode:    uint32(0755),
+	}, prefixFmt, mtime); err != nil {
+		return nil, err
+	}
+	node, _, _, err = fs.Path(ctx, dir, 1, false, 0)
+	return node, err
+}
+
+// Copy links the node at `srcPath` into the `dstDir` dir of the `dst` FS, the source node is removed if `move` is
+// set (`src` and `dst` must be the same `*FS` when copying within a FS)
+func (ft *FileTree) Copy(ctx context.Context, src *FS, srcPath string, dst *FS, dstDir, name string, overwrite, move bool, prefixFmt string) (*Node, int64, error) {
+	if srcPath == "/" {
+		return nil, 0, ErrInvalidCopy
+	}
+	if src == dst && (dstDir == srcPath || strings.HasPrefix(dstDir, srcPath+"/")) {
+		return nil, 0, ErrInvalidCopy
+	}
+	node, _, _, err := src.Path(ctx, srcPath, 1, false, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	// Check the source before copying it, the move must not be partial
+	if move {
+		if err := ft.checkRetention(ctx, src.Name, srcPath, node.Hash); err != nil {
+			return nil, 0, err
+		}
+	}
+	if name == "" {
+		name = node.Name
+	}
+	if name == "" || strings.Contains(name, "/") || name == "." || name == ".." {
+		return nil, 0, ErrInvalidDest
+	}
+	// Overwriting the source with itself would delete it when moving
+	if src == dst && path.Join(dstDir, name) == srcPath {
+		return nil, 0, ErrSameNode
+	}
+
+	mtime := time.Now().Unix()
+	dir, err := ft.mkdirAll(ctx, dst, dstDir, prefixFmt, mtime)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !overwrite {
+		for _, c := range dir.Children {
+			if c.Name == name {
+				return nil, 0, ErrNodeExists
+			}
+		}
+	}
+
+	// Only the meta is re-linked (a renamed node gets a new ref, its content/children refs are unchanged)
+	newChild := *node.Meta
+	newChild.Name = name
+	newChild.ChangeTime = mtime
+	if err := ft.checkAddLimit(ctx, dst.Name, dir, &newChild, move && src == dst); err != nil {
+		return nil, 0, err
+	}
+	_, revision, err := ft.AddChild(ctx, nil, dir, &newChild, prefixFmt, mtime)
+	if err != nil {
+		return nil, 0, err
+	}
+	// AddChild returns the updated parent
+	newNode, _, _, err := dst.Path(ctx, path.Join(dstDir, name), 1, false, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if !move {
+		return newNode, revision, nil
+	}
+
+	// Fetch the source node again, the tree may have been updated
+	node, _, _, err = src.Path(ctx, srcPath, 1, false, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	if _, revision, err = ft.Delete(ctx, nil, node, prefixFmt, mtime); err != nil {
+		return nil, 0, err
+	}
+	return newNode, revision, nil
+}
+
+// copyHandler handles both the `_copy` and the `_move` endpoints
+func (ft *FileTree) copyHandler(move bool) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			httputil.WriteErrorStatus(w, http.StatusMethodNotAllowed)
+			return
+		}
+		ctx := ctxutil.WithNamespace(r.Context(), r.Header.Get(ctxutil.NamespaceHeader))
+		vars := mux.Vars(r)
+		refType := vars["type"]
+		fsName := vars["name"]
+
+		opts := &CopyOptions{}
+		if err := httputil.Unmarshal(r, opts); err != nil {
+			httputil.WriteJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid payload: %v", err))
+			return
+		}
+		if opts.DestFS != "" {
+			opts.DestFS = tenant.Name(r, opts.DestFS)
+		} else {
+			if refType != "fs" {
+				httputil.WriteJSONError(w, http.StatusBadRequest, "dest_fs is required")
+				return
+			}
+			opts.DestFS = fsName
+		}
+		if move && refType != "fs" {
+			httputil.WriteJSONError(w, http.StatusBadRequest, "only FS references can be moved from")
+			return
+		}
+
+		// Read access is needed on the source (write access to move from it), and write access on the destination
+		srcAction := perms.Read
+		if move {
+			srcAction = perms.Write
+		}
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(srcAction, perms.FS),
+			perms.ResourceWithID(perms.Filetree, perms.FS, fsName),
+		) || !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Write, perms.FS),
+			perms.ResourceWithID(perms.Filetree, perms.FS, opts.DestFS),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+
+		src, err := ft.fsByType(ctx, refType, fsName, FSKeyFmt, 0)
+		switch err {
+		case nil:
+		case ErrTagNotFound:
+			notFound(w)
+			return
+		default:
+			panic(err)
+		}
+		dst := src
+		if refType != "fs" || opts.DestFS != fsName {
+			dst, err = ft.FS(ctx, opts.DestFS, FSKeyFmt, false, 0)
+			if err != nil {
+				panic(err)
+			}
+		}
+
+		srcPath := "/" + strings.Trim(opts.Path, "/")
+		dstDir := "/" + strings.Trim(opts.DestDir, "/")
+		newNode, revision, err := ft.Copy(ctx, src, srcPath, dst, dstDir, opts.Name, opts.Overwrite, move, FSKeyFmt)
+		switch err {
+		case nil:
+		case clientutil.ErrBlobNotFound, blobsfile.ErrBlobNotFound:
+			notFound(w)
+			return
+		case ErrNodeExists:
+			httputil.WriteJSONError(w, http.StatusConflict, err.Error())
+			return
+		case ErrInvalidCopy, ErrInvalidDest, ErrSameNode:
+			httputil.WriteJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		default:
+			panic(err)
+		}
+
+		w.Header().Add("BlobStash-Filetree-FS-Revision", strconv.FormatInt(revision, 10))
+
+		evtType := "copied"
+		if move {
+			evtType = "moved"
+		}
+		updateEvent := &FSUpdateEvent{
+			Name:      dst.Name,
+			Type:      fmt.Sprintf("%s-%s", newNode.Type, evtType),
+			Ref:       newNode.Hash,
+			Path:      path.Join(dstDir, newNode.Name)[1:],
+			Time:      time.Now().UTC().Unix(),
+			SessionID: httputil.GetSessionID(r),
+		}
+		if err := ft.hub.FiletreeFSUpdateEvent(ctx, nil, updateEvent.JSON()); err != nil {
+			panic(err)
+		}
+
+		httputil.MarshalAndWrite(r, w, newNode)
+	}
+}
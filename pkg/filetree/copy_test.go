@@ -0,0 +1,116 @@
+package filetree_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"a4.io/blobstash/pkg/filetree"
+	"a4.io/blobstash/pkg/testutil"
+)
+
+func TestCopyAndMove(t *testing.T) {
+	srv := testutil.NewServer(t)
+	defer srv.Close()
+
+	for _, p := range []string{"a.txt", "dir/b.txt"} {
+		resp, err := srv.Do("POST", "/api/filetree/fs/fs/docs/_append?path="+p, strings.NewReader("content of "+p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("failed to create %s: %d", p, resp.StatusCode)
+		}
+	}
+
+	do := func(action, body string) (int, *filetree.Node) {
+		req, err := srv.NewRequest("POST", "/api/filetree/fs/fs/docs/"+action, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		node := &filetree.Node{}
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(node); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp.StatusCode, node
+	}
+	// content returns the content hash of the node
+	content := func(p string) (int, string) {
+		resp, err := srv.Do("GET", "/api/filetree/fs/fs/docs/"+p, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		node := &filetree.Node{}
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(node); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp.StatusCode, node.ContentHash
+	}
+	_, a := content("a.txt")
+	_, b := content("dir/b.txt")
+	if a == "" || b == "" || a == b {
+		t.Fatalf("unexpected content hashes %q/%q", a, b)
+	}
+
+	// Copy
+	status, node := do("_copy", `{"path": "/a.txt", "dest_dir": "/copies", "name": "c.txt"}`)
+	if status != http.StatusOK || node.Name != "c.txt" {
+		t.Fatalf("failed to copy %d %+v", status, node)
+	}
+	for _, p := range []string{"a.txt", "copies/c.txt"} {
+		if status, hash := content(p); status != http.StatusOK || hash != a {
+			t.Errorf("%s: unexpected content %d %q", p, status, hash)
+		}
+	}
+
+	// The destination is not overwritten by default
+	if status, _ := do("_copy", `{"path": "/dir/b.txt", "dest_dir": "/copies", "name": "c.txt"}`); status != http.StatusConflict {
+		t.Errorf("expected a 409, got %d", status)
+	}
+	if status, _ := do("_copy", `{"path": "/dir/b.txt", "dest_dir": "/copies", "name": "c.txt", "overwrite": true}`); status != http.StatusOK {
+		t.Errorf("failed to overwrite %d", status)
+	}
+	if status, hash := content("copies/c.txt"); status != http.StatusOK || hash != b {
+		t.Errorf("unexpected overwritten content %d %q", status, hash)
+	}
+
+	// Move
+	if status, node := do("_move", `{"path": "/dir/b.txt", "dest_dir": "/"}`); status != http.StatusOK || node.Name != "b.txt" {
+		t.Fatalf("failed to move %d %+v", status, node)
+	}
+	if status, _ := content("dir/b.txt"); status != http.StatusNotFound {
+		t.Errorf("the moved node should be removed, got %d", status)
+	}
+	if status, hash := content("b.txt"); status != http.StatusOK || hash != b {
+		t.Errorf("unexpected moved content %d %q", status, hash)
+	}
+
+	// Copying/moving a node onto itself is rejected (it would delete the node when moving)
+	for _, action := range []string{"_copy", "_move"} {
+		for _, body := range []string{
+			`{"path": "/a.txt", "dest_dir": "/", "overwrite": true}`,
+			`{"path": "/a.txt", "dest_dir": "/", "name": "a.txt", "overwrite": true}`,
+			`{"path": "/a.txt", "dest_fs": "docs", "dest_dir": "", "overwrite": true}`,
+		} {
+			if status, _ := do(action, body); status != http.StatusBadRequest {
+				t.Errorf("%s %s: expected a 400, got %d", action, body, status)
+			}
+		}
+	}
+	if status, hash := content("a.txt"); status != http.StatusOK || hash != a {
+		t.Errorf("the source should be untouched %d %q", status, hash)
+	}
+}
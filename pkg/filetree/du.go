@@ -0,0 +1,103 @@
+package filetree // import "a4.io/blobstash/pkg/filetree"
+
+import (
+	"context"
+
+	rnode "a4.io/blobstash/pkg/filetree/filetreeutil/node"
+)
+
+// du returns the cumulative stats of the node subtree, the dirs created before the stats were maintained (or by
+// clients not setting them) are walked once (the results are cached by ref as the nodes are immutable)
+func (ft *FileTree) du(ctx context.Context, m *rnode.RawNode) (*rnode.DirStats, error) {
+	if m.IsFile() {
+		return &rnode.DirStats{Size: int64(m.Size), FilesCount: 1}, nil
+	}
+	if m.DirStats != nil {
+		return m.DirStats, nil
+	}
+	if cached, ok := ft.duCache.Get(m.Hash); m.Hash != "" && ok {
+		return cached.(*rnode.DirStats), nil
+	}
+	stats := &rnode.DirStats{}
+	for _, ref := range m.Refs {
+		child, err := ft.rawNode(ctx, ref.(string))
+		if err != nil {
+			return nil, err
+		}
+		cstats, err := ft.du(ctx, child)
+		if err != nil {
+			return nil, err
+		}
+		stats.Add(cstats)
+		if !child.IsFile() {
+			stats.DirsCount++
+		}
+	}
+	if m.Hash != "" {
+		ft.duCache.Add(m.Hash, stats)
+	}
+	return stats, nil
+}
+
+// updateDirStats computes the stats of the dir from its (already fetched) children, must be called before
+// encoding the updated dir meta
+func (ft *FileTree) updateDirStats(ctx context.Context, n *Node) error {
+	stats := &rnode.DirStats{}
+	for _, c := range n.Children {
+		cstats, err := ft.du(ctx, c.Meta)
+		if err != nil {
+			return err
+		}
+		stats.Add(cstats)
+		if !c.Meta.IsFile() {
+			stats.DirsCount++
+		}
+	}
+	n.Meta.DirStats = stats
+	n.Size = int(stats.Size)
+	n.FilesCount = stats.FilesCount
+	return nil
+}
+
+// FSSize returns the total size of the files of the FS (as of the given time in UNIX nano if asOf is not 0), 0 if the
+// FS does not exist
+func (ft *FileTree) FSSize(ctx context.Context, name string, asOf int64) (int64, error) {
+	fs, err := ft.FS(ctx, name, FSKeyFmt, false, asOf)
+	if err != nil {
+		return 0, err
+	}
+	if fs.Ref == "" {
+		return 0, nil
+	}
+	m, err := ft.rawNode(ctx, fs.Ref)
+	if err != nil {
+		return 0, err
+	}
+	stats, err := ft.du(ctx, m)
+	if err != nil {
+		return 0, err
+	}
+	return stats.Size, nil
+}
+
+// FSBlobs returns the blobs (nodes and chunks) of the current version of each FS
+func (ft *FileTree) FSBlobs(ctx context.Context) (map[string][]string, error) {
+	fsInfos, err := ft.IterFS(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	out := map[string][]string{}
+	for _, fsInfo := range fsInfos {
+		if fsInfo.Ref == "" {
+			continue
+		}
+		root, err := ft.nodeByRef(ctx, fsInfo.Ref)
+		if err != nil {
+			return nil, err
+		}
+		if out[fsInfo.Name], err = ft.TreeBlobs(ctx, root); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
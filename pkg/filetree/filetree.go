@@ -17,6 +17,8 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -30,6 +32,7 @@ import (
 	"a4.io/blobstash/pkg/blob"
 	"a4.io/blobstash/pkg/cache"
 	"a4.io/blobstash/pkg/client/clientutil"
+	"a4.io/blobstash/pkg/clock"
 	"a4.io/blobstash/pkg/config"
 	"a4.io/blobstash/pkg/ctxutil"
 	rnode "a4.io/blobstash/pkg/filetree/filetreeutil/node"
@@ -43,7 +46,11 @@ import (
 	"a4.io/blobstash/pkg/hub"
 	"a4.io/blobstash/pkg/perms"
 	"a4.io/blobstash/pkg/queue"
+	"a4.io/blobstash/pkg/rangedb"
+	"a4.io/blobstash/pkg/signing"
 	"a4.io/blobstash/pkg/stash/store"
+	"a4.io/blobstash/pkg/tenant"
+	"a4.io/blobstash/pkg/trace"
 	"a4.io/blobstash/pkg/vkv"
 )
 
@@ -92,7 +99,9 @@ type FileTree struct {
 
 	authFunc    func(*http.Request) bool
 	sharingCred *bewit.Cred
-	shareTTL    time.Duration
+	// Signs the public upload links
+	uploadCred *bewit.Cred
+	shareTTL   int64 // time.Duration, can be updated on config reload
 
 	thumbCache    *cache.Cache
 	metadataCache *cache.Cache
@@ -101,6 +110,17 @@ type FileTree struct {
 	webmQueue *queue.Queue
 
 	fileTypeCache *lru.Cache
+	duCache       *lru.Cache
+	// Parsed `_redirects` files of the hosted websites
+	redirectsCache *lru.Cache
+	// Shared by the file readers (for the read-ahead)
+	chunkCache *filereader.ChunkCache
+
+	// Schedules the purge of the trash entries
+	expiry *rangedb.ExpirationIndex
+
+	// Prevents concurrent materializations
+	materializeMu sync.Mutex
 
 	log log.Logger
 }
@@ -110,30 +130,12 @@ func (ft *FileTree) SharingCred() *bewit.Cred {
 }
 
 func (ft *FileTree) ShareTTL() time.Duration {
-	return ft.shareTTL
-}
-
-// BlobStore is the interface to be compatible with both the server and the BlobStore client
-func NewBlobStoreCompat(bs store.BlobStore, ctx context.Context) *BlobStore {
-	return &BlobStore{bs, ctx}
+	return time.Duration(atomic.LoadInt64(&ft.shareTTL))
 }
 
-type BlobStore struct {
-	blobStore store.BlobStore
-	ctx       context.Context
-}
-
-func (bs *BlobStore) Get(hash string) ([]byte, error) {
-	return bs.blobStore.Get(bs.ctx, hash)
-}
-
-func (bs *BlobStore) Stat(ctx context.Context, hash string) (bool, error) {
-	return bs.blobStore.Stat(bs.ctx, hash)
-}
-
-func (bs *BlobStore) Put(ctx context.Context, hash string, data []byte) error {
-	_, err := bs.blobStore.Put(ctx, &blob.Blob{Hash: hash, Data: data})
-	return err
+// SetShareTTL updates the validity of the newly created sharing links
+func (ft *FileTree) SetShareTTL(ttl time.Duration) {
+	atomic.StoreInt64(&ft.shareTTL, int64(ttl))
 }
 
 // TODO(tsileo): a way to create a snapshot without modifying anything (and forcing the datactx before)
@@ -144,6 +146,19 @@ type Snapshot struct {
 	Hostname  string `msgpack:"h" json:"hostname,omitempty"`
 	Message   string `msgpack:"m,omitempty" json:"message,omitempty"`
 	UserAgent string `msgpack:"ua,omitempty" json:"user_agent,omitempty"`
+
+	Signature *signing.Signature `msgpack:"sig,omitempty" json:"signature,omitempty"`
+}
+
+func init() {
+	// The FS roots are signed, so they can be verified when received during a sync
+	signing.RegisterFormat(strings.Replace(FSKeyFmt, "%s", "", 1), func(kv *vkv.KeyValue) (string, *signing.Signature, error) {
+		snap := &Snapshot{}
+		if err := msgpack.Unmarshal(kv.Data, snap); err != nil {
+			return "", nil, err
+		}
+		return kv.HexHash(), snap.Signature, nil
+	})
 }
 
 type FS struct {
@@ -160,8 +175,15 @@ func NewFS(ref string, ft *FileTree) *FS {
 }
 
 // New initializes the `DocStoreExt`
-func New(logger log.Logger, conf *config.Config, authFunc func(*http.Request) bool, kvStore store.KvStore, blobStore store.BlobStore, chub *hub.Hub) (*FileTree, error) {
+func New(logger log.Logger, conf *config.Config, authFunc func(*http.Request) bool, kvStore store.KvStore, blobStore store.BlobStore, chub *hub.Hub, expiry *rangedb.ExpirationIndex) (*FileTree, error) {
 	logger.Debug("init")
+	if conf.Filetree != nil {
+		for fs, chunking := range conf.Filetree.Chunking {
+			if err := toChunking(chunking).Validate(); err != nil {
+				return nil, fmt.Errorf("invalid chunking for %q: %v", fs, err)
+			}
+		}
+	}
 	// FIXME(tsileo): make the number of thumbnails to keep in memory a config item
 	thumbscache, err := cache.New(conf.VarDir(), "filetree_thumbs.cache", 512<<20)
 	if err != nil {
@@ -179,6 +201,18 @@ func New(logger log.Logger, conf *config.Config, authFunc func(*http.Request) bo
 	if err != nil {
 		return nil, err
 	}
+	duCache, err := lru.New(1024)
+	if err != nil {
+		return nil, err
+	}
+	redirectsCache, err := lru.New(64)
+	if err != nil {
+		return nil, err
+	}
+	chunkCache, err := filereader.NewChunkCache(conf.FiletreeChunkCacheSize())
+	if err != nil {
+		return nil, err
+	}
 
 	webmQueue, err := queue.New(filepath.Join(conf.VarDir(), "filetree-webm.queue"))
 	if err != nil {
@@ -193,19 +227,28 @@ func New(logger log.Logger, conf *config.Config, authFunc func(*http.Request) bo
 			Key: []byte(conf.SharingKey),
 			ID:  "filetree",
 		},
-		webmQueue:     webmQueue,
-		thumbCache:    thumbscache,
-		metadataCache: metacache,
-		nodeCache:     nodeCache,
-		fileTypeCache: fileTypeCache,
-		authFunc:      authFunc,
-		shareTTL:      1 * time.Hour,
-		hub:           chub,
-		log:           logger,
+		uploadCred: &bewit.Cred{
+			Key: []byte(conf.SharingKey),
+			ID:  "filetree-upload",
+		},
+		webmQueue:      webmQueue,
+		thumbCache:     thumbscache,
+		metadataCache:  metacache,
+		nodeCache:      nodeCache,
+		fileTypeCache:  fileTypeCache,
+		duCache:        duCache,
+		redirectsCache: redirectsCache,
+		chunkCache:     chunkCache,
+		expiry:         expiry,
+		authFunc:       authFunc,
+		shareTTL:       int64(conf.SharingTTL()),
+		hub:            chub,
+		log:            logger,
 	}
 
 	chub.Subscribe(hub.NewFiletreeNode, "webm", ft.webmHubCallback)
 	go ft.webmWorker()
+	expiry.Handle(trashExpiryPrefix, ft.expireTrashEntry)
 
 	return ft, nil
 }
@@ -306,6 +349,9 @@ func (ft *FileTree) webmHubCallback(ctx context.Context, _ *blob.Blob, data inte
 
 // RegisterRoute registers all the HTTP handlers for the extension
 func (ft *FileTree) Register(r *mux.Router, root *mux.Router, basicAuth func(http.Handler) http.Handler) {
+	// Static websites (matched by domain)
+	ft.registerSites(root)
+
 	// Raw node endpoint
 	r.Handle("/node/{ref}", basicAuth(http.HandlerFunc(ft.nodeHandler())))
 	r.Handle("/node/{ref}/_snapshot", basicAuth(http.HandlerFunc(ft.nodeSnapshotHandler())))
@@ -320,6 +366,19 @@ func (ft *FileTree) Register(r *mux.Router, root *mux.Router, basicAuth func(htt
 	r.Handle("/fs/{type}/{name}/_tree_blobs", basicAuth(http.HandlerFunc(ft.treeBlobsHandler())))
 	r.Handle("/fs/{type}/{name}/_tgz", basicAuth(http.HandlerFunc(ft.tgzHandler())))
 	r.Handle("/fs/{type}/{name}/_create", basicAuth(http.HandlerFunc(ft.fsCreateHandler())))
+	r.Handle("/fs/{type}/{name}/_merge", basicAuth(http.HandlerFunc(ft.mergeHandler())))
+	r.Handle("/fs/{type}/{name}/_sync", basicAuth(http.HandlerFunc(ft.fsSyncHandler())))
+	r.Handle("/fs/{type}/{name}/_tags", basicAuth(http.HandlerFunc(ft.tagsHandler())))
+	r.Handle("/fs/{type}/{name}/_manifest", basicAuth(http.HandlerFunc(ft.manifestHandler())))
+	r.Handle("/fs/{type}/{name}/_append", basicAuth(http.HandlerFunc(ft.appendHandler())))
+	r.Handle("/fs/{type}/{name}/_copy", basicAuth(http.HandlerFunc(ft.copyHandler(false))))
+	r.Handle("/fs/{type}/{name}/_move", basicAuth(http.HandlerFunc(ft.copyHandler(true))))
+	r.Handle("/fs/{type}/{name}/_import", basicAuth(http.HandlerFunc(ft.importHandler())))
+	r.Handle("/fs/{type}/{name}/_materialize", basicAuth(http.HandlerFunc(ft.materializeHandler())))
+	r.Handle("/fs/{type}/{name}/_upload_link", basicAuth(http.HandlerFunc(ft.uploadLinkHandler())))
+	r.Handle("/fs/{type}/{name}/_trash", basicAuth(http.HandlerFunc(ft.trashHandler())))
+	r.Handle("/fs/{type}/{name}/_trash/{id}", basicAuth(http.HandlerFunc(ft.trashEntryHandler())))
+	r.Handle("/fs/{type}/{name}/_trash/{id}/_restore", basicAuth(http.HandlerFunc(ft.trashRestoreHandler())))
 	r.Handle("/fs/{type}/{name}/", basicAuth(http.HandlerFunc(ft.fsHandler())))
 	r.Handle("/fs/{type}/{name}/{path:.+}", basicAuth(http.HandlerFunc(ft.fsHandler())))
 	// r.Handle("/fs", http.HandlerFunc(ft.fsHandler()))
@@ -338,6 +397,8 @@ func (ft *FileTree) Register(r *mux.Router, root *mux.Router, basicAuth func(htt
 	root.Handle("/f/{ref}", fileHandler)
 	root.Handle("/w/{ref}.{ext}", http.HandlerFunc(ft.webmHandler()))
 	root.Handle("/tgz/{ref}", http.HandlerFunc(ft.nodeTgzHandler())) // support bewit, no basic auth middleware
+	// Public upload links (bewit signed, no basic auth middleware)
+	root.Handle("/up/{name}", http.HandlerFunc(ft.publicUploadHandler()))
 }
 
 // Node holds the data about the file node (either file/dir), analog to a Meta
@@ -345,6 +406,7 @@ type Node struct {
 	Name          string  `json:"name" msgpack:"n"`
 	Type          string  `json:"type" msgpack:"t"`
 	FileType      string  `json:"file_type,omitempty" msgpack:"ft,omitempty"`
+	ContentType   string  `json:"content_type,omitempty" msgpack:"cty,omitempty"`
 	Size          int     `json:"size,omitempty" msgpack:"s,omitempty"`
 	Mode          int     `json:"mode,omitempty" msgpack:"mo,omitempty"`
 	ModTime       string  `json:"mtime" msgpack:"mt"`
@@ -353,6 +415,7 @@ type Node struct {
 	Hash          string  `json:"ref" msgpack:"r"`
 	Children      []*Node `json:"children,omitempty" msgpack:"c,omitempty"`
 	ChildrenCount int     `json:"children_count,omitempty" msgpack:"cc,omitempty"`
+	FilesCount    int     `json:"files_count,omitempty" msgpack:"fc,omitempty"`
 
 	// FIXME(ts): rename to Metadata
 	Data map[string]interface{} `json:"metadata,omitempty" msgpack:"md,omitempty"`
@@ -364,10 +427,41 @@ type Node struct {
 
 	URL  string            `json:"url,omitempty" msgpack:"u,omitempty"`
 	URLs map[string]string `json:"urls,omitempty" msgpack:"us,omitempty"`
+
+	// Deduplication stats of the upload that created the node
+	UploadStats *writer.WriteStats `json:"upload_stats,omitempty" msgpack:"-"`
+}
+
+// putRoot saves the new root of a FS along with the snapshot (signed if a signing key is set), the nodes under WORM
+// retention can't be deleted/overwritten by the new root (enforced by the kvstore layer, see `CheckKvWrite`)
+func (ft *FileTree) putRoot(ctx context.Context, key, ref string, snap *Snapshot) (*vkv.KeyValue, error) {
+	// The version is part of the signature, and it must be greater than the current one to become the latest version
+	version := clock.Now().UTC().UnixNano()
+	cur, err := ft.kvStore.Get(ctx, key, -1)
+	switch err {
+	case nil:
+		if version <= cur.Version {
+			version = cur.Version + 1
+		}
+	case vkv.ErrNotFound:
+	default:
+		return nil, err
+	}
+	snap.Signature = signing.Sign(key, ref, version)
+	snapEncoded, err := msgpack.Marshal(snap)
+	if err != nil {
+		return nil, err
+	}
+	return ft.kvStore.Put(ctx, key, ref, snapEncoded, version)
 }
 
 // Update the given node with the given meta, the updated/new node is assumed to be already saved
-func (ft *FileTree) Update(ctx context.Context, snap *Snapshot, n *Node, m *rnode.RawNode, prefixFmt string, first bool) (*Node, int64, error) {
+func (ft *FileTree) Update(ctx context.Context, snap *Snapshot, n *Node, m *rnode.RawNode, prefixFmt string, first bool) (_ *Node, _ int64, err error) {
+	ctx, span := trace.Start(ctx, "filetree.Update", "name", m.Name, "hash", m.Hash, "first", first)
+	defer func() {
+		span.SetError(err)
+		span.Finish()
+	}()
 	newNode, err := ft.metaToNode(ctx, m)
 	if err != nil {
 		return nil, 0, err
@@ -391,11 +485,7 @@ func (ft *FileTree) Update(ctx context.Context, snap *Snapshot, n *Node, m *rnod
 		if h, ok := ctxutil.FileTreeHostname(ctx); ok {
 			snap.Hostname = h
 		}
-		snapEncoded, err := msgpack.Marshal(snap)
-		if err != nil {
-			return nil, 0, err
-		}
-		newRev, err := ft.kvStore.Put(ctx, fmt.Sprintf(prefixFmt, n.fs.Name), newNode.Hash, snapEncoded, -1)
+		newRev, err := ft.putRoot(ctx, fmt.Sprintf(prefixFmt, n.fs.Name), newNode.Hash, snap)
 		if err != nil {
 			return nil, 0, err
 		}
@@ -435,6 +525,9 @@ func (ft *FileTree) Update(ctx context.Context, snap *Snapshot, n *Node, m *rnod
 	// parentMeta.Refs = newRefs
 	// n.parent.Children = newChildren
 
+	if err := ft.updateDirStats(ctx, newNode.parent); err != nil {
+		return nil, 0, err
+	}
 	newRef, data := newNode.parent.Meta.Encode()
 	newNode.parent.Hash = newRef
 	newNode.parent.Meta.Hash = newRef
@@ -490,6 +583,9 @@ func (ft *FileTree) AddChild(ctx context.Context, snap *Snapshot, n *Node, newCh
 	}
 
 	// Save the new node (the updated dir)
+	if err := ft.updateDirStats(ctx, n); err != nil {
+		return nil, 0, err
+	}
 	newRef, data := n.Meta.Encode()
 	n.Hash = newRef
 	n.Meta.Hash = newRef
@@ -522,6 +618,9 @@ func (ft *FileTree) Delete(ctx context.Context, snap *Snapshot, n *Node, prefixF
 	parent.Meta.Refs = newRefs
 	parent.Children = newChildren
 	parent.ChildrenCount = len(newChildren)
+	if err := ft.updateDirStats(ctx, parent); err != nil {
+		return nil, 0, err
+	}
 	newRef, data := parent.Meta.Encode()
 	parent.Hash = newRef
 	parent.Meta.Hash = newRef
@@ -532,6 +631,13 @@ func (ft *FileTree) Delete(ctx context.Context, snap *Snapshot, n *Node, prefixF
 	return ft.Update(ctx, snap, parent, parent.Meta, prefixFmt, true)
 }
 
+// fileReader returns a reader for the file, with read-ahead enabled
+func (ft *FileTree) fileReader(ctx context.Context, m *rnode.RawNode) *filereader.File {
+	f := filereader.NewFile(ctx, ft.blobStore, m, nil)
+	f.SetReadAhead(ft.chunkCache, ft.conf.FiletreeReadAhead())
+	return f
+}
+
 func (n *Node) Close() error {
 	return nil
 }
@@ -562,7 +668,12 @@ func (ft *FileTree) metaToNode(ctx context.Context, m *rnode.RawNode) (*Node, er
 	if n.Type == rnode.Dir {
 		n.ChildrenCount = len(m.Refs)
 		n.Mode = int(os.FileMode(n.Mode) | os.ModeDir)
+		if m.DirStats != nil {
+			n.Size = int(m.DirStats.Size)
+			n.FilesCount = m.DirStats.FilesCount
+		}
 	} else {
+		n.ContentType = m.ContentType()
 		n.FileType = FTBinary
 		if imginfo.IsImage(m.Name) {
 			n.FileType = FTImage
@@ -704,40 +815,72 @@ func (ft *FileTree) BFS(ctx context.Context, root *Node, fn func(*Node) (bool, e
 
 // fetchDir recursively fetch dir children
 func (ft *FileTree) fetchDir(ctx context.Context, n *Node, depth, maxDepth int) error {
-	if depth > maxDepth {
-		return nil
+	_, err := ft.fetchDirPage(ctx, n, depth, maxDepth, "", 0)
+	return err
+}
+
+// fetchDirPage recursively fetch dir children (sorted by name), only the children after `cursor` (a child name)
+// are fetched, and at most `limit` children per dir (0 for no limit), returns true if there's more children
+func (ft *FileTree) fetchDirPage(ctx context.Context, n *Node, depth, maxDepth int, cursor string, limit int) (bool, error) {
+	if depth > maxDepth || n.Type != rnode.Dir {
+		return false, nil
+	}
+	// Only fetch the raw nodes to sort the children, the (more expensive) info is only fetched for the page
+	metas := []*rnode.RawNode{}
+	for _, ref := range n.Meta.Refs {
+		m, err := ft.rawNode(ctx, ref.(string))
+		if err != nil {
+			return false, err
+		}
+		metas = append(metas, m)
+	}
+	sort.Slice(metas, func(i, j int) bool {
+		return metas[i].Name < metas[j].Name
+	})
+	if cursor != "" {
+		metas = metas[sort.Search(len(metas), func(i int) bool { return metas[i].Name > cursor }):]
+	}
+	var hasMore bool
+	if limit > 0 && len(metas) > limit {
+		metas = metas[:limit]
+		hasMore = true
 	}
-	if n.Type == rnode.Dir {
-		n.Children = []*Node{}
-		for _, ref := range n.Meta.Refs {
-			cn, err := ft.nodeByRef(ctx, ref.(string))
-			if err != nil {
-				return err
-			}
-			if cn.Type == "file" {
-				// FIXME(tsileo): init the new file in fetchInfo and only if needed
-				f := filereader.NewFile(ctx, ft.blobStore, cn.Meta, nil)
-				defer f.Close()
 
-				info, err := ft.fetchInfo(f, cn.Meta.Name, cn.Meta.Hash, cn.Meta.ContentHash)
-				if err != nil {
-					panic(err)
-				}
-				cn.Info = info
-			}
+	n.Children = []*Node{}
+	for _, m := range metas {
+		cn, err := ft.metaToNode(ctx, m)
+		if err != nil {
+			return false, err
+		}
+		if cn.Type == "file" {
+			// FIXME(tsileo): init the new file in fetchInfo and only if needed
+			f := ft.fileReader(ctx, cn.Meta)
+			defer f.Close()
 
-			n.Children = append(n.Children, cn)
-			if err := ft.fetchDir(ctx, cn, depth+1, maxDepth); err != nil {
-				return err
+			info, err := ft.fetchInfo(f, cn.Meta.Name, cn.Meta.Hash, cn.Meta.ContentHash)
+			if err != nil {
+				panic(err)
 			}
+			cn.Info = info
+		}
+
+		n.Children = append(n.Children, cn)
+		if _, err := ft.fetchDirPage(ctx, cn, depth+1, maxDepth, "", limit); err != nil {
+			return false, err
 		}
 	}
 
-	sort.Slice(n.Children, func(i, j int) bool {
-		return n.Children[i].Meta.Name < n.Children[j].Meta.Name
-	})
+	return hasMore, nil
+}
 
-	return nil
+// setPagination outputs the children pagination headers
+func setPagination(w http.ResponseWriter, n *Node, hasMore bool) {
+	var cursor string
+	if len(n.Children) > 0 {
+		cursor = n.Children[len(n.Children)-1].Name
+	}
+	w.Header().Set("BlobStash-FileTree-Cursor", cursor)
+	w.Header().Set("BlobStash-FileTree-Has-More", strconv.FormatBool(hasMore))
 }
 
 // Commit duplicate the last snapshot and add a commit message
@@ -752,11 +895,7 @@ func (fs *FS) commit(ctx context.Context, prefixFmt, message string) (int64, err
 	}
 	snap.Message = message
 
-	snapEncoded, err := msgpack.Marshal(snap)
-	if err != nil {
-		return 0, err
-	}
-	newRev, err := fs.ft.kvStore.Put(ctx, fmt.Sprintf(prefixFmt, fs.Name), kv.HexHash(), snapEncoded, -1)
+	newRev, err := fs.ft.putRoot(ctx, fmt.Sprintf(prefixFmt, fs.Name), kv.HexHash(), snap)
 	if err != nil {
 		return 0, err
 	}
@@ -944,7 +1083,7 @@ func (fs *FS) Path(ctx context.Context, path string, depth int, create bool, mti
 func (ft *FileTree) uploadHandler() func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "POST" {
-			w.WriteHeader(http.StatusMethodNotAllowed)
+			httputil.WriteErrorStatus(w, http.StatusMethodNotAllowed)
 			return
 		}
 		ctx := ctxutil.WithNamespace(r.Context(), r.Header.Get(ctxutil.NamespaceHeader))
@@ -968,7 +1107,11 @@ func (ft *FileTree) uploadHandler() func(http.ResponseWriter, *http.Request) {
 			panic(err)
 		}
 		defer file.Close()
-		uploader := writer.NewUploader(&BlobStore{ft.blobStore, ctx})
+		uploader, err := ft.newUploader(ctx, "*", r.URL.Query())
+		if err != nil {
+			httputil.WriteJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
 		fdata, err := ioutil.ReadAll(file)
 		if err != nil {
 			panic(err)
@@ -1065,14 +1208,15 @@ func (ft *FileTree) fetchInfo(reader io.ReadSeeker, filename, hash, contentHash
 func (ft *FileTree) fsRootHandler() func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "GET" {
-			w.WriteHeader(http.StatusMethodNotAllowed)
+			httputil.WriteErrorStatus(w, http.StatusMethodNotAllowed)
 			return
 		}
 		ctx := ctxutil.WithNamespace(r.Context(), r.Header.Get(ctxutil.NamespaceHeader))
 
 		nodes := []*Node{}
 
-		prefix := r.URL.Query().Get("prefix")
+		// Only list the FS of the tenant
+		prefix := tenant.Name(r, r.URL.Query().Get("prefix"))
 		it, err := ft.IterFS(ctx, prefix)
 		if err != nil {
 			panic(err)
@@ -1091,8 +1235,8 @@ func (ft *FileTree) fsRootHandler() func(http.ResponseWriter, *http.Request) {
 }
 
 type FSInfo struct {
-	Name string
-	Ref  string
+	Name string `json:"name"`
+	Ref  string `json:"ref"`
 }
 
 func (ft *FileTree) IterFS(ctx context.Context, start string) ([]*FSInfo, error) {
@@ -1121,7 +1265,7 @@ func fixPath(p string) string {
 func (ft *FileTree) versionsHandler() func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "GET" {
-			w.WriteHeader(http.StatusMethodNotAllowed)
+			httputil.WriteErrorStatus(w, http.StatusMethodNotAllowed)
 
 		}
 		ctx := ctxutil.WithNamespace(r.Context(), r.Header.Get(ctxutil.NamespaceHeader))
@@ -1148,7 +1292,7 @@ func (ft *FileTree) versionsHandler() func(http.ResponseWriter, *http.Request) {
 				panic(err)
 			}
 		default:
-			panic(fmt.Errorf("Unknown type \"%s\"", refType))
+			panic(httputil.Errorf(http.StatusBadRequest, "unknown type %q", refType))
 		}
 
 		q := httputil.NewQuery(r.URL.Query())
@@ -1220,9 +1364,9 @@ func (ft *FileTree) LuaFSVersions(name string) ([]*Snapshot, error) {
 func (ft *FileTree) commitHandler() func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "POST" {
-			w.WriteHeader(http.StatusMethodNotAllowed)
+			httputil.WriteErrorStatus(w, http.StatusMethodNotAllowed)
 		}
-		ctx := r.Context()
+		ctx := ctxutil.WithNamespace(r.Context(), r.Header.Get(ctxutil.NamespaceHeader))
 
 		vars := mux.Vars(r)
 		fsName := vars["name"]
@@ -1246,7 +1390,7 @@ func (ft *FileTree) commitHandler() func(http.ResponseWriter, *http.Request) {
 				panic(err)
 			}
 		default:
-			panic(fmt.Errorf("Unknown type \"%s\"", refType))
+			panic(httputil.Errorf(http.StatusBadRequest, "unknown type %q", refType))
 		}
 
 		message, err := httputil.Read(r)
@@ -1292,7 +1436,16 @@ func (ft *FileTree) fsHandler() func(http.ResponseWriter, *http.Request) {
 		if err != nil {
 			panic(err)
 		}
-		depth, err := q.GetInt("depth", 1, 5)
+		depth, err := q.GetInt("depth", 1, ft.conf.FiletreeMaxDepth())
+		if err != nil {
+			panic(err)
+		}
+		limit, err := q.GetInt("limit", ft.conf.FiletreeMaxLimit(), ft.conf.FiletreeMaxLimit())
+		if err != nil {
+			panic(err)
+		}
+		cursor := q.Get("cursor")
+		du, err := q.GetBoolDefault("du", false)
 		if err != nil {
 			panic(err)
 		}
@@ -1309,21 +1462,36 @@ func (ft *FileTree) fsHandler() func(http.ResponseWriter, *http.Request) {
 			if err != nil {
 				panic(err)
 			}
+		case "tag":
+			fs, err = ft.TaggedFS(ctx, fsName)
+			switch err {
+			case nil:
+			case ErrTagNotFound:
+				httputil.WriteErrorStatus(w, http.StatusNotFound)
+				return
+			default:
+				panic(err)
+			}
 		default:
-			panic(fmt.Errorf("Unknown type \"%s\"", refType))
+			panic(httputil.Errorf(http.StatusBadRequest, "unknown type %q", refType))
+		}
+		// Tags are read-only
+		if refType == "tag" && r.Method != "GET" && r.Method != "HEAD" {
+			httputil.WriteErrorStatus(w, http.StatusMethodNotAllowed)
+			return
 		}
 		switch r.Method {
 		case "GET", "HEAD":
-			node, _, _, err := fs.Path(ctx, path, depth, false, mtime)
+			node, _, _, err := fs.Path(ctx, path, 0, false, mtime)
 			switch err {
 			case nil:
 			case clientutil.ErrBlobNotFound:
 				// Returns a 404 if the blob/children is not found
-				w.WriteHeader(http.StatusNotFound)
+				httputil.WriteErrorStatus(w, http.StatusNotFound)
 				return
 			case blobsfile.ErrBlobNotFound:
 				// Returns a 404 if the blob/children is not found
-				w.WriteHeader(http.StatusNotFound)
+				httputil.WriteErrorStatus(w, http.StatusNotFound)
 				return
 			default:
 				panic(fmt.Errorf("failed to get path: %v", err))
@@ -1337,9 +1505,34 @@ func (ft *FileTree) fsHandler() func(http.ResponseWriter, *http.Request) {
 				return
 			}
 
+			// Re-fetch the children with the requested depth/page (`Path` only fetched the first level)
+			if node.Type == rnode.Dir && !du {
+				hasMore, err := ft.fetchDirPage(ctx, node, 1, depth, cursor, limit)
+				if err != nil {
+					panic(err)
+				}
+				setPagination(w, node, hasMore)
+			}
+
+			// Only returns the cumulative size of the subtree
+			if du {
+				stats, err := ft.du(ctx, node.Meta)
+				if err != nil {
+					panic(err)
+				}
+				httputil.MarshalAndWrite(r, w, map[string]interface{}{
+					"ref":         node.Hash,
+					"path":        path,
+					"size":        stats.Size,
+					"files_count": stats.FilesCount,
+					"dirs_count":  stats.DirsCount,
+				})
+				return
+			}
+
 			if node.Type == "file" {
 				// FIXME(tsileo): init the new file in fetchInfo and only if needed
-				f := filereader.NewFile(ctx, ft.blobStore, node.Meta, nil)
+				f := ft.fileReader(ctx, node.Meta)
 				defer f.Close()
 
 				fmt.Printf("METAMAETA=%+v\n", node.Meta)
@@ -1363,25 +1556,43 @@ func (ft *FileTree) fsHandler() func(http.ResponseWriter, *http.Request) {
 
 			if hash := r.Header.Get("If-Match"); hash != "" {
 				if node.Hash != hash {
-					w.WriteHeader(http.StatusPreconditionFailed)
+					httputil.WriteErrorStatus(w, http.StatusPreconditionFailed)
 					return
 				}
 			}
+			if !created {
+				if err := ft.checkRetention(ctx, fs.Name, path, node.Hash); err != nil {
+					panic(err)
+				}
+			}
+
+			limit, err := ft.uploadLimit(ctx, fs.Name, node)
+			if err != nil {
+				panic(err)
+			}
 
 			// fmt.Printf("Current node:%v %+v %+v\n", path, node, node.meta)
 			// fmt.Printf("Current node parent:%+v %+v\n", node.parent, node.parent.meta)
 			r.ParseMultipartForm(MaxUploadSize)
-			file, _, err := r.FormFile("file")
+			file, header, err := r.FormFile("file")
 			if err != nil {
 				panic(err)
 			}
 			defer file.Close()
-			uploader := writer.NewUploader(&BlobStore{ft.blobStore, ctx})
+			if err := limit.check(header.Size, true); err != nil {
+				panic(err)
+			}
+			uploader, err := ft.newUploader(ctx, fs.Name, r.URL.Query())
+			if err != nil {
+				httputil.WriteJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			limit.apply(uploader)
 
 			// Create/save me Meta
 			meta, err := uploader.PutReader(filepath.Base(path), file, nil)
 			if err != nil {
-				panic(err)
+				panic(limit.error(err))
 			}
 			meta.ModTime = mtime
 			fmt.Printf("new meta=%+v\n", meta)
@@ -1395,6 +1606,7 @@ func (ft *FileTree) fsHandler() func(http.ResponseWriter, *http.Request) {
 			}
 
 			w.Header().Add("BlobStash-Filetree-FS-Revision", strconv.FormatInt(revision, 10))
+			newNode.UploadStats = uploader.Stats()
 
 			// Event handling for the oplog
 			evtType := "file-updated"
@@ -1430,18 +1642,18 @@ func (ft *FileTree) fsHandler() func(http.ResponseWriter, *http.Request) {
 			node, _, _, err := fs.Path(ctx, path, 1, true, mtime)
 			if err != nil {
 				if err == blobsfile.ErrBlobNotFound {
-					w.WriteHeader(http.StatusNotFound)
+					httputil.WriteErrorStatus(w, http.StatusNotFound)
 					return
 				}
 				panic(err)
 			}
 			if node.Type != rnode.Dir {
-				panic("only dir can be patched")
+				panic(httputil.NewError(http.StatusBadRequest, "only dir can be patched"))
 			}
 
 			if hash := r.Header.Get("If-Match"); hash != "" {
 				if node.Hash != hash {
-					w.WriteHeader(http.StatusPreconditionFailed)
+					httputil.WriteErrorStatus(w, http.StatusPreconditionFailed)
 					return
 				}
 			}
@@ -1460,8 +1672,7 @@ func (ft *FileTree) fsHandler() func(http.ResponseWriter, *http.Request) {
 				}
 
 				if newChild == nil {
-					// FIXME(tsileo): return a 404
-					panic("cannot find node for patching")
+					panic(httputil.NewError(http.StatusNotFound, "cannot find node for patching"))
 				}
 
 				if newName := r.Header.Get("BlobStash-Filetree-Patch-Name"); newName != "" {
@@ -1500,6 +1711,11 @@ func (ft *FileTree) fsHandler() func(http.ResponseWriter, *http.Request) {
 				newChild.ChangeTime = 0
 			}
 
+			// A renamed node is already counted in the FS total size
+			if err := ft.checkAddLimit(ctx, fs.Name, node, newChild, rename); err != nil {
+				panic(err)
+			}
+
 			// FIXME(tsileo): add a &Snapshot{}
 			newNode, revision, err := ft.AddChild(ctx, nil, node, newChild, prefixFmt, mtime)
 			if err != nil {
@@ -1526,24 +1742,37 @@ func (ft *FileTree) fsHandler() func(http.ResponseWriter, *http.Request) {
 		case "DELETE":
 			// Delete the node
 			node, _, _, err := fs.Path(ctx, path, 1, false, mtime)
-			if err != nil {
-				if err == blobsfile.ErrBlobNotFound {
-					w.WriteHeader(http.StatusNotFound)
-					return
-				}
-				// FIXME FIXME FIXME
-				w.WriteHeader(http.StatusNotFound)
+			switch err {
+			case nil:
+			case clientutil.ErrBlobNotFound, blobsfile.ErrBlobNotFound:
+				httputil.WriteErrorStatus(w, http.StatusNotFound)
 				return
-				//panic(err)
+			default:
+				panic(err)
 			}
 
 			if hash := r.Header.Get("If-Match"); hash != "" {
 				if node.Hash != hash {
-					w.WriteHeader(http.StatusPreconditionFailed)
+					httputil.WriteErrorStatus(w, http.StatusPreconditionFailed)
 					return
 				}
 			}
 
+			// Keep the node in the trash (unless a permanent delete is requested)
+			permanent, err := q.GetBoolDefault("permanent", false)
+			if err != nil {
+				panic(err)
+			}
+			if retention := ft.conf.FiletreeTrashRetention(fs.Name); retention > 0 && !permanent && refType == "fs" && prefixFmt == FSKeyFmt {
+				// Check the retention before, the trash entry would be left behind if the delete is refused
+				if err := ft.checkRetention(ctx, fs.Name, path, node.Hash); err != nil {
+					panic(err)
+				}
+				if _, err := ft.moveToTrash(ctx, fs.Name, path, node, retention); err != nil {
+					panic(err)
+				}
+			}
+
 			// FIXME(tsileo): add a &Snapshot{} !
 			_, revision, err := ft.Delete(ctx, nil, node, prefixFmt, mtime)
 			if err != nil {
@@ -1568,7 +1797,7 @@ func (ft *FileTree) fsHandler() func(http.ResponseWriter, *http.Request) {
 			return
 
 		default:
-			w.WriteHeader(http.StatusMethodNotAllowed)
+			httputil.WriteErrorStatus(w, http.StatusMethodNotAllowed)
 			return
 		}
 	}
@@ -1601,7 +1830,7 @@ func (ft *FileTree) CreateFS(ctx context.Context, fsName, prefixFmt string) (*No
 func (ft *FileTree) fsCreateHandler() func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "POST" {
-			w.WriteHeader(http.StatusMethodNotAllowed)
+			httputil.WriteErrorStatus(w, http.StatusMethodNotAllowed)
 			return
 		}
 
@@ -1614,7 +1843,7 @@ func (ft *FileTree) fsCreateHandler() func(http.ResponseWriter, *http.Request) {
 		fsName := vars["name"]
 		refType := vars["type"]
 		if refType != "fs" {
-			panic("bad ref type")
+			panic(httputil.NewError(http.StatusBadRequest, "bad ref type"))
 		}
 		prefixFmt := FSKeyFmt
 		if p := r.URL.Query().Get("prefix"); p != "" {
@@ -1664,8 +1893,18 @@ func (ft *FileTree) tgzHandler() func(http.ResponseWriter, *http.Request) {
 			if err != nil {
 				panic(err)
 			}
+		case "tag":
+			fs, err = ft.TaggedFS(ctx, fsName)
+			switch err {
+			case nil:
+			case ErrTagNotFound:
+				notFound(w)
+				return
+			default:
+				panic(err)
+			}
 		default:
-			panic(fmt.Errorf("Unknown type \"%s\"", refType))
+			panic(httputil.Errorf(http.StatusBadRequest, "unknown type %q", refType))
 		}
 		switch r.Method {
 		case "GET", "HEAD":
@@ -1674,11 +1913,11 @@ func (ft *FileTree) tgzHandler() func(http.ResponseWriter, *http.Request) {
 			case nil:
 			case clientutil.ErrBlobNotFound:
 				// Returns a 404 if the blob/children is not found
-				w.WriteHeader(http.StatusNotFound)
+				httputil.WriteErrorStatus(w, http.StatusNotFound)
 				return
 			case blobsfile.ErrBlobNotFound:
 				// Returns a 404 if the blob/children is not found
-				w.WriteHeader(http.StatusNotFound)
+				httputil.WriteErrorStatus(w, http.StatusNotFound)
 				return
 			default:
 				panic(fmt.Errorf("failed to get path: %v", err))
@@ -1739,7 +1978,7 @@ func (ft *FileTree) tgzHandler() func(http.ResponseWriter, *http.Request) {
 
 func (ft *FileTree) treeBlobsHandler() func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		ctx := context.Background()
+		ctx := ctxutil.WithNamespace(r.Context(), r.Header.Get(ctxutil.NamespaceHeader))
 		vars := mux.Vars(r)
 		fsName := vars["name"]
 		path := "/" + vars["path"]
@@ -1750,7 +1989,7 @@ func (ft *FileTree) treeBlobsHandler() func(http.ResponseWriter, *http.Request)
 		}
 
 		if path != "/" {
-			panic("can only tree blobs the root path")
+			panic(httputil.NewError(http.StatusBadRequest, "can only tree blobs the root path"))
 		}
 
 		var asOf int64
@@ -1774,8 +2013,18 @@ func (ft *FileTree) treeBlobsHandler() func(http.ResponseWriter, *http.Request)
 			if err != nil {
 				panic(err)
 			}
+		case "tag":
+			fs, err = ft.TaggedFS(ctx, fsName)
+			switch err {
+			case nil:
+			case ErrTagNotFound:
+				notFound(w)
+				return
+			default:
+				panic(err)
+			}
 		default:
-			panic(fmt.Errorf("Unknown type \"%s\"", refType))
+			panic(httputil.Errorf(http.StatusBadRequest, "unknown type %q", refType))
 		}
 
 		node, _, _, err := fs.Path(ctx, "/", 1, false, 0)
@@ -1839,11 +2088,21 @@ func (ft *FileTree) webmHandler() func(http.ResponseWriter, *http.Request) {
 		if !authorized {
 			// Try if an API key is provided
 			ft.log.Info("before authFunc")
-			if !ft.authFunc(r) {
+			if !ft.apiKeyAuth(r) {
 				// Rreturns a 404 to prevent leak of hashes
 				notFound(w)
 				return
 			}
+			// The video is only served if the node can be read in the namespace (a tenant can only read its own)
+			ctx := ctxutil.WithNamespace(r.Context(), r.Header.Get(ctxutil.NamespaceHeader))
+			exists, err := ft.blobStore.Stat(ctx, hash)
+			if err != nil {
+				panic(err)
+			}
+			if !exists {
+				notFound(w)
+				return
+			}
 		}
 		webmPath := filepath.Join(ft.conf.VidDir(), fmt.Sprintf("%s.%s", hash, ext))
 		fmt.Printf("webmPath=%s\n", webmPath)
@@ -1856,6 +2115,18 @@ func (ft *FileTree) webmHandler() func(http.ResponseWriter, *http.Request) {
 	}
 }
 
+// apiKeyAuth authenticates the request with an API key, for the handlers not behind the auth middleware (as they also
+// accept a bewit), the requests of a tenant are scoped to its namespace like with the middleware
+func (ft *FileTree) apiKeyAuth(r *http.Request) bool {
+	if !ft.authFunc(r) {
+		return false
+	}
+	if t := tenant.FromRequest(r); t != "" {
+		tenant.Enforce(r, t)
+	}
+	return true
+}
+
 // fileHandler serve the Meta like it's a standard file
 func (ft *FileTree) fileHandler() func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -1885,16 +2156,18 @@ func (ft *FileTree) serveFile(ctx context.Context, w http.ResponseWriter, r *htt
 	if !authorized {
 		// Try if an API key is provided
 		ft.log.Info("before authFunc")
-		if !ft.authFunc(r) {
+		if !ft.apiKeyAuth(r) {
 			// Rreturns a 404 to prevent leak of hashes
 			notFound(w)
 			return
 		}
+		// The namespace may have been scoped to the tenant of the API key
+		ctx = ctxutil.WithNamespace(ctx, r.Header.Get(ctxutil.NamespaceHeader))
 	}
 
 	blob, err := ft.blobStore.Get(ctx, hash)
 	if err != nil {
-		if err == clientutil.ErrBlobNotFound {
+		if err == clientutil.ErrBlobNotFound || err == blobsfile.ErrBlobNotFound {
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
@@ -1907,13 +2180,31 @@ func (ft *FileTree) serveFile(ctx context.Context, w http.ResponseWriter, r *htt
 	}
 
 	if !m.IsFile() {
-		panic(httputil.NewPublicErrorFmt("node is not a file (%s)", m.Type))
+		panic(httputil.Errorf(http.StatusBadRequest, "node is not a file (%s)", m.Type))
+	}
+
+	// Strong validator derived from the content (the resized images are a different representation)
+	etag := m.ContentHash
+	if etag == "" {
+		etag = m.Hash
+	}
+	if width := r.URL.Query().Get("w"); width != "" {
+		etag = etag + "-w" + width
+	}
+	etag = strconv.Quote(etag)
+	w.Header().Set("ETag", etag)
+
+	// Skip the file reading (and the resizing) if the client already has the content, `http.ServeContent` will
+	// handle the other conditional requests
+	if etagMatch(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
 	}
 
 	// Initialize a new `File`
 	var f io.ReadSeeker
 	// FIXME(tsileo): ctx
-	f = filereader.NewFile(ctx, ft.blobStore, m, nil)
+	f = ft.fileReader(ctx, m)
 
 	// Check if the file is requested for download (?dl=1)
 	httputil.SetAttachment(m.Name, r, w)
@@ -1925,17 +2216,37 @@ func (ft *FileTree) serveFile(ctx context.Context, w http.ResponseWriter, r *htt
 		panic(err)
 	}
 
+	// No `Last-Modified` (and `If-Modified-Since` support) if the mtime is unknown
 	var mtime time.Time
 	if m.ModTime > 0 {
 		mtime = time.Unix(m.ModTime, 0)
-	} else {
-		mtime = time.Now()
+	}
+
+	// Use the MIME type detected at upload (`http.ServeContent` falls back to the extension/sniffing if empty)
+	if ct := m.ContentType(); ct != "" && w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", ct)
 	}
 
 	// Serve the file content using the same code as the `http.ServeFile` (it'll handle HEAD request)
 	http.ServeContent(w, r, m.Name, mtime, f)
 }
 
+// etagMatch returns true if the `If-None-Match` header value matches the ETag (using the weak comparison)
+func etagMatch(header, etag string) bool {
+	if header == "" {
+		return false
+	}
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
 func (ft *FileTree) publicHandler() func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "GET" && r.Method != "HEAD" {
@@ -1948,7 +2259,8 @@ func (ft *FileTree) publicHandler() func(http.ResponseWriter, *http.Request) {
 
 		vars := mux.Vars(r)
 		fsName := vars["name"]
-		path := "/public/" + vars["path"]
+		// The trailing slash of the dirs is kept in the URL path (for the listing relative links)
+		path := strings.TrimSuffix("/public/"+vars["path"], "/")
 		refType := vars["type"]
 		prefixFmt := FSKeyFmt
 		if p := r.URL.Query().Get("prefix"); p != "" {
@@ -1974,8 +2286,18 @@ func (ft *FileTree) publicHandler() func(http.ResponseWriter, *http.Request) {
 			if err != nil {
 				panic(err)
 			}
+		case "tag":
+			fs, err = ft.TaggedFS(ctx, fsName)
+			switch err {
+			case nil:
+			case ErrTagNotFound:
+				notFound(w)
+				return
+			default:
+				panic(err)
+			}
 		default:
-			panic(fmt.Errorf("Unknown type \"%s\"", refType))
+			panic(httputil.Errorf(http.StatusBadRequest, "unknown type %q", refType))
 		}
 		node, _, _, err := fs.Path(ctx, path, 1, false, mtime)
 		switch err {
@@ -1992,13 +2314,17 @@ func (ft *FileTree) publicHandler() func(http.ResponseWriter, *http.Request) {
 			panic(err)
 		}
 
-		w.Header().Set("ETag", node.Hash)
-
-		// Handle HEAD request
-		if r.Method == "HEAD" {
+		if node.Type == rnode.Dir {
+			ft.dirListing(ctx, w, r, node, r.URL.Path, fmt.Sprintf("/public/%s/%s/", refType, fsName))
 			return
 		}
 
+		// The tagged FS are referenced as `<fs>@<tag>`
+		if cc := ft.conf.FiletreeCacheControl(strings.SplitN(fsName, "@", 2)[0]); cc != "" {
+			w.Header().Set("Cache-Control", cc)
+		}
+
+		// The ETag and the HEAD requests are handled by `serveFile`
 		ft.serveFile(ctx, w, r, node.Hash, true)
 		return
 	}
@@ -2006,7 +2332,7 @@ func (ft *FileTree) publicHandler() func(http.ResponseWriter, *http.Request) {
 
 func (ft *FileTree) GetSemiPrivateLink(n *Node) (string, string, error) {
 	u := &url.URL{Path: fmt.Sprintf("/%s/%s", n.Type[0:1], n.Hash)}
-	if err := bewit.Bewit(ft.sharingCred, u, ft.shareTTL); err != nil {
+	if err := bewit.Bewit(ft.sharingCred, u, ft.ShareTTL()); err != nil {
 		panic(err)
 	}
 	return u.String() + "&dl=1", u.String() + "&dl=0", nil
@@ -2014,11 +2340,11 @@ func (ft *FileTree) GetSemiPrivateLink(n *Node) (string, string, error) {
 
 func (ft *FileTree) GetWebmLink(n *Node) (string, string, error) {
 	u := &url.URL{Path: fmt.Sprintf("/w/%s.webm", n.ContentHash)}
-	if err := bewit.Bewit(ft.sharingCred, u, ft.shareTTL); err != nil {
+	if err := bewit.Bewit(ft.sharingCred, u, ft.ShareTTL()); err != nil {
 		panic(err)
 	}
 	u1 := &url.URL{Path: fmt.Sprintf("/w/%s.jpg", n.ContentHash)}
-	if err := bewit.Bewit(ft.sharingCred, u1, ft.shareTTL); err != nil {
+	if err := bewit.Bewit(ft.sharingCred, u1, ft.ShareTTL()); err != nil {
 		panic(err)
 	}
 	return u.String(), u1.String(), nil
@@ -2026,7 +2352,7 @@ func (ft *FileTree) GetWebmLink(n *Node) (string, string, error) {
 
 func (ft *FileTree) GetTgzLink(n *Node) (string, error) {
 	u := &url.URL{Path: fmt.Sprintf("/tgz/%s", n.Hash)}
-	if err := bewit.Bewit(ft.sharingCred, u, ft.shareTTL); err != nil {
+	if err := bewit.Bewit(ft.sharingCred, u, ft.ShareTTL()); err != nil {
 		panic(err)
 	}
 	return u.String(), nil
@@ -2038,20 +2364,29 @@ func (ft *FileTree) nodeHandler() func(http.ResponseWriter, *http.Request) {
 		// Check permissions
 		// permissions.CheckPerms(r, PermName)
 
-		// TODO(tsileo): limit the max depth of the tree configurable via query args
 		if r.Method != "GET" && r.Method != "HEAD" {
-			w.WriteHeader(http.StatusMethodNotAllowed)
+			httputil.WriteErrorStatus(w, http.StatusMethodNotAllowed)
 			return
 		}
 
 		ctx := ctxutil.WithNamespace(r.Context(), r.Header.Get(ctxutil.NamespaceHeader))
 		vars := mux.Vars(r)
+		q := httputil.NewQuery(r.URL.Query())
+		depth, err := q.GetInt("depth", 1, ft.conf.FiletreeMaxDepth())
+		if err != nil {
+			panic(err)
+		}
+		limit, err := q.GetInt("limit", ft.conf.FiletreeMaxLimit(), ft.conf.FiletreeMaxLimit())
+		if err != nil {
+			panic(err)
+		}
+		cursor := q.Get("cursor")
 
 		hash := vars["ref"]
 		n, err := ft.nodeByRef(ctx, hash)
 		if err != nil {
-			if err == clientutil.ErrBlobNotFound {
-				w.WriteHeader(http.StatusNotFound)
+			if err == clientutil.ErrBlobNotFound || err == blobsfile.ErrBlobNotFound {
+				httputil.WriteErrorStatus(w, http.StatusNotFound)
 				return
 			}
 			panic(err)
@@ -2065,7 +2400,7 @@ func (ft *FileTree) nodeHandler() func(http.ResponseWriter, *http.Request) {
 		u := &url.URL{Path: fmt.Sprintf("/%s/%s", n.Type[0:1], n.Hash)}
 
 		if r.URL.Query().Get("bewit") == "1" {
-			if err := bewit.Bewit(ft.sharingCred, u, ft.shareTTL); err != nil {
+			if err := bewit.Bewit(ft.sharingCred, u, ft.ShareTTL()); err != nil {
 				panic(err)
 			}
 			w.Header().Add("BlobStash-FileTree-SemiPrivate-Path", u.String()+"&dl="+dlMode)
@@ -2077,14 +2412,16 @@ func (ft *FileTree) nodeHandler() func(http.ResponseWriter, *http.Request) {
 			return
 		}
 
-		if err := ft.fetchDir(ctx, n, 1, 1); err != nil {
+		hasMore, err := ft.fetchDirPage(ctx, n, 1, depth, cursor, limit)
+		if err != nil {
 			panic(err)
 		}
+		setPagination(w, n, hasMore)
 
 		if r.URL.Query().Get("bewit") == "1" {
 			for _, child := range n.Children {
 				u := &url.URL{Path: fmt.Sprintf("/%s/%s", child.Type[0:1], child.Hash)}
-				if err := bewit.Bewit(ft.sharingCred, u, ft.shareTTL); err != nil {
+				if err := bewit.Bewit(ft.sharingCred, u, ft.ShareTTL()); err != nil {
 					panic(err)
 				}
 				child.URL = u.String() + "&dl=" + dlMode
@@ -2093,7 +2430,7 @@ func (ft *FileTree) nodeHandler() func(http.ResponseWriter, *http.Request) {
 		}
 
 		// FIXME(tsileo): init the new file in fetchInfo and only if needed
-		f := filereader.NewFile(ctx, ft.blobStore, n.Meta, nil)
+		f := ft.fileReader(ctx, n.Meta)
 		defer f.Close()
 
 		info, err := ft.fetchInfo(f, n.Meta.Name, n.Meta.Hash, n.Meta.ContentHash)
@@ -2104,7 +2441,7 @@ func (ft *FileTree) nodeHandler() func(http.ResponseWriter, *http.Request) {
 
 		u1 := &url.URL{Path: fmt.Sprintf("/w/%s.webm", n.ContentHash)}
 
-		if err := bewit.Bewit(ft.sharingCred, u1, ft.shareTTL); err != nil {
+		if err := bewit.Bewit(ft.sharingCred, u1, ft.ShareTTL()); err != nil {
 			panic(err)
 		}
 		n.URLs = map[string]string{"webm": u1.String()}
@@ -2112,6 +2449,12 @@ func (ft *FileTree) nodeHandler() func(http.ResponseWriter, *http.Request) {
 		fmt.Printf("INFO FETCHED")
 		httputil.MarshalAndWrite(r, w, map[string]interface{}{
 			"node": n,
+			"pagination": map[string]interface{}{
+				"cursor":   w.Header().Get("BlobStash-FileTree-Cursor"),
+				"has_more": hasMore,
+				"count":    len(n.Children),
+				"per_page": limit,
+			},
 		})
 	}
 }
@@ -2141,7 +2484,7 @@ func (ft *FileTree) nodeTgzHandler() func(http.ResponseWriter, *http.Request) {
 		if !authorized {
 			// Try if an API key is provided
 			ft.log.Info("before authFunc")
-			if !ft.authFunc(r) {
+			if !ft.apiKeyAuth(r) {
 				// Rreturns a 404 to prevent leak of hashes
 				notFound(w)
 				return
@@ -2158,7 +2501,7 @@ func (ft *FileTree) nodeTgzHandler() func(http.ResponseWriter, *http.Request) {
 		//	auth.Forbidden(w)
 		//	return
 		//}
-		ctx := context.TODO()
+		ctx := ctxutil.WithNamespace(r.Context(), r.Header.Get(ctxutil.NamespaceHeader))
 		vars := mux.Vars(r)
 
 		hash := vars["ref"]
@@ -2171,7 +2514,7 @@ func (ft *FileTree) nodeTgzHandler() func(http.ResponseWriter, *http.Request) {
 			panic(err)
 		}
 		if node.Type == "file" {
-			panic("cannot snapshot a file")
+			panic(httputil.NewError(http.StatusBadRequest, "cannot snapshot a file"))
 		}
 
 		w.Header().Set("ETag", node.Hash)
@@ -2227,13 +2570,14 @@ func (ft *FileTree) nodeTgzHandler() func(http.ResponseWriter, *http.Request) {
 func (ft *FileTree) nodeSnapshotHandler() func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "POST" {
-			w.WriteHeader(http.StatusMethodNotAllowed)
+			httputil.WriteErrorStatus(w, http.StatusMethodNotAllowed)
 			return
 		}
 		sreq := &snapReq{}
 		if err := httputil.Unmarshal(r, sreq); err != nil {
 			panic(err)
 		}
+		sreq.FS = tenant.Name(r, sreq.FS)
 
 		if !auth.Can(
 			w,
@@ -2251,13 +2595,13 @@ func (ft *FileTree) nodeSnapshotHandler() func(http.ResponseWriter, *http.Reques
 		n, err := ft.nodeByRef(ctx, hash)
 		if err != nil {
 			if err == clientutil.ErrBlobNotFound {
-				w.WriteHeader(http.StatusNotFound)
+				httputil.WriteErrorStatus(w, http.StatusNotFound)
 				return
 			}
 			panic(err)
 		}
 		if n.Type == "file" {
-			panic("cannot snapshot a file")
+			panic(httputil.NewError(http.StatusBadRequest, "cannot snapshot a file"))
 		}
 
 		snap := &Snapshot{
@@ -2265,11 +2609,7 @@ func (ft *FileTree) nodeSnapshotHandler() func(http.ResponseWriter, *http.Reques
 			Hostname: sreq.Hostname,
 		}
 
-		snapEncoded, err := msgpack.Marshal(snap)
-		if err != nil {
-			panic(err)
-		}
-		newRev, err := ft.kvStore.Put(ctx, fmt.Sprintf(FSKeyFmt, sreq.FS), hash, snapEncoded, -1)
+		newRev, err := ft.putRoot(ctx, fmt.Sprintf(FSKeyFmt, sreq.FS), hash, snap)
 		if err != nil {
 			panic(err)
 		}
@@ -2308,7 +2648,7 @@ func (ft *FileTree) Node(ctx context.Context, hash string) (*Node, error) {
 		return nil, err
 	}
 
-	f := filereader.NewFile(ctx, ft.blobStore, node.Meta, nil)
+	f := ft.fileReader(ctx, node.Meta)
 	defer f.Close()
 
 	info, err := ft.fetchInfo(f, node.Meta.Name, node.Meta.Hash, node.Meta.ContentHash)
@@ -2392,7 +2732,7 @@ func (ft *FileTree) NodeWithChildren(ctx context.Context, hash string) (*Node, e
 	}
 
 	// FIXME(tsileo): init the new file in fetchInfo and only if needed
-	f := filereader.NewFile(ctx, ft.blobStore, node.Meta, nil)
+	f := ft.fileReader(ctx, node.Meta)
 	defer f.Close()
 
 	info, err := ft.fetchInfo(f, node.Meta.Name, node.Meta.Hash, node.Meta.ContentHash)
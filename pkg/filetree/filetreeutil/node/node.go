@@ -12,7 +12,8 @@ import (
 	"path/filepath"
 
 	"github.com/vmihailenco/msgpack"
-	"golang.org/x/crypto/blake2b"
+
+	"a4.io/blobstash/pkg/hashutil"
 )
 
 var (
@@ -58,6 +59,26 @@ type RawNode struct {
 	ContentHash string                 `msgpack:"ch"`
 	Metadata    map[string]interface{} `msgpack:"m,omitempty"`
 	Hash        string                 `msgpack:"-"`
+
+	// MIME type detected at upload (only for files, empty if unknown)
+	MimeType string `msgpack:"mi,omitempty"`
+
+	// Cumulative stats of the subtree (only for dirs, nil if unknown)
+	DirStats *DirStats `msgpack:"ds,omitempty"`
+}
+
+// DirStats holds the cumulative size of a directory subtree
+type DirStats struct {
+	Size       int64 `msgpack:"s" json:"size"`
+	FilesCount int   `msgpack:"fc" json:"files_count"`
+	DirsCount  int   `msgpack:"dc" json:"dirs_count"`
+}
+
+// Add adds the stats of a child node
+func (s *DirStats) Add(o *DirStats) {
+	s.Size += o.Size
+	s.FilesCount += o.FilesCount
+	s.DirsCount += o.DirsCount
 }
 
 func (n *RawNode) FileRefs() []*IndexValue {
@@ -118,7 +139,7 @@ func (n *RawNode) Encode() (string, []byte) {
 	}
 	data := append(NodeBlobHeader, NodeBlobMsgpackEncoding)
 	data = append(data, js...)
-	h := fmt.Sprintf("%x", blake2b.Sum256(data))
+	h := hashutil.Compute(data)
 	return h, data
 }
 
@@ -149,8 +170,12 @@ func NewNodeFromBlob(hash string, blob []byte) (*RawNode, error) {
 	return node, nil
 }
 
+// ContentType returns the MIME type detected at upload, or guessed from the file extension
 func (n *RawNode) ContentType() string {
 	if n.IsFile() {
+		if n.MimeType != "" {
+			return n.MimeType
+		}
 		return mime.TypeByExtension(filepath.Ext(n.Name))
 	}
 	return ""
@@ -0,0 +1,462 @@
+package filetree // import "a4.io/blobstash/pkg/filetree"
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/blob"
+	clientblobstore "a4.io/blobstash/pkg/client/blobstore"
+	"a4.io/blobstash/pkg/client/clientutil"
+	clientfiletree "a4.io/blobstash/pkg/client/filetree"
+	"a4.io/blobstash/pkg/ctxutil"
+	rnode "a4.io/blobstash/pkg/filetree/filetreeutil/node"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/perms"
+	"a4.io/blobstash/pkg/tenant"
+)
+
+// FS delta sync
+//
+// Syncs a FS with the same FS (or another one) on a remote BlobStash instance. The trees are walked from the root, and
+// the subtrees already stored on the destination (same node hash) are skipped, so only the missing node/chunk blobs of
+// the changed files are transferred. The nodes are sent bottom-up (the children before the parent), so a node stored
+// on the destination always has its full subtree.
+//
+// The FS root is only updated if the destination is an ancestor of the source (fast-forward, using the version
+// history of both sides), diverging histories are reported as conflicts (the paths modified on both sides since the
+// common ancestor), they can be resolved with a merge.
+
+// FS sync directions
+const (
+	SyncPush = "push"
+	SyncPull = "pull"
+)
+
+// FS sync status
+const (
+	SyncUpToDate    = "up-to-date"
+	SyncFastForward = "fast-forward"
+	SyncAhead       = "ahead" // the destination already contains the source
+	SyncDiverged    = "diverged"
+)
+
+// Max number of versions fetched to compare the histories
+const syncHistoryLimit = 1000
+
+// FSSyncRequest holds the FS sync options
+type FSSyncRequest struct {
+	URL       string `json:"url"`
+	APIKey    string `json:"api_key"`
+	RemoteFS  string `json:"remote_fs"` // defaults to the local FS name
+	Direction string `json:"direction"` // "push" (the default) or "pull"
+	DryRun    bool   `json:"dry_run"`
+}
+
+// FSSyncResult holds the result of a FS sync
+type FSSyncResult struct {
+	Direction string   `json:"direction"`
+	Status    string   `json:"status"`
+	LocalRef  string   `json:"local_ref"`
+	RemoteRef string   `json:"remote_ref"`
+	Base      string   `json:"base,omitempty"`
+	Ref       string   `json:"ref,omitempty"`
+	Changed   []string `json:"changed"`
+	Conflicts []string `json:"conflicts,omitempty"`
+
+	BlobsSent     int   `json:"blobs_sent"`
+	BlobsSize     int64 `json:"blobs_size"`
+	NodesSkipped  int   `json:"nodes_skipped"`
+	DurationMilli int64 `json:"duration_ms"`
+}
+
+// syncStore is one side of the sync
+type syncStore interface {
+	Get(ctx context.Context, hash string) ([]byte, error)
+	Stat(ctx context.Context, hash string) (bool, error)
+	Put(ctx context.Context, hash string, data []byte) error
+}
+
+// localSyncStore wraps the local blob store
+type localSyncStore struct {
+	ft *FileTree
+}
+
+func (s *localSyncStore) Get(ctx context.Context, hash string) ([]byte, error) {
+	return s.ft.blobStore.Get(ctx, hash)
+}
+
+func (s *localSyncStore) Stat(ctx context.Context, hash string) (bool, error) {
+	return s.ft.blobStore.Stat(ctx, hash)
+}
+
+func (s *localSyncStore) Put(ctx context.Context, hash string, data []byte) error {
+	_, err := s.ft.blobStore.Put(ctx, &blob.Blob{Hash: hash, Data: data})
+	return err
+}
+
+type fsSyncer struct {
+	src, dst syncStore
+	res      *FSSyncResult
+	dryRun   bool
+}
+
+// copyBlob copies the blob from the source to the destination (if missing)
+func (s *fsSyncer) copyBlob(ctx context.Context, hash string, data []byte) error {
+	exists, err := s.dst.Stat(ctx, hash)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+	if data == nil {
+		if data, err = s.src.Get(ctx, hash); err != nil {
+			return err
+		}
+	}
+	s.res.BlobsSent++
+	s.res.BlobsSize += int64(len(data))
+	if s.dryRun {
+		return nil
+	}
+	return s.dst.Put(ctx, hash, data)
+}
+
+// transfer copies the missing blobs of the node subtree
+func (s *fsSyncer) transfer(ctx context.Context, p, ref string) error {
+	// The subtree is already stored on the destination
+	exists, err := s.dst.Stat(ctx, ref)
+	if err != nil {
+		return err
+	}
+	if exists {
+		s.res.NodesSkipped++
+		return nil
+	}
+
+	data, err := s.src.Get(ctx, ref)
+	if err != nil {
+		return err
+	}
+	n, err := rnode.NewNodeFromBlob(ref, data)
+	if err != nil {
+		return err
+	}
+	if n.IsFile() {
+		s.res.Changed = append(s.res.Changed, p)
+		for _, iv := range n.FileRefs() {
+			if err := s.copyBlob(ctx, iv.Value, nil); err != nil {
+				return err
+			}
+		}
+	} else {
+		for _, cref := range n.Refs {
+			child, err := s.src.Get(ctx, cref.(string))
+			if err != nil {
+				return err
+			}
+			cn, err := rnode.NewNodeFromBlob(cref.(string), child)
+			if err != nil {
+				return err
+			}
+			if err := s.transfer(ctx, path.Join(p, cn.Name), cn.Hash); err != nil {
+				return err
+			}
+		}
+	}
+
+	// The node is sent last
+	return s.copyBlob(ctx, ref, data)
+}
+
+// syncChildren returns the children of a dir node (indexed by name)
+func syncChildren(ctx context.Context, bs syncStore, n *rnode.RawNode) (map[string]*rnode.RawNode, error) {
+	out := map[string]*rnode.RawNode{}
+	if n == nil || n.IsFile() {
+		return out, nil
+	}
+	for _, ref := range n.Refs {
+		data, err := bs.Get(ctx, ref.(string))
+		if err != nil {
+			return nil, err
+		}
+		child, err := rnode.NewNodeFromBlob(ref.(string), data)
+		if err != nil {
+			return nil, err
+		}
+		out[child.Name] = child
+	}
+	return out, nil
+}
+
+// changedPaths returns the paths that differ between the two trees (both stored in the given store)
+func changedPaths(ctx context.Context, bs syncStore, p string, a, b *rnode.RawNode, out map[string]struct{}) error {
+	if nodeRef(a) == nodeRef(b) {
+		return nil
+	}
+	if !isDir(a) || !isDir(b) {
+		out[p] = struct{}{}
+		return nil
+	}
+	ac, err := syncChildren(ctx, bs, a)
+	if err != nil {
+		return err
+	}
+	bc, err := syncChildren(ctx, bs, b)
+	if err != nil {
+		return err
+	}
+	for name, an := range ac {
+		if err := changedPaths(ctx, bs, path.Join(p, name), an, bc[name], out); err != nil {
+			return err
+		}
+	}
+	for name := range bc {
+		if _, ok := ac[name]; !ok {
+			out[path.Join(p, name)] = struct{}{}
+		}
+	}
+	return nil
+}
+
+// fetchSyncNode fetches a node (nil if ref is empty)
+func fetchSyncNode(ctx context.Context, bs syncStore, ref string) (*rnode.RawNode, error) {
+	if ref == "" {
+		return nil, nil
+	}
+	data, err := bs.Get(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	return rnode.NewNodeFromBlob(ref, data)
+}
+
+// conflicts returns the paths modified on both sides since the common ancestor
+func (s *fsSyncer) conflicts(ctx context.Context, base, srcRef, dstRef string) ([]string, error) {
+	srcBase, err := fetchSyncNode(ctx, s.src, base)
+	if err != nil {
+		return nil, err
+	}
+	dstBase, err := fetchSyncNode(ctx, s.dst, base)
+	if err != nil {
+		return nil, err
+	}
+	srcNode, err := fetchSyncNode(ctx, s.src, srcRef)
+	if err != nil {
+		return nil, err
+	}
+	dstNode, err := fetchSyncNode(ctx, s.dst, dstRef)
+	if err != nil {
+		return nil, err
+	}
+	srcChanges := map[string]struct{}{}
+	if err := changedPaths(ctx, s.src, "/", srcBase, srcNode, srcChanges); err != nil {
+		return nil, err
+	}
+	dstChanges := map[string]struct{}{}
+	if err := changedPaths(ctx, s.dst, "/", dstBase, dstNode, dstChanges); err != nil {
+		return nil, err
+	}
+	out := []string{}
+	for p := range srcChanges {
+		if _, ok := dstChanges[p]; ok {
+			out = append(out, p)
+		}
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// syncStatus compares the histories (newest first) of the source and the destination
+func syncStatus(srcHistory, dstHistory []string) (status, base string) {
+	var srcRef, dstRef string
+	if len(srcHistory) > 0 {
+		srcRef = srcHistory[0]
+	}
+	if len(dstHistory) > 0 {
+		dstRef = dstHistory[0]
+	}
+	if srcRef == dstRef {
+		return SyncUpToDate, srcRef
+	}
+	if dstRef == "" {
+		return SyncFastForward, ""
+	}
+	for _, ref := range srcHistory {
+		if ref == dstRef {
+			return SyncFastForward, dstRef
+		}
+	}
+	inDst := map[string]bool{}
+	for _, ref := range dstHistory {
+		inDst[ref] = true
+	}
+	if inDst[srcRef] {
+		return SyncAhead, srcRef
+	}
+	for _, ref := range srcHistory {
+		if inDst[ref] {
+			return SyncDiverged, ref
+		}
+	}
+	return SyncDiverged, ""
+}
+
+// SyncFS syncs the FS with a remote BlobStash instance
+func (ft *FileTree) SyncFS(ctx context.Context, name string, req *FSSyncRequest) (*FSSyncResult, error) {
+	start := time.Now()
+	if req.RemoteFS == "" {
+		req.RemoteFS = name
+	}
+	if req.Direction == "" {
+		req.Direction = SyncPush
+	}
+	if req.Direction != SyncPush && req.Direction != SyncPull {
+		return nil, fmt.Errorf("invalid direction %q", req.Direction)
+	}
+
+	cu := clientutil.NewClientUtil(req.URL, clientutil.WithAPIKey(req.APIKey))
+	remoteFT := clientfiletree.New(cu)
+	local := &localSyncStore{ft}
+	remote := clientblobstore.New(cu)
+
+	localHistory, err := ft.historyRefs(ctx, FSKeyFmt, name)
+	if err != nil {
+		return nil, err
+	}
+	versions, err := remoteFT.Versions(req.RemoteFS, syncHistoryLimit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch the remote versions: %w", err)
+	}
+	remoteHistory := []string{}
+	for _, v := range versions {
+		remoteHistory = append(remoteHistory, v.Ref)
+	}
+
+	res := &FSSyncResult{Direction: req.Direction, Changed: []string{}}
+	if len(localHistory) > 0 {
+		res.LocalRef = localHistory[0]
+	}
+	if len(remoteHistory) > 0 {
+		res.RemoteRef = remoteHistory[0]
+	}
+	s := &fsSyncer{res: res, dryRun: req.DryRun}
+	srcHistory, dstHistory, srcRef := localHistory, remoteHistory, res.LocalRef
+	s.src, s.dst = local, remote
+	if req.Direction == SyncPull {
+		srcHistory, dstHistory, srcRef = remoteHistory, localHistory, res.RemoteRef
+		s.src, s.dst = remote, local
+	}
+	if srcRef == "" {
+		return nil, fmt.Errorf("nothing to %s, the source FS does not exist", req.Direction)
+	}
+
+	res.Status, res.Base = syncStatus(srcHistory, dstHistory)
+	switch res.Status {
+	case SyncUpToDate, SyncAhead:
+		res.DurationMilli = time.Since(start).Milliseconds()
+		return res, nil
+	case SyncDiverged:
+		dstRef := dstHistory[0]
+		if res.Conflicts, err = s.conflicts(ctx, res.Base, srcRef, dstRef); err != nil {
+			return nil, err
+		}
+		res.DurationMilli = time.Since(start).Milliseconds()
+		return res, nil
+	}
+
+	if err := s.transfer(ctx, "/", srcRef); err != nil {
+		return nil, err
+	}
+	res.Ref = srcRef
+	if !req.DryRun {
+		message := fmt.Sprintf("sync from %s", req.URL)
+		if req.Direction == SyncPush {
+			hostname, _ := os.Hostname()
+			message = fmt.Sprintf("sync from %s", hostname)
+			if _, err := remoteFT.MakeSnapshot(srcRef, req.RemoteFS, message, "blobstash-fs-sync"); err != nil {
+				return nil, fmt.Errorf("failed to update the remote FS: %w", err)
+			}
+		} else {
+			if _, err := ft.putRoot(ctx, fmt.Sprintf(FSKeyFmt, name), srcRef, &Snapshot{Message: message}); err != nil {
+				return nil, err
+			}
+			updateEvent := &FSUpdateEvent{
+				Name: name,
+				Type: "fs-synced",
+				Ref:  srcRef,
+				Path: "",
+				Time: time.Now().UTC().Unix(),
+			}
+			if err := ft.hub.FiletreeFSUpdateEvent(ctx, nil, updateEvent.JSON()); err != nil {
+				return nil, err
+			}
+		}
+	}
+	res.DurationMilli = time.Since(start).Milliseconds()
+	return res, nil
+}
+
+func (ft *FileTree) fsSyncHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			httputil.WriteErrorStatus(w, http.StatusMethodNotAllowed)
+			return
+		}
+		vars := mux.Vars(r)
+		fsName := vars["name"]
+		if vars["type"] != "fs" {
+			httputil.WriteJSONError(w, http.StatusBadRequest, "only FS can be synced")
+			return
+		}
+
+		req := &FSSyncRequest{}
+		if err := httputil.Unmarshal(r, req); err != nil {
+			httputil.WriteJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if req.URL == "" {
+			httputil.WriteJSONError(w, http.StatusBadRequest, "missing url")
+			return
+		}
+
+		// Pulling updates the local FS
+		action := perms.Read
+		if req.Direction == SyncPull {
+			action = perms.Write
+		}
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(action, perms.FS),
+			perms.ResourceWithID(perms.Filetree, perms.FS, fsName),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+
+		if req.RemoteFS == "" {
+			// The remote FS is scoped by the remote API key
+			req.RemoteFS, _ = tenant.Strip(r, fsName)
+		}
+		ctx := ctxutil.WithNamespace(r.Context(), r.Header.Get(ctxutil.NamespaceHeader))
+		res, err := ft.SyncFS(ctx, fsName, req)
+		if err != nil {
+			httputil.WriteJSONError(w, http.StatusBadGateway, err.Error())
+			return
+		}
+		if res.Status == SyncDiverged {
+			httputil.MarshalAndWrite(r, w, res, httputil.WithStatusCode(http.StatusConflict))
+			return
+		}
+		httputil.MarshalAndWrite(r, w, res)
+	}
+}
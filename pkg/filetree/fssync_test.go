@@ -0,0 +1,102 @@
+package filetree
+
+import (
+	"context"
+	"testing"
+
+	rnode "a4.io/blobstash/pkg/filetree/filetreeutil/node"
+	"a4.io/blobstash/pkg/hashutil"
+)
+
+type memSyncStore map[string][]byte
+
+func (s memSyncStore) Get(ctx context.Context, hash string) ([]byte, error) {
+	return s[hash], nil
+}
+
+func (s memSyncStore) Stat(ctx context.Context, hash string) (bool, error) {
+	_, ok := s[hash]
+	return ok, nil
+}
+
+func (s memSyncStore) Put(ctx context.Context, hash string, data []byte) error {
+	s[hash] = data
+	return nil
+}
+
+func (s memSyncStore) putNode(n *rnode.RawNode) string {
+	ref, data := n.Encode()
+	s[ref] = data
+	return ref
+}
+
+func (s memSyncStore) putFile(name, content string) string {
+	chunk := []byte(content)
+	chunkRef := hashutil.Compute(chunk)
+	s[chunkRef] = chunk
+	return s.putNode(&rnode.RawNode{
+		Name: name,
+		Type: rnode.File,
+		Size: len(chunk),
+		Refs: []interface{}{[]interface{}{0, chunkRef}},
+	})
+}
+
+func TestSyncStatus(t *testing.T) {
+	for _, tc := range []struct {
+		src, dst []string
+		status   string
+		base     string
+	}{
+		{[]string{"a"}, []string{"a"}, SyncUpToDate, "a"},
+		{[]string{"b", "a"}, nil, SyncFastForward, ""},
+		{[]string{"b", "a"}, []string{"a"}, SyncFastForward, "a"},
+		{[]string{"a"}, []string{"b", "a"}, SyncAhead, "a"},
+		{[]string{"c", "a"}, []string{"b", "a"}, SyncDiverged, "a"},
+		{[]string{"c"}, []string{"b"}, SyncDiverged, ""},
+	} {
+		status, base := syncStatus(tc.src, tc.dst)
+		if status != tc.status || base != tc.base {
+			t.Errorf("syncStatus(%v, %v): got %s/%s, expected %s/%s", tc.src, tc.dst, status, base, tc.status, tc.base)
+		}
+	}
+}
+
+func TestSyncTransfer(t *testing.T) {
+	ctx := context.Background()
+	src := memSyncStore{}
+	unchanged := src.putFile("unchanged.txt", "same")
+	sub := src.putNode(&rnode.RawNode{Name: "sub", Type: rnode.Dir, Refs: []interface{}{unchanged}})
+	base := src.putNode(&rnode.RawNode{Name: "_root", Type: rnode.Dir, Refs: []interface{}{sub, src.putFile("a.txt", "v1")}})
+
+	// The destination has the base version
+	dst := memSyncStore{}
+	for k, v := range src {
+		dst[k] = v
+	}
+
+	root := src.putNode(&rnode.RawNode{Name: "_root", Type: rnode.Dir, Refs: []interface{}{sub, src.putFile("a.txt", "v2")}})
+	s := &fsSyncer{src: src, dst: dst, res: &FSSyncResult{}}
+	if err := s.transfer(ctx, "/", root); err != nil {
+		t.Fatal(err)
+	}
+	// root node + a.txt node + chunk
+	if s.res.BlobsSent != 3 || s.res.NodesSkipped != 1 || len(s.res.Changed) != 1 || s.res.Changed[0] != "/a.txt" {
+		t.Errorf("unexpected result %+v", s.res)
+	}
+	for k := range src {
+		if _, ok := dst[k]; !ok {
+			t.Errorf("blob %s not synced", k)
+		}
+	}
+
+	// Both sides modified a.txt since the base
+	dstRoot := dst.putNode(&rnode.RawNode{Name: "_root", Type: rnode.Dir, Refs: []interface{}{sub, dst.putFile("a.txt", "v3")}})
+	conflicts, err := s.conflicts(ctx, base, root, dstRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conflicts) != 1 || conflicts[0] != "/a.txt" {
+		t.Errorf("unexpected conflicts %v", conflicts)
+	}
+}
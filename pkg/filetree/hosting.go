@@ -0,0 +1,259 @@
+package filetree // import "a4.io/blobstash/pkg/filetree"
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"a4.io/blobsfile"
+	"a4.io/blobstash/pkg/client/clientutil"
+	"a4.io/blobstash/pkg/config"
+)
+
+// Static website hosting
+//
+// A FS (or a dir of a FS) can be served at the root of a domain (see the `filetree.sites` config), with support
+// for `index.html`, a custom `404.html` page, clean URLs and a Netlify-like `_redirects` file (one
+// `<from> <to> [<status>]` rule per line, `from` may end with `*`, and `:splat` in `to` is replaced by the
+// matched suffix).
+
+const (
+	siteIndex     = "index.html"
+	site404       = "404.html"
+	siteRedirects = "_redirects"
+
+	// Max size of the `_redirects` file
+	maxRedirectsSize = 64 << 10
+)
+
+type redirectRule struct {
+	from, to string
+	status   int
+}
+
+// match returns the redirect target if the rule matches the path
+func (rr *redirectRule) match(p string) (string, bool) {
+	if strings.HasSuffix(rr.from, "*") {
+		prefix := strings.TrimSuffix(rr.from, "*")
+		if !strings.HasPrefix(p, prefix) {
+			return "", false
+		}
+		return strings.Replace(rr.to, ":splat", strings.TrimPrefix(p, prefix), -1), true
+	}
+	if p != rr.from {
+		return "", false
+	}
+	return rr.to, true
+}
+
+func parseRedirects(data []byte) ([]*redirectRule, error) {
+	rules := []*redirectRule{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for i := 1; scanner.Scan(); i++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("invalid redirect at line %d", i)
+		}
+		rule := &redirectRule{from: fields[0], to: fields[1], status: http.StatusMovedPermanently}
+		if len(fields) == 3 {
+			status, err := strconv.Atoi(fields[2])
+			if err != nil || status < 300 || status > 399 {
+				return nil, fmt.Errorf("invalid redirect status at line %d", i)
+			}
+			rule.status = status
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+func (ft *FileTree) siteByHost(host string) (*config.FiletreeSite, bool) {
+	if ft.conf.Filetree == nil {
+		return nil, false
+	}
+	for _, site := range ft.conf.Filetree.Sites {
+		if site.Domain == host {
+			return site, true
+		}
+	}
+	return nil, false
+}
+
+// SitesDomains returns the domains of the hosted websites
+func (ft *FileTree) SitesDomains() []string {
+	domains := []string{}
+	if ft.conf.Filetree != nil {
+		for _, site := range ft.conf.Filetree.Sites {
+			domains = append(domains, site.Domain)
+		}
+	}
+	return domains
+}
+
+// siteFile returns the file node at the given path (nil if it does not exist or if it's not a file)
+func (ft *FileTree) siteFile(ctx context.Context, fs *FS, p string) (*Node, error) {
+	node, _, _, err := fs.Path(ctx, p, 1, false, 0)
+	switch err {
+	case nil:
+	case clientutil.ErrBlobNotFound, blobsfile.ErrBlobNotFound:
+		return nil, nil
+	default:
+		return nil, err
+	}
+	if node.Type != "file" {
+		return nil, nil
+	}
+	return node, nil
+}
+
+func (ft *FileTree) readFile(ctx context.Context, n *Node, maxSize int64) ([]byte, error) {
+	f := ft.fileReader(ctx, n.Meta)
+	defer f.Close()
+	return ioutil.ReadAll(io.LimitReader(f, maxSize))
+}
+
+// siteRedirects returns the rules of the `_redirects` file (cached by ref)
+func (ft *FileTree) siteRedirects(ctx context.Context, fs *FS, root string) ([]*redirectRule, error) {
+	n, err := ft.siteFile(ctx, fs, path.Join(root, siteRedirects))
+	if err != nil || n == nil {
+		return nil, err
+	}
+	if cached, ok := ft.redirectsCache.Get(n.Hash); ok {
+		return cached.([]*redirectRule), nil
+	}
+	data, err := ft.readFile(ctx, n, maxRedirectsSize)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := parseRedirects(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", siteRedirects, err)
+	}
+	ft.redirectsCache.Add(n.Hash, rules)
+	return rules, nil
+}
+
+// sitePaths returns the candidate paths (relative to the site root) for the requested path
+func sitePaths(p string, cleanURLs bool) []string {
+	if strings.HasSuffix(p, "/") {
+		return []string{p + siteIndex}
+	}
+	if !cleanURLs {
+		return []string{p}
+	}
+	return []string{p, p + ".html", p + "/" + siteIndex}
+}
+
+func (ft *FileTree) siteHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		site, ok := ft.siteByHost(requestHost(r))
+		if !ok {
+			notFound(w)
+			return
+		}
+		ctx := r.Context()
+		p := path.Clean("/" + r.URL.Path)
+		if strings.HasSuffix(r.URL.Path, "/") && p != "/" {
+			p = p + "/"
+		}
+
+		fs, err := ft.FS(ctx, site.FS, FSKeyFmt, false, 0)
+		if err != nil {
+			panic(err)
+		}
+		if fs.Ref == "" {
+			notFound(w)
+			return
+		}
+
+		rules, err := ft.siteRedirects(ctx, fs, site.Root)
+		if err != nil {
+			panic(err)
+		}
+		for _, rule := range rules {
+			if target, ok := rule.match(p); ok {
+				http.Redirect(w, r, target, rule.status)
+				return
+			}
+		}
+
+		if cc := ft.conf.FiletreeCacheControl(site.FS); cc != "" {
+			w.Header().Set("Cache-Control", cc)
+		}
+		for _, candidate := range sitePaths(p, site.CleanURLs) {
+			node, err := ft.siteFile(ctx, fs, path.Join(site.Root, candidate))
+			if err != nil {
+				panic(err)
+			}
+			if node != nil {
+				ft.serveFile(ctx, w, r, node.Hash, true)
+				return
+			}
+		}
+
+		// Redirect to the dir if it has an index
+		if !strings.HasSuffix(p, "/") {
+			node, err := ft.siteFile(ctx, fs, path.Join(site.Root, p, siteIndex))
+			if err != nil {
+				panic(err)
+			}
+			if node != nil {
+				http.Redirect(w, r, p+"/", http.StatusMovedPermanently)
+				return
+			}
+		}
+
+		// Custom 404 page
+		node, err := ft.siteFile(ctx, fs, path.Join(site.Root, site404))
+		if err != nil {
+			panic(err)
+		}
+		if node == nil {
+			notFound(w)
+			return
+		}
+		data, err := ft.readFile(ctx, node, int64(node.Meta.Size))
+		if err != nil {
+			panic(err)
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusNotFound)
+		if r.Method == "GET" {
+			w.Write(data)
+		}
+	}
+}
+
+// requestHost returns the host the same way the mux `Host` matcher does
+func requestHost(r *http.Request) string {
+	if r.URL.IsAbs() {
+		return r.URL.Host
+	}
+	return r.Host
+}
+
+// registerSites registers the static websites handler (matched by domain)
+func (ft *FileTree) registerSites(root *mux.Router) {
+	root.MatcherFunc(func(r *http.Request, _ *mux.RouteMatch) bool {
+		_, ok := ft.siteByHost(requestHost(r))
+		return ok
+	}).HandlerFunc(ft.siteHandler())
+}
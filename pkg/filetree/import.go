@@ -0,0 +1,249 @@
+package filetree // import "a4.io/blobstash/pkg/filetree"
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/ctxutil"
+	rnode "a4.io/blobstash/pkg/filetree/filetreeutil/node"
+	"a4.io/blobstash/pkg/filetree/writer"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/perms"
+)
+
+// Server-side import
+//
+// A directory already present on the server disk (inside the configured import root) is uploaded directly to the blob
+// store (without going through the HTTP API) and linked into a FS, useful for the initial seeding of large trees.
+
+// Max number of files/dirs uploaded concurrently by an import
+const maxImportWorkers = 32
+
+var (
+	// ErrInvalidImport is returned when the import source is not an absolute path to a directory of the import root
+	ErrInvalidImport = errors.New("the import path must be an absolute path to a directory inside the import root")
+
+	// ErrImportDisabled is returned when no import root is configured
+	ErrImportDisabled = errors.New("the server-side imports are disabled")
+)
+
+// inRoot reports whether p is the root dir or one of its descendants (the symlinks of the existing part of p are
+// resolved, so a link can't point outside of the root)
+func inRoot(root, p string) (bool, error) {
+	root, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return false, err
+	}
+	var rest []string
+	cur := filepath.Clean(p)
+	for {
+		resolved, err := filepath.EvalSymlinks(cur)
+		if err == nil {
+			cur = filepath.Join(append([]string{resolved}, rest...)...)
+			break
+		}
+		if !os.IsNotExist(err) {
+			return false, err
+		}
+		parent := filepath.Dir(cur)
+		if parent == cur {
+			break
+		}
+		rest = append([]string{filepath.Base(cur)}, rest...)
+		cur = parent
+	}
+	rel, err := filepath.Rel(root, cur)
+	if err != nil {
+		return false, nil
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)), nil
+}
+
+// ImportOptions holds the options of a server-side import
+type ImportOptions struct {
+	// Absolute path of the directory to import (on the server disk)
+	Path string `json:"path"`
+
+	// Destination dir (created if needed)
+	DestDir string `json:"dest_dir"`
+
+	// Optional name (defaults to the base name of the path)
+	Name string `json:"name,omitempty"`
+
+	// Replace the existing node at the destination
+	Overwrite bool `json:"overwrite,omitempty"`
+
+	// Number of files/dirs uploaded concurrently (defaults to the uploader default, 32 max)
+	Workers int `json:"workers,omitempty"`
+}
+
+// Import uploads the local directory at `opts.Path` using the uploader, and links it into `opts.DestDir`, it returns
+// the imported node
+func (ft *FileTree) Import(ctx context.Context, fs *FS, up *writer.Uploader, opts *ImportOptions, prefixFmt string) (*Node, int64, error) {
+	root := ft.conf.FiletreeImportRoot()
+	if root == "" {
+		return nil, 0, ErrImportDisabled
+	}
+	if !filepath.IsAbs(opts.Path) {
+		return nil, 0, ErrInvalidImport
+	}
+	ok, err := inRoot(root, opts.Path)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !ok {
+		return nil, 0, ErrInvalidImport
+	}
+	fi, err := os.Stat(opts.Path)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !fi.IsDir() {
+		return nil, 0, ErrInvalidImport
+	}
+	name := opts.Name
+	if name == "" {
+		name = filepath.Base(opts.Path)
+	}
+	if name == "" || strings.Contains(name, "/") || name == "." || name == ".." {
+		return nil, 0, ErrInvalidDest
+	}
+	if opts.Workers > 0 {
+		if err := up.SetWorkers(opts.Workers); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	mtime := time.Now().Unix()
+	dstDir := "/" + strings.Trim(opts.DestDir, "/")
+	dir, err := ft.mkdirAll(ctx, fs, dstDir, prefixFmt, mtime)
+	if err != nil {
+		return nil, 0, err
+	}
+	// Check the destination before the (potentially long) upload
+	if !opts.Overwrite {
+		for _, c := range dir.Children {
+			if c.Name == name {
+				return nil, 0, ErrNodeExists
+			}
+		}
+	}
+
+	meta, err := up.PutDir(opts.Path)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to import %s: %w", opts.Path, err)
+	}
+	meta.Name = name
+	meta.ChangeTime = mtime
+	if err := ft.checkAddLimit(ctx, fs.Name, dir, meta, false); err != nil {
+		return nil, 0, err
+	}
+	// The dir may have been updated during the upload
+	if dir, err = ft.mkdirAll(ctx, fs, dstDir, prefixFmt, mtime); err != nil {
+		return nil, 0, err
+	}
+	_, revision, err := ft.AddChild(ctx, nil, dir, meta, prefixFmt, mtime)
+	if err != nil {
+		return nil, 0, err
+	}
+	node, _, _, err := fs.Path(ctx, path.Join(dstDir, name), 1, false, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	return node, revision, nil
+}
+
+// importHandler imports a directory from the server disk (server admin only, as it gives access to the server
+// filesystem)
+func (ft *FileTree) importHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			httputil.WriteErrorStatus(w, http.StatusMethodNotAllowed)
+			return
+		}
+		vars := mux.Vars(r)
+		if vars["type"] != "fs" {
+			httputil.WriteJSONError(w, http.StatusBadRequest, "only FS references can be imported to")
+			return
+		}
+		fsName := vars["name"]
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Admin, perms.Config),
+			perms.Resource(perms.Server, perms.Config),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+		ctx := ctxutil.WithNamespace(r.Context(), r.Header.Get(ctxutil.NamespaceHeader))
+
+		opts := &ImportOptions{}
+		if err := httputil.Unmarshal(r, opts); err != nil {
+			httputil.WriteJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid payload: %v", err))
+			return
+		}
+		if opts.Workers < 0 || opts.Workers > maxImportWorkers {
+			httputil.WriteJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid workers, must be between 0 and %d", maxImportWorkers))
+			return
+		}
+
+		fs, err := ft.FS(ctx, fsName, FSKeyFmt, false, 0)
+		if err != nil {
+			panic(err)
+		}
+		uploader, err := ft.newUploader(ctx, fs.Name, r.URL.Query())
+		if err != nil {
+			httputil.WriteJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		newNode, revision, err := ft.Import(ctx, fs, uploader, opts, FSKeyFmt)
+		switch {
+		case err == nil:
+		case os.IsNotExist(err):
+			notFound(w)
+			return
+		case err == ErrNodeExists:
+			httputil.WriteJSONError(w, http.StatusConflict, err.Error())
+			return
+		case err == ErrImportDisabled:
+			httputil.WriteJSONError(w, http.StatusForbidden, err.Error())
+			return
+		case err == ErrInvalidImport, err == ErrInvalidDest:
+			httputil.WriteJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		default:
+			panic(err)
+		}
+		ft.log.Info("directory imported", "fs", fs.Name, "path", opts.Path, "ref", newNode.Hash)
+
+		w.Header().Add("BlobStash-Filetree-FS-Revision", strconv.FormatInt(revision, 10))
+		newNode.UploadStats = uploader.Stats()
+
+		updateEvent := &FSUpdateEvent{
+			Name:      fs.Name,
+			Type:      fmt.Sprintf("%s-imported", rnode.Dir),
+			Ref:       newNode.Hash,
+			Path:      path.Join("/"+strings.Trim(opts.DestDir, "/"), newNode.Name)[1:],
+			Time:      time.Now().UTC().Unix(),
+			SessionID: httputil.GetSessionID(r),
+		}
+		if err := ft.hub.FiletreeFSUpdateEvent(ctx, nil, updateEvent.JSON()); err != nil {
+			panic(err)
+		}
+
+		httputil.MarshalAndWrite(r, w, newNode)
+	}
+}
@@ -0,0 +1,114 @@
+package filetree_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/filetree"
+	"a4.io/blobstash/pkg/testutil"
+)
+
+func TestImport(t *testing.T) {
+	root := t.TempDir()
+	srv := testutil.NewServer(t, func(conf *config.Config) {
+		conf.Filetree = &config.Filetree{ImportRoot: root}
+	})
+	defer srv.Close()
+
+	src := filepath.Join(root, "src")
+	for i := 0; i < 20; i++ {
+		p := filepath.Join(src, fmt.Sprintf("dir%d", i%3), fmt.Sprintf("file%d.txt", i))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(strings.Repeat("a", i)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	do := func(method, path, body string) (int, *filetree.Node) {
+		req, err := srv.NewRequest(method, "/api/filetree/fs/fs/docs/"+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		node := &filetree.Node{}
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(node); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp.StatusCode, node
+	}
+
+	payload := fmt.Sprintf(`{"path": %q, "dest_dir": "/seed", "name": "data", "workers": 3}`, src)
+	status, node := do("POST", "_import", payload)
+	if status != http.StatusOK {
+		t.Fatalf("failed to import: %d", status)
+	}
+	if node.Name != "data" || node.Type != "dir" || node.UploadStats == nil || node.UploadStats.Size != 190 {
+		t.Errorf("unexpected imported node %+v", node)
+	}
+	for i := 0; i < 20; i++ {
+		p := fmt.Sprintf("seed/data/dir%d/file%d.txt", i%3, i)
+		if status, node := do("GET", p, ""); status != http.StatusOK || node.Size != i {
+			t.Errorf("%s not imported (%d, %+v)", p, status, node)
+		}
+	}
+
+	// The destination must not exist
+	if status, _ := do("POST", "_import", payload); status != http.StatusConflict {
+		t.Errorf("expected a 409, got %d", status)
+	}
+	if status, _ := do("POST", "_import", `{"path": "relative/path"}`); status != http.StatusBadRequest {
+		t.Errorf("expected a 400 for a relative path, got %d", status)
+	}
+	if status, _ := do("POST", "_import", fmt.Sprintf(`{"path": %q}`, filepath.Join(src, "missing"))); status != http.StatusNotFound {
+		t.Errorf("expected a 404 for a missing dir, got %d", status)
+	}
+
+	// The path must be inside the import root (even through a symlink)
+	outside := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{outside, filepath.Join(root, ".."), filepath.Join(root, "link")} {
+		if status, _ := do("POST", "_import", fmt.Sprintf(`{"path": %q, "name": "out"}`, p)); status != http.StatusBadRequest {
+			t.Errorf("expected a 400 for %s, got %d", p, status)
+		}
+	}
+	if status, _ := do("POST", "_import", fmt.Sprintf(`{"path": %q, "name": "many", "workers": 1000}`, src)); status != http.StatusBadRequest {
+		t.Errorf("expected a 400 for too many workers, got %d", status)
+	}
+}
+
+func TestImportDisabled(t *testing.T) {
+	srv := testutil.NewServer(t)
+	defer srv.Close()
+
+	req, err := srv.NewRequest("POST", "/api/filetree/fs/fs/docs/_import", strings.NewReader(fmt.Sprintf(`{"path": %q}`, t.TempDir())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected a 403 without import root, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,268 @@
+package filetree // import "a4.io/blobstash/pkg/filetree"
+
+import (
+	"bytes"
+	"context"
+	"html/template"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+	"github.com/yuin/goldmark"
+
+	rnode "a4.io/blobstash/pkg/filetree/filetreeutil/node"
+	"a4.io/blobstash/pkg/filetree/imginfo"
+	"a4.io/blobstash/pkg/httputil"
+)
+
+// Directory listing for the public dirs
+//
+// The default output is a minimal `<pre>` listing, the rich mode (enabled with the `filetree.rich_listing` config)
+// adds breadcrumbs, sorting (`?sort=name|size|mtime&order=asc|desc`), the README.md rendered at the top, and a
+// thumbnails grid for the image-heavy dirs.
+//
+// With `Accept: application/json`, the children are returned as JSON (sorted by name, paginated with `cursor`/`limit`)
+// along with bewit-signed URLs for the files, so the front-ends can build their own views.
+
+const (
+	// Max size of the rendered README
+	maxReadmeSize = 1 << 20
+
+	// Thumbnail width for the gallery view
+	thumbnailWidth = "200"
+)
+
+var minimalListingTmpl = template.Must(template.New("minimal").Parse(`<!doctype html>
+<title>{{ .Path }}</title>
+<pre>
+{{ range .Entries }}<a href="{{ .Href }}">{{ .Name }}</a>
+{{ end }}</pre>
+`))
+
+var richListingTmpl = template.Must(template.New("rich").Parse(`<!doctype html>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{ .Path }}</title>
+<style>
+body{font-family:sans-serif;max-width:60em;margin:1em auto;padding:0 1em}
+table{width:100%;border-collapse:collapse}td,th{text-align:left;padding:.2em .5em}
+.gallery{display:flex;flex-wrap:wrap;gap:.5em}.gallery a{display:block;width:200px;text-align:center;word-break:break-all}
+.gallery img{max-width:200px;max-height:200px}
+</style>
+<nav>{{ range .Breadcrumbs }}<a href="{{ .Href }}">{{ .Name }}</a> / {{ end }}</nav>
+{{ if .Readme }}<article>{{ .Readme }}</article><hr>{{ end }}
+{{ if .Gallery }}<div class="gallery">
+{{ range .Images }}<a href="{{ .Href }}"><img src="{{ .Href }}?w={{ $.ThumbnailWidth }}" alt="{{ .Name }}" loading="lazy"><br>{{ .Name }}</a>
+{{ end }}</div>{{ end }}
+<table>
+<tr><th><a href="?sort=name&order={{ .NextOrder }}">Name</a></th><th><a href="?sort=size&order={{ .NextOrder }}">Size</a></th><th><a href="?sort=mtime&order={{ .NextOrder }}">Modified</a></th></tr>
+{{ range .Entries }}<tr><td><a href="{{ .Href }}">{{ .Name }}</a></td><td>{{ .Size }}</td><td>{{ .ModTime }}</td></tr>
+{{ end }}</table>
+`))
+
+type listingEntry struct {
+	Name, Href, Size, ModTime string
+}
+
+type listingData struct {
+	Path           string
+	Breadcrumbs    []*listingEntry
+	Readme         template.HTML
+	Gallery        bool
+	Images         []*listingEntry
+	Entries        []*listingEntry
+	NextOrder      string
+	ThumbnailWidth string
+}
+
+// sortChildren sorts the dir children (the dirs are listed first)
+func sortChildren(children []*Node, by string, desc bool) {
+	sort.SliceStable(children, func(i, j int) bool {
+		a, b := children[i], children[j]
+		if (a.Type == rnode.Dir) != (b.Type == rnode.Dir) {
+			return a.Type == rnode.Dir
+		}
+		// Reversing the operands (instead of negating) keeps a strict ordering for the equal keys
+		if desc {
+			a, b = b, a
+		}
+		switch by {
+		case "size":
+			return a.Size < b.Size
+		case "mtime":
+			return a.Meta.ModTime < b.Meta.ModTime
+		default:
+			return a.Name < b.Name
+		}
+	})
+}
+
+func listingHref(n *Node) string {
+	if n.Type == rnode.Dir {
+		return url.PathEscape(n.Name) + "/"
+	}
+	return url.PathEscape(n.Name)
+}
+
+// renderReadme returns the README.md of the dir rendered as HTML (the raw HTML is escaped)
+func (ft *FileTree) renderReadme(ctx context.Context, n *Node) (template.HTML, error) {
+	for _, child := range n.Children {
+		if child.Type != "file" || !strings.EqualFold(child.Name, "readme.md") {
+			continue
+		}
+		data, err := ft.readFile(ctx, child, maxReadmeSize)
+		if err != nil {
+			return "", err
+		}
+		var buf bytes.Buffer
+		if err := goldmark.Convert(data, &buf); err != nil {
+			return "", err
+		}
+		return template.HTML(buf.String()), nil
+	}
+	return "", nil
+}
+
+// dirListing outputs the HTML listing of the dir, `p` is the URL path of the dir, and `root` the URL path of the
+// root of the listing (for the breadcrumbs)
+func (ft *FileTree) dirListing(ctx context.Context, w http.ResponseWriter, r *http.Request, n *Node, p, root string) {
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		ft.jsonDirListing(ctx, w, r, n, p)
+		return
+	}
+
+	// The links are relative to the dir
+	if !strings.HasSuffix(p, "/") {
+		http.Redirect(w, r, p+"/", http.StatusMovedPermanently)
+		return
+	}
+
+	q := r.URL.Query()
+	desc := q.Get("order") == "desc"
+	sortChildren(n.Children, q.Get("sort"), desc)
+
+	data := &listingData{
+		Path:           p,
+		Breadcrumbs:    []*listingEntry{},
+		Images:         []*listingEntry{},
+		Entries:        []*listingEntry{},
+		NextOrder:      "desc",
+		ThumbnailWidth: thumbnailWidth,
+	}
+	if desc {
+		data.NextOrder = "asc"
+	}
+	for _, child := range n.Children {
+		entry := &listingEntry{Name: child.Name, Href: listingHref(child)}
+		if child.Type == rnode.Dir {
+			entry.Name = entry.Name + "/"
+		} else {
+			entry.Size = humanize.Bytes(uint64(child.Size))
+		}
+		if child.Meta.ModTime > 0 {
+			entry.ModTime = time.Unix(child.Meta.ModTime, 0).UTC().Format("2006-01-02 15:04")
+		}
+		data.Entries = append(data.Entries, entry)
+		if child.Type == "file" && imginfo.IsImage(child.Name) {
+			data.Images = append(data.Images, entry)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if ft.conf.Filetree == nil || !ft.conf.Filetree.RichListing {
+		if err := minimalListingTmpl.Execute(w, data); err != nil {
+			httputil.Log(r, ft.log).Error("failed to render listing", "err", err)
+		}
+		return
+	}
+
+	// Breadcrumbs (from the root of the listing)
+	parts := []string{path.Base(root)}
+	if rel := strings.Trim(strings.TrimPrefix(p, root), "/"); rel != "" {
+		parts = append(parts, strings.Split(rel, "/")...)
+	}
+	for i, part := range parts {
+		data.Breadcrumbs = append(data.Breadcrumbs, &listingEntry{
+			Name: part,
+			Href: "./" + strings.Repeat("../", len(parts)-i-1),
+		})
+	}
+	// Gallery view for the image-heavy dirs
+	data.Gallery = len(data.Images) > 0 && len(data.Images)*2 >= len(data.Entries)
+
+	readme, err := ft.renderReadme(ctx, n)
+	if err != nil {
+		panic(err)
+	}
+	data.Readme = readme
+
+	if err := richListingTmpl.Execute(w, data); err != nil {
+		httputil.Log(r, ft.log).Error("failed to render listing", "err", err)
+	}
+}
+
+type jsonListingEntry struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Href        string `json:"href"`
+	Size        int    `json:"size"`
+	ModTime     string `json:"mtime,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Ref         string `json:"ref"`
+	URL         string `json:"url,omitempty"`
+}
+
+// jsonDirListing outputs the dir children as JSON, the `href` are relative to the dir URL path (with a trailing slash),
+// and `url` is a bewit-signed link to the file content
+func (ft *FileTree) jsonDirListing(ctx context.Context, w http.ResponseWriter, r *http.Request, n *Node, p string) {
+	q := httputil.NewQuery(r.URL.Query())
+	limit, err := q.GetInt("limit", ft.conf.FiletreeMaxLimit(), ft.conf.FiletreeMaxLimit())
+	if err != nil {
+		panic(err)
+	}
+	hasMore, err := ft.fetchDirPage(ctx, n, 1, 1, q.Get("cursor"), limit)
+	if err != nil {
+		panic(err)
+	}
+	setPagination(w, n, hasMore)
+
+	entries := []*jsonListingEntry{}
+	for _, child := range n.Children {
+		entry := &jsonListingEntry{
+			Name:        child.Name,
+			Type:        child.Type,
+			Href:        listingHref(child),
+			Size:        child.Size,
+			ContentType: child.ContentType,
+			Ref:         child.Hash,
+		}
+		if child.Meta.ModTime > 0 {
+			entry.ModTime = time.Unix(child.Meta.ModTime, 0).UTC().Format(time.RFC3339)
+		}
+		if child.Type == rnode.File {
+			_, u, err := ft.GetSemiPrivateLink(child)
+			if err != nil {
+				panic(err)
+			}
+			entry.URL = u
+		}
+		entries = append(entries, entry)
+	}
+
+	w.Header().Set("ETag", n.Hash)
+	httputil.MarshalAndWrite(r, w, map[string]interface{}{
+		"path":     p,
+		"ref":      n.Hash,
+		"children": entries,
+		"pagination": map[string]interface{}{
+			"cursor":   w.Header().Get("BlobStash-FileTree-Cursor"),
+			"has_more": hasMore,
+			"count":    len(entries),
+			"per_page": limit,
+		},
+	})
+}
@@ -0,0 +1,67 @@
+package filetree_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"a4.io/blobstash/pkg/testutil"
+)
+
+func TestJSONDirListing(t *testing.T) {
+	srv := testutil.NewServer(t)
+	defer srv.Close()
+
+	// Only the `/public` dir of the FS is served
+	for _, p := range []string{"public/dir/a.txt", "public/dir/b.txt", "public/dir/sub/c.txt"} {
+		resp, err := srv.Do("POST", "/api/filetree/fs/fs/docs/_append?path="+p, strings.NewReader("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("failed to create %s: %d", p, resp.StatusCode)
+		}
+	}
+
+	req, err := srv.NewRequest("GET", "/public/fs/docs/dir/?limit=2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected a 200, got %d", resp.StatusCode)
+	}
+	res := struct {
+		Path     string `json:"path"`
+		Children []struct {
+			Name string `json:"name"`
+			Type string `json:"type"`
+			Href string `json:"href"`
+			Size int    `json:"size"`
+			URL  string `json:"url"`
+		} `json:"children"`
+		Pagination struct {
+			Cursor  string `json:"cursor"`
+			HasMore bool   `json:"has_more"`
+		} `json:"pagination"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Children) != 2 || res.Children[0].Name != "a.txt" || res.Children[1].Name != "b.txt" {
+		t.Fatalf("unexpected children %+v", res.Children)
+	}
+	if c := res.Children[0]; c.Size != 5 || c.Href != "a.txt" || !strings.Contains(c.URL, "bewit=") {
+		t.Errorf("unexpected entry %+v", c)
+	}
+	if !res.Pagination.HasMore || res.Pagination.Cursor != "b.txt" {
+		t.Errorf("unexpected pagination %+v", res.Pagination)
+	}
+}
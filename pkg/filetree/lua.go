@@ -38,8 +38,7 @@ func (sr *searchReq) GetCode() string {
 	case sr.Code != "":
 		return sr.Code
 	default:
-		// TODO(tsileo): return a 400
-		panic("invalid search request")
+		panic(httputil.NewError(http.StatusBadRequest, "invalid search request"))
 	}
 }
 
@@ -47,7 +46,7 @@ func (sr *searchReq) GetCode() string {
 func (ft *FileTree) nodeSearchHandler() func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "POST" {
-			w.WriteHeader(http.StatusMethodNotAllowed)
+			httputil.WriteErrorStatus(w, http.StatusMethodNotAllowed)
 			return
 		}
 		sreq := &searchReq{}
@@ -82,13 +81,13 @@ func (ft *FileTree) nodeSearchHandler() func(http.ResponseWriter, *http.Request)
 		n, err := ft.nodeByRef(ctx, hash)
 		if err != nil {
 			if err == clientutil.ErrBlobNotFound {
-				w.WriteHeader(http.StatusNotFound)
+				httputil.WriteErrorStatus(w, http.StatusNotFound)
 				return
 			}
 			panic(err)
 		}
 		if n.Type == "file" {
-			panic("cannot search a file")
+			panic(httputil.NewError(http.StatusBadRequest, "cannot search a file"))
 		}
 
 		result := []*searchResult{}
@@ -19,6 +19,7 @@ import (
 	"a4.io/blobstash/pkg/filetree/reader/filereader"
 	"a4.io/blobstash/pkg/filetree/vidinfo"
 	"a4.io/blobstash/pkg/filetree/writer"
+	"a4.io/blobstash/pkg/iface"
 	"a4.io/blobstash/pkg/stash/store"
 )
 
@@ -225,7 +226,7 @@ func setupFileTree(ft *filetree.FileTree, bs store.BlobStore, kv store.KvStore)
 				return 3
 			},
 			"put_file": func(L *lua.LState) int {
-				uploader := writer.NewUploader(filetree.NewBlobStoreCompat(bs, context.TODO()))
+				uploader := writer.NewUploader(iface.NewBlobStorer(context.TODO(), bs))
 				name := L.ToString(1)
 				newName := L.ToString(2)
 				extraMeta := L.ToBool(3)
@@ -261,7 +262,7 @@ func setupFileTree(ft *filetree.FileTree, bs store.BlobStore, kv store.KvStore)
 				return 1
 			},
 			"upload_file": func(L *lua.LState) int {
-				uploader := writer.NewUploader(filetree.NewBlobStoreCompat(bs, context.TODO()))
+				uploader := writer.NewUploader(iface.NewBlobStorer(context.TODO(), bs))
 				name := L.ToString(1)
 				contents := L.ToString(2)
 				node, err := uploader.PutReader(name, strings.NewReader(contents), nil)
@@ -273,7 +274,7 @@ func setupFileTree(ft *filetree.FileTree, bs store.BlobStore, kv store.KvStore)
 				return 1
 			},
 			"put_file_at": func(L *lua.LState) int {
-				uploader := writer.NewUploader(filetree.NewBlobStoreCompat(bs, context.TODO()))
+				uploader := writer.NewUploader(iface.NewBlobStorer(context.TODO(), bs))
 				snap := toSnap(luautil.TableToMap(L, L.ToTable(1)))
 				name := L.ToString(2)
 				contents := L.ToString(3)
@@ -0,0 +1,188 @@
+package filetree // import "a4.io/blobstash/pkg/filetree"
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"a4.io/blobsfile"
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/client/clientutil"
+	"a4.io/blobstash/pkg/ctxutil"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/perms"
+)
+
+// ManifestEntry holds a file of the FS manifest
+type ManifestEntry struct {
+	Path    string `json:"path"`
+	Hash    string `json:"content_hash"`
+	Size    int    `json:"size"`
+	ModTime int64  `json:"mtime,omitempty"`
+}
+
+// Manifest returns all the files below the given node (sorted by path), the paths are relative to the FS root
+// (`base` is the path of the node)
+func (ft *FileTree) Manifest(ctx context.Context, node *Node, base string) ([]*ManifestEntry, error) {
+	out := []*ManifestEntry{}
+	if err := ft.manifest(ctx, node, base, &out); err != nil {
+		return nil, err
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Path < out[j].Path })
+	return out, nil
+}
+
+func (ft *FileTree) manifest(ctx context.Context, n *Node, p string, out *[]*ManifestEntry) error {
+	if n.Meta.IsFile() {
+		*out = append(*out, &ManifestEntry{
+			Path:    p,
+			Hash:    n.Meta.ContentHash,
+			Size:    n.Meta.Size,
+			ModTime: n.Meta.ModTime,
+		})
+		return nil
+	}
+	for _, ref := range n.Meta.Refs {
+		cn, err := ft.nodeByRef(ctx, ref.(string))
+		if err != nil {
+			return err
+		}
+		if err := ft.manifest(ctx, cn, strings.TrimSuffix(p, "/")+"/"+cn.Name, out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fsByType returns the FS for the given reference type (ref, fs or tag)
+func (ft *FileTree) fsByType(ctx context.Context, refType, name, prefixFmt string, asOf int64) (*FS, error) {
+	switch refType {
+	case "ref":
+		return &FS{Ref: name, ft: ft}, nil
+	case "fs":
+		return ft.FS(ctx, name, prefixFmt, false, asOf)
+	case "tag":
+		return ft.TaggedFS(ctx, name)
+	default:
+		return nil, fmt.Errorf("Unknown type \"%s\"", refType)
+	}
+}
+
+// manifestHandler returns the (path, content hash, size, mtime) of every file of the FS (or below `path`) so sync
+// clients can diff against their local state in a single request.
+//
+// The root ref is returned as ETag (a client can send `If-None-Match` to skip unchanged FS), the entries are
+// paginated with `cursor` (the last path of the previous page) and `limit`, and gzip encoded if requested.
+func (ft *FileTree) manifestHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			httputil.WriteErrorStatus(w, http.StatusMethodNotAllowed)
+			return
+		}
+		ctx := ctxutil.WithNamespace(r.Context(), r.Header.Get(ctxutil.NamespaceHeader))
+		vars := mux.Vars(r)
+		fsName := vars["name"]
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Read, perms.FS),
+			perms.ResourceWithID(perms.Filetree, perms.FS, fsName),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+		prefixFmt := FSKeyFmt
+		if p := r.URL.Query().Get("prefix"); p != "" {
+			prefixFmt = p + ":%s"
+		}
+		q := httputil.NewQuery(r.URL.Query())
+		asOf, err := q.GetInt64Default("as_of", 0)
+		if err != nil {
+			panic(err)
+		}
+		limit, err := q.GetInt("limit", 1000, 10000)
+		if err != nil {
+			panic(err)
+		}
+		cursor := q.Get("cursor")
+		path := "/" + strings.Trim(q.Get("path"), "/")
+
+		fs, err := ft.fsByType(ctx, vars["type"], fsName, prefixFmt, asOf)
+		switch err {
+		case nil:
+		case ErrTagNotFound:
+			notFound(w)
+			return
+		default:
+			panic(err)
+		}
+
+		node, _, _, err := fs.Path(ctx, path, 1, false, 0)
+		switch err {
+		case nil:
+		case clientutil.ErrBlobNotFound, blobsfile.ErrBlobNotFound:
+			httputil.WriteErrorStatus(w, http.StatusNotFound)
+			return
+		default:
+			panic(fmt.Errorf("failed to get path: %v", err))
+		}
+
+		// The manifest only depends on the node ref (and the pagination)
+		w.Header().Set("ETag", node.Hash)
+		w.Header().Set("BlobStash-FileTree-Revision", strconv.FormatInt(fs.Revision, 10))
+		if r.Header.Get("If-None-Match") == node.Hash {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		if r.Method == "HEAD" {
+			return
+		}
+
+		entries, err := ft.Manifest(ctx, node, path)
+		if err != nil {
+			panic(err)
+		}
+		start := sort.Search(len(entries), func(i int) bool { return entries[i].Path > cursor })
+		entries = entries[start:]
+		hasMore := len(entries) > limit
+		if hasMore {
+			entries = entries[:limit]
+		}
+		if len(entries) > 0 {
+			cursor = entries[len(entries)-1].Path
+		}
+
+		js, err := json.Marshal(map[string]interface{}{
+			"ref":  node.Hash,
+			"data": entries,
+			"pagination": map[string]interface{}{
+				"cursor":   cursor,
+				"has_more": hasMore,
+				"count":    len(entries),
+				"per_page": limit,
+			},
+		})
+		if err != nil {
+			panic(err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Vary", "Accept-Encoding")
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Write(js)
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		gw := gzip.NewWriter(w)
+		defer gw.Close()
+		if _, err := gw.Write(js); err != nil {
+			httputil.Log(r, ft.log).Error("failed to write manifest", "err", err)
+		}
+	}
+}
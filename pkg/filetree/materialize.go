@@ -0,0 +1,343 @@
+package filetree // import "a4.io/blobstash/pkg/filetree"
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/blake2b"
+
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/clock"
+	"a4.io/blobstash/pkg/ctxutil"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/perms"
+)
+
+// Materialized snapshots
+//
+// A FS is written to a new dated sub-directory of a local directory on each run. The files are hard links to a cache
+// (the `.cache` sub-directory, keyed by content hash/mode/mtime), so the files unchanged since the previous run are
+// neither fetched nor written again, and don't use any extra space.
+//
+// As all the snapshots share the same inodes, the files are read-only (modifying a file would alter all the
+// snapshots). The cache entries not used by the last run are removed (the older snapshots keep their links).
+
+const (
+	materializeCacheDir   = ".cache"
+	materializeTimeLayout = "20060102T150405Z"
+)
+
+// MaterializeStats holds the stats of a materialization
+type MaterializeStats struct {
+	Path         string `json:"path"`
+	FilesCount   int    `json:"files_count"`
+	FilesLinked  int    `json:"files_linked"` // files already in the cache
+	DirsCount    int    `json:"dirs_count"`
+	Size         int64  `json:"size"`
+	SizeWritten  int64  `json:"size_written"`
+	CachePruned  int    `json:"cache_pruned"`
+	SnapsDeleted int    `json:"snapshots_deleted"`
+}
+
+// materializeKey returns the cache key of the file (the hard links share the mode/mtime)
+func materializeKey(n *Node) string {
+	chash := n.Meta.ContentHash
+	if chash == "" {
+		// Empty files (and old nodes) have no content hash
+		chash = n.Hash
+	}
+	return fmt.Sprintf("%s-%d-%o", chash, n.Meta.ModTime, materializePerm(n))
+}
+
+// materializePerm returns the (read-only) permissions of the materialized node
+func materializePerm(n *Node) os.FileMode {
+	if n.Meta.Mode == 0 {
+		return 0444
+	}
+	return os.FileMode(n.Meta.Mode).Perm() &^ 0222
+}
+
+// Materialize writes the FS referenced by ref (see `ResolveFS`) to a new sub-directory of dir, the most recent `keep`
+// snapshots are kept (0 to keep them all)
+func (ft *FileTree) Materialize(ctx context.Context, ref, dir string, keep int) (*MaterializeStats, error) {
+	if !filepath.IsAbs(dir) {
+		return nil, fmt.Errorf("the materialize dir must be absolute")
+	}
+	ft.materializeMu.Lock()
+	defer ft.materializeMu.Unlock()
+	fs, err := ft.ResolveFS(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	root, err := fs.Root(ctx, false, 0)
+	if err != nil {
+		return nil, err
+	}
+	cacheDir := filepath.Join(dir, materializeCacheDir)
+	if err := os.MkdirAll(cacheDir, 0700); err != nil {
+		return nil, err
+	}
+	stats := &MaterializeStats{Path: filepath.Join(dir, clock.Now().UTC().Format(materializeTimeLayout))}
+	// Write in a temp dir so an interrupted run does not look like a complete snapshot
+	tmp := stats.Path + ".tmp"
+	if err := os.RemoveAll(tmp); err != nil {
+		return nil, err
+	}
+
+	used := map[string]struct{}{}
+	var dirs []*Node
+	var dirsPath []string
+	if err := ft.IterTree(ctx, root, func(n *Node, p string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		dst := filepath.Join(tmp, filepath.FromSlash(p))
+		if dst != tmp && !strings.HasPrefix(dst, tmp+string(filepath.Separator)) {
+			return fmt.Errorf("invalid path %q", p)
+		}
+		if !n.Meta.IsFile() {
+			dirs = append(dirs, n)
+			dirsPath = append(dirsPath, dst)
+			return os.Mkdir(dst, 0700)
+		}
+		key := materializeKey(n)
+		cached := filepath.Join(cacheDir, key[:2], key)
+		if _, err := os.Stat(cached); err == nil {
+			stats.FilesLinked++
+		} else if os.IsNotExist(err) {
+			if err := ft.materializeFile(ctx, n, cached); err != nil {
+				return err
+			}
+			stats.SizeWritten += int64(n.Size)
+		} else {
+			return err
+		}
+		used[key] = struct{}{}
+		stats.FilesCount++
+		stats.Size += int64(n.Size)
+		return os.Link(cached, dst)
+	}); err != nil {
+		return nil, err
+	}
+	// The dirs attributes are set once the children are written (as it updates the mtime)
+	for i := len(dirs) - 1; i >= 0; i-- {
+		perm := os.FileMode(0755)
+		if dirs[i].Meta.Mode != 0 {
+			perm = os.FileMode(dirs[i].Meta.Mode).Perm() | 0700
+		}
+		if err := os.Chmod(dirsPath[i], perm); err != nil {
+			return nil, err
+		}
+		if dirs[i].Meta.ModTime > 0 {
+			mtime := time.Unix(dirs[i].Meta.ModTime, 0)
+			if err := os.Chtimes(dirsPath[i], mtime, mtime); err != nil {
+				return nil, err
+			}
+		}
+	}
+	stats.DirsCount = len(dirs)
+	if err := os.Rename(tmp, stats.Path); err != nil {
+		return nil, err
+	}
+
+	if stats.CachePruned, err = pruneMaterializeCache(cacheDir, used); err != nil {
+		return nil, err
+	}
+	if stats.SnapsDeleted, err = pruneMaterializeSnapshots(dir, keep); err != nil {
+		return nil, err
+	}
+	ft.log.Info("FS materialized", "ref", ref, "path", stats.Path, "files", stats.FilesCount,
+		"linked", stats.FilesLinked, "size_written", stats.SizeWritten)
+	return stats, nil
+}
+
+// materializeFile writes the file content (verified against the content hash) to the cache
+func (ft *FileTree) materializeFile(ctx context.Context, n *Node, cached string) error {
+	if err := os.MkdirAll(filepath.Dir(cached), 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(cached), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	h, err := blake2b.New256(nil)
+	if err != nil {
+		return err
+	}
+	var size int64
+	for _, iv := range n.Meta.FileRefs() {
+		blob, err := ft.blobStore.Get(ctx, iv.Value)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(blob); err != nil {
+			return err
+		}
+		h.Write(blob)
+		size += int64(len(blob))
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if size != int64(n.Size) {
+		return fmt.Errorf("file %s not successfully materialized, size:%d/expected size:%d", n.Hash, size, n.Size)
+	}
+	if n.Meta.ContentHash != "" && n.Size > 0 {
+		if chash := fmt.Sprintf("%x", h.Sum(nil)); chash != n.Meta.ContentHash {
+			return fmt.Errorf("file %s not successfully materialized, hash:%s/expected hash:%s", n.Hash, chash, n.Meta.ContentHash)
+		}
+	}
+	if err := os.Chmod(f.Name(), materializePerm(n)); err != nil {
+		return err
+	}
+	if n.Meta.ModTime > 0 {
+		mtime := time.Unix(n.Meta.ModTime, 0)
+		if err := os.Chtimes(f.Name(), mtime, mtime); err != nil {
+			return err
+		}
+	}
+	return os.Rename(f.Name(), cached)
+}
+
+// pruneMaterializeCache removes the cache entries not used by the last run
+func pruneMaterializeCache(cacheDir string, used map[string]struct{}) (int, error) {
+	var pruned int
+	err := filepath.Walk(cacheDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		if _, ok := used[info.Name()]; ok {
+			return nil
+		}
+		pruned++
+		return os.Remove(p)
+	})
+	return pruned, err
+}
+
+// pruneMaterializeSnapshots removes the oldest snapshots, and the temp dirs of the interrupted runs
+func pruneMaterializeSnapshots(dir string, keep int) (int, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	var snaps []string
+	for _, fi := range fis {
+		name := fi.Name()
+		if !fi.IsDir() || name == materializeCacheDir {
+			continue
+		}
+		if strings.HasSuffix(name, ".tmp") {
+			if err := removeAll(filepath.Join(dir, name)); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if _, err := time.Parse(materializeTimeLayout, name); err == nil {
+			snaps = append(snaps, name)
+		}
+	}
+	if keep == 0 || len(snaps) <= keep {
+		return 0, nil
+	}
+	sort.Strings(snaps)
+	for _, name := range snaps[:len(snaps)-keep] {
+		if err := removeAll(filepath.Join(dir, name)); err != nil {
+			return 0, err
+		}
+	}
+	return len(snaps) - keep, nil
+}
+
+// removeAll removes the snapshot dir (the dirs may not be writable)
+func removeAll(p string) error {
+	if err := filepath.Walk(p, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return os.Chmod(p, 0700)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	return os.RemoveAll(p)
+}
+
+// materializeHandler materializes the FS to a directory of the materialize root (server admin only, as it writes to
+// the server filesystem)
+func (ft *FileTree) materializeHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			httputil.WriteErrorStatus(w, http.StatusMethodNotAllowed)
+			return
+		}
+		vars := mux.Vars(r)
+		if vars["type"] != "fs" {
+			httputil.WriteJSONError(w, http.StatusBadRequest, "only FS references can be materialized")
+			return
+		}
+		fsName := vars["name"]
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Admin, perms.Config),
+			perms.Resource(perms.Server, perms.Config),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+		root := ft.conf.FiletreeMaterializeRoot()
+		if root == "" {
+			httputil.WriteJSONError(w, http.StatusForbidden, "the on-demand materializations are disabled")
+			return
+		}
+		ctx := ctxutil.WithNamespace(r.Context(), r.Header.Get(ctxutil.NamespaceHeader))
+
+		opts := &struct {
+			Dir  string `json:"dir"`
+			Keep int    `json:"keep"`
+		}{}
+		if err := httputil.Unmarshal(r, opts); err != nil {
+			httputil.WriteJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid payload: %v", err))
+			return
+		}
+		if !filepath.IsAbs(opts.Dir) || opts.Keep < 0 {
+			httputil.WriteJSONError(w, http.StatusBadRequest, "an absolute dir is required")
+			return
+		}
+		ok, err := inRoot(root, opts.Dir)
+		if err != nil {
+			panic(err)
+		}
+		if !ok {
+			httputil.WriteJSONError(w, http.StatusBadRequest, "the dir must be inside the materialize root")
+			return
+		}
+
+		stats, err := ft.Materialize(ctx, fsName, opts.Dir, opts.Keep)
+		switch err {
+		case nil:
+		case ErrFSNotFound:
+			notFound(w)
+			return
+		default:
+			panic(err)
+		}
+		httputil.MarshalAndWrite(r, w, stats)
+	}
+}
@@ -0,0 +1,124 @@
+package filetree_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/filetree"
+	"a4.io/blobstash/pkg/testutil"
+)
+
+func TestMaterialize(t *testing.T) {
+	root := t.TempDir()
+	srv := testutil.NewServer(t, func(conf *config.Config) {
+		conf.Filetree = &config.Filetree{MaterializeRoot: root}
+	})
+	defer srv.Close()
+
+	for _, p := range []string{"a.txt", "dir/b.txt", "dir/sub/c.txt"} {
+		resp, err := srv.Do("POST", "/api/filetree/fs/fs/docs/_append?path="+p, strings.NewReader("content of "+p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("failed to create %s: %d", p, resp.StatusCode)
+		}
+	}
+
+	dir := filepath.Join(root, "docs")
+	materialize := func() *filetree.MaterializeStats {
+		req, err := srv.NewRequest("POST", "/api/filetree/fs/fs/docs/_materialize", strings.NewReader(fmt.Sprintf(`{"dir": %q, "keep": 2}`, dir)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("failed to materialize: %d", resp.StatusCode)
+		}
+		stats := &filetree.MaterializeStats{}
+		if err := json.NewDecoder(resp.Body).Decode(stats); err != nil {
+			t.Fatal(err)
+		}
+		// Each run gets its own dir
+		srv.Clock.Add(time.Hour)
+		return stats
+	}
+
+	first := materialize()
+	if first.FilesCount != 3 || first.FilesLinked != 0 || first.DirsCount != 3 {
+		t.Errorf("unexpected stats %+v", first)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(first.Path, "dir", "sub", "c.txt"))
+	if err != nil || string(data) != "content of dir/sub/c.txt" {
+		t.Errorf("file not materialized (%q, %v)", data, err)
+	}
+	// The files are shared between the snapshots
+	if _, err := os.OpenFile(filepath.Join(first.Path, "a.txt"), os.O_WRONLY, 0); err == nil && os.Getuid() != 0 {
+		t.Errorf("the materialized files should be read-only")
+	}
+
+	resp, err := srv.Do("POST", "/api/filetree/fs/fs/docs/_append?path=a.txt", strings.NewReader(" updated"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// Only the updated file is written again
+	second := materialize()
+	if second.FilesCount != 3 || second.FilesLinked != 2 || second.CachePruned != 1 {
+		t.Errorf("unexpected stats %+v", second)
+	}
+	for _, p := range []string{"dir/b.txt", "dir/sub/c.txt"} {
+		fi1, err1 := os.Stat(filepath.Join(first.Path, p))
+		fi2, err2 := os.Stat(filepath.Join(second.Path, p))
+		if err1 != nil || err2 != nil || !os.SameFile(fi1, fi2) {
+			t.Errorf("%s should be hard linked (%v, %v)", p, err1, err2)
+		}
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(first.Path, "a.txt")); err != nil || string(data) != "content of a.txt" {
+		t.Errorf("the previous snapshot should be unchanged (%q, %v)", data, err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(second.Path, "a.txt")); err != nil || string(data) != "content of a.txt updated" {
+		t.Errorf("the updated file should be materialized (%q, %v)", data, err)
+	}
+
+	// Only the last 2 snapshots are kept
+	third := materialize()
+	if third.FilesLinked != 3 || third.SizeWritten != 0 || third.SnapsDeleted != 1 {
+		t.Errorf("unexpected stats %+v", third)
+	}
+	if _, err := os.Stat(first.Path); !os.IsNotExist(err) {
+		t.Errorf("the oldest snapshot should be deleted (%v)", err)
+	}
+
+	// The dir must be inside the materialize root
+	for _, d := range []string{t.TempDir(), filepath.Join(root, "..", "docs")} {
+		req, err := srv.NewRequest("POST", "/api/filetree/fs/fs/docs/_materialize", strings.NewReader(fmt.Sprintf(`{"dir": %q}`, d)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected a 400 for %s, got %d", d, resp.StatusCode)
+		}
+	}
+}
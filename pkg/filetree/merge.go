@@ -0,0 +1,391 @@
+package filetree // import "a4.io/blobstash/pkg/filetree"
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/ctxutil"
+	rnode "a4.io/blobstash/pkg/filetree/filetreeutil/node"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/perms"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+// Merge conflict resolution policies
+const (
+	MergeReport = ""       // conflicts are reported, nothing is merged
+	MergeNewest = "newest" // the node with the newest mtime wins
+)
+
+// MergeConflict holds a path modified on both sides
+type MergeConflict struct {
+	Path       string `json:"path"`
+	Ours       string `json:"ours,omitempty"`   // empty if deleted
+	Theirs     string `json:"theirs,omitempty"` // empty if deleted
+	Resolution string `json:"resolution,omitempty"`
+}
+
+// MergeResult holds the result of a merge
+type MergeResult struct {
+	Ref       string           `json:"ref"`
+	Base      string           `json:"base,omitempty"`
+	Ours      string           `json:"ours"`
+	Theirs    string           `json:"theirs"`
+	Conflicts []*MergeConflict `json:"conflicts"`
+	Revision  int64            `json:"revision,omitempty"`
+}
+
+type merger struct {
+	ft        *FileTree
+	policy    string
+	conflicts []*MergeConflict
+	blobs     []*blob.Blob // the merged dirs, only saved once the merge is complete
+}
+
+func (ft *FileTree) rawNode(ctx context.Context, ref string) (*rnode.RawNode, error) {
+	if ref == "" {
+		return nil, nil
+	}
+	data, err := ft.blobStore.Get(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	return rnode.NewNodeFromBlob(ref, data)
+}
+
+func (m *merger) children(ctx context.Context, n *rnode.RawNode) (map[string]*rnode.RawNode, error) {
+	out := map[string]*rnode.RawNode{}
+	if n == nil || n.IsFile() {
+		return out, nil
+	}
+	for _, ref := range n.Refs {
+		child, err := m.ft.rawNode(ctx, ref.(string))
+		if err != nil {
+			return nil, err
+		}
+		out[child.Name] = child
+	}
+	return out, nil
+}
+
+func nodeRef(n *rnode.RawNode) string {
+	if n == nil {
+		return ""
+	}
+	return n.Hash
+}
+
+func isDir(n *rnode.RawNode) bool {
+	return n != nil && n.Type == rnode.Dir
+}
+
+// resolve picks a side for a conflicting path
+func (m *merger) resolve(p string, ours, theirs *rnode.RawNode) *rnode.RawNode {
+	conflict := &MergeConflict{Path: p, Ours: nodeRef(ours), Theirs: nodeRef(theirs)}
+	m.conflicts = append(m.conflicts, conflict)
+	pick := ours
+	if m.policy == MergeNewest {
+		// An edit always wins over a deletion
+		if ours == nil || (theirs != nil && theirs.ModTime > ours.ModTime) {
+			pick = theirs
+		}
+		conflict.Resolution = "ours"
+		if pick == theirs {
+			conflict.Resolution = "theirs"
+		}
+	}
+	return pick
+}
+
+// mergeDir performs a three-way merge of the given dirs (base may be nil)
+func (m *merger) mergeDir(ctx context.Context, p string, base, ours, theirs *rnode.RawNode) (*rnode.RawNode, error) {
+	bc, err := m.children(ctx, base)
+	if err != nil {
+		return nil, err
+	}
+	oc, err := m.children(ctx, ours)
+	if err != nil {
+		return nil, err
+	}
+	tc, err := m.children(ctx, theirs)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for name := range oc {
+		names = append(names, name)
+	}
+	for name := range tc {
+		if _, ok := oc[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	changed := false
+	refs := []interface{}{}
+	picks := []*rnode.RawNode{}
+	for _, name := range names {
+		b, o, t := bc[name], oc[name], tc[name]
+		var pick *rnode.RawNode
+		switch {
+		case nodeRef(o) == nodeRef(t):
+			pick = o
+		case nodeRef(o) == nodeRef(b):
+			pick = t
+		case nodeRef(t) == nodeRef(b):
+			pick = o
+		case isDir(o) && isDir(t):
+			if !isDir(b) {
+				b = nil
+			}
+			pick, err = m.mergeDir(ctx, path.Join(p, name), b, o, t)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			pick = m.resolve(path.Join(p, name), o, t)
+		}
+		if nodeRef(pick) != nodeRef(o) {
+			changed = true
+		}
+		if pick != nil {
+			refs = append(refs, pick.Hash)
+			picks = append(picks, pick)
+		}
+	}
+	if !changed {
+		return ours, nil
+	}
+
+	merged := *ours
+	merged.Refs = refs
+	// The cumulative stats are recomputed from the merged children (the ones of ours are stale)
+	stats := &rnode.DirStats{}
+	for _, c := range picks {
+		cstats, err := m.ft.du(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+		stats.Add(cstats)
+		if !c.IsFile() {
+			stats.DirsCount++
+		}
+	}
+	merged.DirStats = stats
+	if theirs.ModTime > merged.ModTime {
+		merged.ModTime = theirs.ModTime
+	}
+	merged.ChangeTime = 0
+	ref, data := merged.Encode()
+	merged.Hash = ref
+	m.blobs = append(m.blobs, &blob.Blob{Hash: ref, Data: data})
+	return &merged, nil
+}
+
+// historyRefs returns the root refs of the FS (newest first)
+func (ft *FileTree) historyRefs(ctx context.Context, prefixFmt, name string) ([]string, error) {
+	kvv, _, err := ft.kvStore.Versions(ctx, fmt.Sprintf(prefixFmt, name), "0", -1)
+	switch err {
+	case nil:
+	case vkv.ErrNotFound:
+		return nil, nil
+	default:
+		return nil, err
+	}
+	out := []string{}
+	for _, kv := range kvv.Versions {
+		out = append(out, kv.HexHash())
+	}
+	return out, nil
+}
+
+// mergeBase looks for the most recent common ancestor in the FS histories
+func (ft *FileTree) mergeBase(ctx context.Context, prefixFmt, name, theirsFS, theirsRef string) (string, error) {
+	ours, err := ft.historyRefs(ctx, prefixFmt, name)
+	if err != nil {
+		return "", err
+	}
+	known := map[string]bool{}
+	for _, ref := range ours {
+		known[ref] = true
+	}
+	theirs := []string{theirsRef}
+	if theirsFS != "" {
+		if theirs, err = ft.historyRefs(ctx, prefixFmt, theirsFS); err != nil {
+			return "", err
+		}
+	}
+	for _, ref := range theirs {
+		if known[ref] {
+			return ref, nil
+		}
+	}
+	return "", nil
+}
+
+// Merge merges the `theirs` root into the `ours` root, using `base` as the common ancestor (if not empty), the merged
+// dirs are not saved for a dry run, nor if the conflicts are only reported
+func (ft *FileTree) Merge(ctx context.Context, base, ours, theirs, policy string, dryRun bool) (*MergeResult, error) {
+	res := &MergeResult{Base: base, Ours: ours, Theirs: theirs, Conflicts: []*MergeConflict{}}
+	switch {
+	case ours == theirs || base == theirs:
+		res.Ref = ours
+		return res, nil
+	case ours == "" || base == ours:
+		// Fast-forward
+		res.Ref = theirs
+		return res, nil
+	}
+
+	bn, err := ft.rawNode(ctx, base)
+	if err != nil {
+		return nil, err
+	}
+	on, err := ft.rawNode(ctx, ours)
+	if err != nil {
+		return nil, err
+	}
+	tn, err := ft.rawNode(ctx, theirs)
+	if err != nil {
+		return nil, err
+	}
+	m := &merger{ft: ft, policy: policy}
+	merged, err := m.mergeDir(ctx, "/", bn, on, tn)
+	if err != nil {
+		return nil, err
+	}
+	res.Ref = merged.Hash
+	res.Conflicts = m.conflicts
+	if dryRun || (policy == MergeReport && len(res.Conflicts) > 0) {
+		return res, nil
+	}
+	for _, b := range m.blobs {
+		if _, err := ft.blobStore.Put(ctx, b); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+func (ft *FileTree) mergeHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			httputil.WriteErrorStatus(w, http.StatusMethodNotAllowed)
+			return
+		}
+		ctx := ctxutil.WithNamespace(r.Context(), r.Header.Get(ctxutil.NamespaceHeader))
+
+		vars := mux.Vars(r)
+		fsName := vars["name"]
+		if vars["type"] != "fs" {
+			httputil.WriteJSONError(w, http.StatusBadRequest, "only FS can be merged into")
+			return
+		}
+		prefixFmt := FSKeyFmt
+		if p := r.URL.Query().Get("prefix"); p != "" {
+			prefixFmt = p + ":%s"
+		}
+
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Write, perms.FS),
+			perms.ResourceWithID(perms.Filetree, perms.FS, fsName),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+
+		q := httputil.NewQuery(r.URL.Query())
+		policy := q.Get("policy")
+		if policy != MergeReport && policy != MergeNewest {
+			httputil.WriteJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid policy %q", policy))
+			return
+		}
+		dryRun, err := q.GetBoolDefault("dry_run", false)
+		if err != nil {
+			panic(err)
+		}
+
+		// Resolve "their" root (either a ref or another FS)
+		theirsFS := q.Get("fs")
+		theirs := q.Get("ref")
+		if theirsFS != "" {
+			if !auth.Can(
+				w,
+				r,
+				perms.Action(perms.Read, perms.FS),
+				perms.ResourceWithID(perms.Filetree, perms.FS, theirsFS),
+			) {
+				auth.Forbidden(w)
+				return
+			}
+			other, err := ft.FS(ctx, theirsFS, prefixFmt, false, 0)
+			if err != nil {
+				panic(err)
+			}
+			theirs = other.Ref
+		}
+		if theirs == "" {
+			httputil.WriteJSONError(w, http.StatusBadRequest, "missing ref/fs")
+			return
+		}
+
+		fs, err := ft.FS(ctx, fsName, prefixFmt, false, 0)
+		if err != nil {
+			panic(err)
+		}
+		base := q.Get("base")
+		if base == "" {
+			base, err = ft.mergeBase(ctx, prefixFmt, fsName, theirsFS, theirs)
+			if err != nil {
+				panic(err)
+			}
+		}
+
+		res, err := ft.Merge(ctx, base, fs.Ref, theirs, policy, dryRun)
+		if err != nil {
+			panic(err)
+		}
+
+		// Unresolved conflicts, nothing is saved
+		if policy == MergeReport && len(res.Conflicts) > 0 {
+			httputil.MarshalAndWrite(r, w, res, httputil.WithStatusCode(http.StatusConflict))
+			return
+		}
+
+		if !dryRun && res.Ref != fs.Ref {
+			kv, err := ft.putRoot(ctx, fmt.Sprintf(prefixFmt, fsName), res.Ref, &Snapshot{
+				Message: fmt.Sprintf("merge %s", theirs),
+			})
+			if err != nil {
+				panic(err)
+			}
+			res.Revision = kv.Version
+
+			updateEvent := &FSUpdateEvent{
+				Name:      fsName,
+				Type:      "fs-merged",
+				Ref:       res.Ref,
+				Path:      "",
+				Time:      time.Now().UTC().Unix(),
+				SessionID: httputil.GetSessionID(r),
+			}
+			if err := ft.hub.FiletreeFSUpdateEvent(ctx, nil, updateEvent.JSON()); err != nil {
+				panic(err)
+			}
+		}
+
+		httputil.MarshalAndWrite(r, w, res)
+	}
+}
@@ -0,0 +1,129 @@
+package filetree_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/filetree"
+	"a4.io/blobstash/pkg/perms"
+	"a4.io/blobstash/pkg/testutil"
+)
+
+func TestMerge(t *testing.T) {
+	srv := testutil.NewServer(t, func(conf *config.Config) {
+		conf.Roles = append(conf.Roles, &config.Role{
+			Name: "b-writer",
+			Perms: []*config.Perm{{
+				Action:   perms.Action(perms.Write, perms.FS),
+				Resource: perms.ResourceWithID(perms.Filetree, perms.FS, "b"),
+			}},
+		})
+		conf.Auth = append(conf.Auth, &config.BasicAuth{ID: "b-writer", Password: "b-writer", Roles: []string{"b-writer"}})
+	})
+	defer srv.Close()
+
+	appendFile := func(fs, p, data string) {
+		resp, err := srv.Do("POST", "/api/filetree/fs/fs/"+fs+"/_append?path="+p, strings.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("failed to append to %s/%s: %d", fs, p, resp.StatusCode)
+		}
+	}
+	merge := func(query string) (int, *filetree.MergeResult) {
+		resp, err := srv.Do("POST", "/api/filetree/fs/fs/b/_merge?fs=a"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		res := &filetree.MergeResult{}
+		if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusConflict {
+			if err := json.NewDecoder(resp.Body).Decode(res); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp.StatusCode, res
+	}
+	blobStatus := func(ref string) int {
+		resp, err := srv.Do("GET", "/api/blobstore/blob/"+ref, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Fast-forward b to a, so both FS share the same history
+	appendFile("a", "x.txt", "x")
+	if status, _ := merge(""); status != http.StatusOK {
+		t.Fatalf("failed to fast-forward: %d", status)
+	}
+	appendFile("a", "y.txt", "y")
+	appendFile("b", "z.txt", "z")
+
+	// The merged dirs are not saved for a dry run
+	status, res := merge("&dry_run=1")
+	if status != http.StatusOK || res.Ref == "" || res.Revision != 0 {
+		t.Fatalf("unexpected dry run merge %d %+v", status, res)
+	}
+	if status := blobStatus(res.Ref); status != http.StatusNotFound {
+		t.Errorf("the dry run merged root should not be saved, got %d", status)
+	}
+
+	// Nor when the conflicts are only reported
+	appendFile("a", "x.txt", "a")
+	appendFile("b", "x.txt", "b")
+	status, res = merge("")
+	if status != http.StatusConflict || len(res.Conflicts) != 1 || res.Conflicts[0].Path != "/x.txt" {
+		t.Fatalf("unexpected conflict report %d %+v", status, res)
+	}
+	if status := blobStatus(res.Ref); status != http.StatusNotFound {
+		t.Errorf("the reported merged root should not be saved, got %d", status)
+	}
+
+	status, res = merge("&policy=newest")
+	if status != http.StatusOK || res.Revision == 0 {
+		t.Fatalf("unexpected merge %d %+v", status, res)
+	}
+	if status := blobStatus(res.Ref); status != http.StatusOK {
+		t.Errorf("the merged root should be saved, got %d", status)
+	}
+
+	// The cumulative stats of the merged dirs are up to date
+	resp, err := srv.Do("GET", "/api/filetree/fs/fs/b/?du=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	du := &struct {
+		Size       int64 `json:"size"`
+		FilesCount int   `json:"files_count"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(du); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	// x.txt (2 bytes), y.txt and z.txt
+	if du.Size != 4 || du.FilesCount != 3 {
+		t.Errorf("unexpected du %+v", du)
+	}
+
+	// Read access is needed on the merged FS
+	req, err := srv.NewRequest("POST", "/api/filetree/fs/fs/b/_merge?fs=a&dry_run=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("", "b-writer")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected a 403, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,125 @@
+package filetree // import "a4.io/blobstash/pkg/filetree"
+
+import (
+	"context"
+	"net/http"
+
+	rnode "a4.io/blobstash/pkg/filetree/filetreeutil/node"
+	"a4.io/blobstash/pkg/filetree/writer"
+	"a4.io/blobstash/pkg/httputil"
+)
+
+// uploadLimit holds the size limits for adding/replacing a node in a FS
+type uploadLimit struct {
+	fsName      string
+	maxFileSize int64 // 0 for no limit
+	available   int64 // space left in the FS (-1 for no limit)
+}
+
+// uploadLimit returns the size limits for replacing the node (or creating it, the node must be attached to the FS root)
+// according to the FS quota
+func (ft *FileTree) uploadLimit(ctx context.Context, fsName string, n *Node) (*uploadLimit, error) {
+	l := &uploadLimit{fsName: fsName, available: -1}
+	quota := ft.conf.FiletreeQuota(fsName)
+	if quota == nil {
+		return l, nil
+	}
+	l.maxFileSize = quota.MaxFileSize
+	if quota.MaxSize > 0 {
+		root := n
+		for root.parent != nil {
+			root = root.parent
+		}
+		stats, err := ft.du(ctx, root.Meta)
+		if err != nil {
+			return nil, err
+		}
+		used := stats.Size
+		// The replaced node does not count
+		if n != root && n.Meta.Hash != "" {
+			replaced, err := ft.du(ctx, n.Meta)
+			if err != nil {
+				return nil, err
+			}
+			used -= replaced.Size
+		}
+		l.available = quota.MaxSize - used
+		if l.available < 0 {
+			l.available = 0
+		}
+	}
+	return l, nil
+}
+
+// checkAddLimit returns an error if adding the node to the dir (replacing the child with the same name) exceeds the FS
+// size limits, the node is not counted against the total size if it's already in the FS (e.g. moved within the FS)
+func (ft *FileTree) checkAddLimit(ctx context.Context, fsName string, dir *Node, m *rnode.RawNode, inFS bool) error {
+	if ft.conf.FiletreeQuota(fsName) == nil {
+		return nil
+	}
+	target := &Node{Meta: &rnode.RawNode{}, parent: dir}
+	for _, c := range dir.Children {
+		if c.Name == m.Name {
+			target.Meta = c.Meta
+		}
+	}
+	l, err := ft.uploadLimit(ctx, fsName, target)
+	if err != nil {
+		return err
+	}
+	if inFS {
+		l.available = -1
+	}
+	stats, err := ft.du(ctx, m)
+	if err != nil {
+		return err
+	}
+	return l.check(stats.Size, m.IsFile())
+}
+
+// apply sets the max size of the files written by the uploader
+func (l *uploadLimit) apply(up *writer.Uploader) {
+	max := int64(-1)
+	if l.maxFileSize > 0 {
+		max = l.maxFileSize
+	}
+	if l.available >= 0 && (max < 0 || l.available < max) {
+		max = l.available
+	}
+	up.SetMaxSize(max)
+}
+
+// check returns an error if a node of the given size can't be added (isFile is false for the dirs, only the total size
+// is checked)
+func (l *uploadLimit) check(size int64, isFile bool) error {
+	if isFile && l.maxFileSize > 0 && size > l.maxFileSize {
+		return l.maxFileSizeError()
+	}
+	if l.available >= 0 && size > l.available {
+		return l.quotaError()
+	}
+	return nil
+}
+
+// error converts the uploader `ErrMaxSizeExceeded` error into the matching API error
+func (l *uploadLimit) error(err error) error {
+	if err != writer.ErrMaxSizeExceeded {
+		return err
+	}
+	if l.available >= 0 && (l.maxFileSize == 0 || l.available < l.maxFileSize) {
+		return l.quotaError()
+	}
+	return l.maxFileSizeError()
+}
+
+func (l *uploadLimit) maxFileSizeError() error {
+	apiErr := httputil.Errorf(http.StatusRequestEntityTooLarge, "file larger than the max file size of FS %q (%d bytes)", l.fsName, l.maxFileSize)
+	apiErr.Code = "max_file_size_exceeded"
+	return apiErr
+}
+
+func (l *uploadLimit) quotaError() error {
+	apiErr := httputil.Errorf(http.StatusRequestEntityTooLarge, "quota of FS %q exceeded (%d bytes available)", l.fsName, l.available)
+	apiErr.Code = "quota_exceeded"
+	return apiErr
+}
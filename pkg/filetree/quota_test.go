@@ -0,0 +1,90 @@
+package filetree_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/testutil"
+)
+
+func TestQuota(t *testing.T) {
+	srv := testutil.NewServer(t, func(conf *config.Config) {
+		conf.Filetree = &config.Filetree{Quotas: map[string]*config.FiletreeQuota{
+			"small": {MaxSize: 10, MaxFileSize: 8},
+		}}
+	})
+	defer srv.Close()
+
+	// check(srv.Do(...))(status, code) checks the response status and the error code
+	check := func(resp *http.Response, err error) func(int, string) {
+		return func(status int, code string) {
+			t.Helper()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != status {
+				t.Errorf("expected a %d, got %d", status, resp.StatusCode)
+				return
+			}
+			if code == "" {
+				return
+			}
+			res := map[string]interface{}{}
+			if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+				t.Fatal(err)
+			}
+			if res["code"] != code {
+				t.Errorf("expected the %q error code, got %+v", code, res)
+			}
+		}
+	}
+	appendFile := func(fs, path, data string) (*http.Response, error) {
+		return srv.Do("POST", "/api/filetree/fs/fs/"+fs+"/_append?path="+path, strings.NewReader(data))
+	}
+
+	check(appendFile("small", "b.txt", "123456789"))(http.StatusRequestEntityTooLarge, "max_file_size_exceeded")
+	check(appendFile("small", "a.txt", "hello"))(http.StatusOK, "")
+	check(appendFile("small", "b.txt", "123456"))(http.StatusRequestEntityTooLarge, "quota_exceeded")
+	check(appendFile("small", "b.txt", "12345"))(http.StatusOK, "")
+	// The FS is full
+	check(appendFile("small", "a.txt", "!"))(http.StatusRequestEntityTooLarge, "quota_exceeded")
+	check(appendFile("other", "a.txt", "123456789012"))(http.StatusOK, "")
+
+	// The replaced file does not count
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	fw, err := mw.CreateFormFile("file", "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write([]byte("abc"))
+	mw.Close()
+	req, err := srv.NewRequest("POST", "/api/filetree/fs/fs/small/a.txt", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	check(http.DefaultClient.Do(req))(http.StatusOK, "")
+
+	// Copying a file counts, moving it within the FS does not
+	copyFile := func(move bool, payload string) (*http.Response, error) {
+		endpoint := "_copy"
+		if move {
+			endpoint = "_move"
+		}
+		req, err := srv.NewRequest("POST", "/api/filetree/fs/fs/small/"+endpoint, strings.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return http.DefaultClient.Do(req)
+	}
+	check(copyFile(false, `{"path": "/b.txt", "dest_dir": "/dir"}`))(http.StatusRequestEntityTooLarge, "quota_exceeded")
+	check(copyFile(true, `{"path": "/b.txt", "dest_dir": "/dir"}`))(http.StatusOK, "")
+}
@@ -6,13 +6,13 @@ import (
 	"os"
 	"path/filepath"
 
-	"a4.io/blobstash/pkg/client/blobstore"
 	"a4.io/blobstash/pkg/filetree/filetreeutil/node"
 	"a4.io/blobstash/pkg/filetree/reader/filereader"
+	"a4.io/blobstash/pkg/iface"
 )
 
 // GetDir restore the directory to path
-func GetDir(ctx context.Context, bs *blobstore.BlobStore, hash, path string) error { // (rr *ReadResult, err error) {
+func GetDir(ctx context.Context, bs iface.BlobGetter, hash, path string) error { // (rr *ReadResult, err error) {
 	// FIXME(tsileo): take a `*meta.Meta` as argument instead of the hash
 
 	// fullHash := blake2b.New256()
@@ -14,6 +14,7 @@ import (
 	"golang.org/x/crypto/blake2b"
 
 	"a4.io/blobstash/pkg/filetree/filetreeutil/node"
+	"a4.io/blobstash/pkg/iface"
 )
 
 // FIXME(tsileo): implements os.FileInfo
@@ -24,9 +25,8 @@ const (
 	SEEK_END int = 2 // seek relative to the end
 )
 
-type BlobStore interface {
-	Get(context.Context, string) ([]byte, error)
-}
+// BlobStore is the interface needed to read files
+type BlobStore = iface.BlobGetter
 
 // Download a file by its hash to path
 func GetFile(ctx context.Context, bs BlobStore, hash, path string) error {
@@ -103,6 +103,77 @@ type File struct {
 
 	lru *lru.Cache
 	ctx context.Context
+
+	// Shared chunk cache and number of chunks to fetch ahead (see `SetReadAhead`)
+	chunkCache *ChunkCache
+	readAhead  int
+}
+
+// ChunkCache is a LRU cache of chunks (keyed by hash) that can be shared between files, concurrent fetches of
+// the same chunk are merged.
+type ChunkCache struct {
+	lru *lru.Cache
+
+	mu       sync.Mutex
+	inflight map[string]*fetchCall
+}
+
+type fetchCall struct {
+	wg   sync.WaitGroup
+	data []byte
+	err  error
+}
+
+// NewChunkCache initializes a chunk cache holding up to `size` chunks
+func NewChunkCache(size int) (*ChunkCache, error) {
+	cache, err := lru.New(size)
+	if err != nil {
+		return nil, err
+	}
+	return &ChunkCache{lru: cache, inflight: map[string]*fetchCall{}}, nil
+}
+
+// get returns the chunk from the cache, or fetch it from the blob store
+func (cc *ChunkCache) get(ctx context.Context, bs BlobStore, hash string) ([]byte, error) {
+	if cached, ok := cc.lru.Get(hash); ok {
+		return cached.([]byte), nil
+	}
+	cc.mu.Lock()
+	if call, ok := cc.inflight[hash]; ok {
+		cc.mu.Unlock()
+		call.wg.Wait()
+		return call.data, call.err
+	}
+	call := &fetchCall{}
+	call.wg.Add(1)
+	cc.inflight[hash] = call
+	cc.mu.Unlock()
+
+	call.data, call.err = bs.Get(ctx, hash)
+	if call.err == nil {
+		cc.lru.Add(hash, call.data)
+	}
+	call.wg.Done()
+
+	cc.mu.Lock()
+	delete(cc.inflight, hash)
+	cc.mu.Unlock()
+	return call.data, call.err
+}
+
+// prefetch fetches the chunk in the background if it's not already cached/being fetched
+func (cc *ChunkCache) prefetch(ctx context.Context, bs BlobStore, hash string) {
+	if cc.lru.Contains(hash) {
+		return
+	}
+	cc.mu.Lock()
+	_, ok := cc.inflight[hash]
+	cc.mu.Unlock()
+	if ok {
+		return
+	}
+	// The errors are ignored, the chunk will be fetched again when read
+	go cc.get(ctx, bs, hash)
 }
 
 // NewFile creates a new File instance.
@@ -143,6 +214,50 @@ func NewFileRemote(ctx context.Context, bs BlobStore, meta *node.RawNode, ivs []
 	return
 }
 
+// SetReadAhead enables the read-ahead of the next `n` chunks for the sequential reads, the chunks are stored in
+// the given shared cache (which takes precedence over the per-file cache)
+func (f *File) SetReadAhead(cache *ChunkCache, n int) {
+	f.chunkCache = cache
+	f.readAhead = n
+}
+
+// getChunk returns the data of the chunk
+func (f *File) getChunk(iv *IndexValue) ([]byte, error) {
+	if f.chunkCache != nil {
+		data, err := f.chunkCache.get(f.ctx, f.bs, iv.Value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch blob %v: %v", iv.Value, err)
+		}
+		// Only read ahead for the sequential reads
+		if iv.I >= f.maxI {
+			for _, next := range f.lmrange[iv.I+1:] {
+				if next.I > iv.I+f.readAhead {
+					break
+				}
+				f.chunkCache.prefetch(f.ctx, f.bs, next.Value)
+			}
+		}
+		return data, nil
+	}
+	if f.lru != nil {
+		//bbuf, _, _ := f.client.Blobs.Get(iv.Value)
+		if cached, ok := f.lru.Get(iv.Value); ok {
+			return cached.([]byte), nil
+		}
+		bbuf, err := f.bs.Get(f.ctx, iv.Value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch blob %v: %v", iv.Value, err)
+		}
+		f.lru.Add(iv.Value, bbuf)
+		return bbuf, nil
+	}
+	bbuf, err := f.bs.Get(f.ctx, iv.Value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch blob %v: %v", iv.Value, err)
+	}
+	return bbuf, nil
+}
+
 // PreloadChunks all the chunks in a goroutine
 func (f *File) PreloadChunks() {
 	f.preloadOnce.Do(func() {
@@ -236,27 +351,13 @@ func (f *File) read(offset int64, cnt int) ([]byte, error) {
 		if offset > iv.Index {
 			continue
 		}
+		cbuf, err = f.getChunk(iv)
+		if err != nil {
+			return nil, err
+		}
 		if iv.I > f.maxI {
 			f.maxI = iv.I
 		}
-		if f.lru != nil {
-			//bbuf, _, _ := f.client.Blobs.Get(iv.Value)
-			if cached, ok := f.lru.Get(iv.Value); ok {
-				cbuf = cached.([]byte)
-			} else {
-				bbuf, err := f.bs.Get(f.ctx, iv.Value)
-				if err != nil {
-					return nil, fmt.Errorf("failed to fetch blob %v: %v", iv.Value, err)
-				}
-				f.lru.Add(iv.Value, bbuf)
-				cbuf = bbuf
-			}
-		} else {
-			cbuf, err = f.bs.Get(f.ctx, iv.Value)
-			if err != nil {
-				return nil, fmt.Errorf("failed to fetch blob %v: %v", iv.Value, err)
-			}
-		}
 		bbuf := cbuf
 		foffset := 0
 		if offset != 0 {
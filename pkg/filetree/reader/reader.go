@@ -8,23 +8,16 @@ import (
 
 	"github.com/hashicorp/golang-lru"
 
-	"a4.io/blobstash/pkg/client/blobstore"
 	"a4.io/blobstash/pkg/filetree/filetreeutil/node"
 	"a4.io/blobstash/pkg/filetree/reader/filereader"
+	"a4.io/blobstash/pkg/iface"
 )
 
-type BlobStorer interface {
-	// Get(context.Context, string) ([]byte, error)
-	// Enumerate(chan<- string, string, string, int) error
-	Stat(string) (bool, error)
-	Put(string, []byte) error
-}
-
 type Downloader struct {
-	bs *blobstore.BlobStore
+	bs iface.BlobGetter
 }
 
-func NewDownloader(bs *blobstore.BlobStore) *Downloader {
+func NewDownloader(bs iface.BlobGetter) *Downloader {
 	return &Downloader{bs}
 }
 
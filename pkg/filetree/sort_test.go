@@ -0,0 +1,38 @@
+package filetree
+
+import (
+	"strings"
+	"testing"
+
+	rnode "a4.io/blobstash/pkg/filetree/filetreeutil/node"
+)
+
+func TestSortChildren(t *testing.T) {
+	for _, tc := range []struct {
+		by       string
+		desc     bool
+		expected string
+	}{
+		{"", false, "d1 d2 a b c"},
+		{"", true, "d2 d1 c b a"},
+		// The equal sizes keep their original order in both directions
+		{"size", false, "d1 d2 b c a"},
+		{"size", true, "d1 d2 a b c"},
+	} {
+		children := []*Node{}
+		for _, c := range []struct {
+			name, typ string
+			size      int
+		}{{"b", "file", 1}, {"d1", rnode.Dir, 0}, {"c", "file", 1}, {"a", "file", 2}, {"d2", rnode.Dir, 0}} {
+			children = append(children, &Node{Name: c.name, Type: c.typ, Size: c.size, Meta: &rnode.RawNode{}})
+		}
+		sortChildren(children, tc.by, tc.desc)
+		names := []string{}
+		for _, c := range children {
+			names = append(names, c.Name)
+		}
+		if got := strings.Join(names, " "); got != tc.expected {
+			t.Errorf("sort %q desc=%v: got %q, expected %q", tc.by, tc.desc, got, tc.expected)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package filetree // import "a4.io/blobstash/pkg/filetree"
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/vmihailenco/msgpack"
+
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/ctxutil"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/perms"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+// TagKeyFmt is the kv key format for the tags (`_filetree:tag:<fs>:<tag>`)
+const TagKeyFmt = "_filetree:tag:%s:%s"
+
+// ErrTagNotFound is returned when the requested tag does not exist
+var ErrTagNotFound = errors.New("tag not found")
+
+// Tag holds a named FS root
+type Tag struct {
+	Name      string `msgpack:"-" json:"name"`
+	FS        string `msgpack:"-" json:"fs"`
+	Ref       string `msgpack:"-" json:"ref"`
+	CreatedAt int64  `msgpack:"-" json:"created_at"`
+
+	Message string `msgpack:"m,omitempty" json:"message,omitempty"`
+}
+
+func validTagName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, "@/:")
+}
+
+// SetTag tags the given FS root
+func (ft *FileTree) SetTag(ctx context.Context, fsName, name, ref, message string) (*Tag, error) {
+	if !validTagName(name) {
+		return nil, fmt.Errorf("invalid tag name %q", name)
+	}
+	tag := &Tag{Name: name, FS: fsName, Ref: ref, Message: message}
+	encoded, err := msgpack.Marshal(tag)
+	if err != nil {
+		return nil, err
+	}
+	kv, err := ft.kvStore.Put(ctx, fmt.Sprintf(TagKeyFmt, fsName, name), ref, encoded, -1)
+	if err != nil {
+		return nil, err
+	}
+	tag.CreatedAt = kv.Version
+	return tag, nil
+}
+
+// DeleteTag removes the tag (the tag history is kept in the kv store)
+func (ft *FileTree) DeleteTag(ctx context.Context, fsName, name string) error {
+	if _, err := ft.Tag(ctx, fsName, name); err != nil {
+		return err
+	}
+	_, err := ft.kvStore.Put(ctx, fmt.Sprintf(TagKeyFmt, fsName, name), "", nil, -1)
+	return err
+}
+
+func kvToTag(fsName, name string, kv *vkv.KeyValue) (*Tag, error) {
+	tag := &Tag{Name: name, FS: fsName, Ref: kv.HexHash(), CreatedAt: kv.Version}
+	if len(kv.Data) > 0 {
+		if err := msgpack.Unmarshal(kv.Data, tag); err != nil {
+			return nil, err
+		}
+	}
+	return tag, nil
+}
+
+// Tag returns the given tag
+func (ft *FileTree) Tag(ctx context.Context, fsName, name string) (*Tag, error) {
+	kv, err := ft.kvStore.Get(ctx, fmt.Sprintf(TagKeyFmt, fsName, name), -1)
+	switch err {
+	case nil:
+	case vkv.ErrNotFound:
+		return nil, ErrTagNotFound
+	default:
+		return nil, err
+	}
+	// Deleted tags have no ref
+	if kv.HexHash() == "" {
+		return nil, ErrTagNotFound
+	}
+	return kvToTag(fsName, name, kv)
+}
+
+// Tags returns all the tags of the given FS
+func (ft *FileTree) Tags(ctx context.Context, fsName string) ([]*Tag, error) {
+	prefix := fmt.Sprintf(TagKeyFmt, fsName, "")
+	kvs, _, err := ft.kvStore.Keys(ctx, prefix, prefix+"\xff", -1)
+	if err != nil {
+		return nil, err
+	}
+	tags := []*Tag{}
+	for _, kv := range kvs {
+		name := strings.TrimPrefix(kv.Key, prefix)
+		// Skip deleted tags, and the tags of other FS sharing the same prefix
+		if kv.HexHash() == "" || !validTagName(name) {
+			continue
+		}
+		tag, err := kvToTag(fsName, name, kv)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, nil
+}
+
+// TaggedFS returns the (read-only) FS for a `<fs>@<tag>` reference
+func (ft *FileTree) TaggedFS(ctx context.Context, ref string) (*FS, error) {
+	i := strings.LastIndex(ref, "@")
+	if i == -1 {
+		return nil, ErrTagNotFound
+	}
+	tag, err := ft.Tag(ctx, ref[:i], ref[i+1:])
+	if err != nil {
+		return nil, err
+	}
+	return &FS{Ref: tag.Ref, ft: ft}, nil
+}
+
+func (ft *FileTree) tagsHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := ctxutil.WithNamespace(r.Context(), r.Header.Get(ctxutil.NamespaceHeader))
+		vars := mux.Vars(r)
+		fsName := vars["name"]
+		if vars["type"] != "fs" {
+			httputil.WriteJSONError(w, http.StatusBadRequest, "only FS can be tagged")
+			return
+		}
+		q := httputil.NewQuery(r.URL.Query())
+
+		switch r.Method {
+		case "GET", "HEAD":
+			if !auth.Can(
+				w,
+				r,
+				perms.Action(perms.Read, perms.FS),
+				perms.ResourceWithID(perms.Filetree, perms.FS, fsName),
+			) {
+				auth.Forbidden(w)
+				return
+			}
+			tags, err := ft.Tags(ctx, fsName)
+			if err != nil {
+				panic(err)
+			}
+			httputil.MarshalAndWrite(r, w, map[string]interface{}{
+				"data": tags,
+			})
+		case "POST":
+			if !auth.Can(
+				w,
+				r,
+				perms.Action(perms.Write, perms.FS),
+				perms.ResourceWithID(perms.Filetree, perms.FS, fsName),
+			) {
+				auth.Forbidden(w)
+				return
+			}
+			name := q.Get("tag")
+			if !validTagName(name) {
+				httputil.WriteJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid tag name %q", name))
+				return
+			}
+
+			// Tag the current root by default
+			ref := q.Get("ref")
+			if ref == "" {
+				asOf, err := q.GetInt64Default("as_of", 0)
+				if err != nil {
+					panic(err)
+				}
+				fs, err := ft.FS(ctx, fsName, FSKeyFmt, false, asOf)
+				if err != nil {
+					panic(err)
+				}
+				ref = fs.Ref
+			}
+			if ref == "" {
+				httputil.WriteJSONError(w, http.StatusNotFound, fmt.Sprintf("FS %q not found", fsName))
+				return
+			}
+			if _, err := ft.nodeByRef(ctx, ref); err != nil {
+				httputil.WriteJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid ref %q: %v", ref, err))
+				return
+			}
+
+			tag, err := ft.SetTag(ctx, fsName, name, ref, q.Get("message"))
+			if err != nil {
+				panic(err)
+			}
+			httputil.MarshalAndWrite(r, w, tag, httputil.WithStatusCode(http.StatusCreated))
+		case "DELETE":
+			if !auth.Can(
+				w,
+				r,
+				perms.Action(perms.Write, perms.FS),
+				perms.ResourceWithID(perms.Filetree, perms.FS, fsName),
+			) {
+				auth.Forbidden(w)
+				return
+			}
+			switch err := ft.DeleteTag(ctx, fsName, q.Get("tag")); err {
+			case nil:
+			case ErrTagNotFound:
+				notFound(w)
+				return
+			default:
+				panic(err)
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			httputil.WriteErrorStatus(w, http.StatusMethodNotAllowed)
+		}
+	}
+}
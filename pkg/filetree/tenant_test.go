@@ -0,0 +1,162 @@
+package filetree_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/ctxutil"
+	"a4.io/blobstash/pkg/filetree"
+	"a4.io/blobstash/pkg/testutil"
+)
+
+func TestTenantIsolation(t *testing.T) {
+	srv := testutil.NewServer(t, func(conf *config.Config) {
+		// The tenants are plain users (not admins)
+		conf.Roles = append(conf.Roles, &config.Role{
+			Name: "tenant",
+			Perms: []*config.Perm{
+				{Action: "action:*", Resource: "resource:filetree:*"},
+				{Action: "action:*", Resource: "resource:blobstore:*"},
+				{Action: "action:*", Resource: "resource:stash:namespace:*"},
+				{Action: "action:*", Resource: "resource:docstore:*"},
+			},
+		})
+		conf.Auth = append(conf.Auth,
+			&config.BasicAuth{ID: "alice", Password: "alice", Roles: []string{"tenant"}, Tenant: "alice"},
+			&config.BasicAuth{ID: "bob", Password: "bob", Roles: []string{"tenant"}, Tenant: "bob"},
+		)
+	})
+	defer srv.Close()
+
+	doNS := func(apiKey, ns, method, path, body string, out interface{}) int {
+		var r io.Reader
+		if body != "" {
+			r = strings.NewReader(body)
+		}
+		req, err := http.NewRequest(method, srv.URL+path, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("", apiKey)
+		req.Header.Set("Content-Type", "application/json")
+		if ns != "" {
+			req.Header.Set(ctxutil.NamespaceHeader, ns)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if out != nil && (resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusCreated) {
+			if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp.StatusCode
+	}
+	do := func(apiKey, method, path, body string, out interface{}) int {
+		return doNS(apiKey, "", method, path, body, out)
+	}
+
+	secret := &filetree.Node{}
+	if status := do("bob", "POST", "/api/filetree/fs/fs/docs/_append?path=secret.txt", "bob data", secret); status != http.StatusOK {
+		t.Fatalf("failed to create the bob file: %d", status)
+	}
+	if status := do("alice", "POST", "/api/filetree/fs/fs/docs/_append?path=notes.txt", "alice data", nil); status != http.StatusOK {
+		t.Fatalf("failed to create the alice file: %d", status)
+	}
+
+	// The destination FS is scoped to the tenant
+	if status := do("alice", "POST", "/api/filetree/fs/fs/docs/_copy", `{"path": "/notes.txt", "dest_fs": "bob.docs"}`, nil); status != http.StatusOK {
+		t.Fatalf("failed to copy: %d", status)
+	}
+	for apiKey, expected := range map[string]string{"bob": "secret.txt", "alice": "notes.txt"} {
+		root := &filetree.Node{}
+		if status := do(apiKey, "GET", "/api/filetree/fs/fs/docs/", "", root); status != http.StatusOK {
+			t.Fatalf("failed to list %s FS: %d", apiKey, status)
+		}
+		if len(root.Children) != 1 || root.Children[0].Name != expected {
+			t.Errorf("unexpected %s FS children %+v", apiKey, root.Children)
+		}
+	}
+
+	// The namespaces of bob are not listed
+	names := &struct {
+		Data []string `json:"data"`
+	}{}
+	if status := do("alice", "GET", "/api/stash/", "", names); status != http.StatusOK {
+		t.Fatalf("failed to list the namespaces: %d", status)
+	}
+	if len(names.Data) != 1 || names.Data[0] != "" {
+		t.Errorf("unexpected namespaces %q", names.Data)
+	}
+
+	// The blobs of bob can neither be listed, nor read by alice
+	blobs := &struct {
+		Data []struct {
+			Hash string `json:"hash"`
+		} `json:"data"`
+	}{}
+	if status := do("alice", "GET", "/api/blobstore/blobs?limit=1000", "", blobs); status != http.StatusOK {
+		t.Fatalf("failed to enumerate the blobs: %d", status)
+	}
+	if len(blobs.Data) == 0 {
+		t.Errorf("the alice blobs should be listed")
+	}
+	for _, ref := range blobs.Data {
+		if ref.Hash == secret.Hash {
+			t.Errorf("the bob node %s should not be listed", secret.Hash)
+		}
+	}
+	// The refs are checked against the tenant namespace, even on the handlers also accepting a bewit (and when
+	// targeting the namespace of another tenant)
+	for _, p := range []string{
+		"/api/blobstore/blob/" + secret.Hash,
+		"/api/filetree/node/" + secret.Hash,
+		"/api/filetree/file/" + secret.Hash,
+		"/api/filetree/fs/ref/" + secret.Hash + "/",
+	} {
+		for _, ns := range []string{"", "bob.", "bob"} {
+			if status := doNS("alice", ns, "GET", p, "", nil); status != http.StatusNotFound {
+				t.Errorf("GET %s (namespace %q): expected a 404, got %d", p, ns, status)
+			}
+		}
+		if status := do("bob", "GET", p, "", nil); status != http.StatusOK {
+			t.Errorf("GET %s: expected a 200 for bob, got %d", p, status)
+		}
+	}
+
+	// The docstore pointers are resolved in the shared root namespace, they're not expanded for a tenant
+	resp, err := srv.Do("POST", "/api/filetree/fs/fs/shared/_append?path=root.txt", strings.NewReader("root data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootNode := &filetree.Node{}
+	if err := json.NewDecoder(resp.Body).Decode(rootNode); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	doc := &struct {
+		ID string `json:"_id"`
+	}{}
+	if status := do("alice", "POST", "/api/docstore/notes", `{"file": {"_attachment": "`+rootNode.Hash+`"}}`, doc); status != http.StatusCreated {
+		t.Fatalf("failed to create the doc: %d", status)
+	}
+	res := &struct {
+		Pointers map[string]interface{} `json:"pointers"`
+	}{}
+	if status := do("alice", "GET", "/api/docstore/notes/"+doc.ID, "", res); status != http.StatusOK {
+		t.Fatalf("failed to fetch the doc: %d", status)
+	}
+	if len(res.Pointers) != 0 {
+		t.Errorf("the pointers should not be expanded for a tenant: %+v", res.Pointers)
+	}
+
+	if status := do("alice", "POST", "/api/stash/bob./_merge", "", nil); status != http.StatusForbidden {
+		t.Errorf("merge: expected a 403, got %d", status)
+	}
+}
@@ -0,0 +1,455 @@
+package filetree // import "a4.io/blobstash/pkg/filetree"
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"a4.io/blobsfile"
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/client/clientutil"
+	"a4.io/blobstash/pkg/clock"
+	"a4.io/blobstash/pkg/ctxutil"
+	rnode "a4.io/blobstash/pkg/filetree/filetreeutil/node"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/perms"
+)
+
+// TrashKeyFmt is the kv key holding the `.trash` tree of a FS
+var TrashKeyFmt = "_filetree:trash:%s"
+
+// Prefix of the trash entries keys in the expiration index
+const trashExpiryPrefix = "filetree-trash:"
+
+// Metadata key holding the original path of a trashed node
+const trashPathKey = "trash_path"
+
+// ErrTrashEntryNotFound is returned when the trash entry does not exist (or was already purged)
+var ErrTrashEntryNotFound = errors.New("trash entry not found")
+
+// TrashEntry represents a deleted node kept in the trash of a FS.
+//
+// The deleted nodes are stored as the children of the FS `.trash` tree, named `<deletion time (unix nano)>-<name>`.
+type TrashEntry struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Path        string `json:"path"`
+	Type        string `json:"type"`
+	Size        int    `json:"size"`
+	Ref         string `json:"ref"`
+	ContentHash string `json:"content_hash,omitempty"`
+	DeletedAt   int64  `json:"deleted_at"`
+	PurgeAt     int64  `json:"purge_at,omitempty"`
+}
+
+func trashExpiryKey(ctx context.Context, fsName, id string) string {
+	ns, _ := ctxutil.Namespace(ctx)
+	return trashExpiryPrefix + ns + "\x00" + fsName + "\x00" + id
+}
+
+// parseTrashID returns the deletion time (unix nano) and the node name of the trash entry
+func parseTrashID(id string) (int64, string, error) {
+	parts := strings.SplitN(id, "-", 2)
+	if len(parts) != 2 {
+		return 0, "", fmt.Errorf("invalid trash entry %q", id)
+	}
+	deletedAt, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, "", fmt.Errorf("invalid trash entry %q", id)
+	}
+	return deletedAt, parts[1], nil
+}
+
+// trashRoot returns the root of the trash tree of the FS (created if needed), only the raw nodes of the children
+// are fetched
+func (ft *FileTree) trashRoot(ctx context.Context, fsName string) (*Node, error) {
+	fs, err := ft.FS(ctx, fsName, TrashKeyFmt, false, 0)
+	if err != nil {
+		return nil, err
+	}
+	root, err := fs.Root(ctx, true, clock.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	root.Children = []*Node{}
+	for _, ref := range root.Meta.Refs {
+		m, err := ft.rawNode(ctx, ref.(string))
+		if err != nil {
+			return nil, err
+		}
+		child, err := ft.metaToNode(ctx, m)
+		if err != nil {
+			return nil, err
+		}
+		child.parent = root
+		child.fs = fs
+		root.Children = append(root.Children, child)
+	}
+	return root, nil
+}
+
+func (ft *FileTree) trashEntry(fsName string, n *Node) (*TrashEntry, error) {
+	deletedAt, name, err := parseTrashID(n.Name)
+	if err != nil {
+		return nil, err
+	}
+	e := &TrashEntry{
+		ID:          n.Name,
+		Name:        name,
+		Type:        n.Type,
+		Size:        n.Size,
+		Ref:         n.Hash,
+		ContentHash: n.ContentHash,
+		DeletedAt:   deletedAt,
+	}
+	if p, ok := n.Meta.Metadata[trashPathKey].(string); ok {
+		e.Path = p
+	}
+	if retention := ft.conf.FiletreeTrashRetention(fsName); retention > 0 {
+		e.PurgeAt = time.Unix(0, deletedAt).Add(retention).UnixNano()
+	}
+	return e, nil
+}
+
+// moveToTrash adds the node (located at path in the FS) to the trash of the FS and schedules its purge, the node must
+// be deleted from the FS by the caller
+func (ft *FileTree) moveToTrash(ctx context.Context, fsName, path string, n *Node, retention time.Duration) (*TrashEntry, error) {
+	root, err := ft.trashRoot(ctx, fsName)
+	if err != nil {
+		return nil, err
+	}
+	now := clock.Now()
+
+	// Copy the raw node before renaming it
+	m := *n.Meta
+	m.Name = fmt.Sprintf("%d-%s", now.UnixNano(), n.Name)
+	m.Metadata = map[string]interface{}{}
+	for k, v := range n.Meta.Metadata {
+		m.Metadata[k] = v
+	}
+	m.Metadata[trashPathKey] = path
+
+	if _, _, err := ft.AddChild(ctx, nil, root, &m, TrashKeyFmt, now.Unix()); err != nil {
+		return nil, err
+	}
+	if err := ft.expiry.Set(trashExpiryKey(ctx, fsName, m.Name), now.Add(retention)); err != nil {
+		return nil, err
+	}
+	entry, err := ft.metaToNode(ctx, &m)
+	if err != nil {
+		return nil, err
+	}
+	return ft.trashEntry(fsName, entry)
+}
+
+// TrashEntries returns the entries of the FS trash (the most recently deleted first)
+func (ft *FileTree) TrashEntries(ctx context.Context, fsName string) ([]*TrashEntry, error) {
+	root, err := ft.trashRoot(ctx, fsName)
+	if err != nil {
+		return nil, err
+	}
+	out := []*TrashEntry{}
+	for _, c := range root.Children {
+		e, err := ft.trashEntry(fsName, c)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].DeletedAt == out[j].DeletedAt {
+			return out[i].ID < out[j].ID
+		}
+		return out[i].DeletedAt > out[j].DeletedAt
+	})
+	return out, nil
+}
+
+func trashChild(root *Node, id string) (*Node, error) {
+	for _, c := range root.Children {
+		if c.Name == id {
+			return c, nil
+		}
+	}
+	return nil, ErrTrashEntryNotFound
+}
+
+// RestoreTrashEntry moves the trash entry back into the FS, at its original path if dest is empty (the destination
+// must not exist), returns the restored node and its path
+func (ft *FileTree) RestoreTrashEntry(ctx context.Context, fsName, id, dest string) (*Node, string, int64, error) {
+	root, err := ft.trashRoot(ctx, fsName)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	entry, err := trashChild(root, id)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	if dest == "" {
+		dest, _ = entry.Meta.Metadata[trashPathKey].(string)
+	}
+	dest = "/" + strings.Trim(dest, "/")
+	if dest == "/" {
+		return nil, "", 0, httputil.NewError(http.StatusBadRequest, "invalid restore path")
+	}
+
+	fs, err := ft.FS(ctx, fsName, FSKeyFmt, false, 0)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	mtime := clock.Now().Unix()
+	node, _, created, err := fs.Path(ctx, dest, 1, true, mtime)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	if !created {
+		return nil, "", 0, httputil.Errorf(http.StatusConflict, "%q already exists", dest)
+	}
+	limit, err := ft.uploadLimit(ctx, fsName, node)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	stats, err := ft.du(ctx, entry.Meta)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	if err := limit.check(stats.Size, entry.Meta.IsFile()); err != nil {
+		return nil, "", 0, err
+	}
+
+	// Strip the trash info from the node and save it under its new name
+	m := *entry.Meta
+	m.Name = filepath.Base(dest)
+	m.Metadata = nil
+	for k, v := range entry.Meta.Metadata {
+		if k == trashPathKey {
+			continue
+		}
+		if m.Metadata == nil {
+			m.Metadata = map[string]interface{}{}
+		}
+		m.Metadata[k] = v
+	}
+	ref, data := m.Encode()
+	m.Hash = ref
+	if _, err := ft.blobStore.Put(ctx, &blob.Blob{Hash: ref, Data: data}); err != nil {
+		return nil, "", 0, err
+	}
+	newNode, revision, err := ft.Update(ctx, nil, node, &m, FSKeyFmt, true)
+	if err != nil {
+		return nil, "", 0, err
+	}
+
+	if err := ft.removeTrashEntry(ctx, fsName, entry); err != nil {
+		return nil, "", 0, err
+	}
+	return newNode, dest, revision, nil
+}
+
+func (ft *FileTree) removeTrashEntry(ctx context.Context, fsName string, entry *Node) error {
+	if _, _, err := ft.Delete(ctx, nil, entry, TrashKeyFmt, clock.Now().Unix()); err != nil {
+		return err
+	}
+	return ft.expiry.Remove(trashExpiryKey(ctx, fsName, entry.Name))
+}
+
+// PurgeTrashEntry removes the entry from the trash of the FS
+func (ft *FileTree) PurgeTrashEntry(ctx context.Context, fsName, id string) error {
+	root, err := ft.trashRoot(ctx, fsName)
+	if err != nil {
+		return err
+	}
+	entry, err := trashChild(root, id)
+	if err != nil {
+		return err
+	}
+	return ft.removeTrashEntry(ctx, fsName, entry)
+}
+
+// PurgeTrash removes all the entries from the trash of the FS
+func (ft *FileTree) PurgeTrash(ctx context.Context, fsName string) error {
+	root, err := ft.trashRoot(ctx, fsName)
+	if err != nil {
+		return err
+	}
+	if len(root.Children) == 0 {
+		return nil
+	}
+	empty := &rnode.RawNode{
+		Type:    rnode.Dir,
+		Version: rnode.V1,
+		Name:    "_root",
+		ModTime: clock.Now().Unix(),
+	}
+	ref, data := empty.Encode()
+	if _, err := ft.blobStore.Put(ctx, &blob.Blob{Hash: ref, Data: data}); err != nil {
+		return err
+	}
+	if _, err := ft.putRoot(ctx, fmt.Sprintf(TrashKeyFmt, fsName), ref, &Snapshot{}); err != nil {
+		return err
+	}
+	for _, c := range root.Children {
+		if err := ft.expiry.Remove(trashExpiryKey(ctx, fsName, c.Name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expireTrashEntry is called by the expiration index when a trash entry must be purged
+func (ft *FileTree) expireTrashEntry(key string) error {
+	parts := strings.SplitN(strings.TrimPrefix(key, trashExpiryPrefix), "\x00", 3)
+	if len(parts) != 3 {
+		return nil
+	}
+	ft.log.Debug("trash entry expired", "ns", parts[0], "fs", parts[1], "id", parts[2])
+	ctx := ctxutil.WithNamespace(context.Background(), parts[0])
+	if err := ft.PurgeTrashEntry(ctx, parts[1], parts[2]); err != nil && err != ErrTrashEntryNotFound {
+		return err
+	}
+	return nil
+}
+
+// trashHandler lists (GET) or purges (DELETE) the trash of the FS
+func (ft *FileTree) trashHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		if vars["type"] != "fs" {
+			httputil.WriteJSONError(w, http.StatusBadRequest, "only FS references have a trash")
+			return
+		}
+		fsName := vars["name"]
+		ctx := ctxutil.WithNamespace(r.Context(), r.Header.Get(ctxutil.NamespaceHeader))
+
+		switch r.Method {
+		case "GET", "HEAD":
+			if !auth.Can(
+				w,
+				r,
+				perms.Action(perms.Read, perms.FS),
+				perms.ResourceWithID(perms.Filetree, perms.FS, fsName),
+			) {
+				auth.Forbidden(w)
+				return
+			}
+			entries, err := ft.TrashEntries(ctx, fsName)
+			if err != nil {
+				panic(err)
+			}
+			httputil.MarshalAndWrite(r, w, map[string]interface{}{
+				"data": entries,
+			})
+		case "DELETE":
+			if !auth.Can(
+				w,
+				r,
+				perms.Action(perms.Delete, perms.FS),
+				perms.ResourceWithID(perms.Filetree, perms.FS, fsName),
+			) {
+				auth.Forbidden(w)
+				return
+			}
+			if err := ft.PurgeTrash(ctx, fsName); err != nil {
+				panic(err)
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			httputil.WriteErrorStatus(w, http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// trashEntryHandler purges a single entry from the trash of the FS
+func (ft *FileTree) trashEntryHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "DELETE" {
+			httputil.WriteErrorStatus(w, http.StatusMethodNotAllowed)
+			return
+		}
+		vars := mux.Vars(r)
+		if vars["type"] != "fs" {
+			httputil.WriteJSONError(w, http.StatusBadRequest, "only FS references have a trash")
+			return
+		}
+		fsName := vars["name"]
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Delete, perms.FS),
+			perms.ResourceWithID(perms.Filetree, perms.FS, fsName),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+		ctx := ctxutil.WithNamespace(r.Context(), r.Header.Get(ctxutil.NamespaceHeader))
+		switch err := ft.PurgeTrashEntry(ctx, fsName, vars["id"]); err {
+		case nil:
+		case ErrTrashEntryNotFound:
+			httputil.WriteErrorStatus(w, http.StatusNotFound)
+			return
+		default:
+			panic(err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// trashRestoreHandler moves a trash entry back into the FS, at its original path or at `path` if set
+func (ft *FileTree) trashRestoreHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			httputil.WriteErrorStatus(w, http.StatusMethodNotAllowed)
+			return
+		}
+		vars := mux.Vars(r)
+		if vars["type"] != "fs" {
+			httputil.WriteJSONError(w, http.StatusBadRequest, "only FS references have a trash")
+			return
+		}
+		fsName := vars["name"]
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Write, perms.FS),
+			perms.ResourceWithID(perms.Filetree, perms.FS, fsName),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+		ctx := ctxutil.WithNamespace(r.Context(), r.Header.Get(ctxutil.NamespaceHeader))
+		newNode, path, revision, err := ft.RestoreTrashEntry(ctx, fsName, vars["id"], r.URL.Query().Get("path"))
+		switch err {
+		case nil:
+		case ErrTrashEntryNotFound, clientutil.ErrBlobNotFound, blobsfile.ErrBlobNotFound:
+			httputil.WriteErrorStatus(w, http.StatusNotFound)
+			return
+		default:
+			panic(err)
+		}
+
+		w.Header().Add("BlobStash-Filetree-FS-Revision", strconv.FormatInt(revision, 10))
+
+		updateEvent := &FSUpdateEvent{
+			Name:      fsName,
+			Type:      fmt.Sprintf("%s-restored", newNode.Type),
+			Ref:       newNode.Hash,
+			Path:      path[1:],
+			Time:      time.Now().UTC().Unix(),
+			SessionID: httputil.GetSessionID(r),
+		}
+		if err := ft.hub.FiletreeFSUpdateEvent(ctx, nil, updateEvent.JSON()); err != nil {
+			panic(err)
+		}
+
+		httputil.MarshalAndWrite(r, w, newNode)
+	}
+}
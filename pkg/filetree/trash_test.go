@@ -0,0 +1,130 @@
+package filetree_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/filetree"
+	"a4.io/blobstash/pkg/testutil"
+)
+
+func TestTrash(t *testing.T) {
+	srv := testutil.NewServer(t, func(conf *config.Config) {
+		conf.Filetree = &config.Filetree{Trash: map[string]string{"*": "24h"}}
+	})
+	defer srv.Close()
+
+	do := func(method, path, body string) (int, []byte) {
+		resp, err := srv.Do(method, "/api/filetree/fs/fs/"+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, data
+	}
+	entries := func() []*filetree.TrashEntry {
+		status, data := do("GET", "docs/_trash", "")
+		if status != http.StatusOK {
+			t.Fatalf("failed to list the trash: %d", status)
+		}
+		res := struct {
+			Data []*filetree.TrashEntry `json:"data"`
+		}{}
+		if err := json.Unmarshal(data, &res); err != nil {
+			t.Fatal(err)
+		}
+		return res.Data
+	}
+
+	for _, p := range []string{"dir/a.txt", "b.txt", "c.txt"} {
+		if status, _ := do("POST", "docs/_append?path="+p, "hello"); status != http.StatusOK {
+			t.Fatalf("failed to create %s: %d", p, status)
+		}
+	}
+
+	if status, _ := do("DELETE", "docs/dir/a.txt", ""); status != http.StatusNoContent {
+		t.Fatalf("expected a 204, got %d", status)
+	}
+	if status, _ := do("GET", "docs/dir/a.txt", ""); status != http.StatusNotFound {
+		t.Errorf("expected a 404 for the deleted file, got %d", status)
+	}
+	trash := entries()
+	if len(trash) != 1 || trash[0].Path != "/dir/a.txt" || trash[0].Name != "a.txt" || trash[0].Type != "file" {
+		t.Fatalf("unexpected trash %+v", trash)
+	}
+
+	// Restore the file at its original path
+	if status, _ := do("POST", "docs/_trash/"+trash[0].ID+"/_restore", ""); status != http.StatusOK {
+		t.Fatalf("failed to restore: %d", status)
+	}
+	if status, data := do("GET", "docs/dir/a.txt", ""); status != http.StatusOK || !strings.Contains(string(data), trash[0].ContentHash) {
+		t.Errorf("expected the restored file, got %d %s", status, data)
+	}
+	if trash := entries(); len(trash) != 0 {
+		t.Errorf("expected an empty trash, got %+v", trash)
+	}
+
+	// The destination must not exist
+	do("DELETE", "docs/dir/a.txt", "")
+	do("POST", "docs/_append?path=dir/a.txt", "new")
+	trash = entries()
+	if status, _ := do("POST", "docs/_trash/"+trash[0].ID+"/_restore", ""); status != http.StatusConflict {
+		t.Errorf("expected a 409, got %d", status)
+	}
+	if status, _ := do("POST", "docs/_trash/"+trash[0].ID+"/_restore?path=dir/a.old.txt", ""); status != http.StatusOK {
+		t.Errorf("failed to restore to another path: %d", status)
+	}
+
+	// Purge a single entry
+	do("DELETE", "docs/b.txt", "")
+	trash = entries()
+	if status, _ := do("DELETE", "docs/_trash/"+trash[0].ID, ""); status != http.StatusNoContent {
+		t.Errorf("expected a 204, got %d", status)
+	}
+	if status, _ := do("POST", "docs/_trash/"+trash[0].ID+"/_restore", ""); status != http.StatusNotFound {
+		t.Errorf("expected a 404 for the purged entry, got %d", status)
+	}
+
+	// Permanent delete
+	if status, _ := do("DELETE", "docs/dir/a.old.txt?permanent=1", ""); status != http.StatusNoContent {
+		t.Errorf("expected a 204, got %d", status)
+	}
+	if trash := entries(); len(trash) != 0 {
+		t.Errorf("expected an empty trash, got %+v", trash)
+	}
+
+	// Automatic purge once the retention elapsed
+	do("DELETE", "docs/c.txt", "")
+	srv.Clock.Add(23 * time.Hour)
+	if err := srv.Server.Expire(); err != nil {
+		t.Fatal(err)
+	}
+	if trash := entries(); len(trash) != 1 {
+		t.Fatalf("expected 1 entry, got %+v", trash)
+	}
+	srv.Clock.Add(time.Hour)
+	if err := srv.Server.Expire(); err != nil {
+		t.Fatal(err)
+	}
+	if trash := entries(); len(trash) != 0 {
+		t.Errorf("expected the entry to be purged, got %+v", trash)
+	}
+
+	// Purge all
+	do("DELETE", "docs/dir/a.txt", "")
+	if status, _ := do("DELETE", "docs/_trash", ""); status != http.StatusNoContent {
+		t.Errorf("expected a 204, got %d", status)
+	}
+	if trash := entries(); len(trash) != 0 {
+		t.Errorf("expected an empty trash, got %+v", trash)
+	}
+}
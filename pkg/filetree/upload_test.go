@@ -0,0 +1,42 @@
+package filetree_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"a4.io/blobstash/pkg/filetree/writer"
+	"a4.io/blobstash/pkg/testutil"
+)
+
+func TestUploadStats(t *testing.T) {
+	srv := testutil.NewServer(t)
+	defer srv.Close()
+
+	upload := func(path string) *writer.WriteStats {
+		resp, err := srv.Do("POST", "/api/filetree/fs/fs/docs/_append?path="+path, strings.NewReader("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("failed to upload %s: %d", path, resp.StatusCode)
+		}
+		res := struct {
+			UploadStats *writer.WriteStats `json:"upload_stats"`
+		}{}
+		if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		return res.UploadStats
+	}
+
+	if stats := upload("a.txt"); stats == nil || *stats != (writer.WriteStats{ChunksCount: 1, ChunksUploaded: 1, Size: 5, SizeUploaded: 5}) {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	// Same content, nothing is uploaded
+	if stats := upload("b.txt"); stats == nil || *stats != (writer.WriteStats{ChunksCount: 1, Size: 5}) {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
@@ -0,0 +1,295 @@
+package filetree // import "a4.io/blobstash/pkg/filetree"
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+	"github.com/gorilla/mux"
+
+	"a4.io/blobsfile"
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/client/clientutil"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/httputil/bewit"
+	"a4.io/blobstash/pkg/perms"
+)
+
+// Public upload links (write-only shares)
+//
+// The inverse of the bewit read shares: a signed `/up/{fs}` URL lets an unauthenticated client upload files in
+// a specific dir of a FS. The restrictions (dir, max size and allowed types) are part of the signed query, and the
+// bewit is only valid for POST requests (a GET displays a minimal upload form). Existing files are never
+// overwritten.
+
+const (
+	// Default max size of a file uploaded via a link
+	defaultUploadLinkMaxSize = 32 << 20
+)
+
+var uploadFormTmpl = template.Must(template.New("upload").Parse(`<!doctype html>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Upload</title>
+<form method="post" enctype="multipart/form-data">
+<input type="file" name="file"{{ if .Accept }} accept="{{ .Accept }}"{{ end }} required>
+<button type="submit">Upload</button>
+</form>
+<p><small>Max size: {{ .MaxSize }}</small></p>
+`))
+
+var uploadDoneTmpl = template.Must(template.New("upload_done").Parse(`<!doctype html>
+<meta charset="utf-8">
+<title>Upload</title>
+<p>{{ .Name }} uploaded.</p>
+<p><a href="">Upload another file</a></p>
+`))
+
+// UploadLink returns a signed URL that allows to upload files in the given dir of the FS (`types` is a list of
+// extensions like `.pdf`, or MIME types like `image/*`, an empty list allows any type)
+func (ft *FileTree) UploadLink(fsName, dir string, maxSize int64, types []string, ttl time.Duration) (string, error) {
+	q := url.Values{}
+	q.Set("path", "/"+strings.Trim(dir, "/"))
+	q.Set("max_size", strconv.FormatInt(maxSize, 10))
+	if len(types) > 0 {
+		q.Set("types", strings.Join(types, ","))
+	}
+	u := &url.URL{Path: fmt.Sprintf("/up/%s", fsName), RawQuery: q.Encode()}
+	if err := bewit.BewitMethod(ft.uploadCred, u, ttl, "POST"); err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+// typeAllowed returns true if the file matches one of the allowed extensions/MIME types
+func typeAllowed(types []string, filename, contentType string) bool {
+	if len(types) == 0 {
+		return true
+	}
+	ext := strings.ToLower(filepath.Ext(filename))
+	if ct := mime.TypeByExtension(ext); ct != "" {
+		contentType = ct
+	}
+	contentType, _, _ = mime.ParseMediaType(contentType)
+	for _, t := range types {
+		t = strings.ToLower(strings.TrimSpace(t))
+		switch {
+		case strings.HasPrefix(t, "."):
+			if ext == t {
+				return true
+			}
+		case strings.HasSuffix(t, "/*"):
+			if strings.HasPrefix(contentType, strings.TrimSuffix(t, "*")) {
+				return true
+			}
+		case t != "" && t == contentType:
+			return true
+		}
+	}
+	return false
+}
+
+// uploadLinkHandler generates an upload link for the given dir (query args: `path`, `max_size`, `types` and `ttl`)
+func (ft *FileTree) uploadLinkHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			httputil.WriteErrorStatus(w, http.StatusMethodNotAllowed)
+			return
+		}
+		vars := mux.Vars(r)
+		if vars["type"] != "fs" {
+			httputil.WriteJSONError(w, http.StatusBadRequest, "upload links are only supported for FS references")
+			return
+		}
+		fsName := vars["name"]
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Write, perms.FS),
+			perms.ResourceWithID(perms.Filetree, perms.FS, fsName),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+		q := httputil.NewQuery(r.URL.Query())
+		maxSize, err := q.GetInt64Default("max_size", defaultUploadLinkMaxSize)
+		if err != nil {
+			panic(err)
+		}
+		if maxSize <= 0 || maxSize > MaxUploadSize {
+			httputil.WriteJSONError(w, http.StatusBadRequest, fmt.Sprintf("max_size must be between 1 and %d", MaxUploadSize))
+			return
+		}
+		ttl := ft.ShareTTL()
+		if v := q.Get("ttl"); v != "" {
+			ttl, err = time.ParseDuration(v)
+			if err != nil || ttl <= 0 {
+				httputil.WriteJSONError(w, http.StatusBadRequest, "invalid ttl")
+				return
+			}
+		}
+		var types []string
+		if v := q.Get("types"); v != "" {
+			types = strings.Split(v, ",")
+		}
+		dir := "/" + strings.Trim(q.Get("path"), "/")
+
+		link, err := ft.UploadLink(fsName, dir, maxSize, types, ttl)
+		if err != nil {
+			panic(err)
+		}
+		httputil.MarshalAndWrite(r, w, map[string]interface{}{
+			"url":        link,
+			"path":       dir,
+			"max_size":   maxSize,
+			"types":      types,
+			"expires_at": time.Now().Add(ttl).Unix(),
+		})
+	}
+}
+
+// publicUploadHandler handles the uploads via a signed link
+func (ft *FileTree) publicUploadHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if err := bewit.ValidateMethod(r, ft.uploadCred, "POST"); err != nil {
+			httputil.Log(r, ft.log).Debug("invalid upload link", "err", err)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		ctx := r.Context()
+		fsName := mux.Vars(r)["name"]
+		q := httputil.NewQuery(r.URL.Query())
+		maxSize, err := q.GetInt64Default("max_size", defaultUploadLinkMaxSize)
+		if err != nil {
+			panic(err)
+		}
+		var types []string
+		if v := q.Get("types"); v != "" {
+			types = strings.Split(v, ",")
+		}
+		dir := "/" + strings.Trim(q.Get("path"), "/")
+
+		if r.Method == "GET" {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			httputil.SetNoCache(w)
+			if err := uploadFormTmpl.Execute(w, map[string]interface{}{
+				"Accept":  strings.Join(types, ","),
+				"MaxSize": humanize.Bytes(uint64(maxSize)),
+			}); err != nil {
+				httputil.Log(r, ft.log).Error("failed to render upload form", "err", err)
+			}
+			return
+		}
+
+		// Reject the too large requests early (with some room for the multipart overhead)
+		r.Body = http.MaxBytesReader(w, r.Body, maxSize+(1<<20))
+		if err := r.ParseMultipartForm(32 << 20); err != nil {
+			httputil.WriteJSONError(w, http.StatusRequestEntityTooLarge, "file too large")
+			return
+		}
+		defer r.MultipartForm.RemoveAll()
+		file, handler, err := r.FormFile("file")
+		if err != nil {
+			httputil.WriteJSONError(w, http.StatusBadRequest, "missing file")
+			return
+		}
+		defer file.Close()
+		if handler.Size > maxSize {
+			httputil.WriteJSONError(w, http.StatusRequestEntityTooLarge, "file too large")
+			return
+		}
+		filename := filepath.Base(filepath.Clean("/" + strings.Replace(handler.Filename, "\\", "/", -1)))
+		if filename == "/" || filename == "." || strings.HasPrefix(filename, ".") {
+			httputil.WriteJSONError(w, http.StatusBadRequest, "invalid filename")
+			return
+		}
+		if !typeAllowed(types, filename, handler.Header.Get("Content-Type")) {
+			httputil.WriteJSONError(w, http.StatusUnsupportedMediaType, "file type not allowed")
+			return
+		}
+
+		fs, err := ft.FS(ctx, fsName, FSKeyFmt, false, 0)
+		if err != nil {
+			panic(err)
+		}
+		p := path.Join(dir, filename)
+
+		// Never overwrite an existing file
+		_, _, _, err = fs.Path(ctx, p, 1, false, 0)
+		switch err {
+		case nil:
+			httputil.WriteJSONError(w, http.StatusConflict, "file already exists")
+			return
+		case clientutil.ErrBlobNotFound, blobsfile.ErrBlobNotFound:
+		default:
+			panic(err)
+		}
+
+		mtime := time.Now().Unix()
+		node, _, _, err := fs.Path(ctx, p, 1, true, mtime)
+		if err != nil {
+			panic(err)
+		}
+		limit, err := ft.uploadLimit(ctx, fs.Name, node)
+		if err != nil {
+			panic(err)
+		}
+		if err := limit.check(handler.Size, true); err != nil {
+			panic(err)
+		}
+		// The chunking cannot be overridden by the uploader
+		uploader, err := ft.newUploader(ctx, fs.Name, nil)
+		if err != nil {
+			panic(err)
+		}
+		limit.apply(uploader)
+		meta, err := uploader.PutReader(filename, io.LimitReader(file, maxSize), nil)
+		if err != nil {
+			panic(limit.error(err))
+		}
+		meta.ModTime = mtime
+		newNode, _, err := ft.Update(ctx, nil, node, meta, FSKeyFmt, true)
+		if err != nil {
+			panic(err)
+		}
+
+		updateEvent := &FSUpdateEvent{
+			Name:      fs.Name,
+			Type:      "file-created",
+			Ref:       newNode.Hash,
+			Path:      p[1:],
+			Time:      time.Now().UTC().Unix(),
+			SessionID: httputil.GetSessionID(r),
+		}
+		if err := ft.hub.FiletreeFSUpdateEvent(ctx, nil, updateEvent.JSON()); err != nil {
+			panic(err)
+		}
+
+		// Only return the name/size, the uploader cannot read the FS
+		if strings.Contains(r.Header.Get("Accept"), "text/html") {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(http.StatusCreated)
+			if err := uploadDoneTmpl.Execute(w, map[string]interface{}{"Name": filename}); err != nil {
+				httputil.Log(r, ft.log).Error("failed to render upload form", "err", err)
+			}
+			return
+		}
+		httputil.MarshalAndWrite(r, w, map[string]interface{}{
+			"name": filename,
+			"size": meta.Size,
+		}, httputil.WithStatusCode(http.StatusCreated))
+	}
+}
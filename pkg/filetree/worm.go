@@ -0,0 +1,119 @@
+package filetree // import "a4.io/blobstash/pkg/filetree"
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"a4.io/blobsfile"
+	"a4.io/blobstash/pkg/client/clientutil"
+	"a4.io/blobstash/pkg/clock"
+	rnode "a4.io/blobstash/pkg/filetree/filetreeutil/node"
+	"a4.io/blobstash/pkg/vkv"
+	"a4.io/blobstash/pkg/worm"
+)
+
+// checkRetention returns an error if the node (at path in the FS) can't be deleted or overwritten yet, i.e. the FS is
+// protected by a WORM policy and the node was written within the retention period (it was not present unchanged in
+// the FS `retention` ago)
+func (ft *FileTree) checkRetention(ctx context.Context, fsName, path, ref string) error {
+	retention := worm.FSRetention(fsName)
+	if retention == 0 || ref == "" {
+		return nil
+	}
+	since := clock.Now().Add(-retention)
+	old, err := ft.FS(ctx, fsName, FSKeyFmt, false, since.UnixNano())
+	if err != nil {
+		return err
+	}
+	if old.Ref != "" {
+		oldNode, _, _, err := old.Path(ctx, path, 1, false, 0)
+		switch err {
+		case nil:
+			if oldNode.Hash == ref {
+				return nil
+			}
+		case clientutil.ErrBlobNotFound, blobsfile.ErrBlobNotFound:
+		default:
+			return err
+		}
+	}
+	// The exact write time is unknown, it can be deleted at the latest after a full retention period
+	return worm.Error(fmt.Sprintf("%q in FS %q", path, fsName), clock.Now().Add(retention))
+}
+
+// CheckKvWrite returns an error if the kv write replaces (or deletes, if ref is empty) the root of a FS with nodes
+// still under WORM retention, it's enforced by the kvstore layer so the FS keys can't be updated via the kv API
+func (ft *FileTree) CheckKvWrite(ctx context.Context, key, ref string) error {
+	return ft.checkRootRetention(ctx, key, ref)
+}
+
+// checkRootRetention returns an error if replacing the current root of the FS (stored at key) with newRef deletes or
+// overwrites nodes under retention
+func (ft *FileTree) checkRootRetention(ctx context.Context, key, newRef string) error {
+	fsName := strings.TrimPrefix(key, strings.Replace(FSKeyFmt, "%s", "", 1))
+	if fsName == key || worm.FSRetention(fsName) == 0 {
+		return nil
+	}
+	cur, err := ft.kvStore.Get(ctx, key, -1)
+	switch err {
+	case nil:
+	case vkv.ErrNotFound:
+		return nil
+	default:
+		return err
+	}
+	return ft.checkReplaceRetention(ctx, fsName, "/", cur.HexHash(), newRef)
+}
+
+// checkReplaceRetention compares the old and the new node at path, and checks the retention of the deleted/overwritten
+// nodes (the unchanged subtrees are skipped)
+func (ft *FileTree) checkReplaceRetention(ctx context.Context, fsName, path, oldRef, newRef string) error {
+	if oldRef == "" || oldRef == newRef {
+		return nil
+	}
+	if newRef == "" {
+		// Deleted
+		return ft.checkRetention(ctx, fsName, path, oldRef)
+	}
+	oldMeta, err := ft.rawNode(ctx, oldRef)
+	if err != nil {
+		return err
+	}
+	newMeta, err := ft.rawNode(ctx, newRef)
+	if err != nil {
+		return err
+	}
+	if oldMeta.Type != rnode.Dir || newMeta.Type != rnode.Dir {
+		return ft.checkRetention(ctx, fsName, path, oldRef)
+	}
+
+	newChildren := map[string]string{}
+	for _, ref := range newMeta.Refs {
+		m, err := ft.rawNode(ctx, ref.(string))
+		if err != nil {
+			return err
+		}
+		newChildren[m.Name] = ref.(string)
+	}
+	for _, ref := range oldMeta.Refs {
+		m, err := ft.rawNode(ctx, ref.(string))
+		if err != nil {
+			return err
+		}
+		childPath := filepath.Join(path, m.Name)
+		newChildRef, ok := newChildren[m.Name]
+		if !ok {
+			// Deleted child
+			if err := ft.checkRetention(ctx, fsName, childPath, ref.(string)); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := ft.checkReplaceRetention(ctx, fsName, childPath, ref.(string), newChildRef); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package filetree_test
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/testutil"
+)
+
+func TestWORMRetention(t *testing.T) {
+	srv := testutil.NewServer(t, func(conf *config.Config) {
+		conf.WORM = []*config.WORM{{FS: "backup-*", Retention: "24h"}}
+	})
+	defer srv.Close()
+
+	do := func(method, path, body string) int {
+		resp, err := srv.Do(method, "/api/filetree/fs/fs/"+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	for _, fs := range []string{"backup-1", "other"} {
+		if status := do("POST", fs+"/_append?path=a.txt", "hello"); status != http.StatusOK {
+			t.Fatalf("%s: failed to create the file: %d", fs, status)
+		}
+	}
+	srv.Clock.Add(time.Hour)
+
+	// The unprotected FS is not affected
+	if status := do("DELETE", "other/a.txt", ""); status != http.StatusNoContent {
+		t.Errorf("expected a 204, got %d", status)
+	}
+
+	// Written within the retention
+	if status := do("DELETE", "backup-1/a.txt", ""); status != http.StatusForbidden {
+		t.Errorf("expected a 403 for the delete, got %d", status)
+	}
+	if status := do("POST", "backup-1/_append?path=a.txt", " world"); status != http.StatusForbidden {
+		t.Errorf("expected a 403 for the overwrite, got %d", status)
+	}
+	// New files can still be added
+	if status := do("POST", "backup-1/_append?path=b.txt", "hello"); status != http.StatusOK {
+		t.Errorf("expected a 200 for the new file, got %d", status)
+	}
+
+	// The FS keys can't be bypassed using the kv API
+	doKv := func(path, body string) int {
+		resp, err := srv.Do("POST", "/api/kvstore/key/"+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := doKv("_filetree:fs:backup-1", "ref="); status != http.StatusForbidden {
+		t.Errorf("expected a 403 for the kv delete, got %d", status)
+	}
+	if status := doKv("_filetree:fs:backup-1/_rename?to=moved", ""); status != http.StatusForbidden {
+		t.Errorf("expected a 403 for the kv rename, got %d", status)
+	}
+	if status := doKv("_filetree:fs:other", "ref="); status != http.StatusOK {
+		t.Errorf("expected a 200 for the unprotected kv delete, got %d", status)
+	}
+
+	// a.txt was already present unchanged 24h ago, but not b.txt
+	srv.Clock.Add(23 * time.Hour)
+	if status := do("DELETE", "backup-1/a.txt", ""); status != http.StatusNoContent {
+		t.Errorf("expected a 204, got %d", status)
+	}
+	if status := do("DELETE", "backup-1/b.txt", ""); status != http.StatusForbidden {
+		t.Errorf("expected a 403, got %d", status)
+	}
+	srv.Clock.Add(time.Hour)
+	if status := do("DELETE", "backup-1/b.txt", ""); status != http.StatusNoContent {
+		t.Errorf("expected a 204, got %d", status)
+	}
+}
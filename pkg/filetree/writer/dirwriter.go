@@ -82,6 +82,11 @@ func (up *Uploader) DirExplorer(path string, pnode *node, nodes chan<- *node) {
 func (up *Uploader) DirWriterNode(node *node) {
 	node.mu.Lock()
 	defer node.mu.Unlock()
+	// Always notify the parent, even on error, or it would wait forever
+	defer func() {
+		node.done = true
+		node.cond.Broadcast()
+	}()
 
 	ctx := context.TODO()
 
@@ -97,6 +102,8 @@ func (up *Uploader) DirWriterNode(node *node) {
 		}
 		if cnode.err != nil {
 			if !os.IsPermission(cnode.err) {
+				node.err = cnode.err
+				cnode.mu.Unlock()
 				return
 			}
 		}
@@ -154,8 +161,6 @@ func (up *Uploader) DirWriterNode(node *node) {
 	} // else {
 	// node.wr.SizeSkipped += len(mjs)
 	// }
-	node.done = true
-	node.cond.Broadcast()
 	return
 }
 
@@ -189,9 +194,9 @@ func (up *Uploader) PutDir(path string) (*rnode.RawNode, error) {
 		up.DirExplorer(path, n, nodes)
 		defer close(nodes)
 	}()
-	// Upload discovered files (5 file descriptor at the same time max).
+	// Upload discovered files (`up.workers` file descriptor at the same time max).
 	wg.Add(1)
-	l := make(chan struct{}, 5)
+	l := make(chan struct{}, up.workers)
 	go func() {
 		defer wg.Done()
 		for f := range nodes {
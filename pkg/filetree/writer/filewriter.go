@@ -1,9 +1,13 @@
 package writer // import "a4.io/blobstash/pkg/filetree/writer"
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"hash"
 	"io"
+	"mime"
+	"net/http"
 	"os"
 	"path/filepath"
 	"time"
@@ -13,46 +17,149 @@ import (
 
 	rnode "a4.io/blobstash/pkg/filetree/filetreeutil/node"
 	"a4.io/blobstash/pkg/hashutil"
+	"a4.io/blobstash/pkg/iface"
 )
 
 var (
 	Pol = chunker.Pol(0x3c657535c4d6f5)
 )
 
-func (up *Uploader) writeReader(f io.Reader, meta *rnode.RawNode) error { // (*WriteResult, error) {
-	ctx := context.TODO()
-	// writeResult := NewWriteResult()
-	// Init the rolling checksum
+// Chunking modes
+const (
+	ChunkingCDC   = "cdc"   // content-defined chunking (the default)
+	ChunkingFixed = "fixed" // fixed-size chunks
+)
 
-	// reuse this buffer
-	buf := make([]byte, 8*1024*1024)
+// Chunk size bounds
+const (
+	MinChunkSize = 64 << 10
+	MaxChunkSize = 8 << 20
+)
+
+// DefaultChunking is the chunking used when none is specified (1MB chunks on average, between 512KB and 8MB)
+var DefaultChunking = &Chunking{Mode: ChunkingCDC, Size: 1 << 20}
+
+// Chunking holds the chunking parameters
+//
+// Smaller chunks improve the deduplication ratio (at the cost of more blobs/metadata), and fixed-size chunks
+// are better suited for data updated in place (like VM images).
+type Chunking struct {
+	Mode string // "cdc" or "fixed"
+	Size int    // average chunk size in CDC mode (must be a power of 2), chunk size in fixed mode
+}
+
+// Validate returns an error if the chunking parameters are not supported
+func (c *Chunking) Validate() error {
+	if c.Size < MinChunkSize || c.Size > MaxChunkSize {
+		return fmt.Errorf("chunk size must be between %d and %d", MinChunkSize, MaxChunkSize)
+	}
+	switch c.Mode {
+	case ChunkingCDC:
+		if c.Size&(c.Size-1) != 0 {
+			return fmt.Errorf("chunk size must be a power of 2 in %q mode", ChunkingCDC)
+		}
+	case ChunkingFixed:
+	default:
+		return fmt.Errorf("unknown chunking mode %q", c.Mode)
+	}
+	return nil
+}
+
+// splitter returns the func splitting the reader into chunks (`io.EOF` is returned once the reader is consumed)
+func (c *Chunking) splitter(r io.Reader) func([]byte) ([]byte, error) {
+	if c.Mode == ChunkingFixed {
+		return func(buf []byte) ([]byte, error) {
+			n, err := io.ReadFull(r, buf[:c.Size])
+			switch err {
+			case nil, io.ErrUnexpectedEOF:
+				return buf[:n], nil
+			default:
+				return nil, err
+			}
+		}
+	}
+	// The average chunk size is 2^bits
+	var bits int
+	for 1<<uint(bits) < c.Size {
+		bits++
+	}
+	max := c.Size * 8
+	if max > MaxChunkSize {
+		max = MaxChunkSize
+	}
+	chunkSplitter := chunker.NewWithBoundaries(r, Pol, uint(c.Size/2), uint(max))
+	chunkSplitter.SetAverageBits(bits)
+	return func(buf []byte) ([]byte, error) {
+		chunk, err := chunkSplitter.Next(buf)
+		if err != nil {
+			return nil, err
+		}
+		return chunk.Data, nil
+	}
+}
+
+// detectContentType sniffs the MIME type from the first bytes of the file, the file extension is used when the
+// content is not recognized (or is plain text, like CSS/JS files)
+func detectContentType(name string, data []byte) string {
+	ct := http.DetectContentType(data)
+	switch ct {
+	case "application/octet-stream", "text/plain; charset=utf-8":
+		if extCt := mime.TypeByExtension(filepath.Ext(name)); extCt != "" {
+			return extCt
+		}
+	}
+	return ct
+}
+
+func (up *Uploader) writeReader(f io.Reader, meta *rnode.RawNode) error { // (*WriteResult, error) {
 	// Prepare the reader to compute the hash on the fly
 	fullHash, err := blake2b.New256(nil)
 	if err != nil {
 		return err
 	}
+	return up.writeChunks(f, meta, fullHash, 0)
+}
+
+// writeChunks chunks the reader and adds the chunks to the meta, starting at the given offset (`fullHash` must
+// already contain the content before the offset)
+func (up *Uploader) writeChunks(f io.Reader, meta *rnode.RawNode, fullHash hash.Hash, size uint) error {
+	ctx := context.TODO()
+	// writeResult := NewWriteResult()
+	// Init the rolling checksum
+
+	// reuse this buffer
+	buf := make([]byte, MaxChunkSize)
 	freader := io.TeeReader(f, fullHash)
-	chunkSplitter := chunker.New(freader, Pol)
+	next := up.chunking.splitter(freader)
 	// TODO don't read one byte at a time if meta.Size < chunker.ChunkMinSize
 	// Prepare the blob writer
-	var size uint
 	for {
-		chunk, err := chunkSplitter.Next(buf)
+		data, err := next(buf)
 		if err == io.EOF {
 			break
 		}
-		chunkHash := hashutil.Compute(chunk.Data)
-		size += chunk.Length
+		if err != nil {
+			return err
+		}
+		chunkHash := hashutil.Compute(data)
+		if size == 0 {
+			meta.MimeType = detectContentType(meta.Name, data)
+		}
+		size += uint(len(data))
+		if up.maxSize >= 0 && int64(size) > up.maxSize {
+			return ErrMaxSizeExceeded
+		}
 
 		exists, err := up.bs.Stat(ctx, chunkHash)
 		if err != nil {
 			panic(fmt.Sprintf("DB error: %v", err))
 		}
 		if !exists {
-			if err := up.bs.Put(ctx, chunkHash, chunk.Data); err != nil {
+			if err := up.bs.Put(ctx, chunkHash, data); err != nil {
 				panic(fmt.Errorf("failed to PUT blob %v", err))
 			}
 		}
+		up.addChunk(len(data), !exists)
 
 		// Save the location and the blob hash into a sorted list (with the offset as index)
 		meta.AddIndexedRef(int(size), chunkHash)
@@ -68,6 +175,64 @@ func (up *Uploader) writeReader(f io.Reader, meta *rnode.RawNode) error { // (*W
 	// return writeResult, nil
 }
 
+// AppendReader returns a new meta for the file with the content of the reader appended, the existing chunks are
+// re-used (only the last one is re-chunked with the new data if it's smaller than the chunk size). The existing
+// content is read (but not re-uploaded) in order to compute the new content hash.
+func (up *Uploader) AppendReader(bg iface.BlobGetter, meta *rnode.RawNode, reader io.Reader) (*rnode.RawNode, error) {
+	ctx := context.TODO()
+	up.StartUpload()
+	defer up.UploadDone()
+
+	newMeta := &rnode.RawNode{
+		Version:  rnode.V1,
+		Type:     rnode.File,
+		Name:     meta.Name,
+		Mode:     meta.Mode,
+		ModTime:  time.Now().Unix(),
+		Metadata: meta.Metadata,
+		MimeType: meta.MimeType,
+	}
+	if newMeta.Mode == 0 {
+		newMeta.Mode = uint32(0644)
+	}
+	fullHash, err := blake2b.New256(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	refs := meta.FileRefs()
+	var tail []byte
+	if n := len(refs); n > 0 {
+		var start int64
+		if n > 1 {
+			start = refs[n-2].Index
+		}
+		if refs[n-1].Index-start < int64(up.chunking.Size) {
+			if tail, err = bg.Get(ctx, refs[n-1].Value); err != nil {
+				return nil, err
+			}
+			refs = refs[:n-1]
+		}
+	}
+	var size uint
+	for _, iv := range refs {
+		data, err := bg.Get(ctx, iv.Value)
+		if err != nil {
+			return nil, err
+		}
+		fullHash.Write(data)
+		size = uint(iv.Index)
+		newMeta.AddIndexedRef(int(iv.Index), iv.Value)
+	}
+	if err := up.writeChunks(io.MultiReader(bytes.NewReader(tail), reader), newMeta, fullHash, size); err != nil {
+		return nil, err
+	}
+	if err := up.PutMeta(newMeta); err != nil {
+		return nil, err
+	}
+	return newMeta, nil
+}
+
 // PutFileRename uploads and renames the file at the given path
 func (up *Uploader) PutFileRename(path, filename string, extraMeta bool) (*rnode.RawNode, error) { // , *WriteResult, error) {
 	return up.putFile(path, filename, extraMeta)
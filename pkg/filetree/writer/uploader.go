@@ -1,21 +1,45 @@
 package writer
 
-import "context"
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"a4.io/blobstash/pkg/iface"
+)
 
 var (
 	uploader    = 25 // concurrent upload uploaders
 	dirUploader = 12 // concurrent directory uploaders
+	dirWorkers  = 5  // default number of nodes uploaded concurrently by `PutDir`
 )
 
+// ErrMaxSizeExceeded is returned when a file is larger than the max size set with `SetMaxSize`
+var ErrMaxSizeExceeded = errors.New("max file size exceeded")
+
+// BlobStorer is the subset of blob methods needed by the uploader (satisfied by both the HTTP client
+// and `iface.NewBlobStorer` for the server-side stores)
 type BlobStorer interface {
-	// Get(context.Context, string) ([]byte, error)
-	// Enumerate(chan<- string, string, string, int) error
-	Stat(context.Context, string) (bool, error)
-	Put(context.Context, string, []byte) error
+	iface.BlobStater
+	iface.BlobPutter
+}
+
+// WriteStats holds the deduplication stats of the written files content (the chunks already present are not uploaded)
+type WriteStats struct {
+	ChunksCount    int   `json:"chunks_count"`
+	ChunksUploaded int   `json:"chunks_uploaded"`
+	Size           int64 `json:"size"`
+	SizeUploaded   int64 `json:"size_uploaded"`
 }
 
 type Uploader struct {
-	bs BlobStorer
+	bs       BlobStorer
+	chunking *Chunking
+	maxSize  int64
+	workers  int
+
+	statsMu sync.Mutex
+	stats   WriteStats
 
 	uploader    chan struct{}
 	dirUploader chan struct{}
@@ -26,13 +50,59 @@ type Uploader struct {
 
 func NewUploader(bs BlobStorer) *Uploader {
 	return &Uploader{
-		bs: bs,
+		bs:       bs,
+		chunking: DefaultChunking,
+		maxSize:  -1,
+		workers:  dirWorkers,
 		// kvs:         kvs,
 		uploader:    make(chan struct{}, uploader),
 		dirUploader: make(chan struct{}, dirUploader),
 	}
 }
 
+// SetChunking sets the chunking parameters used for the files uploaded after the call
+func (up *Uploader) SetChunking(chunking *Chunking) error {
+	if err := chunking.Validate(); err != nil {
+		return err
+	}
+	up.chunking = chunking
+	return nil
+}
+
+// SetMaxSize sets the max size of the files written after the call (negative for no limit, the default), the upload is
+// aborted as soon as the limit is exceeded
+func (up *Uploader) SetMaxSize(maxSize int64) {
+	up.maxSize = maxSize
+}
+
+// SetWorkers sets the number of files/dirs uploaded concurrently by `PutDir` (5 by default)
+func (up *Uploader) SetWorkers(workers int) error {
+	if workers < 1 {
+		return fmt.Errorf("invalid number of workers %d", workers)
+	}
+	up.workers = workers
+	return nil
+}
+
+// Stats returns the deduplication stats of all the files written by the uploader
+func (up *Uploader) Stats() *WriteStats {
+	up.statsMu.Lock()
+	defer up.statsMu.Unlock()
+	stats := up.stats
+	return &stats
+}
+
+func (up *Uploader) addChunk(size int, uploaded bool) {
+	up.statsMu.Lock()
+	defer up.statsMu.Unlock()
+	up.stats.ChunksCount++
+	up.stats.Size += int64(size)
+	if uploaded {
+		up.stats.ChunksUploaded++
+		up.stats.SizeUploaded += int64(size)
+	}
+}
+
 // Block until the client can start the upload, thus limiting the number of file descriptor used.
 func (up *Uploader) StartUpload() {
 	up.uploader <- struct{}{}
@@ -0,0 +1,252 @@
+/*
+Package blake3 implements the BLAKE3 hash function (the default 256 bits output of the hash mode).
+
+This is a portable implementation following the reference one (no SIMD), it implements `hash.Hash`.
+*/
+package blake3 // import "a4.io/blobstash/pkg/hashutil/blake3"
+
+import (
+	"encoding/binary"
+	"hash"
+	"math/bits"
+)
+
+const (
+	// Size is the size of the hash in bytes
+	Size = 32
+	// BlockSize is the block size of the compression function in bytes
+	BlockSize = 64
+
+	chunkLen = 1024
+
+	flagChunkStart = 1 << 0
+	flagChunkEnd   = 1 << 1
+	flagParent     = 1 << 2
+	flagRoot       = 1 << 3
+)
+
+var iv = [8]uint32{
+	0x6A09E667, 0xBB67AE85, 0x3C6EF372, 0xA54FF53A, 0x510E527F, 0x9B05688C, 0x1F83D9AB, 0x5BE0CD19,
+}
+
+var msgPermutation = [16]int{2, 6, 3, 10, 7, 0, 4, 13, 1, 11, 12, 5, 9, 14, 15, 8}
+
+func g(state *[16]uint32, a, b, c, d int, mx, my uint32) {
+	state[a] = state[a] + state[b] + mx
+	state[d] = bits.RotateLeft32(state[d]^state[a], -16)
+	state[c] = state[c] + state[d]
+	state[b] = bits.RotateLeft32(state[b]^state[c], -12)
+	state[a] = state[a] + state[b] + my
+	state[d] = bits.RotateLeft32(state[d]^state[a], -8)
+	state[c] = state[c] + state[d]
+	state[b] = bits.RotateLeft32(state[b]^state[c], -7)
+}
+
+func round(state *[16]uint32, m *[16]uint32) {
+	// Mix the columns
+	g(state, 0, 4, 8, 12, m[0], m[1])
+	g(state, 1, 5, 9, 13, m[2], m[3])
+	g(state, 2, 6, 10, 14, m[4], m[5])
+	g(state, 3, 7, 11, 15, m[6], m[7])
+	// Mix the diagonals
+	g(state, 0, 5, 10, 15, m[8], m[9])
+	g(state, 1, 6, 11, 12, m[10], m[11])
+	g(state, 2, 7, 8, 13, m[12], m[13])
+	g(state, 3, 4, 9, 14, m[14], m[15])
+}
+
+func permute(m *[16]uint32) {
+	var permuted [16]uint32
+	for i := range permuted {
+		permuted[i] = m[msgPermutation[i]]
+	}
+	*m = permuted
+}
+
+// compress returns the first 8 words of the compression function output
+func compress(cv *[8]uint32, block *[16]uint32, counter uint64, blockLen uint32, flags uint32) [8]uint32 {
+	state := [16]uint32{
+		cv[0], cv[1], cv[2], cv[3], cv[4], cv[5], cv[6], cv[7],
+		iv[0], iv[1], iv[2], iv[3],
+		uint32(counter), uint32(counter >> 32), blockLen, flags,
+	}
+	m := *block
+	for i := 0; i < 7; i++ {
+		round(&state, &m)
+		if i < 6 {
+			permute(&m)
+		}
+	}
+	var out [8]uint32
+	for i := range out {
+		out[i] = state[i] ^ state[i+8]
+	}
+	return out
+}
+
+func wordsFromBlock(block []byte) [16]uint32 {
+	var words [16]uint32
+	for i := range words {
+		words[i] = binary.LittleEndian.Uint32(block[i*4:])
+	}
+	return words
+}
+
+// output holds the inputs of a compression, the root one is finalized with the root flag
+type output struct {
+	cv       [8]uint32
+	block    [16]uint32
+	counter  uint64
+	blockLen uint32
+	flags    uint32
+}
+
+func (o *output) chainingValue() [8]uint32 {
+	return compress(&o.cv, &o.block, o.counter, o.blockLen, o.flags)
+}
+
+func (o *output) rootHash() [Size]byte {
+	words := compress(&o.cv, &o.block, 0, o.blockLen, o.flags|flagRoot)
+	var out [Size]byte
+	for i, w := range words {
+		binary.LittleEndian.PutUint32(out[i*4:], w)
+	}
+	return out
+}
+
+type chunkState struct {
+	cv               [8]uint32
+	counter          uint64
+	block            [BlockSize]byte
+	blockLen         int
+	blocksCompressed int
+}
+
+func newChunkState(counter uint64) chunkState {
+	return chunkState{cv: iv, counter: counter}
+}
+
+func (c *chunkState) len() int {
+	return BlockSize*c.blocksCompressed + c.blockLen
+}
+
+func (c *chunkState) startFlag() uint32 {
+	if c.blocksCompressed == 0 {
+		return flagChunkStart
+	}
+	return 0
+}
+
+func (c *chunkState) update(p []byte) {
+	for len(p) > 0 {
+		// Only compress a full block when more input is coming (the last block must be finalized)
+		if c.blockLen == BlockSize {
+			words := wordsFromBlock(c.block[:])
+			c.cv = compress(&c.cv, &words, c.counter, BlockSize, c.startFlag())
+			c.blocksCompressed++
+			c.block = [BlockSize]byte{}
+			c.blockLen = 0
+		}
+		n := copy(c.block[c.blockLen:], p)
+		c.blockLen += n
+		p = p[n:]
+	}
+}
+
+func (c *chunkState) output() *output {
+	return &output{
+		cv:       c.cv,
+		block:    wordsFromBlock(c.block[:]),
+		counter:  c.counter,
+		blockLen: uint32(c.blockLen),
+		flags:    c.startFlag() | flagChunkEnd,
+	}
+}
+
+func parentOutput(left, right [8]uint32) *output {
+	var block [16]uint32
+	copy(block[:8], left[:])
+	copy(block[8:], right[:])
+	return &output{cv: iv, block: block, blockLen: BlockSize, flags: flagParent}
+}
+
+// Hasher is an incremental BLAKE3 hasher
+type Hasher struct {
+	chunk    chunkState
+	cvStack  [][8]uint32
+	chunks   uint64
+	lastSize int
+}
+
+var _ hash.Hash = &Hasher{}
+
+// New returns a new hasher
+func New() *Hasher {
+	h := &Hasher{}
+	h.Reset()
+	return h
+}
+
+// Reset implements `hash.Hash`
+func (h *Hasher) Reset() {
+	h.chunk = newChunkState(0)
+	h.cvStack = h.cvStack[:0]
+	h.chunks = 0
+}
+
+// Size implements `hash.Hash`
+func (h *Hasher) Size() int { return Size }
+
+// BlockSize implements `hash.Hash`
+func (h *Hasher) BlockSize() int { return BlockSize }
+
+// addChunkCV merges the completed subtrees (one merge per trailing 0 bit of the new total number of chunks)
+func (h *Hasher) addChunkCV(cv [8]uint32, totalChunks uint64) {
+	for totalChunks&1 == 0 {
+		left := h.cvStack[len(h.cvStack)-1]
+		h.cvStack = h.cvStack[:len(h.cvStack)-1]
+		cv = parentOutput(left, cv).chainingValue()
+		totalChunks >>= 1
+	}
+	h.cvStack = append(h.cvStack, cv)
+}
+
+// Write implements `io.Writer`
+func (h *Hasher) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		// Only finalize a full chunk when more input is coming (the last chunk may be the root)
+		if h.chunk.len() == chunkLen {
+			cv := h.chunk.output().chainingValue()
+			h.chunks++
+			h.addChunkCV(cv, h.chunks)
+			h.chunk = newChunkState(h.chunks)
+		}
+		want := chunkLen - h.chunk.len()
+		if want > len(p) {
+			want = len(p)
+		}
+		h.chunk.update(p[:want])
+		p = p[want:]
+	}
+	return n, nil
+}
+
+// Sum appends the hash to b (the hasher state is not modified)
+func (h *Hasher) Sum(b []byte) []byte {
+	out := h.chunk.output()
+	for i := len(h.cvStack) - 1; i >= 0; i-- {
+		out = parentOutput(h.cvStack[i], out.chainingValue())
+	}
+	sum := out.rootHash()
+	return append(b, sum[:]...)
+}
+
+// Sum256 returns the BLAKE3 hash of the data
+func Sum256(data []byte) [Size]byte {
+	h := New()
+	h.Write(data)
+	var out [Size]byte
+	copy(out[:], h.Sum(nil))
+	return out
+}
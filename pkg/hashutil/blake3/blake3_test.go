@@ -0,0 +1,50 @@
+package blake3
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// From the official test vectors (the input is the sequence 0, 1, ..., 250, 0, 1...)
+var vectors = []struct {
+	inputLen int
+	hash     string
+}{
+	{0, "af1349b9f5f9a1a6a0404dea36dcc9499bcb25c9adc112b7cc9a93cae41f3262"},
+	{1, "2d3adedff11b61f14c886e35afa036736dcd87a74d27b5c1510225d0f592e213"},
+	{1023, "10108970eeda3eb932baac1428c7a2163b0e924c9a9e25b35bba72b28f70bd11"},
+	{1024, "42214739f095a406f3fc83deb889744ac00df831c10daa55189b5d121c855af7"},
+	{1025, "d00278ae47eb27b34faecf67b4fe263f82d5412916c1ffd97c8cb7fb814b8444"},
+	{2048, "e776b6028c7cd22a4d0ba182a8bf62205d2ef576467e838ed6f2529b85fba24a"},
+	{3073, "7124b49501012f81cc7f11ca069ec9226cecb8a2c850cfe644e327d22d3e1cd3"},
+	{4096, "015094013f57a5277b59d8475c0501042c0b642e531b0a1c8f58d2163229e969"},
+	{8193, "bab6c09cb8ce8cf459261398d2e7aef35700bf488116ceb94a36d0f5f1b7bc3b"},
+	{31744, "62b6960e1a44bcc1eb1a611a8d6235b6b4b78f32e7abc4fb4c6cdcce94895c47"},
+}
+
+func TestVectors(t *testing.T) {
+	for _, tv := range vectors {
+		input := make([]byte, tv.inputLen)
+		for i := range input {
+			input[i] = byte(i % 251)
+		}
+		sum := Sum256(input)
+		if got := hex.EncodeToString(sum[:]); got != tv.hash {
+			t.Errorf("len=%d: expected %s, got %s", tv.inputLen, tv.hash, got)
+		}
+
+		// Incremental writes
+		h := New()
+		for p := input; len(p) > 0; {
+			n := 7
+			if n > len(p) {
+				n = len(p)
+			}
+			h.Write(p[:n])
+			p = p[n:]
+		}
+		if got := hex.EncodeToString(h.Sum(nil)); got != tv.hash {
+			t.Errorf("len=%d (incremental): expected %s, got %s", tv.inputLen, tv.hash, got)
+		}
+	}
+}
@@ -2,16 +2,129 @@ package hashutil // import "a4.io/blobstash/pkg/hashutil"
 
 import (
 	"fmt"
+	"hash"
+	"sync"
 
 	"golang.org/x/crypto/blake2b"
+
+	"a4.io/blobstash/pkg/hashutil/blake3"
+)
+
+// Algorithm identifies the hash function used for addressing the blobs (the value is the version byte written in the
+// meta blobs)
+type Algorithm byte
+
+const (
+	// Blake2b256 is the historical (and default) algorithm
+	Blake2b256 Algorithm = iota
+	// Blake3 is faster on modern CPUs
+	Blake3
+)
+
+// Algorithms lists the supported algorithms
+var Algorithms = []Algorithm{Blake2b256, Blake3}
+
+var (
+	mu         sync.RWMutex
+	defaultAlg = Blake2b256
 )
 
-// ComputeRaw returns the Blake2B hash hex-encoded
+// String returns the name of the algorithm (as set in the config)
+func (a Algorithm) String() string {
+	switch a {
+	case Blake2b256:
+		return "blake2b"
+	case Blake3:
+		return "blake3"
+	default:
+		return fmt.Sprintf("unknown(%d)", byte(a))
+	}
+}
+
+// Sum returns the hash of the data
+func (a Algorithm) Sum(data []byte) [32]byte {
+	switch a {
+	case Blake3:
+		return blake3.Sum256(data)
+	default:
+		return blake2b.Sum256(data)
+	}
+}
+
+// New returns a new hash.Hash computing the hash
+func (a Algorithm) New() hash.Hash {
+	switch a {
+	case Blake3:
+		return blake3.New()
+	default:
+		h, err := blake2b.New256(nil)
+		if err != nil {
+			// Only fails for invalid keys
+			panic(err)
+		}
+		return h
+	}
+}
+
+// ParseAlgorithm returns the algorithm for the given name ("blake2b" or "blake3")
+func ParseAlgorithm(name string) (Algorithm, error) {
+	for _, a := range Algorithms {
+		if a.String() == name {
+			return a, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown hash algorithm %q", name)
+}
+
+// SetDefault sets the algorithm used for the new blobs
+func SetDefault(a Algorithm) {
+	mu.Lock()
+	defer mu.Unlock()
+	defaultAlg = a
+}
+
+// Default returns the algorithm used for the new blobs
+func Default() Algorithm {
+	mu.RLock()
+	defer mu.RUnlock()
+	return defaultAlg
+}
+
+// ComputeRaw returns the hash using the default algorithm
 func ComputeRaw(data []byte) [32]byte {
-	return blake2b.Sum256(data)
+	return Default().Sum(data)
 }
 
-// Compute returns the Blake2B hash hex-encoded
+// Compute returns the hash using the default algorithm hex-encoded
 func Compute(data []byte) string {
-	return fmt.Sprintf("%x", blake2b.Sum256(data))
+	return fmt.Sprintf("%x", Default().Sum(data))
+}
+
+// New returns a new hash.Hash using the default algorithm
+func New() hash.Hash {
+	return Default().New()
+}
+
+// Identify returns the algorithm of the given hash (false if the hash doesn't match the data with any algorithm), the
+// default algorithm is tried first
+func Identify(hash string, data []byte) (Algorithm, bool) {
+	def := Default()
+	if fmt.Sprintf("%x", def.Sum(data)) == hash {
+		return def, true
+	}
+	for _, a := range Algorithms {
+		if a == def {
+			continue
+		}
+		if fmt.Sprintf("%x", a.Sum(data)) == hash {
+			return a, true
+		}
+	}
+	return 0, false
+}
+
+// Verify returns true if the hash matches the data (the blobs stored before switching the algorithm keep their hash)
+func Verify(hash string, data []byte) bool {
+	_, ok := Identify(hash, data)
+	return ok
 }
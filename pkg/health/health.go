@@ -0,0 +1,167 @@
+/*
+Package health implements the liveness (`/healthz`) and readiness (`/readyz`) endpoints.
+
+Both endpoints are unauthenticated (suitable for container orchestration probes), and only expose
+the status of each subsystem, the details (and the errors) of each check are served by the authenticated
+`/api/admin/health` endpoint.
+*/
+package health // import "a4.io/blobstash/pkg/health"
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/perms"
+)
+
+// Checker returns some details about a subsystem, or an error if the subsystem is not ready
+type Checker func() (map[string]interface{}, error)
+
+// Result holds the result of a single check
+type Result struct {
+	Status  int                    `json:"status"`
+	Error   string                 `json:"error,omitempty"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+type check struct {
+	name string
+	f    Checker
+}
+
+// Health holds the readiness checks
+type Health struct {
+	checks []*check
+	start  time.Time
+	mu     sync.Mutex
+	log    log.Logger
+}
+
+// New initializes the health checker
+func New(logger log.Logger) *Health {
+	logger.Debug("init")
+	return &Health{
+		start: time.Now(),
+		log:   logger,
+	}
+}
+
+// AddCheck registers a new readiness check
+func (h *Health) AddCheck(name string, f Checker) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checks = append(h.checks, &check{name, f})
+}
+
+// Check runs all the readiness checks
+func (h *Health) Check() (bool, map[string]*Result) {
+	h.mu.Lock()
+	checks := h.checks
+	h.mu.Unlock()
+
+	ready := true
+	out := map[string]*Result{}
+	for _, c := range checks {
+		res := &Result{Status: http.StatusOK}
+		details, err := h.runCheck(c)
+		if err != nil {
+			ready = false
+			res.Status = http.StatusServiceUnavailable
+			res.Error = err.Error()
+		}
+		res.Details = details
+		out[c.name] = res
+	}
+	return ready, out
+}
+
+func (h *Health) runCheck(c *check) (details map[string]interface{}, err error) {
+	// A failing check must not crash the probe
+	defer func() {
+		if r := recover(); r != nil {
+			h.log.Error("check panicked", "check", c.name, "err", r)
+			err = fmt.Errorf("check panicked: %v", r)
+		}
+	}()
+	return c.f()
+}
+
+func (h *Health) healthzHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET", "HEAD":
+			httputil.WriteJSON(w, map[string]interface{}{
+				"status": "ok",
+				"uptime": time.Since(h.start).String(),
+			})
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func (h *Health) readyzHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET", "HEAD":
+			ready, checks := h.Check()
+			// Only expose the status of each check, the errors may leak some internal details
+			out := map[string]*Result{}
+			for name, res := range checks {
+				out[name] = &Result{Status: res.Status}
+			}
+			writeChecks(w, r, ready, out)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func (h *Health) adminHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Admin, perms.Config),
+			perms.Resource(perms.Server, perms.Config),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+		switch r.Method {
+		case "GET", "HEAD":
+			ready, checks := h.Check()
+			writeChecks(w, r, ready, checks)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func writeChecks(w http.ResponseWriter, r *http.Request, ready bool, checks map[string]*Result) {
+	status := "ok"
+	opts := []func(http.ResponseWriter){}
+	if !ready {
+		status = "unavailable"
+		opts = append(opts, httputil.WithStatusCode(http.StatusServiceUnavailable))
+	}
+	httputil.MarshalAndWrite(r, w, map[string]interface{}{
+		"status": status,
+		"checks": checks,
+	}, opts...)
+}
+
+// Register registers the `/healthz` and `/readyz` endpoints on the root router, and the detailed
+// `/api/admin/health` endpoint
+func (h *Health) Register(root *mux.Router, basicAuth func(http.Handler) http.Handler) {
+	root.HandleFunc("/healthz", h.healthzHandler())
+	root.HandleFunc("/readyz", h.readyzHandler())
+	root.Handle("/api/admin/health", basicAuth(http.HandlerFunc(h.adminHandler())))
+}
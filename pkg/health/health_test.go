@@ -0,0 +1,72 @@
+package health
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	log "github.com/inconshreveable/log15"
+)
+
+func TestReadyz(t *testing.T) {
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	h := New(logger)
+	r := mux.NewRouter()
+	h.Register(r, func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") == "" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+
+	var fail bool
+	h.AddCheck("ok", func() (map[string]interface{}, error) { return nil, nil })
+	h.AddCheck("maybe", func() (map[string]interface{}, error) {
+		if fail {
+			return nil, errors.New("failed")
+		}
+		return nil, nil
+	})
+	h.AddCheck("secret", func() (map[string]interface{}, error) {
+		if fail {
+			return map[string]interface{}{"last_error": "dial tcp 10.0.0.1"}, errors.New("dial tcp 10.0.0.1")
+		}
+		return nil, nil
+	})
+
+	for _, tdata := range []struct {
+		path     string
+		fail     bool
+		authed   bool
+		expected int
+		leaks    bool
+	}{
+		{"/healthz", true, false, http.StatusOK, false},
+		{"/readyz", false, false, http.StatusOK, false},
+		{"/readyz", true, false, http.StatusServiceUnavailable, false},
+		{"/api/admin/health", true, false, http.StatusUnauthorized, false},
+		{"/api/admin/health", true, true, http.StatusServiceUnavailable, true},
+	} {
+		fail = tdata.fail
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", tdata.path, nil)
+		if tdata.authed {
+			req.Header.Set("Authorization", "Basic x")
+		}
+		r.ServeHTTP(w, req)
+		if w.Code != tdata.expected {
+			t.Errorf("%s (fail=%v): expected status %d, got %d", tdata.path, tdata.fail, tdata.expected, w.Code)
+		}
+		// The error details must only be exposed behind auth
+		if leaks := strings.Contains(w.Body.String(), "10.0.0.1"); leaks != tdata.leaks {
+			t.Errorf("%s (fail=%v): expected the error to be exposed=%v, got %q", tdata.path, tdata.fail, tdata.leaks, w.Body.String())
+		}
+	}
+}
@@ -96,10 +96,15 @@ func computeMac(creds *Cred, expiration, method, resource string) string {
 
 // Bewit adds the query args to the given URL, will for valid for the given TTL
 func Bewit(creds *Cred, url *url.URL, ttl time.Duration) error {
+	return BewitMethod(creds, url, ttl, method)
+}
+
+// BewitMethod is like Bewit, but the URL will only be valid for the given HTTP method (e.g. for upload links)
+func BewitMethod(creds *Cred, url *url.URL, ttl time.Duration, method string) error {
 	expiration := strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
 	resource := buildResource(url)
 
-	mac := computeMac(creds, expiration, "GET", resource)
+	mac := computeMac(creds, expiration, method, resource)
 	var bewit bytes.Buffer
 	bewit.WriteString(creds.ID)
 	bewit.WriteString(payloadSeparator)
@@ -126,6 +131,16 @@ func buildResource(url *url.URL) string {
 
 // Validate valides an HTTP requests against the given credential
 func Validate(req *http.Request, creds *Cred) error {
+	// Check the method
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return ErrInvalidMethod
+	}
+	return ValidateMethod(req, creds, method)
+}
+
+// ValidateMethod validates the request against the given credential for a bewit generated with `BewitMethod`
+// (the request method is not checked, so the form of an upload link can be served with a GET)
+func ValidateMethod(req *http.Request, creds *Cred, method string) error {
 	now := time.Now()
 
 	// Extract the bewit
@@ -146,11 +161,6 @@ func Validate(req *http.Request, creds *Cred) error {
 	q.Del("bewit")
 	req.URL.RawQuery = q.Encode()
 
-	// Check the method
-	if req.Method != "GET" && req.Method != "HEAD" {
-		return ErrInvalidMethod
-	}
-
 	// Decode the bewit
 	rawBewit, err := base64.URLEncoding.DecodeString(bewit)
 	if err != nil {
@@ -175,3 +175,18 @@ func TestBewit(t *testing.T) {
 		}
 	}
 }
+
+func TestBewitMethod(t *testing.T) {
+	creds := &Cred{ID: "id2", Key: []byte("key2")}
+	u := &url.URL{Path: resource1, RawQuery: "max_size=10"}
+	check(BewitMethod(creds, u, 1*time.Minute, "POST"))
+	u2 := *u
+
+	if err := ValidateMethod(&http.Request{URL: u, Method: "POST"}, creds, "POST"); err != nil {
+		t.Errorf("Failed to validate bewit, got: %v, expected: nil", err)
+	}
+	// A bewit signed for POST must not be valid for GET
+	if err := Validate(&http.Request{URL: &u2, Method: "GET"}, creds); err != ErrBadMac {
+		t.Errorf("Failed to validate bewit, got: %v, expected: %v", err, ErrBadMac)
+	}
+}
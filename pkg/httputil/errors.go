@@ -0,0 +1,146 @@
+package httputil // import "a4.io/blobstash/pkg/httputil"
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	log "github.com/inconshreveable/log15"
+)
+
+// Error responses
+//
+// All the API errors are returned as a JSON payload `{"code": <code>, "message": <msg>, "request_id": <id>}`, the
+// code is derived from the status code (e.g. `not_found`) unless set explicitly.
+//
+// The handlers either write the error directly (`WriteError`), or panic with it: the panics are recovered by the
+// error middleware (`RecoverHandler`) or the module isolation middleware, a `PublicErrorer` is written with its own
+// status code, and any other error as a generic 500 (the error is only logged, along with the request ID, as it may
+// leak internal details).
+
+// RequestIDHeader is the response header holding the request ID (set by the logger middleware)
+const RequestIDHeader = "Blobstash-Req-ID"
+
+// APIError is a typed API error
+type APIError struct {
+	StatusCode int
+	Code       string
+	Message    string
+
+	err error
+}
+
+// Error implements the error interface
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+// Status implements the PublicErrorer interface
+func (e *APIError) Status() int {
+	return e.StatusCode
+}
+
+// Unwrap returns the underlying error (if any)
+func (e *APIError) Unwrap() error {
+	return e.err
+}
+
+// NewError returns an API error with the given status code (the message defaults to the status text)
+func NewError(status int, msg string) *APIError {
+	if msg == "" {
+		msg = http.StatusText(status)
+	}
+	return &APIError{
+		StatusCode: status,
+		Code:       statusCode(status),
+		Message:    msg,
+	}
+}
+
+// Errorf is a shortcut for `NewError(status, fmt.Sprintf(format, args...))`
+func Errorf(status int, format string, args ...interface{}) *APIError {
+	return NewError(status, fmt.Sprintf(format, args...))
+}
+
+// Wrap returns an API error for err (its message is returned to the client)
+func Wrap(status int, err error) *APIError {
+	apiErr := NewError(status, err.Error())
+	apiErr.err = err
+	return apiErr
+}
+
+// BadRequest wraps err as a 400 error
+func BadRequest(err error) *APIError {
+	return Wrap(http.StatusBadRequest, err)
+}
+
+// statusCode returns the error code for the status (e.g. `method_not_allowed` for a 405)
+func statusCode(status int) string {
+	if status == http.StatusInternalServerError {
+		return "internal_error"
+	}
+	text := http.StatusText(status)
+	if text == "" {
+		return "error"
+	}
+	return strings.ToLower(strings.NewReplacer(" ", "_", "-", "_", "'", "").Replace(text))
+}
+
+// toAPIError converts any error into an API error (the non-API errors are generic 500s, their message is not exposed)
+func toAPIError(err error) *APIError {
+	switch e := err.(type) {
+	case *APIError:
+		return e
+	case PublicErrorer:
+		return NewError(e.Status(), e.Error())
+	default:
+		apiErr := NewError(http.StatusInternalServerError, "")
+		apiErr.err = err
+		return apiErr
+	}
+}
+
+// isPublic returns true if the error message can be returned to the client
+func isPublic(err error) bool {
+	_, ok := err.(PublicErrorer)
+	return ok
+}
+
+// WriteError writes the JSON error payload for err (the non-API errors are logged)
+func WriteError(w http.ResponseWriter, err error) {
+	if !isPublic(err) {
+		log.Error("request failed", "err", err, "req_id", w.Header().Get(RequestIDHeader))
+	}
+	writeError(w, toAPIError(err))
+}
+
+func writeError(w http.ResponseWriter, apiErr *APIError) {
+	js, merr := json.Marshal(map[string]interface{}{
+		"code":       apiErr.Code,
+		"message":    apiErr.Message,
+		"request_id": w.Header().Get(RequestIDHeader),
+	})
+	if merr != nil {
+		http.Error(w, merr.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(apiErr.StatusCode)
+	w.Write(js)
+}
+
+// WriteErrorStatus writes an error with the default message for the status code
+func WriteErrorStatus(w http.ResponseWriter, status int) {
+	WriteError(w, NewError(status, ""))
+}
+
+// WriteRecovered writes the error for a recovered panic value (a non-public error or a non-error value is written as
+// a generic 500), the panic is expected to be logged by the caller
+func WriteRecovered(w http.ResponseWriter, v interface{}) {
+	if err, ok := v.(error); ok {
+		writeError(w, toAPIError(err))
+		return
+	}
+	WriteErrorStatus(w, http.StatusInternalServerError)
+}
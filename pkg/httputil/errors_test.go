@@ -0,0 +1,80 @@
+package httputil
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func decodeError(t *testing.T, rec *httptest.ResponseRecorder) map[string]string {
+	out := map[string]string{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &out); err != nil {
+		t.Fatalf("failed to decode error payload %q: %v", rec.Body.String(), err)
+	}
+	return out
+}
+
+func TestWriteError(t *testing.T) {
+	for _, tdata := range []struct {
+		err     error
+		status  int
+		code    string
+		message string
+	}{
+		{NewError(http.StatusNotFound, ""), http.StatusNotFound, "not_found", "Not Found"},
+		{Errorf(http.StatusConflict, "key %q exists", "k"), http.StatusConflict, "conflict", `key "k" exists`},
+		{BadRequest(errors.New("bad input")), http.StatusBadRequest, "bad_request", "bad input"},
+		{NewError(http.StatusMethodNotAllowed, ""), http.StatusMethodNotAllowed, "method_not_allowed", "Method Not Allowed"},
+		{&PublicError{errors.New("boom")}, http.StatusInternalServerError, "internal_error", "boom"},
+		// The internal errors are not exposed
+		{errors.New("open /data/blobs: permission denied"), http.StatusInternalServerError, "internal_error", "Internal Server Error"},
+	} {
+		rec := httptest.NewRecorder()
+		rec.Header().Set(RequestIDHeader, "abcd")
+		WriteError(rec, tdata.err)
+		if rec.Code != tdata.status {
+			t.Errorf("%v: got status %d, expected %d", tdata.err, rec.Code, tdata.status)
+		}
+		out := decodeError(t, rec)
+		if out["code"] != tdata.code || out["message"] != tdata.message || out["request_id"] != "abcd" {
+			t.Errorf("%v: unexpected payload %+v", tdata.err, out)
+		}
+	}
+}
+
+func TestRecoverHandler(t *testing.T) {
+	h := RecoverHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := NewQuery(r.URL.Query()).GetIntDefault("limit", 10)
+		if err != nil {
+			panic(err)
+		}
+		if r.URL.Query().Get("err") != "" {
+			panic(errors.New("open /data/blobs: permission denied"))
+		}
+		panic("crash")
+	}))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/?"+url.Values{"limit": {"nope"}}.Encode(), nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("got status %d, expected 400", rec.Code)
+	}
+	if out := decodeError(t, rec); out["code"] != "bad_request" {
+		t.Errorf("unexpected payload %+v", out)
+	}
+
+	for _, p := range []string{"/", "/?err=1"} {
+		rec = httptest.NewRecorder()
+		rec.Header().Set(RequestIDHeader, "abcd")
+		h.ServeHTTP(rec, httptest.NewRequest("GET", p, nil))
+		if rec.Code != http.StatusInternalServerError {
+			t.Errorf("%s: got status %d, expected 500", p, rec.Code)
+		}
+		if out := decodeError(t, rec); out["code"] != "internal_error" || out["message"] != "Internal Server Error" || out["request_id"] != "abcd" {
+			t.Errorf("%s: unexpected payload %+v", p, out)
+		}
+	}
+}
@@ -7,13 +7,13 @@ import (
 	"net/http"
 	"net/url"
 	"reflect"
+	"runtime/debug"
 	"strconv"
 	"strings"
 
 	"github.com/golang/snappy"
+	log "github.com/inconshreveable/log15"
 	"github.com/vmihailenco/msgpack"
-
-	"a4.io/blobstash/pkg/logger"
 )
 
 const ResponseFormatHeader = "BlobStash-API-Response-Format"
@@ -36,14 +36,19 @@ func Unmarshal(req *http.Request, out interface{}) error {
 		requestFormat = f
 	}
 
+	var err error
 	switch requestFormat {
 	case jsonMimeType:
-		return json.NewDecoder(req.Body).Decode(out)
+		err = json.NewDecoder(req.Body).Decode(out)
 	case msgpackMimeType:
-		return msgpack.NewDecoder(req.Body).Decode(out)
+		err = msgpack.NewDecoder(req.Body).Decode(out)
+	default:
+		return Errorf(http.StatusUnsupportedMediaType, "Unsupported request content type: \"%s\"", requestFormat)
 	}
-
-	return fmt.Errorf("Unsupported request content type: \"%s\"", requestFormat)
+	if err != nil {
+		return BadRequest(err)
+	}
+	return nil
 }
 
 func Read(r *http.Request) ([]byte, error) {
@@ -121,13 +126,12 @@ func MarshalAndWrite(r *http.Request, w http.ResponseWriter, data interface{}, w
 		out, err = msgpack.Marshal(data)
 	default:
 		// Return a 406
-		msg := fmt.Sprintf("Requested encoding \"%s\" (via Accept) is not supported, try: application/json", responseFormat)
-		http.Error(w, msg, http.StatusNotAcceptable) // 406
+		WriteError(w, Errorf(http.StatusNotAcceptable, "Requested encoding \"%s\" (via Accept) is not supported, try: application/json", responseFormat))
 		return false
 	}
 
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		WriteError(w, err)
 		return false
 	}
 
@@ -147,18 +151,9 @@ func WriteJSON(w http.ResponseWriter, data interface{}) {
 	w.Write(js)
 }
 
-// WriteJSONError is an helper to output a {"error": <msg>} JSON payload with the given status code
+// WriteJSONError is an helper to output a JSON error payload with the given status code and message
 func WriteJSONError(w http.ResponseWriter, status int, msg string) {
-	js, err := json.Marshal(map[string]interface{}{
-		"error": msg,
-	})
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
-	w.Write(js)
+	WriteError(w, NewError(status, msg))
 }
 
 // Error is an shortcut for `WriteJSONError(w, http.StatusInternalServerError, err.Error())`
@@ -239,20 +234,14 @@ type PublicErrorer interface {
 func RecoverHandler(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
-			// FIXME(tsileo): debug config should raise exception
-			// r := recover()
-			var r interface{}
-			if r != nil {
-				logger.Log.Error("request failed", "err", r, "type", reflect.TypeOf(r))
-				switch t := r.(type) {
-				default:
-					if pe, ok := t.(PublicErrorer); ok {
-						WriteJSONError(w, pe.Status(), pe.Error())
-						return
-					}
+			if v := recover(); v != nil {
+				if v == http.ErrAbortHandler {
+					panic(v)
 				}
-				WriteJSONError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
-				return
+				log.Error("request failed", "err", v, "type", reflect.TypeOf(v), "path", r.URL.Path,
+					"req_id", w.Header().Get(RequestIDHeader), "stack", string(debug.Stack()))
+				// May fail if the response was already started
+				WriteRecovered(w, v)
 			}
 		}()
 		h.ServeHTTP(w, r)
@@ -290,7 +279,7 @@ func (q *Query) GetBoolDefault(key string, defaultval bool) (bool, error) {
 	if sv := q.values.Get(key); sv != "" {
 		val, err := strconv.ParseBool(sv)
 		if err != nil {
-			return false, fmt.Errorf("failed to parse %s as bool: %v", key, err)
+			return false, Errorf(http.StatusBadRequest, "failed to parse %s as bool: %v", key, err)
 		}
 
 		return val, nil
@@ -304,7 +293,7 @@ func (q *Query) GetInt64Default(key string, defaultval int64) (int64, error) {
 	if sv := q.values.Get(key); sv != "" {
 		val, err := strconv.ParseInt(sv, 10, 0)
 		if err != nil {
-			return 0, fmt.Errorf("failed to parse %s as int: %v", key, err)
+			return 0, Errorf(http.StatusBadRequest, "failed to parse %s as int: %v", key, err)
 		}
 
 		return val, nil
@@ -318,7 +307,7 @@ func (q *Query) GetIntDefault(key string, defaultval int) (int, error) {
 	if sv := q.values.Get(key); sv != "" {
 		val, err := strconv.Atoi(sv)
 		if err != nil {
-			return 0, fmt.Errorf("failed to parse %s as int: %v", key, err)
+			return 0, Errorf(http.StatusBadRequest, "failed to parse %s as int: %v", key, err)
 		}
 
 		return val, nil
@@ -332,7 +321,7 @@ func (q *Query) GetInt(key string, defaultval, maxval int) (int, error) {
 	if sv := q.values.Get(key); sv != "" {
 		val, err := strconv.Atoi(sv)
 		if err != nil {
-			return 0, fmt.Errorf("failed to parse %s: %v", key, err)
+			return 0, Errorf(http.StatusBadRequest, "failed to parse %s: %v", key, err)
 		}
 
 		// Check the boundaries
@@ -68,6 +68,19 @@ func (rw *crw) WriteHeader(status int) {
 	rw.statusCode = status
 }
 
+// Flush implements the `http.Flusher` interface (needed by the streaming endpoints)
+func (rw *crw) Flush() {
+	rw.writeHeaderIfNeeded()
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the underlying `http.ResponseWriter` (used by `http.ResponseController`)
+func (rw *crw) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
 func (rw *crw) ReqID() string {
 	return rw.reqID
 }
@@ -86,15 +99,24 @@ func LoggerMiddleware(logger log.Logger) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			rw := newCustomResponseWriter(w)
+			// Re-use the ID set by the client (or a reverse proxy) to correlate the logs
+			if reqID := r.Header.Get(RequestIDHeader); validReqID.MatchString(reqID) {
+				rw.reqID = reqID
+			}
+			// Set early so the error responses can reference it
+			w.Header().Set(RequestIDHeader, rw.reqID)
 
-			next.ServeHTTP(rw, r)
+			next.ServeHTTP(rw, r.WithContext(WithReqID(r.Context(), rw.reqID)))
 
 			resp_time := rw.RespTime()
 			w.Header().Set("Blobstash-Resp-Time", resp_time.String())
-			w.Header().Set("Blobstash-Req-ID", rw.reqID)
 			// Write the status code if needed
 			rw.writeHeaderIfNeeded()
-			log.Info(r.URL.String(), "method", r.Method, "status_code", rw.statusCode, "len", r.ContentLength, "proto", r.Proto,
+			logFunc := log.Info
+			if rw.statusCode >= 500 {
+				logFunc = log.Error
+			}
+			logFunc(r.URL.String(), "method", r.Method, "status_code", rw.statusCode, "len", r.ContentLength, "proto", r.Proto,
 				"resp_time", resp_time, "ip", GetIpAddress(r), "req_id", rw.reqID)
 		})
 	}
@@ -0,0 +1,48 @@
+package httputil
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	log "github.com/inconshreveable/log15"
+)
+
+func TestLoggerMiddlewareReqID(t *testing.T) {
+	var ctxReqID string
+	h := LoggerMiddleware(log.New())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctxReqID = ReqID(r)
+		panic("boom")
+	}))
+	h = RecoverHandler(h)
+
+	for _, tdata := range []struct {
+		header   string
+		expected string
+	}{
+		{"", ""},
+		{"client-id.1", "client-id.1"},
+		{"invalid id\n", ""},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		if tdata.header != "" {
+			req.Header.Set(RequestIDHeader, tdata.header)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		reqID := rec.Header().Get(RequestIDHeader)
+		if reqID == "" || (tdata.expected != "" && reqID != tdata.expected) || reqID == tdata.header && tdata.expected == "" {
+			t.Errorf("bad request ID %q for header %q", reqID, tdata.header)
+		}
+		if ctxReqID != reqID {
+			t.Errorf("context request ID %q does not match header %q", ctxReqID, reqID)
+		}
+		if rec.Code != http.StatusInternalServerError {
+			t.Errorf("got status %d, expected 500", rec.Code)
+		}
+		if out := decodeError(t, rec); out["request_id"] != reqID {
+			t.Errorf("got request_id %q in the payload, expected %q", out["request_id"], reqID)
+		}
+	}
+}
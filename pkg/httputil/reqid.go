@@ -0,0 +1,35 @@
+package httputil // import "a4.io/blobstash/pkg/httputil"
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+
+	log "github.com/inconshreveable/log15"
+)
+
+type reqIDKey struct{}
+
+// A request ID provided by the client (or a reverse proxy) is kept only if it looks sane
+var validReqID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// WithReqID returns a copy of the context holding the given request ID
+func WithReqID(ctx context.Context, reqID string) context.Context {
+	return context.WithValue(ctx, reqIDKey{}, reqID)
+}
+
+// ReqID returns the ID of the current request (set by the `LoggerMiddleware`), or an empty string
+func ReqID(r *http.Request) string {
+	if reqID, ok := r.Context().Value(reqIDKey{}).(string); ok {
+		return reqID
+	}
+	return ""
+}
+
+// Log returns a logger that will output the request ID along with every log line
+func Log(r *http.Request, logger log.Logger) log.Logger {
+	if reqID := ReqID(r); reqID != "" {
+		return logger.New("req_id", reqID)
+	}
+	return logger
+}
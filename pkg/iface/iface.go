@@ -0,0 +1,96 @@
+/*
+Package iface defines the small interfaces shared by the BlobStash HTTP clients and the server-side stores.
+
+Code that only needs to read/write blobs or key-value entries (like the filetree writer/reader) should depend on
+these interfaces, this way it can run either embedded in the server or remotely through the HTTP clients.
+*/
+package iface // import "a4.io/blobstash/pkg/iface"
+
+import (
+	"context"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+// BlobGetter is the interface that wraps the Get method for blobs
+type BlobGetter interface {
+	Get(ctx context.Context, hash string) ([]byte, error)
+}
+
+// BlobStater is the interface that wraps the Stat method for blobs
+type BlobStater interface {
+	Stat(ctx context.Context, hash string) (bool, error)
+}
+
+// BlobPutter is the interface that wraps the Put method for blobs
+type BlobPutter interface {
+	Put(ctx context.Context, hash string, data []byte) error
+}
+
+// BlobStorer groups the basic blobs methods
+type BlobStorer interface {
+	BlobGetter
+	BlobStater
+	BlobPutter
+}
+
+// KvGetter is the interface that wraps the Get method for key-value entries
+type KvGetter interface {
+	Get(ctx context.Context, key string, version int64) (*vkv.KeyValue, error)
+}
+
+// KvPutter is the interface that wraps the Put method for key-value entries
+type KvPutter interface {
+	Put(ctx context.Context, key, ref string, data []byte, version int64) (*vkv.KeyValue, error)
+}
+
+// KvStorer groups the basic key-value methods
+type KvStorer interface {
+	KvGetter
+	KvPutter
+}
+
+// ServerBlobStore is the interface implemented by the server-side blob stores (`stash/store.BlobStore`)
+type ServerBlobStore interface {
+	BlobGetter
+	BlobStater
+	Put(ctx context.Context, blob *blob.Blob) (bool, error)
+}
+
+// NewBlobStorer returns a `BlobStorer` backed by a server-side blob store, bound to the given context.
+//
+// The context passed to each call is used, the bound context (that carries the namespace/stash name) is only used
+// for callers still passing `context.TODO()` (like the filetree writer).
+func NewBlobStorer(ctx context.Context, bs ServerBlobStore) BlobStorer {
+	return &serverBlobStorer{bs, ctx}
+}
+
+type serverBlobStorer struct {
+	bs  ServerBlobStore
+	ctx context.Context
+}
+
+// context returns the context to use for the call
+func (s *serverBlobStorer) context(ctx context.Context) context.Context {
+	if ctx == nil || ctx == context.TODO() {
+		return s.ctx
+	}
+	return ctx
+}
+
+// Get implements the `BlobGetter` interface
+func (s *serverBlobStorer) Get(ctx context.Context, hash string) ([]byte, error) {
+	return s.bs.Get(s.context(ctx), hash)
+}
+
+// Stat implements the `BlobStater` interface
+func (s *serverBlobStorer) Stat(ctx context.Context, hash string) (bool, error) {
+	return s.bs.Stat(s.context(ctx), hash)
+}
+
+// Put implements the `BlobPutter` interface
+func (s *serverBlobStorer) Put(ctx context.Context, hash string, data []byte) error {
+	_, err := s.bs.Put(s.context(ctx), &blob.Blob{Hash: hash, Data: data})
+	return err
+}
@@ -0,0 +1,261 @@
+/*
+Package isolation implements the per-module panic isolation.
+
+The handlers (and background tasks) of each module are wrapped with a recovery, a panic only fails the current
+request (with a 500). Repeated crashes (any panic except the API errors, like the `panic(httputil.NewError(...))`
+used by the handlers as a shortcut for a 4xx) trip the module circuit breaker: its routes are disabled (503) for a cooldown period while the other
+modules keep serving, the panic details are only exposed to the admins (`/api/admin/modules`).
+*/
+package isolation // import "a4.io/blobstash/pkg/isolation"
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/perms"
+)
+
+// Circuit breaker settings
+var (
+	// Number of crashes (within `Window`) tripping the breaker
+	Threshold = 5
+	Window    = 1 * time.Minute
+
+	// Duration the module stays disabled
+	Cooldown = 5 * time.Minute
+)
+
+// Status holds the diagnostics of a module
+type Status struct {
+	Name        string `json:"name"`
+	Disabled    bool   `json:"disabled"`
+	DisabledAt  int64  `json:"disabled_at,omitempty"`
+	Until       int64  `json:"disabled_until,omitempty"`
+	Panics      int    `json:"panics_count"`
+	Crashes     int    `json:"crashes_count"`
+	LastPanic   string `json:"last_panic,omitempty"`
+	LastStack   string `json:"last_stack,omitempty"`
+	LastPanicAt int64  `json:"last_panic_at,omitempty"`
+}
+
+// Module tracks the panics of a single module
+type Module struct {
+	name string
+
+	crashes    []time.Time
+	disabledAt time.Time
+	status     *Status
+	mu         sync.Mutex
+
+	log log.Logger
+}
+
+// isCrash returns true if the panic is an actual crash (and not an API error raised with `panic(err)`)
+func isCrash(v interface{}) bool {
+	_, isAPIErr := v.(httputil.PublicErrorer)
+	return !isAPIErr
+}
+
+// Record records a recovered panic, and trips the breaker if needed (ctx is appended to the log line)
+func (m *Module) Record(v interface{}, stack []byte, ctx ...interface{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	m.status.Panics++
+	m.status.LastPanic = fmt.Sprintf("%v", v)
+	m.status.LastStack = string(stack)
+	m.status.LastPanicAt = now.Unix()
+	m.log.Error("panic recovered", append([]interface{}{"err", v, "stack", string(stack)}, ctx...)...)
+	if !isCrash(v) {
+		return
+	}
+	m.status.Crashes++
+
+	// Only keep the crashes within the window
+	crashes := []time.Time{}
+	for _, t := range m.crashes {
+		if now.Sub(t) < Window {
+			crashes = append(crashes, t)
+		}
+	}
+	m.crashes = append(crashes, now)
+	if len(m.crashes) >= Threshold && m.disabledAt.IsZero() {
+		m.log.Error("too many crashes, disabling the module", "crashes", len(m.crashes), "cooldown", Cooldown)
+		m.disabledAt = now
+		m.crashes = nil
+	}
+}
+
+// Disabled returns true if the breaker is tripped (it's reset automatically after the cooldown)
+func (m *Module) Disabled() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.disabledAt.IsZero() {
+		return false
+	}
+	if time.Since(m.disabledAt) >= Cooldown {
+		m.log.Info("cooldown done, re-enabling the module")
+		m.disabledAt = time.Time{}
+		return false
+	}
+	return true
+}
+
+// Reset re-enables the module
+func (m *Module) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.disabledAt = time.Time{}
+	m.crashes = nil
+}
+
+// Status returns the module diagnostics
+func (m *Module) Status() *Status {
+	disabled := m.Disabled()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st := *m.status
+	st.Disabled = disabled
+	if disabled {
+		st.DisabledAt = m.disabledAt.Unix()
+		st.Until = m.disabledAt.Add(Cooldown).Unix()
+	}
+	return &st
+}
+
+// Middleware recovers the panics of the module handlers, and rejects the requests with a 503 while the module is
+// disabled
+func (m *Module) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if m.Disabled() {
+			st := m.Status()
+			js, err := json.Marshal(map[string]interface{}{
+				"code":           "module_disabled",
+				"message":        fmt.Sprintf("module %s is disabled after repeated crashes", m.name),
+				"request_id":     w.Header().Get(httputil.RequestIDHeader),
+				"module":         m.name,
+				"disabled_until": st.Until,
+			})
+			if err != nil {
+				panic(err)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Retry-After", fmt.Sprintf("%d", st.Until-time.Now().Unix()))
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write(js)
+			return
+		}
+		defer func() {
+			if v := recover(); v != nil {
+				if v == http.ErrAbortHandler {
+					panic(v)
+				}
+				m.Record(v, debug.Stack(), "req_id", httputil.ReqID(r), "path", r.URL.Path)
+				// May fail if the response was already started
+				if isCrash(v) {
+					httputil.WriteErrorStatus(w, http.StatusInternalServerError)
+					return
+				}
+				httputil.WriteRecovered(w, v)
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Isolation holds the modules
+type Isolation struct {
+	modules map[string]*Module
+	mu      sync.Mutex
+	log     log.Logger
+}
+
+// New initializes the modules registry
+func New(logger log.Logger) *Isolation {
+	logger.Debug("init")
+	return &Isolation{
+		modules: map[string]*Module{},
+		log:     logger,
+	}
+}
+
+// Module returns the given module (it's created if needed)
+func (i *Isolation) Module(name string) *Module {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if m, ok := i.modules[name]; ok {
+		return m
+	}
+	m := &Module{
+		name:   name,
+		status: &Status{Name: name},
+		log:    i.log.New("module", name),
+	}
+	i.modules[name] = m
+	return m
+}
+
+// RecordTask records the panic of a background task, tasks are named "<module>-<task>"
+func (i *Isolation) RecordTask(task string, v interface{}, stack []byte) {
+	i.Module(strings.SplitN(task, "-", 2)[0]).Record(v, stack)
+}
+
+// Statuses returns the diagnostics for all the modules
+func (i *Isolation) Statuses() []*Status {
+	i.mu.Lock()
+	modules := []*Module{}
+	for _, m := range i.modules {
+		modules = append(modules, m)
+	}
+	i.mu.Unlock()
+	out := []*Status{}
+	for _, m := range modules {
+		out = append(out, m.Status())
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// Handler returns the handler for the `/api/admin/modules` endpoint (POST `?reset=<module>` re-enables a module)
+func (i *Isolation) Handler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Admin, perms.Config),
+			perms.Resource(perms.Server, perms.Config),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+		switch r.Method {
+		case "GET", "HEAD":
+			httputil.MarshalAndWrite(r, w, map[string]interface{}{
+				"data": i.Statuses(),
+			})
+		case "POST":
+			name := r.URL.Query().Get("reset")
+			i.mu.Lock()
+			m, ok := i.modules[name]
+			i.mu.Unlock()
+			if !ok {
+				httputil.WriteJSONError(w, http.StatusNotFound, fmt.Sprintf("unknown module %q", name))
+				return
+			}
+			m.Reset()
+			httputil.MarshalAndWrite(r, w, m.Status())
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package isolation
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/httputil"
+)
+
+func TestMiddleware(t *testing.T) {
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	iso := New(logger)
+	docstore := iso.Module("docstore")
+	h := docstore.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/apierror":
+			panic(httputil.NewError(http.StatusBadRequest, "bad request"))
+		case "/error":
+			panic(errors.New("failed"))
+		case "/crash":
+			var m map[string]string
+			m["crash"] = "boom"
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	do := func(path string) int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Code
+	}
+
+	// API errors raised with `panic(err)` never disable the module
+	for i := 0; i < Threshold+1; i++ {
+		if code := do("/apierror"); code != http.StatusBadRequest {
+			t.Errorf("expected a 400, got %d", code)
+		}
+	}
+	if code := do("/"); code != http.StatusOK {
+		t.Errorf("expected a 200, got %d", code)
+	}
+
+	for i := 0; i < Threshold; i++ {
+		if code := do("/crash"); code != http.StatusInternalServerError {
+			t.Errorf("expected a 500, got %d", code)
+		}
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected a 503, got %d", w.Code)
+	}
+	// The panic details are only exposed to the admins
+	if body := w.Body.String(); strings.Contains(body, "nil map") || strings.Contains(body, "last_panic") {
+		t.Errorf("the panic details should not be exposed: %s", body)
+	}
+	if st := docstore.Status(); !strings.Contains(st.LastPanic, "nil map") {
+		t.Errorf("unexpected last panic %q", st.LastPanic)
+	}
+	if st := iso.Module("blobstore").Status(); st.Disabled {
+		t.Errorf("other modules should not be disabled")
+	}
+
+	docstore.Reset()
+	if code := do("/"); code != http.StatusOK {
+		t.Errorf("expected a 200 after reset, got %d", code)
+	}
+
+	// Panicking with a plain error is a crash too
+	for i := 0; i < Threshold; i++ {
+		if code := do("/error"); code != http.StatusInternalServerError {
+			t.Errorf("expected a 500, got %d", code)
+		}
+	}
+	if code := do("/"); code != http.StatusServiceUnavailable {
+		t.Errorf("expected a 503, got %d", code)
+	}
+	if st := docstore.Status(); st.LastPanic != "failed" {
+		t.Errorf("unexpected last panic %q", st.LastPanic)
+	}
+}
@@ -1,29 +1,47 @@
 package api // import "a4.io/blobstash/pkg/kvstore/api"
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
 	"net/url"
+	"time"
 
 	"github.com/gorilla/mux"
 
 	"a4.io/blobstash/pkg/auth"
 	"a4.io/blobstash/pkg/ctxutil"
 	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/kvstore"
 	"a4.io/blobstash/pkg/perms"
+	"a4.io/blobstash/pkg/rangedb"
 	"a4.io/blobstash/pkg/stash/store"
+	"a4.io/blobstash/pkg/tenant"
 	"a4.io/blobstash/pkg/vkv"
+	"a4.io/blobstash/pkg/worm"
 )
 
 type keyValue struct {
-	Key     string `json:"key"`
-	Version int64  `json:"version"`
-	Hash    string `json:"hash,omitempty"`
-	Data    []byte `json:"data,omitempty"`
+	Key        string `json:"key"`
+	Version    int64  `json:"version"`
+	Hash       string `json:"hash,omitempty"`
+	Data       []byte `json:"data,omitempty"`
+	RedirectTo string `json:"redirect_to,omitempty"`
 }
 
-func toKeyValue(okv *vkv.KeyValue) *keyValue {
+// toKeyValue converts the key for the API output (the tenant prefix is removed)
+func toKeyValue(r *http.Request, okv *vkv.KeyValue) *keyValue {
+	key, _ := tenant.Strip(r, okv.Key)
+	if target := okv.RedirectTo(); target != "" {
+		target, _ = tenant.Strip(r, target)
+		return &keyValue{
+			Key:        key,
+			Version:    okv.Version,
+			RedirectTo: target,
+		}
+	}
 	return &keyValue{
-		Key:     okv.Key,
+		Key:     key,
 		Version: okv.Version,
 		Hash:    okv.HexHash(),
 		Data:    okv.Data,
@@ -31,11 +49,13 @@ func toKeyValue(okv *vkv.KeyValue) *keyValue {
 }
 
 type KvStoreAPI struct {
-	kv store.KvStore
+	kv     store.KvStore
+	expiry *rangedb.ExpirationIndex
 }
 
-func New(kv store.KvStore) *KvStoreAPI {
-	return &KvStoreAPI{kv}
+func New(kv store.KvStore, expiry *rangedb.ExpirationIndex) *KvStoreAPI {
+	expiry.Handle(kvstore.ExpiryPrefix, kvstore.ExpireFunc(kv))
+	return &KvStoreAPI{kv, expiry}
 }
 
 func (kv *KvStoreAPI) keysHandler() func(http.ResponseWriter, *http.Request) {
@@ -55,6 +75,12 @@ func (kv *KvStoreAPI) keysHandler() func(http.ResponseWriter, *http.Request) {
 			ctx := ctxutil.WithNamespace(r.Context(), r.Header.Get(ctxutil.NamespaceHeader))
 			q := httputil.NewQuery(r.URL.Query())
 			start := q.GetDefault("cursor", "")
+			end := "\xff"
+			// Only list the keys of the tenant
+			if t := tenant.FromRequest(r); t != "" {
+				start = tenant.Prefix(t) + start
+				end = tenant.Prefix(t) + end
+			}
 			limit, err := q.GetIntDefault("limit", 50)
 			if err != nil {
 				panic(err)
@@ -67,22 +93,28 @@ func (kv *KvStoreAPI) keysHandler() func(http.ResponseWriter, *http.Request) {
 			var rawKeys []*vkv.KeyValue
 			var cursor string
 			if reverse {
-				rawKeys, cursor, err = kv.kv.ReverseKeys(ctx, start, "\xff", limit)
+				rawKeys, cursor, err = kv.kv.ReverseKeys(ctx, start, end, limit)
 			} else {
-				rawKeys, cursor, err = kv.kv.Keys(ctx, start, "\xff", limit)
+				rawKeys, cursor, err = kv.kv.Keys(ctx, start, end, limit)
 			}
 			if err != nil {
 				panic(err)
 			}
+			if cursor != "" {
+				cursor, _ = tenant.Strip(r, cursor)
+			}
 
 			for _, kv := range rawKeys {
-				keys = append(keys, toKeyValue(kv))
+				if kv.Expired() {
+					continue
+				}
+				keys = append(keys, toKeyValue(r, kv))
 			}
 			httputil.MarshalAndWrite(r, w, map[string]interface{}{
 				"data": keys,
 				"pagination": map[string]interface{}{
 					"cursor":   cursor,
-					"has_more": len(keys) == limit,
+					"has_more": len(rawKeys) == limit,
 					"count":    len(keys),
 					"per_page": limit,
 				},
@@ -128,7 +160,7 @@ func (kv *KvStoreAPI) versionsHandler() func(http.ResponseWriter, *http.Request)
 				panic(err)
 			}
 			for _, v := range resp.Versions {
-				out = append(out, toKeyValue(v))
+				out = append(out, toKeyValue(r, v))
 			}
 			httputil.MarshalAndWrite(r, w, map[string]interface{}{
 				"data": out,
@@ -169,7 +201,17 @@ func (kv *KvStoreAPI) getHandler() func(http.ResponseWriter, *http.Request) {
 				panic(err)
 			}
 
-			item, err := kv.kv.Get(ctx, key, version)
+			// Follow the redirects left by renames/aliases by default (only for the latest version)
+			follow, err := q.GetBoolDefault("follow", true)
+			if err != nil {
+				panic(err)
+			}
+			var item *vkv.KeyValue
+			if follow && version <= 0 {
+				item, err = kvstore.Resolve(ctx, kv.kv, key)
+			} else {
+				item, err = kv.kv.Get(ctx, key, version)
+			}
 			if err != nil {
 				if err == vkv.ErrNotFound {
 					w.WriteHeader(http.StatusNotFound)
@@ -180,8 +222,26 @@ func (kv *KvStoreAPI) getHandler() func(http.ResponseWriter, *http.Request) {
 				}
 				panic(err)
 			}
+			// Expired keys are only visible in the versions
+			if item.Expired() && version <= 0 {
+				w.WriteHeader(http.StatusNotFound)
+				if r.Method == "GET" {
+					w.Write([]byte(http.StatusText(http.StatusNotFound)))
+				}
+				return
+			}
+			// The redirect target must be readable too
+			if item.Key != key && !auth.Can(
+				w,
+				r,
+				perms.Action(perms.Read, perms.KVEntry),
+				perms.ResourceWithID(perms.KvStore, perms.KVEntry, item.Key),
+			) {
+				auth.Forbidden(w)
+				return
+			}
 			if r.Method == "GET" {
-				httputil.MarshalAndWrite(r, w, toKeyValue(item))
+				httputil.MarshalAndWrite(r, w, toKeyValue(r, item))
 			}
 			w.WriteHeader(http.StatusOK)
 			return
@@ -213,12 +273,25 @@ func (kv *KvStoreAPI) getHandler() func(http.ResponseWriter, *http.Request) {
 				httputil.Error(w, err)
 				return
 			}
+			// Optional TTL (in seconds), a new version without TTL cancels the previous one
+			ttl, err := q.GetIntDefault("ttl", 0)
+			if err != nil {
+				httputil.Error(w, err)
+				return
+			}
 			res, err := kv.kv.Put(ctx, key, ref, []byte(data), version)
 			if err != nil {
+				if errors.Is(err, worm.ErrProtected) {
+					httputil.WriteError(w, err)
+					return
+				}
 				httputil.Error(w, err)
 				return
 			}
-			httputil.MarshalAndWrite(r, w, toKeyValue(res))
+			if err := kvstore.SetTTL(ctx, kv.expiry, key, time.Duration(ttl)*time.Second); err != nil {
+				panic(err)
+			}
+			httputil.MarshalAndWrite(r, w, toKeyValue(r, res))
 			// TODO(tsileo): switch to StatusCreated
 		default:
 			w.WriteHeader(http.StatusMethodNotAllowed)
@@ -226,8 +299,61 @@ func (kv *KvStoreAPI) getHandler() func(http.ResponseWriter, *http.Request) {
 	}
 }
 
+func (kv *KvStoreAPI) renameHandler(alias bool) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := mux.Vars(r)["key"]
+		switch r.Method {
+		case "POST":
+			to := r.URL.Query().Get("to")
+			if to == "" {
+				httputil.WriteJSONError(w, http.StatusBadRequest, "missing to")
+				return
+			}
+			// Renaming requires the write permission on both keys
+			for _, k := range []string{key, to} {
+				if !auth.Can(
+					w,
+					r,
+					perms.Action(perms.Write, perms.KVEntry),
+					perms.ResourceWithID(perms.KvStore, perms.KVEntry, k),
+				) {
+					auth.Forbidden(w)
+					return
+				}
+			}
+
+			ctx := ctxutil.WithNamespace(r.Context(), r.Header.Get(ctxutil.NamespaceHeader))
+
+			var res *vkv.KeyValue
+			var err error
+			if alias {
+				// Create the `to` key as an alias of `key`
+				res, err = kvstore.Alias(ctx, kv.kv, to, key)
+			} else {
+				res, err = kvstore.Rename(ctx, kv.kv, key, to)
+			}
+			switch err {
+			case nil:
+			case vkv.ErrNotFound:
+				w.WriteHeader(http.StatusNotFound)
+				return
+			case kvstore.ErrKeyExists:
+				httputil.WriteJSONError(w, http.StatusConflict, fmt.Sprintf("key %q already exists", to))
+				return
+			default:
+				panic(err)
+			}
+			httputil.MarshalAndWrite(r, w, toKeyValue(r, res), httputil.WithStatusCode(http.StatusCreated))
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
 func (kv *KvStoreAPI) Register(r *mux.Router, basicAuth func(http.Handler) http.Handler) {
 	r.Handle("/keys", basicAuth(http.HandlerFunc(kv.keysHandler())))
 	r.Handle("/key/{key}", basicAuth(http.HandlerFunc(kv.getHandler())))
 	r.Handle("/key/{key}/_versions", basicAuth(http.HandlerFunc(kv.versionsHandler())))
+	r.Handle("/key/{key}/_rename", basicAuth(http.HandlerFunc(kv.renameHandler(false))))
+	r.Handle("/key/{key}/_alias", basicAuth(http.HandlerFunc(kv.renameHandler(true))))
 }
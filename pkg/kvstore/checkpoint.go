@@ -0,0 +1,146 @@
+package kvstore // import "a4.io/blobstash/pkg/kvstore"
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"a4.io/blobstash/pkg/vkv"
+)
+
+// Meta checkpoints
+//
+// Every kv write creates a tiny meta blob (the serialized version, needed to rebuild the index from the blobs), on busy
+// instances they dominate the blob count. When the checkpoints are enabled (`kv_checkpoint_interval` in the config),
+// the writes only mark the version as pending, and the pending versions are periodically rolled up in consolidated
+// meta blobs (the meta blob reference of each version then points to its checkpoint). The pending versions are also
+// checkpointed on startup and when closing the kvstore.
+//
+// The meta blobs applied from elsewhere (e.g. merged from a namespace, or replicated) are referenced as is.
+
+const (
+	// Max number of versions in a checkpoint blob
+	maxCheckpointVersions = 1000
+	// Max (approximate) size of a checkpoint blob
+	maxCheckpointSize = 4 << 20
+)
+
+// EnableCheckpoints rolls up the meta blobs of the writes in checkpoints created at the given interval
+func (kv *KvStore) EnableCheckpoints(interval time.Duration) {
+	kv.checkpoints = true
+	kv.cpStop = make(chan struct{})
+	kv.cpDone = make(chan struct{})
+	go func() {
+		defer close(kv.cpDone)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				if _, err := kv.Checkpoint(context.Background()); err != nil {
+					kv.log.Error("failed to checkpoint the meta blobs", "err", err)
+				}
+			case <-kv.cpStop:
+				return
+			}
+		}
+	}()
+}
+
+// stopCheckpoints stops the checkpoint loop and checkpoints the remaining pending versions
+func (kv *KvStore) stopCheckpoints() error {
+	if !kv.checkpoints {
+		return nil
+	}
+	close(kv.cpStop)
+	<-kv.cpDone
+	kv.checkpoints = false
+	if _, err := kv.Checkpoint(context.Background()); err != nil {
+		return fmt.Errorf("failed to checkpoint the meta blobs: %w", err)
+	}
+	return nil
+}
+
+// Checkpoint rolls up the pending versions in checkpoint blobs, and returns the number of checkpointed versions
+func (kv *KvStore) Checkpoint(ctx context.Context) (int, error) {
+	kv.cpMu.Lock()
+	defer kv.cpMu.Unlock()
+
+	var total, blobs int
+	for {
+		pending, err := kv.vkv.PendingMeta(maxCheckpointVersions)
+		if err != nil {
+			return total, err
+		}
+		if len(pending) == 0 {
+			break
+		}
+
+		var size int
+		cp := &vkv.Checkpoint{}
+		for _, v := range pending {
+			vsize := len(v.Key) + len(v.Hash) + len(v.Data)
+			if len(cp.KeyValues) > 0 && size+vsize > maxCheckpointSize {
+				break
+			}
+			size += vsize
+			cp.KeyValues = append(cp.KeyValues, v)
+		}
+
+		metaBlob, err := kv.meta.Build(cp)
+		if err != nil {
+			return total, err
+		}
+
+		// Point the versions to the checkpoint
+		for _, v := range cp.KeyValues {
+			if err := kv.vkv.SetMetaBlob(v.Key, v.Version, metaBlob.Hash); err != nil {
+				return total, err
+			}
+		}
+		if _, err := kv.blobStore.Put(ctx, metaBlob); err != nil {
+			return total, err
+		}
+		for _, v := range cp.KeyValues {
+			if err := kv.vkv.RemovePendingMeta(v.Key, v.Version); err != nil {
+				return total, err
+			}
+		}
+		total += len(cp.KeyValues)
+		blobs++
+	}
+
+	if total > 0 {
+		kv.log.Info("meta blobs checkpointed", "versions", total, "blobs", blobs)
+	}
+	return total, nil
+}
+
+// applyKv stores the version and references the meta blob it comes from
+func (kv *KvStore) applyKv(rkv *vkv.KeyValue, hash string) error {
+	if err := kv.vkv.Put(rkv); err != nil {
+		return err
+	}
+	return kv.vkv.SetMetaBlob(rkv.Key, rkv.Version, hash)
+}
+
+func (kv *KvStore) applyCheckpointFunc(hash string, data []byte) error {
+	cp, err := vkv.UnserializeCheckpoint(data)
+	if err != nil {
+		return fmt.Errorf("failed to unserialize checkpoint: %v", err)
+	}
+	for _, rkv := range cp.KeyValues {
+		metaBlobHash, err := kv.vkv.GetMetaBlob(rkv.Key, rkv.Version)
+		if err != nil {
+			return err
+		}
+		if metaBlobHash != "" {
+			continue
+		}
+		if err := kv.applyKv(rkv, hash); err != nil {
+			return fmt.Errorf("failed to put: %v", err)
+		}
+	}
+	kv.log.Debug("Applied checkpoint", "hash", hash, "versions", len(cp.KeyValues))
+	return nil
+}
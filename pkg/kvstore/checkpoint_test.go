@@ -0,0 +1,83 @@
+package kvstore
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/blobstore"
+	"a4.io/blobstash/pkg/hub"
+	"a4.io/blobstash/pkg/meta"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+func TestCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstash-kvstore")
+	check(err)
+	defer os.RemoveAll(dir)
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	chub := hub.New(logger, true)
+	metaHandler, err := meta.New(logger, chub)
+	check(err)
+	bs, err := blobstore.New(logger, true, dir, nil, chub)
+	check(err)
+	defer bs.Close()
+	kvs, err := New(logger, dir, bs, metaHandler)
+	check(err)
+	defer kvs.Close()
+	kvs.EnableCheckpoints(time.Hour)
+
+	ctx := context.Background()
+	for i, v := range []string{"a", "b", "c"} {
+		_, err := kvs.Put(ctx, "k", "", []byte(v), int64(i+1))
+		check(err)
+		h, err := kvs.GetMetaBlob(ctx, "k", int64(i+1))
+		check(err)
+		if h != "" {
+			t.Errorf("expected no meta blob before the checkpoint, got %s", h)
+		}
+	}
+
+	n, err := kvs.Checkpoint(ctx)
+	check(err)
+	if n != 3 {
+		t.Errorf("expected 3 checkpointed versions, got %d", n)
+	}
+	cpHash, err := kvs.GetMetaBlob(ctx, "k", 1)
+	check(err)
+	for v := int64(2); v <= 3; v++ {
+		h, err := kvs.GetMetaBlob(ctx, "k", v)
+		check(err)
+		if h != cpHash {
+			t.Errorf("expected version %d to point to the checkpoint %s, got %s", v, cpHash, h)
+		}
+	}
+	if n, err := kvs.Checkpoint(ctx); err != nil || n != 0 {
+		t.Errorf("expected no pending versions, got %d (%v)", n, err)
+	}
+
+	// The checkpoint can rebuild another kvstore
+	data, err := bs.Get(ctx, cpHash)
+	check(err)
+	metaType, metaData, ok := meta.IsMetaBlob(data)
+	if !ok || metaType != vkv.CheckpointType {
+		t.Fatalf("expected a checkpoint meta blob, got %q", metaType)
+	}
+	dir2 := filepath.Join(dir, "rebuild")
+	check(os.MkdirAll(dir2, 0700))
+	kvs2, err := New(logger, dir2, bs, metaHandler)
+	check(err)
+	defer kvs2.Close()
+	check(kvs2.applyCheckpointFunc(cpHash, metaData))
+	versions, _, err := kvs2.Versions(ctx, "k", "0", -1)
+	check(err)
+	if len(versions.Versions) != 3 || string(versions.Versions[0].Data) != "c" {
+		t.Errorf("failed to apply the checkpoint, got %+v", versions)
+	}
+}
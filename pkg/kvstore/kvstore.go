@@ -7,12 +7,14 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
-	"time"
+	"sync"
 
 	log "github.com/inconshreveable/log15"
 
+	"a4.io/blobstash/pkg/clock"
 	"a4.io/blobstash/pkg/meta"
 	"a4.io/blobstash/pkg/stash/store"
+	"a4.io/blobstash/pkg/trace"
 	"a4.io/blobstash/pkg/vkv"
 )
 
@@ -28,6 +30,12 @@ type KvStore struct {
 	log       log.Logger
 
 	vkv *vkv.DB
+
+	// Meta checkpoints (see checkpoint.go)
+	checkpoints bool
+	cpMu        sync.Mutex
+	cpStop      chan struct{}
+	cpDone      chan struct{}
 }
 
 func New(logger log.Logger, dir string, blobStore store.BlobStore, metaHandler *meta.Meta) (*KvStore, error) {
@@ -43,6 +51,12 @@ func New(logger log.Logger, dir string, blobStore store.BlobStore, metaHandler *
 		vkv:       kv,
 	}
 	metaHandler.RegisterApplyFunc(KvType, kvStore.applyMetaFunc)
+	metaHandler.RegisterApplyFunc(vkv.CheckpointType, kvStore.applyCheckpointFunc)
+	// Catch up with the versions left pending (after a crash, or if the checkpoints were disabled since)
+	if _, err := kvStore.Checkpoint(context.Background()); err != nil {
+		kv.Close()
+		return nil, fmt.Errorf("failed to checkpoint the meta blobs: %w", err)
+	}
 	return kvStore, nil
 }
 
@@ -50,6 +64,57 @@ func (kv *KvStore) GetMetaBlob(ctx context.Context, key string, version int64) (
 	return kv.vkv.GetMetaBlob(key, version)
 }
 
+// RehashMeta re-creates the meta blobs matching the filter (e.g. the ones hashed with a previous algorithm), and returns
+// the number of rewritten versions (the pending versions are skipped, their meta blob doesn't exist yet)
+func (kv *KvStore) RehashMeta(ctx context.Context, rehash func(hash string) (bool, error)) (int, error) {
+	var rewritten int
+	start := ""
+	for {
+		keys, cursor, err := kv.vkv.Keys(start, "\xff", 100)
+		if err != nil {
+			return rewritten, err
+		}
+		for _, k := range keys {
+			versions, _, err := kv.vkv.Versions(k.Key, 0, 0, 0)
+			if err != nil {
+				return rewritten, err
+			}
+			for _, v := range versions.Versions {
+				h, err := kv.vkv.GetMetaBlob(v.Key, v.Version)
+				if err != nil {
+					return rewritten, err
+				}
+				if h == "" {
+					continue
+				}
+				ok, err := rehash(h)
+				if err != nil {
+					return rewritten, err
+				}
+				if !ok {
+					continue
+				}
+				metaBlob, err := kv.meta.Build(v)
+				if err != nil {
+					return rewritten, err
+				}
+				if err := kv.vkv.SetMetaBlob(v.Key, v.Version, metaBlob.Hash); err != nil {
+					return rewritten, err
+				}
+				if _, err := kv.blobStore.Put(ctx, metaBlob); err != nil {
+					return rewritten, err
+				}
+				rewritten++
+			}
+		}
+		if len(keys) < 100 {
+			break
+		}
+		start = cursor
+	}
+	return rewritten, nil
+}
+
 func (kv *KvStore) applyMetaFunc(hash string, data []byte) error {
 	kv.log.Debug("Apply meta init", "hash", hash)
 	// applied, err := kv.vkv.MetaBlobApplied(hash)
@@ -71,8 +136,15 @@ func (kv *KvStore) applyMetaFunc(hash string, data []byte) error {
 		return nil
 	}
 
-	if _, err := kv.Put(context.Background(), rkv.Key, rkv.HexHash(), rkv.Data, rkv.Version); err != nil {
-		return fmt.Errorf("failed to put: %v", err)
+	if kv.checkpoints {
+		// Keep a reference to the applied meta blob instead of waiting for the next checkpoint
+		if err := kv.applyKv(rkv, hash); err != nil {
+			return fmt.Errorf("failed to put: %v", err)
+		}
+	} else {
+		if _, err := kv.Put(context.Background(), rkv.Key, rkv.HexHash(), rkv.Data, rkv.Version); err != nil {
+			return fmt.Errorf("failed to put: %v", err)
+		}
 	}
 	kv.log.Debug("Applied meta", "kv", rkv)
 	// }
@@ -80,12 +152,19 @@ func (kv *KvStore) applyMetaFunc(hash string, data []byte) error {
 }
 
 func (kv *KvStore) Close() error {
+	if err := kv.stopCheckpoints(); err != nil {
+		return err
+	}
 	return kv.vkv.Close()
 }
 
 func (kv *KvStore) Get(ctx context.Context, key string, version int64) (*vkv.KeyValue, error) {
 	kv.log.Info("OP Get", "key", key, "version", version)
-	return kv.vkv.Get(key, version)
+	_, span := trace.Start(ctx, "kvstore.Get", "key", key, "version", version)
+	defer span.Finish()
+	res, err := kv.vkv.Get(key, version)
+	span.SetError(err)
+	return res, err
 }
 
 func (kv *KvStore) Keys(ctx context.Context, start, end string, limit int) ([]*vkv.KeyValue, string, error) {
@@ -100,7 +179,7 @@ func (kv *KvStore) Versions(ctx context.Context, key, start string, limit int) (
 	var istart int64
 	var err error
 	if start == "0" {
-		istart = time.Now().UTC().UnixNano()
+		istart = clock.Now().UTC().UnixNano()
 	} else {
 		istart, err = strconv.ParseInt(start, 10, 0)
 		if err != nil {
@@ -119,7 +198,12 @@ func (kv *KvStore) ReverseKeys(ctx context.Context, start, end string, limit int
 	return kv.vkv.ReverseKeys(start, end, limit)
 }
 
-func (kv *KvStore) Put(ctx context.Context, key, ref string, data []byte, version int64) (*vkv.KeyValue, error) {
+func (kv *KvStore) Put(ctx context.Context, key, ref string, data []byte, version int64) (_ *vkv.KeyValue, err error) {
+	ctx, span := trace.Start(ctx, "kvstore.Put", "key", key, "ref", ref, "len", len(data))
+	defer func() {
+		span.SetError(err)
+		span.Finish()
+	}()
 	if strings.Contains(key, "/") {
 		return nil, ErrInvalidKey
 	}
@@ -137,6 +221,14 @@ func (kv *KvStore) Put(ctx context.Context, key, ref string, data []byte, versio
 		return nil, err
 	}
 
+	if kv.checkpoints {
+		// The meta blob will be part of the next checkpoint
+		if err := kv.vkv.AddPendingMeta(key, res.Version); err != nil {
+			return nil, err
+		}
+		return res, nil
+	}
+
 	metaBlob, err := kv.meta.Build(res)
 	if err != nil {
 		return nil, err
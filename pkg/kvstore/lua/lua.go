@@ -3,6 +3,7 @@ package lua // import "a4.io/blobstash/pkg/kvstore/lua"
 import (
 	"context"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/yuin/gopher-lua"
@@ -25,6 +26,10 @@ func setupKvStore(L *lua.LState, kvs store.KvStore, ctx context.Context) func(*l
 	return func(L *lua.LState) int {
 		// register functions to the table
 		mod := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+			"iter": func(L *lua.LState) int {
+				L.Push(L.NewFunction(newIter(ctx, kvs, L.OptString(1, ""), L.OptString(2, ""), L.OptString(3, ""), L.OptInt(4, 0), L.OptBool(5, false))))
+				return 1
+			},
 			"keys": func(L *lua.LState) int {
 				keys, cursor, err := kvs.Keys(context.TODO(), L.ToString(1), "\xff", 100)
 				if err != nil {
@@ -95,6 +100,81 @@ func setupKvStore(L *lua.LState, kvs store.KvStore, ctx context.Context) func(*l
 	}
 }
 
+// Number of keys fetched at once by the iterators
+const iterBatchSize = 100
+
+// newIter returns an iterator over the keys starting with `prefix`, within the [prefix+start, prefix+end] range (an
+// empty `end` means no upper bound, and a limit <= 0 means no limit):
+//
+//	for kv, cursor in kvstore.iter('posts:', '', '', 20, true) do
+//	  -- the cursor can be used as the end (reverse) or the start of the next page
+//	end
+//
+// The expired keys are skipped (like the HTTP keys endpoint).
+func newIter(ctx context.Context, kvs store.KvStore, prefix, start, end string, limit int, reverse bool) lua.LGFunction {
+	min := prefix + start
+	max := prefix + "\xff"
+	if end != "" {
+		max = prefix + end
+	}
+	var buf []*vkv.KeyValue
+	var last string
+	var done bool
+	var count int
+	return func(L *lua.LState) int {
+		if limit > 0 && count >= limit {
+			L.Push(lua.LNil)
+			return 1
+		}
+		for len(buf) == 0 {
+			if done {
+				L.Push(lua.LNil)
+				return 1
+			}
+			var keys []*vkv.KeyValue
+			var err error
+			if reverse {
+				keys, _, err = kvs.ReverseKeys(ctx, min, max, iterBatchSize)
+			} else {
+				keys, _, err = kvs.Keys(ctx, min, max, iterBatchSize)
+			}
+			if err != nil {
+				L.RaiseError("failed to iter keys: %v", err)
+				return 0
+			}
+			if len(keys) < iterBatchSize {
+				done = true
+			}
+			for _, kv := range keys {
+				// The lower bound is inclusive, skip the last key of the previous batch
+				if !kv.Expired() && kv.Key != last {
+					buf = append(buf, kv)
+				}
+			}
+			if len(keys) > 0 {
+				// Update the range for the next batch
+				last = keys[len(keys)-1].Key
+				if reverse {
+					// The range upper bound matches the keys prefixed by max, PrevKey(last) excludes last
+					max = vkv.PrevKey(last)
+				} else {
+					min = last
+				}
+			}
+		}
+		kv := buf[0]
+		buf = buf[1:]
+		count++
+		cursor := kv.Key + "\x00"
+		if reverse {
+			cursor = vkv.PrevKey(kv.Key)
+		}
+		L.Push(convertKv(L, kv))
+		L.Push(lua.LString(strings.TrimPrefix(cursor, prefix)))
+		return 2
+	}
+}
+
 func Setup(L *lua.LState, kvs store.KvStore, ctx context.Context) {
 	L.PreloadModule("kvstore", setupKvStore(L, kvs, ctx))
 }
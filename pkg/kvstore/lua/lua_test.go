@@ -0,0 +1,103 @@
+package lua
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	log "github.com/inconshreveable/log15"
+	"github.com/yuin/gopher-lua"
+
+	"a4.io/blobstash/pkg/blobstore"
+	"a4.io/blobstash/pkg/hub"
+	"a4.io/blobstash/pkg/kvstore"
+	"a4.io/blobstash/pkg/meta"
+)
+
+func check(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
+
+func TestIter(t *testing.T) {
+	dir := t.TempDir()
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	chub := hub.New(logger, true)
+	metaHandler, err := meta.New(logger, chub)
+	check(err)
+	bs, err := blobstore.New(logger, true, dir, nil, chub)
+	check(err)
+	defer bs.Close()
+	kvs, err := kvstore.New(logger, dir, bs, metaHandler)
+	check(err)
+	defer kvs.Close()
+
+	ctx := context.Background()
+	// More keys than the batch size (with keys sharing a prefix to check the batch boundaries)
+	for i := 0; i < 150; i++ {
+		_, err := kvs.Put(ctx, fmt.Sprintf("posts:%03d", i), "", []byte("x"), -1)
+		check(err)
+		_, err = kvs.Put(ctx, fmt.Sprintf("posts:%03da", i), "", []byte("x"), -1)
+		check(err)
+	}
+	_, err = kvs.Put(ctx, "other", "", []byte("x"), -1)
+	check(err)
+
+	L := lua.NewState()
+	defer L.Close()
+	Setup(L, kvs, ctx)
+
+	for _, tc := range []struct {
+		args     string
+		expected string
+	}{
+		{"'posts:'", "300 posts:000 posts:149a"},
+		{"'posts:', '', '', 0, true", "300 posts:149a posts:000"},
+		{"'posts:', '010', '011', 0, false", "4 posts:010 posts:011a"},
+		{"'posts:', '', '', 5, true", "5 posts:149a posts:147a"},
+	} {
+		if err := L.DoString(`
+local kvstore = require('kvstore')
+count = 0
+first = nil
+last = nil
+for kv, cursor in kvstore.iter(` + tc.args + `) do
+  count = count + 1
+  if first == nil then first = kv.key end
+  last = kv.key
+end
+`); err != nil {
+			t.Fatal(err)
+		}
+		out := fmt.Sprintf("%s %s %s", L.GetGlobal("count"), L.GetGlobal("first"), L.GetGlobal("last"))
+		if out != tc.expected {
+			t.Errorf("iter(%s): got %q, expected %q", tc.args, out, tc.expected)
+		}
+	}
+
+	// Paginate using the cursor
+	if err := L.DoString(`
+local kvstore = require('kvstore')
+next_start = nil
+for kv, cursor in kvstore.iter('posts:', '', '', 3) do
+  next_start = cursor
+end
+for kv, _ in kvstore.iter('posts:', next_start, '', 1) do
+  page2 = kv.key
+end
+next_end = nil
+for kv, cursor in kvstore.iter('posts:', '', '', 3, true) do
+  next_end = cursor
+end
+for kv, _ in kvstore.iter('posts:', '', next_end, 1, true) do
+  rpage2 = kv.key
+end
+`); err != nil {
+		t.Fatal(err)
+	}
+	if page2, rpage2 := L.GetGlobal("page2").String(), L.GetGlobal("rpage2").String(); page2 != "posts:001a" || rpage2 != "posts:148" {
+		t.Errorf("unexpected pages %q/%q", page2, rpage2)
+	}
+}
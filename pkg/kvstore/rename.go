@@ -0,0 +1,112 @@
+package kvstore // import "a4.io/blobstash/pkg/kvstore"
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"a4.io/blobstash/pkg/clock"
+	"a4.io/blobstash/pkg/stash/store"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+// ErrKeyExists is returned when renaming to an existing key
+var ErrKeyExists = errors.New("key already exists")
+
+// ErrTooManyRedirects is returned when a key redirect chain is too long (or loops)
+var ErrTooManyRedirects = errors.New("too many redirects")
+
+// Max number of redirects followed by `Resolve`
+var maxRedirects = 10
+
+// Renames are serialized
+var renameMu sync.Mutex
+
+// Rename moves the key (and its full history) to a new key, a redirect tombstone is left at the old key.
+//
+// The versions are copied with their original version, so the history is preserved under the new key, the old
+// key history is kept too (the tombstone is the latest version).
+func Rename(ctx context.Context, kvs store.KvStore, key, newKey string) (*vkv.KeyValue, error) {
+	renameMu.Lock()
+	defer renameMu.Unlock()
+
+	if key == newKey {
+		return nil, fmt.Errorf("cannot rename %q to itself", key)
+	}
+
+	current, err := kvs.Get(ctx, key, -1)
+	if err != nil {
+		return nil, err
+	}
+	if current.RedirectTo() != "" {
+		// Already renamed
+		return nil, vkv.ErrNotFound
+	}
+	switch _, err := kvs.Get(ctx, newKey, -1); err {
+	case nil:
+		return nil, ErrKeyExists
+	case vkv.ErrNotFound:
+	default:
+		return nil, err
+	}
+
+	versions, _, err := kvs.Versions(ctx, key, "0", -1)
+	if err != nil {
+		return nil, err
+	}
+
+	// Copy the history (oldest first), the old key stays valid until the tombstone is written
+	var res *vkv.KeyValue
+	for i := len(versions.Versions) - 1; i >= 0; i-- {
+		v := versions.Versions[i]
+		if res, err = kvs.Put(ctx, newKey, v.HexHash(), v.Data, v.Version); err != nil {
+			return nil, err
+		}
+	}
+
+	version := clock.Now().UTC().UnixNano()
+	if version <= current.Version {
+		version = current.Version + 1
+	}
+	if _, err := kvs.Put(ctx, key, "", vkv.RedirectData(newKey), version); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Resolve returns the latest version of the key, following the redirect tombstones left by `Rename`
+func Resolve(ctx context.Context, kvs store.KvStore, key string) (*vkv.KeyValue, error) {
+	for i := 0; i < maxRedirects; i++ {
+		kv, err := kvs.Get(ctx, key, -1)
+		if err != nil {
+			return nil, err
+		}
+		target := kv.RedirectTo()
+		if target == "" {
+			return kv, nil
+		}
+		key = target
+	}
+	return nil, ErrTooManyRedirects
+}
+
+// Alias creates a key redirecting to the target key (the alias can be updated, but not an existing regular key)
+func Alias(ctx context.Context, kvs store.KvStore, alias, target string) (*vkv.KeyValue, error) {
+	renameMu.Lock()
+	defer renameMu.Unlock()
+
+	if alias == target {
+		return nil, fmt.Errorf("cannot alias %q to itself", alias)
+	}
+	switch kv, err := kvs.Get(ctx, alias, -1); err {
+	case nil:
+		if kv.RedirectTo() == "" {
+			return nil, ErrKeyExists
+		}
+	case vkv.ErrNotFound:
+	default:
+		return nil, err
+	}
+	return kvs.Put(ctx, alias, "", vkv.RedirectData(target), -1)
+}
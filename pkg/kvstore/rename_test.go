@@ -0,0 +1,82 @@
+package kvstore
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/blobstore"
+	"a4.io/blobstash/pkg/hub"
+	"a4.io/blobstash/pkg/meta"
+)
+
+func check(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
+
+func TestRename(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstash-kvstore")
+	check(err)
+	defer os.RemoveAll(dir)
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	chub := hub.New(logger, true)
+	metaHandler, err := meta.New(logger, chub)
+	check(err)
+	bs, err := blobstore.New(logger, true, dir, nil, chub)
+	check(err)
+	defer bs.Close()
+	kvs, err := New(logger, dir, bs, metaHandler)
+	check(err)
+	defer kvs.Close()
+
+	ctx := context.Background()
+	for i, v := range []string{"a", "b", "c"} {
+		_, err := kvs.Put(ctx, "old", "", []byte(v), int64(i+1))
+		check(err)
+	}
+	_, err = kvs.Put(ctx, "other", "", []byte("x"), -1)
+	check(err)
+
+	if _, err := Rename(ctx, kvs, "old", "other"); err != ErrKeyExists {
+		t.Errorf("expected ErrKeyExists, got %v", err)
+	}
+	res, err := Rename(ctx, kvs, "old", "new")
+	check(err)
+	if res.Key != "new" || string(res.Data) != "c" || res.Version != 3 {
+		t.Errorf("unexpected renamed key %+v", res)
+	}
+	versions, _, err := kvs.Versions(ctx, "new", "0", -1)
+	check(err)
+	if len(versions.Versions) != 3 {
+		t.Errorf("expected 3 versions, got %d", len(versions.Versions))
+	}
+
+	old, err := kvs.Get(ctx, "old", -1)
+	check(err)
+	if old.RedirectTo() != "new" {
+		t.Errorf("expected a redirect tombstone, got %+v", old)
+	}
+	resolved, err := Resolve(ctx, kvs, "old")
+	check(err)
+	if resolved.Key != "new" || string(resolved.Data) != "c" {
+		t.Errorf("failed to resolve, got %+v", resolved)
+	}
+
+	// Aliases
+	if _, err := Alias(ctx, kvs, "other", "new"); err != ErrKeyExists {
+		t.Errorf("expected ErrKeyExists, got %v", err)
+	}
+	_, err = Alias(ctx, kvs, "latest", "new")
+	check(err)
+	resolved, err = Resolve(ctx, kvs, "latest")
+	check(err)
+	if resolved.Key != "new" {
+		t.Errorf("failed to resolve alias, got %+v", resolved)
+	}
+}
@@ -0,0 +1,62 @@
+package kvstore // import "a4.io/blobstash/pkg/kvstore"
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"a4.io/blobstash/pkg/clock"
+	"a4.io/blobstash/pkg/ctxutil"
+	"a4.io/blobstash/pkg/rangedb"
+	"a4.io/blobstash/pkg/stash/store"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+// ExpiryPrefix is the prefix of the kv keys in the expiration index
+const ExpiryPrefix = "kv:"
+
+// ExpiryKey returns the expiration index key for the given key (in the namespace set in the context)
+func ExpiryKey(ctx context.Context, key string) string {
+	ns, _ := ctxutil.Namespace(ctx)
+	return ExpiryPrefix + ns + "\x00" + key
+}
+
+// SetTTL schedules the expiration of the key, a zero TTL removes any previously set expiration
+func SetTTL(ctx context.Context, expiry *rangedb.ExpirationIndex, key string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return expiry.Remove(ExpiryKey(ctx, key))
+	}
+	return expiry.Set(ExpiryKey(ctx, key), clock.Now().Add(ttl))
+}
+
+// Expire writes an expiration tombstone as the latest version of the key (the history is kept)
+func Expire(ctx context.Context, kvs store.KvStore, key string) error {
+	current, err := kvs.Get(ctx, key, -1)
+	switch err {
+	case nil:
+		if current.Expired() {
+			return nil
+		}
+	case vkv.ErrNotFound:
+		return nil
+	default:
+		return err
+	}
+	version := clock.Now().UTC().UnixNano()
+	if version <= current.Version {
+		version = current.Version + 1
+	}
+	_, err = kvs.Put(ctx, key, "", vkv.ExpiredData(), version)
+	return err
+}
+
+// ExpireFunc returns the handler to register in the expiration index
+func ExpireFunc(kvs store.KvStore) rangedb.ExpireFunc {
+	return func(ekey string) error {
+		parts := strings.SplitN(strings.TrimPrefix(ekey, ExpiryPrefix), "\x00", 2)
+		if len(parts) != 2 {
+			return nil
+		}
+		return Expire(ctxutil.WithNamespace(context.Background(), parts[0]), kvs, parts[1])
+	}
+}
@@ -0,0 +1,129 @@
+/*
+Package lifecycle implements a context-based lifecycle manager for the background tasks.
+
+The context returned by `Context` is cancelled when the shutdown starts, background tasks are expected
+to return as soon as possible, and `Shutdown` waits for them until the grace period expires. No new task can be
+started once the shutdown has started (`Go` and `Track` return `ErrShuttingDown`).
+*/
+package lifecycle // import "a4.io/blobstash/pkg/lifecycle"
+
+import (
+	"context"
+	"errors"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+)
+
+// ErrGracePeriodExpired is returned when the background tasks did not finish during the grace period
+var ErrGracePeriodExpired = errors.New("shutdown grace period expired")
+
+// ErrShuttingDown is returned when starting a task after the shutdown has started
+var ErrShuttingDown = errors.New("shutting down")
+
+// Lifecycle manages the background tasks
+type Lifecycle struct {
+	ctx    context.Context
+	cancel func()
+
+	// The tasks are only added to the wait group while not closing (so no task is added once the shutdown is waiting)
+	mu      sync.Mutex
+	closing bool
+	wg      sync.WaitGroup
+
+	// Called when a task panics
+	onPanic func(task string, v interface{}, stack []byte)
+
+	log log.Logger
+}
+
+// New initializes a lifecycle manager
+func New(logger log.Logger) *Lifecycle {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Lifecycle{
+		ctx:    ctx,
+		cancel: cancel,
+		log:    logger,
+	}
+}
+
+// Context returns a context that will be cancelled once the shutdown starts
+func (l *Lifecycle) Context() context.Context {
+	return l.ctx
+}
+
+// Done returns a channel closed once the shutdown starts
+func (l *Lifecycle) Done() <-chan struct{} {
+	return l.ctx.Done()
+}
+
+// SetPanicHandler sets the func called when a task panics (must be called before starting the tasks)
+func (l *Lifecycle) SetPanicHandler(f func(task string, v interface{}, stack []byte)) {
+	l.onPanic = f
+}
+
+// add registers a new task, unless the shutdown has started
+func (l *Lifecycle) add() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closing {
+		return ErrShuttingDown
+	}
+	l.wg.Add(1)
+	return nil
+}
+
+// Go runs the given task in a tracked goroutine, a panicking task is stopped without crashing the process, returns
+// `ErrShuttingDown` (and the task is not started) if the shutdown has started
+func (l *Lifecycle) Go(name string, f func(ctx context.Context)) error {
+	if err := l.add(); err != nil {
+		l.log.Info("task not started", "task", name, "err", err)
+		return err
+	}
+	go func() {
+		defer l.wg.Done()
+		defer func() {
+			if v := recover(); v != nil {
+				stack := debug.Stack()
+				l.log.Error("task panicked", "task", name, "err", v)
+				if l.onPanic != nil {
+					l.onPanic(name, v, stack)
+				}
+			}
+		}()
+		f(l.ctx)
+		l.log.Debug("task done", "task", name)
+	}()
+	return nil
+}
+
+// Track must be called before starting a task that must be completed before shutting down (an in-flight
+// blob write for example), and the returned func called once it's done. Returns `ErrShuttingDown` if the shutdown
+// has started (the task must not be started).
+func (l *Lifecycle) Track() (func(), error) {
+	if err := l.add(); err != nil {
+		return nil, err
+	}
+	return l.wg.Done, nil
+}
+
+// Shutdown cancels the context and waits for the tasks to finish (up to the grace period)
+func (l *Lifecycle) Shutdown(grace time.Duration) error {
+	l.mu.Lock()
+	l.closing = true
+	l.mu.Unlock()
+	l.cancel()
+	done := make(chan struct{})
+	go func() {
+		l.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(grace):
+		return ErrGracePeriodExpired
+	}
+}
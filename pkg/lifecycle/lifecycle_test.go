@@ -0,0 +1,67 @@
+package lifecycle
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+)
+
+func TestShutdown(t *testing.T) {
+	lc := New(log.New())
+	var stopped bool
+	lc.Go("test", func(ctx context.Context) {
+		<-ctx.Done()
+		stopped = true
+	})
+	if err := lc.Shutdown(time.Second); err != nil {
+		t.Fatalf("shutdown failed: %v", err)
+	}
+	if !stopped {
+		t.Errorf("task not stopped")
+	}
+
+	// No task can be started once the shutdown has started
+	if err := lc.Go("late", func(ctx context.Context) { t.Errorf("the task should not run") }); err != ErrShuttingDown {
+		t.Errorf("expected ErrShuttingDown, got %v", err)
+	}
+	if _, err := lc.Track(); err != ErrShuttingDown {
+		t.Errorf("expected ErrShuttingDown, got %v", err)
+	}
+
+	lc = New(log.New())
+	done, err := lc.Track()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+	if err := lc.Shutdown(10 * time.Millisecond); err != ErrGracePeriodExpired {
+		t.Errorf("expected ErrGracePeriodExpired, got %v", err)
+	}
+}
+
+func TestConcurrentShutdown(t *testing.T) {
+	lc := New(log.New())
+	stop := make(chan struct{})
+	started := make(chan struct{})
+	go func() {
+		close(started)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if done, err := lc.Track(); err == nil {
+				done()
+			}
+			lc.Go("task", func(ctx context.Context) {})
+		}
+	}()
+	<-started
+	if err := lc.Shutdown(time.Second); err != nil {
+		t.Errorf("shutdown failed: %v", err)
+	}
+	close(stop)
+}
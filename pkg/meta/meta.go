@@ -9,12 +9,13 @@ import (
 	log "github.com/inconshreveable/log15"
 
 	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/hashutil"
 	"a4.io/blobstash/pkg/hub"
 )
 
 var (
 	metaBlobHeader   = "#blobstash/meta\n"
-	metaBlobVersion  = 1
+	metaBlobVersion  = 2 // v2 adds the hash algorithm byte
 	metaBlobOverhead = len(metaBlobHeader)
 )
 
@@ -68,11 +69,12 @@ func (m *Meta) RegisterApplyFunc(t string, f func(string, []byte) error) {
 // Build convert the MetaData into a blo
 func (m *Meta) Build(data MetaData) (*blob.Blob, error) {
 	var buf bytes.Buffer
-	// <meta blob header> + <meta blob version> + <type size> + <type bytes> + <data size> + <data>
+	// <meta blob header> + <meta blob version> + <hash algorithm> + <type size> + <type bytes> + <data size> + <data>
 	buf.Write([]byte(metaBlobHeader))
 	tmp := make([]byte, 4)
 	binary.BigEndian.PutUint32(tmp[:], uint32(metaBlobVersion))
 	buf.Write(tmp)
+	buf.WriteByte(byte(hashutil.Default()))
 	binary.BigEndian.PutUint32(tmp[:], uint32(len(data.Type())))
 	buf.Write(tmp)
 	buf.WriteString(data.Type())
@@ -102,8 +104,27 @@ func IsMetaBlob(blob []byte) (string, []byte, bool) { // returns (string, bool)
 		return "", nil, false
 	}
 	if bytes.Equal(blob[0:metaBlobOverhead], []byte(metaBlobHeader)) {
-		typeLen := int(binary.BigEndian.Uint32(blob[metaBlobOverhead+4 : metaBlobOverhead+8]))
-		return string(blob[metaBlobOverhead+8 : metaBlobOverhead+8+typeLen]), blob[metaBlobOverhead+12+typeLen : len(blob)], true
+		off := metaBlobOverhead + 4
+		if binary.BigEndian.Uint32(blob[metaBlobOverhead:off]) >= 2 {
+			// Skip the hash algorithm
+			off++
+		}
+		typeLen := int(binary.BigEndian.Uint32(blob[off : off+4]))
+		return string(blob[off+4 : off+4+typeLen]), blob[off+8+typeLen : len(blob)], true
 	}
 	return "", nil, false
 }
+
+// Algorithm returns the hash algorithm recorded in the meta blob (the v1 meta blobs always used BLAKE2b)
+func Algorithm(blob []byte) (hashutil.Algorithm, bool) {
+	if len(blob) < metaBlobOverhead+4 || !bytes.Equal(blob[0:metaBlobOverhead], []byte(metaBlobHeader)) {
+		return 0, false
+	}
+	if binary.BigEndian.Uint32(blob[metaBlobOverhead:metaBlobOverhead+4]) < 2 {
+		return hashutil.Blake2b256, true
+	}
+	if len(blob) < metaBlobOverhead+5 {
+		return 0, false
+	}
+	return hashutil.Algorithm(blob[metaBlobOverhead+4]), true
+}
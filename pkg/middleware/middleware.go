@@ -6,10 +6,12 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 
 	"a4.io/blobstash/pkg/auth"
 	"a4.io/blobstash/pkg/config"
 	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/tenant"
 
 	_ "github.com/carbocation/interpose/middleware"
 	"github.com/unrolled/secure"
@@ -40,16 +42,117 @@ func Secure(h http.Handler) http.Handler {
 	return secure.New(secureOptions).Handler(h)
 }
 
-func CorsMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Accept")
-		w.Header().Set("Access-Control-Allow-Methods", "POST, PATCH, GET, OPTIONS, DELETE, PUT")
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		if r.Method == "OPTIONS" {
-			return
+// allowedOrigin returns true if the origin matches one of the allowed origins ("*", an exact origin, or a
+// "scheme://*.domain" pattern for the subdomains)
+func allowedOrigin(origins []string, origin string) bool {
+	for _, o := range origins {
+		if o == "*" || strings.EqualFold(strings.TrimSuffix(o, "/"), origin) {
+			return true
 		}
-		next.ServeHTTP(w, r)
-	})
+		if i := strings.Index(o, "://*."); i != -1 {
+			scheme, domain := o[:i+3], o[i+4:]
+			if len(origin) > len(scheme)+len(domain) && strings.HasPrefix(origin, scheme) && strings.HasSuffix(origin, domain) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Cors handles the Cross-Origin Resource Sharing for the API endpoints (the preflight requests are answered
+// before the auth check, as browsers never send the credentials with them)
+func Cors(conf *config.CORS) func(http.Handler) http.Handler {
+	methods := strings.Join(conf.AllowedMethods, ", ")
+	exposed := strings.Join(conf.ExposedHeaders, ", ")
+	allowedHeaders := map[string]bool{}
+	var anyHeader bool
+	for _, h := range conf.AllowedHeaders {
+		if h == "*" {
+			anyHeader = true
+		}
+		allowedHeaders[strings.ToLower(h)] = true
+	}
+	var anyOrigin bool
+	for _, o := range conf.AllowedOrigins {
+		if o == "*" {
+			anyOrigin = true
+		}
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			if origin == "" || !strings.HasPrefix(r.URL.Path, "/api/") {
+				next.ServeHTTP(w, r)
+				return
+			}
+			preflight := r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != ""
+
+			w.Header().Add("Vary", "Origin")
+			if !allowedOrigin(conf.AllowedOrigins, origin) {
+				if preflight {
+					// No CORS headers, the browser will reject the request
+					w.WriteHeader(http.StatusNoContent)
+					return
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if anyOrigin && !conf.AllowCredentials {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			} else {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+			}
+			if conf.AllowCredentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+
+			if !preflight {
+				if exposed != "" {
+					w.Header().Set("Access-Control-Expose-Headers", exposed)
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// Preflight request
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+			reqMethod := strings.ToUpper(r.Header.Get("Access-Control-Request-Method"))
+			var methodOK bool
+			for _, m := range conf.AllowedMethods {
+				if m == reqMethod {
+					methodOK = true
+					break
+				}
+			}
+			if !methodOK {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+
+			// Check the requested headers (e.g. `Authorization` and `Content-Type` for the multipart uploads)
+			var reqHeaders []string
+			for _, h := range strings.Split(r.Header.Get("Access-Control-Request-Headers"), ",") {
+				if h = strings.TrimSpace(h); h == "" {
+					continue
+				}
+				if !anyHeader && !allowedHeaders[strings.ToLower(h)] {
+					w.WriteHeader(http.StatusNoContent)
+					return
+				}
+				reqHeaders = append(reqHeaders, h)
+			}
+
+			w.Header().Set("Access-Control-Allow-Methods", methods)
+			if len(reqHeaders) > 0 {
+				w.Header().Set("Access-Control-Allow-Headers", strings.Join(reqHeaders, ", "))
+			}
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(conf.MaxAge))
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
 }
 
 func NewBasicAuth(conf *config.Config) (func(*http.Request) bool, func(http.Handler) http.Handler) {
@@ -69,6 +172,9 @@ func NewBasicAuth(conf *config.Config) (func(*http.Request) bool, func(http.Hand
 			fmt.Printf("headers=%+v\n", r.Header)
 			if authFunc(r) {
 				apiAuthSuccess.Add(1)
+				if t := auth.Tenant(r); t != "" {
+					tenant.Enforce(r, t)
+				}
 				next.ServeHTTP(w, r)
 				return
 			}
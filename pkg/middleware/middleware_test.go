@@ -0,0 +1,77 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"a4.io/blobstash/pkg/config"
+)
+
+func TestCors(t *testing.T) {
+	conf := &config.Config{DataDir: t.TempDir(), SharingKey: "key", CORS: &config.CORS{
+		AllowedOrigins:   []string{"https://app.example.com", "https://*.a4.io"},
+		AllowCredentials: true,
+	}}
+	if err := conf.Init(); err != nil {
+		t.Fatalf("failed to init config: %v", err)
+	}
+	var called bool
+	h := Cors(conf.CORS)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+
+	for _, tdata := range []struct {
+		method, path, origin, reqMethod, reqHeaders string
+		allowOrigin, allowHeaders                   string
+		called                                      bool
+	}{
+		// Preflight for a multipart upload
+		{"OPTIONS", "/api/filetree/upload", "https://app.example.com", "POST", "authorization, content-type", "https://app.example.com", "authorization, content-type", false},
+		{"OPTIONS", "/api/blobstore/upload", "https://sub.a4.io", "POST", "Authorization", "https://sub.a4.io", "Authorization", false},
+		{"OPTIONS", "/api/blobstore/upload", "https://evil.com", "POST", "Authorization", "", "", false},
+		{"OPTIONS", "/api/blobstore/upload", "https://app.example.com", "POST", "X-Unknown", "https://app.example.com", "", false},
+		{"OPTIONS", "/api/blobstore/upload", "https://app.example.com", "TRACE", "", "https://app.example.com", "", false},
+		{"GET", "/api/kvstore/keys", "https://app.example.com", "", "", "https://app.example.com", "", true},
+		{"GET", "/api/kvstore/keys", "https://a4.io.evil.com", "", "", "", "", true},
+		{"GET", "/app/index.html", "https://app.example.com", "", "", "", "", true},
+	} {
+		called = false
+		req := httptest.NewRequest(tdata.method, tdata.path, nil)
+		req.Header.Set("Origin", tdata.origin)
+		if tdata.reqMethod != "" {
+			req.Header.Set("Access-Control-Request-Method", tdata.reqMethod)
+		}
+		if tdata.reqHeaders != "" {
+			req.Header.Set("Access-Control-Request-Headers", tdata.reqHeaders)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		if called != tdata.called {
+			t.Errorf("%s %s from %s: next called=%v, expected %v", tdata.method, tdata.path, tdata.origin, called, tdata.called)
+		}
+		if got := rec.Header().Get("Access-Control-Allow-Origin"); got != tdata.allowOrigin {
+			t.Errorf("%s %s from %s: got Allow-Origin %q, expected %q", tdata.method, tdata.path, tdata.origin, got, tdata.allowOrigin)
+		}
+		if got := rec.Header().Get("Access-Control-Allow-Headers"); got != tdata.allowHeaders {
+			t.Errorf("%s %s from %s: got Allow-Headers %q, expected %q", tdata.method, tdata.path, tdata.origin, got, tdata.allowHeaders)
+		}
+		if tdata.allowOrigin != "" && rec.Header().Get("Access-Control-Allow-Credentials") != "true" {
+			t.Errorf("%s %s from %s: missing Allow-Credentials", tdata.method, tdata.path, tdata.origin)
+		}
+	}
+}
+
+func TestCorsInvalidConfig(t *testing.T) {
+	for _, c := range []*config.CORS{
+		{AllowedOrigins: []string{"*"}, AllowCredentials: true},
+		{AllowedOrigins: []string{"app.example.com"}},
+		{AllowedOrigins: []string{"https://app.example.com/path"}},
+	} {
+		conf := &config.Config{DataDir: t.TempDir(), SharingKey: "key", CORS: c}
+		if err := conf.Init(); err == nil {
+			t.Errorf("config %+v should be invalid", c)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+/*
+Package migration implements the versioned on-disk schema of the data directory.
+
+The schema version is stored in `schema.json` (at the root of the data directory), the pending migrations are
+applied in order at startup (while holding a lock file), and each applied migration is recorded in the schema
+history along with its rollback notes.
+
+A fresh data directory is initialized at the latest version (there's nothing to migrate), and starting an older
+BlobStash on a data directory migrated by a newer release is refused.
+*/
+package migration // import "a4.io/blobstash/pkg/migration"
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+)
+
+const (
+	schemaFile = "schema.json"
+	lockFile   = "migration.lock"
+)
+
+// ErrLocked is returned when another process is already migrating the data directory
+var ErrLocked = errors.New("data directory is locked by another migration")
+
+// Migration holds a single schema upgrade
+type Migration struct {
+	Version     int
+	Name        string
+	Description string
+
+	// How to go back to the previous version (logged before the migration starts, and kept in the history)
+	Rollback string
+
+	Up func(dir string, logger log.Logger) error
+}
+
+// Applied holds a migration in the schema history
+type Applied struct {
+	Version   int    `json:"version"`
+	Name      string `json:"name"`
+	AppliedAt string `json:"applied_at"`
+	Duration  string `json:"duration"`
+	Rollback  string `json:"rollback,omitempty"`
+}
+
+// Schema holds the content of the schema file
+type Schema struct {
+	Version   int        `json:"version"`
+	UpdatedAt string     `json:"updated_at"`
+	History   []*Applied `json:"history"`
+}
+
+// Migrations, must be sorted by version (and never modified once released)
+var migrations = []*Migration{
+	{
+		Version:     1,
+		Name:        "baseline",
+		Description: "Data directories created before the schema versioning",
+		Rollback:    "Remove schema.json",
+		Up: func(_ string, _ log.Logger) error {
+			return nil
+		},
+	},
+}
+
+// Latest returns the latest schema version
+func Latest() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// Load returns the current schema of the data directory (version 0 if there's no schema file)
+func Load(dir string) (*Schema, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, schemaFile))
+	switch {
+	case os.IsNotExist(err):
+		return &Schema{History: []*Applied{}}, nil
+	case err != nil:
+		return nil, err
+	}
+	schema := &Schema{}
+	if err := json.Unmarshal(data, schema); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", schemaFile, err)
+	}
+	return schema, nil
+}
+
+func (s *Schema) save(dir string) error {
+	s.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write atomically, a crash must not leave a truncated schema file
+	tmp := filepath.Join(dir, schemaFile+".tmp")
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, schemaFile))
+}
+
+// isFresh returns true if the data directory has no data yet
+func isFresh(dir string) (bool, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return true, nil
+		}
+		return false, err
+	}
+	for _, f := range files {
+		if f.Name() != lockFile {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func lock(dir string) (func(), error) {
+	path := filepath.Join(dir, lockFile)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		if os.IsExist(err) {
+			return nil, fmt.Errorf("%w (remove %s if no other BlobStash is running)", ErrLocked, path)
+		}
+		return nil, err
+	}
+	fmt.Fprintf(f, "%d\n", os.Getpid())
+	f.Close()
+	return func() { os.Remove(path) }, nil
+}
+
+// Run applies the pending migrations
+func Run(logger log.Logger, dir string) error {
+	return run(logger, dir, migrations)
+}
+
+func run(logger log.Logger, dir string, migrations []*Migration) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	fresh, err := isFresh(dir)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := lock(dir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	schema, err := Load(dir)
+	if err != nil {
+		return err
+	}
+	latest := migrations[len(migrations)-1].Version
+
+	if fresh {
+		logger.Info("initializing the data directory schema", "version", latest)
+		schema.Version = latest
+		return schema.save(dir)
+	}
+
+	if schema.Version > latest {
+		return fmt.Errorf("data directory schema version %d is newer than the supported version %d (downgrades are not supported)", schema.Version, latest)
+	}
+	if schema.Version == latest {
+		logger.Debug("schema up to date", "version", schema.Version)
+		return nil
+	}
+
+	for _, m := range migrations {
+		if m.Version <= schema.Version {
+			continue
+		}
+		mlog := logger.New("migration", m.Name, "version", m.Version)
+		mlog.Info("applying migration", "description", m.Description, "rollback", m.Rollback)
+		start := time.Now()
+		if err := m.Up(dir, mlog); err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %v (rollback: %s)", m.Version, m.Name, err, m.Rollback)
+		}
+		schema.Version = m.Version
+		schema.History = append(schema.History, &Applied{
+			Version:   m.Version,
+			Name:      m.Name,
+			AppliedAt: time.Now().UTC().Format(time.RFC3339),
+			Duration:  time.Since(start).String(),
+			Rollback:  m.Rollback,
+		})
+		// Save after each migration, so a failure does not re-run the previous ones
+		if err := schema.save(dir); err != nil {
+			return err
+		}
+		mlog.Info("migration applied", "duration", time.Since(start))
+	}
+	return nil
+}
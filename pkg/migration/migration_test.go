@@ -0,0 +1,67 @@
+package migration
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	log "github.com/inconshreveable/log15"
+)
+
+func check(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
+
+func TestRun(t *testing.T) {
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	dir, err := ioutil.TempDir("", "blobstash_migration")
+	check(err)
+	defer os.RemoveAll(dir)
+
+	var applied []int
+	up := func(v int) func(string, log.Logger) error {
+		return func(_ string, _ log.Logger) error {
+			applied = append(applied, v)
+			return nil
+		}
+	}
+	ms := []*Migration{
+		{Version: 1, Name: "one", Up: up(1)},
+		{Version: 2, Name: "two", Up: up(2)},
+	}
+
+	// A fresh data dir starts at the latest version
+	check(run(logger, dir, ms[:1]))
+	schema, err := Load(dir)
+	check(err)
+	if schema.Version != 1 || len(applied) != 0 {
+		t.Errorf("bad schema for a fresh data dir: %+v (applied=%v)", schema, applied)
+	}
+
+	// Upgrade
+	check(ioutil.WriteFile(filepath.Join(dir, "data"), []byte("data"), 0600))
+	check(run(logger, dir, ms))
+	schema, err = Load(dir)
+	check(err)
+	if schema.Version != 2 || len(applied) != 1 || applied[0] != 2 || len(schema.History) != 1 {
+		t.Errorf("bad schema after upgrade: %+v (applied=%v)", schema, applied)
+	}
+
+	// Downgrades are refused
+	if err := run(logger, dir, ms[:1]); err == nil {
+		t.Errorf("downgrade should fail")
+	}
+
+	// Concurrent migrations are refused
+	unlock, err := lock(dir)
+	check(err)
+	if err := run(logger, dir, ms); !errors.Is(err, ErrLocked) {
+		t.Errorf("expected ErrLocked, got %v", err)
+	}
+	unlock()
+}
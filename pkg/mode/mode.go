@@ -0,0 +1,173 @@
+/*
+Package mode implements the server-wide read-only and maintenance modes.
+
+In read-only mode, all the mutating requests (and blob writes) are rejected with a 503, in maintenance mode, all
+the requests are rejected (except the admin and health endpoints), so operators can safely freeze the
+server during a compaction, a migration or a scrub.
+*/
+package mode // import "a4.io/blobstash/pkg/mode"
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/perms"
+)
+
+// Server modes
+const (
+	ReadWrite   = "read-write"
+	ReadOnly    = "read-only"
+	Maintenance = "maintenance"
+)
+
+// ErrReadOnly is returned when trying to write while the server is not in read-write mode
+var ErrReadOnly = errors.New("server is read-only")
+
+// Paths always allowed (the admin API is needed to switch back to the read-write mode)
+var exemptPrefixes = []string{"/api/admin/", "/healthz", "/readyz", "/api/ping"}
+
+var (
+	current = ReadWrite
+	since   = time.Now()
+	reason  string
+	mu      sync.RWMutex
+)
+
+// Valid returns true if the mode is valid
+func Valid(m string) bool {
+	return m == ReadWrite || m == ReadOnly || m == Maintenance
+}
+
+// Set updates the current mode
+func Set(m, why string) error {
+	if m == "" {
+		m = ReadWrite
+	}
+	if !Valid(m) {
+		return fmt.Errorf("invalid mode %q", m)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if m != current {
+		since = time.Now()
+	}
+	current = m
+	reason = why
+	return nil
+}
+
+// Get returns the current mode
+func Get() string {
+	mu.RLock()
+	defer mu.RUnlock()
+	return current
+}
+
+// CanWrite returns `ErrReadOnly` if writes are currently not allowed
+func CanWrite() error {
+	if Get() != ReadWrite {
+		return ErrReadOnly
+	}
+	return nil
+}
+
+func status() map[string]interface{} {
+	mu.RLock()
+	defer mu.RUnlock()
+	return map[string]interface{}{
+		"mode":   current,
+		"since":  since.UTC().Format(time.RFC3339),
+		"reason": reason,
+	}
+}
+
+func isMutating(r *http.Request) bool {
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return false
+	default:
+		return true
+	}
+}
+
+func isExempt(r *http.Request) bool {
+	for _, prefix := range exemptPrefixes {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func unavailable(w http.ResponseWriter) {
+	st := status()
+	msg := fmt.Sprintf("server is in %s mode", st["mode"])
+	if st["reason"] != "" {
+		msg = fmt.Sprintf("%s (%s)", msg, st["reason"])
+	}
+	js, err := json.Marshal(map[string]interface{}{
+		"error": msg,
+		"mode":  st["mode"],
+		"since": st["since"],
+	})
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", "60")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write(js)
+}
+
+// Middleware rejects the requests not allowed in the current mode with a 503
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch m := Get(); {
+		case m == ReadWrite || isExempt(r):
+		case m == Maintenance || isMutating(r):
+			unavailable(w)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Handler returns the handler for the `/api/admin/mode` endpoint
+func Handler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Admin, perms.Config),
+			perms.Resource(perms.Server, perms.Config),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+		switch r.Method {
+		case "GET", "HEAD":
+			httputil.MarshalAndWrite(r, w, status())
+		case "POST":
+			q := httputil.NewQuery(r.URL.Query())
+			if q.Get("mode") == "" {
+				httputil.WriteJSONError(w, http.StatusBadRequest, "missing mode")
+				return
+			}
+			if err := Set(q.Get("mode"), q.Get("reason")); err != nil {
+				httputil.WriteJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			httputil.MarshalAndWrite(r, w, status())
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package mode
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMiddleware(t *testing.T) {
+	defer Set(ReadWrite, "")
+	h := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	for _, tdata := range []struct {
+		mode, method, path string
+		expected           int
+	}{
+		{ReadWrite, "POST", "/api/blobstore/upload", http.StatusOK},
+		{ReadOnly, "GET", "/api/blobstore/blob/x", http.StatusOK},
+		{ReadOnly, "POST", "/api/blobstore/upload", http.StatusServiceUnavailable},
+		{ReadOnly, "POST", "/api/admin/mode", http.StatusOK},
+		{Maintenance, "GET", "/api/blobstore/blob/x", http.StatusServiceUnavailable},
+		{Maintenance, "GET", "/healthz", http.StatusOK},
+	} {
+		if err := Set(tdata.mode, "test"); err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(tdata.method, tdata.path, nil))
+		if w.Code != tdata.expected {
+			t.Errorf("%s %s %s: expected %d, got %d", tdata.mode, tdata.method, tdata.path, tdata.expected, w.Code)
+		}
+	}
+	if err := Set("nope", ""); err == nil {
+		t.Errorf("invalid mode should fail")
+	}
+}
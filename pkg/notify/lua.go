@@ -0,0 +1,36 @@
+package notify // import "a4.io/blobstash/pkg/notify"
+
+import (
+	lua "github.com/yuin/gopher-lua"
+)
+
+// SetupLua exports the `notify` module, `notify.email(to, subject, body)` sends an email (`to` can be a single address
+// or a table of addresses) and returns true, or false and the error message
+func SetupLua(L *lua.LState) {
+	L.PreloadModule("notify", func(L *lua.LState) int {
+		mod := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+			"email": func(L *lua.LState) int {
+				var to []string
+				switch lv := L.CheckAny(1).(type) {
+				case lua.LString:
+					to = append(to, string(lv))
+				case *lua.LTable:
+					lv.ForEach(func(_, v lua.LValue) {
+						to = append(to, v.String())
+					})
+				default:
+					L.ArgError(1, "string or table expected")
+				}
+				if err := Email(to, L.CheckString(2), L.CheckString(3)); err != nil {
+					L.Push(lua.LFalse)
+					L.Push(lua.LString(err.Error()))
+					return 2
+				}
+				L.Push(lua.LTrue)
+				return 1
+			},
+		})
+		L.Push(mod)
+		return 1
+	})
+}
@@ -0,0 +1,204 @@
+/*
+Package notify implements the email notifications.
+
+The emails are sent via SMTP or Mailgun, either by the apps (via the `notify` Lua module), or by BlobStash itself for
+the scrub failures, the replication lag and the GC results (sent to the configured recipients).
+*/
+package notify // import "a4.io/blobstash/pkg/notify"
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"a4.io/blobstash/pkg/config"
+)
+
+// Built-in notifications
+const (
+	Scrub       = "scrub"
+	Replication = "replication"
+	GC          = "gc"
+)
+
+// ErrNotConfigured is returned when sending an email without the `notify` config
+var ErrNotConfigured = errors.New("notifications not configured")
+
+const (
+	defaultSMTPPort       = 587
+	defaultMailgunBaseURL = "https://api.mailgun.net/v3"
+	defaultReplicationLag = 10 * time.Minute
+)
+
+// sender sends an email
+type sender interface {
+	send(from string, to []string, subject, body string) error
+}
+
+var (
+	mu             sync.RWMutex
+	conf           *config.Notify
+	current        sender
+	replicationLag = defaultReplicationLag
+)
+
+// Setup (re)initializes the notifications from the config (it must have been validated by `Config.Init`)
+func Setup(c *config.Notify) {
+	mu.Lock()
+	defer mu.Unlock()
+	conf = c
+	current = nil
+	replicationLag = defaultReplicationLag
+	if c == nil {
+		return
+	}
+	if c.SMTP != nil {
+		current = newSMTPSender(c.SMTP)
+	} else {
+		current = newMailgunSender(c.Mailgun)
+	}
+	if c.ReplicationLag != "" {
+		lag, err := time.ParseDuration(c.ReplicationLag)
+		if err != nil {
+			panic(err)
+		}
+		replicationLag = lag
+	}
+}
+
+// ReplicationLag returns how long the replication must be failing before notifying
+func ReplicationLag() time.Duration {
+	mu.RLock()
+	defer mu.RUnlock()
+	return replicationLag
+}
+
+// Email sends an email to the given recipients
+func Email(to []string, subject, body string) error {
+	mu.RLock()
+	c, s := conf, current
+	mu.RUnlock()
+	if s == nil {
+		return ErrNotConfigured
+	}
+	if len(to) == 0 {
+		return errors.New("no recipients")
+	}
+	for _, addr := range to {
+		// Prevent headers injection
+		if strings.ContainsAny(addr, "\r\n") {
+			return fmt.Errorf("invalid recipient %q", addr)
+		}
+	}
+	if strings.ContainsAny(subject, "\r\n") {
+		return errors.New("invalid subject")
+	}
+	return s.send(c.From, to, subject, body)
+}
+
+// Enabled returns true if the built-in notification must be sent
+func Enabled(event string) bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	if conf == nil || len(conf.To) == 0 {
+		return false
+	}
+	if len(conf.Events) == 0 {
+		return true
+	}
+	for _, evt := range conf.Events {
+		if evt == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Notify sends the built-in notification to the configured recipients (it's a no-op if the event is not enabled)
+func Notify(event, subject, body string) error {
+	if !Enabled(event) {
+		return nil
+	}
+	mu.RLock()
+	to := conf.To
+	mu.RUnlock()
+	return Email(to, "[BlobStash] "+subject, body)
+}
+
+type smtpSender struct {
+	addr string
+	auth smtp.Auth
+}
+
+func newSMTPSender(c *config.NotifySMTP) *smtpSender {
+	port := c.Port
+	if port == 0 {
+		port = defaultSMTPPort
+	}
+	s := &smtpSender{addr: c.Host + ":" + strconv.Itoa(port)}
+	if c.Username != "" {
+		s.auth = smtp.PlainAuth("", c.Username, c.Password, c.Host)
+	}
+	return s
+}
+
+func (s *smtpSender) send(from string, to []string, subject, body string) error {
+	var msg strings.Builder
+	msg.WriteString("From: " + from + "\r\n")
+	msg.WriteString("To: " + strings.Join(to, ", ") + "\r\n")
+	msg.WriteString("Subject: " + subject + "\r\n")
+	msg.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(body)
+	return smtp.SendMail(s.addr, s.auth, from, to, []byte(msg.String()))
+}
+
+type mailgunSender struct {
+	endpoint string
+	apiKey   string
+	client   *http.Client
+}
+
+func newMailgunSender(c *config.NotifyMailgun) *mailgunSender {
+	baseURL := c.BaseURL
+	if baseURL == "" {
+		baseURL = defaultMailgunBaseURL
+	}
+	return &mailgunSender{
+		endpoint: strings.TrimSuffix(baseURL, "/") + "/" + c.Domain + "/messages",
+		apiKey:   c.APIKey,
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (s *mailgunSender) send(from string, to []string, subject, body string) error {
+	form := url.Values{}
+	form.Set("from", from)
+	for _, addr := range to {
+		form.Add("to", addr)
+	}
+	form.Set("subject", subject)
+	form.Set("text", body)
+	req, err := http.NewRequest("POST", s.endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("api", s.apiKey)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("mailgun: unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
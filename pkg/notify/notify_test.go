@@ -0,0 +1,73 @@
+package notify
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+
+	"a4.io/blobstash/pkg/config"
+)
+
+func TestNotify(t *testing.T) {
+	var sent []url.Values
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, key, _ := r.BasicAuth(); key != "key" || r.URL.Path != "/example.com/messages" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			t.Error(err)
+			return
+		}
+		sent = append(sent, r.PostForm)
+	}))
+	defer ts.Close()
+	defer Setup(nil)
+
+	Setup(nil)
+	if err := Email([]string{"a@example.com"}, "subject", "body"); err != ErrNotConfigured {
+		t.Errorf("expected ErrNotConfigured, got %v", err)
+	}
+	if err := Notify(GC, "subject", "body"); err != nil {
+		t.Errorf("expected a no-op, got %v", err)
+	}
+
+	Setup(&config.Notify{
+		From:    "blobstash@example.com",
+		To:      []string{"admin@example.com"},
+		Events:  []string{Scrub},
+		Mailgun: &config.NotifyMailgun{Domain: "example.com", APIKey: "key", BaseURL: ts.URL},
+	})
+	if err := Notify(Scrub, "scrub failed", "details"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Notify(GC, "GC done", "details"); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != 1 || sent[0].Get("to") != "admin@example.com" || sent[0].Get("subject") != "[BlobStash] scrub failed" ||
+		sent[0].Get("from") != "blobstash@example.com" || sent[0].Get("text") != "details" {
+		t.Fatalf("unexpected emails %+v", sent)
+	}
+	if err := Email([]string{"a@example.com\r\nBcc: b@example.com"}, "subject", "body"); err == nil {
+		t.Errorf("expected an invalid recipient error")
+	}
+
+	L := lua.NewState()
+	defer L.Close()
+	SetupLua(L)
+	if err := L.DoString(`
+local notify = require('notify')
+assert(notify.email('a@example.com', 'hello', 'world'))
+assert(notify.email({'a@example.com', 'b@example.com'}, 'hello', 'world'))
+local ok, err = notify.email({}, 'hello', 'world')
+assert(not ok and err == 'no recipients')
+`); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != 3 || len(sent[2]["to"]) != 2 {
+		t.Errorf("unexpected emails %+v", sent)
+	}
+}
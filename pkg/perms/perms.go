@@ -37,6 +37,10 @@ const (
 	Namespace      ObjectType = "namespace"
 	JSONDocument   ObjectType = "json-doc"
 	JSONCollection ObjectType = "json-col"
+	Config         ObjectType = "config"
+	SnapshotRef    ObjectType = "snapshot"
+
+	WebAuthnCredential ObjectType = "webauthn-credential"
 )
 
 // Services
@@ -46,6 +50,9 @@ const (
 	DocStore  ServiceName = "docstore"
 	Filetree  ServiceName = "filetree"
 	Stash     ServiceName = "stash"
+	Server    ServiceName = "server"
+	WebAuthn  ServiceName = "webauthn"
+	Snapshots ServiceName = "snapshots"
 )
 
 // Action formats an action `<action_type>:<object_type>`
@@ -83,6 +90,14 @@ func init() {
 				Action:   Action(Write, KVEntry),
 				Resource: ResourceWithID(KvStore, KVEntry, "_filetree:fs:{{.name}}"),
 			},
+			&config.Perm{
+				Action:   Action(Stat, Namespace),
+				Resource: ResourceWithID(Stash, Namespace, "{{.name}}"),
+			},
+			&config.Perm{
+				Action:   Action(Write, Namespace),
+				Resource: ResourceWithID(Stash, Namespace, "{{.name}}"),
+			},
 			&config.Perm{
 				Action:   Action(GC, Namespace),
 				Resource: ResourceWithID(Stash, Namespace, "{{.name}}"),
@@ -93,11 +108,23 @@ func init() {
 			},
 		},
 	})
+
+	builtinRoles = map[string]bool{}
+	for k := range roles {
+		builtinRoles[k] = true
+	}
+	builtinManagedRoles = map[string]bool{}
+	for k := range managedRoles {
+		builtinManagedRoles[k] = true
+	}
 }
 
 var roles = map[string]rbac.Role{}
 var managedRoles = map[string]*config.Role{}
 
+// Built-in roles (defined in `init`), kept when the config roles are reloaded
+var builtinRoles, builtinManagedRoles map[string]bool
+
 func newManagedRole(r *config.Role) error {
 	for _, k := range r.ArgsRequired {
 		if _, ok := r.Args[k]; !ok {
@@ -162,6 +189,14 @@ func SetupRole(r *config.Role) error {
 }
 
 func GetRole(k string) (rbac.Role, error) {
+	return getRole(roles, k)
+}
+
+func GetRoles(keys []string) (rbac.Roles, error) {
+	return getRoles(roles, keys)
+}
+
+func getRole(roles map[string]rbac.Role, k string) (rbac.Role, error) {
 	r, ok := roles[k]
 	if !ok {
 		return rbac.Role{}, fmt.Errorf("role %q not found", k)
@@ -169,10 +204,10 @@ func GetRole(k string) (rbac.Role, error) {
 	return r, nil
 }
 
-func GetRoles(keys []string) (rbac.Roles, error) {
+func getRoles(roles map[string]rbac.Role, keys []string) (rbac.Roles, error) {
 	res := rbac.Roles{}
 	for _, k := range keys {
-		role, err := GetRole(k)
+		role, err := getRole(roles, k)
 		if err != nil {
 			return nil, err
 		}
@@ -181,11 +216,56 @@ func GetRoles(keys []string) (rbac.Roles, error) {
 	return res, nil
 }
 
-func Setup(conf *config.Config) error {
+// RoleSet holds the roles loaded from a config (see `Load`)
+type RoleSet struct {
+	roles        map[string]rbac.Role
+	managedRoles map[string]*config.Role
+}
+
+// GetRoles returns the given roles from the set
+func (rs *RoleSet) GetRoles(keys []string) (rbac.Roles, error) {
+	return getRoles(rs.roles, keys)
+}
+
+// Apply replaces the current roles with the set
+func (rs *RoleSet) Apply() {
+	roles, managedRoles = rs.roles, rs.managedRoles
+}
+
+// Load loads the roles defined in the config, the current roles are left untouched until the set is applied
+func Load(conf *config.Config) (*RoleSet, error) {
+	oldRoles, oldManagedRoles := roles, managedRoles
+	defer func() {
+		roles, managedRoles = oldRoles, oldManagedRoles
+	}()
+
+	// Drop the roles from a previous config
+	roles, managedRoles = map[string]rbac.Role{}, map[string]*config.Role{}
+	for k, r := range oldRoles {
+		if builtinRoles[k] {
+			roles[k] = r
+		}
+	}
+	for k, r := range oldManagedRoles {
+		if builtinManagedRoles[k] {
+			managedRoles[k] = r
+		}
+	}
+
 	for _, role := range conf.Roles {
 		if err := SetupRole(role); err != nil {
-			panic(err)
+			return nil, err
 		}
 	}
+	return &RoleSet{roles, managedRoles}, nil
+}
+
+// Setup (re-)loads the roles defined in the config
+func Setup(conf *config.Config) error {
+	rs, err := Load(conf)
+	if err != nil {
+		return err
+	}
+	rs.Apply()
 	return nil
 }
@@ -54,3 +54,50 @@ func TestRedefineAdmin(t *testing.T) {
 		t.Errorf("err should not be nil, got %v", err)
 	}
 }
+
+func TestSetupReload(t *testing.T) {
+	conf := &config.Config{Roles: []*config.Role{setupTestRole("reloaded", "action:read:blob", "resource:*")}}
+	for i := 0; i < 2; i++ {
+		if err := Setup(conf); err != nil {
+			t.Fatalf("failed to setup roles: %v", err)
+		}
+	}
+	if _, err := GetRoles([]string{"admin", "reloaded"}); err != nil {
+		t.Errorf("roles should be defined, got %v", err)
+	}
+	if err := Setup(&config.Config{}); err != nil {
+		t.Fatalf("failed to setup roles: %v", err)
+	}
+	if _, err := GetRole("reloaded"); err == nil {
+		t.Errorf("role should have been removed")
+	}
+}
+
+func TestLoad(t *testing.T) {
+	if err := Setup(&config.Config{}); err != nil {
+		t.Fatalf("failed to setup roles: %v", err)
+	}
+	rs, err := Load(&config.Config{Roles: []*config.Role{setupTestRole("loaded", "action:read:blob", "resource:*")}})
+	if err != nil {
+		t.Fatalf("failed to load roles: %v", err)
+	}
+	if _, err := rs.GetRoles([]string{"admin", "loaded"}); err != nil {
+		t.Errorf("roles should be defined in the set, got %v", err)
+	}
+	// The roles are only used once applied
+	if _, err := GetRole("loaded"); err == nil {
+		t.Errorf("role should not be defined before the set is applied")
+	}
+	rs.Apply()
+	if _, err := GetRole("loaded"); err != nil {
+		t.Errorf("role should be defined, got %v", err)
+	}
+
+	// A failed load leaves the current roles untouched
+	if _, err := Load(&config.Config{Roles: []*config.Role{setupTestRole("bad", "read:blob", "resource:*")}}); err == nil {
+		t.Errorf("invalid role should fail")
+	}
+	if _, err := GetRole("loaded"); err != nil {
+		t.Errorf("role should still be defined, got %v", err)
+	}
+}
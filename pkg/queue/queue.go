@@ -108,7 +108,23 @@ func (q *Queue) Blobs() ([]*blob.Blob, error) {
 	return out, nil
 }
 
+// Oldest returns the enqueue time of the oldest item, returns false if the queue is empty.
+func (q *Queue) Oldest() (time.Time, bool, error) {
+	c := q.db.PrefixRange([]byte(""), false)
+	defer c.Close()
+
+	k, _, err := c.Next()
+	switch {
+	case err == io.EOF || (err == nil && k == nil):
+		return time.Time{}, false, nil
+	case err != nil:
+		return time.Time{}, false, err
+	}
+	return time.Unix(0, id.FromRaw(k).Ts()), true, nil
+}
+
 // Enqueue the given `item`. Must be JSON serializable.
+// The item is synced to disk before returning (it won't be lost if the process crashes).
 func (q *Queue) Enqueue(item interface{}) (*id.ID, error) {
 	id, err := id.New(time.Now().UnixNano())
 	if err != nil {
@@ -120,7 +136,9 @@ func (q *Queue) Enqueue(item interface{}) (*id.ID, error) {
 		return nil, err
 	}
 
-	q.db.Set(id.Raw(), js)
+	if err := q.db.SetSync(id.Raw(), js); err != nil {
+		return nil, err
+	}
 
 	return id, nil
 }
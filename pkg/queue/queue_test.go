@@ -2,6 +2,7 @@ package queue
 
 import (
 	"testing"
+	"time"
 )
 
 func check(e error) {
@@ -76,3 +77,29 @@ func TestQueue(t *testing.T) {
 		t.Errorf("no item should have been dequeued, got \"%s\"", deq3.Val)
 	}
 }
+
+func TestQueueOldest(t *testing.T) {
+	q, err := New("queue_oldest_test")
+	if err != nil {
+		t.Fatalf("Error creating db %v", err)
+	}
+	defer q.Remove()
+
+	_, ok, err := q.Oldest()
+	check(err)
+	if ok {
+		t.Errorf("empty queue should not have an oldest item")
+	}
+
+	start := time.Now()
+	_, err = q.Enqueue(&Item{"ok"})
+	check(err)
+	_, err = q.Enqueue(&Item{"ok2"})
+	check(err)
+
+	oldest, ok, err := q.Oldest()
+	check(err)
+	if !ok || oldest.Before(start.Add(-time.Second)) || oldest.After(time.Now()) {
+		t.Errorf("unexpected oldest item time %v", oldest)
+	}
+}
@@ -0,0 +1,227 @@
+package rangedb // import "a4.io/blobstash/pkg/rangedb"
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+	"github.com/syndtr/goleveldb/leveldb"
+
+	"a4.io/blobstash/pkg/clock"
+)
+
+// Key layout:
+// - `e:<expiry timestamp (big endian unix nano)><key>` => empty (sorted by expiry)
+// - `k:<key>` => expiry timestamp (to update/remove the entry)
+var (
+	expiryPrefix = []byte("e:")
+	keyPrefix    = []byte("k:")
+)
+
+// ExpireFunc is called for every expired key, returning an error will retry the expiration later
+type ExpireFunc func(key string) error
+
+// ExpirationIndex keeps keys sorted by their expiry time, so the expired ones can be popped without scanning
+// everything.
+//
+// It's shared by all the modules supporting a TTL, each module registers an `ExpireFunc` for its own key prefix.
+type ExpirationIndex struct {
+	db *RangeDB
+
+	// Serialize the updates (`Set` must read the previous expiry)
+	mu sync.Mutex
+
+	handlers map[string]ExpireFunc
+	stop     chan struct{}
+	done     chan struct{}
+
+	logger log.Logger
+}
+
+// NewExpirationIndex opens (or creates) the expiration index at the given path
+func NewExpirationIndex(logger log.Logger, path string) (*ExpirationIndex, error) {
+	db, err := New(path)
+	if err != nil {
+		return nil, err
+	}
+	return &ExpirationIndex{
+		db:       db,
+		handlers: map[string]ExpireFunc{},
+		logger:   logger,
+	}, nil
+}
+
+func encodeTs(t time.Time) []byte {
+	ts := make([]byte, 8)
+	binary.BigEndian.PutUint64(ts, uint64(t.UnixNano()))
+	return ts
+}
+
+func expiryKey(ts []byte, key string) []byte {
+	var buf bytes.Buffer
+	buf.Write(expiryPrefix)
+	buf.Write(ts)
+	buf.WriteString(key)
+	return buf.Bytes()
+}
+
+func (e *ExpirationIndex) remove(batch *leveldb.Batch, key string) error {
+	k := append(append([]byte{}, keyPrefix...), key...)
+	ts, err := e.db.Get(k)
+	if err != nil {
+		return err
+	}
+	if ts != nil {
+		batch.Delete(expiryKey(ts, key))
+		batch.Delete(k)
+	}
+	return nil
+}
+
+// Set sets (or updates) the expiry time of the key
+func (e *ExpirationIndex) Set(key string, expiresAt time.Time) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	batch := new(leveldb.Batch)
+	if err := e.remove(batch, key); err != nil {
+		return err
+	}
+	ts := encodeTs(expiresAt)
+	batch.Put(expiryKey(ts, key), nil)
+	batch.Put(append(append([]byte{}, keyPrefix...), key...), ts)
+	return e.db.db.Write(batch, nil)
+}
+
+// Remove removes the expiry time of the key (it's a no-op if the key has no expiry time)
+func (e *ExpirationIndex) Remove(key string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	batch := new(leveldb.Batch)
+	if err := e.remove(batch, key); err != nil {
+		return err
+	}
+	return e.db.db.Write(batch, nil)
+}
+
+// ExpiresAt returns the expiry time of the key (the zero time if the key has no expiry time)
+func (e *ExpirationIndex) ExpiresAt(key string) (time.Time, error) {
+	ts, err := e.db.Get(append(append([]byte{}, keyPrefix...), key...))
+	if err != nil || ts == nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(ts))), nil
+}
+
+// PopExpired removes and returns (at most `limit`) keys that expired before `now`, oldest first
+func (e *ExpirationIndex) PopExpired(now time.Time, limit int) ([]string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	max := encodeTs(now)
+	keys := []string{}
+	batch := new(leveldb.Batch)
+	r := e.db.PrefixRange(expiryPrefix, false)
+	defer r.Close()
+	for limit <= 0 || len(keys) < limit {
+		k, _, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		ts := k[len(expiryPrefix) : len(expiryPrefix)+8]
+		if bytes.Compare(ts, max) > 0 {
+			break
+		}
+		key := string(k[len(expiryPrefix)+8:])
+		batch.Delete(k)
+		batch.Delete(append(append([]byte{}, keyPrefix...), key...))
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return keys, nil
+	}
+	if err := e.db.db.Write(batch, nil); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Handle registers the function called when a key starting with the given prefix expires
+func (e *ExpirationIndex) Handle(prefix string, fn ExpireFunc) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.handlers[prefix] = fn
+}
+
+func (e *ExpirationIndex) handler(key string) ExpireFunc {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for prefix, fn := range e.handlers {
+		if strings.HasPrefix(key, prefix) {
+			return fn
+		}
+	}
+	return nil
+}
+
+// Expire pops all the expired keys and calls the matching handlers, the keys are re-scheduled a minute later
+// if the handler failed.
+func (e *ExpirationIndex) Expire(now time.Time) error {
+	for {
+		keys, err := e.PopExpired(now, 500)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			fn := e.handler(key)
+			if fn == nil {
+				e.logger.Warn("no handler for expired key", "key", key)
+				continue
+			}
+			if err := fn(key); err != nil {
+				e.logger.Error("failed to expire key", "key", key, "err", err)
+				if err := e.Set(key, now.Add(1*time.Minute)); err != nil {
+					return err
+				}
+			}
+		}
+		if len(keys) < 500 {
+			return nil
+		}
+	}
+}
+
+// Start calls `Expire` every interval (in the background) until `Close` is called
+func (e *ExpirationIndex) Start(interval time.Duration) {
+	e.stop = make(chan struct{})
+	e.done = make(chan struct{})
+	go func() {
+		defer close(e.done)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				if err := e.Expire(clock.Now()); err != nil {
+					e.logger.Error("expiration failed", "err", err)
+				}
+			case <-e.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops the background worker (if started) and closes the DB
+func (e *ExpirationIndex) Close() error {
+	if e.stop != nil {
+		close(e.stop)
+		<-e.done
+	}
+	return e.db.Close()
+}
@@ -0,0 +1,62 @@
+package rangedb
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+)
+
+func TestExpirationIndex(t *testing.T) {
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	e, err := NewExpirationIndex(logger, "db_expiry")
+	check(err)
+	defer os.RemoveAll("db_expiry")
+	defer e.Close()
+
+	now := time.Now()
+	check(e.Set("kv:c", now.Add(3*time.Second)))
+	check(e.Set("kv:a", now.Add(1*time.Second)))
+	check(e.Set("kv:b", now.Add(2*time.Second)))
+	check(e.Set("kv:d", now.Add(1*time.Hour)))
+	// Updating the expiry time replaces the previous one
+	check(e.Set("kv:c", now.Add(-1*time.Second)))
+	check(e.Set("kv:e", now.Add(1*time.Second)))
+	check(e.Remove("kv:e"))
+
+	keys, err := e.PopExpired(now.Add(2*time.Second), 0)
+	check(err)
+	if expected := []string{"kv:c", "kv:a", "kv:b"}; !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected %v, got %v", expected, keys)
+	}
+	keys, err = e.PopExpired(now.Add(2*time.Second), 0)
+	check(err)
+	if len(keys) != 0 {
+		t.Errorf("expected no keys, got %v", keys)
+	}
+	if ts, err := e.ExpiresAt("kv:d"); err != nil || !ts.Equal(time.Unix(0, now.Add(1*time.Hour).UnixNano())) {
+		t.Errorf("bad expiry time for kv:d: %v (err=%v)", ts, err)
+	}
+
+	// Failed expirations are retried later
+	expired := []string{}
+	e.Handle("kv:", func(key string) error {
+		if key == "kv:f" {
+			return errors.New("failed")
+		}
+		expired = append(expired, key)
+		return nil
+	})
+	check(e.Set("kv:f", now))
+	check(e.Expire(now.Add(2 * time.Hour)))
+	if !reflect.DeepEqual(expired, []string{"kv:d"}) {
+		t.Errorf("expected kv:d to expire, got %v", expired)
+	}
+	if ts, err := e.ExpiresAt("kv:f"); err != nil || !ts.After(now.Add(2*time.Hour)) {
+		t.Errorf("kv:f should have been re-scheduled: %v (err=%v)", ts, err)
+	}
+}
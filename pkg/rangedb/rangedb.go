@@ -7,6 +7,7 @@ import (
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/errors"
 	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/opt"
 	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
@@ -44,6 +45,11 @@ func (db *RangeDB) Set(k, v []byte) error {
 	return db.db.Put(k, v, nil)
 }
 
+// SetSync is like Set, but the write is flushed to disk before returning
+func (db *RangeDB) SetSync(k, v []byte) error {
+	return db.db.Put(k, v, &opt.WriteOptions{Sync: true})
+}
+
 func (db *RangeDB) Delete(k []byte) error {
 	return db.db.Delete(k, nil)
 }
@@ -80,6 +86,15 @@ func NextKey(bkey []byte) []byte {
 	return bkey
 }
 
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
 type Range struct {
 	Reverse  bool
 	Min, Max []byte
@@ -99,7 +114,12 @@ func (db *RangeDB) PrefixRange(prefix []byte, reverse bool) *Range {
 }
 
 func (db *RangeDB) Range(min, max []byte, reverse bool) *Range {
-	iter := db.db.NewIterator(&util.Range{Start: min, Limit: NextKey(max)}, nil)
+	limit := NextKey(max)
+	if len(limit) > 0 && isZero(limit) {
+		// max only contained 0xff bytes (NextKey overflowed), the range has no upper bound
+		limit = nil
+	}
+	iter := db.db.NewIterator(&util.Range{Start: min, Limit: limit}, nil)
 	return &Range{
 		it:      iter,
 		Min:     min,
@@ -82,4 +82,9 @@ func TestDBBasic(t *testing.T) {
 	if !reflect.DeepEqual(r4, out) {
 		t.Errorf("range check failed")
 	}
+
+	r5 := getRange(t, db, []byte("hello099"), []byte("\xff"), false)
+	if !reflect.DeepEqual(r5, [][]byte{[]byte("hello099"), []byte("zello01")}) {
+		t.Errorf("unbounded range check failed %q", r5)
+	}
 }
@@ -2,7 +2,9 @@ package replication // import "a4.io/blobstash/pkg/replication"
 
 import (
 	"context"
+	"fmt"
 	"math"
+	"reflect"
 	"sync"
 	"time"
 
@@ -10,6 +12,9 @@ import (
 	"a4.io/blobstash/pkg/client/clientutil"
 	"a4.io/blobstash/pkg/client/oplog"
 	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/lifecycle"
+	"a4.io/blobstash/pkg/notify"
+	"a4.io/blobstash/pkg/signing"
 	"a4.io/blobstash/pkg/stash/store"
 	bsync "a4.io/blobstash/pkg/sync"
 
@@ -47,34 +52,71 @@ type Replication struct {
 
 	conf *config.ReplicateFrom
 
-	wg *sync.WaitGroup
+	// Cancels the current remote oplog connection (when the peer is updated)
+	cancelNotify func()
+	mu           sync.Mutex
+
+	lc *lifecycle.Lifecycle
+
+	// Last time the replica was known to be in sync, and whether the lag notification was sent (only used by the
+	// oplog goroutine)
+	lastSync    time.Time
+	lagNotified bool
 }
 
-func New(logger log.Logger, conf *config.Config, bs store.BlobStore, s *bsync.Sync, wg *sync.WaitGroup) (*Replication, error) {
+func newRemoteOplog(conf *config.ReplicateFrom) *oplog.Oplog {
+	return oplog.New(clientutil.NewClientUtil(conf.URL, clientutil.WithAPIKey(conf.APIKey)))
+}
+
+func New(logger log.Logger, conf *config.Config, bs store.BlobStore, s *bsync.Sync, lc *lifecycle.Lifecycle) (*Replication, error) {
 	logger.Debug("init")
 	rep := &Replication{
 		conf:        conf.ReplicateFrom,
 		blobstore:   bs,
 		log:         logger,
-		remoteOplog: oplog.New(clientutil.NewClientUtil(conf.ReplicateFrom.URL, clientutil.WithAPIKey(conf.ReplicateFrom.APIKey))),
+		remoteOplog: newRemoteOplog(conf.ReplicateFrom),
 		synctable:   s,
 		backoff: &Backoff{
 			delay:    1 * time.Second,
 			maxDelay: 120 * time.Second,
 			factor:   1.6,
 		},
-		wg: wg,
+		lc: lc,
 	}
 	if err := rep.init(); err != nil {
 		return nil, err
 	}
-	// FIXME(tsileo): clean shutdown
 	return rep, nil
 }
 
+// Reload updates the remote peer, the replication will resync with the new peer
+func (r *Replication) Reload(conf *config.ReplicateFrom) {
+	r.mu.Lock()
+	if reflect.DeepEqual(conf, r.conf) {
+		r.mu.Unlock()
+		return
+	}
+	r.conf = conf
+	r.remoteOplog = newRemoteOplog(conf)
+	cancel := r.cancelNotify
+	r.mu.Unlock()
+
+	r.log.Info("replication peer updated", "url", conf.URL)
+	if cancel != nil {
+		cancel()
+	}
+}
+
+func (r *Replication) peer() (*config.ReplicateFrom, *oplog.Oplog) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.conf, r.remoteOplog
+}
+
 func (r *Replication) sync() error {
 	// Initiate a one-way synchronization
-	stats, err := r.synctable.Sync(r.conf.URL, r.conf.APIKey, true)
+	conf, _ := r.peer()
+	stats, err := r.synctable.Sync(conf.URL, conf.APIKey, true)
 	if err != nil {
 		return err
 	}
@@ -82,49 +124,99 @@ func (r *Replication) sync() error {
 	return nil
 }
 
+// seed runs the full-seed if enabled and the local blob store is empty
+func (r *Replication) seed() (bool, error) {
+	conf, _ := r.peer()
+	if !conf.Seed {
+		return false, nil
+	}
+	empty, err := r.synctable.IsEmpty()
+	if err != nil || !empty {
+		return false, err
+	}
+	r.log.Info("empty replica, starting the full-seed", "url", conf.URL)
+	seedStats, syncStats, err := r.synctable.Seed(conf.URL, conf.APIKey)
+	if err != nil {
+		return false, err
+	}
+	r.log.Info("seed done", "seed_stats", seedStats, "sync_stats", syncStats)
+	return true, nil
+}
+
 func (r *Replication) init() error {
-	r.log.Debug("initial sync")
 	r.backoff.Reset()
-	if err := r.sync(); err != nil {
+	seeded, err := r.seed()
+	if err != nil {
 		return err
 	}
+	if !seeded {
+		r.log.Debug("initial sync")
+		if err := r.sync(); err != nil {
+			return err
+		}
+	}
+	r.lastSync = time.Now()
 	var resync bool
 
 	ops := make(chan *oplog.Op)
 
-	// This should run forever (can't disable replication while BlobStash is already running)
-	go func() {
+	// This should run until shutdown (can't disable replication while BlobStash is already running)
+	r.lc.Go("replication-oplog", func(ctx context.Context) {
+		defer close(ops)
 		for {
 			if resync {
 				r.log.Debug("trying to resync")
 				if err := r.sync(); err != nil {
 					r.log.Error("failed to sync", "err", err, "attempt", r.backoff.attempt)
-					time.Sleep(r.backoff.Delay())
+					r.checkLag(err)
+					if !sleepCtx(ctx, r.backoff.Delay()) {
+						return
+					}
 					continue
 				}
 				r.backoff.Reset()
 				r.log.Debug("sync successful")
+				r.synced()
 				resync = false
 			}
 
 			r.log.Debug("listen to remote oplog")
-			if err := r.remoteOplog.Notify(context.TODO(), ops, nil); err != nil {
+			nctx, cancel := context.WithCancel(ctx)
+			r.mu.Lock()
+			r.cancelNotify = cancel
+			remoteOplog := r.remoteOplog
+			r.mu.Unlock()
+			err := remoteOplog.Notify(nctx, ops, nil)
+			cancel()
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				if nctx.Err() != nil {
+					// The peer was updated, resync right away
+					resync = true
+					continue
+				}
 				r.log.Error("remote oplog SSE error", "err", err, "attempt", r.backoff.attempt)
+				r.checkLag(err)
 				resync = true
-				time.Sleep(r.backoff.Delay())
+				if !sleepCtx(ctx, r.backoff.Delay()) {
+					return
+				}
 			}
 			r.backoff.Reset()
 		}
-	}()
+	})
 
-	go func() {
+	r.lc.Go("replication-worker", func(_ context.Context) {
 		for op := range ops {
 			if op.Event == "blob" {
 				hash := op.Data
 				r.log.Info("new blob from replication", "hash", hash)
 
 				// Fetch the blob from the remote BlobStash instance
-				data, err := r.remoteOplog.GetBlob(context.TODO(), hash)
+				_, remoteOplog := r.peer()
+				data, err := remoteOplog.GetBlob(context.TODO(), hash)
 				if err != nil {
 					panic(err)
 				}
@@ -133,6 +225,12 @@ func (r *Replication) init() error {
 				blob := &blob.Blob{Hash: hash, Data: data}
 				r.log.Debug("fetched blob", "blob", blob)
 
+				// Reject the FS roots/snapshots that were tampered with
+				if err := signing.CheckMetaBlob(data); err != nil {
+					r.log.Error("rejected blob from replication", "hash", hash, "err", err)
+					continue
+				}
+
 				// Save it locally
 				if r.blobstore.Put(context.Background(), blob); err != nil {
 					panic(err)
@@ -140,7 +238,47 @@ func (r *Replication) init() error {
 			}
 		}
 		r.log.Debug("done listening the remote oplog")
-	}()
+	})
 
 	return nil
 }
+
+// checkLag sends the replication lag notification (once) if the replication has been failing for too long
+func (r *Replication) checkLag(err error) {
+	lag := time.Since(r.lastSync)
+	if r.lagNotified || lag < notify.ReplicationLag() {
+		return
+	}
+	conf, _ := r.peer()
+	r.lagNotified = true
+	if nerr := notify.Notify(
+		notify.Replication,
+		"replication lagging",
+		fmt.Sprintf("The replication from %s has been failing for %v, last error: %v\n", conf.URL, lag.Round(time.Second), err),
+	); nerr != nil {
+		r.log.Error("failed to send the replication lag notification", "err", nerr)
+	}
+}
+
+// synced records that the replica is in sync with the remote (and notifies if it was lagging)
+func (r *Replication) synced() {
+	r.lastSync = time.Now()
+	if !r.lagNotified {
+		return
+	}
+	r.lagNotified = false
+	conf, _ := r.peer()
+	if err := notify.Notify(notify.Replication, "replication recovered", fmt.Sprintf("The replication from %s is back in sync.\n", conf.URL)); err != nil {
+		r.log.Error("failed to send the replication recovery notification", "err", err)
+	}
+}
+
+// sleepCtx sleeps for the given duration, returns false if the context was cancelled in the meantime
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
@@ -0,0 +1,385 @@
+/*
+Package reports implements the scheduled storage growth and activity digests.
+
+A report covers the last `period` (a week by default): the bytes added to the blob store, the top-growing FS and
+docstore collections, the deduplication savings and the sync/replication status. Each report is stored as a document
+in the `_reports` collection, and can be emailed (via the `notify` config) and/or POSTed to a webhook.
+*/
+package reports // import "a4.io/blobstash/pkg/reports"
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+	"github.com/gorilla/mux"
+	log "github.com/inconshreveable/log15"
+	"github.com/robfig/cron"
+
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/backend/s3"
+	"a4.io/blobstash/pkg/blobstore"
+	"a4.io/blobstash/pkg/clock"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/docstore"
+	"a4.io/blobstash/pkg/filetree"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/lifecycle"
+	"a4.io/blobstash/pkg/notify"
+	"a4.io/blobstash/pkg/perms"
+	"a4.io/blobstash/pkg/stash/store"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+// Collection is the docstore collection where the reports are stored
+const Collection = "_reports"
+
+// stateKey is the kv key holding the counters of the previous report (used for computing the deltas)
+const stateKey = "_reports:state"
+
+// Growth holds the growth of a FS or a collection over the period
+type Growth struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`   // total size (bytes) for a FS, number of docs for a collection
+	Growth int64  `json:"growth"` // delta since the start of the period
+}
+
+// SyncStatus holds the sync/replication status
+type SyncStatus struct {
+	LastSync    string               `json:"last_sync,omitempty"`
+	LastSyncAge string               `json:"last_sync_age,omitempty"`
+	Replication *s3.ReplicationStats `json:"replication,omitempty"`
+}
+
+// Report holds the stats of a period
+type Report struct {
+	CreatedAt   string `json:"created_at"`
+	PeriodStart string `json:"period_start"`
+	PeriodEnd   string `json:"period_end"`
+
+	BlobsCount int   `json:"blobs_count"`
+	BlobsSize  int64 `json:"blobs_size"`
+	BlobsAdded int   `json:"blobs_added"`
+	BytesAdded int64 `json:"bytes_added"`
+
+	// Deduplicated writes over the period, and the ratio between the bytes written (including the deduplicated ones)
+	// and the bytes actually added
+	DedupSaved int64   `json:"dedup_saved"`
+	DedupRatio float64 `json:"dedup_ratio"`
+
+	TopFS          []*Growth   `json:"top_fs"`
+	TopCollections []*Growth   `json:"top_collections"`
+	Sync           *SyncStatus `json:"sync"`
+}
+
+// state holds the counters at the time of the last report
+type state struct {
+	BlobsCount int   `json:"blobs_count"`
+	BlobsSize  int64 `json:"blobs_size"`
+	DedupSize  int64 `json:"dedup_size"`
+}
+
+// Reports generates the reports
+type Reports struct {
+	conf     *config.Reports
+	kvs      store.KvStore
+	bs       *blobstore.BlobStore
+	ft       *filetree.FileTree
+	ds       *docstore.DocStore
+	lastSync func() time.Time
+	client   *http.Client
+	cron     *cron.Cron
+	lc       *lifecycle.Lifecycle
+	log      log.Logger
+}
+
+// New initializes the reports, and schedules them if enabled (lastSync returns the time of the last successful sync,
+// may be nil)
+func New(logger log.Logger, conf *config.Config, kvs store.KvStore, bs *blobstore.BlobStore, ft *filetree.FileTree, ds *docstore.DocStore, lastSync func() time.Time, lc *lifecycle.Lifecycle) (*Reports, error) {
+	logger.Debug("init")
+	reports := &Reports{
+		conf:     conf.Reports,
+		kvs:      kvs,
+		bs:       bs,
+		ft:       ft,
+		ds:       ds,
+		lastSync: lastSync,
+		client:   &http.Client{Timeout: 30 * time.Second},
+		cron:     cron.New(),
+		lc:       lc,
+		log:      logger,
+	}
+	if reports.conf != nil {
+		if err := reports.cron.AddFunc(reports.conf.Schedule, func() {
+			lc.Go("reports", func(ctx context.Context) {
+				if _, err := reports.Run(ctx); err != nil {
+					reports.log.Error("failed to generate the report", "err", err)
+				}
+			})
+		}); err != nil {
+			return nil, fmt.Errorf("invalid `reports.schedule`: %v", err)
+		}
+	}
+	reports.cron.Start()
+	return reports, nil
+}
+
+// Close stops the scheduler
+func (reports *Reports) Close() error {
+	reports.cron.Stop()
+	return nil
+}
+
+func (reports *Reports) period() time.Duration {
+	if reports.conf == nil {
+		return 7 * 24 * time.Hour
+	}
+	period, err := time.ParseDuration(reports.conf.Period)
+	if err != nil {
+		panic(err)
+	}
+	return period
+}
+
+func (reports *Reports) top() int {
+	if reports.conf == nil {
+		return 5
+	}
+	return reports.conf.Top
+}
+
+// Generate compiles the report for the last period (without storing it)
+func (reports *Reports) Generate(ctx context.Context) (*Report, error) {
+	now := clock.Now()
+	start := now.Add(-reports.period())
+	report := &Report{
+		CreatedAt:   now.Format(time.RFC3339),
+		PeriodStart: start.Format(time.RFC3339),
+		PeriodEnd:   now.Format(time.RFC3339),
+		Sync:        &SyncStatus{},
+	}
+
+	stats, err := reports.bs.DetailedStats()
+	if err != nil {
+		return nil, err
+	}
+	prev, err := reports.state(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if prev == nil {
+		// First report, everything has been added
+		prev = &state{}
+	}
+	report.BlobsCount = stats.BlobsCount
+	report.BlobsSize = stats.BlobsSize
+	report.BlobsAdded = stats.BlobsCount - prev.BlobsCount
+	report.BytesAdded = stats.BlobsSize - prev.BlobsSize
+	report.DedupSaved = stats.Dedup.Size - prev.DedupSize
+	// The dedup counters are reset on restart
+	if report.DedupSaved < 0 {
+		report.DedupSaved = stats.Dedup.Size
+	}
+	if report.BytesAdded > 0 {
+		report.DedupRatio = float64(report.BytesAdded+report.DedupSaved) / float64(report.BytesAdded)
+	}
+
+	// Top-growing FS
+	fss, err := reports.ft.IterFS(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	for _, fsInfo := range fss {
+		size, err := reports.ft.FSSize(ctx, fsInfo.Name, 0)
+		if err != nil {
+			return nil, err
+		}
+		oldSize, err := reports.ft.FSSize(ctx, fsInfo.Name, start.UnixNano())
+		if err != nil {
+			return nil, err
+		}
+		report.TopFS = append(report.TopFS, &Growth{Name: fsInfo.Name, Size: size, Growth: size - oldSize})
+	}
+	report.TopFS = topGrowth(report.TopFS, reports.top())
+
+	// Top-growing collections
+	collections, err := reports.ds.Collections()
+	if err != nil {
+		return nil, err
+	}
+	for _, col := range collections {
+		if col == Collection {
+			continue
+		}
+		count, err := reports.ds.CountAll(col, 0)
+		if err != nil {
+			return nil, err
+		}
+		oldCount, err := reports.ds.CountAll(col, start.UnixNano())
+		if err != nil {
+			return nil, err
+		}
+		report.TopCollections = append(report.TopCollections, &Growth{Name: col, Size: int64(count), Growth: int64(count - oldCount)})
+	}
+	report.TopCollections = topGrowth(report.TopCollections, reports.top())
+
+	// Sync status
+	if reports.lastSync != nil {
+		if lastSync := reports.lastSync(); !lastSync.IsZero() {
+			report.Sync.LastSync = lastSync.Format(time.RFC3339)
+			report.Sync.LastSyncAge = now.Sub(lastSync).Round(time.Second).String()
+		}
+	}
+	report.Sync.Replication = stats.Replication
+
+	return report, reports.saveState(ctx, &state{BlobsCount: stats.BlobsCount, BlobsSize: stats.BlobsSize, DedupSize: stats.Dedup.Size})
+}
+
+// topGrowth returns the n items with the highest growth
+func topGrowth(items []*Growth, n int) []*Growth {
+	sort.SliceStable(items, func(i, j int) bool { return items[i].Growth > items[j].Growth })
+	if len(items) > n {
+		items = items[:n]
+	}
+	if items == nil {
+		items = []*Growth{}
+	}
+	return items
+}
+
+func (reports *Reports) state(ctx context.Context) (*state, error) {
+	kv, err := reports.kvs.Get(ctx, stateKey, -1)
+	switch err {
+	case nil:
+	case vkv.ErrNotFound:
+		return nil, nil
+	default:
+		return nil, err
+	}
+	s := &state{}
+	if err := json.Unmarshal(kv.Data, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (reports *Reports) saveState(ctx context.Context, s *state) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	_, err = reports.kvs.Put(ctx, stateKey, "", data, -1)
+	return err
+}
+
+// Run generates the report, stores it, and sends it by email and/or to the webhook (if configured)
+func (reports *Reports) Run(ctx context.Context) (*Report, error) {
+	report, err := reports.Generate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	js, err := json.Marshal(report)
+	if err != nil {
+		return nil, err
+	}
+	doc := map[string]interface{}{}
+	if err := json.Unmarshal(js, &doc); err != nil {
+		return nil, err
+	}
+	if _, err := reports.ds.Insert(Collection, doc); err != nil {
+		return nil, err
+	}
+	reports.log.Info("report generated", "bytes_added", report.BytesAdded, "blobs_added", report.BlobsAdded)
+
+	if reports.conf == nil {
+		return report, nil
+	}
+	if len(reports.conf.Email) > 0 {
+		if err := notify.Email(reports.conf.Email, "[BlobStash] report for "+report.PeriodEnd[:10], report.Text()); err != nil {
+			reports.log.Error("failed to email the report", "err", err)
+		}
+	}
+	if reports.conf.Webhook != "" {
+		if err := reports.postWebhook(js); err != nil {
+			reports.log.Error("failed to send the report to the webhook", "err", err)
+		}
+	}
+	return report, nil
+}
+
+func (reports *Reports) postWebhook(js []byte) error {
+	resp, err := reports.client.Post(reports.conf.Webhook, "application/json", bytes.NewReader(js))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Text returns the plain text version of the report (for the emails)
+func (r *Report) Text() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "BlobStash report from %s to %s\n\n", r.PeriodStart, r.PeriodEnd)
+	fmt.Fprintf(&b, "Blobs: %d (%s), %d added (%s)\n", r.BlobsCount, humanize.Bytes(uint64(r.BlobsSize)), r.BlobsAdded, signedBytes(r.BytesAdded))
+	fmt.Fprintf(&b, "Deduplication: %s saved (ratio %.2f)\n", humanize.Bytes(uint64(r.DedupSaved)), r.DedupRatio)
+	b.WriteString("\nTop-growing FS:\n")
+	for _, g := range r.TopFS {
+		fmt.Fprintf(&b, "  %s: %s (%s)\n", g.Name, humanize.Bytes(uint64(g.Size)), signedBytes(g.Growth))
+	}
+	b.WriteString("\nTop-growing collections:\n")
+	for _, g := range r.TopCollections {
+		fmt.Fprintf(&b, "  %s: %d docs (%+d)\n", g.Name, g.Size, g.Growth)
+	}
+	b.WriteString("\nSync: ")
+	if r.Sync.LastSync != "" {
+		fmt.Fprintf(&b, "last sync %s (%s ago)\n", r.Sync.LastSync, r.Sync.LastSyncAge)
+	} else {
+		b.WriteString("never synced\n")
+	}
+	return b.String()
+}
+
+func signedBytes(n int64) string {
+	if n < 0 {
+		return "-" + humanize.Bytes(uint64(-n))
+	}
+	return "+" + humanize.Bytes(uint64(n))
+}
+
+// Register registers the reports endpoint (`POST` generates a report right away)
+func (reports *Reports) Register(r *mux.Router, basicAuth func(http.Handler) http.Handler) {
+	r.Handle("/", basicAuth(http.HandlerFunc(reports.reportsHandler())))
+}
+
+func (reports *Reports) reportsHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Admin, perms.Config),
+			perms.Resource(perms.Server, perms.Config),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+		switch r.Method {
+		case "POST":
+			report, err := reports.Run(r.Context())
+			if err != nil {
+				panic(err)
+			}
+			httputil.MarshalAndWrite(r, w, report)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package reports_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/reports"
+	"a4.io/blobstash/pkg/testutil"
+)
+
+func TestReports(t *testing.T) {
+	webhook := make(chan []byte, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		webhook <- data
+	}))
+	defer hook.Close()
+
+	srv := testutil.NewServer(t, func(conf *config.Config) {
+		conf.Reports = &config.Reports{Top: 1, Webhook: hook.URL}
+	})
+	defer srv.Close()
+
+	do := func(method, path, body string) *http.Response {
+		t.Helper()
+		resp, err := srv.Do(method, path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+			t.Fatalf("%s %s: unexpected status %d", method, path, resp.StatusCode)
+		}
+		return resp
+	}
+	run := func() *reports.Report {
+		t.Helper()
+		resp := do("POST", "/api/admin/reports/", "")
+		defer resp.Body.Close()
+		report := &reports.Report{}
+		if err := json.NewDecoder(resp.Body).Decode(report); err != nil {
+			t.Fatal(err)
+		}
+		return report
+	}
+
+	do("POST", "/api/filetree/fs/fs/small/_append?path=a.txt", "hello").Body.Close()
+	do("POST", "/api/filetree/fs/fs/big/_append?path=a.txt", "hello world!").Body.Close()
+	do("POST", "/api/docstore/notes", `{"title": "hello"}`).Body.Close()
+
+	report := run()
+	if report.BlobsAdded == 0 || report.BytesAdded <= 0 {
+		t.Errorf("expected added blobs, got %+v", report)
+	}
+	if len(report.TopFS) != 1 || report.TopFS[0].Name != "big" || report.TopFS[0].Growth != 12 {
+		t.Errorf("unexpected top FS %+v", report.TopFS)
+	}
+	if len(report.TopCollections) != 1 || report.TopCollections[0].Name != "notes" || report.TopCollections[0].Growth != 1 {
+		t.Errorf("unexpected top collections %+v", report.TopCollections)
+	}
+	select {
+	case data := <-webhook:
+		hooked := &reports.Report{}
+		if err := json.Unmarshal(data, hooked); err != nil {
+			t.Fatal(err)
+		}
+		if hooked.CreatedAt != report.CreatedAt {
+			t.Errorf("unexpected webhook payload %s", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the webhook was not called")
+	}
+
+	// The next report only covers the new data (only the meta blobs of the first stored report)
+	srv.Clock.Add(8 * 24 * time.Hour)
+	previous := report
+	report = run()
+	<-webhook
+	if report.BlobsAdded >= previous.BlobsAdded || report.BlobsCount != previous.BlobsCount+report.BlobsAdded {
+		t.Errorf("unexpected added blobs, got %+v", report)
+	}
+	if len(report.TopFS) != 1 || report.TopFS[0].Growth != 0 || report.TopFS[0].Size != 12 {
+		t.Errorf("unexpected top FS %+v", report.TopFS)
+	}
+	if len(report.TopCollections) != 1 || report.TopCollections[0].Growth != 0 {
+		t.Errorf("unexpected top collections %+v", report.TopCollections)
+	}
+
+	// The reports are stored in the docstore
+	resp := do("GET", "/api/docstore/"+reports.Collection, "")
+	defer resp.Body.Close()
+	res := map[string]interface{}{}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := res["data"].([]interface{}); len(data) != 2 {
+		t.Errorf("expected 2 stored reports, got %+v", res)
+	}
+}
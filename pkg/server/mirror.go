@@ -0,0 +1,45 @@
+package server // import "a4.io/blobstash/pkg/server"
+
+import (
+	"net/http"
+
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/blobstore"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/perms"
+)
+
+// mirrorHandler runs the mirror consistency check (`?verify=1` to also read back and verify every blob)
+func (s *Server) mirrorHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Admin, perms.Config),
+			perms.Resource(perms.Server, perms.Config),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+		if r.Method != "GET" && r.Method != "HEAD" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		q := httputil.NewQuery(r.URL.Query())
+		verify, err := q.GetBoolDefault("verify", false)
+		if err != nil {
+			httputil.WriteJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		report, err := s.blobstore.MirrorCheck(r.Context(), verify)
+		switch err {
+		case nil:
+		case blobstore.ErrMirrorDisabled:
+			httputil.WriteJSONError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		default:
+			panic(err)
+		}
+		httputil.MarshalAndWrite(r, w, report)
+	}
+}
@@ -0,0 +1,124 @@
+package server // import "a4.io/blobstash/pkg/server"
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/mode"
+	"a4.io/blobstash/pkg/notify"
+	"a4.io/blobstash/pkg/perms"
+	"a4.io/blobstash/pkg/signing"
+	"a4.io/blobstash/pkg/throttle"
+	"a4.io/blobstash/pkg/worm"
+)
+
+// Reload re-reads the config file and applies the reloadable items (auth/roles, apps, replication peer and
+// sharing links TTL), the blob backends and the indexes are not re-opened. All the items are loaded before being
+// applied, the running config is left untouched if any of them fails.
+func (s *Server) Reload() error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	path := s.conf.Path()
+	if path == "" {
+		return errors.New("config was not loaded from a file")
+	}
+	conf, err := config.New(path)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %v", err)
+	}
+	if err := conf.Init(); err != nil {
+		return fmt.Errorf("invalid config: %v", err)
+	}
+
+	// Items that cannot be updated on the fly
+	for item, changed := range map[string]bool{
+		"listen":             conf.Listen != s.conf.Listen,
+		"data_dir":           conf.DataDir != s.conf.DataDir,
+		"tls_auto":           conf.AutoTLS != s.conf.AutoTLS,
+		"tls_domains":        !reflect.DeepEqual(conf.Domains, s.conf.Domains),
+		"s3_replication":     !reflect.DeepEqual(conf.S3Repl, s.conf.S3Repl),
+		"remote_replication": !reflect.DeepEqual(conf.RemoteRepl, s.conf.RemoteRepl),
+		"replication":        !reflect.DeepEqual(conf.Replication, s.conf.Replication),
+		"replicate_from":     (conf.ReplicateFrom == nil) != (s.conf.ReplicateFrom == nil),
+		"auth (enabling)":    (len(conf.Auth) == 0) != (len(s.conf.Auth) == 0),
+		"sharing_key":        conf.SharingKey != s.conf.SharingKey,
+		"secret_key":         conf.SecretKey != s.conf.SecretKey,
+		"exports":            !reflect.DeepEqual(conf.Exports, s.conf.Exports),
+		"scrub":              !reflect.DeepEqual(conf.Scrub, s.conf.Scrub),
+		"filetree":           !reflect.DeepEqual(conf.Filetree, s.conf.Filetree),
+		"cors":               !reflect.DeepEqual(conf.CORS, s.conf.CORS),
+		"http":               !reflect.DeepEqual(conf.HTTP, s.conf.HTTP),
+		"tls_dns":            !reflect.DeepEqual(conf.TLSDNS, s.conf.TLSDNS),
+	} {
+		if changed {
+			s.log.Warn("config item changed, a restart is needed to apply it", "item", item)
+		}
+	}
+
+	// Load/validate everything before applying anything, so a bad config leaves the running one untouched
+	applyAuth, err := auth.Load(conf, s.log.New("app", "perms"))
+	if err != nil {
+		return fmt.Errorf("failed to reload auth: %v", err)
+	}
+	if conf.Mode != "" && !mode.Valid(conf.Mode) {
+		return fmt.Errorf("invalid mode %q", conf.Mode)
+	}
+	applySigning, err := signing.Load(conf.Signing)
+	if err != nil {
+		return fmt.Errorf("failed to reload signing: %v", err)
+	}
+	// The apps are either all swapped or left untouched
+	if err := s.apps.Reload(conf); err != nil {
+		return err
+	}
+
+	applyAuth()
+	// Only update the mode if it was changed in the config (it may have been toggled using the API)
+	if conf.Mode != s.conf.Mode {
+		// Cannot fail as the mode was validated above
+		mode.Set(conf.Mode, "config")
+	}
+	throttle.Setup(conf.Throttle)
+	applySigning()
+	worm.Setup(conf.WORM)
+	notify.Setup(conf.Notify)
+	s.filetree.SetShareTTL(conf.SharingTTL())
+	if s.replication != nil && conf.ReplicateFrom != nil {
+		s.replication.Reload(conf.ReplicateFrom)
+	}
+	s.conf = conf
+
+	s.log.Info("config reloaded", "path", path)
+	return nil
+}
+
+func (s *Server) reloadHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			if !auth.Can(
+				w,
+				r,
+				perms.Action(perms.Admin, perms.Config),
+				perms.Resource(perms.Server, perms.Config),
+			) {
+				auth.Forbidden(w)
+				return
+			}
+			if err := s.Reload(); err != nil {
+				s.log.Error("failed to reload config", "err", err)
+				httputil.WriteJSONError(w, http.StatusUnprocessableEntity, err.Error())
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
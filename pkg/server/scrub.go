@@ -0,0 +1,103 @@
+package server // import "a4.io/blobstash/pkg/server"
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/blobstore"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/notify"
+	"a4.io/blobstash/pkg/perms"
+)
+
+// startScrub runs a scrub in the background (tracked by the lifecycle manager)
+func (s *Server) startScrub() {
+	s.lc.Go("blobstore-scrub", func(ctx context.Context) {
+		err := s.blobstore.Scrub(ctx)
+		switch err {
+		case context.Canceled, blobstore.ErrScrubRunning:
+			return
+		case nil:
+		default:
+			s.log.Error("scrub failed", "err", err)
+		}
+		if err := s.notifyScrub(err); err != nil {
+			s.log.Error("failed to send the scrub notification", "err", err)
+		}
+	})
+}
+
+// notifyScrub sends the scrub notification if the scrub failed or found corrupted blobs
+func (s *Server) notifyScrub(scrubErr error) error {
+	if scrubErr != nil {
+		return notify.Notify(notify.Scrub, "scrub failed", fmt.Sprintf("The scrub failed: %v\n", scrubErr))
+	}
+	report, err := s.blobstore.ScrubReport()
+	if err != nil {
+		return err
+	}
+	if report.Failed == 0 {
+		return nil
+	}
+	var body strings.Builder
+	fmt.Fprintf(&body, "%d blobs checked, %d corrupted, %d repaired, %d served from the S3 replica.\n\n", report.Checked,
+		report.Failed, report.Repaired, report.FromReplica)
+	for _, f := range report.Findings {
+		fmt.Fprintf(&body, "%s: %s", f.Hash, f.Error)
+		if f.RepairedFrom != "" {
+			fmt.Fprintf(&body, " (repaired from %s)", f.RepairedFrom)
+		}
+		if f.ServedFromReplica {
+			body.WriteString(" (not repaired, served from the S3 replica)")
+		}
+		body.WriteString("\n")
+	}
+	return notify.Notify(notify.Scrub, fmt.Sprintf("scrub found %d corrupted blobs", report.Failed), body.String())
+}
+
+func (s *Server) scrubHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Admin, perms.Config),
+			perms.Resource(perms.Server, perms.Config),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+		switch r.Method {
+		case "GET", "HEAD":
+			report, err := s.blobstore.ScrubReport()
+			switch err {
+			case nil:
+			case blobstore.ErrScrubDisabled:
+				httputil.WriteJSONError(w, http.StatusUnprocessableEntity, err.Error())
+				return
+			default:
+				panic(err)
+			}
+			httputil.MarshalAndWrite(r, w, report)
+		case "POST":
+			report, err := s.blobstore.ScrubReport()
+			if err == blobstore.ErrScrubDisabled {
+				httputil.WriteJSONError(w, http.StatusUnprocessableEntity, err.Error())
+				return
+			}
+			if err != nil {
+				panic(err)
+			}
+			if report.Running {
+				httputil.WriteJSONError(w, http.StatusConflict, blobstore.ErrScrubRunning.Error())
+				return
+			}
+			s.startScrub()
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
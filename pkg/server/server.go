@@ -2,10 +2,12 @@ package server // import "a4.io/blobstash/pkg/server"
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"expvar"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -14,30 +16,50 @@ import (
 	"syscall"
 	"time"
 
+	"a4.io/blobstash/pkg/admin"
 	"a4.io/blobstash/pkg/apps"
 	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/backup"
 	"a4.io/blobstash/pkg/blobstore"
 	blobStoreAPI "a4.io/blobstash/pkg/blobstore/api"
 	"a4.io/blobstash/pkg/capabilities"
+	"a4.io/blobstash/pkg/clock"
 	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/dns01"
 	"a4.io/blobstash/pkg/docstore"
 	docstoreLua "a4.io/blobstash/pkg/docstore/lua"
 	"a4.io/blobstash/pkg/expvarserver"
 	"a4.io/blobstash/pkg/filetree"
+	"a4.io/blobstash/pkg/hashutil"
+	"a4.io/blobstash/pkg/health"
 	"a4.io/blobstash/pkg/httputil"
 	"a4.io/blobstash/pkg/hub"
+	"a4.io/blobstash/pkg/isolation"
 	"a4.io/blobstash/pkg/js"
 	"a4.io/blobstash/pkg/kvstore"
 	kvStoreAPI "a4.io/blobstash/pkg/kvstore/api"
+	"a4.io/blobstash/pkg/lifecycle"
 	"a4.io/blobstash/pkg/meta"
 	"a4.io/blobstash/pkg/middleware"
+	"a4.io/blobstash/pkg/migration"
+	"a4.io/blobstash/pkg/mode"
+	"a4.io/blobstash/pkg/notify"
 	"a4.io/blobstash/pkg/oplog"
+	"a4.io/blobstash/pkg/rangedb"
 	"a4.io/blobstash/pkg/replication"
+	"a4.io/blobstash/pkg/reports"
 	"a4.io/blobstash/pkg/session"
+	"a4.io/blobstash/pkg/signing"
+	"a4.io/blobstash/pkg/snapshots"
 	"a4.io/blobstash/pkg/stash"
 	stashAPI "a4.io/blobstash/pkg/stash/api"
 	synctable "a4.io/blobstash/pkg/sync"
+	"a4.io/blobstash/pkg/tenant"
+	"a4.io/blobstash/pkg/throttle"
+	"a4.io/blobstash/pkg/trace"
+	"a4.io/blobstash/pkg/warmup"
 	"a4.io/blobstash/pkg/webauthn"
+	"a4.io/blobstash/pkg/worm"
 	gcontext "github.com/gorilla/context"
 
 	"golang.org/x/crypto/acme/autocert"
@@ -46,6 +68,7 @@ import (
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	log "github.com/inconshreveable/log15"
+	"github.com/robfig/cron"
 	lua "github.com/yuin/gopher-lua"
 )
 
@@ -68,10 +91,26 @@ type Server struct {
 	closeFunc func() error
 
 	blobstore *blobstore.BlobStore
+	expiry    *rangedb.ExpirationIndex
+
+	// Modules updated on config reload
+	apps        *apps.Apps
+	filetree    *filetree.FileTree
+	replication *replication.Replication
+	reloadMu    sync.Mutex
 
 	hostWhitelist map[string]bool
+	hostMu        sync.Mutex
 	shutdown      chan struct{}
-	wg            *sync.WaitGroup
+	lc            *lifecycle.Lifecycle
+	isolation     *isolation.Isolation
+}
+
+// moduleRouter returns a subrouter for the given module, the module panics are isolated from the other modules
+func (s *Server) moduleRouter(name, prefix string) *mux.Router {
+	r := s.router.PathPrefix(prefix).Subrouter()
+	r.Use(s.isolation.Module(name).Middleware)
+	return r
 }
 
 func New(conf *config.Config) (*Server, error) {
@@ -81,21 +120,51 @@ func New(conf *config.Config) (*Server, error) {
 	if err := auth.Setup(conf, logger.New("app", "perms")); err != nil {
 		return nil, fmt.Errorf("failed to setup auth: %v", err)
 	}
+	throttle.Setup(conf.Throttle)
+	hashutil.SetDefault(conf.HashAlg())
+	if err := signing.Setup(conf.Signing); err != nil {
+		return nil, fmt.Errorf("failed to setup signing: %v", err)
+	}
+	worm.Setup(conf.WORM)
+	notify.Setup(conf.Notify)
 	logger.SetHandler(log.LvlFilterHandler(conf.LogLvl(), log.StreamHandler(os.Stdout, log.LogfmtFormat())))
-	var wg sync.WaitGroup
+	if err := trace.Setup(logger.New("app", "trace"), conf); err != nil {
+		return nil, fmt.Errorf("failed to setup tracing: %v", err)
+	}
+	lc := lifecycle.New(logger.New("app", "lifecycle"))
+	if err := mode.Set(conf.Mode, "config"); err != nil {
+		return nil, err
+	}
 
 	sess := session.New(conf)
 
+	// Recover the panics per module (a crashing module is disabled without affecting the other ones)
+	iso := isolation.New(logger.New("app", "isolation"))
+	lc.SetPanicHandler(iso.RecordTask)
+
 	s := &Server{
+		isolation:     iso,
 		router:        mux.NewRouter().StrictSlash(true),
 		conf:          conf,
 		hostWhitelist: map[string]bool{},
 		log:           logger,
-		wg:            &wg,
-		shutdown:      make(chan struct{}),
+		lc:            lc,
+		shutdown:      make(chan struct{}, 1),
 	}
 	authFunc, basicAuth := middleware.NewBasicAuth(conf)
 	s.router.Handle("/api/ping", basicAuth(http.HandlerFunc(pingHandler)))
+	s.router.Handle("/api/admin/reload", basicAuth(http.HandlerFunc(s.reloadHandler())))
+	s.router.Handle("/api/admin/mode", basicAuth(http.HandlerFunc(mode.Handler())))
+	s.router.Handle("/api/admin/modules", basicAuth(http.HandlerFunc(iso.Handler())))
+
+	// Heavy modules are initialized in the background
+	wu := warmup.New(logger.New("app", "warmup"))
+	wu.Register(s.router.PathPrefix("/api/warmup").Subrouter(), basicAuth)
+
+	// Upgrade the data directory schema if needed (before opening anything)
+	if err := migration.Run(logger.New("app", "migration"), conf.VarDir()); err != nil {
+		return nil, fmt.Errorf("failed to migrate the data directory: %v", err)
+	}
 
 	hub := hub.New(logger.New("app", "hub"), true)
 	// Load the blobstore
@@ -128,11 +197,17 @@ func New(conf *config.Config) (*Server, error) {
 		bs["blobs_size_human"] = humanize.Bytes(uint64(bstats.BlobsSize))
 		bs["blobs_blobsfile_volumes"] = bstats.BlobsFilesCount
 
+		details, err := s.blobstore.DetailedStats()
+		if err != nil {
+			panic(err)
+		}
+
 		// return newRev.Version, nil
 		httputil.MarshalAndWrite(r, w, map[string]interface{}{
-			"s3":         stats,
-			"started_at": start.Format(time.RFC3339),
-			"blobstore":  bs,
+			"s3":                stats,
+			"started_at":        start.Format(time.RFC3339),
+			"blobstore":         bs,
+			"blobstore_details": details,
 		})
 
 	})))
@@ -148,13 +223,16 @@ func New(conf *config.Config) (*Server, error) {
 		if err != nil {
 			return nil, fmt.Errorf("failed to initialize oplog: %v", err)
 		}
-		oplg.Register(s.router.PathPrefix("/_oplog").Subrouter(), basicAuth)
+		oplg.Register(s.moduleRouter("oplog", "/_oplog"), basicAuth)
 	}
 	// Load the kvstore
 	rootKvstore, err := kvstore.New(logger.New("app", "kvstore"), conf.VarDir(), rootBlobstore, metaHandler)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize kvstore app: %v", err)
 	}
+	if interval := conf.KvCheckpoints(); interval > 0 {
+		rootKvstore.EnableCheckpoints(interval)
+	}
 
 	// Now load the stash manager
 	// func New(dir string, m *meta.Meta, bs *blobstore.BlobStore, kvs *kvstore.KvStore, h *hub.Hub, l log.Logger) (*Stash, error) {
@@ -162,40 +240,132 @@ func New(conf *config.Config) (*Server, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize the stash manager: %v", err)
 	}
-	stashAPI.New(cstash, hub).Register(s.router.PathPrefix("/api/stash").Subrouter(), basicAuth)
+	rootBlobstore.SetNamespacesStatsFunc(cstash.NamespacesStats)
+	cstash.SetIsolated(tenant.Isolated(conf))
+	stashAPI.New(cstash, hub).Register(s.moduleRouter("stash", "/api/stash"), basicAuth)
 
 	blobstore := cstash.BlobStore()
 	// FIXME(tsileo): test the stash with kvstore
 	//kvstore := rootKvstore
 	kvstore := cstash.KvStore()
 
-	kvStoreAPI.New(kvstore).Register(s.router.PathPrefix("/api/kvstore").Subrouter(), basicAuth)
+	// Expiration index shared by the kv TTLs, the docstore TTL collections and the filetree trash
+	expiry, err := rangedb.NewExpirationIndex(logger.New("app", "expiry"), filepath.Join(conf.VarDir(), "expiry.index"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize the expiration index: %v", err)
+	}
+
+	s.expiry = expiry
+	kvStoreAPI.New(kvstore, expiry).Register(s.moduleRouter("kvstore", "/api/kvstore"), basicAuth)
 	// FIXME(tsileo): handle middleware in the `Register` interface
-	blobStoreAPI.New(blobstore).Register(s.router.PathPrefix("/api/blobstore").Subrouter(), basicAuth)
+	blobStoreAPI.New(blobstore, rootBlobstore).Register(s.moduleRouter("blobstore", "/api/blobstore"), basicAuth)
 
 	// Load the synctable
 	// XXX(tsileo): sync should always get the root data context
 	synctable := synctable.New(logger.New("app", "sync"), conf, rootBlobstore)
-	synctable.Register(s.router.PathPrefix("/api/sync").Subrouter(), basicAuth)
+	synctable.Register(s.moduleRouter("sync", "/api/sync"), basicAuth)
 
 	// Enable replication if set in the config
 	if conf.ReplicateFrom != nil {
-		if _, err := replication.New(logger.New("app", "replication"), conf, rootBlobstore, synctable, &wg); err != nil {
+		s.replication, err = replication.New(logger.New("app", "replication"), conf, rootBlobstore, synctable, lc)
+		if err != nil {
 			return nil, fmt.Errorf("failed to initialize replication app: %v", err)
 		}
 	}
 
-	filetree, err := filetree.New(logger.New("app", "filetree"), conf, authFunc, kvstore, blobstore, hub)
+	// Liveness/readiness probes
+	hc := health.New(logger.New("app", "health"))
+	hc.AddCheck("blobstore", func() (map[string]interface{}, error) {
+		bstats, err := rootBlobstore.Stats()
+		if err != nil {
+			return nil, err
+		}
+		dedupCount, dedupSize := rootBlobstore.DedupStats()
+		return map[string]interface{}{
+			"blobs_count":             bstats.BlobsCount,
+			"blobs_blobsfile_volumes": bstats.BlobsFilesCount,
+			"deduped_writes_count":    dedupCount,
+			"deduped_writes_size":     dedupSize,
+		}, nil
+	})
+	hc.AddCheck("warmup", func() (map[string]interface{}, error) {
+		details := map[string]interface{}{}
+		for _, status := range wu.Statuses() {
+			details[status.Name] = status.State
+		}
+		if !wu.AllReady() {
+			return details, errors.New("modules still warming up")
+		}
+		return details, nil
+	})
+	if rootBlobstore.ReadCacheStats() != nil {
+		hc.AddCheck("blob_cache", func() (map[string]interface{}, error) {
+			cstats := rootBlobstore.ReadCacheStats()
+			return map[string]interface{}{
+				"hits":        cstats.Hits,
+				"misses":      cstats.Misses,
+				"evictions":   cstats.Evictions,
+				"size":        cstats.Size,
+				"max_size":    cstats.MaxSize,
+				"blobs_count": cstats.Blobs,
+			}, nil
+		})
+	}
+	if rootBlobstore.ReplicationEnabled() {
+		hc.AddCheck("s3_replication", func() (map[string]interface{}, error) {
+			return rootBlobstore.S3Stats()
+		})
+	}
+	if remoteBack := rootBlobstore.RemoteBackend(); remoteBack != nil {
+		hc.AddCheck("remote_replication", func() (map[string]interface{}, error) {
+			stats, err := remoteBack.Stats()
+			if err != nil {
+				return nil, err
+			}
+			return map[string]interface{}{
+				"blobs_waiting":      stats.BlobsWaiting,
+				"oldest_waiting_age": stats.OldestWaitingAge,
+				"failures":           stats.Failures,
+				"last_error":         stats.LastError,
+			}, nil
+		})
+	}
+	if conf.ReplicateFrom != nil {
+		hc.AddCheck("sync", func() (map[string]interface{}, error) {
+			lastSync := synctable.LastSync()
+			if lastSync.IsZero() {
+				return nil, errors.New("no successful sync yet")
+			}
+			return map[string]interface{}{
+				"last_sync":     lastSync.Format(time.RFC3339),
+				"last_sync_age": time.Since(lastSync).String(),
+			}, nil
+		})
+	}
+	hc.Register(s.router, basicAuth)
+
+	filetree, err := filetree.New(logger.New("app", "filetree"), conf, authFunc, kvstore, blobstore, hub, expiry)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize filetree app: %v", err)
 	}
-	filetree.Register(s.router.PathPrefix("/api/filetree").Subrouter(), s.router, basicAuth)
+	filetree.Register(s.moduleRouter("filetree", "/api/filetree"), s.router, basicAuth)
+	rootBlobstore.SetColdGroupsFuncs(cstash.NamespacesBlobStores, filetree.FSBlobs)
+	cstash.SetKvWriteCheck(filetree.CheckKvWrite)
+	s.filetree = filetree
+	s.whitelistHosts(filetree.SitesDomains()...)
 
-	docstore, err := docstore.New(logger.New("app", "docstore"), conf, kvstore, blobstore, filetree)
+	docstore, err := docstore.New(logger.New("app", "docstore"), conf, kvstore, blobstore, filetree, wu, expiry)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize docstore app: %v", err)
 	}
-	docstore.Register(s.router.PathPrefix("/api/docstore").Subrouter(), basicAuth)
+	docstore.Register(s.moduleRouter("docstore", "/api/docstore"), basicAuth)
+
+	snaps, err := snapshots.New(logger.New("app", "snapshots"), conf, kvstore, blobstore, filetree, lc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize snapshots: %v", err)
+	}
+	snaps.Register(s.moduleRouter("snapshots", "/api/snapshots"), basicAuth)
+	signing.NewAPI(kvstore).Register(s.moduleRouter("signing", "/api/signing"), basicAuth)
 
 	// Load the Lua config
 	if _, err := os.Stat("blobstash.lua"); err == nil {
@@ -220,12 +390,14 @@ func New(conf *config.Config) (*Server, error) {
 	if err != nil {
 		return nil, err
 	}
+	wa.Register(s.moduleRouter("webauthn", "/api/webauthn"), basicAuth)
 
-	apps, err := apps.New(logger.New("app", "apps"), conf, sess, wa, rootBlobstore, kvstore, filetree, docstore, hub, s.whitelistHosts)
+	apps, err := apps.New(logger.New("app", "apps"), conf, sess, wa, rootBlobstore, kvstore, filetree, docstore, hub, wu, s.whitelistHosts)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize filetree app: %v", err)
 	}
-	apps.Register(s.router.PathPrefix("/api/apps").Subrouter(), s.router, basicAuth)
+	apps.Register(s.moduleRouter("apps", "/api/apps"), s.router, basicAuth)
+	s.apps = apps
 
 	js.Register(s.router.PathPrefix("/js").Subrouter(), basicAuth)
 
@@ -233,13 +405,84 @@ func New(conf *config.Config) (*Server, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize caps app: %v", err)
 	}
-	caps.Register(s.router.PathPrefix("/api/capabilities").Subrouter(), basicAuth)
+	caps.Register(s.moduleRouter("capabilities", "/api/capabilities"), basicAuth)
+
+	// Incremental exports (scheduled)
+	exports, err := backup.NewExports(logger.New("app", "exports"), conf, rootBlobstore, lc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize exports: %v", err)
+	}
+	exports.Register(s.moduleRouter("exports", "/api/admin/exports"), basicAuth)
+
+	// Blob integrity scrubber
+	s.router.Handle("/api/admin/scrub", basicAuth(http.HandlerFunc(s.scrubHandler())))
+	s.router.Handle("/api/admin/mirror", basicAuth(http.HandlerFunc(s.mirrorHandler())))
+	scrubCron := cron.New()
+	if conf.Scrub != nil && conf.Scrub.Schedule != "" {
+		if err := scrubCron.AddFunc(conf.Scrub.Schedule, s.startScrub); err != nil {
+			return nil, fmt.Errorf("invalid scrub schedule: %v", err)
+		}
+	}
+	scrubCron.Start()
+
+	// Scheduled FS materializations
+	materializeCron := cron.New()
+	if conf.Filetree != nil {
+		for _, m := range conf.Filetree.Materialize {
+			m := m
+			if err := materializeCron.AddFunc(m.Schedule, func() {
+				lc.Go("filetree-materialize", func(ctx context.Context) {
+					if _, err := filetree.Materialize(ctx, m.FS, m.Dir, m.Keep); err != nil && err != context.Canceled {
+						logger.Error("materialize failed", "fs", m.FS, "dir", m.Dir, "err", err)
+					}
+				})
+			}); err != nil {
+				return nil, fmt.Errorf("invalid materialize schedule for %q: %v", m.FS, err)
+			}
+		}
+	}
+	materializeCron.Start()
+
+	// Storage growth and activity reports
+	reps, err := reports.New(logger.New("app", "reports"), conf, kvstore, rootBlobstore, filetree, docstore, synctable.LastSync, lc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize reports: %v", err)
+	}
+	reps.Register(s.moduleRouter("reports", "/api/admin/reports"), basicAuth)
+
+	// Admin web UI (and its JSON APIs)
+	admin.New(logger.New("app", "admin"), rootBlobstore, filetree, apps, synctable.LastSync).Register(s.moduleRouter("admin", "/api/admin"), s.router, basicAuth)
+
+	// Now that all the core routes are registered, check the apps custom routes
+	if err := apps.CheckRoutes(); err != nil {
+		return nil, err
+	}
+
+	expiry.Start(1 * time.Minute)
 
 	// Setup the closeFunc
 	s.closeFunc = func() error {
-		logger.Debug("waiting for the waitgroup...")
-		wg.Wait()
-		logger.Debug("waitgroup done")
+		scrubCron.Stop()
+		materializeCron.Stop()
+		if err := reps.Close(); err != nil {
+			return err
+		}
+		if err := snaps.Close(); err != nil {
+			return err
+		}
+		if err := expiry.Close(); err != nil {
+			return err
+		}
+		logger.Debug("expiration index closed")
+		logger.Debug("waiting for the background tasks...")
+		if err := lc.Shutdown(conf.GracePeriod()); err != nil {
+			logger.Error("background tasks not done", "err", err)
+		}
+		logger.Debug("background tasks done")
+		if err := exports.Close(); err != nil {
+			return err
+		}
+		logger.Debug("exports closed")
 		if err := filetree.Close(); err != nil {
 			return err
 		}
@@ -264,14 +507,21 @@ func New(conf *config.Config) (*Server, error) {
 			return err
 		}
 		logger.Debug("root bs closed")
+		if err := trace.Close(); err != nil {
+			return err
+		}
 		return nil
 	}
 	return s, nil
 }
 
+// Shutdown triggers a graceful shutdown
 func (s *Server) Shutdown() {
-	s.shutdown <- struct{}{}
-	// TODO(tsileo) shotdown sync repl too
+	select {
+	case s.shutdown <- struct{}{}:
+	default:
+		// A shutdown is already in progress
+	}
 }
 
 func (s *Server) Bootstrap() error {
@@ -290,6 +540,15 @@ func (s *Server) Bootstrap() error {
 			return err
 		}
 	}
+	if s.conf.RemoteRestoreMode {
+		remoteBack := s.blobstore.RemoteBackend()
+		if remoteBack == nil {
+			return fmt.Errorf("remote replication is not enabled")
+		}
+		if _, err := remoteBack.Restore(context.Background(), true); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
@@ -297,6 +556,8 @@ func (s *Server) Bootstrap() error {
 func (s *Server) hostPolicy(hosts ...string) autocert.HostPolicy {
 	s.whitelistHosts(hosts...)
 	return func(_ context.Context, host string) error {
+		s.hostMu.Lock()
+		defer s.hostMu.Unlock()
 		if !s.hostWhitelist[host] {
 			return errors.New("blobstash: tls host not configured")
 		}
@@ -305,15 +566,32 @@ func (s *Server) hostPolicy(hosts ...string) autocert.HostPolicy {
 }
 
 func (s *Server) whitelistHosts(hosts ...string) {
+	s.hostMu.Lock()
+	defer s.hostMu.Unlock()
 	for _, h := range hosts {
 		s.hostWhitelist[h] = true
 	}
 }
 
-func (s *Server) Serve() error {
+// Handler returns the HTTP handler serving the API (with all the middlewares)
+func (s *Server) Handler() http.Handler {
 	reqLogger := httputil.LoggerMiddleware(s.log)
 	expvarMiddleare := httputil.ExpvarsMiddleware(serverCounters)
-	h := httputil.RecoverHandler(middleware.CorsMiddleware(reqLogger(expvarMiddleare(middleware.Secure(s.router)))))
+	return httputil.RecoverHandler(middleware.Cors(s.conf.CORS)(reqLogger(expvarMiddleare(trace.Middleware(mode.Middleware(middleware.Secure(s.router)))))))
+}
+
+// Expire runs the pending expirations (kv TTLs, docstore TTLs and trash purges) without waiting for the background worker
+func (s *Server) Expire() error {
+	return s.expiry.Expire(clock.Now())
+}
+
+// Close stops the background tasks and closes the modules (for the servers not started with `Serve`)
+func (s *Server) Close() error {
+	return s.closeFunc()
+}
+
+func (s *Server) Serve() error {
+	h := s.Handler()
 	if s.conf.ExtraApacheCombinedLogs != "" {
 		s.log.Info(fmt.Sprintf("enabling apache logs to %s", s.conf.ExtraApacheCombinedLogs))
 		logFile, err := os.OpenFile(s.conf.ExtraApacheCombinedLogs, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
@@ -327,30 +605,93 @@ func (s *Server) Serve() error {
 	// ClearHandler from gorilla for the sessions
 	h = gcontext.ClearHandler(h)
 
-	go func() {
-		listen := config.DefaultListen
-		if s.conf.Listen != "" {
-			listen = s.conf.Listen
+	listen := config.DefaultListen
+	if s.conf.Listen != "" {
+		listen = s.conf.Listen
+	}
+	timeouts := s.conf.HTTP.Timeouts()
+	srv := &http.Server{
+		Addr:              listen,
+		Handler:           h,
+		ReadHeaderTimeout: timeouts.ReadHeader,
+		ReadTimeout:       timeouts.Read,
+		WriteTimeout:      timeouts.Write,
+		IdleTimeout:       timeouts.Idle,
+		MaxHeaderBytes:    s.conf.HTTP.MaxHeaderBytes,
+	}
+	srv.SetKeepAlivesEnabled(!s.conf.HTTP.DisableKeepAlives)
+	if s.conf.HTTP.DisableHTTP2 {
+		// A non-nil empty map disables the HTTP/2 support
+		srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
+	dns01Ctx, dns01Cancel := context.WithCancel(context.Background())
+	defer dns01Cancel()
+	if s.conf.AutoTLS {
+		cacheDir := autocert.DirCache(filepath.Join(s.conf.ConfigDir(), config.LetsEncryptDir))
+
+		m := autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: s.hostPolicy(s.conf.Domains...),
+			Cache:      cacheDir,
 		}
-		s.log.Info(fmt.Sprintf("listening on %v", listen))
-		if s.conf.AutoTLS {
-			cacheDir := autocert.DirCache(filepath.Join(s.conf.ConfigDir(), config.LetsEncryptDir))
+		srv.TLSConfig = m.TLSConfig()
 
-			m := autocert.Manager{
-				Prompt:     autocert.AcceptTOS,
-				HostPolicy: s.hostPolicy(s.conf.Domains...),
-				Cache:      cacheDir,
+		// The wildcard certificates (DNS-01 challenge) take precedence, the other hosts use the HTTP-01/TLS-ALPN-01
+		// challenges
+		if s.conf.TLSDNS != nil {
+			dm, err := dns01.New(s.log.New("app", "dns01"), s.conf.TLSDNS, cacheDir)
+			if err != nil {
+				s.closeFunc()
+				return err
 			}
-			s := &http.Server{
-				Addr:      listen,
-				Handler:   h,
-				TLSConfig: m.TLSConfig(),
+			go dm.Run(dns01Ctx)
+			srv.TLSConfig.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+				if cert := dm.GetCertificate(hello); cert != nil {
+					return cert, nil
+				}
+				return m.GetCertificate(hello)
 			}
-			s.ListenAndServeTLS("", "")
-		} else {
-			http.ListenAndServe(listen, h)
 		}
-	}()
+	}
+
+	// Listen on the unix socket only if `listen` is not explicitly set
+	listeners := []net.Listener{}
+	listenFailed := func(addr string, err error) error {
+		for _, ln := range listeners {
+			ln.Close()
+		}
+		s.closeFunc()
+		return fmt.Errorf("failed to listen on %s: %v", addr, err)
+	}
+	if sock := s.conf.HTTP.UnixSocket; sock != "" {
+		ln, err := listenUnix(sock, s.conf.HTTP.SocketMode())
+		if err != nil {
+			return listenFailed(sock, err)
+		}
+		listeners = append(listeners, ln)
+	}
+	if s.conf.HTTP.UnixSocket == "" || s.conf.Listen != "" {
+		ln, err := net.Listen("tcp", listen)
+		if err != nil {
+			return listenFailed(listen, err)
+		}
+		listeners = append(listeners, ln)
+	}
+	for _, ln := range listeners {
+		go func(ln net.Listener) {
+			s.log.Info(fmt.Sprintf("listening on %v", ln.Addr()))
+			var err error
+			if s.conf.AutoTLS && ln.Addr().Network() == "tcp" {
+				err = srv.ServeTLS(ln, "", "")
+			} else {
+				err = srv.Serve(ln)
+			}
+			if err != nil && err != http.ErrServerClosed {
+				s.log.Error("server failed", "err", err)
+				s.Shutdown()
+			}
+		}(ln)
+	}
 	if s.conf.ExpvarListen != "" {
 		go func() {
 			s.log.Info(fmt.Sprintf("enabling expvar server on %v", s.conf.ExpvarListen))
@@ -360,8 +701,41 @@ func (s *Server) Serve() error {
 		}()
 	}
 	s.tillShutdown()
+
+	// Stop accepting new requests and wait for the in-flight ones (uploads...)
+	grace := s.conf.GracePeriod()
+	s.log.Info("draining in-flight requests", "grace_period", grace)
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		s.log.Error("failed to drain in-flight requests", "err", err)
+	}
+
+	// Stop the background tasks and close the modules (flush the blobsfile, close the indexes)
 	return s.closeFunc()
-	// return http.ListenAndServe(":8051", s.router)
+}
+
+// listenUnix listens on the given unix socket (a stale socket file is removed first)
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		// Fails if another instance is still serving on the socket
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("socket %s already in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
 }
 
 func (s *Server) tillShutdown() {
@@ -370,11 +744,18 @@ func (s *Server) tillShutdown() {
 	signal.Notify(cs, os.Interrupt,
 		syscall.SIGINT,
 		syscall.SIGTERM,
-		syscall.SIGQUIT)
+		syscall.SIGQUIT,
+		syscall.SIGHUP)
 	for {
 		select {
 		case sig := <-cs:
 			s.log.Debug("captured signal", "signal", sig)
+			if sig == syscall.SIGHUP {
+				if err := s.Reload(); err != nil {
+					s.log.Error("failed to reload config", "err", err)
+				}
+				continue
+			}
 			s.log.Info("shutting down...")
 			return
 		case <-s.shutdown:
@@ -0,0 +1,63 @@
+package session // import "a4.io/blobstash/pkg/session"
+
+import (
+	"net/http"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// SetupLua exports the `session` module (flash messages and CSRF helpers) bound to the current request
+func (s *Session) SetupLua(L *lua.LState, w http.ResponseWriter, r *http.Request) {
+	L.PreloadModule("session", func(L *lua.LState) int {
+		mod := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+			"flash": func(L *lua.LState) int {
+				if err := s.AddFlash(w, r, L.OptString(2, "info"), L.CheckString(1)); err != nil {
+					panic(err)
+				}
+				return 0
+			},
+			"flashes": func(L *lua.LState) int {
+				flashes, err := s.Flashes(w, r)
+				if err != nil {
+					panic(err)
+				}
+				tbl := L.CreateTable(len(flashes), 0)
+				for _, f := range flashes {
+					tflash := L.CreateTable(0, 2)
+					tflash.RawSetString("category", lua.LString(f.Category))
+					tflash.RawSetString("message", lua.LString(f.Message))
+					tbl.Append(tflash)
+				}
+				L.Push(tbl)
+				return 1
+			},
+			"csrf_token": func(L *lua.LState) int {
+				token, err := s.CSRFToken(w, r)
+				if err != nil {
+					panic(err)
+				}
+				L.Push(lua.LString(token))
+				return 1
+			},
+			"csrf_field": func(L *lua.LState) int {
+				token, err := s.CSRFToken(w, r)
+				if err != nil {
+					panic(err)
+				}
+				L.Push(lua.LString(CSRFField(token)))
+				return 1
+			},
+			"check_csrf": func(L *lua.LState) int {
+				if err := s.ValidateCSRF(r); err != nil {
+					L.Push(lua.LFalse)
+					return 1
+				}
+				L.Push(lua.LTrue)
+				return 1
+			},
+		})
+		// returns the module
+		L.Push(mod)
+		return 1
+	})
+}
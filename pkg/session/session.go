@@ -1,10 +1,58 @@
 package session // import "a4.io/blobstash/pkg/session"
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+
 	"a4.io/blobstash/pkg/config"
 	"github.com/gorilla/sessions"
 )
 
+const (
+	// Name of the (signed) cookie session holding the flash messages and the CSRF token
+	appSessionName = "blobstash_app"
+
+	// CSRFFieldName is the name of the form field holding the CSRF token
+	CSRFFieldName = "csrf_token"
+
+	// CSRFHeaderName is the name of the header holding the CSRF token (for XHR requests)
+	CSRFHeaderName = "X-CSRF-Token"
+
+	csrfKey = "_csrf"
+
+	// Max size of the form body read when looking for the CSRF token
+	maxFormSize = 10 << 20
+
+	// Max size read from a multipart body when looking for the CSRF token (it must be the first part)
+	maxCSRFPartSize = 4 << 10
+)
+
+// ErrInvalidCSRFToken is returned when the CSRF token is missing or does not match the session
+var ErrInvalidCSRFToken = errors.New("invalid CSRF token")
+
+// Flash is a message stored in the session until it is displayed
+type Flash struct {
+	Category string
+	Message  string
+}
+
+func init() {
+	// Needed to store flashes in the cookie store
+	gob.Register(&Flash{})
+}
+
 type Session struct {
 	sess *sessions.CookieStore
 }
@@ -18,3 +66,153 @@ func New(conf *config.Config) *Session {
 		sess: sessions.NewCookieStore([]byte(conf.SecretKey)),
 	}
 }
+
+// appSession returns the session used for the flashes and the CSRF token, an invalid (e.g. tampered) cookie is
+// replaced by a new session
+func (s *Session) appSession(r *http.Request) *sessions.Session {
+	sess, _ := s.sess.Get(r, appSessionName)
+	opts := *sess.Options
+	opts.HttpOnly = true
+	opts.SameSite = http.SameSiteLaxMode
+	sess.Options = &opts
+	return sess
+}
+
+// AddFlash stores a message to be displayed on the next request
+func (s *Session) AddFlash(w http.ResponseWriter, r *http.Request, category, message string) error {
+	sess := s.appSession(r)
+	sess.AddFlash(&Flash{Category: category, Message: message})
+	return sess.Save(r, w)
+}
+
+// Flashes returns (and removes) the flash messages stored in the session
+func (s *Session) Flashes(w http.ResponseWriter, r *http.Request) ([]*Flash, error) {
+	sess := s.appSession(r)
+	raw := sess.Flashes()
+	out := []*Flash{}
+	if len(raw) == 0 {
+		return out, nil
+	}
+	for _, f := range raw {
+		if flash, ok := f.(*Flash); ok {
+			out = append(out, flash)
+		}
+	}
+	if err := sess.Save(r, w); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// CSRFToken returns the CSRF token bound to the session (a new one is generated if needed)
+func (s *Session) CSRFToken(w http.ResponseWriter, r *http.Request) (string, error) {
+	sess := s.appSession(r)
+	if token, ok := sess.Values[csrfKey].(string); ok && token != "" {
+		return token, nil
+	}
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	sess.Values[csrfKey] = token
+	if err := sess.Save(r, w); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// ValidateCSRF checks the CSRF token sent along an unsafe request (the token is read from the `X-CSRF-Token`
+// header or the `csrf_token` form field, it must be the first field of a multipart form), the request body can
+// still be read after the check
+func (s *Session) ValidateCSRF(r *http.Request) error {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return nil
+	}
+	expected, _ := s.appSession(r).Values[csrfKey].(string)
+	if expected == "" {
+		return ErrInvalidCSRFToken
+	}
+	token, err := csrfTokenFromRequest(r)
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+		return ErrInvalidCSRFToken
+	}
+	return nil
+}
+
+// csrfTokenFromRequest extracts the CSRF token from the header or the form (without consuming the body)
+func csrfTokenFromRequest(r *http.Request) (string, error) {
+	if token := r.Header.Get(CSRFHeaderName); token != "" {
+		return token, nil
+	}
+	if r.Body == nil {
+		return "", nil
+	}
+	ct, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch ct {
+	case "multipart/form-data":
+		return csrfTokenFromMultipart(r, params["boundary"])
+	case "application/x-www-form-urlencoded":
+		return csrfTokenFromForm(r)
+	default:
+		return "", nil
+	}
+}
+
+// csrfTokenFromForm reads the CSRF token from an URL-encoded form (the body is buffered and replayed)
+func csrfTokenFromForm(r *http.Request) (string, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxFormSize+1))
+	if err != nil {
+		return "", fmt.Errorf("failed to read form: %w", err)
+	}
+	if len(body) > maxFormSize {
+		return "", errors.New("form too large")
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	values, err := url.ParseQuery(string(body))
+	if err != nil {
+		return "", fmt.Errorf("failed to parse form: %w", err)
+	}
+	return values.Get(CSRFFieldName), nil
+}
+
+// csrfTokenFromMultipart reads the CSRF token from the first part of a multipart form (only the bytes read so far
+// are buffered, and replayed in front of the remaining body)
+func csrfTokenFromMultipart(r *http.Request, boundary string) (string, error) {
+	if boundary == "" {
+		return "", nil
+	}
+	var buf bytes.Buffer
+	body := r.Body
+	defer func() {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(&buf, body), body}
+	}()
+
+	mr := multipart.NewReader(io.TeeReader(io.LimitReader(body, maxCSRFPartSize), &buf), boundary)
+	part, err := mr.NextPart()
+	if err != nil {
+		return "", nil
+	}
+	defer part.Close()
+	if part.FormName() != CSRFFieldName {
+		return "", nil
+	}
+	token, err := ioutil.ReadAll(part)
+	if err != nil {
+		return "", nil
+	}
+	return string(token), nil
+}
+
+// CSRFField returns the hidden input to add in the HTML forms
+func CSRFField(token string) template.HTML {
+	return template.HTML(fmt.Sprintf(`<input type="hidden" name="%s" value="%s">`, CSRFFieldName, template.HTMLEscapeString(token)))
+}
@@ -0,0 +1,146 @@
+package session
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"a4.io/blobstash/pkg/config"
+)
+
+// withCookies returns a new request carrying the cookies set in the response
+func withCookies(method, body string, w *httptest.ResponseRecorder) *http.Request {
+	r := httptest.NewRequest(method, "/", strings.NewReader(body))
+	if body != "" {
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	return r
+}
+
+func TestFlashes(t *testing.T) {
+	s := New(&config.Config{SecretKey: "secret"})
+	w := httptest.NewRecorder()
+	if err := s.AddFlash(w, httptest.NewRequest("GET", "/", nil), "error", "oops"); err != nil {
+		t.Fatal(err)
+	}
+
+	w2 := httptest.NewRecorder()
+	flashes, err := s.Flashes(w2, withCookies("GET", "", w))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flashes) != 1 || flashes[0].Category != "error" || flashes[0].Message != "oops" {
+		t.Fatalf("unexpected flashes %+v", flashes)
+	}
+
+	// The flashes are only displayed once
+	flashes, err = s.Flashes(httptest.NewRecorder(), withCookies("GET", "", w2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flashes) != 0 {
+		t.Errorf("flashes should have been consumed, got %+v", flashes)
+	}
+
+	// A session signed with another key is ignored
+	other := New(&config.Config{SecretKey: "other"})
+	flashes, err = other.Flashes(httptest.NewRecorder(), withCookies("GET", "", w))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flashes) != 0 {
+		t.Errorf("tampered session should be ignored, got %+v", flashes)
+	}
+}
+
+func TestCSRF(t *testing.T) {
+	s := New(&config.Config{SecretKey: "secret"})
+	w := httptest.NewRecorder()
+	token, err := s.CSRFToken(w, httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(CSRFField(token)), token) {
+		t.Errorf("token missing from the field")
+	}
+
+	form := url.Values{"csrf_token": {token}, "title": {"hello"}}.Encode()
+	for _, tc := range []struct {
+		r     *http.Request
+		valid bool
+	}{
+		{withCookies("GET", "", w), true},
+		{withCookies("POST", form, w), true},
+		{withCookies("POST", "title=hello", w), false},
+		{withCookies("POST", "csrf_token=nope", w), false},
+		{httptest.NewRequest("POST", "/", strings.NewReader(form)), false},
+	} {
+		if err := s.ValidateCSRF(tc.r); (err == nil) != tc.valid {
+			t.Errorf("%s %v: unexpected result %v", tc.r.Method, tc.r.Header, err)
+		}
+	}
+
+	r := withCookies("DELETE", "", w)
+	r.Header.Set(CSRFHeaderName, token)
+	if err := s.ValidateCSRF(r); err != nil {
+		t.Errorf("header token should be valid: %v", err)
+	}
+
+	// The body can still be read after the check
+	r = withCookies("POST", form, w)
+	if err := s.ValidateCSRF(r); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.ParseForm(); err != nil || r.PostForm.Get("title") != "hello" {
+		t.Errorf("the body should be left untouched")
+	}
+
+	// Multipart forms: the token must be the first part, and the rest of the body is not buffered
+	multipartForm := func(fields ...string) (*bytes.Buffer, string) {
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		for i := 0; i < len(fields); i += 2 {
+			if err := mw.WriteField(fields[i], fields[i+1]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := mw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return &buf, mw.FormDataContentType()
+	}
+	big := strings.Repeat("x", 2*maxCSRFPartSize)
+	for _, tc := range []struct {
+		fields []string
+		valid  bool
+	}{
+		{[]string{"csrf_token", token, "file", big}, true},
+		{[]string{"file", "small", "csrf_token", token}, false},
+		{[]string{"file", big, "csrf_token", token}, false},
+		{[]string{"csrf_token", big}, false},
+	} {
+		body, ct := multipartForm(tc.fields...)
+		r := withCookies("POST", "", w)
+		r.Body = ioutil.NopCloser(body)
+		r.Header.Set("Content-Type", ct)
+		if err := s.ValidateCSRF(r); (err == nil) != tc.valid {
+			t.Errorf("multipart %q: unexpected result %v", tc.fields[0], err)
+		}
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			t.Fatalf("the multipart body should be left untouched: %v", err)
+		}
+		for i := 0; i < len(tc.fields); i += 2 {
+			if r.PostFormValue(tc.fields[i]) != tc.fields[i+1] {
+				t.Errorf("multipart %q: field %q should be left untouched", tc.fields[0], tc.fields[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package signing
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/ctxutil"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/perms"
+	"a4.io/blobstash/pkg/stash/store"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+// API exposes the public key and the verification of the signed kv entries
+type API struct {
+	kvs store.KvStore
+}
+
+// NewAPI initializes the signing API
+func NewAPI(kvs store.KvStore) *API {
+	return &API{kvs}
+}
+
+// Register registers the signing endpoints
+func (api *API) Register(r *mux.Router, basicAuth func(http.Handler) http.Handler) {
+	r.Handle("/public_key", basicAuth(http.HandlerFunc(api.publicKeyHandler())))
+	r.Handle("/verify/{key}", basicAuth(http.HandlerFunc(api.verifyHandler())))
+}
+
+func (api *API) publicKeyHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		httputil.MarshalAndWrite(r, w, map[string]interface{}{
+			"public_key": PublicKey(),
+		})
+	}
+}
+
+type verifyResult struct {
+	Key       string     `json:"key"`
+	Version   int64      `json:"version"`
+	Ref       string     `json:"ref"`
+	Signature *Signature `json:"signature"`
+	Valid     bool       `json:"valid"`
+	Error     string     `json:"error,omitempty"`
+}
+
+func (api *API) verifyHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		key := mux.Vars(r)["key"]
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Read, perms.KVEntry),
+			perms.ResourceWithID(perms.KvStore, perms.KVEntry, key),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+		f := formatFor(key)
+		if f == nil {
+			httputil.WriteJSONError(w, http.StatusBadRequest, "the key does not hold signed entries")
+			return
+		}
+
+		ctx := ctxutil.WithNamespace(r.Context(), r.Header.Get(ctxutil.NamespaceHeader))
+		q := httputil.NewQuery(r.URL.Query())
+		version, err := q.GetInt64Default("version", -1)
+		if err != nil {
+			httputil.WriteError(w, httputil.BadRequest(err))
+			return
+		}
+		kv, err := api.kvs.Get(ctx, key, version)
+		switch err {
+		case nil:
+		case vkv.ErrNotFound:
+			httputil.WriteErrorStatus(w, http.StatusNotFound)
+			return
+		default:
+			httputil.Error(w, err)
+			return
+		}
+
+		ref, sig, err := f(kv)
+		if err != nil {
+			httputil.Error(w, err)
+			return
+		}
+		res := &verifyResult{
+			Key:       kv.Key,
+			Version:   kv.Version,
+			Ref:       ref,
+			Signature: sig,
+		}
+		if err := Verify(kv.Key, ref, kv.Version, sig); err != nil {
+			res.Error = err.Error()
+		} else {
+			res.Valid = true
+		}
+		httputil.MarshalAndWrite(r, w, res)
+	}
+}
@@ -0,0 +1,248 @@
+/*
+Package signing implements the Ed25519 signatures of the filetree roots and the snapshots.
+
+When a key is configured, each update of a FS root and each snapshot record is signed with it. The signature covers
+the kv key, the ref and the version, so a signed root cannot be replayed under another name or as a newer version.
+
+The signed entries are checked when their meta blobs are received during a sync: an invalid signature is always
+rejected, the unsigned entries (or the ones signed with an untrusted key) are only rejected if `require_signed_sync` is
+set, so a tampered remote can't silently inject modified roots.
+*/
+package signing // import "a4.io/blobstash/pkg/signing"
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/meta"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+var (
+	// ErrUnsigned is returned when verifying an entry without signature
+	ErrUnsigned = errors.New("entry is not signed")
+
+	// ErrUntrustedKey is returned when the entry is signed with a key that is not trusted
+	ErrUntrustedKey = errors.New("entry is signed with an untrusted key")
+
+	// ErrInvalidSignature is returned when the signature does not match the entry
+	ErrInvalidSignature = errors.New("invalid signature")
+)
+
+// Signature holds an Ed25519 signature along with the public key that created it (both hex-encoded)
+type Signature struct {
+	PublicKey string `msgpack:"pk" json:"public_key"`
+	Sig       string `msgpack:"s" json:"sig"`
+}
+
+// Format extracts the signed ref and the signature from a kv entry (an empty ref means there is nothing to verify, e.g.
+// a deleted entry)
+type Format func(kv *vkv.KeyValue) (ref string, sig *Signature, err error)
+
+var (
+	mu              sync.RWMutex
+	privKey         ed25519.PrivateKey
+	trusted         = map[string]bool{}
+	requireSigned   bool
+	formats         = map[string]Format{} // map[<kv key prefix>]Format
+	formatsPrefixes []string
+)
+
+// Payload returns the signed message for the given entry
+func Payload(key, ref string, version int64) []byte {
+	return []byte(fmt.Sprintf("#blobstash/signature/v1\n%s\n%s\n%d", key, ref, version))
+}
+
+// LoadKey loads an Ed25519 private key from a file containing the hex-encoded seed
+func LoadKey(path string) (ed25519.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid key file %q: %v", path, err)
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("invalid key file %q: expected a %d bytes seed", path, ed25519.SeedSize)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// Setup (re)initializes the signing key and the trusted keys from the config
+func Setup(conf *config.Signing) error {
+	apply, err := Load(conf)
+	if err != nil {
+		return err
+	}
+	apply()
+	return nil
+}
+
+// Load loads the signing key and the trusted keys from the config, they're only used once the returned func is
+// called
+func Load(conf *config.Signing) (func(), error) {
+	var key ed25519.PrivateKey
+	keys := map[string]bool{}
+	if conf != nil {
+		if conf.KeyFile != "" {
+			var err error
+			key, err = LoadKey(conf.KeyFile)
+			if err != nil {
+				return nil, err
+			}
+			keys[hex.EncodeToString(key.Public().(ed25519.PublicKey))] = true
+		}
+		for _, k := range conf.TrustedKeys {
+			keys[strings.ToLower(k)] = true
+		}
+	}
+	return func() {
+		mu.Lock()
+		defer mu.Unlock()
+		privKey = key
+		trusted = keys
+		requireSigned = conf != nil && conf.RequireSignedSync
+	}, nil
+}
+
+// Enabled returns true if a signing key is configured
+func Enabled() bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	return privKey != nil
+}
+
+// PublicKey returns the hex-encoded public key (empty if no signing key is configured)
+func PublicKey() string {
+	mu.RLock()
+	defer mu.RUnlock()
+	if privKey == nil {
+		return ""
+	}
+	return hex.EncodeToString(privKey.Public().(ed25519.PublicKey))
+}
+
+// Sign signs the entry with the configured key (returns nil if no signing key is configured)
+func Sign(key, ref string, version int64) *Signature {
+	mu.RLock()
+	defer mu.RUnlock()
+	if privKey == nil {
+		return nil
+	}
+	return &Signature{
+		PublicKey: hex.EncodeToString(privKey.Public().(ed25519.PublicKey)),
+		Sig:       hex.EncodeToString(ed25519.Sign(privKey, Payload(key, ref, version))),
+	}
+}
+
+// Verify checks the signature of the entry, the signature must be valid and created by a trusted key
+func Verify(key, ref string, version int64, sig *Signature) error {
+	if sig == nil {
+		return ErrUnsigned
+	}
+	pub, err := hex.DecodeString(sig.PublicKey)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return ErrInvalidSignature
+	}
+	rawSig, err := hex.DecodeString(sig.Sig)
+	if err != nil || !ed25519.Verify(ed25519.PublicKey(pub), Payload(key, ref, version), rawSig) {
+		return ErrInvalidSignature
+	}
+	mu.RLock()
+	defer mu.RUnlock()
+	if !trusted[strings.ToLower(sig.PublicKey)] {
+		return ErrUntrustedKey
+	}
+	return nil
+}
+
+// RegisterFormat registers the format of the signed entries stored under the given kv key prefix
+func RegisterFormat(prefix string, f Format) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := formats[prefix]; !ok {
+		formatsPrefixes = append(formatsPrefixes, prefix)
+	}
+	formats[prefix] = f
+}
+
+// Signed returns true if the kv key holds signed entries
+func Signed(key string) bool {
+	return formatFor(key) != nil
+}
+
+func formatFor(key string) Format {
+	mu.RLock()
+	defer mu.RUnlock()
+	for _, prefix := range formatsPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return formats[prefix]
+		}
+	}
+	return nil
+}
+
+// VerifyKeyValue checks the signature of the kv entry (the entries stored under an unregistered prefix are not checked)
+func VerifyKeyValue(kv *vkv.KeyValue) error {
+	f := formatFor(kv.Key)
+	if f == nil {
+		return nil
+	}
+	ref, sig, err := f(kv)
+	if err != nil {
+		return err
+	}
+	if ref == "" {
+		return nil
+	}
+	return Verify(kv.Key, ref, kv.Version, sig)
+}
+
+// CheckMetaBlob checks the signatures of the kv entries contained in the meta blob (the other blobs are ignored), the
+// unsigned entries are only rejected if `require_signed_sync` is set
+func CheckMetaBlob(data []byte) error {
+	metaType, metaData, isMeta := meta.IsMetaBlob(data)
+	if !isMeta {
+		return nil
+	}
+	var kvs []*vkv.KeyValue
+	switch metaType {
+	case vkv.KvType:
+		kv, err := vkv.UnserializeBlob(metaData)
+		if err != nil {
+			return err
+		}
+		kvs = append(kvs, kv)
+	case vkv.CheckpointType:
+		cp, err := vkv.UnserializeCheckpoint(metaData)
+		if err != nil {
+			return err
+		}
+		kvs = cp.KeyValues
+	default:
+		return nil
+	}
+
+	mu.RLock()
+	strict := requireSigned
+	mu.RUnlock()
+	for _, kv := range kvs {
+		switch err := VerifyKeyValue(kv); err {
+		case nil:
+		case ErrUnsigned, ErrUntrustedKey:
+			if strict {
+				return fmt.Errorf("key %q at version %d: %w", kv.Key, kv.Version, err)
+			}
+		default:
+			return fmt.Errorf("key %q at version %d: %w", kv.Key, kv.Version, err)
+		}
+	}
+	return nil
+}
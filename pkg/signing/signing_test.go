@@ -0,0 +1,135 @@
+package signing
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/hub"
+	"a4.io/blobstash/pkg/meta"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+func setupKey(t *testing.T, requireSigned bool) {
+	dir, err := ioutil.TempDir("", "blobstash_signing")
+	if err != nil {
+		panic(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+		Setup(nil)
+	})
+	path := filepath.Join(dir, "key")
+	seed := make([]byte, ed25519.SeedSize)
+	seed[0] = 1
+	if err := ioutil.WriteFile(path, []byte(hex.EncodeToString(seed)+"\n"), 0600); err != nil {
+		panic(err)
+	}
+	if err := Setup(&config.Signing{KeyFile: path, RequireSignedSync: requireSigned}); err != nil {
+		t.Fatalf("failed to setup: %v", err)
+	}
+}
+
+func TestSignVerify(t *testing.T) {
+	if Sign("k", "ref", 1) != nil {
+		t.Errorf("expected no signature without key")
+	}
+	setupKey(t, false)
+	sig := Sign("k", "ref", 1)
+	if sig == nil || sig.PublicKey != PublicKey() {
+		t.Fatalf("invalid signature %+v", sig)
+	}
+	if err := Verify("k", "ref", 1, sig); err != nil {
+		t.Errorf("expected a valid signature, got %v", err)
+	}
+	for _, tc := range []struct {
+		key     string
+		ref     string
+		version int64
+	}{
+		{"k2", "ref", 1},
+		{"k", "ref2", 1},
+		{"k", "ref", 2},
+	} {
+		if err := Verify(tc.key, tc.ref, tc.version, sig); err != ErrInvalidSignature {
+			t.Errorf("%+v: expected ErrInvalidSignature, got %v", tc, err)
+		}
+	}
+	if err := Verify("k", "ref", 1, nil); err != ErrUnsigned {
+		t.Errorf("expected ErrUnsigned, got %v", err)
+	}
+
+	// Valid, but the key is no longer trusted
+	Setup(nil)
+	if err := Verify("k", "ref", 1, sig); err != ErrUntrustedKey {
+		t.Errorf("expected ErrUntrustedKey, got %v", err)
+	}
+	Setup(&config.Signing{TrustedKeys: []string{sig.PublicKey}})
+	if err := Verify("k", "ref", 1, sig); err != nil {
+		t.Errorf("expected a valid signature, got %v", err)
+	}
+}
+
+func TestCheckMetaBlob(t *testing.T) {
+	// The signature is stored as-is in the data for the test
+	RegisterFormat("_test:", func(kv *vkv.KeyValue) (string, *Signature, error) {
+		if len(kv.Data) == 0 {
+			return kv.HexHash(), nil, nil
+		}
+		return kv.HexHash(), &Signature{PublicKey: PublicKey(), Sig: string(kv.Data)}, nil
+	})
+	m, err := meta.New(log.New(), hub.New(log.New(), true))
+	if err != nil {
+		panic(err)
+	}
+	build := func(key, ref string, version int64, sig *Signature) []byte {
+		kv := &vkv.KeyValue{Key: key, Version: version}
+		kv.SetHexHash(ref)
+		if sig != nil {
+			kv.Data = []byte(sig.Sig)
+		}
+		b, err := m.Build(kv)
+		if err != nil {
+			panic(err)
+		}
+		return b.Data
+	}
+
+	ref := "0000000000000000000000000000000000000000000000000000000000000001"
+	other := "0000000000000000000000000000000000000000000000000000000000000002"
+	setupKey(t, true)
+	sig := Sign("_test:a", ref, 10)
+	if err := CheckMetaBlob(build("_test:a", ref, 10, sig)); err != nil {
+		t.Errorf("expected a valid blob, got %v", err)
+	}
+	// Tampered root
+	if err := CheckMetaBlob(build("_test:a", other, 10, sig)); err == nil {
+		t.Errorf("expected the tampered root to be rejected")
+	}
+	// Unsigned root
+	if err := CheckMetaBlob(build("_test:a", ref, 10, nil)); err == nil {
+		t.Errorf("expected the unsigned root to be rejected")
+	}
+	// Not a signed key
+	if err := CheckMetaBlob(build("other", ref, 10, nil)); err != nil {
+		t.Errorf("expected the blob to be ignored, got %v", err)
+	}
+	if err := CheckMetaBlob([]byte("not a meta blob")); err != nil {
+		t.Errorf("expected the blob to be ignored, got %v", err)
+	}
+
+	// The unsigned roots are allowed if `require_signed_sync` is not set
+	setupKey(t, false)
+	if err := CheckMetaBlob(build("_test:a", ref, 10, nil)); err != nil {
+		t.Errorf("expected the unsigned root to be allowed, got %v", err)
+	}
+	if err := CheckMetaBlob(build("_test:a", other, 10, sig)); err == nil {
+		t.Errorf("expected the tampered root to be rejected")
+	}
+}
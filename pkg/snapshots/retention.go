@@ -0,0 +1,199 @@
+package snapshots // import "a4.io/blobstash/pkg/snapshots"
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"time"
+
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/ctxutil"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/perms"
+)
+
+// Retention
+//
+// The snapshots can be rotated using grandfather-father-son policies (`snapshots.retention` in the config): for each
+// snapshot name, the most recent snapshot of each of the last N days, M weeks and K months (the periods with no
+// snapshot are not counted) is kept, and the others are dropped. The snapshots without a matching policy are kept
+// forever.
+//
+// The prune report lists the blobs that are no longer referenced by any snapshot (blobs cannot be deleted, but they may
+// now be reclaimed by the stash GC or an export). The docstore snapshots don't hold any blob, the document versions are
+// kept in the kv store history.
+
+// PruneReport is the outcome of a pruning
+type PruneReport struct {
+	DryRun      bool        `json:"dry_run"`
+	Kept        int         `json:"kept"`
+	Dropped     []*Snapshot `json:"dropped"`
+	Unreachable []string    `json:"unreachable"`
+}
+
+// policy returns the retention policy for the snapshot name (nil if there's none)
+func (snaps *Snapshots) policy(name string) *config.SnapshotRetention {
+	if snaps.conf.Snapshots == nil {
+		return nil
+	}
+	for _, rp := range snaps.conf.Snapshots.Retention {
+		if ok, _ := path.Match(rp.Name, name); ok {
+			return rp
+		}
+	}
+	return nil
+}
+
+// expired returns the snapshots not kept by the policy (the snapshots must be sorted, the most recent first)
+func expired(rp *config.SnapshotRetention, snaps []*Snapshot) []*Snapshot {
+	kept := map[*Snapshot]bool{}
+	for _, rule := range []struct {
+		count  int
+		period func(time.Time) string
+	}{
+		{rp.Daily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{rp.Weekly, func(t time.Time) string {
+			y, w := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", y, w)
+		}},
+		{rp.Monthly, func(t time.Time) string { return t.Format("2006-01") }},
+	} {
+		seen := map[string]bool{}
+		for _, s := range snaps {
+			if len(seen) == rule.count {
+				break
+			}
+			p := rule.period(time.Unix(0, s.CreatedAt).UTC())
+			if seen[p] {
+				continue
+			}
+			// The most recent snapshot of the period
+			seen[p] = true
+			kept[s] = true
+		}
+	}
+	out := []*Snapshot{}
+	for _, s := range snaps {
+		if !kept[s] {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// refs returns the blobs referenced by the snapshot
+func (snaps *Snapshots) refs(ctx context.Context, s *Snapshot, out map[string]struct{}) error {
+	switch s.Type {
+	case TypeFS:
+		return snaps.ft.Refs(ctx, s.Ref, func(ref string) error {
+			out[ref] = struct{}{}
+			return nil
+		})
+	case TypeBlob:
+		out[s.Ref] = struct{}{}
+	}
+	return nil
+}
+
+// Prune drops the snapshots expired according to the retention policies (nothing is dropped if dryRun is true)
+func (snaps *Snapshots) Prune(ctx context.Context, dryRun bool) (*PruneReport, error) {
+	all, err := snaps.List(ctx, "", "")
+	if err != nil {
+		return nil, err
+	}
+	byName := map[string][]*Snapshot{}
+	for _, s := range all {
+		byName[s.Name] = append(byName[s.Name], s)
+	}
+
+	report := &PruneReport{DryRun: dryRun, Dropped: []*Snapshot{}, Unreachable: []string{}}
+	dropped := map[*Snapshot]bool{}
+	for name, series := range byName {
+		rp := snaps.policy(name)
+		if rp == nil {
+			continue
+		}
+		for _, s := range expired(rp, series) {
+			dropped[s] = true
+			report.Dropped = append(report.Dropped, s)
+		}
+	}
+	report.Kept = len(all) - len(report.Dropped)
+	if len(report.Dropped) == 0 {
+		return report, nil
+	}
+	sort.Slice(report.Dropped, func(i, j int) bool { return report.Dropped[i].CreatedAt > report.Dropped[j].CreatedAt })
+
+	// Compute the blobs only referenced by the dropped snapshots
+	keptRefs := map[string]struct{}{}
+	droppedRefs := map[string]struct{}{}
+	for _, s := range all {
+		refs := keptRefs
+		if dropped[s] {
+			refs = droppedRefs
+		}
+		if err := snaps.refs(ctx, s, refs); err != nil {
+			return nil, fmt.Errorf("failed to walk snapshot %s/%s: %w", s.Name, s.ID, err)
+		}
+	}
+	for ref := range droppedRefs {
+		if _, ok := keptRefs[ref]; !ok {
+			report.Unreachable = append(report.Unreachable, ref)
+		}
+	}
+	sort.Strings(report.Unreachable)
+
+	if dryRun {
+		return report, nil
+	}
+	for _, s := range report.Dropped {
+		if _, err := snaps.kvs.Put(ctx, s.Key(), "", nil, -1); err != nil {
+			return nil, err
+		}
+	}
+	snaps.log.Info("snapshots pruned", "dropped", len(report.Dropped), "kept", report.Kept, "unreachable_blobs", len(report.Unreachable))
+	return report, nil
+}
+
+func (snaps *Snapshots) pruneHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			if !auth.Can(
+				w,
+				r,
+				perms.Action(perms.Admin, perms.SnapshotRef),
+				perms.Resource(perms.Snapshots, perms.SnapshotRef),
+			) {
+				auth.Forbidden(w)
+				return
+			}
+			q := httputil.NewQuery(r.URL.Query())
+			dryRun, err := q.GetBoolDefault("dry_run", false)
+			if err != nil {
+				httputil.Error(w, err)
+				return
+			}
+
+			// The pruning must complete before shutting down
+			done, err := snaps.lc.Track()
+			if err != nil {
+				httputil.WriteJSONError(w, http.StatusServiceUnavailable, err.Error())
+				return
+			}
+			defer done()
+			ctx := ctxutil.WithNamespace(r.Context(), r.Header.Get(ctxutil.NamespaceHeader))
+			report, err := snaps.Prune(ctx, dryRun)
+			if err != nil {
+				httputil.Error(w, err)
+				return
+			}
+			httputil.MarshalAndWrite(r, w, report)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
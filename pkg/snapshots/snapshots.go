@@ -0,0 +1,386 @@
+/*
+Package snapshots implements named, immutable pointers to the data.
+
+A snapshot records a root ref (a filetree node, a docstore collection version or a blob) along with a message and a
+timestamp. Snapshots are never updated, creating a snapshot with an existing name adds a new snapshot to the series.
+They are stored in the kv store (as `_snapshots:<name>:<created_at>`, so they follow the namespace of the request), and
+the stash GC treats the refs of the snapshots created in a namespace as roots (i.e. they are merged into the root
+blobstore along with the data they reference). The snapshots are signed if a signing key is configured.
+*/
+package snapshots // import "a4.io/blobstash/pkg/snapshots"
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	log "github.com/inconshreveable/log15"
+	"github.com/robfig/cron"
+
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/clock"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/ctxutil"
+	"a4.io/blobstash/pkg/filetree"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/lifecycle"
+	"a4.io/blobstash/pkg/perms"
+	"a4.io/blobstash/pkg/signing"
+	"a4.io/blobstash/pkg/stash/store"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+// KeyFmt is the kv key format of the snapshots (`_snapshots:<name>:<created_at>`)
+const KeyFmt = "_snapshots:%s:%d"
+
+// KeyPrefix is the prefix of the snapshot keys
+const KeyPrefix = "_snapshots:"
+
+// Snapshot types
+const (
+	TypeFS   = "fs"   // A filetree node (the ref can be a FS name, resolved to its current root)
+	TypeDoc  = "doc"  // A docstore collection version (`<collection>@<version>`, defaults to the current version)
+	TypeBlob = "blob" // A single blob
+)
+
+var (
+	// ErrSnapshotNotFound is returned when the requested snapshot does not exist
+	ErrSnapshotNotFound = errors.New("snapshot not found")
+
+	validName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+)
+
+// Snapshot is an immutable pointer to a root ref
+type Snapshot struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	Ref       string `json:"ref"`
+	Message   string `json:"message,omitempty"`
+	CreatedAt int64  `json:"created_at"`
+
+	Signature *signing.Signature `json:"signature,omitempty"`
+}
+
+func init() {
+	// The snapshots are signed, so they can be verified when received during a sync
+	signing.RegisterFormat(KeyPrefix, func(kv *vkv.KeyValue) (string, *signing.Signature, error) {
+		// Pruned snapshot
+		if len(kv.Data) == 0 {
+			return "", nil, nil
+		}
+		s := &Snapshot{}
+		if err := json.Unmarshal(kv.Data, s); err != nil {
+			return "", nil, err
+		}
+		return s.Ref, s.Signature, nil
+	})
+}
+
+// Key returns the kv key of the snapshot
+func (s *Snapshot) Key() string {
+	return fmt.Sprintf(KeyFmt, s.Name, s.CreatedAt)
+}
+
+// DocRef returns the collection and the version of a docstore snapshot
+func (s *Snapshot) DocRef() (string, int64, error) {
+	i := strings.LastIndex(s.Ref, "@")
+	if i == -1 {
+		return "", 0, fmt.Errorf("invalid doc ref %q", s.Ref)
+	}
+	version, err := strconv.ParseInt(s.Ref[i+1:], 10, 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid doc ref %q: %v", s.Ref, err)
+	}
+	return s.Ref[:i], version, nil
+}
+
+// Snapshots manages the snapshots
+type Snapshots struct {
+	kvs  store.KvStore
+	bs   store.BlobStore
+	ft   *filetree.FileTree
+	conf *config.Config
+	cron *cron.Cron
+	lc   *lifecycle.Lifecycle
+	log  log.Logger
+}
+
+// New initializes the snapshots manager, and schedules the pruning
+func New(logger log.Logger, conf *config.Config, kvs store.KvStore, bs store.BlobStore, ft *filetree.FileTree, lc *lifecycle.Lifecycle) (*Snapshots, error) {
+	logger.Debug("init")
+	snaps := &Snapshots{
+		kvs:  kvs,
+		bs:   bs,
+		ft:   ft,
+		conf: conf,
+		cron: cron.New(),
+		lc:   lc,
+		log:  logger,
+	}
+	if conf.Snapshots != nil && conf.Snapshots.PruneSchedule != "" {
+		if err := snaps.cron.AddFunc(conf.Snapshots.PruneSchedule, func() {
+			lc.Go("snapshots-prune", func(ctx context.Context) {
+				if _, err := snaps.Prune(ctx, false); err != nil {
+					snaps.log.Error("failed to prune snapshots", "err", err)
+				}
+			})
+		}); err != nil {
+			return nil, fmt.Errorf("invalid `snapshots.prune_schedule`: %v", err)
+		}
+	}
+	snaps.cron.Start()
+	return snaps, nil
+}
+
+// Close stops the scheduler
+func (snaps *Snapshots) Close() error {
+	snaps.cron.Stop()
+	return nil
+}
+
+// resolve validates the snapshot and sets its immutable ref
+func (snaps *Snapshots) resolve(ctx context.Context, s *Snapshot) error {
+	if !validName.MatchString(s.Name) {
+		return fmt.Errorf("invalid name %q", s.Name)
+	}
+	if s.Ref == "" {
+		return errors.New("missing ref")
+	}
+	switch s.Type {
+	case TypeFS:
+		if !isHash(s.Ref) {
+			fs, err := snaps.ft.ResolveFS(ctx, s.Ref)
+			if err != nil {
+				return fmt.Errorf("failed to resolve FS %q: %w", s.Ref, err)
+			}
+			s.Ref = fs.Ref
+		}
+	case TypeBlob:
+		if !isHash(s.Ref) {
+			return fmt.Errorf("invalid ref %q", s.Ref)
+		}
+	case TypeDoc:
+		if !strings.Contains(s.Ref, "@") {
+			s.Ref = fmt.Sprintf("%s@%d", s.Ref, s.CreatedAt)
+		}
+		collection, _, err := s.DocRef()
+		if err != nil {
+			return err
+		}
+		if collection == "" {
+			return fmt.Errorf("invalid doc ref %q", s.Ref)
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid type %q", s.Type)
+	}
+
+	exists, err := snaps.bs.Stat(ctx, s.Ref)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("blob %q not found", s.Ref)
+	}
+	return nil
+}
+
+// Create records a new snapshot (the ref is resolved first)
+func (snaps *Snapshots) Create(ctx context.Context, s *Snapshot) (*Snapshot, error) {
+	s.CreatedAt = clock.Now().UTC().UnixNano()
+	if err := snaps.resolve(ctx, s); err != nil {
+		return nil, httputil.BadRequest(err)
+	}
+	s.ID = strconv.FormatInt(s.CreatedAt, 10)
+	s.Signature = signing.Sign(s.Key(), s.Ref, s.CreatedAt)
+	encoded, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	// The kv ref keeps a reference to the root blob
+	var ref string
+	if s.Type != TypeDoc {
+		ref = s.Ref
+	}
+	if _, err := snaps.kvs.Put(ctx, s.Key(), ref, encoded, s.CreatedAt); err != nil {
+		return nil, err
+	}
+	snaps.log.Info("snapshot created", "name", s.Name, "type", s.Type, "ref", s.Ref)
+	return s, nil
+}
+
+// Get returns the snapshot
+func (snaps *Snapshots) Get(ctx context.Context, name, id string) (*Snapshot, error) {
+	createdAt, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return nil, ErrSnapshotNotFound
+	}
+	kv, err := snaps.kvs.Get(ctx, fmt.Sprintf(KeyFmt, name, createdAt), -1)
+	if err != nil {
+		if err == vkv.ErrNotFound {
+			return nil, ErrSnapshotNotFound
+		}
+		return nil, err
+	}
+	// Pruned snapshot
+	if len(kv.Data) == 0 {
+		return nil, ErrSnapshotNotFound
+	}
+	s := &Snapshot{}
+	if err := json.Unmarshal(kv.Data, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// List returns the snapshots (the most recent first), optionally filtered by name and type
+func (snaps *Snapshots) List(ctx context.Context, name, typ string) ([]*Snapshot, error) {
+	return List(ctx, snaps.kvs, name, typ)
+}
+
+// List returns the snapshots stored in kvs (the most recent first), optionally filtered by name and type
+func List(ctx context.Context, kvs store.KvStore, name, typ string) ([]*Snapshot, error) {
+	prefix := KeyPrefix
+	if name != "" {
+		prefix = fmt.Sprintf("%s%s:", KeyPrefix, name)
+	}
+	out := []*Snapshot{}
+	start := prefix
+	for {
+		keys, _, err := kvs.Keys(ctx, start, prefix+"\xff", 100)
+		if err != nil {
+			return nil, err
+		}
+		for _, kv := range keys {
+			if len(kv.Data) == 0 {
+				continue
+			}
+			s := &Snapshot{}
+			if err := json.Unmarshal(kv.Data, s); err != nil {
+				return nil, fmt.Errorf("invalid snapshot %q: %v", kv.Key, err)
+			}
+			if typ != "" && s.Type != typ {
+				continue
+			}
+			out = append(out, s)
+		}
+		if len(keys) < 100 {
+			break
+		}
+		start = keys[len(keys)-1].Key + "\x00"
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].CreatedAt > out[j].CreatedAt })
+	return out, nil
+}
+
+// Register registers the snapshots endpoints
+func (snaps *Snapshots) Register(r *mux.Router, basicAuth func(http.Handler) http.Handler) {
+	r.Handle("/", basicAuth(http.HandlerFunc(snaps.snapshotsHandler())))
+	r.Handle("/_prune", basicAuth(http.HandlerFunc(snaps.pruneHandler())))
+	r.Handle("/{name}/{id}", basicAuth(http.HandlerFunc(snaps.snapshotHandler())))
+}
+
+func (snaps *Snapshots) snapshotsHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := ctxutil.WithNamespace(r.Context(), r.Header.Get(ctxutil.NamespaceHeader))
+		switch r.Method {
+		case "GET", "HEAD":
+			q := httputil.NewQuery(r.URL.Query())
+			name := q.Get("name")
+			resource := perms.Resource(perms.Snapshots, perms.SnapshotRef)
+			if name != "" {
+				resource = perms.ResourceWithID(perms.Snapshots, perms.SnapshotRef, name)
+			}
+			if !auth.Can(
+				w,
+				r,
+				perms.Action(perms.List, perms.SnapshotRef),
+				resource,
+			) {
+				auth.Forbidden(w)
+				return
+			}
+			out, err := snaps.List(ctx, name, q.Get("type"))
+			if err != nil {
+				httputil.Error(w, err)
+				return
+			}
+			httputil.MarshalAndWrite(r, w, map[string]interface{}{
+				"data": out,
+			})
+		case "POST":
+			s := &Snapshot{}
+			if err := httputil.Unmarshal(r, s); err != nil {
+				httputil.WriteError(w, err)
+				return
+			}
+			if !auth.Can(
+				w,
+				r,
+				perms.Action(perms.Write, perms.SnapshotRef),
+				perms.ResourceWithID(perms.Snapshots, perms.SnapshotRef, s.Name),
+			) {
+				auth.Forbidden(w)
+				return
+			}
+			created, err := snaps.Create(ctx, s)
+			if err != nil {
+				httputil.WriteError(w, err)
+				return
+			}
+			httputil.MarshalAndWrite(r, w, created, httputil.WithStatusCode(http.StatusCreated))
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func (snaps *Snapshots) snapshotHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := ctxutil.WithNamespace(r.Context(), r.Header.Get(ctxutil.NamespaceHeader))
+		vars := mux.Vars(r)
+		switch r.Method {
+		case "GET", "HEAD":
+			if !auth.Can(
+				w,
+				r,
+				perms.Action(perms.Read, perms.SnapshotRef),
+				perms.ResourceWithID(perms.Snapshots, perms.SnapshotRef, vars["name"]),
+			) {
+				auth.Forbidden(w)
+				return
+			}
+			s, err := snaps.Get(ctx, vars["name"], vars["id"])
+			switch err {
+			case nil:
+			case ErrSnapshotNotFound:
+				httputil.WriteErrorStatus(w, http.StatusNotFound)
+				return
+			default:
+				httputil.Error(w, err)
+				return
+			}
+			httputil.MarshalAndWrite(r, w, s)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// isHash returns true if h looks like a blob hash
+func isHash(h string) bool {
+	if len(h) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(h)
+	return err == nil
+}
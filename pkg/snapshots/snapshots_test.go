@@ -0,0 +1,71 @@
+package snapshots
+
+import (
+	"testing"
+	"time"
+
+	"a4.io/blobstash/pkg/config"
+)
+
+func TestDocRef(t *testing.T) {
+	for _, tc := range []struct {
+		ref        string
+		collection string
+		version    int64
+		err        bool
+	}{
+		{"notes@10", "notes", 10, false},
+		{"my@notes@20", "my@notes", 20, false},
+		{"notes", "", 0, true},
+		{"notes@latest", "", 0, true},
+	} {
+		s := &Snapshot{Type: TypeDoc, Ref: tc.ref}
+		collection, version, err := s.DocRef()
+		if tc.err {
+			if err == nil {
+				t.Errorf("%q: expected an error", tc.ref)
+			}
+			continue
+		}
+		if err != nil || collection != tc.collection || version != tc.version {
+			t.Errorf("%q: got %q/%d/%v", tc.ref, collection, version, err)
+		}
+	}
+
+	s := &Snapshot{Name: "daily", CreatedAt: 42}
+	if k := s.Key(); k != "_snapshots:daily:42" {
+		t.Errorf("bad key %q", k)
+	}
+}
+
+func TestExpired(t *testing.T) {
+	// One snapshot every 12 hours for 90 days, the most recent first
+	now := time.Date(2020, 3, 31, 23, 0, 0, 0, time.UTC)
+	snaps := []*Snapshot{}
+	for i := 0; i < 180; i++ {
+		snaps = append(snaps, &Snapshot{CreatedAt: now.Add(-time.Duration(i) * 12 * time.Hour).UnixNano()})
+	}
+
+	for _, tc := range []struct {
+		rp   *config.SnapshotRetention
+		kept int
+	}{
+		{&config.SnapshotRetention{Daily: 7}, 7},
+		// The last 7 days cover the 2 most recent weeks, and the current month
+		{&config.SnapshotRetention{Daily: 7, Weekly: 4, Monthly: 3}, 7 + 2 + 2},
+		// Only 3 months of snapshots
+		{&config.SnapshotRetention{Monthly: 12}, 3},
+	} {
+		dropped := expired(tc.rp, snaps)
+		if kept := len(snaps) - len(dropped); kept != tc.kept {
+			t.Errorf("%+v: kept %d snapshots, expected %d", tc.rp, kept, tc.kept)
+		}
+	}
+
+	// The most recent snapshot is always kept
+	for _, s := range expired(&config.SnapshotRetention{Monthly: 1}, snaps) {
+		if s == snaps[0] {
+			t.Errorf("the most recent snapshot should be kept")
+		}
+	}
+}
@@ -14,6 +14,7 @@ import (
 	"a4.io/blobstash/pkg/stash"
 	"a4.io/blobstash/pkg/stash/gc"
 	"a4.io/blobstash/pkg/stash/store"
+	"a4.io/blobstash/pkg/tenant"
 )
 
 type StashAPI struct {
@@ -31,16 +32,33 @@ func (s *StashAPI) listHandler() func(http.ResponseWriter, *http.Request) {
 			w.WriteHeader(http.StatusMethodNotAllowed)
 			return
 		}
+		// Only list the namespaces owned by the tenant
+		names := []string{}
+		for _, name := range s.stash.ContextNames() {
+			if name, ok := tenant.Strip(r, name); ok {
+				names = append(names, name)
+			}
+		}
 		httputil.MarshalAndWrite(r, w, map[string]interface{}{
-			"data": s.stash.ContextNames(),
+			"data": names,
 		})
 	}
 }
 
+// merge returns false (and writes a 403) if the request is made by a tenant, as merging would write to the shared root
+// namespace
+func merge(w http.ResponseWriter, r *http.Request) bool {
+	if tenant.FromRequest(r) != "" {
+		httputil.WriteJSONError(w, http.StatusForbidden, "a tenant namespace cannot be merged")
+		return false
+	}
+	return true
+}
+
 func (s *StashAPI) dataContextHandler() func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		name := mux.Vars(r)["name"]
-		dataContext, ok := s.stash.DataContextByName(name)
+		name := tenant.Name(r, mux.Vars(r)["name"])
+		_, ok := s.stash.DataContextByName(name)
 		switch r.Method {
 		case "GET", "HEAD":
 			if !ok {
@@ -58,8 +76,6 @@ func (s *StashAPI) dataContextHandler() func(http.ResponseWriter, *http.Request)
 				w.WriteHeader(http.StatusNotFound)
 				return
 			}
-			// FIXME(tsileo): stash.Destroy should destroy the data ctx
-			dataContext.Destroy()
 			if err := s.stash.Destroy(context.TODO(), name); err != nil {
 				panic(err)
 			}
@@ -73,6 +89,9 @@ func (s *StashAPI) dataContextHandler() func(http.ResponseWriter, *http.Request)
 
 func (s *StashAPI) dataContextMergeHandler() func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if !merge(w, r) {
+			return
+		}
 		name := mux.Vars(r)["name"]
 		_, ok := s.stash.DataContextByName(name)
 		switch r.Method {
@@ -97,6 +116,9 @@ type GCInput struct {
 
 func (s *StashAPI) dataContextGCHandler() func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if !merge(w, r) {
+			return
+		}
 		ctx := r.Context()
 		name := mux.Vars(r)["name"]
 		ctx = ctxutil.WithNamespace(ctx, name)
@@ -117,6 +139,9 @@ func (s *StashAPI) dataContextGCHandler() func(http.ResponseWriter, *http.Reques
 			if err := s.stash.DoAndDestroy(ctx, name, func(ctx context.Context, dc store.DataContext) error {
 				blobs, size, err := gc.GC(ctx, s.hub, s.stash, dc, out.Script, map[string]struct{}{})
 				fmt.Printf("GC err=%v, output: %d blobs,  %s\n\n", err, blobs, humanize.Bytes(size))
+				if nerr := gc.Notify(name, blobs, size, err); nerr != nil {
+					fmt.Printf("failed to send the GC notification: %v\n", nerr)
+				}
 				return err
 
 			}); err != nil {
@@ -136,6 +161,9 @@ type GC2Input struct {
 
 func (s *StashAPI) dataContextGC2Handler() func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if !merge(w, r) {
+			return
+		}
 		ctx := r.Context()
 		name := mux.Vars(r)["name"]
 		ctx = ctxutil.WithNamespace(ctx, name)
@@ -3,7 +3,10 @@ package gc // import "a4.io/blobstash/pkg/stash/gc"
 import (
 	"context"
 	"fmt"
+	"strconv"
+	"strings"
 
+	humanize "github.com/dustin/go-humanize"
 	"github.com/vmihailenco/msgpack"
 	lua "github.com/yuin/gopher-lua"
 
@@ -11,16 +14,22 @@ import (
 	"a4.io/blobstash/pkg/apps/luautil"
 	"a4.io/blobstash/pkg/blob"
 	bsLua "a4.io/blobstash/pkg/blobstore/lua"
+	"a4.io/blobstash/pkg/ctxutil"
 	"a4.io/blobstash/pkg/extra"
 	"a4.io/blobstash/pkg/filetree/filetreeutil/node"
 	"a4.io/blobstash/pkg/hub"
 	kvsLua "a4.io/blobstash/pkg/kvstore/lua"
 	"a4.io/blobstash/pkg/luascripts"
+	"a4.io/blobstash/pkg/notify"
+	"a4.io/blobstash/pkg/snapshots"
 	"a4.io/blobstash/pkg/stash"
 	"a4.io/blobstash/pkg/stash/store"
+	"a4.io/blobstash/pkg/vkv"
 )
 
 func GC(ctx context.Context, h *hub.Hub, s *stash.Stash, dc store.DataContext, script string, existingRefs map[string]struct{}) (int, uint64, error) {
+	// The GC reads must not mark the blobs as hot
+	ctx = ctxutil.WithSkipAccessTracking(ctx)
 
 	// TODO(tsileo): take a logger
 	refs := map[string]struct{}{}
@@ -74,6 +83,11 @@ func GC(ctx context.Context, h *hub.Hub, s *stash.Stash, dc store.DataContext, s
 	if err := L.DoString(script); err != nil {
 		return 0, 0, err
 	}
+
+	// The snapshots created in the namespace are roots
+	if err := markSnapshots(ctx, L, s, dc); err != nil {
+		return 0, 0, err
+	}
 	fmt.Printf("refs=%q\n", orderedRefs)
 	blobsCnt := 0
 	totalSize := uint64(0)
@@ -105,6 +119,82 @@ func GC(ctx context.Context, h *hub.Hub, s *stash.Stash, dc store.DataContext, s
 	return blobsCnt, totalSize, nil
 }
 
+// Notify sends the GC results notification (the number and size of the blobs saved from the namespace)
+func Notify(ns string, blobs int, size uint64, gcErr error) error {
+	if gcErr != nil {
+		return notify.Notify(notify.GC, fmt.Sprintf("GC of %q failed", ns), fmt.Sprintf("The GC of the %q namespace failed: %v\n", ns, gcErr))
+	}
+	return notify.Notify(notify.GC, fmt.Sprintf("GC of %q done", ns), fmt.Sprintf("The GC of the %q namespace saved %d blobs (%s).\n", ns, blobs, humanize.Bytes(size)))
+}
+
+// markSnapshots marks the snapshots stored in the data context, along with the data they reference
+func markSnapshots(ctx context.Context, L *lua.LState, s *stash.Stash, dc store.DataContext) error {
+	snaps, err := snapshots.List(ctx, dc.KvStore(), "", "")
+	if err != nil {
+		return err
+	}
+	call := func(fn string, args ...string) error {
+		largs := make([]lua.LValue, 0, len(args))
+		for _, arg := range args {
+			largs = append(largs, lua.LString(arg))
+		}
+		return L.CallByParam(lua.P{Fn: L.GetGlobal(fn), NRet: 0, Protect: true}, largs...)
+	}
+	for _, snap := range snaps {
+		switch snap.Type {
+		case snapshots.TypeFS:
+			err = call("mark_filetree_node", snap.Ref)
+		case snapshots.TypeBlob:
+			err = call("mark", snap.Ref)
+		case snapshots.TypeDoc:
+			err = markDocSnapshot(ctx, s.KvStore(), snap, call)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to mark snapshot %s/%s: %v", snap.Name, snap.ID, err)
+		}
+		// Mark the snapshot itself last
+		if err := call("mark_kv", snap.Key(), snap.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// markDocSnapshot marks the version of each document of the collection at the snapshot version
+func markDocSnapshot(ctx context.Context, kvs store.KvStore, snap *snapshots.Snapshot, call func(string, ...string) error) error {
+	collection, version, err := snap.DocRef()
+	if err != nil {
+		return err
+	}
+	prefix := fmt.Sprintf("docstore:%s:", collection)
+	start := prefix
+	for {
+		keys, _, err := kvs.Keys(ctx, start, prefix+"\xff", 100)
+		if err != nil {
+			return err
+		}
+		for _, kv := range keys {
+			versions, _, err := kvs.Versions(ctx, kv.Key, strconv.FormatInt(version, 10), 1)
+			switch err {
+			case nil:
+			case vkv.ErrNotFound:
+				// The document was created after the snapshot
+				continue
+			default:
+				return err
+			}
+			id := strings.TrimPrefix(kv.Key, prefix)
+			if err := call("mark_docstore_doc", collection, id, strconv.FormatInt(versions.Versions[0].Version, 10)); err != nil {
+				return err
+			}
+		}
+		if len(keys) < 100 {
+			return nil
+		}
+		start = keys[len(keys)-1].Key + "\x00"
+	}
+}
+
 // FIXME(tsileo): have a single share "Lua lib" for all the Lua interactions (GC, document store...)
 func loadNode(L *lua.LState) int {
 	// register functions to the table
@@ -2,6 +2,7 @@ package gc
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"os"
 	"testing"
@@ -15,6 +16,7 @@ import (
 	"a4.io/blobstash/pkg/hub"
 	kstore "a4.io/blobstash/pkg/kvstore"
 	"a4.io/blobstash/pkg/meta"
+	"a4.io/blobstash/pkg/snapshots"
 	"a4.io/blobstash/pkg/stash"
 )
 
@@ -59,7 +61,7 @@ func TestDataContextMerge(t *testing.T) {
 	}
 	defer s.Close()
 
-	blobsRoot, _, err := s.Root().BlobStore().Enumerate(context.Background(), "", "\xff", 0)
+	blobsRoot, err := s.Root().BlobStore().Enumerate(context.Background(), &blob.Range{})
 	if err != nil {
 		panic(err)
 	}
@@ -72,13 +74,16 @@ func TestDataContextMerge(t *testing.T) {
 		panic(err)
 	}
 	blobsIdx := map[string]*blob.Blob{}
-	var lastBlob *blob.Blob
+	var firstBlob, lastBlob *blob.Blob
 	for i := 0; i < 5; i++ {
 		b := makeBlob([]byte(fmt.Sprintf("hello%d", i)))
 		if _, err := tmpDataContext.BlobStoreProxy().Put(context.TODO(), b); err != nil {
 			panic(err)
 		}
 		blobsIdx[b.Hash] = b
+		if firstBlob == nil {
+			firstBlob = b
+		}
 		lastBlob = b
 	}
 
@@ -86,7 +91,17 @@ func TestDataContextMerge(t *testing.T) {
 		panic(err)
 	}
 
-	blobsRoot, _, err = s.Root().BlobStore().Enumerate(context.Background(), "", "\xff", 0)
+	// The snapshots are GC roots
+	snap := &snapshots.Snapshot{ID: "20", Name: "first", Type: snapshots.TypeBlob, Ref: firstBlob.Hash, CreatedAt: 20}
+	encoded, err := json.Marshal(snap)
+	if err != nil {
+		panic(err)
+	}
+	if _, err := tmpDataContext.KvStore().Put(context.TODO(), snap.Key(), snap.Ref, encoded, snap.CreatedAt); err != nil {
+		panic(err)
+	}
+
+	blobsRoot, err = s.Root().BlobStore().Enumerate(context.Background(), &blob.Range{})
 	if err != nil {
 		panic(err)
 	}
@@ -98,12 +113,22 @@ func TestDataContextMerge(t *testing.T) {
 		panic(err)
 	}
 
-	blobsRoot, _, err = s.Root().BlobStore().Enumerate(context.Background(), "", "\xff", 0)
+	blobsRoot, err = s.Root().BlobStore().Enumerate(context.Background(), &blob.Range{})
 	if err != nil {
 		panic(err)
 	}
-	if len(blobsRoot) != 2 {
-		t.Errorf("root blobstore should contains 2 blobs, got %d", len(blobsRoot))
+	// The kv and its ref, the snapshot and its ref
+	if len(blobsRoot) != 4 {
+		t.Errorf("root blobstore should contains 4 blobs, got %d", len(blobsRoot))
+	}
+	var found bool
+	for _, ref := range blobsRoot {
+		if ref.Hash == firstBlob.Hash {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("the snapshot ref should have been merged")
 	}
 
 	// FIXME(tsileo): try to read the kv and the blob in the root data context
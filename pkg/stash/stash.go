@@ -7,6 +7,7 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
 	log "github.com/inconshreveable/log15"
 
@@ -20,6 +21,7 @@ import (
 	"a4.io/blobstash/pkg/meta"
 	"a4.io/blobstash/pkg/stash/store"
 	"a4.io/blobstash/pkg/vkv"
+	"a4.io/blobstash/pkg/worm"
 )
 
 type dataContext struct {
@@ -65,7 +67,7 @@ func (dc *dataContext) Merge(ctx context.Context) error {
 		return nil
 	}
 
-	blobs, _, err := dc.bs.Enumerate(ctx, "", "\xff", 0)
+	blobs, err := dc.bs.Enumerate(ctx, &blob.Range{})
 	if err != nil {
 		return err
 	}
@@ -196,13 +198,61 @@ func (dc *dataContext) Destroy() error {
 	return os.RemoveAll(dc.dir)
 }
 
+// lastWrite returns the time of the last write in the data context (the latest modification time of its files)
+func (dc *dataContext) lastWrite() (time.Time, error) {
+	var last time.Time
+	err := filepath.Walk(dc.dir, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(last) {
+			last = info.ModTime()
+		}
+		return nil
+	})
+	return last, err
+}
+
+// checkRetention returns an error if the data context is protected by a WORM policy
+func (dc *dataContext) checkRetention(name string) error {
+	if worm.NamespaceRetention(name) == 0 {
+		return nil
+	}
+	last, err := dc.lastWrite()
+	if err != nil {
+		return err
+	}
+	return worm.CheckNamespace(name, last)
+}
+
 type Stash struct {
 	rootDataContext *dataContext
 	contexes        map[string]*dataContext
 	path            string
+	isolated        func(string) bool
+	kvCheck         func(context.Context, string, string) error
 	sync.Mutex
 }
 
+// SetIsolated sets the func reporting the isolated data contexts (that can't read from the root data context)
+func (s *Stash) SetIsolated(isolated func(string) bool) {
+	s.Lock()
+	defer s.Unlock()
+	s.isolated = isolated
+	for name, dc := range s.contexes {
+		dc.bsProxy.(*store.BlobStoreProxy).Isolated = isolated(name)
+		dc.kvsProxy.(*store.KvStoreProxy).Isolated = isolated(name)
+	}
+}
+
+// SetKvWriteCheck sets the func called before each kv write (with the key and the ref), the write is refused if it
+// returns an error (used to enforce the WORM policies on the FS keys)
+func (s *Stash) SetKvWriteCheck(check func(ctx context.Context, key, ref string) error) {
+	s.Lock()
+	defer s.Unlock()
+	s.kvCheck = check
+}
+
 func (s *Stash) destroy(dataContext *dataContext, name string) error {
 	if dataContext.root {
 		return fmt.Errorf("cannot destroy the root data context")
@@ -272,17 +322,24 @@ func (s *Stash) NewDataContext(name string) (*dataContext, error) {
 	if err != nil {
 		return nil, err
 	}
+	// The reads are tracked in the root access index
+	if root, ok := s.rootDataContext.bs.(*blobstore.BlobStore); ok {
+		bsDst.ShareAccessTracking(root)
+	}
+	isolated := s.isolated != nil && s.isolated(name)
 	bs := &store.BlobStoreProxy{
 		BlobStore: bsDst,
 		ReadSrc:   s.rootDataContext.bs,
+		Isolated:  isolated,
 	}
 	kvsDst, err := kvstore.New(l.New("app", "kvstore"), path, bs, m)
 	if err != nil {
 		return nil, err
 	}
 	kvs := &store.KvStoreProxy{
-		KvStore: kvsDst,
-		ReadSrc: s.rootDataContext.kvs,
+		KvStore:  kvsDst,
+		ReadSrc:  s.rootDataContext.kvs,
+		Isolated: isolated,
 	}
 	dataCtx := &dataContext{
 		bsDst:    bsDst,
@@ -322,6 +379,10 @@ func (s *Stash) DoAndDestroy(ctx context.Context, name string, do func(context.C
 	}
 	s.Unlock()
 
+	// Check the retention before, `do` may already drop some data
+	if err := dc.checkRetention(name); err != nil {
+		return err
+	}
 	if err := do(ctx, dc); err != nil {
 		return err
 	}
@@ -342,6 +403,9 @@ func (s *Stash) MergeFileTreeVersionAndDestroy(ctx context.Context, name string,
 	if !ok {
 		return fmt.Errorf("data context not found")
 	}
+	if err := dc.checkRetention(name); err != nil {
+		return err
+	}
 
 	refs, err := dc.MergeFileTreeVersion(ctx, key, version)
 	if err != nil {
@@ -406,6 +470,9 @@ func (s *Stash) Destroy(ctx context.Context, name string) error {
 	if !ok {
 		return fmt.Errorf("data context not found")
 	}
+	if err := dc.checkRetention(name); err != nil {
+		return err
+	}
 
 	if err := s.destroy(dc, name); err != nil {
 		return err
@@ -450,6 +517,42 @@ func (s *Stash) DataContextByName(name string) (*dataContext, bool) {
 	return nil, false
 }
 
+// NamespacesBlobStores returns the blob store of each namespace (data context)
+func (s *Stash) NamespacesBlobStores() map[string]*blobstore.BlobStore {
+	s.Lock()
+	defer s.Unlock()
+	out := map[string]*blobstore.BlobStore{}
+	for name, dc := range s.contexes {
+		if bs, ok := dc.bsDst.(*blobstore.BlobStore); ok && !dc.closed {
+			out[name] = bs
+		}
+	}
+	return out
+}
+
+// NamespacesStats returns the blobs usage of each namespace (data context)
+func (s *Stash) NamespacesStats() ([]*blobstore.NamespaceStats, error) {
+	s.Lock()
+	defer s.Unlock()
+	out := []*blobstore.NamespaceStats{}
+	for name, dc := range s.contexes {
+		bs, ok := dc.bsDst.(*blobstore.BlobStore)
+		if !ok || dc.closed {
+			continue
+		}
+		stats, err := bs.Stats()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, &blobstore.NamespaceStats{
+			Name:       name,
+			BlobsCount: stats.BlobsCount,
+			BlobsSize:  stats.BlobsSize,
+		})
+	}
+	return out, nil
+}
+
 func (s *Stash) BlobStore() *BlobStore {
 	return &BlobStore{s}
 }
@@ -490,12 +593,12 @@ func (bs *BlobStore) Stat(ctx context.Context, hash string) (bool, error) {
 
 }
 
-func (bs *BlobStore) Enumerate(ctx context.Context, start, end string, limit int) ([]*blob.SizedBlobRef, string, error) {
+func (bs *BlobStore) Enumerate(ctx context.Context, r *blob.Range) ([]*blob.SizedBlobRef, error) {
 	dataContext, err := bs.s.dataContext(ctx)
 	if err != nil {
-		return nil, "", err
+		return nil, err
 	}
-	return dataContext.BlobStoreProxy().Enumerate(ctx, start, end, limit)
+	return dataContext.BlobStoreProxy().Enumerate(ctx, r)
 }
 
 type KvStore struct {
@@ -505,6 +608,14 @@ type KvStore struct {
 func (kv *KvStore) Close() error { return nil }
 
 func (kv *KvStore) Put(ctx context.Context, key, ref string, data []byte, version int64) (*vkv.KeyValue, error) {
+	kv.s.Lock()
+	check := kv.s.kvCheck
+	kv.s.Unlock()
+	if check != nil {
+		if err := check(ctx, key, ref); err != nil {
+			return nil, err
+		}
+	}
 	dataContext, err := kv.s.dataContext(ctx)
 	if err != nil {
 		return nil, err
@@ -57,7 +57,7 @@ func TestDataContextMerge(t *testing.T) {
 	}
 	defer s.Close()
 
-	blobsRoot, _, err := s.rootDataContext.bs.Enumerate(context.Background(), "", "\xff", 0)
+	blobsRoot, err := s.rootDataContext.bs.Enumerate(context.Background(), &blob.Range{})
 	if err != nil {
 		panic(err)
 	}
@@ -78,7 +78,7 @@ func TestDataContextMerge(t *testing.T) {
 		blobsIdx[b.Hash] = b
 	}
 
-	blobsRoot, _, err = s.Root().BlobStore().Enumerate(context.Background(), "", "\xff", 0)
+	blobsRoot, err = s.Root().BlobStore().Enumerate(context.Background(), &blob.Range{})
 	if err != nil {
 		panic(err)
 	}
@@ -90,7 +90,7 @@ func TestDataContextMerge(t *testing.T) {
 		panic(err)
 	}
 
-	blobsRoot, _, err = s.rootDataContext.bs.Enumerate(context.Background(), "", "\xff", 0)
+	blobsRoot, err = s.rootDataContext.bs.Enumerate(context.Background(), &blob.Range{})
 	if err != nil {
 		panic(err)
 	}
@@ -9,7 +9,6 @@ import (
 
 	"a4.io/blobsfile"
 	"a4.io/blobstash/pkg/blob"
-	"a4.io/blobstash/pkg/blobstore"
 	"a4.io/blobstash/pkg/vkv"
 )
 
@@ -91,10 +90,13 @@ type KvStore interface {
 type KvStoreProxy struct {
 	KvStore
 	ReadSrc KvStore
+
+	// Isolated prevents reading from the source
+	Isolated bool
 }
 
 func (p *KvStoreProxy) Put(ctx context.Context, key, ref string, data []byte, version int64) (*vkv.KeyValue, error) {
-	if version > 0 {
+	if version > 0 && !p.Isolated {
 		kv, err := p.ReadSrc.Get(ctx, key, version)
 		switch err {
 		case vkv.ErrNotFound:
@@ -109,6 +111,9 @@ func (p *KvStoreProxy) Put(ctx context.Context, key, ref string, data []byte, ve
 }
 
 func (p *KvStoreProxy) Get(ctx context.Context, key string, version int64) (*vkv.KeyValue, error) {
+	if p.Isolated {
+		return p.KvStore.Get(ctx, key, version)
+	}
 	kv, err := p.KvStore.Get(ctx, key, version)
 	switch err {
 	case nil:
@@ -133,6 +138,9 @@ func (p *KvStoreProxy) Get(ctx context.Context, key string, version int64) (*vkv
 }
 
 func (p *KvStoreProxy) GetMetaBlob(ctx context.Context, key string, version int64) (string, error) {
+	if p.Isolated {
+		return p.KvStore.GetMetaBlob(ctx, key, version)
+	}
 	h, err := p.KvStore.GetMetaBlob(ctx, key, version)
 	switch err {
 	case nil:
@@ -145,6 +153,9 @@ func (p *KvStoreProxy) GetMetaBlob(ctx context.Context, key string, version int6
 }
 
 func (p *KvStoreProxy) Versions(ctx context.Context, key, start string, limit int) (*vkv.KeyValueVersions, string, error) {
+	if p.Isolated {
+		return p.KvStore.Versions(ctx, key, start, limit)
+	}
 	var tmp []*sortHelper
 	var out []*vkv.KeyValue
 	res := &vkv.KeyValueVersions{
@@ -204,6 +215,9 @@ func (p *KvStoreProxy) Versions(ctx context.Context, key, start string, limit in
 }
 
 func (p *KvStoreProxy) ReverseKeys(ctx context.Context, start, end string, limit int) ([]*vkv.KeyValue, string, error) {
+	if p.Isolated {
+		return p.KvStore.ReverseKeys(ctx, start, end, limit)
+	}
 	var tmp []*sortHelper
 	var out []*vkv.KeyValue
 
@@ -252,6 +266,9 @@ func (p *KvStoreProxy) ReverseKeys(ctx context.Context, start, end string, limit
 }
 
 func (p *KvStoreProxy) Keys(ctx context.Context, start, end string, limit int) ([]*vkv.KeyValue, string, error) {
+	if p.Isolated {
+		return p.KvStore.Keys(ctx, start, end, limit)
+	}
 	var tmp []*sortHelper
 	var out []*vkv.KeyValue
 
@@ -303,13 +320,16 @@ type BlobStore interface {
 	Put(ctx context.Context, blob *blob.Blob) (bool, error)
 	Get(ctx context.Context, hash string) ([]byte, error)
 	Stat(ctx context.Context, hash string) (bool, error)
-	Enumerate(ctx context.Context, start, end string, limit int) ([]*blob.SizedBlobRef, string, error)
+	Enumerate(ctx context.Context, r *blob.Range) ([]*blob.SizedBlobRef, error)
 	Close() error
 }
 
 type BlobStoreProxy struct {
 	BlobStore
 	ReadSrc BlobStore
+
+	// Isolated prevents reading from the source (the blobs are always stored locally)
+	Isolated bool
 }
 
 func (p *BlobStoreProxy) Get(ctx context.Context, hash string) ([]byte, error) {
@@ -317,6 +337,9 @@ func (p *BlobStoreProxy) Get(ctx context.Context, hash string) ([]byte, error) {
 	switch err {
 	case nil:
 	case blobsfile.ErrBlobNotFound:
+		if p.Isolated {
+			return nil, err
+		}
 		return p.ReadSrc.Get(ctx, hash)
 	default:
 		return nil, err
@@ -329,70 +352,61 @@ func (p *BlobStoreProxy) Stat(ctx context.Context, hash string) (bool, error) {
 	if err != nil {
 		return false, err
 	}
-	if !exists {
+	if !exists && !p.Isolated {
 		return p.ReadSrc.Stat(ctx, hash)
 	}
 	return exists, nil
 }
 
 func (p *BlobStoreProxy) Put(ctx context.Context, blob *blob.Blob) (bool, error) {
+	if p.Isolated {
+		return p.BlobStore.Put(ctx, blob)
+	}
 	existsSrc, err := p.ReadSrc.Stat(ctx, blob.Hash)
 	if err != nil {
 		return false, err
 	}
 	if existsSrc {
-		return true, nil
+		// Already stored in the source, nothing saved
+		return false, nil
 	}
 	return p.BlobStore.Put(ctx, blob)
 }
 
-func (p *BlobStoreProxy) Enumerate(ctx context.Context, start, end string, limit int) ([]*blob.SizedBlobRef, string, error) {
-	// Here, we will need to merge two differents "enumerate results" into one
-	var tmp []*sortHelper
-	var out []*blob.SizedBlobRef
-
-	mcursor := parseCursor(start)
-
-	// Fetch the data from the "root" blobstore
-	rootBlobs, _, err := p.ReadSrc.Enumerate(ctx, mcursor.rstart, end, limit)
-	if err != nil {
-		return nil, "", err
-	}
-
-	for _, blob := range rootBlobs {
-		tmp = append(tmp, &sortHelper{blob, true})
+func (p *BlobStoreProxy) Enumerate(ctx context.Context, r *blob.Range) ([]*blob.SizedBlobRef, error) {
+	if p.Isolated {
+		return p.BlobStore.Enumerate(ctx, r)
 	}
-
-	// Fetch the data from the stash
-	localBlobs, _, err := p.BlobStore.Enumerate(ctx, mcursor.sstart, end, 0)
+	// Merge the blobs from the "root" blobstore and the stash, as the hashes are the pagination keys, the next page
+	// can be fetched from both with the same range
+	rootBlobs, err := p.ReadSrc.Enumerate(ctx, r)
 	if err != nil {
-		return nil, "", err
+		return nil, err
 	}
-
-	for _, blob := range localBlobs {
-		tmp = append(tmp, &sortHelper{blob, false})
+	localBlobs, err := p.BlobStore.Enumerate(ctx, r)
+	if err != nil {
+		return nil, err
 	}
 
-	// Sort everything
-	sort.Slice(tmp, func(i, j int) bool {
-		return tmp[i].Item.(*blob.SizedBlobRef).Hash > tmp[j].Item.(*blob.SizedBlobRef).Hash
-	})
-
-	// Slice it if it's too big
-	if len(tmp) > 0 && len(tmp) > limit {
-		tmp = tmp[0:limit]
+	out := make([]*blob.SizedBlobRef, 0, len(rootBlobs)+len(localBlobs))
+	seen := map[string]struct{}{}
+	for _, refs := range [][]*blob.SizedBlobRef{rootBlobs, localBlobs} {
+		for _, ref := range refs {
+			if _, ok := seen[ref.Hash]; ok {
+				continue
+			}
+			seen[ref.Hash] = struct{}{}
+			out = append(out, ref)
+		}
 	}
-
-	// Build the final result, and compute the "merge cursor"
-	for _, sh := range tmp {
-		b := sh.Item.(*blob.SizedBlobRef)
-		if sh.IsFromRoot {
-			mcursor.rcursor = b.Hash
-		} else {
-			mcursor.scursor = b.Hash
+	sort.Slice(out, func(i, j int) bool {
+		if r.Reverse {
+			return out[i].Hash > out[j].Hash
 		}
-		out = append(out, b)
+		return out[i].Hash < out[j].Hash
+	})
+	if r.Limit > 0 && len(out) > r.Limit {
+		out = out[:r.Limit]
 	}
-
-	return out, mcursor.Encode(blobstore.NextHexKey), nil
+	return out, nil
 }
@@ -7,8 +7,11 @@ import (
 	"time"
 
 	"a4.io/blobstash/pkg/blob"
+	bsclient "a4.io/blobstash/pkg/client/blobstore"
 	"a4.io/blobstash/pkg/client/clientutil"
+	"a4.io/blobstash/pkg/signing"
 	"a4.io/blobstash/pkg/stash/store"
+	"a4.io/blobstash/pkg/throttle"
 
 	log "github.com/inconshreveable/log15"
 )
@@ -32,6 +35,7 @@ func NewSyncClient(logger log.Logger, st *Sync, state *StateTree, blobstore stor
 		oneWay:    oneWay,
 		state:     state,
 		blobstore: blobstore,
+		log:       logger,
 	}
 }
 
@@ -81,6 +85,9 @@ type SyncStats struct {
 
 // Get fetch the given blob from the remote BlobStash instance.
 func (stc *SyncClient) remotePutBlob(hash string, blob []byte) error {
+	if err := throttle.Upload().WaitN(context.TODO(), len(blob)); err != nil {
+		return err
+	}
 	resp, err := stc.client.Post(fmt.Sprintf("/api/blobstore/blob/%s", hash), blob)
 	if err != nil {
 		return err
@@ -109,7 +116,14 @@ func (stc *SyncClient) remoteGetBlob(hash string) ([]byte, error) {
 		return nil, err
 	}
 
-	return clientutil.Decode(resp)
+	data, err := clientutil.Decode(resp)
+	if err != nil {
+		return nil, err
+	}
+	if err := throttle.Download().WaitN(context.TODO(), len(data)); err != nil {
+		return nil, err
+	}
+	return data, nil
 }
 
 func (stc *SyncClient) putBlob(hash string, data []byte) (bool, error) {
@@ -117,6 +131,10 @@ func (stc *SyncClient) putBlob(hash string, data []byte) (bool, error) {
 	if err := blob.Check(); err != nil {
 		return false, err
 	}
+	// Reject the FS roots/snapshots that were tampered with
+	if err := signing.CheckMetaBlob(data); err != nil {
+		return false, fmt.Errorf("blob %s rejected: %w", hash, err)
+	}
 	return stc.blobstore.Put(context.Background(), blob)
 }
 
@@ -249,18 +267,8 @@ func (stc *SyncClient) Sync() (*SyncStats, error) {
 	}
 
 	// Upload blobs to the remote BlobStash instances
-	for _, h := range upHashes {
-		blob, err := stc.getBlob(h)
-		if err != nil {
-			return nil, err
-		}
-
-		stats.Downloaded++
-		stats.DownloadedSize += len(blob)
-
-		if err := stc.remotePutBlob(h, blob); err != nil {
-			return nil, err
-		}
+	if err := stc.sendBlobs(upHashes, stats); err != nil {
+		return nil, err
 	}
 
 	// Pull missing blobs from remote BlobStash instances
@@ -282,6 +290,57 @@ func (stc *SyncClient) Sync() (*SyncStats, error) {
 	return stats, nil
 }
 
+// sendBlobs uploads the blobs over a single stream (or one request per blob if the remote instance does not support
+// the blobs upload stream)
+func (stc *SyncClient) sendBlobs(hashes []string, stats *SyncStats) error {
+	if len(hashes) == 0 {
+		return nil
+	}
+	stream, err := bsclient.New(stc.client).Stream(context.TODO())
+	if err != nil {
+		if bsErr, ok := err.(*clientutil.BadStatusCodeError); !ok || !bsErr.IsNotFound() {
+			return err
+		}
+		stc.log.Debug("blobs upload stream not supported by the remote, falling back to one request per blob")
+		for _, h := range hashes {
+			blob, err := stc.getBlob(h)
+			if err != nil {
+				return err
+			}
+
+			stats.Downloaded++
+			stats.DownloadedSize += len(blob)
+
+			if err := stc.remotePutBlob(h, blob); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, h := range hashes {
+		blob, err := stc.getBlob(h)
+		if err != nil {
+			stream.Close()
+			return err
+		}
+
+		stats.Downloaded++
+		stats.DownloadedSize += len(blob)
+
+		if err := throttle.Upload().WaitN(context.TODO(), len(blob)); err != nil {
+			stream.Close()
+			return err
+		}
+		if err := stream.Put(h, blob); err != nil {
+			stream.Close()
+			return err
+		}
+	}
+	_, _, err = stream.Close()
+	return err
+}
+
 func slice2map(items []string) map[string]struct{} {
 	res := map[string]struct{}{}
 	for _, item := range items {
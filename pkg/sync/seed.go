@@ -0,0 +1,264 @@
+package sync // import "a4.io/blobstash/pkg/sync"
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"a4.io/blobsfile"
+	"github.com/gorilla/mux"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/client/clientutil"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/signing"
+	"a4.io/blobstash/pkg/throttle"
+)
+
+// Full-seed mode
+//
+// Bootstrapping an empty replica with the Merkle sync requires one request per blob, instead, the source lists
+// its sealed BlobsFiles (the seed manifest, with the hashes of each pack) and streams all the blobs of a pack
+// in a single response. Once seeded, the regular sync takes care of the live tail (the blobs stored in the
+// BlobsFile currently being written).
+//
+// Each blob of a pack stream is framed as: <32 bytes hash><4 bytes big endian size><data> (see `blob.WriteFrame`).
+
+// sealedPacker is implemented by the (root) blob store
+type sealedPacker interface {
+	SealedPacks() []string
+}
+
+// SeedPack holds the index manifest of a sealed BlobsFile
+type SeedPack struct {
+	Name   string   `json:"name"`
+	Hashes []string `json:"hashes"`
+}
+
+// SeedManifest lists the sealed BlobsFiles available for seeding
+type SeedManifest struct {
+	Packs []*SeedPack `json:"packs"`
+}
+
+// SeedStats holds the stats of a full-seed
+type SeedStats struct {
+	Packs          int    `json:"packs"`
+	PacksSkipped   int    `json:"packs_skipped"`
+	Downloaded     int    `json:"blobs_downloaded"`
+	DownloadedSize int    `json:"downloaded_size"`
+	Duration       string `json:"seed_duration"`
+}
+
+func (st *Sync) sealedPacks() ([]string, error) {
+	sp, ok := st.blobstore.(sealedPacker)
+	if !ok {
+		return nil, fmt.Errorf("blob store does not support seeding")
+	}
+	return sp.SealedPacks(), nil
+}
+
+// SeedManifest returns the manifest of the sealed BlobsFiles
+func (st *Sync) SeedManifest() (*SeedManifest, error) {
+	packs, err := st.sealedPacks()
+	if err != nil {
+		return nil, err
+	}
+	manifest := &SeedManifest{Packs: []*SeedPack{}}
+	for _, pack := range packs {
+		hashes, err := blobsfile.ScanBlobsFile(pack)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan %s: %v", pack, err)
+		}
+		manifest.Packs = append(manifest.Packs, &SeedPack{Name: filepath.Base(pack), Hashes: hashes})
+	}
+	return manifest, nil
+}
+
+func (st *Sync) seedManifestHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		manifest, err := st.SeedManifest()
+		if err != nil {
+			panic(err)
+		}
+		httputil.WriteJSON(w, manifest)
+	}
+}
+
+func (st *Sync) seedPackHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["pack"]
+		packs, err := st.sealedPacks()
+		if err != nil {
+			panic(err)
+		}
+		var path string
+		for _, pack := range packs {
+			if filepath.Base(pack) == name {
+				path = pack
+				break
+			}
+		}
+		if path == "" {
+			httputil.WriteJSONError(w, http.StatusNotFound, fmt.Sprintf("no sealed pack %q", name))
+			return
+		}
+		hashes, err := blobsfile.ScanBlobsFile(path)
+		if err != nil {
+			panic(err)
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		bw := bufio.NewWriter(w)
+		for _, h := range hashes {
+			data, err := st.blobstore.Get(r.Context(), h)
+			if err != nil {
+				// The headers are already sent, the client will detect the truncated stream
+				st.log.Error("failed to stream pack", "pack", name, "hash", h, "err", err)
+				return
+			}
+			if err := blob.WriteFrame(bw, h, data); err != nil {
+				st.log.Error("failed to stream pack", "pack", name, "err", err)
+				return
+			}
+		}
+		if err := bw.Flush(); err != nil {
+			st.log.Error("failed to stream pack", "pack", name, "err", err)
+		}
+	}
+}
+
+// readSeedBlob reads the next blob of a pack stream (returns `io.EOF` at the end of the stream)
+func readSeedBlob(r io.Reader) (*blob.Blob, error) {
+	b, err := blob.ReadFrame(r, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.Check(); err != nil {
+		return nil, err
+	}
+	if err := signing.CheckMetaBlob(b.Data); err != nil {
+		return nil, fmt.Errorf("blob %s rejected: %w", b.Hash, err)
+	}
+	return b, nil
+}
+
+// RemoteSeedManifest fetches the seed manifest of the remote instance
+func (stc *SyncClient) RemoteSeedManifest() (*SeedManifest, error) {
+	manifest := &SeedManifest{}
+	resp, err := stc.client.Get("/api/sync/seed")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := clientutil.ExpectStatusCode(resp, http.StatusOK); err != nil {
+		return nil, err
+	}
+	if err := clientutil.Unmarshal(resp, manifest); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// missingBlobs returns the number of blobs of the pack not stored locally
+func (stc *SyncClient) missingBlobs(pack *SeedPack) (int, error) {
+	missing := 0
+	for _, h := range pack.Hashes {
+		exists, err := stc.blobstore.Stat(context.Background(), h)
+		if err != nil {
+			return 0, err
+		}
+		if !exists {
+			missing++
+		}
+	}
+	return missing, nil
+}
+
+func (stc *SyncClient) seedPack(pack *SeedPack, stats *SeedStats) error {
+	resp, err := stc.client.Get(fmt.Sprintf("/api/sync/seed/%s", pack.Name))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := clientutil.ExpectStatusCode(resp, http.StatusOK); err != nil {
+		return err
+	}
+	br := bufio.NewReader(throttle.Download().Reader(context.TODO(), resp.Body))
+	cnt := 0
+	for {
+		b, err := readSeedBlob(br)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read pack %s: %v", pack.Name, err)
+		}
+		if _, err := stc.blobstore.Put(context.Background(), b); err != nil {
+			return err
+		}
+		cnt++
+		stats.Downloaded++
+		stats.DownloadedSize += len(b.Data)
+	}
+	if cnt != len(pack.Hashes) {
+		return fmt.Errorf("truncated pack %s: got %d blobs, expected %d", pack.Name, cnt, len(pack.Hashes))
+	}
+	return nil
+}
+
+// Seed downloads all the sealed BlobsFiles of the remote instance, the packs already stored locally are
+// skipped (so an interrupted seed can be resumed). A regular sync is still needed afterwards.
+func (stc *SyncClient) Seed() (*SeedStats, error) {
+	start := time.Now()
+	stats := &SeedStats{}
+	manifest, err := stc.RemoteSeedManifest()
+	if err != nil {
+		return nil, err
+	}
+	for _, pack := range manifest.Packs {
+		missing, err := stc.missingBlobs(pack)
+		if err != nil {
+			return nil, err
+		}
+		if missing == 0 {
+			stats.PacksSkipped++
+			continue
+		}
+		stc.log.Info("seeding pack", "pack", pack.Name, "blobs", len(pack.Hashes), "missing", missing)
+		if err := stc.seedPack(pack, stats); err != nil {
+			return nil, err
+		}
+		stats.Packs++
+	}
+	stats.Duration = time.Since(start).String()
+	return stats, nil
+}
+
+// Seed bootstraps the local blob store from the sealed BlobsFiles of the remote instance, then runs a regular
+// one-way sync for the remaining blobs
+func (st *Sync) Seed(url, apiKey string) (*SeedStats, *SyncStats, error) {
+	client := NewSyncClient(st.log.New("submodule", "synctable-client"), st, nil, st.blobstore, url, apiKey, true)
+	seedStats, err := client.Seed()
+	if err != nil {
+		return nil, nil, err
+	}
+	st.log.Info("seed done", "stats", seedStats)
+	syncStats, err := st.Sync(url, apiKey, true)
+	if err != nil {
+		return seedStats, nil, err
+	}
+	return seedStats, syncStats, nil
+}
+
+// IsEmpty returns true if the local blob store has no blobs
+func (st *Sync) IsEmpty() (bool, error) {
+	blobs, err := st.blobstore.Enumerate(context.Background(), &blob.Range{Limit: 1})
+	if err != nil {
+		return false, err
+	}
+	return len(blobs) == 0, nil
+}
@@ -19,7 +19,9 @@ import (
 	"hash"
 	"net/http"
 	"sync"
+	"time"
 
+	"a4.io/blobstash/pkg/blob"
 	"a4.io/blobstash/pkg/config"
 	"a4.io/blobstash/pkg/httputil"
 	"a4.io/blobstash/pkg/stash/store"
@@ -53,6 +55,9 @@ type Sync struct {
 	blobstore store.BlobStore
 	conf      *config.Config
 
+	lastSync time.Time
+	mu       sync.Mutex
+
 	log log2.Logger
 }
 
@@ -69,6 +74,8 @@ func (st *Sync) Register(r *mux.Router, basicAuth func(http.Handler) http.Handle
 	r.Handle("/state", basicAuth(http.HandlerFunc(st.stateHandler())))
 	r.Handle("/state/leaf/{prefix}", basicAuth(http.HandlerFunc(st.stateLeafHandler())))
 	r.Handle("/_trigger", basicAuth(http.HandlerFunc(st.triggerHandler())))
+	r.Handle("/seed", basicAuth(http.HandlerFunc(st.seedManifestHandler())))
+	r.Handle("/seed/{pack}", basicAuth(http.HandlerFunc(st.seedPackHandler())))
 }
 
 func (st *Sync) Client(url, apiKey string, oneWay bool) *SyncClient {
@@ -82,7 +89,21 @@ func (st *Sync) Sync(url, apiKey string, oneWay bool) (*SyncStats, error) {
 	rawState := st.generateTree()
 	defer rawState.Close()
 	client := NewSyncClient(st.log.New("submodule", "synctable-client"), st, rawState, st.blobstore, url, apiKey, oneWay)
-	return client.Sync()
+	stats, err := client.Sync()
+	if err != nil {
+		return nil, err
+	}
+	st.mu.Lock()
+	st.lastSync = time.Now()
+	st.mu.Unlock()
+	return stats, nil
+}
+
+// LastSync returns the time of the last successful sync (zero if none)
+func (st *Sync) LastSync() time.Time {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.lastSync
 }
 
 func (st *Sync) triggerHandler() func(http.ResponseWriter, *http.Request) {
@@ -104,7 +125,7 @@ func (st *Sync) triggerHandler() func(http.ResponseWriter, *http.Request) {
 
 func (st *Sync) generateTree() *StateTree {
 	state := NewStateTree()
-	blobs, _, err := st.blobstore.Enumerate(context.Background(), "", "\xff", 0)
+	blobs, err := st.blobstore.Enumerate(context.Background(), &blob.Range{})
 	if err != nil {
 		panic(err)
 	}
@@ -134,7 +155,7 @@ func (st *State) String() string {
 }
 
 func (st *Sync) LeafState(prefix string) (*LeafState, error) {
-	blobs, _, err := st.blobstore.Enumerate(context.Background(), prefix, prefix+"\xff", 0)
+	blobs, err := st.blobstore.Enumerate(context.Background(), blob.PrefixRange(prefix))
 	if err != nil {
 		panic(err)
 	}
@@ -0,0 +1,110 @@
+/*
+Package tenant implements the per-tenant isolation of the data.
+
+A tenant is tied to an API key (the `tenant` field of the `auth` config). The names of the resources (the kv keys,
+the docstore collections, the FS names and the blob namespaces) requested by a tenant are automatically prefixed with
+`{tenant}.` by the auth middleware, so a tenant can only access (and list) its own resources. The API keys without
+tenant are not affected (and see the prefixed names).
+
+The requests of a tenant always target one of its namespaces (`{tenant}.` by default), and the tenant namespaces don't
+read from the shared root namespace, so the blobs of a tenant can't be enumerated nor read by another tenant. The refs
+(blob hashes and filetree node refs) can't be prefixed, they're checked by reading them in the tenant namespace, a ref
+owned by another tenant is not found. The handlers that also accept a bewit (and are not behind the auth middleware)
+enforce the tenant after checking the API key.
+*/
+package tenant // import "a4.io/blobstash/pkg/tenant"
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/ctxutil"
+)
+
+// Separator between the tenant name and the resource name
+const Separator = "."
+
+// Prefix returns the prefix of the resources owned by the tenant
+func Prefix(tenant string) string {
+	return tenant + Separator
+}
+
+// FromRequest returns the tenant of the authenticated request (empty if none)
+func FromRequest(r *http.Request) string {
+	return auth.Tenant(r)
+}
+
+// Name returns the name of the resource for the tenant of the request
+func Name(r *http.Request, name string) string {
+	if t := FromRequest(r); t != "" {
+		return Prefix(t) + name
+	}
+	return name
+}
+
+// Strip removes the tenant prefix from the resource name, returns false if the resource is not owned by the tenant of
+// the request
+func Strip(r *http.Request, name string) (string, bool) {
+	t := FromRequest(r)
+	if t == "" {
+		return name, true
+	}
+	if !strings.HasPrefix(name, Prefix(t)) {
+		return "", false
+	}
+	return strings.TrimPrefix(name, Prefix(t)), true
+}
+
+// Enforce prefixes the resource names of the request (URL vars, query args and namespace header) with the tenant prefix,
+// the request is updated in place
+func Enforce(r *http.Request, tenant string) {
+	prefix := Prefix(tenant)
+	vars := mux.Vars(r)
+	for _, name := range []string{"key", "collection"} {
+		if v, ok := vars[name]; ok {
+			vars[name] = prefix + v
+		}
+	}
+	// The filetree FS (the node refs are checked by reading them in the tenant namespace)
+	if v, ok := vars["name"]; ok && (vars["type"] == "fs" || vars["type"] == "tag") {
+		vars["name"] = prefix + v
+	}
+
+	// Query args referencing other resources (kv rename target, merged FS and blob namespace)
+	q := r.URL.Query()
+	var updated bool
+	for _, name := range []string{"to", "fs", "ns"} {
+		if v := q.Get(name); v != "" {
+			q.Set(name, prefix+v)
+			updated = true
+		}
+	}
+	if updated {
+		r.URL.RawQuery = q.Encode()
+	}
+
+	// Namespaces (the shared root namespace is replaced by the tenant namespace)
+	r.Header.Set(ctxutil.NamespaceHeader, prefix+r.Header.Get(ctxutil.NamespaceHeader))
+}
+
+// Isolated returns a func that reports whether the namespace is owned by one of the configured tenants
+func Isolated(conf *config.Config) func(string) bool {
+	tenants := map[string]struct{}{}
+	for _, a := range conf.Auth {
+		if a.Tenant != "" {
+			tenants[a.Tenant] = struct{}{}
+		}
+	}
+	return func(ns string) bool {
+		i := strings.Index(ns, Separator)
+		if i == -1 {
+			return false
+		}
+		_, ok := tenants[ns[:i]]
+		return ok
+	}
+}
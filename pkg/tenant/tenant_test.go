@@ -0,0 +1,112 @@
+package tenant
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/ctxutil"
+)
+
+func TestEnforce(t *testing.T) {
+	r := httptest.NewRequest("POST", "/api/filetree/fs/fs/docs/_merge?fs=other&ns=ns2&limit=5", nil)
+	r = mux.SetURLVars(r, map[string]string{"type": "fs", "name": "docs", "key": "k1", "collection": "notes"})
+	r.Header.Set(ctxutil.NamespaceHeader, "ns1")
+
+	Enforce(r, "alice")
+
+	vars := mux.Vars(r)
+	for name, expected := range map[string]string{"name": "alice.docs", "key": "alice.k1", "collection": "alice.notes", "type": "fs"} {
+		if vars[name] != expected {
+			t.Errorf("var %q: got %q, expected %q", name, vars[name], expected)
+		}
+	}
+	if v := r.URL.Query().Get("fs"); v != "alice.other" {
+		t.Errorf("query fs: got %q", v)
+	}
+	if v := r.URL.Query().Get("ns"); v != "alice.ns2" {
+		t.Errorf("query ns: got %q", v)
+	}
+	if v := r.URL.Query().Get("limit"); v != "5" {
+		t.Errorf("query limit: got %q", v)
+	}
+	if v := r.Header.Get(ctxutil.NamespaceHeader); v != "alice.ns1" {
+		t.Errorf("namespace: got %q", v)
+	}
+
+	// The node refs are left as is (they're read in the tenant namespace)
+	r = mux.SetURLVars(httptest.NewRequest("GET", "/", nil), map[string]string{"type": "ref", "name": "abcd"})
+	Enforce(r, "alice")
+	if v := mux.Vars(r)["name"]; v != "abcd" {
+		t.Errorf("ref name: got %q", v)
+	}
+	// Without namespace, the tenant namespace is used (instead of the shared root namespace)
+	if v := r.Header.Get(ctxutil.NamespaceHeader); v != "alice." {
+		t.Errorf("default namespace: got %q", v)
+	}
+}
+
+func TestIsolated(t *testing.T) {
+	isolated := Isolated(&config.Config{
+		Auth: []*config.BasicAuth{
+			{ID: "alice", Password: "alice", Tenant: "alice"},
+			{ID: "admin", Password: "admin"},
+		},
+	})
+	for ns, expected := range map[string]bool{"alice.": true, "alice.tmp": true, "": false, "tmp": false, "bob.tmp": false, "alice": false} {
+		if v := isolated(ns); v != expected {
+			t.Errorf("namespace %q: got %v, expected %v", ns, v, expected)
+		}
+	}
+}
+
+func TestNameAndStrip(t *testing.T) {
+	conf := &config.Config{
+		Roles: []*config.Role{{
+			Name:  "docs-reader",
+			Perms: []*config.Perm{{Action: "action:read:fs", Resource: "resource:filetree:fs:*"}},
+		}},
+		Auth: []*config.BasicAuth{
+			{ID: "alice", Username: "", Password: "alice", Roles: []string{"docs-reader"}, Tenant: "alice"},
+			{ID: "admin", Username: "", Password: "admin", Roles: []string{"admin"}},
+		},
+	}
+	if err := auth.Setup(conf, log.New()); err != nil {
+		panic(err)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.SetBasicAuth("", "alice")
+	if !auth.Check(r) {
+		t.Fatalf("auth failed")
+	}
+	if v := Name(r, "docs"); v != "alice.docs" {
+		t.Errorf("got %q", v)
+	}
+	if v, ok := Strip(r, "alice.docs"); !ok || v != "docs" {
+		t.Errorf("got %q/%v", v, ok)
+	}
+	if _, ok := Strip(r, "bob.docs"); ok {
+		t.Errorf("bob.docs should not be owned by alice")
+	}
+
+	// Without tenant, the names are left untouched
+	for _, r := range []*http.Request{httptest.NewRequest("GET", "/", nil), func() *http.Request {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.SetBasicAuth("", "admin")
+		auth.Check(r)
+		return r
+	}()} {
+		if v := Name(r, "alice.docs"); v != "alice.docs" {
+			t.Errorf("got %q", v)
+		}
+		if v, ok := Strip(r, "bob.docs"); !ok || v != "bob.docs" {
+			t.Errorf("got %q/%v", v, ok)
+		}
+	}
+}
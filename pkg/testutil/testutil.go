@@ -0,0 +1,117 @@
+/*
+Package testutil implements a test harness spinning up a complete in-process BlobStash server.
+
+The blobs are kept in memory (the indexes still live in a temp dir), and the server uses a fake clock that the tests can
+advance:
+
+	srv := testutil.NewServer(t)
+	defer srv.Close()
+	resp, err := srv.Do("POST", "/api/kvstore/key/hello", strings.NewReader("data=world"))
+	srv.Clock.Add(24 * time.Hour)
+*/
+package testutil // import "a4.io/blobstash/pkg/testutil"
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"a4.io/blobstash/pkg/clock"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/server"
+)
+
+// APIKey is the password of the admin API key of the test servers
+const APIKey = "testutil"
+
+// Server is an in-process BlobStash server
+type Server struct {
+	// Base URL of the API
+	URL string
+
+	Conf   *config.Config
+	Server *server.Server
+	Clock  *clock.Fake
+
+	t       testing.TB
+	dir     string
+	httpSrv *httptest.Server
+}
+
+// NewServer starts a server (the setup funcs can customize the config before the server gets initialized), the test
+// fails if the server cannot be started
+func NewServer(t testing.TB, setup ...func(*config.Config)) *Server {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "blobstash-testutil")
+	if err != nil {
+		t.Fatalf("failed to create the data dir: %v", err)
+	}
+	conf := &config.Config{
+		DataDir:       dir,
+		LogLevel:      "crit",
+		SecretKey:     "testutil-secret-key-testutil-secret-key",
+		SharingKey:    "testutil-sharing-key-testutil-sharing-key",
+		Auth:          []*config.BasicAuth{{ID: "admin", Password: APIKey, Roles: []string{"admin"}}},
+		InMemoryBlobs: true,
+	}
+	for _, f := range setup {
+		f(conf)
+	}
+
+	// The clock must be set before the server starts (some modules record their start time)
+	fake := clock.NewFake(time.Now())
+	clock.Set(fake)
+
+	s, err := server.New(conf)
+	if err != nil {
+		clock.Set(nil)
+		os.RemoveAll(dir)
+		t.Fatalf("failed to start the server: %v", err)
+	}
+	httpSrv := httptest.NewServer(s.Handler())
+	return &Server{
+		URL:     httpSrv.URL,
+		Conf:    conf,
+		Server:  s,
+		Clock:   fake,
+		t:       t,
+		dir:     dir,
+		httpSrv: httpSrv,
+	}
+}
+
+// NewRequest returns an authenticated request for the given API path
+func (s *Server) NewRequest(method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, s.URL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth("", APIKey)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	return req, nil
+}
+
+// Do performs an authenticated request (the form encoded body can be nil)
+func (s *Server) Do(method, path string, body io.Reader) (*http.Response, error) {
+	req, err := s.NewRequest(method, path, body)
+	if err != nil {
+		return nil, err
+	}
+	return http.DefaultClient.Do(req)
+}
+
+// Close stops the server, restores the real clock and removes the data dir
+func (s *Server) Close() {
+	s.httpSrv.Close()
+	if err := s.Server.Close(); err != nil {
+		s.t.Errorf("failed to close the server: %v", err)
+	}
+	clock.Set(nil)
+	os.RemoveAll(s.dir)
+}
@@ -0,0 +1,53 @@
+package testutil
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer(t *testing.T) {
+	srv := NewServer(t)
+	defer srv.Close()
+
+	put := func() int64 {
+		resp, err := srv.Do("POST", "/api/kvstore/key/hello", strings.NewReader("data=world"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status %d", resp.StatusCode)
+		}
+		kv := struct {
+			Version int64 `json:"version"`
+		}{}
+		if err := json.NewDecoder(resp.Body).Decode(&kv); err != nil {
+			t.Fatal(err)
+		}
+		return kv.Version
+	}
+
+	// The versions follow the fake clock
+	v1 := put()
+	if v1 != srv.Clock.Now().UTC().UnixNano() {
+		t.Errorf("expected the version to be the fake clock time, got %d", v1)
+	}
+	srv.Clock.Add(24 * time.Hour)
+	v2 := put()
+	if time.Duration(v2-v1) != 24*time.Hour {
+		t.Errorf("expected a 24h gap between the versions, got %v", time.Duration(v2-v1))
+	}
+
+	// Requests without the API key are rejected
+	resp, err := http.Get(srv.URL + "/api/kvstore/key/hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected a 401, got %d", resp.StatusCode)
+	}
+}
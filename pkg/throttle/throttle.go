@@ -0,0 +1,156 @@
+/*
+Package throttle implements bandwidth limiting for the background jobs (S3 replication, sync and exports).
+
+The limits are shared by all the jobs (so they cannot saturate the connection when running concurrently), and can be
+updated on the fly (config reload).
+*/
+package throttle // import "a4.io/blobstash/pkg/throttle"
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"a4.io/blobstash/pkg/config"
+)
+
+// Limiter is a token bucket limiting a throughput (in bytes/sec), a nil Limiter is unlimited
+type Limiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+
+	now func() time.Time
+}
+
+// New initializes a limiter, the burst defaults to 1s worth of data (returns nil if the rate is not set)
+func New(rate, burst int64) *Limiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = rate
+	}
+	return &Limiter{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		now:    time.Now,
+	}
+}
+
+// reserve takes n tokens (the bucket can go in debt) and returns the delay before the bytes can be transferred
+func (l *Limiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// WaitN blocks until n bytes can be transferred
+func (l *Limiter) WaitN(ctx context.Context, n int) error {
+	if l == nil || n <= 0 {
+		return nil
+	}
+	delay := l.reserve(n)
+	if delay == 0 {
+		return nil
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+type reader struct {
+	ctx context.Context
+	l   *Limiter
+	r   io.Reader
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if werr := r.l.WaitN(r.ctx, n); werr != nil && err == nil {
+		err = werr
+	}
+	return n, err
+}
+
+// Reader returns a reader limited to the limiter throughput
+func (l *Limiter) Reader(ctx context.Context, r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &reader{ctx, l, r}
+}
+
+type writerAt struct {
+	ctx context.Context
+	l   *Limiter
+	w   io.WriterAt
+}
+
+func (w *writerAt) WriteAt(p []byte, off int64) (int, error) {
+	if err := w.l.WaitN(w.ctx, len(p)); err != nil {
+		return 0, err
+	}
+	return w.w.WriteAt(p, off)
+}
+
+// WriterAt returns a writer limited to the limiter throughput
+func (l *Limiter) WriterAt(ctx context.Context, w io.WriterAt) io.WriterAt {
+	if l == nil {
+		return w
+	}
+	return &writerAt{ctx, l, w}
+}
+
+var (
+	mu       sync.Mutex
+	upload   *Limiter
+	download *Limiter
+)
+
+// Setup (re)initializes the shared limiters from the config
+func Setup(conf *config.Throttle) {
+	mu.Lock()
+	defer mu.Unlock()
+	if conf == nil {
+		upload, download = nil, nil
+		return
+	}
+	upload = New(conf.Upload, conf.UploadBurst)
+	download = New(conf.Download, conf.DownloadBurst)
+}
+
+// Upload returns the limiter for the outgoing transfers (may be nil)
+func Upload() *Limiter {
+	mu.Lock()
+	defer mu.Unlock()
+	return upload
+}
+
+// Download returns the limiter for the incoming transfers (may be nil)
+func Download() *Limiter {
+	mu.Lock()
+	defer mu.Unlock()
+	return download
+}
@@ -0,0 +1,62 @@
+package throttle
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"a4.io/blobstash/pkg/config"
+)
+
+func TestLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := New(1000, 500)
+	l.now = func() time.Time { return now }
+
+	for _, tc := range []struct {
+		elapsed time.Duration
+		n       int
+		delay   time.Duration
+	}{
+		{0, 500, 0},                                    // the burst is available right away
+		{0, 100, 100 * time.Millisecond},               // in debt
+		{100 * time.Millisecond, 0, 0},                 // paid back
+		{time.Hour, 1500, time.Second},                 // the tokens are capped to the burst
+		{time.Second, 2000, 2 * time.Second},           // bigger than the burst
+		{2 * time.Second, 500, 500 * time.Millisecond}, // still in debt
+	} {
+		now = now.Add(tc.elapsed)
+		if delay := l.reserve(tc.n); delay != tc.delay {
+			t.Errorf("reserve(%d) after %v: got %v, expected %v", tc.n, tc.elapsed, delay, tc.delay)
+		}
+	}
+}
+
+func TestUnlimited(t *testing.T) {
+	Setup(&config.Throttle{Download: 1 << 20})
+	defer Setup(nil)
+	if Upload() != nil || Download() == nil {
+		t.Fatalf("only the download should be limited")
+	}
+
+	// A nil limiter is a no-op
+	data := []byte("hello")
+	if err := Upload().WaitN(context.Background(), 1<<30); err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadAll(Upload().Reader(context.Background(), bytes.NewReader(data)))
+	if err != nil || !bytes.Equal(out, data) {
+		t.Errorf("unexpected output %q", out)
+	}
+}
+
+func TestWaitCanceled(t *testing.T) {
+	l := New(1, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := l.WaitN(ctx, 100); err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
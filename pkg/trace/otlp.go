@@ -0,0 +1,227 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/config"
+)
+
+var (
+	defaultOTLPEndpoint = "http://localhost:4318/v1/traces"
+	defaultServiceName  = "blobstash"
+
+	otlpBatchSize     = 256
+	otlpFlushInterval = 5 * time.Second
+)
+
+// otlpExporter batches spans and sends them using OTLP/HTTP (JSON encoding)
+type otlpExporter struct {
+	endpoint    string
+	serviceName string
+	headers     map[string]string
+	client      *http.Client
+
+	spans chan *Span
+	stop  chan struct{}
+	wg    sync.WaitGroup
+
+	log log.Logger
+}
+
+func newOTLPExporter(logger log.Logger, conf *config.Tracing) *otlpExporter {
+	e := &otlpExporter{
+		endpoint:    conf.Endpoint,
+		serviceName: conf.ServiceName,
+		headers:     conf.Headers,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		spans:       make(chan *Span, otlpBatchSize*4),
+		stop:        make(chan struct{}),
+		log:         logger,
+	}
+	if e.endpoint == "" {
+		e.endpoint = defaultOTLPEndpoint
+	}
+	if e.serviceName == "" {
+		e.serviceName = defaultServiceName
+	}
+	e.wg.Add(1)
+	go e.loop()
+	return e
+}
+
+// Export implements the `Exporter` interface, spans are dropped if the buffer is full
+func (e *otlpExporter) Export(s *Span) {
+	select {
+	case e.spans <- s:
+	default:
+		e.log.Debug("tracing buffer full, dropping span", "name", s.Name)
+	}
+}
+
+// Close flushes the pending spans
+func (e *otlpExporter) Close() error {
+	close(e.stop)
+	e.wg.Wait()
+	return nil
+}
+
+func (e *otlpExporter) loop() {
+	defer e.wg.Done()
+	t := time.NewTicker(otlpFlushInterval)
+	defer t.Stop()
+	batch := []*Span{}
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := e.send(batch); err != nil {
+			e.log.Error("failed to export spans", "err", err, "spans", len(batch))
+		}
+		batch = []*Span{}
+	}
+	for {
+		select {
+		case s := <-e.spans:
+			batch = append(batch, s)
+			if len(batch) >= otlpBatchSize {
+				flush()
+			}
+		case <-t.C:
+			flush()
+		case <-e.stop:
+			for {
+				select {
+				case s := <-e.spans:
+					batch = append(batch, s)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string      `json:"traceId"`
+	SpanID            string      `json:"spanId"`
+	ParentSpanID      string      `json:"parentSpanId,omitempty"`
+	Name              string      `json:"name"`
+	Kind              int         `json:"kind"`
+	StartTimeUnixNano string      `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string      `json:"endTimeUnixNano"`
+	Attributes        []otlpAttr  `json:"attributes,omitempty"`
+	Status            *otlpStatus `json:"status,omitempty"`
+}
+
+func toOTLPValue(v interface{}) otlpValue {
+	switch vv := v.(type) {
+	case string:
+		return otlpValue{StringValue: &vv}
+	case bool:
+		return otlpValue{BoolValue: &vv}
+	case int:
+		s := strconv.Itoa(vv)
+		return otlpValue{IntValue: &s}
+	case int64:
+		s := strconv.FormatInt(vv, 10)
+		return otlpValue{IntValue: &s}
+	case float64:
+		return otlpValue{DoubleValue: &vv}
+	default:
+		s := fmt.Sprintf("%v", v)
+		return otlpValue{StringValue: &s}
+	}
+}
+
+func toOTLPSpan(s *Span) *otlpSpan {
+	out := &otlpSpan{
+		TraceID:           s.TraceID.String(),
+		SpanID:            s.SpanID.String(),
+		Name:              s.Name,
+		Kind:              1, // SPAN_KIND_INTERNAL
+		StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+	}
+	if s.ParentID != (SpanID{}) {
+		out.ParentSpanID = s.ParentID.String()
+	}
+	if _, ok := s.Attrs["http.method"]; ok {
+		out.Kind = 2 // SPAN_KIND_SERVER
+	}
+	for k, v := range s.Attrs {
+		out.Attributes = append(out.Attributes, otlpAttr{k, toOTLPValue(v)})
+	}
+	if s.Err != nil {
+		out.Status = &otlpStatus{Code: 2, Message: s.Err.Error()}
+	}
+	return out
+}
+
+func (e *otlpExporter) send(batch []*Span) error {
+	spans := make([]*otlpSpan, 0, len(batch))
+	for _, s := range batch {
+		spans = append(spans, toOTLPSpan(s))
+	}
+	payload := map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []otlpAttr{{"service.name", toOTLPValue(e.serviceName)}},
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": "a4.io/blobstash"},
+						"spans": spans,
+					},
+				},
+			},
+		},
+	}
+	js, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", e.endpoint, bytes.NewReader(js))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("OTLP collector returned status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,301 @@
+/*
+Package trace implements a minimal tracing API (spans propagated through `context.Context`), exported using
+the OTLP/HTTP JSON protocol (compatible with the OpenTelemetry collector, Jaeger, Tempo...).
+
+Tracing is disabled by default, and `Start` returns a nil span (all the `*Span` methods are nil-safe), so
+instrumented code paths don't pay anything when it's not configured.
+
+Incoming `traceparent` headers (W3C Trace Context) are honored by the HTTP middleware.
+*/
+package trace // import "a4.io/blobstash/pkg/trace"
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/config"
+)
+
+// TraceParentHeader is the W3C Trace Context header
+const TraceParentHeader = "traceparent"
+
+type key int
+
+const spanKey key = 0
+
+// TraceID identifies a trace
+type TraceID [16]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+
+// SpanID identifies a span
+type SpanID [8]byte
+
+func (s SpanID) String() string { return hex.EncodeToString(s[:]) }
+
+// Span tracks a single operation
+type Span struct {
+	TraceID  TraceID
+	SpanID   SpanID
+	ParentID SpanID
+	Name     string
+	Start    time.Time
+	End      time.Time
+	Attrs    map[string]interface{}
+	Err      error
+
+	mu    sync.Mutex
+	ended bool
+}
+
+// Exporter sends the finished spans to a backend
+type Exporter interface {
+	Export(*Span)
+	Close() error
+}
+
+var (
+	mu       sync.RWMutex
+	exporter Exporter
+)
+
+// Setup configures the global exporter from the config (does nothing if tracing is not enabled)
+func Setup(logger log.Logger, conf *config.Config) error {
+	if conf.Tracing == nil || conf.Tracing.Exporter == "" {
+		return nil
+	}
+	var exp Exporter
+	switch conf.Tracing.Exporter {
+	case "log":
+		exp = &logExporter{logger}
+	case "otlp":
+		exp = newOTLPExporter(logger, conf.Tracing)
+	default:
+		return fmt.Errorf("unknown tracing exporter %q", conf.Tracing.Exporter)
+	}
+	logger.Info("tracing enabled", "exporter", conf.Tracing.Exporter)
+	SetExporter(exp)
+	return nil
+}
+
+// SetExporter sets the global exporter (nil disables tracing)
+func SetExporter(exp Exporter) {
+	mu.Lock()
+	defer mu.Unlock()
+	exporter = exp
+}
+
+// Close flushes and closes the global exporter
+func Close() error {
+	mu.Lock()
+	defer mu.Unlock()
+	if exporter == nil {
+		return nil
+	}
+	err := exporter.Close()
+	exporter = nil
+	return err
+}
+
+// Enabled returns true if an exporter is configured
+func Enabled() bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	return exporter != nil
+}
+
+// FromContext returns the current span (or nil)
+func FromContext(ctx context.Context) *Span {
+	if ctx == nil {
+		return nil
+	}
+	if s, ok := ctx.Value(spanKey).(*Span); ok {
+		return s
+	}
+	return nil
+}
+
+// WithSpan returns a new context holding the given span
+func WithSpan(ctx context.Context, s *Span) context.Context {
+	return context.WithValue(ctx, spanKey, s)
+}
+
+// Start starts a new span (child of the span in the context if any), attrs are key/value pairs (like log15)
+func Start(ctx context.Context, name string, attrs ...interface{}) (context.Context, *Span) {
+	if !Enabled() {
+		return ctx, nil
+	}
+	s := &Span{
+		Name:   name,
+		Start:  time.Now(),
+		SpanID: newSpanID(),
+		Attrs:  map[string]interface{}{},
+	}
+	if parent := FromContext(ctx); parent != nil {
+		s.TraceID = parent.TraceID
+		s.ParentID = parent.SpanID
+	} else {
+		s.TraceID = newTraceID()
+	}
+	s.SetAttrs(attrs...)
+	return WithSpan(ctx, s), s
+}
+
+// SetAttrs sets the given key/value pairs
+func (s *Span) SetAttrs(attrs ...interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; i+1 < len(attrs); i += 2 {
+		s.Attrs[fmt.Sprintf("%v", attrs[i])] = attrs[i+1]
+	}
+}
+
+// SetError records an error for the span
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Err = err
+}
+
+// Finish ends the span and sends it to the exporter
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.End = time.Now()
+	s.mu.Unlock()
+
+	mu.RLock()
+	exp := exporter
+	mu.RUnlock()
+	if exp != nil {
+		exp.Export(s)
+	}
+}
+
+// TraceParent returns the W3C `traceparent` header value for the span
+func (s *Span) TraceParent() string {
+	if s == nil {
+		return ""
+	}
+	return fmt.Sprintf("00-%s-%s-01", s.TraceID, s.SpanID)
+}
+
+// ParseTraceParent parses a W3C `traceparent` header value
+func ParseTraceParent(v string) (TraceID, SpanID, bool) {
+	var tid TraceID
+	var sid SpanID
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return tid, sid, false
+	}
+	if _, err := hex.Decode(tid[:], []byte(parts[1])); err != nil {
+		return tid, sid, false
+	}
+	if _, err := hex.Decode(sid[:], []byte(parts[2])); err != nil {
+		return tid, sid, false
+	}
+	if tid == (TraceID{}) || sid == (SpanID{}) {
+		return tid, sid, false
+	}
+	return tid, sid, true
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Flush implements the `http.Flusher` interface (needed by the SSE endpoints)
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the underlying `http.ResponseWriter` (used by `http.ResponseController`)
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Middleware starts a span for each HTTP request
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !Enabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx := r.Context()
+		if tid, sid, ok := ParseTraceParent(r.Header.Get(TraceParentHeader)); ok {
+			// Continue the remote trace
+			ctx = WithSpan(ctx, &Span{TraceID: tid, SpanID: sid})
+		}
+		ctx, span := Start(ctx, r.Method+" "+r.URL.Path, "http.method", r.Method, "http.target", r.URL.RequestURI(), "http.host", r.Host)
+		defer span.Finish()
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r.WithContext(ctx))
+		span.SetAttrs("http.status_code", sw.status)
+		if sw.status >= 500 {
+			span.SetError(fmt.Errorf("%s", http.StatusText(sw.status)))
+		}
+	})
+}
+
+func newTraceID() TraceID {
+	var t TraceID
+	if _, err := rand.Read(t[:]); err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func newSpanID() SpanID {
+	var s SpanID
+	if _, err := rand.Read(s[:]); err != nil {
+		panic(err)
+	}
+	return s
+}
+
+type logExporter struct {
+	log log.Logger
+}
+
+func (e *logExporter) Export(s *Span) {
+	ctx := []interface{}{"trace_id", s.TraceID, "span_id", s.SpanID, "parent_id", s.ParentID, "duration", s.End.Sub(s.Start)}
+	for k, v := range s.Attrs {
+		ctx = append(ctx, k, v)
+	}
+	if s.Err != nil {
+		ctx = append(ctx, "err", s.Err)
+	}
+	e.log.Debug(s.Name, ctx...)
+}
+
+func (e *logExporter) Close() error { return nil }
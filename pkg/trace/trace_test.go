@@ -0,0 +1,47 @@
+package trace
+
+import (
+	"context"
+	"testing"
+)
+
+type memExporter struct {
+	spans []*Span
+}
+
+func (e *memExporter) Export(s *Span) { e.spans = append(e.spans, s) }
+func (e *memExporter) Close() error   { return nil }
+
+func TestSpans(t *testing.T) {
+	// Disabled by default
+	if _, span := Start(context.Background(), "noop"); span != nil {
+		t.Errorf("expected a nil span when tracing is disabled")
+	}
+
+	exp := &memExporter{}
+	SetExporter(exp)
+	defer SetExporter(nil)
+
+	ctx, parent := Start(context.Background(), "parent")
+	_, child := Start(ctx, "child", "k", "v")
+	child.Finish()
+	parent.Finish()
+
+	if len(exp.spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(exp.spans))
+	}
+	if child.TraceID != parent.TraceID || child.ParentID != parent.SpanID {
+		t.Errorf("bad child span %+v (parent %+v)", child, parent)
+	}
+	if child.Attrs["k"] != "v" {
+		t.Errorf("missing attr")
+	}
+
+	tid, sid, ok := ParseTraceParent(parent.TraceParent())
+	if !ok || tid != parent.TraceID || sid != parent.SpanID {
+		t.Errorf("failed to parse traceparent %q", parent.TraceParent())
+	}
+	if _, _, ok := ParseTraceParent("00-invalid"); ok {
+		t.Errorf("invalid traceparent should not be parsed")
+	}
+}
@@ -1,16 +1,17 @@
 package vkv // import "a4.io/blobstash/pkg/vkv"
 
 import (
+	"bytes"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"strconv"
-	"time"
 
 	"github.com/vmihailenco/msgpack"
 
+	"a4.io/blobstash/pkg/clock"
 	"a4.io/blobstash/pkg/rangedb"
 )
 
@@ -22,6 +23,7 @@ const (
 	FlagMetaBlob
 	FlagVersion
 	FlagKey
+	FlagPendingMeta
 )
 
 // KvType for meta serialization
@@ -65,6 +67,35 @@ func (kv *KeyValue) HexHash() string {
 	return ""
 }
 
+// redirectPrefix marks the data of a redirect tombstone (left at the old key after a rename)
+const redirectPrefix = "\x00vkv:redirect:"
+
+// RedirectData returns the data for a redirect tombstone pointing to the given key
+func RedirectData(key string) []byte {
+	return []byte(redirectPrefix + key)
+}
+
+// RedirectTo returns the key the tombstone redirects to (empty if it's not a redirect tombstone)
+func (kv *KeyValue) RedirectTo() string {
+	if len(kv.Hash) > 0 || !bytes.HasPrefix(kv.Data, []byte(redirectPrefix)) {
+		return ""
+	}
+	return string(kv.Data[len(redirectPrefix):])
+}
+
+// expiredData marks the data of an expiration tombstone (written when the TTL of a key expires)
+const expiredData = "\x00vkv:expired"
+
+// ExpiredData returns the data for an expiration tombstone
+func ExpiredData() []byte {
+	return []byte(expiredData)
+}
+
+// Expired returns true if the key value is an expiration tombstone
+func (kv *KeyValue) Expired() bool {
+	return len(kv.Hash) == 0 && string(kv.Data) == expiredData
+}
+
 // KeyValueVersions holds the full history for a key value pair
 type KeyValueVersions struct {
 	Key string `json:"key"`
@@ -155,7 +186,7 @@ func (db *DB) Put(kv *KeyValue) error {
 	kv.SchemaVersion = schemaVersion
 
 	if kv.Version < 1 {
-		kv.Version = time.Now().UTC().UnixNano()
+		kv.Version = clock.Now().UTC().UnixNano()
 	}
 
 	encoded, err := kv.Dump()
@@ -207,11 +238,19 @@ func buildVkey(kvkey []byte, version int64) []byte {
 }
 
 func buildMetaBlobKey(key []byte, version int64) []byte {
+	return buildFlaggedVkey(FlagMetaBlob, key, version)
+}
+
+func buildPendingMetaKey(key []byte, version int64) []byte {
+	return buildFlaggedVkey(FlagPendingMeta, key, version)
+}
+
+func buildFlaggedVkey(flag byte, key []byte, version int64) []byte {
 	klen := len(key)
 	vkey := make([]byte, klen+10)
 
-	// Set the version flag
-	vkey[0] = FlagMetaBlob
+	// Set the flag
+	vkey[0] = flag
 
 	// Copy the key
 	copy(vkey[1:], key[:])
@@ -259,6 +298,46 @@ func (db *DB) GetMetaBlob(key string, version int64) (string, error) {
 	return "", nil
 }
 
+// AddPendingMeta marks the version as waiting for its meta blob (i.e. for the next checkpoint)
+func (db *DB) AddPendingMeta(key string, version int64) error {
+	return db.rdb.Set(buildPendingMetaKey([]byte(key), version), []byte{1})
+}
+
+// RemovePendingMeta removes the pending mark of the version
+func (db *DB) RemovePendingMeta(key string, version int64) error {
+	return db.rdb.Delete(buildPendingMetaKey([]byte(key), version))
+}
+
+// PendingMeta returns the versions waiting for their meta blob (up to limit versions, all of them if limit <= 0)
+func (db *DB) PendingMeta(limit int) ([]*KeyValue, error) {
+	out := []*KeyValue{}
+	c := db.rdb.PrefixRange([]byte{FlagPendingMeta}, false)
+	defer c.Close()
+
+	k, _, err := c.Next()
+	for ; err == nil && (limit <= 0 || len(out) < limit); k, _, err = c.Next() {
+		// <flag><key><sep><8 bytes version>
+		if len(k) < 10 {
+			continue
+		}
+		key := string(k[1 : len(k)-9])
+		version := int64(binary.BigEndian.Uint64(k[len(k)-8:]))
+		kv, err := db.getAt(key, version)
+		if err != nil {
+			if err == ErrNotFound {
+				continue
+			}
+			return nil, err
+		}
+		kv.Version = version
+		out = append(out, kv)
+	}
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (db *DB) getAt(key string, version int64) (*KeyValue, error) {
 	kvkey := append([]byte{FlagKey}, []byte(key)...)
 	vkey := buildVkey(kvkey, version)
@@ -330,7 +409,7 @@ func (db *DB) Versions(key string, start, end int64, limit int) (*KeyValueVersio
 		Versions: []*KeyValue{},
 	}
 	if end <= 0 {
-		end = time.Now().UTC().UnixNano()
+		end = clock.Now().UTC().UnixNano()
 	}
 
 	kvkey := append([]byte{FlagKey}, []byte(key)...)
@@ -358,6 +437,38 @@ func (db *DB) Versions(key string, start, end int64, limit int) (*KeyValueVersio
 	return res, nstart, nil
 }
 
+// CheckpointType for meta serialization
+const CheckpointType = "kv-checkpoint"
+
+// Checkpoint rolls up several versions in a single meta blob
+type Checkpoint struct {
+	SchemaVersion int `msgpack:"_v"`
+
+	KeyValues []*KeyValue `msgpack:"kvs"`
+}
+
+// Implements the `MetaData` interface
+func (cp *Checkpoint) Type() string {
+	return CheckpointType
+}
+
+// Implements the `MetaData` interface
+func (cp *Checkpoint) Dump() ([]byte, error) {
+	cp.SchemaVersion = schemaVersion
+	for _, kv := range cp.KeyValues {
+		kv.SchemaVersion = schemaVersion
+	}
+	return msgpack.Marshal(cp)
+}
+
+func UnserializeCheckpoint(blob []byte) (*Checkpoint, error) {
+	cp := &Checkpoint{}
+	if err := msgpack.Unmarshal(blob, cp); err != nil {
+		return nil, err
+	}
+	return cp, nil
+}
+
 func UnserializeBlob(blob []byte) (*KeyValue, error) {
 	kv := &KeyValue{}
 	if err := msgpack.Unmarshal(blob, kv); err != nil {
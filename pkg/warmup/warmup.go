@@ -0,0 +1,167 @@
+/*
+Package warmup tracks the lazy initialization of the heavy modules (apps git clones, docstore indexes...).
+
+Modules register a warm-up task that runs in the background, this way the server (and the blob API) can
+start serving requests right after boot, and the per-module status is exposed at `/api/warmup`.
+*/
+package warmup // import "a4.io/blobstash/pkg/warmup"
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/httputil"
+)
+
+// States of a warm-up task
+const (
+	Warming = "warming"
+	Ready   = "ready"
+	Failed  = "failed"
+)
+
+// Status holds the warm-up status of a module
+type Status struct {
+	Name      string    `json:"name"`
+	State     string    `json:"state"`
+	Error     string    `json:"error,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+	Duration  string    `json:"duration,omitempty"`
+
+	done chan struct{}
+}
+
+// Warmup manages the background warm-up tasks
+type Warmup struct {
+	statuses map[string]*Status
+	order    []string
+	mu       sync.Mutex
+	log      log.Logger
+}
+
+// New initializes a warm-up manager
+func New(logger log.Logger) *Warmup {
+	logger.Debug("init")
+	return &Warmup{
+		statuses: map[string]*Status{},
+		log:      logger,
+	}
+}
+
+// Go runs the given warm-up task in the background
+func (w *Warmup) Go(name string, f func() error) {
+	status := &Status{
+		Name:      name,
+		State:     Warming,
+		StartedAt: time.Now(),
+		done:      make(chan struct{}),
+	}
+	w.mu.Lock()
+	if _, ok := w.statuses[name]; !ok {
+		w.order = append(w.order, name)
+	}
+	w.statuses[name] = status
+	w.mu.Unlock()
+
+	w.log.Info("warming up", "module", name)
+	go func() {
+		defer close(status.done)
+		err := f()
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		status.Duration = time.Since(status.StartedAt).String()
+		if err != nil {
+			status.State = Failed
+			status.Error = err.Error()
+			w.log.Error("warm-up failed", "module", name, "err", err)
+			return
+		}
+		status.State = Ready
+		w.log.Info("module ready", "module", name, "duration", status.Duration)
+	}()
+}
+
+// IsReady returns true if the module is ready (unknown modules are considered ready)
+func (w *Warmup) IsReady(name string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	status, ok := w.statuses[name]
+	return !ok || status.State == Ready
+}
+
+// Err returns the warm-up error of the given module, if any
+func (w *Warmup) Err(name string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if status, ok := w.statuses[name]; ok && status.State == Failed {
+		return fmt.Errorf("%s warm-up failed: %s", name, status.Error)
+	}
+	return nil
+}
+
+// Wait blocks until the given module warm-up is done
+func (w *Warmup) Wait(name string) error {
+	w.mu.Lock()
+	status, ok := w.statuses[name]
+	w.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	<-status.done
+	return w.Err(name)
+}
+
+// Statuses returns the status of every registered module (in registration order)
+func (w *Warmup) Statuses() []*Status {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	out := []*Status{}
+	for _, name := range w.order {
+		s := *w.statuses[name]
+		if s.State == Warming {
+			s.Duration = time.Since(s.StartedAt).String()
+		}
+		out = append(out, &s)
+	}
+	return out
+}
+
+// AllReady returns true if all the modules are ready
+func (w *Warmup) AllReady() bool {
+	for _, s := range w.Statuses() {
+		if s.State != Ready {
+			return false
+		}
+	}
+	return true
+}
+
+// NotReady writes a "503 Service Unavailable" response for the given module
+func NotReady(w http.ResponseWriter, name string) {
+	w.Header().Set("Retry-After", "5")
+	httputil.WriteJSONError(w, http.StatusServiceUnavailable, fmt.Sprintf("%s is warming up", name))
+}
+
+func (w *Warmup) statusHandler() func(http.ResponseWriter, *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET", "HEAD":
+			httputil.MarshalAndWrite(r, rw, map[string]interface{}{
+				"ready": w.AllReady(),
+				"data":  w.Statuses(),
+			})
+		default:
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// Register registers the warm-up status endpoint
+func (w *Warmup) Register(r *mux.Router, basicAuth func(http.Handler) http.Handler) {
+	r.Handle("/", basicAuth(http.HandlerFunc(w.statusHandler())))
+}
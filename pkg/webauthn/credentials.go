@@ -0,0 +1,195 @@
+package webauthn // import "a4.io/blobstash/pkg/webauthn"
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/perms"
+)
+
+// ErrCredentialNotFound is returned when managing an unknown credential
+var ErrCredentialNotFound = errors.New("credential not found")
+
+// ErrCredentialRPMismatch is returned when an app manages a credential registered for another relying party
+var ErrCredentialRPMismatch = errors.New("credential registered for another relying party")
+
+// CredentialInfo describes a registered authenticator
+type CredentialInfo struct {
+	ID        string     `json:"id"`
+	RPID      string     `json:"rp_id"`
+	Name      string     `json:"name"`
+	SignCount uint       `json:"sign_count"`
+	Created   *time.Time `json:"created,omitempty"`
+	LastUsed  *time.Time `json:"last_used,omitempty"`
+}
+
+func newCredentialInfo(c *credential) *CredentialInfo {
+	info := &CredentialInfo{
+		ID:        c.ID(),
+		RPID:      c.RPID,
+		Name:      c.Name,
+		SignCount: c.CredentialSignCount(),
+	}
+	if !c.Created.IsZero() {
+		created := c.Created
+		info.Created = &created
+	}
+	if !c.LastUsed.IsZero() {
+		lastUsed := c.LastUsed
+		info.LastUsed = &lastUsed
+	}
+	return info
+}
+
+// Credentials returns all the registered credentials (for all the relying parties)
+func (wa *WebAuthn) Credentials() ([]*CredentialInfo, error) {
+	wa.mu.Lock()
+	defer wa.mu.Unlock()
+	creds, err := loadAll(wa.conf)
+	if err != nil {
+		return nil, err
+	}
+	out := []*CredentialInfo{}
+	for _, c := range creds {
+		out = append(out, newCredentialInfo(c))
+	}
+	return out, nil
+}
+
+// updateCredential calls the given func on the matching credential (it can return nil to delete it) and saves the
+// JSON DB file, if rpid is set, the credential must be registered for this relying party
+func (wa *WebAuthn) updateCredential(rpid, id string, f func(*credential) *credential) error {
+	wa.mu.Lock()
+	defer wa.mu.Unlock()
+	creds, err := loadAll(wa.conf)
+	if err != nil {
+		return err
+	}
+	var found bool
+	newCreds := []*credential{}
+	for _, c := range creds {
+		if c.ID() == id {
+			if rpid != "" && c.RPID != rpid {
+				return ErrCredentialRPMismatch
+			}
+			found = true
+			if c = f(c); c == nil {
+				continue
+			}
+		}
+		newCreds = append(newCreds, c)
+	}
+	if !found {
+		return ErrCredentialNotFound
+	}
+	return saveAll(wa.conf, newCreds)
+}
+
+// RenameCredential updates the name of the credential
+func (wa *WebAuthn) RenameCredential(id, name string) error {
+	return wa.renameCredential("", id, name)
+}
+
+func (wa *WebAuthn) renameCredential(rpid, id, name string) error {
+	return wa.updateCredential(rpid, id, func(c *credential) *credential {
+		c.Name = name
+		return c
+	})
+}
+
+// RevokeCredential deletes the credential, it won't be accepted anymore for login
+func (wa *WebAuthn) RevokeCredential(id string) error {
+	return wa.revokeCredential("", id)
+}
+
+func (wa *WebAuthn) revokeCredential(rpid, id string) error {
+	return wa.updateCredential(rpid, id, func(_ *credential) *credential {
+		return nil
+	})
+}
+
+func (wa *WebAuthn) credentialsHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.List, perms.WebAuthnCredential),
+			perms.ResourceWithID(perms.WebAuthn, perms.WebAuthnCredential, "*"),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+		creds, err := wa.Credentials()
+		if err != nil {
+			panic(err)
+		}
+		httputil.MarshalAndWrite(r, w, map[string]interface{}{
+			"data": creds,
+		})
+	}
+}
+
+func (wa *WebAuthn) credentialHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		switch r.Method {
+		case "PATCH":
+			if !auth.Can(
+				w,
+				r,
+				perms.Action(perms.Write, perms.WebAuthnCredential),
+				perms.ResourceWithID(perms.WebAuthn, perms.WebAuthnCredential, id),
+			) {
+				auth.Forbidden(w)
+				return
+			}
+			payload := struct {
+				Name string `json:"name"`
+			}{}
+			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil || payload.Name == "" {
+				httputil.WriteJSONError(w, http.StatusBadRequest, "invalid payload, a name is required")
+				return
+			}
+			if err := wa.RenameCredential(id, payload.Name); err != nil {
+				if err == ErrCredentialNotFound {
+					httputil.WriteJSONError(w, http.StatusNotFound, err.Error())
+					return
+				}
+				panic(err)
+			}
+			w.WriteHeader(http.StatusNoContent)
+		case "DELETE":
+			if !auth.Can(
+				w,
+				r,
+				perms.Action(perms.Delete, perms.WebAuthnCredential),
+				perms.ResourceWithID(perms.WebAuthn, perms.WebAuthnCredential, id),
+			) {
+				auth.Forbidden(w)
+				return
+			}
+			if err := wa.RevokeCredential(id); err != nil {
+				if err == ErrCredentialNotFound {
+					httputil.WriteJSONError(w, http.StatusNotFound, err.Error())
+					return
+				}
+				panic(err)
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// Register registers the credentials management API
+func (wa *WebAuthn) Register(r *mux.Router, basicAuth func(http.Handler) http.Handler) {
+	r.Handle("/credentials", basicAuth(http.HandlerFunc(wa.credentialsHandler())))
+	r.Handle("/credentials/{id}", basicAuth(http.HandlerFunc(wa.credentialHandler())))
+}
@@ -12,6 +12,8 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"sync"
+	"time"
 
 	"a4.io/blobstash/pkg/config"
 	"a4.io/blobstash/pkg/session"
@@ -75,6 +77,16 @@ type credential struct {
 	owner warp.User
 	Att   *warp.AttestationObject
 	RPID  string
+
+	// User-defined name (to identify the authenticator)
+	Name     string
+	Created  time.Time
+	LastUsed time.Time
+}
+
+// ID returns the (URL-safe) base64 encoded credential ID
+func (c *credential) ID() string {
+	return base64.RawURLEncoding.EncodeToString(c.CredentialID())
 }
 
 func (c *credential) Owner() warp.User {
@@ -123,8 +135,7 @@ func (u *user) load(rpid string) error {
 	}
 	for _, cred := range allCreds {
 		if cred.RPID == rpid {
-			id := base64.RawURLEncoding.EncodeToString(cred.Att.AuthData.AttestedCredentialData.CredentialID)
-			u.credentials[id] = cred
+			u.credentials[cred.ID()] = cred
 		}
 	}
 	return nil
@@ -140,6 +151,7 @@ func (u *user) save(rpid string, rcred *credential, cid []byte, authData *warp.A
 	for _, acred := range allCreds {
 		if acred.RPID == rpid && authData != nil && bytes.Equal(acred.Att.AuthData.AttestedCredentialData.CredentialID, cid) {
 			acred.Att.AuthData.SignCount = authData.SignCount
+			acred.LastUsed = time.Now().UTC()
 		}
 
 		newCreds = append(newCreds, acred)
@@ -149,11 +161,16 @@ func (u *user) save(rpid string, rcred *credential, cid []byte, authData *warp.A
 		newCreds = append(newCreds, rcred)
 	}
 
-	js, err := json.Marshal(newCreds)
+	return saveAll(u.conf, newCreds)
+}
+
+// saveAll replaces the JSON DB file content
+func saveAll(conf *config.Config, creds []*credential) error {
+	js, err := json.Marshal(creds)
 	if err != nil {
 		return err
 	}
-	if err := ioutil.WriteFile(filepath.Join(u.conf.VarDir(), "webauthn.json"), js, 0600); err != nil {
+	if err := ioutil.WriteFile(filepath.Join(conf.VarDir(), "webauthn.json"), js, 0600); err != nil {
 		return err
 	}
 	return nil
@@ -163,6 +180,9 @@ type WebAuthn struct {
 	conf *config.Config
 	sess *session.Session
 	user *user
+
+	// Protects the JSON DB file
+	mu sync.Mutex
 }
 
 func New(conf *config.Config, s *session.Session) (*WebAuthn, error) {
@@ -179,23 +199,60 @@ func New(conf *config.Config, s *session.Session) (*WebAuthn, error) {
 }
 
 func (wa *WebAuthn) findCredential(id []byte) (warp.Credential, error) {
-	strID := base64.RawStdEncoding.EncodeToString(id)
+	strID := base64.RawURLEncoding.EncodeToString(id)
 	if c, ok := wa.user.credentials[strID]; ok {
 		return c, nil
 	}
 	return nil, fmt.Errorf("no credential")
 }
 
-func (wa *WebAuthn) BeginRegistration(rw http.ResponseWriter, r *http.Request, origin string) (string, error) {
+// ParseUserVerification validates the user verification requirement (defaults to "preferred")
+func ParseUserVerification(uv string) (warp.UserVerificationRequirement, error) {
+	switch req := warp.UserVerificationRequirement(uv); req {
+	case "":
+		return warp.VerificationPreferred, nil
+	case warp.VerificationRequired, warp.VerificationPreferred, warp.VerificationDiscouraged:
+		return req, nil
+	default:
+		return "", fmt.Errorf("invalid user verification requirement %q", uv)
+	}
+}
+
+// credentialDescriptors returns the descriptors for all the registered credentials of the user
+func credentialDescriptors(user warp.User) []warp.PublicKeyCredentialDescriptor {
+	ds := []warp.PublicKeyCredentialDescriptor{}
+	for _, c := range user.Credentials() {
+		ds = append(ds, warp.PublicKeyCredentialDescriptor{
+			Type: "public-key",
+			ID:   c.CredentialID(),
+		})
+	}
+	return ds
+}
+
+// BeginRegistration starts the registration of a new authenticator (the already registered ones are excluded)
+func (wa *WebAuthn) BeginRegistration(rw http.ResponseWriter, r *http.Request, origin, userVerification string) (string, error) {
 	relyingParty := &rp{
 		origin: origin,
 	}
+	uv, err := ParseUserVerification(userVerification)
+	if err != nil {
+		return "", err
+	}
 
+	wa.mu.Lock()
+	defer wa.mu.Unlock()
 	if err := wa.user.load(relyingParty.EntityID()); err != nil {
 		return "", err
 	}
 
-	opts, err := warp.StartRegistration(relyingParty, wa.user, warp.Attestation(warp.ConveyanceDirect))
+	opts, err := warp.StartRegistration(
+		relyingParty,
+		wa.user,
+		warp.Attestation(warp.ConveyanceDirect),
+		warp.ExcludeCredentials(credentialDescriptors(wa.user)),
+		warp.AuthenticatorSelection(warp.AuthenticatorSelectionCriteria{UserVerification: uv}),
+	)
 	if err != nil {
 		return "", err
 	}
@@ -216,11 +273,14 @@ func (wa *WebAuthn) BeginRegistration(rw http.ResponseWriter, r *http.Request, o
 	return string(js), nil
 }
 
-func (wa *WebAuthn) FinishRegistration(rw http.ResponseWriter, r *http.Request, origin, js string) error {
+// FinishRegistration saves the new credential under the given name
+func (wa *WebAuthn) FinishRegistration(rw http.ResponseWriter, r *http.Request, origin, js, name string) error {
 	relyingParty := &rp{
 		origin: origin,
 	}
 
+	wa.mu.Lock()
+	defer wa.mu.Unlock()
 	if err := wa.user.load(relyingParty.EntityID()); err != nil {
 		return err
 	}
@@ -246,10 +306,15 @@ func (wa *WebAuthn) FinishRegistration(rw http.ResponseWriter, r *http.Request,
 
 	fmt.Printf("att=%+v\n\n", att)
 
+	if name == "" {
+		name = fmt.Sprintf("Authenticator #%d", len(wa.user.credentials)+1)
+	}
 	newCred := &credential{
-		RPID:  relyingParty.EntityID(),
-		Att:   att,
-		owner: wa.user,
+		RPID:    relyingParty.EntityID(),
+		Att:     att,
+		Name:    name,
+		Created: time.Now().UTC(),
+		owner:   wa.user,
 	}
 
 	if err := wa.user.save(relyingParty.EntityID(), newCred, nil, nil); err != nil {
@@ -293,28 +358,30 @@ func (wa *WebAuthn) getSession(r *http.Request, name string) (*sessionData, erro
 	return sessionData, nil
 }
 
-func (wa *WebAuthn) BeginLogin(rw http.ResponseWriter, r *http.Request, origin string) (string, error) {
+// BeginLogin starts the authentication (any of the registered authenticators can be used)
+func (wa *WebAuthn) BeginLogin(rw http.ResponseWriter, r *http.Request, origin, userVerification string) (string, error) {
 	relyingParty := &rp{
 		origin: origin,
 	}
+	uv, err := ParseUserVerification(userVerification)
+	if err != nil {
+		return "", err
+	}
 
+	wa.mu.Lock()
+	defer wa.mu.Unlock()
 	if err := wa.user.load(relyingParty.EntityID()); err != nil {
 		return "", err
 	}
 
-	opts, err := warp.StartAuthentication(warp.AllowCredentials(
-		func(user warp.User) []warp.PublicKeyCredentialDescriptor {
-			ds := []warp.PublicKeyCredentialDescriptor{}
-			for _, c := range user.Credentials() {
-				ds = append(ds, warp.PublicKeyCredentialDescriptor{
-					Type: "public-key",
-					ID:   c.CredentialID(),
-				})
-			}
-			return ds
-		}(wa.user)),
+	opts, err := warp.StartAuthentication(
+		warp.AllowCredentials(credentialDescriptors(wa.user)),
 		warp.RelyingPartyID(relyingParty.EntityID()),
+		warp.UserVerification(uv),
 	)
+	if err != nil {
+		return "", err
+	}
 	sessionData := &sessionData{
 		RequestOptions: opts,
 	}
@@ -335,6 +402,8 @@ func (wa *WebAuthn) FinishLogin(rw http.ResponseWriter, r *http.Request, origin,
 		origin: origin,
 	}
 
+	wa.mu.Lock()
+	defer wa.mu.Unlock()
 	if err := wa.user.load(relyingParty.EntityID()); err != nil {
 		return err
 	}
@@ -369,7 +438,9 @@ func (wa *WebAuthn) FinishLogin(rw http.ResponseWriter, r *http.Request, origin,
 	return nil
 }
 
-func (wa *WebAuthn) SetupLua(L *lua.LState, baseURL string, w http.ResponseWriter, r *http.Request) {
+// SetupLua exports the `webauthn` module, userVerification is the user verification requirement for the app
+// ("required", "preferred" or "discouraged")
+func (wa *WebAuthn) SetupLua(L *lua.LState, baseURL, userVerification string, w http.ResponseWriter, r *http.Request) {
 	L.PreloadModule("webauthn", func(L *lua.LState) int {
 		u, err := url.Parse(baseURL)
 		if err != nil {
@@ -384,6 +455,8 @@ func (wa *WebAuthn) SetupLua(L *lua.LState, baseURL string, w http.ResponseWrite
 					origin: baseURL,
 				}
 
+				wa.mu.Lock()
+				defer wa.mu.Unlock()
 				if err := wa.user.load(relyingParty.EntityID()); err != nil {
 					panic(err)
 				}
@@ -396,8 +469,58 @@ func (wa *WebAuthn) SetupLua(L *lua.LState, baseURL string, w http.ResponseWrite
 				L.Push(tbl)
 				return 1
 			},
+			"credentials": func(L *lua.LState) int {
+				creds, err := wa.Credentials()
+				if err != nil {
+					panic(err)
+				}
+				relyingParty := &rp{
+					origin: baseURL,
+				}
+				tbl := L.NewTable()
+				for _, c := range creds {
+					if c.RPID != relyingParty.EntityID() {
+						continue
+					}
+					tcred := L.CreateTable(0, 4)
+					tcred.RawSetString("id", lua.LString(c.ID))
+					tcred.RawSetString("name", lua.LString(c.Name))
+					if c.Created != nil {
+						tcred.RawSetString("created", lua.LNumber(c.Created.Unix()))
+					}
+					if c.LastUsed != nil {
+						tcred.RawSetString("last_used", lua.LNumber(c.LastUsed.Unix()))
+					}
+					tbl.Append(tcred)
+				}
+				L.Push(tbl)
+				return 1
+			},
+			// The apps can only manage the credentials of their own relying party
+			"rename_credential": func(L *lua.LState) int {
+				relyingParty := &rp{
+					origin: baseURL,
+				}
+				if err := wa.renameCredential(relyingParty.EntityID(), L.CheckString(1), L.CheckString(2)); err != nil {
+					L.Push(lua.LString(err.Error()))
+					return 1
+				}
+				L.Push(lua.LNil)
+				return 1
+			},
+			"revoke_credential": func(L *lua.LState) int {
+				relyingParty := &rp{
+					origin: baseURL,
+				}
+				if err := wa.revokeCredential(relyingParty.EntityID(), L.CheckString(1)); err != nil {
+					L.Push(lua.LString(err.Error()))
+					return 1
+				}
+				L.Push(lua.LNil)
+				return 1
+			},
 			"begin_registration": func(L *lua.LState) int {
-				js, err := wa.BeginRegistration(w, r, baseURL)
+				js, err := wa.BeginRegistration(w, r, baseURL, userVerification)
 				if err != nil {
 					panic(err)
 				}
@@ -405,14 +528,14 @@ func (wa *WebAuthn) SetupLua(L *lua.LState, baseURL string, w http.ResponseWrite
 				return 1
 			},
 			"finish_registration": func(L *lua.LState) int {
-				if err := wa.FinishRegistration(w, r, baseURL, L.ToString(1)); err != nil {
+				if err := wa.FinishRegistration(w, r, baseURL, L.ToString(1), L.OptString(2, "")); err != nil {
 					panic(err)
 				}
 				L.Push(lua.LNil)
 				return 1
 			},
 			"begin_login": func(L *lua.LState) int {
-				js, err := wa.BeginLogin(w, r, baseURL)
+				js, err := wa.BeginLogin(w, r, baseURL, userVerification)
 				if err != nil {
 					panic(err)
 				}
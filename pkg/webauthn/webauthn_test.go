@@ -0,0 +1,123 @@
+package webauthn
+
+import (
+	"testing"
+
+	"github.com/e3b0c442/warp"
+	lua "github.com/yuin/gopher-lua"
+
+	"a4.io/blobstash/pkg/config"
+)
+
+func testCredential(rpid string, id byte) *credential {
+	att := &warp.AttestationObject{}
+	att.AuthData.AttestedCredentialData.CredentialID = []byte{id, id, id}
+	return &credential{RPID: rpid, Att: att}
+}
+
+func TestCredentialsManagement(t *testing.T) {
+	conf := &config.Config{DataDir: t.TempDir()}
+	wa, err := New(conf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1 := testCredential("a.example.com", 1)
+	c2 := testCredential("a.example.com", 2)
+	c3 := testCredential("b.example.com", 3)
+	if err := saveAll(conf, []*credential{c1, c2, c3}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Multiple credentials can be registered for the same relying party
+	if err := wa.user.load("a.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if len(wa.user.credentials) != 2 {
+		t.Fatalf("expected 2 credentials, got %d", len(wa.user.credentials))
+	}
+	if _, err := wa.findCredential(c2.CredentialID()); err != nil {
+		t.Errorf("credential not found: %v", err)
+	}
+
+	if err := wa.RenameCredential(c2.ID(), "yubikey"); err != nil {
+		t.Fatal(err)
+	}
+	if err := wa.RevokeCredential(c1.ID()); err != nil {
+		t.Fatal(err)
+	}
+	if err := wa.RevokeCredential(c1.ID()); err != ErrCredentialNotFound {
+		t.Errorf("expected ErrCredentialNotFound, got %v", err)
+	}
+
+	creds, err := wa.Credentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(creds) != 2 || creds[0].ID != c2.ID() || creds[0].Name != "yubikey" || creds[1].RPID != "b.example.com" {
+		t.Errorf("unexpected credentials %+v", creds)
+	}
+}
+
+func TestLuaCredentialsScopedToRP(t *testing.T) {
+	conf := &config.Config{DataDir: t.TempDir()}
+	wa, err := New(conf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1 := testCredential("a.example.com", 1)
+	c2 := testCredential("b.example.com", 2)
+	if err := saveAll(conf, []*credential{c1, c2}); err != nil {
+		t.Fatal(err)
+	}
+
+	L := lua.NewState()
+	defer L.Close()
+	wa.SetupLua(L, "https://a.example.com/app", "", nil, nil)
+	call := func(code string) string {
+		if err := L.DoString(`local webauthn = require('webauthn'); return ` + code); err != nil {
+			t.Fatal(err)
+		}
+		defer L.Pop(1)
+		if L.Get(-1) == lua.LNil {
+			return ""
+		}
+		return L.Get(-1).String()
+	}
+
+	// The credentials of b.example.com can neither be renamed, nor revoked from an a.example.com app
+	if err := call(`webauthn.rename_credential("` + c2.ID() + `", "stolen")`); err != ErrCredentialRPMismatch.Error() {
+		t.Errorf("expected a RP mismatch, got %q", err)
+	}
+	if err := call(`webauthn.revoke_credential("` + c2.ID() + `")`); err != ErrCredentialRPMismatch.Error() {
+		t.Errorf("expected a RP mismatch, got %q", err)
+	}
+	if err := call(`webauthn.rename_credential("` + c1.ID() + `", "yubikey")`); err != "" {
+		t.Errorf("failed to rename: %s", err)
+	}
+	if err := call(`webauthn.revoke_credential("` + c1.ID() + `")`); err != "" {
+		t.Errorf("failed to revoke: %s", err)
+	}
+
+	creds, err := wa.Credentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(creds) != 1 || creds[0].ID != c2.ID() || creds[0].Name != "" {
+		t.Errorf("unexpected credentials %+v", creds)
+	}
+}
+
+func TestParseUserVerification(t *testing.T) {
+	for uv, expected := range map[string]warp.UserVerificationRequirement{
+		"":            warp.VerificationPreferred,
+		"required":    warp.VerificationRequired,
+		"discouraged": warp.VerificationDiscouraged,
+	} {
+		if got, err := ParseUserVerification(uv); err != nil || got != expected {
+			t.Errorf("ParseUserVerification(%q) = %q, %v", uv, got, err)
+		}
+	}
+	if _, err := ParseUserVerification("always"); err == nil {
+		t.Errorf("invalid requirement should fail")
+	}
+}
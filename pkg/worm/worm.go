@@ -0,0 +1,101 @@
+/*
+Package worm implements the write-once (WORM) retention policies.
+
+A policy applies to the namespaces and/or the FS matching its glob patterns: the data written in the last `retention`
+can't be deleted or overwritten. A namespace can't be destroyed (or garbage collected) until `retention` has elapsed
+since its last write, and the nodes of a FS can only be deleted/overwritten if they were already present (unchanged)
+`retention` ago.
+*/
+package worm // import "a4.io/blobstash/pkg/worm"
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+
+	"a4.io/blobstash/pkg/clock"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/httputil"
+)
+
+// ErrProtected is returned (wrapped in a 403 API error) when deleting or overwriting data under retention
+var ErrProtected = errors.New("protected by a WORM retention policy")
+
+type policy struct {
+	namespace string
+	fs        string
+	retention time.Duration
+}
+
+var (
+	mu       sync.RWMutex
+	policies []*policy
+)
+
+// Setup (re)initializes the policies from the config (it must have been validated by `Config.Init`)
+func Setup(conf []*config.WORM) {
+	var out []*policy
+	for _, p := range conf {
+		retention, err := time.ParseDuration(p.Retention)
+		if err != nil {
+			panic(err)
+		}
+		out = append(out, &policy{
+			namespace: p.Namespace,
+			fs:        p.FS,
+			retention: retention,
+		})
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	policies = out
+}
+
+// retention returns the longest retention of the matching policies (0 if none match)
+func retention(name string, pattern func(*policy) string) time.Duration {
+	mu.RLock()
+	defer mu.RUnlock()
+	var out time.Duration
+	for _, p := range policies {
+		pat := pattern(p)
+		if pat == "" {
+			continue
+		}
+		if ok, _ := path.Match(pat, name); ok && p.retention > out {
+			out = p.retention
+		}
+	}
+	return out
+}
+
+// NamespaceRetention returns the retention of the namespace (0 if the namespace is not protected)
+func NamespaceRetention(ns string) time.Duration {
+	return retention(ns, func(p *policy) string { return p.namespace })
+}
+
+// FSRetention returns the retention of the FS (0 if the FS is not protected)
+func FSRetention(name string) time.Duration {
+	return retention(name, func(p *policy) string { return p.fs })
+}
+
+// Error returns the API error for a delete/overwrite refused until the given time
+func Error(what string, until time.Time) error {
+	apiErr := httputil.Wrap(http.StatusForbidden, fmt.Errorf("%s is %w until %s", what, ErrProtected, until.UTC().Format(time.RFC3339)))
+	apiErr.Code = "worm_protected"
+	return apiErr
+}
+
+// CheckNamespace returns an error if the namespace can't be destroyed yet
+func CheckNamespace(ns string, lastWrite time.Time) error {
+	r := NamespaceRetention(ns)
+	if r == 0 {
+		return nil
+	}
+	if until := lastWrite.Add(r); clock.Now().Before(until) {
+		return Error(fmt.Sprintf("namespace %q", ns), until)
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package worm
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"a4.io/blobstash/pkg/clock"
+	"a4.io/blobstash/pkg/config"
+)
+
+func TestRetention(t *testing.T) {
+	Setup([]*config.WORM{
+		{Namespace: "backup-*", Retention: "24h"},
+		{Namespace: "backup-db", FS: "photos", Retention: "48h"},
+	})
+	defer Setup(nil)
+
+	for _, tc := range []struct {
+		ns, fs      string
+		nsRetention time.Duration
+		fsRetention time.Duration
+	}{
+		{"backup-1", "", 24 * time.Hour, 0},
+		{"backup-db", "photos", 48 * time.Hour, 48 * time.Hour},
+		{"other", "backup-1", 0, 0},
+	} {
+		if r := NamespaceRetention(tc.ns); r != tc.nsRetention {
+			t.Errorf("namespace %q: expected %v, got %v", tc.ns, tc.nsRetention, r)
+		}
+		if r := FSRetention(tc.fs); r != tc.fsRetention {
+			t.Errorf("FS %q: expected %v, got %v", tc.fs, tc.fsRetention, r)
+		}
+	}
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock.Set(clock.NewFake(now))
+	defer clock.Set(nil)
+	if err := CheckNamespace("backup-1", now.Add(-23*time.Hour)); !errors.Is(err, ErrProtected) {
+		t.Errorf("expected ErrProtected, got %v", err)
+	}
+	if err := CheckNamespace("backup-1", now.Add(-25*time.Hour)); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+	if err := CheckNamespace("other", now); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// signingKeygenCmd implements `blobstash signing-keygen <key file>`, it generates an Ed25519 key for the `signing`
+// config (the file contains the hex-encoded seed) and outputs the public key (to add in the `trusted_keys` of the
+// other instances).
+func signingKeygenCmd(args []string) error {
+	fs := flag.NewFlagSet("signing-keygen", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: blobstash signing-keygen <key file>")
+	}
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(fs.Arg(0), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(hex.EncodeToString(priv.Seed()) + "\n"); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fmt.Println(hex.EncodeToString(pub))
+	return nil
+}